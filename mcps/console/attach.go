@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	kvcorev1 "kubevirt.io/client-go/kubevirt/typed/core/v1"
+)
+
+// Attach connects in and out to the serial console of the VMI without
+// logging in, passing bytes through unchanged, until in is closed or the
+// console disconnects. It lets callers drive interactive programs. Only
+// connecting is bounded by the deadline, the session lasts as long as in.
+func (ve *VMExec) Attach(in io.Reader, out io.Writer) error {
+	ctx, cancel := ve.withDeadline(context.Background(), ve.runDeadline(0))
+	defer cancel()
+	vmi, err := ve.getRunningVMI(ctx)
+	if err != nil {
+		return err
+	}
+
+	ve.reportProgress("connecting to console")
+	con, err := ve.client.VirtualMachineInstance(vmi.Namespace).SerialConsole(vmi.Name, &kvcorev1.SerialConsoleOptions{ConnectionTimeout: ve.connectTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to connect to console: %v", err)
+	}
+
+	inReader, inWriter := io.Pipe()
+	go func() {
+		_, err := io.Copy(inWriter, in)
+		inWriter.CloseWithError(err)
+	}()
+
+	ve.reportProgress("attached")
+	if err := con.Stream(kvcorev1.StreamOptions{In: inReader, Out: out}); err != nil && err != io.EOF {
+		return fmt.Errorf("console stream failed: %v", err)
+	}
+	return nil
+}
@@ -15,11 +15,11 @@ fi
 
 # Build the binary
 echo "Compiling vm-exec..."
-go build -o vm-exec vm-exec.go
+go build -o vm-exec .
 
 echo "Build complete! Binary: $(pwd)/vm-exec"
 echo ""
 echo "Usage examples:"
 echo "  ./vm-exec -n default -v vmi1 -c 'uname -a'"
-echo "  ./vm-exec -n default -v vmi2 -c 'ls -la' --method ssh"
+echo "  ./vm-exec -n default -v vmi2 -c 'ls -la' --method agent"
 echo "  ./vm-exec -n default -v vmi1 -c 'whoami' --verbose"
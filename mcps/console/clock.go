@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// Clock is the time source of the console capture and guest agent polling,
+// replaced in tests so they do not wait in real time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock is the Clock used by vm-exec
+var clock Clock = realClock{}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	v1 "kubevirt.io/api/core/v1"
+	kvcorev1 "kubevirt.io/client-go/kubevirt/typed/core/v1"
+)
+
+// ansiEscapeRegex matches terminal escape sequences emitted by guest consoles
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[()][0-9A-B]`)
+
+// ReadConsole attaches to the serial console without sending any input and
+// returns the last lines printed during the capture window. The serial
+// console has no backlog, so only output produced while attached is seen.
+func (ve *VMExec) ReadConsole(duration time.Duration, lines int) (string, error) {
+	deadline := ve.deadline
+	if deadline == 0 {
+		deadline = ve.runDeadline(0) + duration
+	}
+	ctx, cancel := ve.withDeadline(context.Background(), deadline)
+	defer cancel()
+
+	vmi, err := ve.client.VirtualMachineInstance(ve.namespace).Get(ctx, ve.vmName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("VMI '%s' not found in namespace '%s': %v", ve.vmName, ve.namespace, err)
+	}
+	if vmi.Status.Phase != v1.Running {
+		return "", fmt.Errorf("VMI '%s' is not running (phase: %s)", ve.vmName, vmi.Status.Phase)
+	}
+
+	con, err := ve.client.VirtualMachineInstance(ve.namespace).SerialConsole(ve.vmName, &kvcorev1.SerialConsoleOptions{ConnectionTimeout: remaining(ctx, ve.connectTimeout)})
+	if err != nil {
+		return "", deadlineError(ctx, deadline, fmt.Errorf("failed to connect to console: %v", err))
+	}
+
+	// The input side is never written to, keeping the session read-only
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	defer inWriter.Close()
+
+	go func() {
+		err := con.Stream(kvcorev1.StreamOptions{In: inReader, Out: outWriter})
+		outWriter.CloseWithError(err)
+	}()
+
+	var mu sync.Mutex
+	var captured bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := outReader.Read(buf)
+			mu.Lock()
+			captured.Write(buf[:n])
+			mu.Unlock()
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	if ve.verbose {
+		fmt.Printf("Capturing console output for %v...\n", duration)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("console stream failed: %v", err)
+		}
+	case <-clock.After(duration):
+	case <-ctx.Done():
+		outReader.Close()
+		return "", fmt.Errorf("did not finish within the deadline of %v", deadline)
+	}
+	outReader.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return lastConsoleLines(captured.String(), lines), nil
+}
+
+// lastConsoleLines normalizes console output (line endings, escape
+// sequences) and keeps at most the last n lines
+func lastConsoleLines(output string, n int) string {
+	output = ansiEscapeRegex.ReplaceAllString(output, "")
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	output = strings.ReplaceAll(output, "\r", "\n")
+
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestLastConsoleLines(t *testing.T) {
+	tests := []struct {
+		output string
+		n      int
+		want   string
+	}{
+		{"a\r\nb\r\nc\r\n", 2, "b\nc\n"},
+		{"a\r\nb\r\nc", 0, "a\nb\nc\n"},
+		{"\x1b[1;32mOK\x1b[0m Started\r\n\x1b(Blogin: ", 0, "OK Started\nlogin: \n"},
+		{"a\rb", 5, "a\nb\n"},
+		{"a\n\nb\n", 0, "a\n\nb\n"},
+		{"\r\n\r\n", 1, ""},
+		{"", 3, ""},
+	}
+	for _, tt := range tests {
+		if got := lastConsoleLines(tt.output, tt.n); got != tt.want {
+			t.Errorf("lastConsoleLines(%q, %d) = %q, want %q", tt.output, tt.n, got, tt.want)
+		}
+	}
+}
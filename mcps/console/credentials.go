@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+
+	v1 "kubevirt.io/api/core/v1"
+)
+
+// CredentialsSecretAnnotation names a Secret in the VM namespace holding the
+// console login credentials under the "username" and "password" keys (the
+// layout of kubernetes.io/basic-auth Secrets). It is read from the VMI and
+// then from the owning VM.
+const CredentialsSecretAnnotation = "kubevirt-mcp/credentials-secret"
+
+// PasswordEnvVar can carry the password instead of --password, which would
+// otherwise be visible in the process list
+const PasswordEnvVar = "VM_EXEC_PASSWORD"
+
+// Credentials are the username/password used for console login
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialsFile is the --credentials-file format. The first entry whose
+// match fields all apply to the VMI wins; empty match fields match anything.
+//
+//	credentials:
+//	- match:
+//	    namespace: default
+//	    name: vmi1
+//	  username: admin
+//	  password: secret
+//	- match:
+//	    labels:
+//	      kubevirt.io/os: custom
+//	  username: custom
+//	  password: custom
+type CredentialsFile struct {
+	Credentials []CredentialsEntry `json:"credentials"`
+}
+
+type CredentialsEntry struct {
+	Match struct {
+		Namespace string            `json:"namespace,omitempty"`
+		Name      string            `json:"name,omitempty"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	} `json:"match"`
+	Credentials `json:",inline"`
+}
+
+// resolveCredentials returns the console credentials configured for the VMI,
+// or nil when the built-in login profile should be used. Precedence:
+// --username/--password flags, the Secret referenced by the credentials
+// annotation, then the credentials file.
+func (ve *VMExec) resolveCredentials(ctx context.Context, vmi *v1.VirtualMachineInstance) (*Credentials, error) {
+	if ve.username != "" || ve.password != "" {
+		return &Credentials{Username: ve.username, Password: ve.password}, nil
+	}
+
+	secretName := vmi.Annotations[CredentialsSecretAnnotation]
+	if secretName == "" {
+		vm, err := ve.client.VirtualMachine(vmi.Namespace).Get(ctx, vmi.Name, metav1.GetOptions{})
+		if err == nil {
+			secretName = vm.Annotations[CredentialsSecretAnnotation]
+		}
+	}
+	if secretName != "" {
+		secret, err := ve.client.CoreV1().Secrets(vmi.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials secret '%s': %v", secretName, err)
+		}
+		return &Credentials{Username: string(secret.Data["username"]), Password: string(secret.Data["password"])}, nil
+	}
+
+	if ve.credentialsFile != "" {
+		return lookupCredentialsFile(ve.credentialsFile, vmi)
+	}
+
+	return nil, nil
+}
+
+// lookupCredentialsFile returns the first credentials file entry matching the VMI
+func lookupCredentialsFile(path string, vmi *v1.VirtualMachineInstance) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+
+	var file CredentialsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %v", err)
+	}
+
+	for _, entry := range file.Credentials {
+		if entry.Match.Namespace != "" && entry.Match.Namespace != vmi.Namespace {
+			continue
+		}
+		if entry.Match.Name != "" && entry.Match.Name != vmi.Name {
+			continue
+		}
+		if !labels.SelectorFromSet(entry.Match.Labels).Matches(labels.Set(vmi.Labels)) {
+			continue
+		}
+		credentials := entry.Credentials
+		return &credentials, nil
+	}
+
+	return nil, nil
+}
+
+// withCredentials returns the profile with its credentials replaced. The
+// profile prompt regex embeds the default user name, so a custom user falls
+// back to the generic prompt expression.
+func (p loginProfile) withCredentials(credentials *Credentials) loginProfile {
+	if credentials.Username != "" && credentials.Username != p.username {
+		p.username = credentials.Username
+		p.loggedInPrompt = PromptExpression
+		p.becomeRoot = p.becomeRoot && credentials.Username != "root"
+	}
+	if credentials.Password != "" {
+		p.password = credentials.Password
+	}
+	return p
+}
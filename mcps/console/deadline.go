@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// DeadlineSlack is added to the default deadline for the API calls
+	// around the console, SSH and guest agent operations
+	DeadlineSlack = 15 * time.Second
+
+	// WatchdogGrace is how long after the deadline vm-exec exits even when
+	// an operation ignores the cancellation
+	WatchdogGrace = 5 * time.Second
+)
+
+// runDeadline returns the overall deadline of a run of steps commands or
+// transfer steps: --deadline when set, otherwise connecting, logging in and
+// every step within its timeout
+func (ve *VMExec) runDeadline(steps int) time.Duration {
+	if ve.deadline > 0 {
+		return ve.deadline
+	}
+	return ve.connectTimeout + ve.loginTimeout + time.Duration(steps)*ve.timeout + DeadlineSlack
+}
+
+// withDeadline returns a context cancelled once the deadline passed
+func (ve *VMExec) withDeadline(parent context.Context, deadline time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(parent, clock.Now().Add(deadline))
+}
+
+// remaining bounds a timeout by the deadline of ctx, so expect calls, which
+// only take a timeout, give up when the deadline passes
+func remaining(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	left := deadline.Sub(clock.Now())
+	if left < timeout {
+		// A zero timeout means the expect default
+		return max(left, time.Millisecond)
+	}
+	return timeout
+}
+
+// deadlineError explains err when it was caused by the deadline of ctx
+func deadlineError(ctx context.Context, deadline time.Duration, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("did not finish within the deadline of %v: %v", deadline, err)
+	}
+	return err
+}
+
+// startWatchdog exits vm-exec shortly after the deadline, the last resort
+// when the console or the API server stops answering in a way the context
+// does not interrupt
+func startWatchdog(deadline time.Duration) {
+	go func() {
+		<-clock.After(deadline + WatchdogGrace)
+		fmt.Fprintf(os.Stderr, "Error: vm-exec did not finish within the deadline of %v\n", deadline)
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	expect "github.com/google/goexpect"
+	corev1 "k8s.io/api/core/v1"
+
+	v1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// MaxTransferSize caps --put-file and --get-file, which are meant for
+	// config files and logs rather than disk images
+	MaxTransferSize = 1 << 20
+
+	// agentChunkSize is the number of bytes moved per guest-file-read/write
+	agentChunkSize = 48 * 1024
+
+	// consoleLineSize keeps each base64 line sent over the console, plus the
+	// secondary prompt, within an 80 column terminal
+	consoleLineSize = 76
+
+	heredocDelimiter = "VMEXEC_EOF"
+
+	// transferSteps is the number of --timeout periods in the default
+	// deadline of a file transfer, large files over the console need
+	// --deadline
+	transferSteps = 4
+)
+
+// fileModeRegex validates --file-mode
+var fileModeRegex = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// secondaryPromptRegex matches the shell's PS2 prompt printed inside a heredoc
+var secondaryPromptRegex = regexp.MustCompile(`\n> `)
+
+// transferFile runs the --put-file or --get-file request between --local-file
+// and the guest
+func transferFile(ve *VMExec) error {
+	if putFile != "" {
+		var data []byte
+		var err error
+		if localFile == "-" {
+			data, err = io.ReadAll(io.LimitReader(os.Stdin, MaxTransferSize+1))
+		} else {
+			data, err = os.ReadFile(localFile)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read local file: %v", err)
+		}
+		return ve.PutFile(data, putFile, fileMode)
+	}
+
+	data, err := ve.GetFile(getFile)
+	if err != nil {
+		return err
+	}
+	if localFile == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(localFile, data, 0600)
+}
+
+// PutFile writes data to path inside the guest, then applies mode if set
+func (ve *VMExec) PutFile(data []byte, path, mode string) error {
+	if len(data) > MaxTransferSize {
+		return fmt.Errorf("file is %d bytes, larger than the %d bytes limit", len(data), MaxTransferSize)
+	}
+
+	deadline := ve.runDeadline(transferSteps)
+	ctx, cancel := ve.withDeadline(context.Background(), deadline)
+	defer cancel()
+	return deadlineError(ctx, deadline, ve.putFile(ctx, data, path, mode))
+}
+
+// putFile writes the file of PutFile
+func (ve *VMExec) putFile(ctx context.Context, data []byte, path, mode string) error {
+	vmi, err := ve.getRunningVMI(ctx)
+	if err != nil {
+		return err
+	}
+
+	useAgent, err := ve.useGuestAgent(vmi)
+	if err != nil {
+		return err
+	}
+	if mode != "" && ve.getVMIType(vmi) == vmTypeWindows {
+		return fmt.Errorf("--file-mode does not apply to Windows guests")
+	}
+	ve.reportProgress("writing %d bytes to %s", len(data), path)
+	if useAgent {
+		return ve.putFileViaGuestAgent(ctx, vmi, data, path, mode)
+	}
+	return ve.putFileViaConsole(ctx, vmi, data, path, mode)
+}
+
+// GetFile returns the content of path inside the guest
+func (ve *VMExec) GetFile(path string) ([]byte, error) {
+	deadline := ve.runDeadline(transferSteps)
+	ctx, cancel := ve.withDeadline(context.Background(), deadline)
+	defer cancel()
+	data, err := ve.getFile(ctx, path)
+	return data, deadlineError(ctx, deadline, err)
+}
+
+// getFile reads the file of GetFile
+func (ve *VMExec) getFile(ctx context.Context, path string) ([]byte, error) {
+	vmi, err := ve.getRunningVMI(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	useAgent, err := ve.useGuestAgent(vmi)
+	if err != nil {
+		return nil, err
+	}
+	ve.reportProgress("reading %s", path)
+	if useAgent {
+		return ve.getFileViaGuestAgent(ctx, vmi, path)
+	}
+	return ve.getFileViaConsole(ctx, vmi, path)
+}
+
+// putFileViaGuestAgent writes the file with guest-file-open/write/close
+func (ve *VMExec) putFileViaGuestAgent(ctx context.Context, vmi *v1.VirtualMachineInstance, data []byte, path, mode string) error {
+	ctx, cancel := context.WithTimeout(ctx, ve.timeout)
+	defer cancel()
+
+	pod, err := ve.getLauncherPod(ctx, vmi)
+	if err != nil {
+		return err
+	}
+	domain := libvirtDomain(vmi)
+
+	handle, err := ve.guestFileOpen(ctx, pod, domain, path, "w")
+	if err != nil {
+		return err
+	}
+
+	for offset := 0; offset < len(data); offset += agentChunkSize {
+		end := offset + agentChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		writeCmd := map[string]interface{}{
+			"execute": "guest-file-write",
+			"arguments": map[string]interface{}{
+				"handle":  handle,
+				"buf-b64": base64.StdEncoding.EncodeToString(data[offset:end]),
+			},
+		}
+		if err := ve.guestAgentCommand(ctx, pod, domain, writeCmd, &struct{}{}); err != nil {
+			ve.guestFileClose(ctx, pod, domain, handle)
+			return fmt.Errorf("guest-file-write failed: %v", err)
+		}
+	}
+
+	if err := ve.guestFileClose(ctx, pod, domain, handle); err != nil {
+		return err
+	}
+
+	if mode != "" {
+		output, exitCode, err := ve.guestExec(ctx, pod, domain, chmodCommand(mode, path))
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("chmod failed: %s", strings.TrimSpace(output))
+		}
+	}
+	return nil
+}
+
+// getFileViaGuestAgent reads the file with guest-file-open/read/close
+func (ve *VMExec) getFileViaGuestAgent(ctx context.Context, vmi *v1.VirtualMachineInstance, path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ve.timeout)
+	defer cancel()
+
+	pod, err := ve.getLauncherPod(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+	domain := libvirtDomain(vmi)
+
+	handle, err := ve.guestFileOpen(ctx, pod, domain, path, "r")
+	if err != nil {
+		return nil, err
+	}
+	defer ve.guestFileClose(ctx, pod, domain, handle)
+
+	var data []byte
+	for {
+		var read struct {
+			Return struct {
+				Count  int    `json:"count"`
+				BufB64 string `json:"buf-b64"`
+				EOF    bool   `json:"eof"`
+			} `json:"return"`
+		}
+		readCmd := map[string]interface{}{
+			"execute":   "guest-file-read",
+			"arguments": map[string]interface{}{"handle": handle, "count": agentChunkSize},
+		}
+		if err := ve.guestAgentCommand(ctx, pod, domain, readCmd, &read); err != nil {
+			return nil, fmt.Errorf("guest-file-read failed: %v", err)
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(read.Return.BufB64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode file content: %v", err)
+		}
+		data = append(data, chunk...)
+		if len(data) > MaxTransferSize {
+			return nil, fmt.Errorf("file is larger than the %d bytes limit", MaxTransferSize)
+		}
+
+		if read.Return.EOF || read.Return.Count == 0 {
+			return data, nil
+		}
+	}
+}
+
+// guestFileOpen opens a guest file and returns the agent file handle
+func (ve *VMExec) guestFileOpen(ctx context.Context, pod *corev1.Pod, domain, path, mode string) (int, error) {
+	var opened struct {
+		Return int `json:"return"`
+	}
+	openCmd := map[string]interface{}{
+		"execute":   "guest-file-open",
+		"arguments": map[string]interface{}{"path": path, "mode": mode},
+	}
+	if err := ve.guestAgentCommand(ctx, pod, domain, openCmd, &opened); err != nil {
+		return 0, fmt.Errorf("guest-file-open failed: %v", err)
+	}
+	return opened.Return, nil
+}
+
+// guestFileClose closes a guest file handle
+func (ve *VMExec) guestFileClose(ctx context.Context, pod *corev1.Pod, domain string, handle int) error {
+	closeCmd := map[string]interface{}{
+		"execute":   "guest-file-close",
+		"arguments": map[string]interface{}{"handle": handle},
+	}
+	if err := ve.guestAgentCommand(ctx, pod, domain, closeCmd, &struct{}{}); err != nil {
+		return fmt.Errorf("guest-file-close failed: %v", err)
+	}
+	return nil
+}
+
+// putFileViaConsole streams the base64 encoded file into a heredoc decoded
+// by base64 -d, one line at a time so the serial console is not overrun,
+// then checks the resulting file size
+func (ve *VMExec) putFileViaConsole(ctx context.Context, vmi *v1.VirtualMachineInstance, data []byte, path, mode string) error {
+	expecter, err := ve.openConsoleSession(ctx, vmi)
+	if err != nil {
+		return err
+	}
+	defer expecter.Close()
+	stop := context.AfterFunc(ctx, func() { expecter.Close() })
+	defer stop()
+
+	quotedPath := shellQuote(path)
+	lines := []string{fmt.Sprintf("base64 -d > %s <<'%s'", quotedPath, heredocDelimiter)}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for offset := 0; offset < len(encoded); offset += consoleLineSize {
+		end := offset + consoleLineSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		lines = append(lines, encoded[offset:end])
+	}
+
+	for _, line := range lines {
+		if err := expecter.Send(line + "\n"); err != nil {
+			return fmt.Errorf("failed to send file content: %v", err)
+		}
+		if _, _, err := expecter.Expect(secondaryPromptRegex, remaining(ctx, ve.timeout)); err != nil {
+			return fmt.Errorf("console did not accept file content: %v", err)
+		}
+	}
+
+	b := []expect.Batcher{
+		&expect.BSnd{S: heredocDelimiter + "\n"},
+		&expect.BExp{R: PromptExpression},
+	}
+	if _, err := ve.safeExpectBatch(expecter, b, remaining(ctx, ve.timeout)); err != nil {
+		return fmt.Errorf("failed to finish file transfer: %v", err)
+	}
+
+	size, err := ve.consoleFileSize(ctx, expecter, path)
+	if err != nil {
+		return err
+	}
+	if size != len(data) {
+		return fmt.Errorf("file transfer incomplete, wrote %d of %d bytes", size, len(data))
+	}
+
+	if mode != "" {
+		output, exitCode, err := ve.runCommandOnConsole(ctx, expecter, chmodCommand(mode, path))
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return fmt.Errorf("chmod failed: %s", strings.TrimSpace(output))
+		}
+	}
+	return nil
+}
+
+// getFileViaConsole prints the file base64 encoded on the console and decodes it
+func (ve *VMExec) getFileViaConsole(ctx context.Context, vmi *v1.VirtualMachineInstance, path string) ([]byte, error) {
+	expecter, err := ve.openConsoleSession(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+	defer expecter.Close()
+
+	size, err := ve.consoleFileSize(ctx, expecter, path)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxTransferSize {
+		return nil, fmt.Errorf("file is %d bytes, larger than the %d bytes limit", size, MaxTransferSize)
+	}
+
+	output, exitCode, err := ve.runCommandOnConsole(ctx, expecter, "base64 "+shellQuote(path))
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		return nil, fmt.Errorf("failed to read %s: %s", path, strings.TrimSpace(output))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(output), ""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode file content: %v", err)
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("file transfer incomplete, read %d of %d bytes", len(data), size)
+	}
+	return data, nil
+}
+
+// consoleFileSize returns the size of a guest file using wc on the console
+func (ve *VMExec) consoleFileSize(ctx context.Context, expecter expect.Expecter, path string) (int, error) {
+	output, exitCode, err := ve.runCommandOnConsole(ctx, expecter, "wc -c < "+shellQuote(path))
+	if err != nil {
+		return 0, err
+	}
+	if exitCode != 0 {
+		return 0, fmt.Errorf("failed to read %s: %s", path, strings.TrimSpace(output))
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected file size output %q", output)
+	}
+	return size, nil
+}
+
+// chmodCommand returns the shell command applying an octal mode to path
+func chmodCommand(mode, path string) string {
+	return fmt.Sprintf("chmod %s %s", mode, shellQuote(path))
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
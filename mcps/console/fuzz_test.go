@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets run their seeds with go test and are fuzzed with e.g.
+//
+//	go test -run '^$' -fuzz FuzzExtractCommandOutput -fuzztime 1m
+
+func FuzzExtractCommandOutput(f *testing.F) {
+	f.Add("uname -r", "6.8.5-301.fc40.x86_64", "[fedora@fedora ~]$ ")
+	f.Add("true", "", "$ ")
+	f.Add("ls /", "bin\r\ndev\r\netc", "# ")
+	f.Add("cat x", "cat x\r\ncat x", "[root@vm ~]# ")
+	f.Add("", "output", "$ ")
+
+	f.Fuzz(func(t *testing.T, command, output, prompt string) {
+		buffer := command + "\r\n" + output + "\r\n" + prompt
+		if output == "" {
+			buffer = command + "\r\n" + prompt
+		}
+		got := extractCommandOutput(buffer, command)
+
+		// The output is recovered exactly when the buffer has the shape the
+		// console produces: one command line, the output, one prompt line
+		if strings.Contains(command, "\r\n") || strings.Contains(prompt, "\r\n") || !promptLineRegex.MatchString(prompt) {
+			return
+		}
+		if strings.HasSuffix(command, "\r") || strings.HasPrefix(output, "\n") {
+			return
+		}
+		if got != output {
+			t.Fatalf("extractCommandOutput(%q, %q) = %q, want %q", buffer, command, got, output)
+		}
+	})
+}
+
+func FuzzExtractCommandOutputFallback(f *testing.F) {
+	f.Add("[root@vm ~]# ec\rho hi\r\nhi\r\n[root@vm ~]# ", "echo hi")
+	f.Add("garbage", "")
+	f.Add("\r\n\r\n$ ", "x")
+
+	f.Fuzz(func(t *testing.T, buffer, command string) {
+		// Arbitrary buffers, e.g. with the command echo wrapped by the
+		// terminal, must not crash the extraction
+		extractCommandOutput(buffer, command)
+	})
+}
+
+func FuzzParseExitCode(f *testing.F) {
+	f.Add("echo $?\r\n0\r\n$ ")
+	f.Add("echo $?\r\n127\r\n[root@vm ~]# ")
+	f.Add("echo $?\r\n99999999999999999999\r\n$ ")
+	f.Add("echo $?\r\n-1\r\n$ ")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, buffer string) {
+		if code := parseExitCode(buffer); code < 0 || code > 255 {
+			t.Fatalf("parseExitCode(%q) = %d, not an exit code", buffer, code)
+		}
+	})
+}
+
+func FuzzParseExitCodeRoundTrip(f *testing.F) {
+	f.Add(uint8(0), "$ ")
+	f.Add(uint8(1), "[root@vm ~]# ")
+
+	f.Fuzz(func(t *testing.T, code uint8, prompt string) {
+		buffer := "echo $?\r\n" + strconv.Itoa(int(code)) + "\r\n" + prompt
+		if got := parseExitCode(buffer); got != int(code) {
+			t.Fatalf("parseExitCode(%q) = %d, want %d", buffer, got, code)
+		}
+	})
+}
+
+func FuzzLastConsoleLines(f *testing.F) {
+	f.Add("login: \x1b[0mroot\r\nPassword: \r\n$ ", 2)
+	f.Add("a\rb\r\nc\n", 0)
+	f.Add("", 5)
+
+	f.Fuzz(func(t *testing.T, output string, n int) {
+		got := lastConsoleLines(output, n)
+		if strings.Contains(got, "\r") {
+			t.Fatalf("lastConsoleLines(%q, %d) = %q keeps carriage returns", output, n, got)
+		}
+		if got != "" && !strings.HasSuffix(got, "\n") {
+			t.Fatalf("lastConsoleLines(%q, %d) = %q does not end with a newline", output, n, got)
+		}
+		if lines := strings.Count(got, "\n"); n > 0 && lines > n {
+			t.Fatalf("lastConsoleLines(%q, %d) returned %d lines", output, n, lines)
+		}
+	})
+}
+
+func FuzzDecodeGuestExecOutput(f *testing.F) {
+	f.Add(base64.StdEncoding.EncodeToString([]byte("out")), base64.StdEncoding.EncodeToString([]byte("err")), 1, 0)
+	f.Add("not base64", "", 0, 9)
+
+	f.Fuzz(func(t *testing.T, outData, errData string, exitCode, signal int) {
+		output, code, err := decodeGuestExecOutput(guestExecResult{OutData: outData, ErrData: errData, ExitCode: exitCode, Signal: signal})
+		if err != nil {
+			return
+		}
+		stdout, _ := base64.StdEncoding.DecodeString(outData)
+		if !strings.HasPrefix(output, string(stdout)) {
+			t.Fatalf("output %q does not start with stdout %q", output, stdout)
+		}
+		if signal == 0 && code != exitCode {
+			t.Fatalf("exit code %d, want %d", code, exitCode)
+		}
+	})
+}
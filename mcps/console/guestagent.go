@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+
+	v1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// launcherComputeContainer is the virt-launcher container running libvirt
+	launcherComputeContainer = "compute"
+
+	// guestExecPollInterval is how often guest-exec-status is polled
+	guestExecPollInterval = 250 * time.Millisecond
+)
+
+// guestExecResult mirrors the reply of the qemu-guest-agent guest-exec-status command
+type guestExecResult struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+// hasGuestAgent reports whether the qemu-guest-agent inside the VMI is connected
+func hasGuestAgent(vmi *v1.VirtualMachineInstance) bool {
+	for _, cond := range vmi.Status.Conditions {
+		if cond.Type == v1.VirtualMachineInstanceAgentConnected && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// guestAgentSession runs the commands through the qemu-guest-agent using
+// guest-exec, issued with virsh inside the virt-launcher compute container.
+// Unlike the console flow it needs no login and returns the real exit code.
+func (ve *VMExec) guestAgentSession(ctx context.Context, vmi *v1.VirtualMachineInstance) (*session, error) {
+	pod, err := ve.getLauncherPod(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+
+	if ve.verbose {
+		fmt.Printf("Executing via guest agent in pod %s\n", pod.Name)
+	}
+
+	domain := libvirtDomain(vmi)
+	// Windows commands run in the --shell, with their stderr kept apart
+	windows := ve.getVMIType(vmi) == vmTypeWindows
+	return &session{
+		via: "guest agent",
+		run: func(ctx context.Context, command string) (string, string, int, error) {
+			if windows {
+				path, args := windowsShellCommand(ve.shell, ve.cwd, command)
+				return ve.guestExecStreams(ctx, pod, domain, path, args)
+			}
+			// guest-exec sets the --env variables itself
+			command = ve.withRunContext(command, false)
+			if ve.separateStderr {
+				return ve.guestShellExec(ctx, pod, domain, command)
+			}
+			output, exitCode, err := ve.guestExec(ctx, pod, domain, command)
+			return output, "", exitCode, err
+		},
+		close: func() {},
+	}, nil
+}
+
+// libvirtDomain returns the name of the libvirt domain backing the VMI
+func libvirtDomain(vmi *v1.VirtualMachineInstance) string {
+	return fmt.Sprintf("%s_%s", vmi.Namespace, vmi.Name)
+}
+
+// guestExec runs a single shell command with guest-exec and waits for it to
+// finish, returning its stdout and stderr combined
+func (ve *VMExec) guestExec(ctx context.Context, pod *corev1.Pod, domain, command string) (string, int, error) {
+	stdout, stderr, exitCode, err := ve.guestShellExec(ctx, pod, domain, command)
+	return stdout + stderr, exitCode, err
+}
+
+// guestShellExec runs a single shell command with guest-exec and waits for
+// it to finish, returning its stdout and stderr apart
+func (ve *VMExec) guestShellExec(ctx context.Context, pod *corev1.Pod, domain, command string) (string, string, int, error) {
+	// Every guest-exec starts a new shell, so the locale is set per command
+	if ve.normalizeLocale {
+		command = "export " + NormalizedLocale + "; " + command
+	}
+	return ve.guestExecStreams(ctx, pod, domain, "/bin/sh", []string{"-c", command})
+}
+
+// guestExecStreams runs the program at path with guest-exec and waits for it
+// to finish, returning its stdout and stderr apart
+func (ve *VMExec) guestExecStreams(ctx context.Context, pod *corev1.Pod, domain, path string, args []string) (string, string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, ve.timeout)
+	defer cancel()
+
+	var started struct {
+		Return struct {
+			PID int `json:"pid"`
+		} `json:"return"`
+	}
+	arguments := map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}
+	if len(ve.env) > 0 {
+		arguments["env"] = ve.env
+	}
+	execCmd := map[string]interface{}{
+		"execute":   "guest-exec",
+		"arguments": arguments,
+	}
+	if err := ve.guestAgentCommand(ctx, pod, domain, execCmd, &started); err != nil {
+		return "", "", 1, fmt.Errorf("guest-exec failed: %v", err)
+	}
+
+	statusCmd := map[string]interface{}{
+		"execute":   "guest-exec-status",
+		"arguments": map[string]interface{}{"pid": started.Return.PID},
+	}
+	for {
+		var status struct {
+			Return guestExecResult `json:"return"`
+		}
+		if err := ve.guestAgentCommand(ctx, pod, domain, statusCmd, &status); err != nil {
+			return "", "", 1, fmt.Errorf("guest-exec-status failed: %v", err)
+		}
+
+		if status.Return.Exited {
+			return decodeGuestExecStreams(status.Return)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", "", 1, fmt.Errorf("command did not finish within %v", ve.timeout)
+		case <-clock.After(guestExecPollInterval):
+		}
+	}
+}
+
+// decodeGuestExecOutput combines the base64 encoded stdout and stderr of a
+// finished guest-exec into a single output, like the console would show it
+func decodeGuestExecOutput(result guestExecResult) (string, int, error) {
+	stdout, stderr, exitCode, err := decodeGuestExecStreams(result)
+	return stdout + stderr, exitCode, err
+}
+
+// decodeGuestExecStreams decodes the base64 encoded stdout and stderr of a
+// finished guest-exec
+func decodeGuestExecStreams(result guestExecResult) (string, string, int, error) {
+	stdout, err := base64.StdEncoding.DecodeString(result.OutData)
+	if err != nil {
+		return "", "", 1, fmt.Errorf("failed to decode command output: %v", err)
+	}
+	stderr, err := base64.StdEncoding.DecodeString(result.ErrData)
+	if err != nil {
+		return "", "", 1, fmt.Errorf("failed to decode command error output: %v", err)
+	}
+
+	exitCode := result.ExitCode
+	if result.Signal != 0 {
+		// Follow the shell convention for processes killed by a signal
+		exitCode = 128 + result.Signal
+	}
+
+	return string(stdout), string(stderr), exitCode, nil
+}
+
+// guestAgentCommand sends a QMP guest agent command to the domain and decodes the reply
+func (ve *VMExec) guestAgentCommand(ctx context.Context, pod *corev1.Pod, domain string, agentCmd interface{}, reply interface{}) error {
+	payload, err := json.Marshal(agentCmd)
+	if err != nil {
+		return err
+	}
+
+	stdout, err := ve.execInPod(ctx, pod, launcherComputeContainer, []string{"virsh", "qemu-agent-command", domain, string(payload)})
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdout)), reply); err != nil {
+		return fmt.Errorf("unexpected guest agent reply %q: %v", stdout, err)
+	}
+	return nil
+}
+
+// getLauncherPod returns the running virt-launcher pod of the VMI
+func (ve *VMExec) getLauncherPod(ctx context.Context, vmi *v1.VirtualMachineInstance) (*corev1.Pod, error) {
+	pods, err := ve.client.CoreV1().Pods(vmi.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", v1.CreatedByLabel, vmi.UID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list virt-launcher pods: %v", err)
+	}
+
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no running virt-launcher pod found for VMI '%s'", vmi.Name)
+}
+
+// execInPod runs a command in a pod container and returns its stdout
+func (ve *VMExec) execInPod(ctx context.Context, pod *corev1.Pod, container string, command []string) (string, error) {
+	req := ve.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod.Name).
+		Namespace(pod.Namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(ve.client.Config(), "POST", req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeGuestExecStreams(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name           string
+		result         guestExecResult
+		stdout, stderr string
+		exitCode       int
+		err            bool
+	}{
+		{"output", guestExecResult{Exited: true, OutData: encode("out\n"), ErrData: encode("err\n"), ExitCode: 3}, "out\n", "err\n", 3, false},
+		{"no output", guestExecResult{Exited: true}, "", "", 0, false},
+		{"killed by a signal", guestExecResult{Exited: true, OutData: encode("partial"), Signal: 9}, "partial", "", 137, false},
+		{"invalid stdout", guestExecResult{OutData: "not base64"}, "", "", 1, true},
+		{"invalid stderr", guestExecResult{OutData: encode("out"), ErrData: "%%%"}, "", "", 1, true},
+	}
+	for _, tt := range tests {
+		stdout, stderr, exitCode, err := decodeGuestExecStreams(tt.result)
+		if stdout != tt.stdout || stderr != tt.stderr || exitCode != tt.exitCode || (err != nil) != tt.err {
+			t.Errorf("%s: decodeGuestExecStreams() = %q, %q, %d, %v", tt.name, stdout, stderr, exitCode, err)
+		}
+	}
+
+	output, _, _ := decodeGuestExecOutput(tests[0].result)
+	if output != "out\nerr\n" {
+		t.Errorf("decodeGuestExecOutput() = %q, want stdout followed by stderr", output)
+	}
+}
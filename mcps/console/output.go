@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	expect "github.com/google/goexpect"
+)
+
+// Files keeping the output of a console command with --separate-stderr or
+// --max-output until it is read back, one pair per guest shell
+const (
+	consoleOutputFile = "/tmp/.vm-exec-output.$$"
+	consoleStderrFile = "/tmp/.vm-exec-stderr.$$"
+)
+
+// outputRedirect wraps command in a group redirecting its output to the
+// console output files, keeping cd and exports in the session shell. stderr
+// goes to its own file when separate is set.
+func outputRedirect(command string, separate bool) string {
+	command = strings.TrimRight(command, " \t;")
+	if !strings.HasSuffix(command, "&") {
+		command += ";"
+	}
+	stderr := "2>&1"
+	if separate {
+		stderr = "2>" + consoleStderrFile
+	}
+	return "{ " + command + " } >" + consoleOutputFile + " " + stderr
+}
+
+// runCommandOnConsoleRedirected runs a command on the console with its
+// output redirected to files in the guest, then reads the files back. With
+// --max-output only its first bytes are read, so a command printing
+// megabytes does not flood the console and the expect buffer.
+func (ve *VMExec) runCommandOnConsoleRedirected(ctx context.Context, expecter expect.Expecter, command string) (string, string, int, error) {
+	_, exitCode, err := ve.runCommandOnConsole(ctx, expecter, outputRedirect(command, ve.separateStderr))
+	if err != nil {
+		return "", "", exitCode, err
+	}
+	stdout, err := ve.readConsoleOutputFile(ctx, expecter, consoleOutputFile)
+	if err != nil {
+		return "", "", exitCode, fmt.Errorf("failed to read the output of the command: %v", err)
+	}
+	var stderr string
+	if ve.separateStderr {
+		if stderr, err = ve.readConsoleOutputFile(ctx, expecter, consoleStderrFile); err != nil {
+			return "", "", exitCode, fmt.Errorf("failed to read the stderr of the command: %v", err)
+		}
+	}
+	if _, _, err := ve.runCommandOnConsole(ctx, expecter, "rm -f "+consoleOutputFile+" "+consoleStderrFile); err != nil {
+		return "", "", exitCode, err
+	}
+	return stdout, stderr, exitCode, nil
+}
+
+// readConsoleOutputFile prints a console output file, one byte beyond
+// --max-output so limitOutput sees it was cut
+func (ve *VMExec) readConsoleOutputFile(ctx context.Context, expecter expect.Expecter, path string) (string, error) {
+	command := "cat " + path + " 2>/dev/null"
+	if ve.maxOutput > 0 {
+		command = "head -c " + strconv.Itoa(ve.maxOutput+1) + " " + path + " 2>/dev/null"
+	}
+	output, _, err := ve.runCommandOnConsole(ctx, expecter, command)
+	return output, err
+}
+
+// limitOutput cuts output to --max-output bytes, on a character boundary,
+// and marks where it was cut
+func (ve *VMExec) limitOutput(output string) (string, bool) {
+	if ve.maxOutput <= 0 || len(output) <= ve.maxOutput {
+		return output, false
+	}
+	cut := ve.maxOutput
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut--
+	}
+	return output[:cut] + fmt.Sprintf("\n... vm-exec: output truncated at %d bytes ...\n", ve.maxOutput), true
+}
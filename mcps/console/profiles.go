@@ -0,0 +1,94 @@
+package main
+
+import "strings"
+
+// loginProfile describes how to log in to a cloud image over the console
+type loginProfile struct {
+	username string
+	password string
+	// loggedInPrompt matches the shell prompt of the user or of root
+	loggedInPrompt string
+	// becomeRoot runs "sudo su" after login
+	becomeRoot bool
+}
+
+// loginProfiles holds the password based login profiles, keyed by VM type.
+// CirrOS and Alpine have dedicated login functions since their console
+// flow differs. Cloud images other than Fedora ship without a password, the
+// credentials below are expected to be set through cloud-init.
+var loginProfiles = map[string]loginProfile{
+	"fedora": {
+		username:       "fedora",
+		password:       "fedora",
+		loggedInPrompt: `(\[fedora@[^\s\]]+\s+~\]\$ |\[root@[^\s\]]+\s+[^\]]*\]\# )`,
+		becomeRoot:     true,
+	},
+	"ubuntu": {
+		username:       "ubuntu",
+		password:       "ubuntu",
+		loggedInPrompt: `(ubuntu@[^\s:]+:~\$ |root@[^\s:]+:[^#]*\# )`,
+		becomeRoot:     true,
+	},
+	"debian": {
+		username:       "debian",
+		password:       "debian",
+		loggedInPrompt: `(debian@[^\s:]+:~\$ |root@[^\s:]+:[^#]*\# )`,
+		becomeRoot:     true,
+	},
+	"centos": {
+		username:       "cloud-user",
+		password:       "cloud-user",
+		loggedInPrompt: `(\[cloud-user@[^\s\]]+\s+~\]\$ |\[root@[^\s\]]+\s+[^\]]*\]\# )`,
+		becomeRoot:     true,
+	},
+	"rhel": {
+		username:       "cloud-user",
+		password:       "cloud-user",
+		loggedInPrompt: `(\[cloud-user@[^\s\]]+\s+~\]\$ |\[root@[^\s\]]+\s+[^\]]*\]\# )`,
+		becomeRoot:     true,
+	},
+}
+
+// genericLoginProfile is used when credentials are configured for a VM type
+// without a login profile (custom images, CirrOS, Alpine)
+var genericLoginProfile = loginProfile{
+	loggedInPrompt: PromptExpression,
+}
+
+// osTypeHints maps substrings found in image names, guest agent OS IDs and
+// kubevirt.io/os labels to VM types. Order matters: more specific hints first.
+var osTypeHints = []struct {
+	hint   string
+	vmType string
+}{
+	{"fedora", "fedora"},
+	{"cirros", "cirros"},
+	{"alpine", "alpine"},
+	{"ubuntu", "ubuntu"},
+	{"debian", "debian"},
+	{"centos", "centos"},
+	{"rhel", "rhel"},
+	{"redhat", "rhel"},
+	// The guest agent reports "mswindows", the common templates win10,
+	// win11 and win2k16 to win2k25
+	{"windows", vmTypeWindows},
+	{"win10", vmTypeWindows},
+	{"win11", vmTypeWindows},
+	{"win2k", vmTypeWindows},
+}
+
+// normalizeOSType maps an image name, guest agent OS ID or kubevirt.io/os
+// label value (e.g. "rhel9", "quay.io/containerdisks/ubuntu:22.04") to a VM type
+func normalizeOSType(value string) string {
+	value = strings.ToLower(value)
+	if value == "" {
+		return ""
+	}
+
+	for _, h := range osTypeHints {
+		if strings.Contains(value, h.hint) {
+			return h.vmType
+		}
+	}
+	return ""
+}
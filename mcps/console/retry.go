@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	expect "github.com/google/goexpect"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	v1 "kubevirt.io/api/core/v1"
+)
+
+const (
+	// DefaultConsoleRetries is how many times connecting to the console and
+	// logging in is retried after a dropped stream or a timeout
+	DefaultConsoleRetries = 2
+
+	// DefaultRetryBackoff is the wait before the first retry, doubled for
+	// every further retry up to MaxRetryBackoff
+	DefaultRetryBackoff = 2 * time.Second
+	MaxRetryBackoff     = 30 * time.Second
+)
+
+// errLoginRejected marks a login the guest refused, retrying cannot help
+var errLoginRejected = errors.New("login rejected")
+
+// loginRejectedRegex matches the messages of a refused console login
+var loginRejectedRegex = regexp.MustCompile(`(?i)(login incorrect|authentication failure|permission denied|access denied)`)
+
+// retryableConsoleError reports whether connecting and logging in again may
+// succeed: dropped streams and timeouts are retried, refused logins and
+// missing or forbidden VMIs are not
+func retryableConsoleError(err error) bool {
+	switch {
+	case errors.Is(err, errLoginRejected),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded),
+		apierrors.IsNotFound(err),
+		apierrors.IsForbidden(err),
+		apierrors.IsUnauthorized(err),
+		apierrors.IsBadRequest(err):
+		return false
+	}
+	return true
+}
+
+// retryBackoff returns the wait before the given retry, counted from 1
+func (ve *VMExec) retryBackoff(retry int) time.Duration {
+	backoff := ve.consoleRetryBackoff
+	for i := 1; i < retry && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, MaxRetryBackoff)
+}
+
+// openConsoleWithRetry connects to the console and logs in, retrying with
+// backoff while the attempts fail with retryable errors and the deadline of
+// ctx allows it
+func (ve *VMExec) openConsoleWithRetry(ctx context.Context, vmi *v1.VirtualMachineInstance, vmiType string, credentials *Credentials) (expect.Expecter, error) {
+	attempts := ve.consoleRetries + 1
+	for attempt := 1; ; attempt++ {
+		if ve.verbose {
+			fmt.Printf("Connecting to VM console (attempt %d/%d)...\n", attempt, attempts)
+		}
+		expecter, err := ve.connectAndLogin(ctx, vmi, vmiType, credentials)
+		if err == nil {
+			if ve.verbose {
+				fmt.Printf("Successfully logged in to VM (attempt %d/%d)\n", attempt, attempts)
+			}
+			return expecter, nil
+		}
+		if attempt == attempts || !retryableConsoleError(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				err = fmt.Errorf("%v (after %d attempts)", err, attempt)
+			}
+			return nil, err
+		}
+
+		backoff := ve.retryBackoff(attempt)
+		if ve.verbose {
+			fmt.Printf("Console attempt %d/%d failed: %v, retrying in %v\n", attempt, attempts, err, backoff)
+		}
+		ve.reportProgress("console attempt %d/%d failed, retrying in %v", attempt, attempts, backoff)
+		select {
+		case <-clock.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// connectAndLogin makes one attempt of openConsoleWithRetry
+func (ve *VMExec) connectAndLogin(ctx context.Context, vmi *v1.VirtualMachineInstance, vmiType string, credentials *Credentials) (expect.Expecter, error) {
+	ve.reportProgress("connecting to console")
+	expecter, streamErr, err := ve.newExpecter(ctx, vmi)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to console: %w", err)
+	}
+
+	ve.reportProgress("logging in")
+	if err := ve.loginToVM(ctx, expecter, vmi, vmiType, credentials); err != nil {
+		// Checked before closing, which ends the stream as well
+		closed := streamErr()
+		expecter.Close()
+		if closed != nil && !errors.Is(err, errLoginRejected) {
+			return nil, fmt.Errorf("failed to login to VM: console stream closed: %v", closed)
+		}
+		return nil, fmt.Errorf("failed to login to VM: %w", err)
+	}
+	return expecter, nil
+}
+
+// loginBatch runs a login batch, reporting a refused login as
+// errLoginRejected with the message of the guest
+func loginBatch(expecter expect.Expecter, batch []expect.Batcher, timeout time.Duration) error {
+	res, err := expecter.ExpectBatch(batch, timeout)
+	if err == nil {
+		return nil
+	}
+	for _, r := range res {
+		if match := loginRejectedRegex.FindString(r.Output); match != "" {
+			return fmt.Errorf("%w: %s", errLoginRejected, strings.TrimSpace(match))
+		}
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// envNameRegex matches the variable names accepted by --env
+	envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// runAsRegex matches the user names accepted by --run-as
+	runAsRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+// parseEnv validates the KEY=VALUE assignments of --env
+func parseEnv(assignments []string) ([]string, error) {
+	for _, assignment := range assignments {
+		name, _, ok := strings.Cut(assignment, "=")
+		if !ok || !envNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable '%s', use KEY=VALUE", assignment)
+		}
+	}
+	return assignments, nil
+}
+
+// withRunContext wraps a shell command so it runs with the --env variables,
+// in --cwd and as --run-as. The variables are left to guest-exec unless env
+// is set, sudo would drop them. The command runs in a subshell, so the cd
+// and exports do not stay in a console session.
+func (ve *VMExec) withRunContext(command string, env bool) string {
+	var script []string
+	if ve.cwd != "" {
+		script = append(script, "cd "+shellQuote(ve.cwd)+" || exit 1")
+	}
+	if env || ve.runAs != "" {
+		for _, assignment := range ve.env {
+			name, value, _ := strings.Cut(assignment, "=")
+			script = append(script, "export "+name+"="+shellQuote(value))
+		}
+	}
+	if len(script) == 0 && ve.runAs == "" {
+		return command
+	}
+	script = append(script, command)
+	if ve.runAs != "" {
+		return "sudo -n -u " + shellQuote(ve.runAs) + " -- sh -c " + shellQuote(strings.Join(script, "; "))
+	}
+	return "(" + strings.Join(script, "; ") + ")"
+}
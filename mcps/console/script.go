@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// readScript returns the commands of a --script file, one per line.
+// Blank lines and lines starting with # are skipped.
+func readScript(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open script: %v", err)
+	}
+	defer file.Close()
+
+	var commands []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read script: %v", err)
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("script %s contains no commands", path)
+	}
+
+	return commands, nil
+}
+
+// printResultsJSON prints the per-command results as a JSON array
+func printResultsJSON(results []CommandResult) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(results)
+}
+
+// StructuredResult is the --output json form of a command result
+type StructuredResult struct {
+	Command    string `json:"command,omitempty"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr,omitempty"`
+	ExitCode   int    `json:"exit_code"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	VMType     string `json:"vm_type"`
+}
+
+// printStructuredJSON prints the results for --output json, a single object
+// for one command and an array naming each command for a batch
+func printStructuredJSON(w io.Writer, results []CommandResult, vmType string, batch bool) {
+	structured := make([]StructuredResult, 0, len(results))
+	for _, result := range results {
+		entry := StructuredResult{
+			Stdout:     result.Output,
+			Stderr:     result.Stderr,
+			ExitCode:   result.ExitCode,
+			Truncated:  result.Truncated,
+			DurationMs: result.Duration.Milliseconds(),
+			VMType:     vmType,
+		}
+		if batch {
+			entry.Command = result.Command
+		}
+		structured = append(structured, entry)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if batch {
+		encoder.Encode(structured)
+		return
+	}
+	encoder.Encode(structured[0])
+}
+
+// firstFailure returns the exit code of the first failed command, or 0
+func firstFailure(results []CommandResult) int {
+	for _, result := range results {
+		if result.ExitCode != 0 {
+			return result.ExitCode
+		}
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ServeRequest is a line read from stdin with --serve
+type ServeRequest struct {
+	Commands []string `json:"commands"`
+	// Timeout overrides --timeout for the commands of this request, in seconds
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// ServeResponse is the line written to stdout for each --serve request
+type ServeResponse struct {
+	Results []StructuredResult `json:"results,omitempty"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// Serve logs in once and runs the commands of every request read from in,
+// one JSON request per line, answering each with a JSON line on out. It
+// returns when in is closed, or after answering with an error since the
+// session may no longer be usable. Logging in and every request are bounded
+// by their own deadline.
+func (ve *VMExec) Serve(in io.Reader, out io.Writer) error {
+	encoder := json.NewEncoder(out)
+
+	s, err := ve.openServeSession()
+	if err != nil {
+		encoder.Encode(ServeResponse{Error: err.Error()})
+		return err
+	}
+	defer s.close()
+	ve.reportProgress("serving commands via %s", s.via)
+
+	defaultTimeout := ve.timeout
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), MaxTransferSize)
+	for scanner.Scan() {
+		var request ServeRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			encoder.Encode(ServeResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+			continue
+		}
+
+		ve.timeout = defaultTimeout
+		if request.Timeout > 0 {
+			ve.timeout = time.Duration(request.Timeout) * time.Second
+		}
+		results, err := ve.serveRequest(s, request.Commands)
+		if err != nil {
+			encoder.Encode(ServeResponse{Error: err.Error()})
+			return err
+		}
+
+		response := ServeResponse{Results: []StructuredResult{}}
+		for _, result := range results {
+			response.Results = append(response.Results, StructuredResult{
+				Command:    result.Command,
+				Stdout:     result.Output,
+				Stderr:     result.Stderr,
+				ExitCode:   result.ExitCode,
+				Truncated:  result.Truncated,
+				DurationMs: result.Duration.Milliseconds(),
+				VMType:     ve.vmType,
+			})
+		}
+		if err := encoder.Encode(response); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// openServeSession logs in within the deadline of a run without commands
+func (ve *VMExec) openServeSession() (*session, error) {
+	deadline := ve.runDeadline(0)
+	ctx, cancel := ve.withDeadline(context.Background(), deadline)
+	defer cancel()
+
+	vmi, err := ve.getRunningVMI(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ve.vmType = ve.getVMIType(vmi)
+	s, err := ve.openSession(ctx, vmi)
+	return s, deadlineError(ctx, deadline, err)
+}
+
+// serveRequest runs the commands of a request within --deadline, or the
+// timeout of every command
+func (ve *VMExec) serveRequest(s *session, commands []string) ([]CommandResult, error) {
+	deadline := ve.deadline
+	if deadline == 0 {
+		deadline = time.Duration(len(commands))*ve.timeout + DeadlineSlack
+	}
+	ctx, cancel := ve.withDeadline(context.Background(), deadline)
+	defer cancel()
+
+	results, err := ve.runCommands(ctx, s, commands)
+	return results, deadlineError(ctx, deadline, err)
+}
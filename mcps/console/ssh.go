@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	v1 "kubevirt.io/api/core/v1"
+)
+
+// DefaultSSHPort is the guest port SSH connects to, overridden with --ssh-port
+const DefaultSSHPort = 22
+
+// defaultSSHUsers are the login users of the VM types without a password
+// login profile
+var defaultSSHUsers = map[string]string{
+	"cirros": "cirros",
+	"alpine": "root",
+}
+
+// defaultSSHPasswords are the console passwords of the VM types without a
+// password login profile, tried when no key is given
+var defaultSSHPasswords = map[string]string{
+	"cirros": "gocubsgo",
+}
+
+// sshSession runs the commands over SSH, tunnelled to the guest through the
+// VMI port-forward subresource like virtctl ssh, one SSH session per command
+func (ve *VMExec) sshSession(ctx context.Context, vmi *v1.VirtualMachineInstance) (*session, error) {
+	client, err := ve.dialSSH(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		via: "ssh",
+		run: func(ctx context.Context, command string) (string, string, int, error) {
+			return ve.runSSHCommand(ctx, client, ve.withRunContext(command, true))
+		},
+		close: func() { client.Close() },
+	}, nil
+}
+
+// runSSHCommand runs a single command in a new SSH session. stdout and
+// stderr are combined like the console would show them, unless
+// --separate-stderr keeps stderr apart.
+func (ve *VMExec) runSSHCommand(ctx context.Context, client *ssh.Client, command string) (string, string, int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", 1, fmt.Errorf("failed to open SSH session: %v", err)
+	}
+	defer session.Close()
+
+	// Every session starts a new shell, so the locale is set per command
+	if ve.normalizeLocale {
+		command = "export " + NormalizedLocale + "; " + command
+	}
+
+	type result struct {
+		stdout, stderr []byte
+		err            error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if !ve.separateStderr {
+			output, err := session.CombinedOutput(command)
+			done <- result{stdout: output, err: err}
+			return
+		}
+		var stdout, stderr bytes.Buffer
+		session.Stdout, session.Stderr = &stdout, &stderr
+		err := session.Run(command)
+		done <- result{stdout.Bytes(), stderr.Bytes(), err}
+	}()
+
+	select {
+	case r := <-done:
+		var exitErr *ssh.ExitError
+		switch {
+		case r.err == nil:
+			return string(r.stdout), string(r.stderr), 0, nil
+		case errors.As(r.err, &exitErr):
+			return string(r.stdout), string(r.stderr), exitErr.ExitStatus(), nil
+		default:
+			return "", "", 1, fmt.Errorf("command execution failed: %v", r.err)
+		}
+	case <-clock.After(ve.timeout):
+		return "", "", 1, fmt.Errorf("command did not finish within %v", ve.timeout)
+	case <-ctx.Done():
+		return "", "", 1, fmt.Errorf("command interrupted: %v", ctx.Err())
+	}
+}
+
+// dialSSH connects and authenticates to the SSH server of the guest
+func (ve *VMExec) dialSSH(ctx context.Context, vmi *v1.VirtualMachineInstance) (*ssh.Client, error) {
+	config, err := ve.sshClientConfig(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+
+	ve.reportProgress("connecting to ssh port %d", ve.sshPort)
+	stream, err := ve.client.VirtualMachineInstance(vmi.Namespace).PortForward(vmi.Name, ve.sshPort, "tcp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to forward SSH port %d: %v", ve.sshPort, err)
+	}
+	conn := stream.AsConn()
+
+	// The handshake has no timeout of its own on an established connection
+	conn.SetDeadline(clock.Now().Add(ve.connectTimeout))
+	address := fmt.Sprintf("vmi/%s.%s:%d", vmi.Name, vmi.Namespace, ve.sshPort)
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH login as %s failed: %v", config.User, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if ve.verbose {
+		fmt.Printf("Logged in over SSH as %s\n", config.User)
+	}
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+// sshClientConfig returns the SSH user and authentication for the VMI. The
+// user is --ssh-user, then the console credentials and the VM type default.
+// The key of --ssh-key is offered first, then the console password.
+func (ve *VMExec) sshClientConfig(ctx context.Context, vmi *v1.VirtualMachineInstance) (*ssh.ClientConfig, error) {
+	credentials, err := ve.resolveCredentials(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+	vmiType := ve.getVMIType(vmi)
+	profile, hasProfile := loginProfiles[vmiType]
+
+	user, password := ve.sshUser, ""
+	if credentials != nil {
+		if user == "" {
+			user = credentials.Username
+		}
+		password = credentials.Password
+	}
+	if user == "" {
+		user = profile.username
+	}
+	if user == "" {
+		user = defaultSSHUsers[vmiType]
+	}
+	if user == "" {
+		return nil, fmt.Errorf("unknown VM type - cannot determine the SSH user, set --ssh-user or --username")
+	}
+	if password == "" && hasProfile && user == profile.username {
+		password = profile.password
+	}
+	if password == "" && user == defaultSSHUsers[vmiType] {
+		password = defaultSSHPasswords[vmiType]
+	}
+
+	var auth []ssh.AuthMethod
+	if ve.sshKey != "" {
+		key, err := os.ReadFile(ve.sshKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key %s: %v", ve.sshKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password), ssh.KeyboardInteractive(
+			func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no SSH key or password for user %s, set --ssh-key or --password", user)
+	}
+
+	return &ssh.ClientConfig{
+		User: user,
+		Auth: auth,
+		// The connection is tunnelled through the authenticated Kubernetes
+		// API to the VMI, guest host keys are not pinned
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         ve.connectTimeout,
+	}, nil
+}
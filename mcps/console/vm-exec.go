@@ -6,7 +6,9 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	expect "github.com/google/goexpect"
@@ -23,23 +25,129 @@ import (
 var (
 	namespace  string
 	vmName     string
-	command    string
+	commands   []string
+	script     string
 	timeout    int
 	kubeconfig string
 	verbose    bool
+	progress   bool
+	method     string
+	shell      string
+
+	outputFormat    string
+	normalizeLocale bool
+	separateStderr  bool
+	maxOutput       int
+	env             []string
+	cwd             string
+	runAs           string
+	kubeContext     string
+
+	username        string
+	password        string
+	credentialsFile string
+
+	readConsole     bool
+	consoleDuration int
+	consoleLines    int
+
+	connectTimeout time.Duration
+	loginTimeout   time.Duration
+	promptTimeout  time.Duration
+	deadline       time.Duration
+
+	consoleRetries      int
+	consoleRetryBackoff time.Duration
+
+	putFile   string
+	getFile   string
+	localFile string
+	fileMode  string
+
+	sshKey  string
+	sshUser string
+	sshPort int
+
+	serve  bool
+	attach bool
 )
 
 const (
 	PromptExpression = `(\$ |\# )`
+
+	// ProgressPrefix starts the phase lines written to stderr with --progress
+	ProgressPrefix = "vm-exec-progress: "
+
+	// NormalizedLocale is exported in the guest shell with --normalize-locale
+	// so output parsed by callers is neither translated nor in local time
+	NormalizedLocale = "LANG=C LC_ALL=C TZ=UTC"
+)
+
+// Default console timeouts, overridden with --connect-timeout,
+// --login-timeout and --prompt-timeout
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultLoginTimeout   = 60 * time.Second
+	DefaultPromptTimeout  = 5 * time.Second
+)
+
+// promptLineRegex matches a console line ending with a shell prompt
+var promptLineRegex = regexp.MustCompile(`[\$\#] ?$`)
+
+// Output formats selectable with --output
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// Execution methods selectable with --method
+const (
+	MethodAuto    = "auto"
+	MethodConsole = "console"
+	MethodAgent   = "agent"
+	MethodSSH     = "ssh"
 )
 
 func main() {
 	pflag.StringVarP(&namespace, "namespace", "n", "default", "Namespace of the VM")
 	pflag.StringVarP(&vmName, "vm", "v", "", "Name of the VM (required)")
-	pflag.StringVarP(&command, "command", "c", "", "Command to execute in the VM (required)")
+	pflag.StringArrayVarP(&commands, "command", "c", nil, "Command to execute in the VM (required, repeat to run several commands in one session)")
+	pflag.StringVar(&script, "script", "", "File with one command per line to run in one session (blank lines and # comments are skipped)")
 	pflag.IntVarP(&timeout, "timeout", "t", 30, "Timeout in seconds")
 	pflag.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file")
+	pflag.StringVar(&kubeContext, "context", "", "Kubeconfig context to use (default: the current context)")
 	pflag.BoolVar(&verbose, "verbose", false, "Verbose output")
+	pflag.BoolVar(&progress, "progress", false, "Report execution phases on stderr as '"+ProgressPrefix+"<phase>' lines")
+	pflag.StringVarP(&outputFormat, "output", "o", OutputText, "Output format: text prints the command output, json prints stdout, exit code, duration and VM type as a JSON document")
+	pflag.StringVar(&username, "username", "", "Console login username, overrides the VM type default")
+	pflag.StringVar(&password, "password", "", "Console login password, overrides the VM type default (or set "+PasswordEnvVar+")")
+	pflag.StringVar(&credentialsFile, "credentials-file", "", "YAML file with console credentials keyed by namespace, VM name or labels")
+	pflag.DurationVar(&connectTimeout, "connect-timeout", DefaultConnectTimeout, "Timeout connecting to the serial console")
+	pflag.DurationVar(&loginTimeout, "login-timeout", DefaultLoginTimeout, "Timeout of the console login sequence")
+	pflag.DurationVar(&promptTimeout, "prompt-timeout", DefaultPromptTimeout, "Timeout waiting for a prompt when checking whether the console is already logged in")
+	pflag.DurationVar(&deadline, "deadline", 0, "Overall deadline after which vm-exec gives up, even when the console hangs (default: the connect and login timeouts plus --timeout per command); with --serve it bounds the login and each request")
+	pflag.IntVar(&consoleRetries, "console-retries", DefaultConsoleRetries, "Times connecting to the console and logging in is retried when the stream drops or times out; refused logins are not retried")
+	pflag.DurationVar(&consoleRetryBackoff, "retry-backoff", DefaultRetryBackoff, "Wait before the first console retry, doubled for every further retry")
+	pflag.StringVar(&method, "method", MethodAuto, "Execution method: auto (guest agent when connected and guest-exec works, then SSH when the guest accepts it, console otherwise), agent, ssh or console")
+	pflag.StringVar(&shell, "shell", ShellPowerShell, "Shell running the commands of Windows guests through the guest agent: powershell or cmd")
+	pflag.BoolVar(&separateStderr, "separate-stderr", false, "Capture the stderr of the commands apart from their stdout with every method, instead of combined like the console shows them")
+	pflag.IntVar(&maxOutput, "max-output", 0, "Cut the stdout and stderr of each command to this many bytes, marking where they were cut, 0 for no limit")
+	pflag.StringArrayVar(&env, "env", nil, "Environment variable of the commands as KEY=VALUE, repeat to set several")
+	pflag.StringVar(&cwd, "cwd", "", "Working directory of the commands in the guest")
+	pflag.StringVar(&runAs, "run-as", "", "Guest user running the commands, through sudo on Linux guests")
+	pflag.BoolVar(&normalizeLocale, "normalize-locale", false, "Run the commands with "+NormalizedLocale+" so their output can be parsed regardless of the guest locale and time zone")
+	pflag.BoolVar(&readConsole, "read-console", false, "Read serial console output without logging in or sending input, instead of executing a command")
+	pflag.IntVar(&consoleDuration, "duration", 10, "Seconds to capture console output with --read-console")
+	pflag.IntVar(&consoleLines, "lines", 100, "Maximum number of trailing console lines printed with --read-console")
+	pflag.StringVar(&putFile, "put-file", "", "Guest path to write --local-file to, instead of executing a command")
+	pflag.StringVar(&getFile, "get-file", "", "Guest path to copy to --local-file, instead of executing a command")
+	pflag.StringVar(&localFile, "local-file", "-", "Local file for --put-file and --get-file (- for stdin/stdout)")
+	pflag.StringVar(&fileMode, "file-mode", "", "Octal permissions applied to the guest file with --put-file, e.g. 0755")
+	pflag.StringVar(&sshKey, "ssh-key", "", "Private key file offered for SSH login, before the console password")
+	pflag.StringVar(&sshUser, "ssh-user", "", "SSH login user (default: the console username)")
+	pflag.IntVar(&sshPort, "ssh-port", DefaultSSHPort, "Guest port of the SSH server")
+	pflag.BoolVar(&attach, "attach", false, "Connect stdin and stdout to the serial console without logging in, instead of executing a command")
+	pflag.BoolVar(&serve, "serve", false, "Log in once and run the commands of each JSON request line read from stdin, answering with a JSON line on stdout")
 
 	pflag.Parse()
 
@@ -49,12 +157,93 @@ func main() {
 		os.Exit(1)
 	}
 
-	if command == "" {
+	if script != "" {
+		scriptCommands, err := readScript(script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		commands = append(commands, scriptCommands...)
+	}
+
+	fileTransfer := putFile != "" || getFile != ""
+	if putFile != "" && getFile != "" {
+		fmt.Fprintf(os.Stderr, "Error: --put-file and --get-file are mutually exclusive\n")
+		os.Exit(1)
+	}
+	if consoleRetries < 0 || consoleRetryBackoff < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --console-retries and --retry-backoff cannot be negative\n")
+		os.Exit(1)
+	}
+	if maxOutput < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-output cannot be negative\n")
+		os.Exit(1)
+	}
+	if _, err := parseEnv(env); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if runAs != "" && !runAsRegex.MatchString(runAs) {
+		fmt.Fprintf(os.Stderr, "Error: invalid --run-as user '%s'\n", runAs)
+		os.Exit(1)
+	}
+
+	if fileMode != "" && !fileModeRegex.MatchString(fileMode) {
+		fmt.Fprintf(os.Stderr, "Error: invalid file mode '%s'\n", fileMode)
+		os.Exit(1)
+	}
+
+	if serve && (len(commands) > 0 || readConsole || fileTransfer) {
+		fmt.Fprintf(os.Stderr, "Error: --serve reads the commands from stdin\n")
+		os.Exit(1)
+	}
+	if attach && (len(commands) > 0 || readConsole || fileTransfer || serve) {
+		fmt.Fprintf(os.Stderr, "Error: --attach cannot be combined with commands, --read-console, file transfers or --serve\n")
+		os.Exit(1)
+	}
+
+	if len(commands) == 0 && !readConsole && !fileTransfer && !serve && !attach {
 		fmt.Fprintf(os.Stderr, "Error: Command is required\n")
 		pflag.Usage()
 		os.Exit(1)
 	}
 
+	if method != MethodAuto && method != MethodConsole && method != MethodAgent && method != MethodSSH {
+		fmt.Fprintf(os.Stderr, "Error: unsupported method '%s'\n", method)
+		pflag.Usage()
+		os.Exit(1)
+	}
+	if method == MethodSSH && (readConsole || fileTransfer) {
+		fmt.Fprintf(os.Stderr, "Error: --method ssh only applies to command execution\n")
+		os.Exit(1)
+	}
+
+	if shell != ShellPowerShell && shell != ShellCmd {
+		fmt.Fprintf(os.Stderr, "Error: unsupported shell '%s'\n", shell)
+		pflag.Usage()
+		os.Exit(1)
+	}
+
+	if outputFormat != OutputText && outputFormat != OutputJSON {
+		fmt.Fprintf(os.Stderr, "Error: unsupported output format '%s'\n", outputFormat)
+		pflag.Usage()
+		os.Exit(1)
+	}
+	if outputFormat == OutputJSON && (readConsole || fileTransfer) {
+		fmt.Fprintf(os.Stderr, "Error: --output json only applies to command execution\n")
+		os.Exit(1)
+	}
+
+	// Keep stdout for the JSON document, verbose messages go to stderr
+	resultOutput := os.Stdout
+	if outputFormat == OutputJSON || serve || attach {
+		os.Stdout = os.Stderr
+	}
+
+	if password == "" {
+		password = os.Getenv(PasswordEnvVar)
+	}
+
 	log.InitializeLogging("vm-exec")
 
 	// Create Kubernetes client
@@ -62,12 +251,12 @@ func main() {
 	if kubeconfig != "" {
 		config = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 			&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
-			&clientcmd.ConfigOverrides{},
+			&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
 		)
 	} else {
 		config = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 			clientcmd.NewDefaultClientConfigLoadingRules(),
-			&clientcmd.ConfigOverrides{},
+			&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
 		)
 	}
 
@@ -87,60 +276,356 @@ func main() {
 		client:    virtClient,
 		namespace: namespace,
 		vmName:    vmName,
-		command:   command,
+		commands:  commands,
 		timeout:   time.Duration(timeout) * time.Second,
 		verbose:   verbose,
+		progress:  progress,
+		method:    method,
+		shell:     shell,
+
+		normalizeLocale: normalizeLocale,
+		separateStderr:  separateStderr,
+		maxOutput:       maxOutput,
+		env:             env,
+		cwd:             cwd,
+		runAs:           runAs,
+
+		connectTimeout: connectTimeout,
+		loginTimeout:   loginTimeout,
+		promptTimeout:  promptTimeout,
+		deadline:       deadline,
+
+		consoleRetries:      consoleRetries,
+		consoleRetryBackoff: consoleRetryBackoff,
+
+		username:        username,
+		password:        password,
+		credentialsFile: credentialsFile,
+
+		sshKey:  sshKey,
+		sshUser: sshUser,
+		sshPort: sshPort,
+	}
+
+	// The watchdog exits once the run is well past its deadline. Serve and
+	// attach run for as long as their caller wants and bound each operation
+	// instead.
+	if !serve && !attach {
+		steps := len(commands)
+		if fileTransfer {
+			steps = transferSteps
+		}
+		runDeadline := vmExec.runDeadline(steps)
+		if readConsole && deadline == 0 {
+			runDeadline += time.Duration(consoleDuration) * time.Second
+		}
+		startWatchdog(runDeadline)
+	}
+
+	if readConsole {
+		output, err := vmExec.ReadConsole(time.Duration(consoleDuration)*time.Second, consoleLines)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(output)
+		os.Exit(0)
+	}
+
+	if attach {
+		if err := vmExec.Attach(os.Stdin, resultOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if serve {
+		if err := vmExec.Serve(os.Stdin, resultOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if fileTransfer {
+		if err := transferFile(vmExec); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// Execute command on VM
-	output, exitCode, err := vmExec.ExecuteCommand()
+	// Execute commands on VM
+	results, err := vmExec.ExecuteCommands()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
+	// The exit code is part of the JSON document, exiting non-zero is left
+	// to vm-exec failures
+	if outputFormat == OutputJSON {
+		printStructuredJSON(resultOutput, results, vmExec.vmType, len(commands) > 1 || script != "")
+		os.Exit(0)
+	}
+
+	// Several commands are reported as a JSON array, exiting with the first failure
+	if len(commands) > 1 || script != "" {
+		printResultsJSON(results)
+		os.Exit(firstFailure(results))
+	}
+
 	// Print output with trailing newline
+	output := results[0].Output
 	if output != "" {
 		fmt.Print(output)
 		if !strings.HasSuffix(output, "\n") {
 			fmt.Println()
 		}
 	}
+	if stderr := results[0].Stderr; stderr != "" {
+		fmt.Fprint(os.Stderr, stderr)
+		if !strings.HasSuffix(stderr, "\n") {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
 
 	// Exit with the command's exit code
-	os.Exit(exitCode)
+	os.Exit(results[0].ExitCode)
 }
 
 type VMExec struct {
 	client    kubecli.KubevirtClient
 	namespace string
 	vmName    string
-	command   string
+	commands  []string
 	timeout   time.Duration
 	verbose   bool
+	progress  bool
+	method    string
+	// shell runs the commands of Windows guests, see windowsShellCommand
+	shell string
+
+	normalizeLocale bool
+	// separateStderr keeps the stderr of Linux commands apart, Windows
+	// commands always have it apart
+	separateStderr bool
+	// maxOutput cuts the output of each command, see limitOutput
+	maxOutput int
+	// env, cwd and runAs set up each command, see withRunContext
+	env   []string
+	cwd   string
+	runAs string
+
+	connectTimeout time.Duration
+	loginTimeout   time.Duration
+	promptTimeout  time.Duration
+	// deadline overrides the overall deadline, see runDeadline
+	deadline time.Duration
+
+	// consoleRetries and consoleRetryBackoff control openConsoleWithRetry
+	consoleRetries      int
+	consoleRetryBackoff time.Duration
+
+	username        string
+	password        string
+	credentialsFile string
+
+	sshKey  string
+	sshUser string
+	sshPort int
+
+	// vmType is the detected VM type, set once the VMI was found
+	vmType string
+}
+
+// CommandResult is the outcome of one command
+type CommandResult struct {
+	Command  string `json:"command"`
+	Output   string `json:"output"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	// Truncated is set when --max-output cut the output or stderr
+	Truncated bool          `json:"truncated,omitempty"`
+	Duration  time.Duration `json:"-"`
 }
 
-func (ve *VMExec) ExecuteCommand() (string, int, error) {
-	ctx := context.Background()
+// session runs commands one after the other over an open connection to the
+// guest, logged in once. run gives up when its context is done, it returns
+// the stderr of the command apart with --separate-stderr and on Windows.
+type session struct {
+	// via names the method in progress messages
+	via   string
+	run   func(ctx context.Context, command string) (output, stderr string, exitCode int, err error)
+	close func()
+}
+
+// ExecuteCommands runs all commands in order in a single session, within
+// the deadline of the run
+func (ve *VMExec) ExecuteCommands() ([]CommandResult, error) {
+	deadline := ve.runDeadline(len(ve.commands))
+	ctx, cancel := ve.withDeadline(context.Background(), deadline)
+	defer cancel()
+
+	results, err := ve.executeCommands(ctx)
+	return results, deadlineError(ctx, deadline, err)
+}
 
+// executeCommands runs the commands of ExecuteCommands
+func (ve *VMExec) executeCommands(ctx context.Context) ([]CommandResult, error) {
 	// Get VMI
 	vmi, err := ve.getRunningVMI(ctx)
 	if err != nil {
-		return "", 1, err
+		return nil, err
 	}
 
+	ve.vmType = ve.getVMIType(vmi)
 	if ve.verbose {
 		fmt.Printf("Found running VMI: %s\n", vmi.Name)
-		vmiType := ve.getVMIType(vmi)
-		fmt.Printf("VM Type: %s\n", vmiType)
-		fmt.Printf("Executing command: %s\n", ve.command)
+		fmt.Printf("VM Type: %s\n", ve.vmType)
+		fmt.Printf("Executing commands: %q\n", ve.commands)
+	}
+
+	s, err := ve.openSession(ctx, vmi)
+	if err != nil {
+		return nil, err
 	}
+	defer s.close()
+	return ve.runCommands(ctx, s, ve.commands)
+}
 
-	// Connect to console and execute command
-	return ve.executeViaConsole(vmi)
+// openSession opens a session with the selected method, falling back from
+// the guest agent to SSH and the console with the auto method
+func (ve *VMExec) openSession(ctx context.Context, vmi *v1.VirtualMachineInstance) (*session, error) {
+	useAgent, err := ve.useGuestAgent(vmi)
+	if err != nil {
+		return nil, err
+	}
+	if useAgent {
+		s, err := ve.guestAgentSession(ctx, vmi)
+		if err != nil || ve.method != MethodAuto || ve.getVMIType(vmi) == vmTypeWindows {
+			return s, err
+		}
+		return ve.withAgentFallback(vmi, s), nil
+	}
+	return ve.loginSession(ctx, vmi)
+}
+
+// withAgentFallback wraps a guest agent session of the auto method so it
+// moves to SSH or the console when guest-exec fails, as it does when the
+// qemu-ga of RHEL-family guests blocks it. Once guest-exec ran a command a
+// later failure is returned, rerunning the command could run it twice.
+func (ve *VMExec) withAgentFallback(vmi *v1.VirtualMachineInstance, agent *session) *session {
+	var fallback *session
+	ran := false
+	s := &session{via: agent.via}
+	s.run = func(ctx context.Context, command string) (string, string, int, error) {
+		if fallback != nil {
+			return fallback.run(ctx, command)
+		}
+		output, stderr, exitCode, err := agent.run(ctx, command)
+		if err == nil || ran || ctx.Err() != nil {
+			ran = ran || err == nil
+			return output, stderr, exitCode, err
+		}
+		if ve.verbose {
+			fmt.Printf("guest-exec failed (%v), falling back to SSH or console\n", err)
+		}
+		ve.reportProgress("guest-exec failed, falling back to SSH or console")
+		login, loginErr := ve.loginSession(ctx, vmi)
+		if loginErr != nil {
+			return "", "", 0, fmt.Errorf("guest-exec failed (%v), falling back failed too: %v", err, loginErr)
+		}
+		fallback = login
+		s.via = fallback.via
+		return fallback.run(ctx, command)
+	}
+	s.close = func() {
+		agent.close()
+		if fallback != nil {
+			fallback.close()
+		}
+	}
+	return s
+}
+
+// loginSession opens a session that logs in to the guest, over SSH when
+// the method allows it and the guest accepts it, on the console otherwise
+func (ve *VMExec) loginSession(ctx context.Context, vmi *v1.VirtualMachineInstance) (*session, error) {
+	if ve.method == MethodSSH || ve.method == MethodAuto {
+		s, err := ve.sshSession(ctx, vmi)
+		switch {
+		case err == nil:
+			return s, nil
+		case ve.method == MethodSSH:
+			return nil, err
+		case ve.verbose:
+			fmt.Printf("SSH not available (%v), falling back to console\n", err)
+		}
+	}
+
+	// Connect to console
+	return ve.consoleSession(ctx, vmi)
+}
+
+// runCommands executes the commands one after the other in the session
+func (ve *VMExec) runCommands(ctx context.Context, s *session, commands []string) ([]CommandResult, error) {
+	var results []CommandResult
+	for i, command := range commands {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("command %d/%d not run: %v", i+1, len(commands), err)
+		}
+		ve.reportProgress("running command %d/%d via %s", i+1, len(commands), s.via)
+		start := clock.Now()
+		output, stderr, exitCode, err := s.run(ctx, command)
+		if err != nil {
+			return nil, err
+		}
+		output, outputCut := ve.limitOutput(output)
+		stderr, stderrCut := ve.limitOutput(stderr)
+		results = append(results, CommandResult{Command: command, Output: output, Stderr: stderr, ExitCode: exitCode, Truncated: outputCut || stderrCut, Duration: clock.Now().Sub(start)})
+	}
+	return results, nil
+}
+
+// useGuestAgent reports whether the selected method resolves to the guest
+// agent for the VMI, failing when the agent is required but not connected
+func (ve *VMExec) useGuestAgent(vmi *v1.VirtualMachineInstance) (bool, error) {
+	if ve.getVMIType(vmi) == vmTypeWindows {
+		if err := ve.windowsMethodError(vmi); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	switch ve.method {
+	case MethodAgent:
+		if !hasGuestAgent(vmi) {
+			return false, fmt.Errorf("guest agent is not connected on VMI '%s'", vmi.Name)
+		}
+		return true, nil
+	case MethodAuto:
+		// Prefer the guest agent, it needs no login and reports real exit codes
+		if hasGuestAgent(vmi) {
+			return true, nil
+		}
+		if ve.verbose {
+			fmt.Printf("Guest agent not connected, falling back to console\n")
+		}
+	}
+	return false, nil
+}
+
+// reportProgress writes a phase line to stderr when --progress is set
+func (ve *VMExec) reportProgress(format string, args ...interface{}) {
+	if ve.progress {
+		fmt.Fprintf(os.Stderr, ProgressPrefix+format+"\n", args...)
+	}
 }
 
 func (ve *VMExec) getRunningVMI(ctx context.Context) (*v1.VirtualMachineInstance, error) {
+	ve.reportProgress("looking up VMI %s/%s", ve.namespace, ve.vmName)
+
 	// Try to get VMI first
 	vmi, err := ve.client.VirtualMachineInstance(ve.namespace).Get(ctx, ve.vmName, metav1.GetOptions{})
 	if err != nil {
@@ -165,68 +650,112 @@ func (ve *VMExec) getRunningVMI(ctx context.Context) (*v1.VirtualMachineInstance
 		return nil, fmt.Errorf("VMI '%s' is not running (phase: %s)", ve.vmName, vmi.Status.Phase)
 	}
 
-	// Check if VMI is paused
+	// Check if VMI is paused, by a user or by KubeVirt after an I/O error
 	for _, cond := range vmi.Status.Conditions {
 		if cond.Type == v1.VirtualMachineInstancePaused && cond.Status == "True" {
-			return nil, fmt.Errorf("VMI '%s' is paused", ve.vmName)
+			reason := cond.Reason
+			if cond.Message != "" {
+				reason += ": " + cond.Message
+			}
+			return nil, fmt.Errorf("VMI '%s' is paused (%s), unpause it with 'virtctl unpause vmi %s'", ve.vmName, reason, ve.vmName)
 		}
 	}
 
 	return vmi, nil
 }
 
-func (ve *VMExec) executeViaConsole(vmi *v1.VirtualMachineInstance) (string, int, error) {
-	vmiType := ve.getVMIType(vmi)
-	if vmiType == "" {
-		return "", 1, fmt.Errorf("unknown VM type - cannot determine login method")
+// consoleSession runs the commands on the serial console after logging in
+func (ve *VMExec) consoleSession(ctx context.Context, vmi *v1.VirtualMachineInstance) (*session, error) {
+	expecter, err := ve.openConsoleSession(ctx, vmi)
+	if err != nil {
+		return nil, err
 	}
+	return &session{
+		via: "console",
+		run: func(ctx context.Context, command string) (string, string, int, error) {
+			command = ve.withRunContext(command, true)
+			if ve.separateStderr || ve.maxOutput > 0 {
+				return ve.runCommandOnConsoleRedirected(ctx, expecter, command)
+			}
+			output, exitCode, err := ve.runCommandOnConsole(ctx, expecter, command)
+			return output, "", exitCode, err
+		},
+		close: func() { expecter.Close() },
+	}, nil
+}
 
-	if ve.verbose {
-		fmt.Printf("Connecting to VM console...\n")
+// openConsoleSession connects to the serial console and logs in. The caller
+// must close the returned expecter.
+func (ve *VMExec) openConsoleSession(ctx context.Context, vmi *v1.VirtualMachineInstance) (expect.Expecter, error) {
+	credentials, err := ve.resolveCredentials(ctx, vmi)
+	if err != nil {
+		return nil, err
 	}
 
-	// Connect to console
-	expecter, err := ve.newExpecter(vmi)
-	if err != nil {
-		return "", 1, fmt.Errorf("failed to connect to console: %v", err)
+	vmiType := ve.getVMIType(vmi)
+	if vmiType == "" && credentials == nil {
+		return nil, fmt.Errorf("unknown VM type - cannot determine login method, provide credentials to log in")
+	}
+	// Without a login profile there is no default user to go with a password
+	if _, ok := loginProfiles[vmiType]; !ok && credentials != nil && credentials.Username == "" {
+		return nil, fmt.Errorf("no default user for the VM type - set --username with the password")
 	}
-	defer expecter.Close()
 
-	// Login based on VM type
-	if err := ve.loginToVM(expecter, vmi, vmiType); err != nil {
-		return "", 1, fmt.Errorf("failed to login to VM: %v", err)
+	// Connect to console and login based on VM type
+	expecter, err := ve.openConsoleWithRetry(ctx, vmi, vmiType, credentials)
+	if err != nil {
+		return nil, err
 	}
 
-	if ve.verbose {
-		fmt.Printf("Successfully logged in to VM\n")
+	// The session keeps the exported locale for all the commands that follow
+	if ve.normalizeLocale {
+		if _, _, err := ve.runCommandOnConsole(ctx, expecter, "export "+NormalizedLocale); err != nil {
+			expecter.Close()
+			return nil, fmt.Errorf("failed to normalize locale: %v", err)
+		}
 	}
 
-	// Execute command and get result
-	return ve.runCommandOnConsole(expecter, ve.command)
+	return expecter, nil
 }
 
-func (ve *VMExec) newExpecter(vmi *v1.VirtualMachineInstance) (expect.Expecter, error) {
-	const connectionTimeout = 10 * time.Second
-
+// newExpecter connects to the serial console. The returned function
+// reports why the console stream ended, or nil while it is open; expect
+// calls fail as soon as it ends instead of waiting for their timeout.
+func (ve *VMExec) newExpecter(ctx context.Context, vmi *v1.VirtualMachineInstance) (expect.Expecter, func() error, error) {
 	// Create console connection exactly like the tests do
 	vmiReader, vmiWriter := io.Pipe()
 	expecterReader, expecterWriter := io.Pipe()
 
-	serialConsoleOptions := &kvcorev1.SerialConsoleOptions{ConnectionTimeout: connectionTimeout}
+	serialConsoleOptions := &kvcorev1.SerialConsoleOptions{ConnectionTimeout: remaining(ctx, ve.connectTimeout)}
 	con, err := ve.client.VirtualMachineInstance(vmi.Namespace).SerialConsole(vmi.Name, serialConsoleOptions)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	resCh := make(chan error)
+	var mu sync.Mutex
+	var streamErr error
+	resCh := make(chan error, 1)
 	go func() {
-		resCh <- con.Stream(kvcorev1.StreamOptions{
+		err := con.Stream(kvcorev1.StreamOptions{
 			In:  vmiReader,
 			Out: expecterWriter,
 		})
+		mu.Lock()
+		streamErr = err
+		if streamErr == nil {
+			streamErr = io.EOF
+		}
+		mu.Unlock()
+		expecterWriter.CloseWithError(streamErr)
+		resCh <- err
 	}()
+	streamClosed := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return streamErr
+	}
 
-	opts := []expect.Option{expect.SendTimeout(connectionTimeout), expect.Verbose(ve.verbose)}
+	opts := []expect.Option{expect.SendTimeout(ve.connectTimeout), expect.Verbose(ve.verbose)}
 	expecter, _, err := expect.SpawnGeneric(&expect.GenOptions{
 		In:  vmiWriter,
 		Out: expecterReader,
@@ -238,24 +767,38 @@ func (ve *VMExec) newExpecter(vmi *v1.VirtualMachineInstance) (expect.Expecter,
 			vmiReader.Close()
 			return nil
 		},
-		Check: func() bool { return true },
-	}, connectionTimeout, opts...)
+		Check: func() bool { return streamClosed() == nil },
+	}, remaining(ctx, ve.connectTimeout), opts...)
 
-	return expecter, err
+	return expecter, streamClosed, err
 }
 
-func (ve *VMExec) loginToVM(expecter expect.Expecter, vmi *v1.VirtualMachineInstance, vmiType string) error {
-	const promptTimeout = 5 * time.Second
-	const loginTimeout = 60 * time.Second
+// loginToVM logs in on the console within the login timeout and the deadline
+// of ctx. The expecter is closed when the deadline passes, ending the console
+// stream even when the guest stopped answering.
+func (ve *VMExec) loginToVM(ctx context.Context, expecter expect.Expecter, vmi *v1.VirtualMachineInstance, vmiType string, credentials *Credentials) error {
+	stop := context.AfterFunc(ctx, func() { expecter.Close() })
+	defer stop()
+	loginTimeout, promptTimeout := remaining(ctx, ve.loginTimeout), remaining(ctx, ve.promptTimeout)
 
 	// Send newline to see current state
 	if err := expecter.Send("\n"); err != nil {
 		return err
 	}
 
+	profile, ok := loginProfiles[vmiType]
+	if credentials != nil {
+		// Custom credentials use the password login flow for any VM type
+		if !ok {
+			profile = genericLoginProfile
+		}
+		return ve.loginWithProfile(expecter, profile.withCredentials(credentials), loginTimeout, promptTimeout)
+	}
+	if ok {
+		return ve.loginWithProfile(expecter, profile, loginTimeout, promptTimeout)
+	}
+
 	switch vmiType {
-	case "fedora":
-		return ve.loginToFedora(expecter, vmi, loginTimeout, promptTimeout)
 	case "cirros":
 		return ve.loginToCirros(expecter, vmi, loginTimeout, promptTimeout)
 	case "alpine":
@@ -265,12 +808,12 @@ func (ve *VMExec) loginToVM(expecter expect.Expecter, vmi *v1.VirtualMachineInst
 	}
 }
 
-func (ve *VMExec) loginToFedora(expecter expect.Expecter, vmi *v1.VirtualMachineInstance, loginTimeout, promptTimeout time.Duration) error {
-	loggedInPromptRegex := `(\[fedora@[^\s\]]+\s+~\]\$ |\[root@[^\s\]]+\s+[^\]]*\]\# )`
-
+// loginWithProfile logs in with the username/password of a cloud image login
+// profile and, when the profile requires it, becomes root with "sudo su"
+func (ve *VMExec) loginWithProfile(expecter expect.Expecter, profile loginProfile, loginTimeout, promptTimeout time.Duration) error {
 	b := []expect.Batcher{
 		&expect.BSnd{S: "\n"},
-		&expect.BExp{R: loggedInPromptRegex},
+		&expect.BExp{R: profile.loggedInPrompt},
 	}
 	_, err := expecter.ExpectBatch(b, promptTimeout)
 	if err == nil {
@@ -282,16 +825,19 @@ func (ve *VMExec) loginToFedora(expecter expect.Expecter, vmi *v1.VirtualMachine
 		&expect.BSnd{S: "\n"},
 		&expect.BSnd{S: "\n"},
 		&expect.BExp{R: `[^\s]+ login: `}, // Match any hostname followed by " login: "
-		&expect.BSnd{S: "fedora\n"},
+		&expect.BSnd{S: profile.username + "\n"},
 		&expect.BExp{R: "Password:"},
-		&expect.BSnd{S: "fedora\n"},
-		&expect.BExp{R: loggedInPromptRegex},
-		&expect.BSnd{S: "sudo su\n"},
-		&expect.BExp{R: PromptExpression},
+		&expect.BSnd{S: profile.password + "\n"},
+		&expect.BExp{R: profile.loggedInPrompt},
+	}
+	if profile.becomeRoot {
+		b = append(b,
+			&expect.BSnd{S: "sudo su\n"},
+			&expect.BExp{R: PromptExpression},
+		)
 	}
 
-	_, err = expecter.ExpectBatch(b, loginTimeout)
-	return err
+	return loginBatch(expecter, b, loginTimeout)
 }
 
 func (ve *VMExec) loginToCirros(expecter expect.Expecter, vmi *v1.VirtualMachineInstance, loginTimeout, promptTimeout time.Duration) error {
@@ -313,8 +859,7 @@ func (ve *VMExec) loginToCirros(expecter expect.Expecter, vmi *v1.VirtualMachine
 		&expect.BExp{R: PromptExpression},
 	}
 
-	_, err = expecter.ExpectBatch(b, loginTimeout)
-	return err
+	return loginBatch(expecter, b, loginTimeout)
 }
 
 func (ve *VMExec) loginToAlpine(expecter expect.Expecter, vmi *v1.VirtualMachineInstance, loginTimeout, promptTimeout time.Duration) error {
@@ -335,8 +880,7 @@ func (ve *VMExec) loginToAlpine(expecter expect.Expecter, vmi *v1.VirtualMachine
 		&expect.BExp{R: PromptExpression},
 	}
 
-	_, err = expecter.ExpectBatch(b, loginTimeout)
-	return err
+	return loginBatch(expecter, b, loginTimeout)
 }
 
 // safeExpectBatch validates that the commands arrive to the console properly.
@@ -386,7 +930,13 @@ func (ve *VMExec) safeExpectBatch(expecter expect.Expecter, batch []expect.Batch
 	return res, err
 }
 
-func (ve *VMExec) runCommandOnConsole(expecter expect.Expecter, command string) (string, int, error) {
+// runCommandOnConsole runs a command within --timeout and the deadline of
+// ctx. When the deadline passes the expecter is closed, the console state is
+// unknown after an interrupted command.
+func (ve *VMExec) runCommandOnConsole(ctx context.Context, expecter expect.Expecter, command string) (string, int, error) {
+	stop := context.AfterFunc(ctx, func() { expecter.Close() })
+	defer stop()
+
 	// Use SafeExpectBatch to ensure commands are sent properly
 	b := []expect.Batcher{
 		&expect.BSnd{S: command + "\n"},
@@ -395,7 +945,7 @@ func (ve *VMExec) runCommandOnConsole(expecter expect.Expecter, command string)
 		&expect.BExp{R: PromptExpression}, // Wait for prompt after exit code
 	}
 
-	res, err := ve.safeExpectBatch(expecter, b, ve.timeout)
+	res, err := ve.safeExpectBatch(expecter, b, remaining(ctx, ve.timeout))
 	if err != nil {
 		return "", 1, fmt.Errorf("command execution failed: %v", err)
 	}
@@ -413,75 +963,112 @@ func (ve *VMExec) runCommandOnConsole(expecter expect.Expecter, command string)
 			fmt.Printf("Debug: First buffer content: %q\n", buffer)
 		}
 
-		// Extract command output after the validated command
-		// The SafeExpectBatch modifies the regex to include the command, so we look for it
-		commandPrefix := command + "\r\n"
-		if idx := strings.Index(buffer, commandPrefix); idx != -1 {
-			start := idx + len(commandPrefix)
-			remaining := buffer[start:]
+		output = extractCommandOutput(buffer, command)
+	}
 
-			// Find the end of command output (before the prompt)
-			if endIdx := strings.Index(remaining, "\r\n["); endIdx != -1 {
-				output = remaining[:endIdx]
-			} else {
-				// Fallback: take everything until the end if no clear prompt boundary
-				output = strings.TrimSpace(remaining)
-			}
-		} else {
-			// Fallback: if we can't find the command prefix, try to extract from the full buffer
-			// Look for the pattern after any initial content
-			lines := strings.Split(buffer, "\r\n")
-			var outputLines []string
-			foundCommand := false
-
-			for _, line := range lines {
-				if strings.Contains(line, command) {
-					foundCommand = true
-					continue
-				}
-				if foundCommand && (strings.Contains(line, "]$") || strings.Contains(line, "]#")) {
-					break
-				}
-				if foundCommand && line != "" {
-					outputLines = append(outputLines, line)
-				}
-			}
+	if len(res) >= 2 {
+		exitCode = parseExitCode(res[1].Output)
+	}
 
-			if len(outputLines) > 0 {
-				output = strings.Join(outputLines, "\n")
-			}
+	return output, exitCode, nil
+}
+
+// extractCommandOutput returns the output of command from the console buffer
+// of its expect batch, which holds the echoed command, its output and the
+// next prompt
+func extractCommandOutput(buffer, command string) string {
+	// Extract command output after the validated command
+	// The SafeExpectBatch modifies the regex to include the command, so we look for it
+	commandPrefix := command + "\r\n"
+	if idx := strings.Index(buffer, commandPrefix); idx != -1 {
+		remaining := buffer[idx+len(commandPrefix):]
+
+		// Find the end of command output (before the prompt on the last line)
+		if endIdx := strings.LastIndex(remaining, "\r\n"); endIdx != -1 {
+			return remaining[:endIdx]
+		}
+		// Only the prompt follows a command that printed nothing
+		if promptLineRegex.MatchString(remaining) {
+			return ""
 		}
+		// Fallback: take everything until the end if no clear prompt boundary
+		return strings.TrimSpace(remaining)
+	}
 
-		// TODO: Parse exit code from the echo $? command
-		// For now, assume success if we got output without connection errors
-		exitCode = 0
+	// Fallback: if we can't find the command prefix, try to extract from the full buffer
+	// Look for the pattern after any initial content
+	lines := strings.Split(buffer, "\r\n")
+	var outputLines []string
+	foundCommand := false
+
+	for _, line := range lines {
+		// Output lines may contain the command text too, only the first
+		// occurrence is the echoed command
+		if !foundCommand && strings.Contains(line, command) {
+			foundCommand = true
+			continue
+		}
+		if foundCommand && promptLineRegex.MatchString(line) {
+			break
+		}
+		if foundCommand && line != "" {
+			outputLines = append(outputLines, line)
+		}
 	}
 
-	return output, exitCode, nil
+	return strings.Join(outputLines, "\n")
+}
+
+// parseExitCode reads the exit code printed by "echo $?" from the console
+// buffer. It falls back to 0, the historical behavior, when no exit code
+// (a number from 0 to 255) is found.
+func parseExitCode(buffer string) int {
+	if idx := strings.Index(buffer, "echo $?"); idx != -1 {
+		buffer = buffer[idx+len("echo $?"):]
+	}
+
+	for _, line := range strings.Split(buffer, "\n") {
+		if exitCode, err := strconv.Atoi(strings.TrimSpace(line)); err == nil && exitCode >= 0 && exitCode <= 255 {
+			return exitCode
+		}
+	}
+	return 0
 }
 
 func (ve *VMExec) getVMIType(vmi *v1.VirtualMachineInstance) string {
+	// The guest agent reports the actual OS when it is connected
+	if vmiType := normalizeOSType(vmi.Status.GuestOSInfo.ID); vmiType != "" {
+		return vmiType
+	}
+
 	// Check container disk images to determine VM type
 	for _, volume := range vmi.Spec.Volumes {
 		if volume.VolumeSource.ContainerDisk == nil {
 			continue
 		}
 
-		image := volume.VolumeSource.ContainerDisk.Image
-		if strings.Contains(image, "fedora") {
-			return "fedora"
-		} else if strings.Contains(image, "cirros") {
-			return "cirros"
-		} else if strings.Contains(image, "alpine") {
-			return "alpine"
+		if vmiType := normalizeOSType(volume.VolumeSource.ContainerDisk.Image); vmiType != "" {
+			return vmiType
 		}
 	}
 
 	// Check labels as fallback
 	if vmi.Labels != nil {
 		if os, exists := vmi.Labels["kubevirt.io/os"]; exists {
+			if vmiType := normalizeOSType(os); vmiType != "" {
+				return vmiType
+			}
 			return os
 		}
+		// Labels of the VMs created from the common templates, e.g.
+		// os.template.kubevirt.io/win2k22
+		for label := range vmi.Labels {
+			if os, ok := strings.CutPrefix(label, "os.template.kubevirt.io/"); ok {
+				if vmiType := normalizeOSType(os); vmiType != "" {
+					return vmiType
+				}
+			}
+		}
 	}
 
 	return ""
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestExtractCommandOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		buffer  string
+		command string
+		want    string
+	}{
+		{"one line", "uname -r\r\n6.8.5-301.fc40.x86_64\r\n[fedora@fedora ~]$ ", "uname -r", "6.8.5-301.fc40.x86_64"},
+		{"several lines", "ls /\r\nbin\r\ndev\r\n# ", "ls /", "bin\r\ndev"},
+		{"after the previous prompt", "[root@vm ~]# echo hi\r\nhi\r\n[root@vm ~]# ", "echo hi", "hi"},
+		{"no output", "true\r\n$ ", "true", ""},
+		{"no prompt yet", "cat log\r\n  partial ", "cat log", "partial"},
+		{"output holding the command", "cat x\r\ncat x\r\n# ", "cat x", "cat x"},
+		{"echo with trailing space", "echo hi \r\nhi\r\n\r\nthere\r\n$ ", "echo hi", "hi\nthere"},
+		{"command not echoed", "garbage", "echo hi", ""},
+	}
+	for _, tt := range tests {
+		if got := extractCommandOutput(tt.buffer, tt.command); got != tt.want {
+			t.Errorf("%s: extractCommandOutput(%q, %q) = %q, want %q", tt.name, tt.buffer, tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestParseExitCode(t *testing.T) {
+	tests := []struct {
+		buffer string
+		want   int
+	}{
+		{"echo $?\r\n0\r\n$ ", 0},
+		{"echo $?\r\n127\r\n[root@vm ~]# ", 127},
+		{"5\r\necho $?\r\n2\r\n$ ", 2},
+		{"echo $?\r\n-1\r\n$ ", 0},
+		{"echo $?\r\n300\r\n1\r\n$ ", 1},
+		{"echo $?\r\n99999999999999999999\r\n$ ", 0},
+		{"echo $?\r\n$ ", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseExitCode(tt.buffer); got != tt.want {
+			t.Errorf("parseExitCode(%q) = %d, want %d", tt.buffer, got, tt.want)
+		}
+	}
+}
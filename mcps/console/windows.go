@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "kubevirt.io/api/core/v1"
+)
+
+// vmTypeWindows is the VM type of Windows guests. They have no serial
+// console login to drive, commands run through the guest agent only.
+const vmTypeWindows = "windows"
+
+// Shells running the commands of Windows guests, selected with --shell
+const (
+	ShellPowerShell = "powershell"
+	ShellCmd        = "cmd"
+)
+
+// windowsShellCommand returns the guest-exec path and arguments running
+// command in the shell of a Windows guest, in the cwd directory when set
+func windowsShellCommand(shell, cwd, command string) (string, []string) {
+	if shell == ShellCmd {
+		if cwd != "" {
+			command = `cd /d "` + cwd + `" && ` + command
+		}
+		return "cmd.exe", []string{"/c", command}
+	}
+	if cwd != "" {
+		command = "Set-Location -LiteralPath '" + strings.ReplaceAll(cwd, "'", "''") + "'; " + command
+	}
+	return "powershell.exe", []string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", command}
+}
+
+// windowsMethodError explains why a method other than the guest agent
+// cannot run commands on a Windows VMI, or returns nil when it can
+func (ve *VMExec) windowsMethodError(vmi *v1.VirtualMachineInstance) error {
+	switch {
+	case ve.runAs != "":
+		return fmt.Errorf("VMI '%s' runs Windows, --run-as only applies to Linux guests", vmi.Name)
+	case ve.method == MethodConsole || ve.method == MethodSSH:
+		return fmt.Errorf("VMI '%s' runs Windows, which has no console login to automate; commands run through the guest agent only", vmi.Name)
+	case !hasGuestAgent(vmi):
+		return fmt.Errorf("VMI '%s' runs Windows and its guest agent is not connected; install the QEMU guest agent from the virtio-win drivers to run commands", vmi.Name)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxApplyObjects bounds the number of objects of a single manifest
+const maxApplyObjects = 50
+
+var (
+	// apiErrorRegex matches the "Error from server (Reason): message"
+	// form kubectl prints API errors in
+	apiErrorRegex = regexp.MustCompile(`^Error from server \(([^)]+)\): (.*)$`)
+	// webhookDenialRegex matches admission webhook denials
+	webhookDenialRegex = regexp.MustCompile(`admission webhook "([^"]+)" denied the request: (.*)$`)
+	// fieldErrorRegex matches the field errors of an Invalid API error, e.g.
+	// "spec.running: Invalid value: true: ..." or "spec.template: Required value"
+	fieldErrorRegex = regexp.MustCompile(`([A-Za-z0-9_.\[\]\-/]+): (Invalid value|Required value|Unsupported value|Duplicate value|Forbidden|Not found|Too long|Too many|Internal error)`)
+	// unknownFieldRegex matches the strict decoding errors of unknown fields
+	unknownFieldRegex = regexp.MustCompile(`unknown field "([^"]+)"`)
+)
+
+// ApplyParams represents the parameters of kubevirt_apply
+type ApplyParams struct {
+	Manifest  string `json:"manifest"`
+	Namespace string `json:"namespace,omitempty"`
+	Apply     bool   `json:"apply,omitempty"`
+	Force     bool   `json:"force,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// ValidationCause is a single reason the API server rejected an object
+type ValidationCause struct {
+	Field   string `json:"field,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+}
+
+// ApplyObject is the validation and apply outcome of one object of the
+// manifest
+type ApplyObject struct {
+	Kind      string            `json:"kind"`
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Action    string            `json:"action"`
+	Valid     bool              `json:"valid"`
+	Reason    string            `json:"reason,omitempty"`
+	Webhook   string            `json:"webhook,omitempty"`
+	Causes    []ValidationCause `json:"causes,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Diff      string            `json:"diff,omitempty"`
+}
+
+// ApplyResult is the kubevirt_apply tool result
+type ApplyResult struct {
+	Valid   bool          `json:"valid"`
+	Applied bool          `json:"applied"`
+	Objects []ApplyObject `json:"objects"`
+	Note    string        `json:"note,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "kubevirt_apply",
+		Description: "Validate a full YAML or JSON manifest of KubeVirt and CDI objects (VirtualMachine, VirtualMachineInstance, DataVolume, ...) with a server side dry run, including admission webhooks, and optionally apply it. Reports per object whether it would be created, configured or unchanged with a diff, and validation errors as structured field causes",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"manifest": map[string]interface{}{
+					"type":        "string",
+					"description": "YAML or JSON manifest, several objects can be separated with ---",
+				},
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Namespace of the objects that do not set one",
+					"default":     "default",
+				},
+				"apply": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Apply the manifest when every object passes the dry run, otherwise only validate it",
+					"default":     false,
+				},
+				"force": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Take over fields owned by other field managers instead of failing with a conflict",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"manifest"},
+		},
+		Handler: handleApply,
+	})
+}
+
+// handleApply is the tools/call handler for kubevirt_apply
+func handleApply(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ApplyParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(params.Manifest) == "" {
+		return "", missingArgument("manifest")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	objects, err := parseManifest(params.Manifest, params.Namespace)
+	if err != nil {
+		return "", &invalidParamsError{err: err}
+	}
+	result, err := applyManifest(ctx, objects, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// clusterScopedKinds are the kinds of the kubevirt.io API groups stored
+// without a namespace, parseManifest sets none on them
+var clusterScopedKinds = map[string]bool{
+	"VirtualMachineClusterInstancetype": true,
+	"VirtualMachineClusterPreference":   true,
+	"MigrationPolicy":                   true,
+	"CDI":                               true,
+	"CDIConfig":                         true,
+	"StorageProfile":                    true,
+	"ObjectTransfer":                    true,
+}
+
+// parseManifest decodes the YAML or JSON documents of manifest, setting the
+// namespace of the namespaced objects without one. Only objects of the
+// kubevirt.io API groups are accepted.
+func parseManifest(manifest, namespace string) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	decoder := yaml.NewDecoder(strings.NewReader(manifest))
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("manifest is not valid YAML or JSON: %v", err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		position := fmt.Sprintf("object %d", len(objects)+1)
+
+		apiVersion, _ := obj["apiVersion"].(string)
+		kind, _ := obj["kind"].(string)
+		if apiVersion == "" || kind == "" {
+			return nil, fmt.Errorf("%s: apiVersion and kind are required", position)
+		}
+		group, _, _ := strings.Cut(apiVersion, "/")
+		if !strings.Contains(apiVersion, "/") || !(group == "kubevirt.io" || strings.HasSuffix(group, ".kubevirt.io")) {
+			return nil, fmt.Errorf("%s: %s %s is not a KubeVirt or CDI object, only kubevirt.io API groups are supported", position, apiVersion, kind)
+		}
+		metadata, ok := obj["metadata"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: metadata is required", position)
+		}
+		if name, _ := metadata["name"].(string); name == "" {
+			return nil, fmt.Errorf("%s: %s needs metadata.name, generateName cannot be applied", position, kind)
+		}
+		if ns, _ := metadata["namespace"].(string); ns == "" && !clusterScopedKinds[kind] {
+			metadata["namespace"] = namespace
+		}
+
+		objects = append(objects, obj)
+		if len(objects) > maxApplyObjects {
+			return nil, fmt.Errorf("manifest has more than %d objects", maxApplyObjects)
+		}
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("manifest holds no object")
+	}
+	return objects, nil
+}
+
+// applyManifest dry runs every object and applies them all only when none
+// fails, so an invalid object does not leave the manifest half applied
+func applyManifest(ctx context.Context, objects []map[string]interface{}, params ApplyParams) (*ApplyResult, error) {
+	result := &ApplyResult{Valid: true}
+	manifests := make([][]byte, len(objects))
+	for i, obj := range objects {
+		manifest, err := json.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode manifest: %v", err)
+		}
+		manifests[i] = manifest
+
+		metadata := obj["metadata"].(map[string]interface{})
+		entry := ApplyObject{Kind: obj["kind"].(string)}
+		entry.Name, _ = metadata["name"].(string)
+		entry.Namespace, _ = metadata["namespace"].(string)
+		reportProgress(ctx, "validating %s %s/%s", entry.Kind, entry.Namespace, entry.Name)
+
+		group, _, _ := strings.Cut(obj["apiVersion"].(string), "/")
+		resource := strings.ToLower(entry.Kind) + "." + group
+		before := objectYAML(ctx, resource, entry.Name, entry.Namespace)
+		output, err := runKubectlWithInput(ctx, manifest, applyArgs(params.Force, "--dry-run=server", "-o", "json")...)
+		if err != nil {
+			entry.Action = "failed"
+			describeApplyError(&entry, err)
+			result.Valid = false
+			result.Objects = append(result.Objects, entry)
+			continue
+		}
+
+		entry.Valid = true
+		var after map[string]interface{}
+		if err := json.Unmarshal(output, &after); err != nil {
+			return nil, fmt.Errorf("failed to parse kubectl output: %v", err)
+		}
+		switch {
+		case before == "":
+			entry.Action = "created"
+		case before == cleanObjectYAML(after):
+			entry.Action = "unchanged"
+		default:
+			entry.Action = "configured"
+			label := entry.Namespace + "/" + resource + "/" + entry.Name
+			entry.Diff = unifiedDiff("a/"+label, "b/"+label, before, cleanObjectYAML(after))
+		}
+		result.Objects = append(result.Objects, entry)
+	}
+
+	switch {
+	case !params.Apply:
+		result.Note = "server dry run only, pass apply to apply the manifest"
+		return result, nil
+	case !result.Valid:
+		result.Note = "nothing was applied, fix the objects that failed the dry run"
+		return result, nil
+	}
+
+	for i := range result.Objects {
+		entry := &result.Objects[i]
+		reportProgress(ctx, "applying %s %s/%s", entry.Kind, entry.Namespace, entry.Name)
+		if _, err := runKubectlWithInput(ctx, manifests[i], applyArgs(params.Force)...); err != nil {
+			entry.Action = "failed"
+			describeApplyError(entry, err)
+			result.Valid = false
+			result.Note = fmt.Sprintf("applying stopped at %s %s, the objects before it were applied", entry.Kind, entry.Name)
+			return result, nil
+		}
+		logMessage(LogInfo, "apply", "%s %s/%s %s", entry.Kind, entry.Namespace, entry.Name, entry.Action)
+	}
+	result.Applied = true
+	return result, nil
+}
+
+// applyArgs returns the kubectl server side apply arguments for a manifest
+// on stdin
+func applyArgs(force bool, extra ...string) []string {
+	args := []string{"apply", "--server-side", "--field-manager=" + managedByValue}
+	if force {
+		args = append(args, "--force-conflicts")
+	}
+	return append(append(args, extra...), "-f", "-")
+}
+
+// describeApplyError breaks the kubectl error of a rejected object down into
+// its reason, the denying webhook and the field causes
+func describeApplyError(entry *ApplyObject, err error) {
+	message := kubectlErrorMessage(err)
+	entry.Error = message
+	if match := apiErrorRegex.FindStringSubmatch(message); match != nil {
+		entry.Reason, message = match[1], match[2]
+	}
+	if match := webhookDenialRegex.FindStringSubmatch(message); match != nil {
+		entry.Webhook, message = match[1], match[2]
+	}
+	entry.Causes = validationCauses(message)
+}
+
+// validationCauses splits an API error message into field causes. Messages
+// without recognizable field errors are returned as a single cause.
+func validationCauses(message string) []ValidationCause {
+	var causes []ValidationCause
+	for _, match := range unknownFieldRegex.FindAllStringSubmatch(message, -1) {
+		causes = append(causes, ValidationCause{Field: match[1], Type: "Unknown field", Message: fmt.Sprintf("unknown field %q", match[1])})
+	}
+
+	matches := fieldErrorRegex.FindAllStringSubmatchIndex(message, -1)
+	for i, match := range matches {
+		end := len(message)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		detail := strings.TrimSpace(message[match[1]:end])
+		detail = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(detail, ","), "]"))
+		detail = strings.TrimPrefix(detail, ": ")
+		cause := ValidationCause{Field: strings.TrimPrefix(message[match[2]:match[3]], "["), Type: message[match[4]:match[5]], Message: detail}
+		if cause.Message == "" {
+			cause.Message = cause.Type
+		}
+		causes = append(causes, cause)
+	}
+
+	if len(causes) == 0 {
+		causes = append(causes, ValidationCause{Message: message})
+	}
+	return causes
+}
+
+// tables renders the apply result as the objects followed by their
+// validation causes and diffs
+func (r *ApplyResult) tables() []table {
+	objects := table{title: "Objects", headers: []string{"KIND", "NAMESPACE", "NAME", "ACTION", "VALID", "REASON", "WEBHOOK"}}
+	causes := table{title: "Validation errors", headers: []string{"OBJECT", "FIELD", "TYPE", "MESSAGE"}}
+	var diffs bytes.Buffer
+	for _, o := range r.Objects {
+		objects.rows = append(objects.rows, []string{o.Kind, o.Namespace, o.Name, o.Action, strconv.FormatBool(o.Valid), o.Reason, o.Webhook})
+		for _, c := range o.Causes {
+			causes.rows = append(causes.rows, []string{o.Kind + "/" + o.Name, c.Field, c.Type, c.Message})
+		}
+		diffs.WriteString(o.Diff)
+	}
+	overview := table{title: "Apply", headers: []string{"FIELD", "VALUE"}}
+	overview.rows = append(overview.rows,
+		[]string{"Valid", strconv.FormatBool(r.Valid)},
+		[]string{"Applied", strconv.FormatBool(r.Applied)},
+	)
+	if r.Note != "" {
+		overview.rows = append(overview.rows, []string{"Note", r.Note})
+	}
+	tables := []table{overview, objects, causes}
+	if diffs.Len() > 0 {
+		diff := table{title: "Diff", headers: []string{"DIFF"}}
+		for _, line := range strings.Split(strings.TrimRight(diffs.String(), "\n"), "\n") {
+			diff.rows = append(diff.rows, []string{line})
+		}
+		tables = append(tables, diff)
+	}
+	return tables
+}
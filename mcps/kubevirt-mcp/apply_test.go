@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseManifestNamespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     interface{}
+	}{
+		{"namespaced kind", "apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  name: web\n", "dev"},
+		{"namespace of the object", "apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  name: web\n  namespace: prod\n", "prod"},
+		{"cluster instancetype", "apiVersion: instancetype.kubevirt.io/v1beta1\nkind: VirtualMachineClusterInstancetype\nmetadata:\n  name: small\n", nil},
+		{"cluster preference", "apiVersion: instancetype.kubevirt.io/v1beta1\nkind: VirtualMachineClusterPreference\nmetadata:\n  name: fedora\n", nil},
+		{"migration policy", "apiVersion: migrations.kubevirt.io/v1alpha1\nkind: MigrationPolicy\nmetadata:\n  name: fast\n", nil},
+		{"storage profile", "apiVersion: cdi.kubevirt.io/v1beta1\nkind: StorageProfile\nmetadata:\n  name: local\n", nil},
+		{"namespaced instancetype", "apiVersion: instancetype.kubevirt.io/v1beta1\nkind: VirtualMachineInstancetype\nmetadata:\n  name: small\n", "dev"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := parseManifest(tt.manifest, "dev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := objects[0]["metadata"].(map[string]interface{})["namespace"]; got != tt.want {
+				t.Fatalf("namespace = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{"", "manifest holds no object"},
+		{"---\n---\n", "manifest holds no object"},
+		{"kind: [", "not valid YAML or JSON"},
+		{"kind: VirtualMachine\nmetadata:\n  name: web\n", "object 1: apiVersion and kind are required"},
+		{"apiVersion: v1\nkind: Pod\nmetadata:\n  name: web\n", "v1 Pod is not a KubeVirt or CDI object"},
+		{"apiVersion: kubevirt.io.evil.com/v1\nkind: VirtualMachine\nmetadata:\n  name: web\n", "not a KubeVirt or CDI object"},
+		{"apiVersion: kubevirt.io/v1\nkind: VirtualMachine\n", "object 1: metadata is required"},
+		{"apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  generateName: web-\n", "VirtualMachine needs metadata.name"},
+		{"apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  name: web\n---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: s\n", "object 2: v1 Secret"},
+		{strings.Repeat("apiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata:\n  name: web\n---\n", maxApplyObjects+1), "more than"},
+	}
+	for _, tt := range tests {
+		if _, err := parseManifest(tt.manifest, "dev"); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseManifest(%q) error = %v, want %q", tt.manifest, err, tt.want)
+		}
+	}
+}
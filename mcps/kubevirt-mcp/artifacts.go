@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the export of tool results, see
+// ArtifactsConfig. Exporting is enabled by setting a directory, a ConfigMap
+// namespace or both.
+const (
+	artifactsDirEnv       = "KUBEVIRT_MCP_ARTIFACTS_DIR"
+	artifactsNamespaceEnv = "KUBEVIRT_MCP_ARTIFACTS_NAMESPACE"
+	artifactsMinSizeEnv   = "KUBEVIRT_MCP_ARTIFACTS_MIN_SIZE"
+
+	// maxConfigMapArtifactSize keeps exported ConfigMaps below the 1MiB object
+	// size limit, leaving room for the metadata
+	maxConfigMapArtifactSize = 1000 * 1024
+)
+
+// artifactSequence numbers the results exported by this server process so
+// results of the same tool in the same second get distinct names
+var (
+	artifactMu       sync.Mutex
+	artifactSequence int
+)
+
+// exportArtifacts persists a tool result to the configured artifacts
+// directory and ConfigMap namespace, returning where it was written. Export
+// failures are logged and never fail the tool call.
+func exportArtifacts(toolName, result string) []string {
+	dir := serverConfig.Artifacts.Dir
+	namespace := serverConfig.Artifacts.Namespace
+	if dir == "" && namespace == "" {
+		return nil
+	}
+	if len(result) < serverConfig.Artifacts.MinSize {
+		return nil
+	}
+
+	artifactMu.Lock()
+	artifactSequence++
+	sequence := artifactSequence
+	artifactMu.Unlock()
+
+	// Names sort by time and identify the tool, e.g. vm_list-20240102T150405Z-0001.json
+	timestamp := time.Now().UTC().Format("20060102T150405Z")
+	extension := ".txt"
+	if json.Valid([]byte(result)) {
+		extension = ".json"
+	}
+	fileName := fmt.Sprintf("%s-%s-%04d%s", toolName, timestamp, sequence, extension)
+
+	var locations []string
+	if dir != "" {
+		path, err := writeArtifactFile(dir, fileName, result)
+		if err != nil {
+			logMessage(LogWarning, "artifacts", "Failed to export %s result: %v", toolName, err)
+		} else {
+			locations = append(locations, path)
+		}
+	}
+	if namespace != "" {
+		name := fmt.Sprintf("kubevirt-mcp-%s-%s-%04d", strings.ReplaceAll(toolName, "_", "-"), strings.ToLower(timestamp), sequence)
+		if err := writeArtifactConfigMap(namespace, name, toolName, fileName, result); err != nil {
+			logMessage(LogWarning, "artifacts", "Failed to export %s result: %v", toolName, err)
+		} else {
+			locations = append(locations, "configmap/"+namespace+"/"+name)
+		}
+	}
+
+	for _, location := range locations {
+		logMessage(LogInfo, "artifacts", "Exported %s result to %s", toolName, location)
+	}
+	return locations
+}
+
+// writeArtifactFile writes the result into dir. A PVC mounted into the
+// server pod is exported to by pointing dir at its mount path.
+func writeArtifactFile(dir, fileName, result string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create artifacts directory: %v", err)
+	}
+	path := filepath.Join(dir, fileName)
+	if err := os.WriteFile(path, []byte(result), 0644); err != nil {
+		return "", fmt.Errorf("failed to write artifact: %v", err)
+	}
+	return path, nil
+}
+
+// writeArtifactConfigMap stores the result in a new ConfigMap, keyed by the
+// artifact file name
+func writeArtifactConfigMap(namespace, name, toolName, fileName, result string) error {
+	if len(result) > maxConfigMapArtifactSize {
+		return fmt.Errorf("result is %d bytes, larger than the %d bytes ConfigMap limit", len(result), maxConfigMapArtifactSize)
+	}
+	return createObject(context.Background(), map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+			"labels":    managedLabels(toolName, false),
+		},
+		"data": map[string]string{fileName: result},
+	})
+}
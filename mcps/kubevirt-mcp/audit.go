@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the audit log, see AuditConfig. Auditing
+// is enabled by setting a file, an Event namespace or both.
+const (
+	auditFileEnv      = "KUBEVIRT_MCP_AUDIT_FILE"
+	auditNamespaceEnv = "KUBEVIRT_MCP_AUDIT_NAMESPACE"
+	auditMaxSizeEnv   = "KUBEVIRT_MCP_AUDIT_MAX_SIZE"
+	auditMaxFilesEnv  = "KUBEVIRT_MCP_AUDIT_MAX_FILES"
+
+	// defaultAuditMaxSize is the size in MiB the audit file is rotated at
+	defaultAuditMaxSize = 100
+	// defaultAuditMaxFiles is the number of rotated audit files kept
+	defaultAuditMaxFiles = 5
+
+	// maxAuditEventMessage keeps the message of audit Events readable in
+	// kubectl get events, the file has the full record
+	maxAuditEventMessage = 1024
+
+	redacted = "[REDACTED]"
+)
+
+// AuditRecord is a line of the audit file, describing a tool call
+type AuditRecord struct {
+	Time       time.Time              `json:"time"`
+	Tool       string                 `json:"tool"`
+	Arguments  map[string]interface{} `json:"arguments,omitempty"`
+	Identity   string                 `json:"identity,omitempty"`
+	Session    string                 `json:"session"`
+	DurationMs int64                  `json:"duration_ms"`
+	ResultSize int                    `json:"result_size"`
+	ExitCode   *int                   `json:"exit_code,omitempty"`
+	ErrorCode  int                    `json:"error_code,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+var (
+	// secretArgumentPattern matches the names of arguments holding secrets,
+	// at any depth of the arguments
+	secretArgumentPattern = regexp.MustCompile(`(?i)(password|passwd|token|secret|passphrase|private_?key|userdata)`)
+	// secretLinePattern matches secrets in the lines of string arguments,
+	// e.g. the password of cloud-init user data or of a YAML manifest
+	secretLinePattern = regexp.MustCompile(`(?im)((password|passwd|token|secret|passphrase)\w*["']?\s*[:=]\s*).+$`)
+	// secretManifestPattern matches manifests of Secrets, recorded redacted
+	// as a whole
+	secretManifestPattern = regexp.MustCompile(`(?m)^\s*"?kind"?\s*:\s*"?Secret"?\s*,?\s*$`)
+)
+
+// auditLog is the audit file and the Events being created
+var auditLog struct {
+	sync.Mutex
+	file   *os.File
+	size   int64
+	events sync.WaitGroup
+}
+
+// startAudit opens the audit file when one is set, so a file that cannot
+// be written stops the server instead of calls going unrecorded
+func startAudit() error {
+	config := serverConfig.Audit
+	if config.File != "" {
+		if err := openAuditFile(); err != nil {
+			return err
+		}
+		logMessage(LogInfo, "audit", "Recording every tool call to %s", config.File)
+	}
+	if config.Namespace != "" {
+		logMessage(LogInfo, "audit", "Recording every tool call as an Event in namespace %s", config.Namespace)
+	}
+	return nil
+}
+
+// openAuditFile opens the audit file for appending, the caller holds the
+// lock once the server runs
+func openAuditFile() error {
+	path := expandHome(serverConfig.Audit.File)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create audit directory: %v", err)
+	}
+	// Arguments are redacted but still tell what agents did, keep them
+	// private to the server user
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit file: %v", err)
+	}
+	auditLog.file = file
+	auditLog.size = info.Size()
+	return nil
+}
+
+// closeAudit waits for the audit Events being created and closes the file
+func closeAudit() {
+	auditLog.events.Wait()
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if auditLog.file != nil {
+		auditLog.file.Close()
+		auditLog.file = nil
+	}
+}
+
+// auditToolCall records a tool call to the audit file and as an Event.
+// Audit failures are logged and never fail the tool call.
+func auditToolCall(ctx context.Context, req JSONRPCRequest, resp JSONRPCResponse, duration time.Duration) {
+	config := serverConfig.Audit
+	if config.File == "" && config.Namespace == "" {
+		return
+	}
+
+	var params struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	json.Unmarshal(req.Params, &params)
+	record := AuditRecord{
+		Time:       clock.Now().UTC(),
+		Tool:       params.Name,
+		Arguments:  redactArguments(params.Name, params.Arguments),
+		Identity:   identityName(ctx),
+		Session:    requestSession(ctx),
+		DurationMs: duration.Milliseconds(),
+	}
+	if resp.Error != nil {
+		record.ErrorCode = resp.Error.Code
+		record.Error = resp.Error.Message
+	} else {
+		text := resultText(resp)
+		record.ResultSize = len(text)
+		record.ExitCode = resultExitCode(text)
+	}
+
+	if config.File != "" {
+		if err := writeAuditRecord(record); err != nil {
+			logMessage(LogWarning, "audit", "Failed to record %s call: %v", record.Tool, err)
+		}
+	}
+	if config.Namespace != "" {
+		auditLog.events.Add(1)
+		go func() {
+			defer auditLog.events.Done()
+			if err := createAuditEvent(config.Namespace, record); err != nil {
+				logMessage(LogWarning, "audit", "Failed to record %s call as an Event: %v", record.Tool, err)
+			}
+		}()
+	}
+}
+
+// writeAuditRecord appends a record to the audit file, rotating it first
+// when the record would take it over the maximum size
+func writeAuditRecord(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %v", err)
+	}
+	line = append(line, '\n')
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if auditLog.file == nil {
+		return fmt.Errorf("audit file is closed")
+	}
+	maxSize := int64(serverConfig.Audit.MaxSize) * 1024 * 1024
+	if maxSize > 0 && auditLog.size > 0 && auditLog.size+int64(len(line)) > maxSize {
+		if err := rotateAuditFile(); err != nil {
+			return err
+		}
+	}
+	n, err := auditLog.file.Write(line)
+	auditLog.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit record: %v", err)
+	}
+	return nil
+}
+
+// rotateAuditFile renames the audit file to FILE.1, shifting the previous
+// rotated files up to maxFiles and deleting the oldest, then opens a new
+// file. The caller holds the lock.
+func rotateAuditFile() error {
+	path := expandHome(serverConfig.Audit.File)
+	maxFiles := serverConfig.Audit.MaxFiles
+	auditLog.file.Close()
+	auditLog.file = nil
+
+	if maxFiles < 1 {
+		os.Remove(path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", path, maxFiles))
+		for i := maxFiles - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		}
+		if err := os.Rename(path, path+".1"); err != nil {
+			logMessage(LogWarning, "audit", "Failed to rotate %s: %v", path, err)
+		}
+	}
+	return openAuditFile()
+}
+
+// createAuditEvent records a tool call as an Event of the audit namespace.
+// Events expire with the event TTL of the API server, one hour by default.
+func createAuditEvent(namespace string, record AuditRecord) error {
+	eventType, reason, outcome := "Normal", "ToolCall", "succeeded"
+	if record.ErrorCode != 0 {
+		eventType, reason, outcome = "Warning", "ToolCallFailed", "failed: "+record.Error
+	}
+	caller := record.Identity
+	if caller == "" {
+		caller = record.Session
+	}
+	arguments, _ := json.Marshal(record.Arguments)
+	message := fmt.Sprintf("%s called %s %s, %s in %dms", caller, record.Tool, arguments, outcome, record.DurationMs)
+	if len(message) > maxAuditEventMessage {
+		message = message[:maxAuditEventMessage-3] + "..."
+	}
+
+	timestamp := record.Time.Format(time.RFC3339)
+	ctx, cancel := clock.WithTimeout(context.Background(), timeoutFor(timeoutKubectl))
+	defer cancel()
+	return createObject(ctx, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]interface{}{
+			"name":      generateName("kubevirt-mcp-audit-"),
+			"namespace": namespace,
+			"labels":    managedLabels(record.Tool, false),
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"name":       namespace,
+		},
+		"type":               eventType,
+		"reason":             reason,
+		"message":            message,
+		"source":             map[string]interface{}{"component": managedByValue},
+		"reportingComponent": managedByValue,
+		"firstTimestamp":     timestamp,
+		"lastTimestamp":      timestamp,
+		"count":              1,
+	})
+}
+
+// auditSizeOnlyArguments are the arguments of tools recorded by size only:
+// the text typed on a console, where agents answer login and sudo
+// prompts, and the content of files written to guests, often keys
+var auditSizeOnlyArguments = map[string]string{
+	"vm_console_send": "text",
+	"vm_file_put":     "content",
+}
+
+// redactArguments returns a copy of tool arguments with secrets replaced:
+// arguments named like passwords or tokens, the data of Secret manifests,
+// password lines of strings such as cloud-init user data, and the typed
+// text and file contents of auditSizeOnlyArguments, recorded by size only
+func redactArguments(tool string, args map[string]interface{}) map[string]interface{} {
+	if args == nil {
+		return nil
+	}
+	copied := redactValue("", args).(map[string]interface{})
+	if name, ok := auditSizeOnlyArguments[tool]; ok {
+		if value, ok := args[name].(string); ok {
+			copied[name] = fmt.Sprintf("[%d bytes]", len(value))
+		}
+	}
+	return copied
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		secret := v["kind"] == "Secret"
+		for k, item := range v {
+			if secret && (k == "data" || k == "stringData") {
+				copied[k] = redacted
+				continue
+			}
+			copied[k] = redactValue(k, item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = redactValue(key, item)
+		}
+		return copied
+	case string:
+		switch {
+		case secretArgumentPattern.MatchString(key) && !strings.HasSuffix(key, "_file"):
+			return redacted
+		case key == "content":
+			return fmt.Sprintf("[%d bytes]", len(v))
+		case secretManifestPattern.MatchString(v):
+			return redacted
+		}
+		return secretLinePattern.ReplaceAllString(v, "${1}"+redacted)
+	}
+	if secretArgumentPattern.MatchString(key) && value != nil {
+		return redacted
+	}
+	return value
+}
+
+// resultText returns the text content of a tools/call response
+func resultText(resp JSONRPCResponse) string {
+	result, ok := resp.Result.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	content, _ := result["content"].([]map[string]interface{})
+	var text strings.Builder
+	for _, item := range content {
+		if s, ok := item["text"].(string); ok {
+			text.WriteString(s)
+		}
+	}
+	return text.String()
+}
+
+// resultExitCode returns the exit code of guest commands in a result, like
+// the exit_code of vm_exec; the first failing one of a batch
+func resultExitCode(text string) *int {
+	var single struct {
+		ExitCode *int `json:"exit_code"`
+	}
+	if json.Unmarshal([]byte(text), &single) == nil {
+		return single.ExitCode
+	}
+	var batch []struct {
+		ExitCode *int `json:"exit_code"`
+	}
+	if json.Unmarshal([]byte(text), &batch) != nil {
+		return nil
+	}
+	var code *int
+	for _, result := range batch {
+		if result.ExitCode == nil {
+			continue
+		}
+		if code == nil || (*code == 0 && *result.ExitCode != 0) {
+			code = result.ExitCode
+		}
+	}
+	return code
+}
+
+// readAuditRecords returns the records of the audit file and of the last
+// rotated one after a time, oldest first
+func readAuditRecords(after time.Time) []AuditRecord {
+	path := expandHome(serverConfig.Audit.File)
+	var records []AuditRecord
+	for _, file := range []string{path + ".1", path} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record AuditRecord
+			if json.Unmarshal(scanner.Bytes(), &record) == nil && record.Time.After(after) {
+				records = append(records, record)
+			}
+		}
+		f.Close()
+	}
+	return records
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// rpcBatch collects the responses to the messages of a JSON-RPC batch, sent
+// together as one array once every message of the batch is done
+type rpcBatch struct {
+	conn      *rpcWriter
+	mu        sync.Mutex
+	pending   int
+	responses []JSONRPCResponse
+}
+
+// newRPCBatch returns a batch waiting for size messages, answered on w
+func newRPCBatch(w *rpcWriter, size int) *rpcBatch {
+	return &rpcBatch{conn: w, pending: size}
+}
+
+// done records that a message of the batch is done, with its response or
+// nil for notifications and cancelled requests, and sends the responses
+// after the last one. A batch of notifications only gets no response.
+func (b *rpcBatch) done(resp *JSONRPCResponse) error {
+	b.mu.Lock()
+	if resp != nil {
+		b.responses = append(b.responses, *resp)
+	}
+	b.pending--
+	last := b.pending == 0
+	b.mu.Unlock()
+
+	if !last || len(b.responses) == 0 {
+		return nil
+	}
+	return b.conn.send(b.responses)
+}
+
+// sendResponse sends the response to a request, or adds it to the batch of
+// the request
+func sendResponse(req JSONRPCRequest, resp JSONRPCResponse) error {
+	if req.batch != nil {
+		return req.batch.done(&resp)
+	}
+	if req.conn == nil {
+		return output.send(resp)
+	}
+	return req.conn.send(resp)
+}
+
+// skipResponse marks a request that gets no response as done, so its batch
+// is not waiting for it
+func skipResponse(req JSONRPCRequest) {
+	if req.batch != nil {
+		if err := req.batch.done(nil); err != nil {
+			log.Printf("Failed to encode batch response: %v", err)
+		}
+	}
+}
+
+// decodeBatch splits a JSON-RPC batch into its messages, returning the error
+// to send back when it is not valid JSON or an empty array
+func decodeBatch(data []byte) ([]json.RawMessage, *RPCError) {
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, &RPCError{Code: -32700, Message: "Parse error: " + err.Error()}
+	}
+	if len(messages) == 0 {
+		return nil, &RPCError{Code: -32600, Message: "Invalid Request: empty batch"}
+	}
+	return messages, nil
+}
+
+// readBatch dispatches the messages of a JSON-RPC batch. Each request is
+// handled like a single one, concurrently with the others; invalid messages
+// are answered with an error in the batch response.
+func readBatch(data []byte, w *rpcWriter, requests chan<- JSONRPCRequest) {
+	messages, rpcErr := decodeBatch(data)
+	if rpcErr != nil {
+		log.Printf("Failed to decode JSON-RPC batch: %s", rpcErr.Message)
+		w.send(JSONRPCResponse{JSONRPC: "2.0", ID: nil, Error: rpcErr})
+		return
+	}
+	batch := newRPCBatch(w, len(messages))
+	for _, message := range messages {
+		dispatchMessage(message, w, batch, requests)
+	}
+}
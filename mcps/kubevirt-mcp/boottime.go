@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Boot milestones of vm_boot_time, in the order they normally happen
+const (
+	milestoneCreated       = "created"
+	milestonePodScheduled  = "pod_scheduled"
+	milestoneImagesPulled  = "images_pulled"
+	milestoneScheduled     = "scheduled"
+	milestoneRunning       = "running"
+	milestoneKernelBoot    = "guest_kernel_boot"
+	milestoneAgent         = "agent_connected"
+	milestoneCloudInitDone = "cloud_init_done"
+
+	// bootProbeTimeout bounds the guest probe, in seconds
+	bootProbeTimeout = 30
+
+	// bootProbeCommand prints the guest time, the uptime and when cloud-init
+	// last finished, all in seconds. It runs on busybox guests too.
+	bootProbeCommand = "date +%s; cut -d' ' -f1 /proc/uptime; stat -c %Y /var/lib/cloud/data/result.json 2>/dev/null || true"
+)
+
+var bootMilestones = []string{
+	milestoneCreated, milestonePodScheduled, milestoneImagesPulled, milestoneScheduled,
+	milestoneRunning, milestoneKernelBoot, milestoneAgent, milestoneCloudInitDone,
+}
+
+// VMBootTimeParams represents the parameters of vm_boot_time
+type VMBootTimeParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	VMName          string `json:"vm_name"`
+	Probe           *bool  `json:"probe,omitempty"`
+	Method          string `json:"method,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Format          string `json:"format,omitempty"`
+}
+
+// BootMilestone is one step of the boot of a VM. SinceCreated and Delta are
+// seconds from the creation of the VMI and from the previous milestone.
+type BootMilestone struct {
+	Milestone    string     `json:"milestone"`
+	Reached      bool       `json:"reached"`
+	Time         *time.Time `json:"time,omitempty"`
+	SinceCreated float64    `json:"sinceCreatedSeconds,omitempty"`
+	Delta        float64    `json:"deltaSeconds,omitempty"`
+	Source       string     `json:"source,omitempty"`
+}
+
+// VMBootTimeResult is the vm_boot_time tool result
+type VMBootTimeResult struct {
+	Namespace    string          `json:"namespace"`
+	VMName       string          `json:"vmName"`
+	Node         string          `json:"node,omitempty"`
+	Pod          string          `json:"pod,omitempty"`
+	TotalSeconds float64         `json:"totalSeconds"`
+	Milestones   []BootMilestone `json:"milestones"`
+	Notes        []string        `json:"notes,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_boot_time",
+		Description: "Measure the boot of the current VMI of a VM: created, launcher pod scheduled, images pulled, scheduled, running, guest kernel boot, guest agent connected and cloud-init done, from the VMI status, pod events and a guest probe, with the time between milestones",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+				"probe": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Run a command in the guest for the kernel boot and cloud-init milestones",
+					"default":     true,
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "Execution method of the guest probe",
+					"enum":        []string{"auto", "agent", "ssh", "console"},
+					"default":     "auto",
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"credentials_file": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMBootTime,
+	})
+}
+
+// handleVMBootTime is the tools/call handler for vm_boot_time
+func handleVMBootTime(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMBootTimeParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := measureBootTime(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// measureBootTime collects the milestones of the current VMI
+func measureBootTime(ctx context.Context, params VMBootTimeParams) (*VMBootTimeResult, error) {
+	var vmi VirtualMachineInstance
+	found, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", params.VMName, params.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("VM %s/%s has no VMI, start it first", params.Namespace, params.VMName)
+	}
+
+	result := &VMBootTimeResult{Namespace: params.Namespace, VMName: params.VMName, Node: vmi.Status.NodeName}
+	times := map[string]time.Time{milestoneCreated: vmi.Metadata.CreationTimestamp}
+	sources := map[string]string{milestoneCreated: "vmi"}
+	set := func(milestone, source string, t time.Time) {
+		if !t.IsZero() {
+			times[milestone] = t
+			sources[milestone] = source
+		}
+	}
+
+	for _, transition := range vmi.Status.PhaseTransitionTimestamps {
+		switch transition.Phase {
+		case "Scheduled":
+			set(milestoneScheduled, "vmi phase", transition.PhaseTransitionTimestamp)
+		case "Running":
+			set(milestoneRunning, "vmi phase", transition.PhaseTransitionTimestamp)
+		}
+	}
+	for _, cond := range vmi.Status.Conditions {
+		if cond.Type == "AgentConnected" && cond.Status == "True" {
+			set(milestoneAgent, "vmi condition", cond.LastTransitionTime)
+		}
+	}
+
+	reportProgress(ctx, "reading launcher pod events")
+	pod, events, err := launcherPodEvents(ctx, &vmi)
+	if err != nil {
+		result.Notes = append(result.Notes, fmt.Sprintf("pod milestones unavailable: %v", err))
+	} else {
+		result.Pod = pod
+		var pulled time.Time
+		for _, e := range events {
+			switch e.Reason {
+			case "Scheduled":
+				set(milestonePodScheduled, "pod event", e.firstSeen())
+			case "Pulled":
+				if e.lastSeen().After(pulled) {
+					pulled = e.lastSeen()
+				}
+			}
+		}
+		set(milestoneImagesPulled, "pod event", pulled)
+		if len(events) == 0 {
+			result.Notes = append(result.Notes, "the launcher pod has no events left, they expire after an hour by default")
+		}
+	}
+
+	if params.Probe == nil || *params.Probe {
+		if vmi.Status.Phase != "Running" {
+			result.Notes = append(result.Notes, fmt.Sprintf("guest not probed, the VMI is %s", vmi.Status.Phase))
+		} else {
+			reportProgress(ctx, "probing the guest")
+			kernelBoot, cloudInitDone, err := probeGuestBoot(ctx, params)
+			if err != nil {
+				result.Notes = append(result.Notes, fmt.Sprintf("guest probe failed: %v", err))
+			}
+			set(milestoneKernelBoot, "guest uptime", kernelBoot)
+			set(milestoneCloudInitDone, "guest", cloudInitDone)
+		}
+	}
+
+	result.Milestones = bootTimeline(times, sources)
+	for _, m := range result.Milestones {
+		if m.Reached {
+			result.TotalSeconds = m.SinceCreated
+		}
+	}
+	return result, nil
+}
+
+// launcherPodEvents returns the name and events of the first virt-launcher
+// pod of the VMI, the one it booted in even when it migrated since
+func launcherPodEvents(ctx context.Context, vmi *VirtualMachineInstance) (string, []Event, error) {
+	var pods PodList
+	if err := runKubectlJSON(ctx, &pods, "get", "pods", "-n", vmi.Metadata.Namespace, "-l", "kubevirt.io/created-by="+vmi.Metadata.UID); err != nil {
+		return "", nil, err
+	}
+	if len(pods.Items) == 0 {
+		return "", nil, fmt.Errorf("no virt-launcher pod found for VMI '%s'", vmi.Metadata.Name)
+	}
+	first := pods.Items[0]
+	for _, pod := range pods.Items[1:] {
+		if pod.Metadata.CreationTimestamp.Before(first.Metadata.CreationTimestamp) {
+			first = pod
+		}
+	}
+
+	var events struct {
+		Items []Event `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &events, "get", "events", "-n", vmi.Metadata.Namespace, "--field-selector", "involvedObject.name="+first.Metadata.Name); err != nil {
+		return "", nil, err
+	}
+	return first.Metadata.Name, events.Items, nil
+}
+
+// probeGuestBoot runs bootProbeCommand in the guest. The kernel boot is the
+// probe time minus the guest uptime, so it does not depend on the guest
+// clock but is late by the time vm-exec took to return. cloud-init is only
+// done when it finished after the kernel boot, an older result.json is left
+// from a previous boot.
+func probeGuestBoot(ctx context.Context, params VMBootTimeParams) (time.Time, time.Time, error) {
+	result, err := runGuestCommand(ctx, VMExecParams{
+		Namespace:       params.Namespace,
+		VMName:          params.VMName,
+		Command:         bootProbeCommand,
+		Timeout:         bootProbeTimeout,
+		Method:          params.Method,
+		Username:        params.Username,
+		Password:        params.Password,
+		CredentialsFile: params.CredentialsFile,
+	})
+	now := clock.Now()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	lines := strings.Fields(result.Stdout)
+	if len(lines) < 2 {
+		return time.Time{}, time.Time{}, fmt.Errorf("unexpected probe output %q", result.Stdout)
+	}
+	guestNow, err := strconv.ParseInt(lines[0], 10, 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unexpected guest time %q", lines[0])
+	}
+	uptime, err := strconv.ParseFloat(lines[1], 64)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unexpected guest uptime %q", lines[1])
+	}
+	kernelBoot := now.Add(-time.Duration(uptime * float64(time.Second))).Truncate(time.Second)
+
+	var cloudInitDone time.Time
+	if len(lines) > 2 {
+		finished, err := strconv.ParseInt(lines[2], 10, 64)
+		if err != nil {
+			return kernelBoot, time.Time{}, fmt.Errorf("unexpected cloud-init result time %q", lines[2])
+		}
+		// Seconds after the kernel boot on the guest clock
+		afterBoot := float64(finished) - (float64(guestNow) - uptime)
+		if afterBoot >= 0 {
+			cloudInitDone = kernelBoot.Add(time.Duration(afterBoot * float64(time.Second))).Truncate(time.Second)
+		}
+	}
+	return kernelBoot, cloudInitDone, nil
+}
+
+// bootTimeline orders the reached milestones by time, followed by the ones
+// not reached
+func bootTimeline(times map[string]time.Time, sources map[string]string) []BootMilestone {
+	created := times[milestoneCreated]
+	var reached, missing []BootMilestone
+	for _, name := range bootMilestones {
+		t, ok := times[name]
+		if !ok {
+			missing = append(missing, BootMilestone{Milestone: name})
+			continue
+		}
+		reached = append(reached, BootMilestone{
+			Milestone:    name,
+			Reached:      true,
+			Time:         &t,
+			SinceCreated: t.Sub(created).Seconds(),
+			Source:       sources[name],
+		})
+	}
+	sort.SliceStable(reached, func(i, j int) bool { return reached[i].Time.Before(*reached[j].Time) })
+	for i := 1; i < len(reached); i++ {
+		reached[i].Delta = reached[i].Time.Sub(*reached[i-1].Time).Seconds()
+	}
+	return append(reached, missing...)
+}
+
+// tables renders the result for the text format
+func (r *VMBootTimeResult) tables() []table {
+	milestones := table{
+		title:   fmt.Sprintf("Boot of %s/%s on %s in %.0fs", r.Namespace, r.VMName, r.Node, r.TotalSeconds),
+		headers: []string{"MILESTONE", "TIME", "SINCE CREATED", "DELTA", "SOURCE"},
+	}
+	for _, m := range r.Milestones {
+		if !m.Reached {
+			milestones.rows = append(milestones.rows, []string{m.Milestone, "not reached", "", "", ""})
+			continue
+		}
+		milestones.rows = append(milestones.rows, []string{
+			m.Milestone,
+			m.Time.UTC().Format(time.RFC3339),
+			fmt.Sprintf("%.0fs", m.SinceCreated),
+			fmt.Sprintf("+%.0fs", m.Delta),
+			m.Source,
+		})
+	}
+	tables := []table{milestones}
+	if len(r.Notes) > 0 {
+		notes := table{title: "Notes", headers: []string{"NOTE"}}
+		for _, note := range r.Notes {
+			notes.rows = append(notes.rows, []string{note})
+		}
+		tables = append(tables, notes)
+	}
+	return tables
+}
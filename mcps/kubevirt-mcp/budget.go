@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Environment variables configuring the context budget of tool results, see
+// BudgetConfig. The budget is enabled by setting a maximum number of tokens.
+const (
+	maxResultTokensEnv  = "KUBEVIRT_MCP_MAX_RESULT_TOKENS"
+	budgetStrategiesEnv = "KUBEVIRT_MCP_BUDGET_STRATEGIES"
+	budgetHeadRatioEnv  = "KUBEVIRT_MCP_BUDGET_HEAD_RATIO"
+
+	// charsPerToken is a rough estimate that holds for English text and JSON
+	charsPerToken = 4
+
+	// Budget strategies, applied in the configured order until the result fits
+	budgetDedup    = "dedup"
+	budgetHeadTail = "head-tail"
+
+	defaultBudgetHeadRatio = 0.3
+)
+
+// contextBudget shrinks verbose tool results so they fit in the context
+// window of the client's model
+type contextBudget struct {
+	maxChars   int
+	strategies []string
+	headRatio  float64
+}
+
+// loadContextBudget reads the budget configuration, it returns nil when no
+// budget is configured
+func loadContextBudget() *contextBudget {
+	config := serverConfig.Budget
+	if config.MaxResultTokens <= 0 {
+		return nil
+	}
+
+	budget := &contextBudget{maxChars: config.MaxResultTokens * charsPerToken, headRatio: defaultBudgetHeadRatio}
+
+	for _, strategy := range config.Strategies {
+		if strategy != budgetDedup && strategy != budgetHeadTail {
+			logMessage(LogWarning, "budget", "Ignoring unknown budget strategy %q", strategy)
+			continue
+		}
+		budget.strategies = append(budget.strategies, strategy)
+	}
+
+	if ratio := config.HeadRatio; ratio < 0 || ratio > 1 {
+		logMessage(LogWarning, "budget", "Ignoring invalid head ratio %v", ratio)
+	} else {
+		budget.headRatio = ratio
+	}
+	return budget
+}
+
+// apply shrinks the result with the configured strategies until it fits.
+// note is appended when the result was shrunk, e.g. where the full result
+// was exported to.
+func (b *contextBudget) apply(result, note string) string {
+	if b == nil || len(result) <= b.maxChars {
+		return result
+	}
+
+	original := len(result)
+	for _, strategy := range b.strategies {
+		switch strategy {
+		case budgetDedup:
+			result = dedupLines(result)
+		case budgetHeadTail:
+			result = headTail(result, b.maxChars, b.headRatio)
+		}
+		if len(result) <= b.maxChars {
+			break
+		}
+	}
+
+	summary := fmt.Sprintf("[result reduced from %d to %d characters to fit %s=%d", original, len(result), maxResultTokensEnv, b.maxChars/charsPerToken)
+	if note != "" {
+		summary += ", " + note
+	}
+	return result + "\n" + summary + "]"
+}
+
+// dedupLines collapses runs of identical lines, typical of repeated events
+// and log messages, into one line with a repeat count
+func dedupLines(text string) string {
+	lines := strings.Split(text, "\n")
+	var out []string
+	for i := 0; i < len(lines); {
+		j := i + 1
+		for j < len(lines) && lines[j] == lines[i] {
+			j++
+		}
+		if repeats := j - i; repeats > 1 && strings.TrimSpace(lines[i]) != "" {
+			out = append(out, fmt.Sprintf("%s [repeated %d times]", lines[i], repeats))
+		} else {
+			out = append(out, lines[i:j]...)
+		}
+		i = j
+	}
+	return strings.Join(out, "\n")
+}
+
+// headTail keeps whole lines from the start and the end of the text within
+// maxChars, the head getting headRatio of the room. The tail usually holds
+// the most recent events and log lines, so it gets the rest.
+func headTail(text string, maxChars int, headRatio float64) string {
+	if len(text) <= maxChars {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	headRoom := int(float64(maxChars) * headRatio)
+	tailRoom := maxChars - headRoom
+
+	head := 0
+	for used := 0; head < len(lines) && used+len(lines[head])+1 <= headRoom; head++ {
+		used += len(lines[head]) + 1
+	}
+	tail := len(lines)
+	for used := 0; tail > head && used+len(lines[tail-1])+1 <= tailRoom; tail-- {
+		used += len(lines[tail-1]) + 1
+	}
+
+	omitted := tail - head
+	if omitted <= 0 {
+		return text
+	}
+	if omitted == len(lines) {
+		// Nothing but very long lines, cut them by characters instead
+		cut := len(text) - headRoom - tailRoom
+		return strings.ToValidUTF8(text[:headRoom]+fmt.Sprintf("... %d characters omitted ...", cut)+text[len(text)-tailRoom:], "")
+	}
+	kept := append(append([]string{}, lines[:head]...), fmt.Sprintf("... %d lines omitted ...", omitted))
+	return strings.Join(append(kept, lines[tail:]...), "\n")
+}
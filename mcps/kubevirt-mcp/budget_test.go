@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDedupLines(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"a\nb\nc", "a\nb\nc"},
+		{"a\na\na\nb", "a [repeated 3 times]\nb"},
+		{"a\nb\na", "a\nb\na"},
+		{"a\n\n\nb", "a\n\n\nb"},
+		{"x\nevent\nevent\n", "x\nevent [repeated 2 times]\n"},
+	}
+	for _, tt := range tests {
+		if got := dedupLines(tt.text); got != tt.want {
+			t.Errorf("dedupLines(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	const lines = "a\nb\nc\nd\ne\nf"
+	tests := []struct {
+		name      string
+		text      string
+		maxChars  int
+		headRatio float64
+		want      string
+	}{
+		{"fits", lines, 11, 0.3, lines},
+		{"head and tail", lines, 6, 0.5, "a\n... 4 lines omitted ...\nf"},
+		{"tail only", lines, 6, 0, "... 3 lines omitted ...\nd\ne\nf"},
+		{"head only", lines, 6, 1, "a\nb\nc\n... 3 lines omitted ..."},
+		{"long line", strings.Repeat("x", 20), 10, 0.3, "xxx... 10 characters omitted ...xxxxxxx"},
+		{"long line cut within a rune", strings.Repeat("é", 10), 5, 0.5, "é... 15 characters omitted ...é"},
+	}
+	for _, tt := range tests {
+		if got := headTail(tt.text, tt.maxChars, tt.headRatio); got != tt.want {
+			t.Errorf("%s: headTail() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContextBudgetApply(t *testing.T) {
+	budget := &contextBudget{maxChars: 40, strategies: []string{budgetDedup, budgetHeadTail}, headRatio: 0.5}
+	numbered := "line 1\nline 2\nline 3\nline 4\nline 5\nline 6\nline 7\nline 8\nline 9"
+	tests := []struct {
+		name   string
+		budget *contextBudget
+		result string
+		note   string
+		want   string
+	}{
+		{"no budget", nil, numbered, "", numbered},
+		{"fits", budget, "short", "", "short"},
+		{
+			"dedup is enough", budget, strings.TrimSuffix(strings.Repeat("same event line\n", 10), "\n"), "",
+			"same event line [repeated 10 times]\n[result reduced from 159 to 35 characters to fit KUBEVIRT_MCP_MAX_RESULT_TOKENS=10]",
+		},
+		{
+			"head and tail with a note", budget, numbered, "full result in /tmp/result.json",
+			"line 1\nline 2\n... 5 lines omitted ...\nline 8\nline 9\n[result reduced from 62 to 51 characters to fit KUBEVIRT_MCP_MAX_RESULT_TOKENS=10, full result in /tmp/result.json]",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.budget.apply(tt.result, tt.note); got != tt.want {
+			t.Errorf("%s: apply() =\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadContextBudget(t *testing.T) {
+	previous := serverConfig
+	t.Cleanup(func() { serverConfig = previous })
+
+	serverConfig = defaultServerConfig()
+	if budget := loadContextBudget(); budget != nil {
+		t.Fatalf("loadContextBudget() = %+v without a maximum", budget)
+	}
+
+	serverConfig.Budget = BudgetConfig{MaxResultTokens: 100, Strategies: stringList{budgetHeadTail, "summarize", budgetDedup}, HeadRatio: 2}
+	want := &contextBudget{maxChars: 400, strategies: []string{budgetHeadTail, budgetDedup}, headRatio: defaultBudgetHeadRatio}
+	if got := loadContextBudget(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("loadContextBudget() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// inFlight holds the cancel functions of the requests being handled, keyed
+// by connection and request ID. A client can reuse the ID of a request that
+// is still running, so a key holds the cancel functions of all of them.
+var inFlight = struct {
+	sync.Mutex
+	cancels map[string][]*context.CancelFunc
+}{cancels: map[string][]*context.CancelFunc{}}
+
+// connKey is the context key of the stream a request was read from
+type connKey struct{}
+
+// requestKey normalizes a JSON-RPC ID, which can be a number or a string,
+// scoped to the stream of the request since clients of the listener choose
+// their IDs independently
+func requestKey(conn *rpcWriter, id interface{}) string {
+	return fmt.Sprintf("%p/%T:%v", conn, id, id)
+}
+
+// requestConn returns the stream a request was read from, stdout when the
+// request did not come from one
+func requestConn(ctx context.Context) *rpcWriter {
+	if conn, ok := ctx.Value(connKey{}).(*rpcWriter); ok && conn != nil {
+		return conn
+	}
+	return output
+}
+
+// startRequest returns the context of a request, derived from the context
+// of its stream and cancelled when the client cancels the request. done must
+// be called once the request is handled.
+func startRequest(parent context.Context, req JSONRPCRequest) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.WithValue(parent, connKey{}, req.conn))
+	if req.ID == nil {
+		return ctx, cancel
+	}
+
+	key := requestKey(req.conn, req.ID)
+	entry := &cancel
+	inFlight.Lock()
+	inFlight.cancels[key] = append(inFlight.cancels[key], entry)
+	inFlight.Unlock()
+
+	return ctx, func() {
+		inFlight.Lock()
+		var kept []*context.CancelFunc
+		for _, other := range inFlight.cancels[key] {
+			if other != entry {
+				kept = append(kept, other)
+			}
+		}
+		if len(kept) == 0 {
+			delete(inFlight.cancels, key)
+		} else {
+			inFlight.cancels[key] = kept
+		}
+		inFlight.Unlock()
+		cancel()
+	}
+}
+
+// isCancellation reports whether a message cancels an earlier request, using
+// either the MCP notifications/cancelled or the LSP style $/cancelRequest
+func isCancellation(req JSONRPCRequest) bool {
+	return req.Method == "notifications/cancelled" || req.Method == "$/cancelRequest"
+}
+
+// cancelRequest cancels the request named by a cancellation message, all of
+// them when the ID is in use more than once. Unknown or already finished
+// requests are ignored.
+func cancelRequest(req JSONRPCRequest) {
+	var params struct {
+		RequestID interface{} `json:"requestId"`
+		ID        interface{} `json:"id"`
+		Reason    string      `json:"reason,omitempty"`
+	}
+	json.Unmarshal(req.Params, &params)
+
+	id := params.RequestID
+	if id == nil {
+		id = params.ID
+	}
+	if id == nil {
+		return
+	}
+
+	inFlight.Lock()
+	cancels := inFlight.cancels[requestKey(req.conn, id)]
+	inFlight.Unlock()
+	if len(cancels) == 0 {
+		return
+	}
+
+	logMessage(LogInfo, "cancel", "Cancelling request %v: %s", id, params.Reason)
+	for _, cancel := range cancels {
+		(*cancel)()
+	}
+}
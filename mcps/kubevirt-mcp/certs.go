@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// kubeVirtCAName is both the secret holding the current KubeVirt CA and
+	// the configmap holding the bundle of current and previous CAs
+	kubeVirtCAName = "kubevirt-ca"
+	// subresourcesAPIService is the aggregated API serving console, VNC and
+	// the other subresources, backed by virt-api
+	subresourcesAPIService = "v1.subresources.kubevirt.io"
+	// rotationOverdueFraction is the share of a certificate's lifetime left
+	// below which rotation is considered stuck. virt-operator renews
+	// certificates well before, at 80% of their lifetime by default.
+	rotationOverdueFraction = 0.1
+)
+
+// requiredCertSecrets are the certificates console and subresource access
+// depend on
+var requiredCertSecrets = []string{kubeVirtCAName, "kubevirt-virt-api-certs", "kubevirt-virt-handler-server-certs", "kubevirt-virt-handler-certs"}
+
+// Certificate status values
+const (
+	certOK              = "ok"
+	certRotationOverdue = "rotation-overdue"
+	certExpired         = "expired"
+	certNotYetValid     = "not-yet-valid"
+	certUntrusted       = "untrusted"
+	certInvalid         = "invalid"
+)
+
+// KubeVirtCertsParams represents the parameters of kubevirt_certs
+type KubeVirtCertsParams struct {
+	Format string `json:"format,omitempty"`
+}
+
+// KubeVirtCertificate is a certificate generated by virt-operator
+type KubeVirtCertificate struct {
+	Source    string     `json:"source"`
+	Subject   string     `json:"subject,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	DNSNames  []string   `json:"dnsNames,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+	Remaining string     `json:"remaining,omitempty"`
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// CertRotateStrategy is the self signed certificate rotation configured in
+// the KubeVirt CR, empty fields mean the virt-operator default
+type CertRotateStrategy struct {
+	CADuration        string `json:"caDuration,omitempty"`
+	CARenewBefore     string `json:"caRenewBefore,omitempty"`
+	ServerDuration    string `json:"serverDuration,omitempty"`
+	ServerRenewBefore string `json:"serverRenewBefore,omitempty"`
+}
+
+// KubeVirtCertsResult is the kubevirt_certs tool result
+type KubeVirtCertsResult struct {
+	Namespace      string                `json:"namespace"`
+	Healthy        bool                  `json:"healthy"`
+	Problems       []string              `json:"problems,omitempty"`
+	RotateStrategy CertRotateStrategy    `json:"rotateStrategy"`
+	Certificates   []KubeVirtCertificate `json:"certificates"`
+}
+
+type certSecret struct {
+	Metadata ObjectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+type apiService struct {
+	Spec struct {
+		CABundle string `json:"caBundle,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []Condition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "kubevirt_certs",
+		Description: "Check the certificates virt-operator generates for virt-api, virt-handler, virt-controller and the subresources aggregated API: expiry, stuck rotation and whether the CA bundles still trust them. Expired or untrusted certificates silently break console, VNC and other subresource access",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleKubeVirtCerts,
+	})
+}
+
+// handleKubeVirtCerts is the tools/call handler for kubevirt_certs
+func handleKubeVirtCerts(ctx context.Context, args json.RawMessage) (string, error) {
+	var params KubeVirtCertsParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	result, err := kubeVirtCerts(ctx)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// kubeVirtCerts inspects the certificate secrets of the KubeVirt namespace,
+// the CA bundle configmap and the caBundle of the subresources APIService
+func kubeVirtCerts(ctx context.Context) (*KubeVirtCertsResult, error) {
+	reportProgress(ctx, "reading the KubeVirt CR")
+	kv, kvRaw, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespace := kv.Metadata.Namespace
+	selfSigned := nestedMap(kvRaw, "spec", "certificateRotateStrategy", "selfSigned")
+	result := &KubeVirtCertsResult{
+		Namespace: namespace,
+		RotateStrategy: CertRotateStrategy{
+			CADuration:        stringField(nestedMap(selfSigned, "ca"), "duration"),
+			CARenewBefore:     stringField(nestedMap(selfSigned, "ca"), "renewBefore"),
+			ServerDuration:    stringField(nestedMap(selfSigned, "server"), "duration"),
+			ServerRenewBefore: stringField(nestedMap(selfSigned, "server"), "renewBefore"),
+		},
+	}
+	now := clock.Now()
+
+	reportProgress(ctx, "reading certificate secrets in %s", namespace)
+	var secrets struct {
+		Items []certSecret `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &secrets, "get", "secrets", "-n", namespace); err != nil {
+		return nil, err
+	}
+	sort.Slice(secrets.Items, func(i, j int) bool {
+		return secrets.Items[i].Metadata.Name < secrets.Items[j].Metadata.Name
+	})
+
+	var bundle []*x509.Certificate
+	var cm struct {
+		Data map[string]string `json:"data,omitempty"`
+	}
+	found, err := getOptionalObject(ctx, &cm, "configmap", kubeVirtCAName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		result.Problems = append(result.Problems, fmt.Sprintf("configmap %s not found, components cannot verify each other", kubeVirtCAName))
+	} else if bundle, err = parseCertificates([]byte(cm.Data["ca-bundle"])); err != nil || len(bundle) == 0 {
+		result.Problems = append(result.Problems, fmt.Sprintf("configmap %s has no valid ca-bundle", kubeVirtCAName))
+	}
+	for _, cert := range bundle {
+		result.Certificates = append(result.Certificates, checkCertificate("configmap/"+kubeVirtCAName, cert, false, now))
+	}
+
+	seen := map[string]bool{}
+	certs := map[string]*x509.Certificate{}
+	for _, secret := range secrets.Items {
+		name := secret.Metadata.Name
+		encoded, ok := secret.Data["tls.crt"]
+		if !ok || !strings.HasPrefix(name, "kubevirt-") {
+			continue
+		}
+		seen[name] = true
+		entry := KubeVirtCertificate{Source: "secret/" + name}
+		pemData, err := base64.StdEncoding.DecodeString(encoded)
+		var parsed []*x509.Certificate
+		if err == nil {
+			parsed, err = parseCertificates(pemData)
+		}
+		if err != nil || len(parsed) == 0 {
+			entry.Status = certInvalid
+			entry.Message = "tls.crt holds no valid certificate"
+			if err != nil {
+				entry.Message = err.Error()
+			}
+			result.Certificates = append(result.Certificates, entry)
+			continue
+		}
+		certs[name] = parsed[0]
+		entry = checkCertificate(entry.Source, parsed[0], true, now)
+		// Export certificates are signed by their own kubevirt-export-ca
+		if entry.Status == certOK && found && name != kubeVirtCAName && !strings.Contains(name, "export") {
+			if err := verifyCertificate(parsed[0], parsed[1:], bundle, now); err != nil {
+				entry.Status = certUntrusted
+				entry.Message = fmt.Sprintf("not trusted by configmap/%s: %v", kubeVirtCAName, err)
+			}
+		}
+		result.Certificates = append(result.Certificates, entry)
+	}
+	for _, name := range requiredCertSecrets {
+		if !seen[name] {
+			result.Problems = append(result.Problems, fmt.Sprintf("secret %s not found", name))
+		}
+	}
+
+	reportProgress(ctx, "checking the %s APIService", subresourcesAPIService)
+	if err := checkSubresourcesAPIService(ctx, result, certs["kubevirt-virt-api-certs"], now); err != nil {
+		return nil, err
+	}
+
+	for _, cert := range result.Certificates {
+		if cert.Status != certOK {
+			problem := fmt.Sprintf("%s: %s", cert.Source, cert.Status)
+			if cert.Message != "" {
+				problem += ", " + cert.Message
+			}
+			result.Problems = append(result.Problems, problem)
+		}
+	}
+	result.Healthy = len(result.Problems) == 0
+	return result, nil
+}
+
+// checkSubresourcesAPIService reports the CA the API server uses to reach
+// virt-api and whether it still trusts the virt-api certificate
+func checkSubresourcesAPIService(ctx context.Context, result *KubeVirtCertsResult, virtAPI *x509.Certificate, now time.Time) error {
+	output, err := runKubectl(ctx, "get", "apiservice", subresourcesAPIService, "--ignore-not-found", "-o", "json")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(output)) == "" {
+		result.Problems = append(result.Problems, fmt.Sprintf("APIService %s not found", subresourcesAPIService))
+		return nil
+	}
+	var svc apiService
+	if err := json.Unmarshal(output, &svc); err != nil {
+		return fmt.Errorf("failed to parse kubectl output: %v", err)
+	}
+	for _, cond := range svc.Status.Conditions {
+		if cond.Type == "Available" && cond.Status != "True" {
+			result.Problems = append(result.Problems, fmt.Sprintf("APIService %s is not available: %s", subresourcesAPIService, cond.Message))
+		}
+	}
+
+	source := "apiservice/" + subresourcesAPIService
+	pemData, err := base64.StdEncoding.DecodeString(svc.Spec.CABundle)
+	var bundle []*x509.Certificate
+	if err == nil {
+		bundle, err = parseCertificates(pemData)
+	}
+	if err != nil || len(bundle) == 0 {
+		result.Certificates = append(result.Certificates, KubeVirtCertificate{Source: source, Status: certInvalid, Message: "caBundle holds no valid certificate"})
+		return nil
+	}
+	for _, cert := range bundle {
+		result.Certificates = append(result.Certificates, checkCertificate(source, cert, false, now))
+	}
+	if virtAPI != nil {
+		if err := verifyCertificate(virtAPI, nil, bundle, now); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("APIService %s caBundle does not trust the virt-api certificate: %v", subresourcesAPIService, err))
+		}
+	}
+	return nil
+}
+
+// checkCertificate reports the validity window of cert and whether it is
+// expired or, for the current certificate of a secret, should have been
+// rotated already. Bundles keep previous CAs around until they expire.
+func checkCertificate(source string, cert *x509.Certificate, current bool, now time.Time) KubeVirtCertificate {
+	entry := KubeVirtCertificate{
+		Source:    source,
+		Subject:   cert.Subject.CommonName,
+		Issuer:    cert.Issuer.CommonName,
+		DNSNames:  cert.DNSNames,
+		NotBefore: &cert.NotBefore,
+		NotAfter:  &cert.NotAfter,
+		Remaining: humanDuration(cert.NotAfter.Sub(now)),
+		Status:    certOK,
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	switch {
+	case now.After(cert.NotAfter):
+		entry.Status = certExpired
+		entry.Message = fmt.Sprintf("expired %s ago", humanDuration(now.Sub(cert.NotAfter)))
+	case now.Before(cert.NotBefore):
+		entry.Status = certNotYetValid
+		entry.Message = fmt.Sprintf("valid in %s, check the node clocks", humanDuration(cert.NotBefore.Sub(now)))
+	case current && float64(cert.NotAfter.Sub(now)) < float64(lifetime)*rotationOverdueFraction:
+		entry.Status = certRotationOverdue
+		entry.Message = fmt.Sprintf("%s of a %s lifetime left, virt-operator should have renewed it", entry.Remaining, humanDuration(lifetime))
+	}
+	return entry
+}
+
+// verifyCertificate checks that cert chains up to one of the CAs
+func verifyCertificate(cert *x509.Certificate, intermediates, cas []*x509.Certificate, now time.Time) error {
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, ca := range cas {
+		opts.Roots.AddCert(ca)
+	}
+	for _, intermediate := range intermediates {
+		opts.Intermediates.AddCert(intermediate)
+	}
+	_, err := cert.Verify(opts)
+	return err
+}
+
+// parseCertificates parses the PEM encoded certificates of data, skipping
+// other blocks such as keys
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// stringField returns the string value of key, or "" when missing
+func stringField(obj map[string]interface{}, key string) string {
+	s, _ := obj[key].(string)
+	return s
+}
+
+// tables renders the certificate report as an overview followed by the
+// certificates
+func (r *KubeVirtCertsResult) tables() []table {
+	overview := table{title: "KubeVirt certificates " + r.Namespace, headers: []string{"FIELD", "VALUE"}}
+	overview.rows = append(overview.rows, []string{"Healthy", strconv.FormatBool(r.Healthy)})
+	for _, setting := range [][2]string{
+		{"CA duration", r.RotateStrategy.CADuration},
+		{"CA renew before", r.RotateStrategy.CARenewBefore},
+		{"Server duration", r.RotateStrategy.ServerDuration},
+		{"Server renew before", r.RotateStrategy.ServerRenewBefore},
+	} {
+		if setting[1] == "" {
+			setting[1] = "default"
+		}
+		overview.rows = append(overview.rows, []string{setting[0], setting[1]})
+	}
+	for _, problem := range r.Problems {
+		overview.rows = append(overview.rows, []string{"Problem", problem})
+	}
+
+	certs := table{title: "Certificates", headers: []string{"SOURCE", "SUBJECT", "ISSUER", "NOT AFTER", "REMAINING", "STATUS", "MESSAGE"}}
+	for _, c := range r.Certificates {
+		notAfter := ""
+		if c.NotAfter != nil {
+			notAfter = c.NotAfter.UTC().Format(time.RFC3339)
+		}
+		certs.rows = append(certs.rows, []string{c.Source, c.Subject, c.Issuer, notAfter, c.Remaining, c.Status, c.Message})
+	}
+	return []table{overview, certs}
+}
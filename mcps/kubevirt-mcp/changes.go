@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVMChangesSince = "1h"
+
+	// maxChangeFields bounds the fields listed per change
+	maxChangeFields = 20
+
+	// changeEventWindow is how long after a change the events it caused are
+	// related to it
+	changeEventWindow = time.Minute
+	// changeAuditSlack widens the span of an audited call when relating it
+	// to changes, managedFields timestamps have a one second precision
+	changeAuditSlack = time.Second
+)
+
+// Sources of the changes of a VM
+const (
+	changeFromObject    = "object"
+	changeFromFields    = "managedFields"
+	changeFromRevision  = "controllerRevision"
+	changeFromEvents    = "event"
+	changeFromAuditFile = "audit"
+)
+
+// VMChangesParams represents the parameters of vm_changes
+type VMChangesParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Since     string `json:"since,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// VMChange is a change of a VM or an event about it
+type VMChange struct {
+	Time    time.Time `json:"time"`
+	Age     string    `json:"age,omitempty"`
+	Source  string    `json:"source"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Fields  []string  `json:"fields,omitempty"`
+	Message string    `json:"message,omitempty"`
+	// Related are the events following a change and the audited tool calls
+	// that made it
+	Related []string `json:"related,omitempty"`
+}
+
+// VMChangesResult is the vm_changes tool result
+type VMChangesResult struct {
+	Namespace  string     `json:"namespace"`
+	VMName     string     `json:"vmName"`
+	Since      string     `json:"since"`
+	Generation int64      `json:"generation"`
+	Actors     []string   `json:"actors"`
+	Changes    []VMChange `json:"changes"`
+	Notes      []string   `json:"notes,omitempty"`
+}
+
+// managedFieldsEntry is an entry of metadata.managedFields, the last write
+// of a field manager with an operation
+type managedFieldsEntry struct {
+	Manager     string                 `json:"manager"`
+	Operation   string                 `json:"operation"`
+	Subresource string                 `json:"subresource,omitempty"`
+	Time        time.Time              `json:"time"`
+	FieldsV1    map[string]interface{} `json:"fieldsV1,omitempty"`
+}
+
+// controllerRevision is a ControllerRevision, KubeVirt keeps one per VM
+// start and instance type or preference in use
+type controllerRevision struct {
+	Metadata struct {
+		ObjectMeta
+		OwnerReferences []struct {
+			UID string `json:"uid"`
+		} `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+	Revision int64                  `json:"revision"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_changes",
+		Description: "Report who and what changed a VM recently: the field managers of its managedFields with the fields they own and when they last wrote them, its controller revisions, the audited tool calls of this server and the events that followed, as one timeline. Use it to answer \"who modified this VM in the last hour\"",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"since": map[string]interface{}{
+					"type":        "string",
+					"description": "Only report changes after this RFC 3339 timestamp or within this duration",
+					"default":     defaultVMChangesSince,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMChanges,
+	})
+}
+
+// handleVMChanges is the tools/call handler for vm_changes
+func handleVMChanges(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMChangesParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Since == "" {
+		params.Since = defaultVMChangesSince
+	}
+	after, err := parseSince(params.Since)
+	if err != nil {
+		return "", &invalidParamsError{err: err}
+	}
+
+	result, err := vmChanges(ctx, params, after)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// vmChanges builds the timeline of the changes of a VM since after
+func vmChanges(ctx context.Context, params VMChangesParams, after time.Time) (*VMChangesResult, error) {
+	reportProgress(ctx, "reading %s/%s", params.Namespace, params.VMName)
+	var vm struct {
+		Metadata struct {
+			ObjectMeta
+			Generation    int64                `json:"generation"`
+			ManagedFields []managedFieldsEntry `json:"managedFields,omitempty"`
+		} `json:"metadata"`
+	}
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+
+	result := &VMChangesResult{
+		Namespace:  params.Namespace,
+		VMName:     params.VMName,
+		Since:      params.Since,
+		Generation: vm.Metadata.Generation,
+		Actors:     []string{},
+		Changes:    []VMChange{},
+	}
+	var changes []VMChange
+	created := vm.Metadata.CreationTimestamp.After(after)
+	for _, entry := range vm.Metadata.ManagedFields {
+		if !entry.Time.After(after) {
+			continue
+		}
+		action := entry.Operation
+		if entry.Subresource != "" {
+			action += " (" + entry.Subresource + ")"
+		}
+		// The write creating the VM is the only one at its creation time
+		if created && entry.Time.Equal(vm.Metadata.CreationTimestamp) {
+			action, created = "Created ("+action+")", false
+		}
+		fields := managedFieldPaths(entry.FieldsV1, "")
+		if len(fields) > maxChangeFields {
+			fields = append(fields[:maxChangeFields], fmt.Sprintf("and %d more", len(fields)-maxChangeFields))
+		}
+		changes = append(changes, VMChange{Time: entry.Time, Source: changeFromFields, Actor: entry.Manager, Action: action, Fields: fields})
+	}
+	if created {
+		changes = append(changes, VMChange{Time: vm.Metadata.CreationTimestamp, Source: changeFromObject, Action: "Created"})
+	}
+
+	reportProgress(ctx, "reading controller revisions")
+	var revisions struct {
+		Items []controllerRevision `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &revisions, "get", "controllerrevisions", "-n", params.Namespace); err != nil {
+		result.Notes = append(result.Notes, fmt.Sprintf("Controller revisions unavailable: %v", err))
+	}
+	for _, revision := range revisions.Items {
+		if !revision.Metadata.CreationTimestamp.After(after) || !ownedByUID(revision.Metadata.OwnerReferences, vm.Metadata.UID) {
+			continue
+		}
+		action := "Revision " + strconv.FormatInt(revision.Revision, 10)
+		if strings.HasPrefix(revision.Metadata.Name, "revision-start-vm-") {
+			action = "Started with generation " + strconv.FormatInt(revision.Revision, 10)
+		}
+		changes = append(changes, VMChange{Time: revision.Metadata.CreationTimestamp, Source: changeFromRevision, Actor: "virt-controller", Action: action, Message: revision.Metadata.Name})
+	}
+
+	events, err := vmEvents(ctx, VMEventsParams{Namespace: params.Namespace, VMName: params.VMName, Limit: maxRecordedHistory}, after)
+	if err != nil {
+		result.Notes = append(result.Notes, fmt.Sprintf("Events unavailable: %v", err))
+		events = &VMEventsResult{}
+	}
+	var eventChanges []VMChange
+	for _, event := range events.Events {
+		eventChanges = append(eventChanges, VMChange{Time: event.LastSeen, Source: changeFromEvents, Actor: event.Object, Action: event.Type + " " + event.Reason, Message: event.Message})
+	}
+
+	var audited []VMChange
+	var spans []time.Duration
+	if serverConfig.Audit.File != "" {
+		for _, record := range readAuditRecords(after) {
+			if readOnlyTools[record.Tool] || record.ErrorCode != 0 || !auditedVMCall(record, params.Namespace, params.VMName) {
+				continue
+			}
+			actor := record.Identity
+			if actor == "" {
+				actor = record.Session
+			}
+			arguments, _ := json.Marshal(record.Arguments)
+			audited = append(audited, VMChange{Time: record.Time, Source: changeFromAuditFile, Actor: actor, Action: record.Tool, Message: string(arguments)})
+			spans = append(spans, time.Duration(record.DurationMs)*time.Millisecond)
+		}
+	} else {
+		result.Notes = append(result.Notes, "Tool calls of this server are not audited, set --audit-file to relate changes to the agents that made them")
+	}
+
+	// Each change is related to the events that followed it and to the
+	// audited calls running when it was written
+	for i := range changes {
+		change := &changes[i]
+		for _, event := range eventChanges {
+			if !event.Time.Before(change.Time.Add(-changeAuditSlack)) && event.Time.Before(change.Time.Add(changeEventWindow)) {
+				change.Related = append(change.Related, fmt.Sprintf("%s %s: %s", event.Actor, event.Action, event.Message))
+			}
+		}
+		for j, call := range audited {
+			start := call.Time.Add(-spans[j] - changeAuditSlack)
+			if !change.Time.Before(start) && !change.Time.After(call.Time.Add(changeAuditSlack)) {
+				change.Related = append(change.Related, fmt.Sprintf("%s called %s", call.Actor, call.Action))
+			}
+		}
+	}
+
+	changes = append(changes, audited...)
+	changes = append(changes, eventChanges...)
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time.Before(changes[j].Time) })
+
+	actors := map[string]bool{}
+	for _, change := range changes {
+		if change.Source != changeFromEvents && change.Actor != "" && !actors[change.Actor] {
+			actors[change.Actor] = true
+			result.Actors = append(result.Actors, change.Actor)
+		}
+		change.Age = since(change.Time)
+		result.Changes = append(result.Changes, change)
+	}
+	sort.Strings(result.Actors)
+
+	result.Notes = append(result.Notes, "managedFields keeps only the last write of each field manager and operation, earlier writes of the same manager are not listed")
+	return result, nil
+}
+
+// managedFieldPaths returns the field paths of a fieldsV1 set, such as
+// spec.runStrategy or metadata.annotations.kubevirt.io/foo. Items of
+// lists are written [key=value] when keyed, [value] for sets.
+func managedFieldPaths(fields map[string]interface{}, prefix string) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var paths []string
+	for _, key := range keys {
+		if key == "." {
+			continue
+		}
+		var name string
+		switch {
+		case strings.HasPrefix(key, "f:"):
+			name = strings.TrimPrefix(key, "f:")
+			if prefix != "" {
+				name = "." + name
+			}
+		case strings.HasPrefix(key, "k:"):
+			var item map[string]interface{}
+			json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &item)
+			parts := make([]string, 0, len(item))
+			for field, value := range item {
+				parts = append(parts, fmt.Sprintf("%s=%v", field, value))
+			}
+			sort.Strings(parts)
+			name = "[" + strings.Join(parts, ",") + "]"
+		case strings.HasPrefix(key, "v:"):
+			name = "[" + strings.TrimPrefix(key, "v:") + "]"
+		default:
+			name = "[" + key + "]"
+		}
+
+		children, _ := fields[key].(map[string]interface{})
+		nested := managedFieldPaths(children, prefix+name)
+		if len(nested) == 0 {
+			paths = append(paths, prefix+name)
+		}
+		paths = append(paths, nested...)
+	}
+	return paths
+}
+
+// ownedByUID reports whether owner references include uid
+func ownedByUID(owners []struct {
+	UID string `json:"uid"`
+}, uid string) bool {
+	for _, owner := range owners {
+		if owner.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// auditedVMCall reports whether an audited tool call targeted a VM
+func auditedVMCall(record AuditRecord, namespace, vmName string) bool {
+	name, _ := record.Arguments["vm_name"].(string)
+	if name == "" && strings.HasPrefix(record.Tool, "vm_") {
+		// vm_create and vm_delete name the VM with name
+		name, _ = record.Arguments["name"].(string)
+	}
+	if name != vmName {
+		return false
+	}
+	ns, _ := record.Arguments["namespace"].(string)
+	if ns == "" {
+		ns = "default"
+	}
+	return ns == namespace
+}
+
+// tables renders the timeline oldest first
+func (r *VMChangesResult) tables() []table {
+	timeline := table{
+		title:   fmt.Sprintf("Changes of %s/%s since %s (generation %d)", r.Namespace, r.VMName, r.Since, r.Generation),
+		headers: []string{"AGE", "SOURCE", "ACTOR", "ACTION", "FIELDS", "DETAILS"},
+	}
+	for _, change := range r.Changes {
+		details := change.Message
+		if len(change.Related) > 0 {
+			if details != "" {
+				details += "; "
+			}
+			details += "related: " + strings.Join(change.Related, "; ")
+		}
+		fields := change.Fields
+		if len(fields) > 3 {
+			fields = append(fields[:3:3], fmt.Sprintf("and %d more", len(change.Fields)-3))
+		}
+		timeline.rows = append(timeline.rows, []string{change.Age, change.Source, change.Actor, change.Action, strings.Join(fields, ", "), details})
+	}
+	tables := []table{timeline}
+	if len(r.Notes) > 0 {
+		notes := table{title: "Notes", headers: []string{"NOTE"}}
+		for _, note := range r.Notes {
+			notes.rows = append(notes.rows, []string{note})
+		}
+		tables = append(tables, notes)
+	}
+	return tables
+}
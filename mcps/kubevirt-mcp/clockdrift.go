@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClockDriftThresholdMs = 1000
+	defaultClockDriftParallelism = 5
+	maxClockDriftParallelism     = 20
+
+	// guestClockCommand prints the guest time and whether the guest clock is
+	// synchronized, by systemd-timesyncd or chrony. busybox date has no %N,
+	// the time is then whole seconds.
+	guestClockCommand = `date +%s.%N; (timedatectl show -p NTPSynchronized --value 2>/dev/null || chronyc -n tracking 2>/dev/null | sed -n 's/^Leap status *: //p') | head -n 1`
+)
+
+// ClockDriftParams represents the parameters of vm_clock_drift
+type ClockDriftParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	AllNamespaces   bool   `json:"all_namespaces,omitempty"`
+	VMName          string `json:"vm_name,omitempty"`
+	LabelSelector   string `json:"label_selector,omitempty"`
+	ThresholdMs     int    `json:"threshold_ms,omitempty"`
+	Parallelism     int    `json:"parallelism,omitempty"`
+	Method          string `json:"method,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Format          string `json:"format,omitempty"`
+}
+
+// VMClockDrift is the clock of one VM compared with its node
+type VMClockDrift struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Node      string `json:"node,omitempty"`
+	// DriftMs is the guest time minus the node time, UncertaintyMs the
+	// error of the measurement caused by the round trips
+	DriftMs       float64 `json:"driftMs"`
+	UncertaintyMs float64 `json:"uncertaintyMs"`
+	NTP           string  `json:"ntp,omitempty"`
+	Status        string  `json:"status"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// ClockDriftResult is the vm_clock_drift tool result
+type ClockDriftResult struct {
+	ThresholdMs int            `json:"thresholdMs"`
+	Checked     int            `json:"checked"`
+	Drifting    int            `json:"drifting"`
+	Failed      int            `json:"failed"`
+	VMs         []VMClockDrift `json:"vms"`
+	Note        string         `json:"note,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_clock_drift",
+		Description: "Compare the guest clock of running VMs with the clock of their node and flag drift beyond a threshold, e.g. after pause/resume or migrations, along with the guest NTP synchronization state",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VMs",
+					"default":     "default",
+				},
+				"all_namespaces": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Check running VMs across all namespaces",
+					"default":     false,
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Check only this VM",
+				},
+				"label_selector": map[string]interface{}{
+					"type":        "string",
+					"description": "Label selector of the VMIs to check (e.g. 'app=web')",
+				},
+				"threshold_ms": map[string]interface{}{
+					"type":        "integer",
+					"description": "Drift in milliseconds beyond which a VM is flagged, on top of the measurement uncertainty (default: 1000)",
+					"default":     defaultClockDriftThresholdMs,
+				},
+				"parallelism": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("Number of VMs checked at the same time, at most %d (default: %d)", maxClockDriftParallelism, defaultClockDriftParallelism),
+					"default":     defaultClockDriftParallelism,
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "Execution method of the guest command reading the clock; agent has the smallest uncertainty",
+					"enum":        []string{"auto", "agent", "ssh", "console"},
+					"default":     "auto",
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"credentials_file": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleClockDrift,
+	})
+}
+
+// handleClockDrift is the tools/call handler for vm_clock_drift
+func handleClockDrift(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ClockDriftParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.ThresholdMs < 0 {
+		return "", &invalidParamsError{err: errors.New("threshold_ms cannot be negative")}
+	}
+	if params.Parallelism < 0 || params.Parallelism > maxClockDriftParallelism {
+		return "", &invalidParamsError{err: fmt.Errorf("parallelism must be between 1 and %d", maxClockDriftParallelism)}
+	}
+	if params.VMName != "" && params.AllNamespaces {
+		return "", &invalidParamsError{err: errors.New("vm_name and all_namespaces are mutually exclusive")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.ThresholdMs == 0 {
+		params.ThresholdMs = defaultClockDriftThresholdMs
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = defaultClockDriftParallelism
+	}
+
+	result, err := checkClockDrift(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// checkClockDrift measures the clock drift of the selected running VMIs
+// with a pool of workers. A VM that cannot be measured is reported as
+// failed and does not stop the others.
+func checkClockDrift(ctx context.Context, params ClockDriftParams) (*ClockDriftResult, error) {
+	var vmis []VirtualMachineInstance
+	if params.VMName != "" {
+		vmi, err := getRunningVMIObject(ctx, params.Namespace, params.VMName)
+		if err != nil {
+			return nil, err
+		}
+		vmis = append(vmis, *vmi)
+	} else {
+		var list VirtualMachineInstanceList
+		args := append([]string{"get", "virtualmachineinstances"}, namespaceArgs(params.Namespace, params.AllNamespaces)...)
+		if params.LabelSelector != "" {
+			args = append(args, "-l", params.LabelSelector)
+		}
+		if err := runKubectlJSON(ctx, &list, args...); err != nil {
+			return nil, err
+		}
+		for _, vmi := range list.Items {
+			if vmi.Status.Phase == "Running" {
+				vmis = append(vmis, vmi)
+			}
+		}
+	}
+	sort.Slice(vmis, func(i, j int) bool {
+		a, b := vmis[i].Metadata, vmis[j].Metadata
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	result := &ClockDriftResult{ThresholdMs: params.ThresholdMs, VMs: make([]VMClockDrift, len(vmis))}
+	if len(vmis) == 0 {
+		result.Note = "no running VM matched"
+		return result, nil
+	}
+
+	reportProgress(ctx, "reading the clocks of %d VMs", len(vmis))
+	indexes := make(chan int)
+	var workers sync.WaitGroup
+	for i := 0; i < min(params.Parallelism, len(vmis)); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indexes {
+				result.VMs[i] = measureClockDrift(ctx, params, &vmis[i])
+			}
+		}()
+	}
+	for i := range vmis {
+		indexes <- i
+	}
+	close(indexes)
+	workers.Wait()
+
+	for _, vm := range result.VMs {
+		switch vm.Status {
+		case "drift":
+			result.Drifting++
+			result.Checked++
+		case "ok":
+			result.Checked++
+		default:
+			result.Failed++
+		}
+	}
+	if result.Drifting > 0 {
+		result.Note = "a guest clock off its node breaks TLS, token expiry and log correlation; check the guest NTP service, or restart chronyd after a pause or migration"
+	}
+	return result, nil
+}
+
+// measureClockDrift compares the guest clock with the node clock, read in
+// the virt-launcher pod. Each clock is compared with the local clock at the
+// middle of its round trip, half of the round trip being the uncertainty.
+func measureClockDrift(ctx context.Context, params ClockDriftParams, vmi *VirtualMachineInstance) VMClockDrift {
+	drift := VMClockDrift{Namespace: vmi.Metadata.Namespace, Name: vmi.Metadata.Name, Node: vmi.Status.NodeName, Status: "error"}
+
+	pod, err := launcherPodOf(ctx, vmi)
+	if err != nil {
+		drift.Error = err.Error()
+		return drift
+	}
+	before := clock.Now()
+	output, err := runKubectl(ctx, "exec", pod.Metadata.Name, "-n", vmi.Metadata.Namespace, "-c", computeContainer, "--", "date", "+%s.%N")
+	after := clock.Now()
+	if err != nil {
+		drift.Error = fmt.Sprintf("failed to read the node clock: %v", err)
+		return drift
+	}
+	nodeTime, _, ok := parseEpoch(strings.TrimSpace(string(output)))
+	if !ok {
+		drift.Error = fmt.Sprintf("unexpected node date output %q", strings.TrimSpace(string(output)))
+		return drift
+	}
+	nodeOffset, nodeUncertainty := clockOffset(nodeTime, before, after)
+
+	before = clock.Now()
+	guest, err := runGuestCommand(ctx, VMExecParams{
+		Namespace:       vmi.Metadata.Namespace,
+		VMName:          vmi.Metadata.Name,
+		Command:         guestClockCommand,
+		Timeout:         30,
+		Method:          params.Method,
+		Username:        params.Username,
+		Password:        params.Password,
+		CredentialsFile: params.CredentialsFile,
+	})
+	after = clock.Now()
+	if err != nil {
+		drift.Error = fmt.Sprintf("failed to read the guest clock: %v", err)
+		return drift
+	}
+	lines := strings.Split(strings.TrimSpace(guest.Stdout), "\n")
+	guestTime, precision, ok := parseEpoch(strings.TrimSpace(lines[0]))
+	if !ok {
+		drift.Error = fmt.Sprintf("unexpected guest date output %q", lines[0])
+		return drift
+	}
+	guestOffset, guestUncertainty := clockOffset(guestTime, before, after)
+	guestUncertainty += precision
+
+	drift.DriftMs = round2(milliseconds(guestOffset - nodeOffset))
+	drift.UncertaintyMs = round2(milliseconds(nodeUncertainty + guestUncertainty))
+	if len(lines) > 1 {
+		drift.NTP = ntpState(strings.TrimSpace(lines[1]))
+	}
+	drift.Status = "ok"
+	if math.Abs(drift.DriftMs) > float64(params.ThresholdMs)+drift.UncertaintyMs {
+		drift.Status = "drift"
+	}
+	return drift
+}
+
+// clockOffset returns how far a remote clock read between before and after
+// is ahead of the local clock, and the uncertainty of that offset
+func clockOffset(remote, before, after time.Time) (time.Duration, time.Duration) {
+	roundTrip := after.Sub(before)
+	return remote.Sub(before.Add(roundTrip / 2)), roundTrip / 2
+}
+
+// parseEpoch parses the output of date +%s.%N and returns its precision.
+// Dates without %N support print it as is, the time is then whole seconds.
+func parseEpoch(value string) (time.Time, time.Duration, bool) {
+	seconds, fraction, _ := strings.Cut(value, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	nsec, err := strconv.ParseInt((fraction + "000000000")[:9], 10, 64)
+	if err != nil || fraction == "" {
+		return time.Unix(sec, 0), time.Second, true
+	}
+	return time.Unix(sec, nsec), 0, true
+}
+
+// ntpState renders the timedatectl or chronyc output as synchronized,
+// unsynchronized or unknown
+func ntpState(value string) string {
+	switch value {
+	case "yes", "Normal":
+		return "synchronized"
+	case "no", "Not synchronised":
+		return "unsynchronized"
+	}
+	return "unknown"
+}
+
+// tables renders the clock of every VM as a table
+func (r *ClockDriftResult) tables() []table {
+	title := fmt.Sprintf("Clock drift (threshold %dms): %d checked, %d drifting, %d failed", r.ThresholdMs, r.Checked, r.Drifting, r.Failed)
+	vms := table{title: title, headers: []string{"NAMESPACE", "NAME", "NODE", "DRIFT", "UNCERTAINTY", "NTP", "STATUS", "ERROR"}}
+	for _, vm := range r.VMs {
+		driftMs, uncertainty := "", ""
+		if vm.Status != "error" {
+			driftMs = fmt.Sprintf("%+.1fms", vm.DriftMs)
+			uncertainty = fmt.Sprintf("±%.1fms", vm.UncertaintyMs)
+		}
+		vms.rows = append(vms.rows, []string{vm.Namespace, vm.Name, vm.Node, driftMs, uncertainty, vm.NTP, vm.Status, vm.Error})
+	}
+	return []table{vms}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clustersEnv points to the YAML file of the cluster registry, like
+// detection.clusters in the configuration file and the --clusters flag
+const clustersEnv = "KUBEVIRT_MCP_CLUSTERS"
+
+// defaultClustersFile is the cluster registry read from the state directory
+// when none is configured
+const defaultClustersFile = "clusters.yaml"
+
+// Cluster types of registered clusters
+const (
+	clusterTypeKubevirtci = "kubevirtci"
+	clusterTypeKubernetes = "kubernetes"
+	clusterTypeOpenShift  = "openshift"
+)
+
+// clusterTarget selects the kubeconfig and context a tool call runs against.
+// Registered clusters also carry their type, docs folder and default
+// namespace, and whether they were reachable at startup.
+type clusterTarget struct {
+	Name       string `yaml:"name" json:"name"`
+	Kubeconfig string `yaml:"kubeconfig" json:"kubeconfig"`
+	Context    string `yaml:"context,omitempty" json:"context,omitempty"`
+	Type       string `yaml:"type,omitempty" json:"type,omitempty"`
+	Docs       string `yaml:"docs,omitempty" json:"docs,omitempty"`
+	Namespace  string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+
+	Reachable bool   `yaml:"-" json:"reachable"`
+	Problem   string `yaml:"-" json:"problem,omitempty"`
+}
+
+type clusterKey struct{}
+
+// clusters is the registry of named clusters, loaded once at startup
+var clusters = map[string]clusterTarget{}
+
+// clustersPath returns the cluster registry file, the configured one or
+// clusters.yaml in the state directory when it exists
+func clustersPath() string {
+	if path := serverConfig.Detection.Clusters; path != "" {
+		return expandHome(path)
+	}
+	path := filepath.Join(stateDir(), defaultClustersFile)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// loadClusters reads the cluster registry, e.g.
+//
+//	clusters:
+//	  - name: kubevirtci
+//	    kubeconfig: ~/kubevirt/_ci-configs/k8s-1.30/.kubeconfig
+//	    type: kubevirtci
+//	  - name: staging
+//	    kubeconfig: ~/.kube/config
+//	    context: admin
+//	    type: openshift
+//	    docs: ~/project/openshift-docs/virt
+//	    namespace: vm-tests
+//
+// Entries that cannot be used are left out with a warning, the remaining
+// ones are validated by validateClusters.
+func loadClusters() map[string]clusterTarget {
+	registry := map[string]clusterTarget{}
+	path := clustersPath()
+	if path == "" {
+		return registry
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logMessage(LogWarning, "clusters", "Ignoring %s: %v", path, err)
+		return registry
+	}
+	var file struct {
+		Clusters []clusterTarget `yaml:"clusters"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		logMessage(LogWarning, "clusters", "Ignoring %s: %v", path, err)
+		return registry
+	}
+	for _, cluster := range file.Clusters {
+		if cluster.Name == "" || cluster.Kubeconfig == "" {
+			logMessage(LogWarning, "clusters", "Ignoring cluster without name or kubeconfig in %s", path)
+			continue
+		}
+		if _, ok := registry[cluster.Name]; ok {
+			logMessage(LogWarning, "clusters", "Ignoring duplicate cluster '%s' in %s", cluster.Name, path)
+			continue
+		}
+		switch cluster.Type {
+		case "", clusterTypeKubevirtci, clusterTypeKubernetes, clusterTypeOpenShift:
+		default:
+			logMessage(LogWarning, "clusters", "Ignoring cluster '%s' in %s: unknown type '%s', use %s, %s or %s",
+				cluster.Name, path, cluster.Type, clusterTypeKubevirtci, clusterTypeKubernetes, clusterTypeOpenShift)
+			continue
+		}
+		cluster.Kubeconfig = expandHome(cluster.Kubeconfig)
+		cluster.Docs = expandHome(cluster.Docs)
+		registry[cluster.Name] = cluster
+	}
+	return validateClusters(registry)
+}
+
+// expandHome replaces a leading ~ with the home directory
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, path[2:])
+}
+
+// contextProperty is the input schema of the context argument, added to
+// every tool
+func contextProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": "Cluster to run against: a registered cluster or a context of the detected kubeconfig (default: its current context)",
+	}
+}
+
+// clusterProperty is the input schema of the cluster argument, added to
+// every tool
+func clusterProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": "Registered cluster to run against, see cluster_list. Its default namespace applies when namespace is not set",
+	}
+}
+
+// withCluster returns a context selecting the cluster named by the cluster
+// or context argument of a tool call
+func withCluster(ctx context.Context, args json.RawMessage) (context.Context, error) {
+	var params struct {
+		Cluster string `json:"cluster"`
+		Context string `json:"context"`
+	}
+	json.Unmarshal(args, &params)
+	if params.Cluster != "" {
+		if params.Context != "" && params.Context != params.Cluster {
+			return nil, &invalidParamsError{err: fmt.Errorf("cluster and context select different clusters, set only one")}
+		}
+		cluster, ok := clusters[params.Cluster]
+		if !ok {
+			return nil, &invalidParamsError{err: fmt.Errorf("unknown cluster '%s', see cluster_list", params.Cluster)}
+		}
+		return context.WithValue(ctx, clusterKey{}, cluster), nil
+	}
+	if params.Context == "" {
+		return ctx, nil
+	}
+
+	if cluster, ok := clusters[params.Context]; ok {
+		return context.WithValue(ctx, clusterKey{}, cluster), nil
+	}
+
+	kubeconfig := findKubeconfigPath()
+	contexts, err := kubeconfigContexts(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range contexts {
+		if name == params.Context {
+			return context.WithValue(ctx, clusterKey{}, clusterTarget{Name: name, Kubeconfig: kubeconfig, Context: name}), nil
+		}
+	}
+	return nil, &invalidParamsError{err: fmt.Errorf("unknown cluster or context '%s'", params.Context)}
+}
+
+// selectedCluster returns the cluster selected for the tool call, if any
+func selectedCluster(ctx context.Context) (clusterTarget, bool) {
+	cluster, ok := ctx.Value(clusterKey{}).(clusterTarget)
+	return cluster, ok
+}
+
+// clusterArguments sets the namespace argument of a tool call to the
+// default namespace of the caller identity, else of the selected registered
+// cluster, else the configured default namespace, when the tool takes a namespace and the call does not
+// set one
+func clusterArguments(ctx context.Context, tool Tool, args json.RawMessage) json.RawMessage {
+	namespace := serverConfig.DefaultNamespace
+	if cluster, ok := selectedCluster(ctx); ok && cluster.Namespace != "" {
+		namespace = cluster.Namespace
+	}
+	if identity, ok := callerIdentity(ctx); ok && identity.defaultNamespace() != "" {
+		namespace = identity.defaultNamespace()
+	}
+	if namespace == "" {
+		return args
+	}
+	if properties, ok := tool.InputSchema["properties"].(map[string]interface{}); !ok || properties["namespace"] == nil {
+		return args
+	}
+
+	fields := map[string]json.RawMessage{}
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &fields); err != nil {
+			return args
+		}
+	}
+	if namespace, ok := fields["namespace"]; ok && string(namespace) != `""` && string(namespace) != "null" {
+		return args
+	}
+	fields["namespace"], _ = json.Marshal(namespace)
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		return args
+	}
+	return updated
+}
+
+// kubeconfigArgs returns the kubectl and vm-exec flags selecting the cluster
+// of the tool call. Without one the detected kubeconfig is used, and without
+// a kubeconfig in-cluster authentication.
+func kubeconfigArgs(ctx context.Context) []string {
+	cluster, ok := selectedCluster(ctx)
+	if !ok {
+		if kubeconfig := findKubeconfigPath(); kubeconfig != "" {
+			return []string{"--kubeconfig", kubeconfig}
+		}
+		return nil
+	}
+	args := []string{"--kubeconfig", cluster.Kubeconfig}
+	if cluster.Context != "" {
+		args = append(args, "--context", cluster.Context)
+	}
+	return args
+}
+
+// kubeconfigContexts lists the context names of a kubeconfig
+func kubeconfigContexts(kubeconfig string) ([]string, error) {
+	args := []string{"config", "get-contexts", "-o", "name"}
+	if kubeconfig != "" {
+		args = append(args, "--kubeconfig", kubeconfig)
+	}
+	output, err := commandOutput(context.Background(), exec.Command("kubectl", args...), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list kubeconfig contexts: %v", err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// ClusterListResult is the cluster_list tool result
+type ClusterListResult struct {
+	Kubeconfig     string          `json:"kubeconfig,omitempty"`
+	CurrentContext string          `json:"currentContext,omitempty"`
+	Contexts       []string        `json:"contexts"`
+	Clusters       []clusterTarget `json:"clusters"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "cluster_list",
+		Description: "List the clusters the server can drive: the contexts of the detected kubeconfig and the registered clusters with their type, docs folder, default namespace and whether they were reachable at startup. Pass a registered cluster as the cluster argument, or a context as the context argument, of any tool",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		Handler: handleClusterList,
+	})
+}
+
+// handleClusterList is the tools/call handler for cluster_list
+func handleClusterList(ctx context.Context, args json.RawMessage) (string, error) {
+	result := &ClusterListResult{Kubeconfig: findKubeconfigPath(), Contexts: []string{}, Clusters: []clusterTarget{}}
+
+	contexts, err := kubeconfigContexts(result.Kubeconfig)
+	if err != nil {
+		return "", err
+	}
+	result.Contexts = append(result.Contexts, contexts...)
+
+	currentArgs := []string{"config", "current-context"}
+	if result.Kubeconfig != "" {
+		currentArgs = append(currentArgs, "--kubeconfig", result.Kubeconfig)
+	}
+	if output, err := commandOutput(ctx, exec.Command("kubectl", currentArgs...), false); err == nil {
+		result.CurrentContext = strings.TrimSpace(string(output))
+	}
+
+	for _, cluster := range clusters {
+		result.Clusters = append(result.Clusters, cluster)
+	}
+	sort.Slice(result.Clusters, func(i, j int) bool { return result.Clusters[i].Name < result.Clusters[j].Name })
+	return formatJSON(result)
+}
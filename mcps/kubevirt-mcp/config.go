@@ -0,0 +1,617 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnv points to the YAML configuration file, like the --config flag
+const configEnv = "KUBEVIRT_MCP_CONFIG"
+
+const (
+	defaultNamespaceEnv = "KUBEVIRT_MCP_DEFAULT_NAMESPACE"
+	docsKubernetesEnv   = "KUBEVIRT_MCP_DOCS_KUBERNETES"
+	docsOpenShiftEnv    = "KUBEVIRT_MCP_DOCS_OPENSHIFT"
+)
+
+// ServerConfig is the configuration of the server. Every setting is read
+// from the configuration file, a command line flag and an environment
+// variable, the environment taking precedence over flags and flags over the
+// file.
+type ServerConfig struct {
+	MaxConcurrency   int    `yaml:"maxConcurrency"`
+	StateDir         string `yaml:"stateDir"`
+	VMExecPath       string `yaml:"vmExecPath"`
+	DefaultNamespace string `yaml:"defaultNamespace"`
+
+	Docs      DocsConfig       `yaml:"docs"`
+	Detection DetectionConfig  `yaml:"detection"`
+	Tools     ToolPolicy       `yaml:"tools"`
+	Timeouts  timeoutOverrides `yaml:"timeouts"`
+	Budget    BudgetConfig     `yaml:"budget"`
+	Artifacts ArtifactsConfig  `yaml:"artifacts"`
+	Fixtures  FixturesConfig   `yaml:"fixtures"`
+	Monitor   MonitorConfig    `yaml:"monitor"`
+	GC        GCConfig         `yaml:"gc"`
+	Sessions  SessionsConfig   `yaml:"sessions"`
+	Console   ConsoleConfig    `yaml:"console"`
+	History   HistoryConfig    `yaml:"history"`
+	HTTP      HTTPConfig       `yaml:"http"`
+	Listen    string           `yaml:"listen"`
+
+	Credentials CredentialsConfig `yaml:"credentials"`
+	Policy      PolicyConfig      `yaml:"policy"`
+	Exec        ExecPolicyConfig  `yaml:"exec"`
+	Audit       AuditConfig       `yaml:"audit"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Simulation  SimulationConfig  `yaml:"simulation"`
+
+	SnapshotSchedules SnapshotSchedulesConfig `yaml:"snapshotSchedules"`
+	RestartWindow     RestartWindowConfig     `yaml:"restartWindow"`
+	Output            OutputConfig            `yaml:"output"`
+	DNS               DNSConfig               `yaml:"dns"`
+}
+
+// DocsConfig overrides the docs folders of config.json
+type DocsConfig struct {
+	Kubernetes string `yaml:"kubernetes"`
+	OpenShift  string `yaml:"openshift"`
+}
+
+// DetectionConfig configures where clusters are looked for. The kubeconfig
+// and kubevirtci settings default to the standard environment variables.
+type DetectionConfig struct {
+	Clusters         string `yaml:"clusters"`
+	Kubeconfig       string `yaml:"kubeconfig"`
+	GlobalKubeconfig string `yaml:"globalKubeconfig"`
+
+	KubevirtciPaths      pathList `yaml:"kubevirtciPaths"`
+	KubevirtciConfigPath string   `yaml:"kubevirtciConfigPath"`
+	KubevirtProvider     string   `yaml:"kubevirtProvider"`
+}
+
+// ToolPolicy restricts the tools offered to clients
+type ToolPolicy struct {
+	Disabled stringList `yaml:"disabled"`
+}
+
+// BudgetConfig configures the context budget of tool results
+type BudgetConfig struct {
+	MaxResultTokens int        `yaml:"maxResultTokens"`
+	Strategies      stringList `yaml:"strategies"`
+	HeadRatio       float64    `yaml:"headRatio"`
+}
+
+// ArtifactsConfig configures the export of tool results
+type ArtifactsConfig struct {
+	Dir       string `yaml:"dir"`
+	Namespace string `yaml:"namespace"`
+	MinSize   int    `yaml:"minSize"`
+}
+
+// FixturesConfig configures the recording and replay of invocations
+type FixturesConfig struct {
+	RecordDir string `yaml:"recordDir"`
+	ReplayDir string `yaml:"replayDir"`
+}
+
+// MonitorConfig configures the conformance monitor
+type MonitorConfig struct {
+	Interval    time.Duration `yaml:"interval"`
+	Namespace   string        `yaml:"namespace"`
+	Migration   bool          `yaml:"migration"`
+	MetricsAddr string        `yaml:"metricsAddr"`
+}
+
+// GCConfig configures the background sweep of orphaned temporary objects
+type GCConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	MinAge   time.Duration `yaml:"minAge"`
+}
+
+// SessionsConfig configures the pool of logged in vm-exec sessions
+type SessionsConfig struct {
+	PoolSize    int           `yaml:"poolSize"`
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+}
+
+// ConsoleConfig configures how vm-exec retries connecting to the serial
+// console and logging in, its timeouts are set with timeouts
+type ConsoleConfig struct {
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+}
+
+// HistoryConfig configures the recorder of VM lifecycle transitions
+type HistoryConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// HTTPConfig configures the HTTP transport, served instead of stdio when an
+// address is set
+type HTTPConfig struct {
+	Addr       string `yaml:"addr"`
+	TLSCert    string `yaml:"tlsCert"`
+	TLSKey     string `yaml:"tlsKey"`
+	ClientCA   string `yaml:"clientCA"`
+	Identities string `yaml:"identities"`
+}
+
+// CredentialsConfig configures the encryption of the cached credentials,
+// the key itself is only read from the environment
+type CredentialsConfig struct {
+	KeySecret string `yaml:"keySecret"`
+}
+
+// PolicyConfig configures the Rego policy evaluated for every tool call
+type PolicyConfig struct {
+	File  string `yaml:"file"`
+	Query string `yaml:"query"`
+	OPA   string `yaml:"opa"`
+}
+
+// ExecPolicyConfig restricts the guest access tools: the namespaces they
+// may be used in and the guest commands refused or run only when confirmed
+type ExecPolicyConfig struct {
+	Namespaces stringList `yaml:"namespaces"`
+	Deny       []string   `yaml:"deny"`
+	Confirm    []string   `yaml:"confirm"`
+
+	CredentialsDir string `yaml:"credentialsDir"`
+}
+
+// AuditConfig configures the audit log of the tool calls, written to a
+// JSONL file rotated at MaxSize MiB and as Events of a namespace
+type AuditConfig struct {
+	File      string `yaml:"file"`
+	Namespace string `yaml:"namespace"`
+	MaxSize   int    `yaml:"maxSize"`
+	MaxFiles  int    `yaml:"maxFiles"`
+}
+
+// TracingConfig configures the export of OpenTelemetry spans to an OTLP/HTTP
+// collector such as Jaeger
+type TracingConfig struct {
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"serviceName"`
+}
+
+// SimulationConfig runs the server against an in-memory cluster instead
+// of a real one
+type SimulationConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Model   string `yaml:"model"`
+}
+
+// SnapshotSchedulesConfig configures the scheduler of VM snapshots
+type SnapshotSchedulesConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RestartWindowConfig configures the maintenance window the pending VM
+// restarts are applied in
+type RestartWindowConfig struct {
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+// OutputConfig configures how much of the output of vm_exec is returned at
+// once and where the rest is kept for paging
+type OutputConfig struct {
+	MaxSize      int           `yaml:"maxSize"`
+	CaptureLimit int           `yaml:"captureLimit"`
+	Dir          string        `yaml:"dir"`
+	Retention    time.Duration `yaml:"retention"`
+}
+
+// DNSConfig configures where vm_dns publishes the hostnames of VMs, with
+// external-dns annotations or through the PowerDNS API. The API key is
+// only read from the environment.
+type DNSConfig struct {
+	Provider string `yaml:"provider"`
+	Zone     string `yaml:"zone"`
+	APIURL   string `yaml:"apiURL"`
+	ServerID string `yaml:"serverID"`
+}
+
+// serverConfig is the configuration of the server, the defaults until
+// loadConfiguration reads the file, flags and environment in main
+var serverConfig = defaultServerConfig()
+
+// defaultServerConfig returns the configuration used when nothing is set
+func defaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Budget: BudgetConfig{
+			Strategies: stringList{budgetDedup, budgetHeadTail},
+			HeadRatio:  defaultBudgetHeadRatio,
+		},
+		Monitor: MonitorConfig{Namespace: "default"},
+		GC:      GCConfig{MinAge: defaultGCMinAge},
+		Sessions: SessionsConfig{
+			PoolSize:    defaultSessionPoolSize,
+			IdleTimeout: defaultSessionIdleTimeout,
+		},
+		Console:           ConsoleConfig{Retries: defaultConsoleRetries, RetryBackoff: defaultConsoleRetryBackoff},
+		SnapshotSchedules: SnapshotSchedulesConfig{Interval: defaultSnapshotScheduleInterval},
+		RestartWindow:     RestartWindowConfig{Duration: defaultRestartWindowDuration},
+		Output:            OutputConfig{MaxSize: defaultOutputMaxSize, CaptureLimit: defaultOutputCaptureLimit, Retention: defaultOutputRetention},
+		DNS:               DNSConfig{Provider: dnsProviderExternalDNS, ServerID: defaultDNSServerID},
+		Policy:            PolicyConfig{Query: defaultPolicyQuery, OPA: "opa"},
+		Exec:              ExecPolicyConfig{Deny: defaultExecDeny, Confirm: defaultExecConfirm},
+		Audit:             AuditConfig{MaxSize: defaultAuditMaxSize, MaxFiles: defaultAuditMaxFiles},
+		Tracing:           TracingConfig{ServiceName: defaultOTLPServiceName},
+	}
+}
+
+// configSetting binds a setting to its flag and environment variable
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	bind  func(fs *flag.FlagSet, c *ServerConfig, name, usage string)
+}
+
+func stringSetting(field func(c *ServerConfig) *string) func(*flag.FlagSet, *ServerConfig, string, string) {
+	return func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+		fs.StringVar(field(c), name, *field(c), usage)
+	}
+}
+
+func intSetting(field func(c *ServerConfig) *int) func(*flag.FlagSet, *ServerConfig, string, string) {
+	return func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+		fs.IntVar(field(c), name, *field(c), usage)
+	}
+}
+
+func valueSetting(field func(c *ServerConfig) flag.Value) func(*flag.FlagSet, *ServerConfig, string, string) {
+	return func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+		fs.Var(field(c), name, usage)
+	}
+}
+
+// configSettings lists every setting with its flag and environment variable
+var configSettings = []configSetting{
+	{"max-concurrency", maxConcurrencyEnv, "Maximum number of requests handled at once, 0 for no limit",
+		intSetting(func(c *ServerConfig) *int { return &c.MaxConcurrency })},
+	{"state-dir", stateDirEnv, "Directory of the server state such as SSH keys and the login kubeconfig (default: ~/.kubevirt-mcp)",
+		stringSetting(func(c *ServerConfig) *string { return &c.StateDir })},
+	{"vm-exec", vmExecPathEnv, "Path of the vm-exec binary (default: next to this binary)",
+		stringSetting(func(c *ServerConfig) *string { return &c.VMExecPath })},
+	{"default-namespace", defaultNamespaceEnv, "Namespace of the tool calls that set none (default: default)",
+		stringSetting(func(c *ServerConfig) *string { return &c.DefaultNamespace })},
+	{"docs-kubernetes", docsKubernetesEnv, "Documentation folder of Kubernetes clusters, overriding config.json",
+		stringSetting(func(c *ServerConfig) *string { return &c.Docs.Kubernetes })},
+	{"docs-openshift", docsOpenShiftEnv, "Documentation folder of OpenShift clusters, overriding config.json",
+		stringSetting(func(c *ServerConfig) *string { return &c.Docs.OpenShift })},
+	{"clusters", clustersEnv, "YAML file of the cluster registry",
+		stringSetting(func(c *ServerConfig) *string { return &c.Detection.Clusters })},
+	{"kubeconfig", kubeconfigEnv, "Kubeconfig tried before any other cluster",
+		stringSetting(func(c *ServerConfig) *string { return &c.Detection.Kubeconfig })},
+	{"global-kubeconfig", globalKubeconfigEnv, "Kubeconfig tried when no other cluster is found",
+		stringSetting(func(c *ServerConfig) *string { return &c.Detection.GlobalKubeconfig })},
+	{"kubevirtci-config-path", kubevirtciConfigPathEnv, "_ci-configs directory of kubevirtci searched before the checkouts",
+		stringSetting(func(c *ServerConfig) *string { return &c.Detection.KubevirtciConfigPath })},
+	{"kubevirt-provider", kubevirtProviderEnv, "kubevirtci provider preferred over the most recent cluster, e.g. k8s-1.30",
+		stringSetting(func(c *ServerConfig) *string { return &c.Detection.KubevirtProvider })},
+	{"kubevirtci-paths", kubevirtciSearchPathsEnv, "Checkouts searched for kubevirtci clusters, separated like PATH",
+		valueSetting(func(c *ServerConfig) flag.Value { return &c.Detection.KubevirtciPaths })},
+	{"disable-tools", disabledToolsEnv, "Comma separated tools hidden from clients and rejected when called",
+		valueSetting(func(c *ServerConfig) flag.Value { return &c.Tools.Disabled })},
+	{"timeouts", timeoutsEnv, "Comma separated timeout overrides, e.g. detection=10s,kubectl=1m",
+		valueSetting(func(c *ServerConfig) flag.Value { return &c.Timeouts })},
+	{"max-result-tokens", maxResultTokensEnv, "Shrink tool results above this many tokens, 0 for no limit",
+		intSetting(func(c *ServerConfig) *int { return &c.Budget.MaxResultTokens })},
+	{"budget-strategies", budgetStrategiesEnv, "Comma separated strategies shrinking results: dedup, head-tail",
+		valueSetting(func(c *ServerConfig) flag.Value { return &c.Budget.Strategies })},
+	{"budget-head-ratio", budgetHeadRatioEnv, "Share of the budget kept from the start of a result with head-tail",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.Float64Var(&c.Budget.HeadRatio, name, c.Budget.HeadRatio, usage)
+		}},
+	{"artifacts-dir", artifactsDirEnv, "Directory every successful tool result is written to",
+		stringSetting(func(c *ServerConfig) *string { return &c.Artifacts.Dir })},
+	{"artifacts-namespace", artifactsNamespaceEnv, "Namespace every successful tool result is stored in as a ConfigMap",
+		stringSetting(func(c *ServerConfig) *string { return &c.Artifacts.Namespace })},
+	{"artifacts-min-size", artifactsMinSizeEnv, "Only export results of at least this many bytes",
+		intSetting(func(c *ServerConfig) *int { return &c.Artifacts.MinSize })},
+	{"record-dir", recordDirEnv, "Record every kubectl and vm-exec invocation to fixtures in this directory",
+		stringSetting(func(c *ServerConfig) *string { return &c.Fixtures.RecordDir })},
+	{"replay-dir", replayDirEnv, "Answer every kubectl and vm-exec invocation from the fixtures in this directory",
+		stringSetting(func(c *ServerConfig) *string { return &c.Fixtures.ReplayDir })},
+	{"monitor-interval", monitorIntervalEnv, "Run the conformance monitor with this interval, e.g. 15m",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.Monitor.Interval, name, c.Monitor.Interval, usage)
+		}},
+	{"monitor-namespace", monitorNamespaceEnv, "Namespace of the conformance monitor VMs",
+		stringSetting(func(c *ServerConfig) *string { return &c.Monitor.Namespace })},
+	{"monitor-migration", monitorMigrationEnv, "Include live migration in the conformance monitor",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.BoolVar(&c.Monitor.Migration, name, c.Monitor.Migration, usage)
+		}},
+	{"metrics-addr", metricsAddrEnv, "Address serving the Prometheus metrics on /metrics, e.g. :9090",
+		stringSetting(func(c *ServerConfig) *string { return &c.Monitor.MetricsAddr })},
+	{"gc-interval", gcIntervalEnv, "Delete orphaned temporary objects with this interval, e.g. 30m",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.GC.Interval, name, c.GC.Interval, usage)
+		}},
+	{"gc-min-age", gcMinAgeEnv, "Only delete orphaned temporary objects older than this",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.GC.MinAge, name, c.GC.MinAge, usage)
+		}},
+	{"session-pool-size", sessionPoolSizeEnv, "Logged in vm-exec sessions kept for vm_exec, 0 to log in on every call",
+		intSetting(func(c *ServerConfig) *int { return &c.Sessions.PoolSize })},
+	{"session-idle-timeout", sessionIdleTimeoutEnv, "Close vm-exec sessions unused for this long",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.Sessions.IdleTimeout, name, c.Sessions.IdleTimeout, usage)
+		}},
+	{"console-retries", consoleRetriesEnv, "Times vm-exec retries connecting to the console and logging in when the stream drops or times out",
+		intSetting(func(c *ServerConfig) *int { return &c.Console.Retries })},
+	{"console-retry-backoff", consoleRetryBackoffEnv, "Wait of vm-exec before the first console retry, doubled for every further retry",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.Console.RetryBackoff, name, c.Console.RetryBackoff, usage)
+		}},
+	{"history-interval", historyIntervalEnv, "Record the lifecycle transitions of every VM with this interval, e.g. 1m",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.History.Interval, name, c.History.Interval, usage)
+		}},
+	{"snapshot-schedule-interval", snapshotScheduleIntervalEnv, "Check the snapshot schedules with this interval, 0 to take no scheduled snapshots",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.SnapshotSchedules.Interval, name, c.SnapshotSchedules.Interval, usage)
+		}},
+	{"restart-window", restartWindowEnv, "Cron schedule in UTC opening the maintenance window the pending VM restarts are applied in, e.g. '0 2 * * 6'",
+		stringSetting(func(c *ServerConfig) *string { return &c.RestartWindow.Schedule })},
+	{"restart-window-duration", restartWindowDurationEnv, "How long the maintenance window stays open",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.RestartWindow.Duration, name, c.RestartWindow.Duration, usage)
+		}},
+	{"output-max-size", outputMaxSizeEnv, "Bytes of the stdout and stderr of a vm_exec command returned at once, the rest is paged, 0 for no limit",
+		intSetting(func(c *ServerConfig) *int { return &c.Output.MaxSize })},
+	{"output-capture-limit", outputCaptureLimitEnv, "Bytes of the stdout and stderr of a command vm-exec reads from the guest at most, 0 for no limit",
+		intSetting(func(c *ServerConfig) *int { return &c.Output.CaptureLimit })},
+	{"output-dir", outputDirEnv, "Directory of the vm_exec output kept for paging and output_file (default: output in the state directory)",
+		stringSetting(func(c *ServerConfig) *string { return &c.Output.Dir })},
+	{"output-retention", outputRetentionEnv, "Keep the vm_exec output for paging this long",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.DurationVar(&c.Output.Retention, name, c.Output.Retention, usage)
+		}},
+	{"dns-provider", dnsProviderEnv, "Where vm_dns publishes VM hostnames: external-dns annotations or the powerdns API",
+		stringSetting(func(c *ServerConfig) *string { return &c.DNS.Provider })},
+	{"dns-zone", dnsZoneEnv, "DNS zone of the VM hostnames, <vm>.<namespace>.<zone> when vm_dns is given none",
+		stringSetting(func(c *ServerConfig) *string { return &c.DNS.Zone })},
+	{"dns-api-url", dnsAPIURLEnv, "URL of the PowerDNS API of the powerdns provider, e.g. http://pdns:8081",
+		stringSetting(func(c *ServerConfig) *string { return &c.DNS.APIURL })},
+	{"dns-server-id", dnsServerIDEnv, "PowerDNS server of the zone",
+		stringSetting(func(c *ServerConfig) *string { return &c.DNS.ServerID })},
+	{"listen", listenEnv, "Serve MCP on unix:PATH, tcp:HOST:PORT or the systemd socket instead of stdio",
+		stringSetting(func(c *ServerConfig) *string { return &c.Listen })},
+	{"http-addr", httpAddrEnv, "Serve MCP over HTTP on this address instead of stdio, e.g. :8443",
+		stringSetting(func(c *ServerConfig) *string { return &c.HTTP.Addr })},
+	{"http-tls-cert", httpTLSCertEnv, "TLS certificate of the HTTP transport",
+		stringSetting(func(c *ServerConfig) *string { return &c.HTTP.TLSCert })},
+	{"http-tls-key", httpTLSKeyEnv, "TLS key of the HTTP transport",
+		stringSetting(func(c *ServerConfig) *string { return &c.HTTP.TLSKey })},
+	{"http-client-ca", httpClientCAEnv, "CA verifying the client certificates of the HTTP transport",
+		stringSetting(func(c *ServerConfig) *string { return &c.HTTP.ClientCA })},
+	{"credentials-key-secret", credentialsKeySecretEnv, "namespace/name of a Secret holding the key encrypting the cached credentials",
+		stringSetting(func(c *ServerConfig) *string { return &c.Credentials.KeySecret })},
+	{"policy", policyFileEnv, "Rego policy evaluated before every tool call",
+		stringSetting(func(c *ServerConfig) *string { return &c.Policy.File })},
+	{"policy-query", policyQueryEnv, "Rule of the policy giving the decision",
+		stringSetting(func(c *ServerConfig) *string { return &c.Policy.Query })},
+	{"opa", policyOPAEnv, "Path of the opa binary evaluating the policy",
+		stringSetting(func(c *ServerConfig) *string { return &c.Policy.OPA })},
+	{"exec-namespaces", execNamespacesEnv, "Comma separated namespaces, or patterns such as dev-*, where guests may be accessed with vm_exec and the console and file tools",
+		valueSetting(func(c *ServerConfig) flag.Value { return &c.Exec.Namespaces })},
+	{"exec-credentials-dir", execCredentialsDirEnv, "Directory of the console credentials files the credentials_file of the guest access tools may name",
+		stringSetting(func(c *ServerConfig) *string { return &c.Exec.CredentialsDir })},
+	{"audit-file", auditFileEnv, "JSONL file every tool call is recorded to",
+		stringSetting(func(c *ServerConfig) *string { return &c.Audit.File })},
+	{"audit-namespace", auditNamespaceEnv, "Namespace every tool call is recorded to as an Event",
+		stringSetting(func(c *ServerConfig) *string { return &c.Audit.Namespace })},
+	{"audit-max-size", auditMaxSizeEnv, "Rotate the audit file at this size in MiB, 0 to never rotate it",
+		intSetting(func(c *ServerConfig) *int { return &c.Audit.MaxSize })},
+	{"audit-max-files", auditMaxFilesEnv, "Rotated audit files kept",
+		intSetting(func(c *ServerConfig) *int { return &c.Audit.MaxFiles })},
+	{"otlp-endpoint", otlpEndpointEnv, "OTLP/HTTP endpoint the trace spans are exported to, e.g. http://jaeger:4318",
+		stringSetting(func(c *ServerConfig) *string { return &c.Tracing.Endpoint })},
+	{"otlp-service-name", otlpServiceNameEnv, "Service name of the exported spans",
+		stringSetting(func(c *ServerConfig) *string { return &c.Tracing.ServiceName })},
+	{"simulate", simulateEnv, "Run the tools against an in-memory simulated cluster instead of a real one",
+		func(fs *flag.FlagSet, c *ServerConfig, name, usage string) {
+			fs.BoolVar(&c.Simulation.Enabled, name, c.Simulation.Enabled, usage)
+		}},
+	{"simulate-model", simulateModelEnv, "YAML manifests of the nodes and VMs the simulated cluster starts with",
+		stringSetting(func(c *ServerConfig) *string { return &c.Simulation.Model })},
+	{"identities", identitiesEnv, "YAML file of the clients of the HTTP transport and the listener and their policy",
+		stringSetting(func(c *ServerConfig) *string { return &c.HTTP.Identities })},
+}
+
+// loadConfiguration reads the configuration file, then applies the flags and
+// finally the environment variables, so each overrides the one before
+func loadConfiguration(args []string) (*ServerConfig, error) {
+	c := defaultServerConfig()
+	fs := flag.NewFlagSet("kubevirt-mcp", flag.ContinueOnError)
+	path := fs.String("config", "", "YAML configuration file (or set "+configEnv+")")
+	for _, setting := range configSettings {
+		setting.bind(fs, c, setting.flag, setting.usage+" (or set "+setting.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	// The flags were parsed into the configuration before the file is read,
+	// they are applied again on top of it
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+
+	if value := os.Getenv(configEnv); value != "" {
+		*path = value
+	}
+	if *path == "" {
+		*path = findConfigFile()
+	}
+	if *path != "" {
+		data, err := os.ReadFile(expandHome(*path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration: %v", err)
+		}
+		decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse configuration %s: %v", *path, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := flags[setting.flag]; ok {
+			fs.Set(setting.flag, value)
+		}
+		if value := os.Getenv(setting.env); value != "" {
+			if err := fs.Set(setting.flag, value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", setting.env, err)
+			}
+		}
+	}
+
+	for _, name := range c.Tools.Disabled {
+		if !toolRegistered(name) {
+			logMessage(LogWarning, "config", "Disabled tool %q does not exist", name)
+		}
+	}
+	return c, nil
+}
+
+// findConfigFile returns the configuration file used without --config:
+// kubevirt-mcp.yaml next to the executable, else kubevirt-mcp/config.yaml
+// of the XDG config directory, empty when neither exists
+func findConfigFile() string {
+	var paths []string
+	if dir, err := executableDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "kubevirt-mcp.yaml"))
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "kubevirt-mcp", "config.yaml"))
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// executableDir returns the directory of the server binary, with symlinks
+// resolved
+func executableDir() (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+		executable = resolved
+	}
+	return filepath.Dir(executable), nil
+}
+
+// stringList is a comma separated list setting
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// pathList is a list of paths separated like PATH
+type pathList []string
+
+func (l *pathList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, string(os.PathListSeparator))
+}
+
+func (l *pathList) Set(value string) error {
+	*l = filepath.SplitList(value)
+	return nil
+}
+
+// timeoutOverrides maps timeout names to durations. Overrides are merged,
+// so e.g. a flag only replaces the timeouts it names in the file.
+type timeoutOverrides map[string]time.Duration
+
+func (t *timeoutOverrides) String() string {
+	if t == nil {
+		return ""
+	}
+	var entries []string
+	for name, d := range *t {
+		entries = append(entries, name+"="+d.String())
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+func (t *timeoutOverrides) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, duration, _ := strings.Cut(entry, "=")
+		if err := t.set(name, duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *timeoutOverrides) UnmarshalYAML(node *yaml.Node) error {
+	var entries map[string]string
+	if err := node.Decode(&entries); err != nil {
+		return err
+	}
+	for name, duration := range entries {
+		if err := t.set(name, duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *timeoutOverrides) set(name, duration string) error {
+	if _, ok := defaultTimeouts[name]; !ok {
+		return fmt.Errorf("unknown timeout %q, known timeouts: %s", name, strings.Join(timeoutNames(), ", "))
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid %s timeout %q", name, duration)
+	}
+	if *t == nil {
+		*t = timeoutOverrides{}
+	}
+	(*t)[name] = d
+	return nil
+}
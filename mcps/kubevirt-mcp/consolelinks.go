@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConsoleLinksParams represents the parameters for the OpenShift console links tool
+type ConsoleLinksParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+}
+
+// RouteLink describes a Route exposing a VM through one of its Services
+type RouteLink struct {
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	URL     string `json:"url"`
+}
+
+// ConsoleLinksResult is the vm_console_links tool result
+type ConsoleLinksResult struct {
+	ConsoleURL    string      `json:"consoleURL"`
+	VMURL         string      `json:"vmURL"`
+	VNCConsoleURL string      `json:"vncConsoleURL"`
+	SerialURL     string      `json:"serialConsoleURL"`
+	Services      []string    `json:"services,omitempty"`
+	Routes        []RouteLink `json:"routes,omitempty"`
+}
+
+type service struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Selector map[string]string `json:"selector,omitempty"`
+	} `json:"spec"`
+}
+
+type route struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Host string `json:"host"`
+		Path string `json:"path,omitempty"`
+		To   struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"to"`
+		TLS *struct{} `json:"tls,omitempty"`
+	} `json:"spec"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_console_links",
+		Description: "On OpenShift, return the web console URL of a VM, its VNC and serial console pages and the Routes exposing it",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleConsoleLinks,
+	})
+}
+
+// handleConsoleLinks is the tools/call handler for vm_console_links
+func handleConsoleLinks(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ConsoleLinksParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := consoleLinks(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// consoleLinks builds the web console links of a VM and finds the Routes
+// pointing at Services that select the VM's pods
+func consoleLinks(ctx context.Context, params ConsoleLinksParams) (*ConsoleLinksResult, error) {
+	output, err := runKubectl(ctx, "get", "consoles.config.openshift.io", "cluster", "-o", "jsonpath={.status.consoleURL}")
+	if err != nil {
+		return nil, fmt.Errorf("OpenShift web console not found, is this an OpenShift cluster? %v", err)
+	}
+	consoleURL := strings.TrimSuffix(strings.TrimSpace(string(output)), "/")
+	if consoleURL == "" {
+		return nil, fmt.Errorf("OpenShift web console URL is not set in consoles.config.openshift.io/cluster")
+	}
+
+	var vm VirtualMachine
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+
+	vmURL := fmt.Sprintf("%s/k8s/ns/%s/kubevirt.io~v1~VirtualMachine/%s", consoleURL, params.Namespace, params.VMName)
+	result := &ConsoleLinksResult{
+		ConsoleURL:    consoleURL,
+		VMURL:         vmURL,
+		VNCConsoleURL: vmURL + "/console/standalone",
+		SerialURL:     vmURL + "/console",
+	}
+
+	// Services select the virt-launcher pod, which carries the VM template labels
+	podLabels := vm.Spec.Template.Metadata.Labels
+	var services struct {
+		Items []service `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &services, "get", "services", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	exposing := map[string]bool{}
+	for _, svc := range services.Items {
+		if selectsLabels(svc.Spec.Selector, podLabels) {
+			exposing[svc.Metadata.Name] = true
+			result.Services = append(result.Services, svc.Metadata.Name)
+		}
+	}
+	sort.Strings(result.Services)
+
+	if len(exposing) == 0 {
+		return result, nil
+	}
+
+	var routes struct {
+		Items []route `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &routes, "get", "routes.route.openshift.io", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	for _, rt := range routes.Items {
+		if rt.Spec.To.Kind != "Service" || !exposing[rt.Spec.To.Name] {
+			continue
+		}
+		scheme := "http"
+		if rt.Spec.TLS != nil {
+			scheme = "https"
+		}
+		result.Routes = append(result.Routes, RouteLink{
+			Name:    rt.Metadata.Name,
+			Service: rt.Spec.To.Name,
+			URL:     fmt.Sprintf("%s://%s%s", scheme, rt.Spec.Host, rt.Spec.Path),
+		})
+	}
+
+	return result, nil
+}
+
+// selectsLabels reports whether a non-empty Service selector matches the labels
+func selectsLabels(selector, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
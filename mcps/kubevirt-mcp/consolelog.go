@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	consoleLogSourceAuto   = "auto"
+	consoleLogSourceLog    = "log"
+	consoleLogSourceSerial = "serial"
+
+	// guestConsoleLogContainer streams the serial console to the pod log when
+	// the logSerialConsole option is enabled in KubeVirt
+	guestConsoleLogContainer = "guest-console-log"
+)
+
+// ConsoleLogParams represents the parameters for fetching console output
+type ConsoleLogParams struct {
+	Namespace    string `json:"namespace,omitempty"`
+	VMName       string `json:"vm_name"`
+	Source       string `json:"source,omitempty"`
+	Lines        int    `json:"lines,omitempty"`
+	SinceSeconds int    `json:"since_seconds,omitempty"`
+	Duration     int    `json:"duration,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_console_log",
+		Description: "Fetch recent serial console output of a VMI without logging in, from the virt-launcher guest-console-log container or a read-only serial console capture. Useful to debug boot failures",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+				"source": map[string]interface{}{
+					"type":        "string",
+					"description": "log reads the guest-console-log container (includes past output), serial attaches to the console for 'duration' seconds, auto prefers log",
+					"enum":        []string{consoleLogSourceAuto, consoleLogSourceLog, consoleLogSourceSerial},
+					"default":     consoleLogSourceAuto,
+				},
+				"lines": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of trailing lines to return (default: 100)",
+					"default":     100,
+				},
+				"since_seconds": map[string]interface{}{
+					"type":        "integer",
+					"description": "Only return log output newer than this many seconds (log source only)",
+				},
+				"duration": map[string]interface{}{
+					"type":        "integer",
+					"description": "Seconds to capture the serial console (serial source only, default: 10)",
+					"default":     10,
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleConsoleLog,
+	})
+	registerSummarizer("vm_console_log", summarizeConsoleLog)
+}
+
+// handleConsoleLog is the tools/call handler for vm_console_log
+func handleConsoleLog(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ConsoleLogParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Lines < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("lines must not be negative")}
+	}
+	if params.Duration < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("duration must not be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Source == "" {
+		params.Source = consoleLogSourceAuto
+	}
+	if params.Lines == 0 {
+		params.Lines = 100
+	}
+	if params.Duration == 0 {
+		params.Duration = 10
+	}
+
+	switch params.Source {
+	case consoleLogSourceLog:
+		return readGuestConsoleLog(ctx, params)
+	case consoleLogSourceSerial:
+		return captureSerialConsole(ctx, params)
+	case consoleLogSourceAuto:
+		output, err := readGuestConsoleLog(ctx, params)
+		if err == nil {
+			return output, nil
+		}
+		return captureSerialConsole(ctx, params)
+	default:
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported source '%s'", params.Source)}
+	}
+}
+
+// readGuestConsoleLog returns the tail of the guest-console-log container log
+func readGuestConsoleLog(ctx context.Context, params ConsoleLogParams) (string, error) {
+	pod, err := getLauncherPod(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return "", err
+	}
+	if !pod.hasContainer(guestConsoleLogContainer) {
+		return "", fmt.Errorf("pod %s has no %s container, enable logSerialConsole in the KubeVirt CR or use source=serial", pod.Metadata.Name, guestConsoleLogContainer)
+	}
+
+	args := []string{"logs", pod.Metadata.Name, "-n", params.Namespace, "-c", guestConsoleLogContainer, "--tail", strconv.Itoa(params.Lines)}
+	if params.SinceSeconds > 0 {
+		args = append(args, fmt.Sprintf("--since=%ds", params.SinceSeconds))
+	}
+
+	output, err := runKubectl(ctx, args...)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Source: %s/%s\n\n%s", pod.Metadata.Name, guestConsoleLogContainer, string(output)), nil
+}
+
+// captureSerialConsole attaches to the serial console read-only via vm-exec
+func captureSerialConsole(ctx context.Context, params ConsoleLogParams) (string, error) {
+	deadline := vmExecDeadline(0, 0) + time.Duration(params.Duration)*time.Second
+	output, err := runVMExec(ctx, deadline, []string{
+		"-n", params.Namespace,
+		"-v", params.VMName,
+		"--read-console",
+		"--duration", strconv.Itoa(params.Duration),
+		"--lines", strconv.Itoa(params.Lines),
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Source: serial console (captured for %ds)\n\n%s", params.Duration, output), nil
+}
+
+// consoleProblemRegex matches console lines worth surfacing in a summary
+var consoleProblemRegex = regexp.MustCompile(`(?i)(error|fail|panic|oops|call trace|segfault|timed out|emergency mode|warn)`)
+
+// consoleDigitsRegex masks numbers so repeated messages with different
+// timestamps or counters are grouped
+var consoleDigitsRegex = regexp.MustCompile(`[0-9]+`)
+
+// summarizeConsoleLog condenses console output into the problem lines,
+// grouped by message, and the last lines of output
+func summarizeConsoleLog(result string) (string, error) {
+	lines := strings.Split(strings.TrimRight(result, "\n"), "\n")
+
+	type problem struct {
+		example string
+		count   int
+	}
+	var order []string
+	problems := map[string]*problem{}
+	for _, line := range lines {
+		if !consoleProblemRegex.MatchString(line) {
+			continue
+		}
+		key := consoleDigitsRegex.ReplaceAllString(strings.TrimSpace(line), "N")
+		if p, ok := problems[key]; ok {
+			p.count++
+			continue
+		}
+		problems[key] = &problem{example: strings.TrimSpace(line), count: 1}
+		order = append(order, key)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d console lines, %d problem messages\n", len(lines), len(order))
+	for _, key := range order {
+		p := problems[key]
+		fmt.Fprintf(&b, "  %dx %s\n", p.count, p.example)
+	}
+
+	tail := lines
+	if len(tail) > 10 {
+		tail = tail[len(tail)-10:]
+	}
+	b.WriteString("\nLast lines:\n")
+	for _, line := range tail {
+		b.WriteString("  " + line + "\n")
+	}
+	return b.String(), nil
+}
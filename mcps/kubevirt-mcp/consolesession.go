@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxConsoleSessions bounds the interactive consoles open at once
+	maxConsoleSessions = 8
+
+	// consoleSessionIdleTimeout closes consoles nobody sent to or read from
+	consoleSessionIdleTimeout = 15 * time.Minute
+
+	// consoleBufferSize is how much unread console output is kept, older
+	// output is dropped
+	consoleBufferSize = 1 << 20
+
+	// consoleQuietPeriod is how long the console must stay silent before a
+	// read without wait_for returns
+	consoleQuietPeriod = 500 * time.Millisecond
+
+	defaultConsoleReadTimeout = 10
+	maxConsoleReadTimeout     = 300
+)
+
+// consoleKeys are the named keys vm_console_send can type after the text
+var consoleKeys = map[string]string{
+	"enter":     "\r",
+	"tab":       "\t",
+	"backspace": "\x7f",
+	"escape":    "\x1b",
+	"ctrl-c":    "\x03",
+	"ctrl-d":    "\x04",
+	"ctrl-z":    "\x1a",
+	"ctrl-]":    "\x1d",
+	"up":        "\x1b[A",
+	"down":      "\x1b[B",
+	"right":     "\x1b[C",
+	"left":      "\x1b[D",
+}
+
+// ConsoleOpenParams represents the parameters of vm_console_open
+type ConsoleOpenParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+}
+
+// ConsoleSendParams represents the parameters of vm_console_send
+type ConsoleSendParams struct {
+	SessionID string   `json:"session_id"`
+	Text      string   `json:"text,omitempty"`
+	Enter     *bool    `json:"enter,omitempty"`
+	Keys      []string `json:"keys,omitempty"`
+}
+
+// ConsoleReadParams represents the parameters of vm_console_read and
+// vm_console_close
+type ConsoleReadParams struct {
+	SessionID string `json:"session_id"`
+	WaitFor   string `json:"wait_for,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+}
+
+// ConsoleSessionResult is the result of the vm_console_* tools
+type ConsoleSessionResult struct {
+	SessionID string `json:"sessionId"`
+	Namespace string `json:"namespace"`
+	VMName    string `json:"vmName"`
+	Output    string `json:"output"`
+	// Matched is set by reads with wait_for
+	Matched *bool `json:"matched,omitempty"`
+	// Dropped counts output bytes lost because they were not read in time
+	Dropped int    `json:"dropped,omitempty"`
+	Closed  bool   `json:"closed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// consoleSession is a vm-exec --attach process connected to a serial console
+type consoleSession struct {
+	id        string
+	namespace string
+	vmName    string
+	// owner is the identity that opened the session, the only one that may
+	// use it. The tools take no namespace argument the access policy could
+	// check.
+	owner string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu sync.Mutex
+	// output holds the console bytes from offset start, read is the offset
+	// of the first unread byte
+	output []byte
+	start  int
+	read   int
+	// changed is closed and replaced whenever output arrives or the console
+	// disconnects
+	changed  chan struct{}
+	closed   bool
+	err      string
+	lastUsed time.Time
+}
+
+// consoleSessions holds the open interactive consoles by session ID
+var consoleSessions = struct {
+	mu       sync.Mutex
+	sessions map[string]*consoleSession
+	janitor  sync.Once
+}{sessions: map[string]*consoleSession{}}
+
+func init() {
+	sessionIDProperty := map[string]interface{}{
+		"type":        "string",
+		"description": "Session ID returned by vm_console_open",
+	}
+	waitForProperty := map[string]interface{}{
+		"type":        "string",
+		"description": "Regular expression to wait for in the unread output, e.g. 'login: $' or '\\(y/n\\)'. Without it the read returns once the console is quiet",
+	}
+	timeoutProperty := map[string]interface{}{
+		"type":        "integer",
+		"description": fmt.Sprintf("Seconds to wait for output (at most %d)", maxConsoleReadTimeout),
+		"default":     defaultConsoleReadTimeout,
+	}
+
+	registerTool(Tool{
+		Name:        "vm_console_open",
+		Description: "Attach to the serial console of a VMI and keep it open as a session for vm_console_send and vm_console_read, to drive interactive programs such as installers, fdisk or debuggers that vm_exec cannot. Nothing is logged in; send the credentials when the console asks for them. Close it with vm_console_close",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleConsoleOpen,
+	})
+
+	keys := make([]string, 0, len(consoleKeys))
+	for key := range consoleKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	registerTool(Tool{
+		Name:        "vm_console_send",
+		Description: "Type text and keys into an open console session. The output is read with vm_console_read",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"session_id": sessionIDProperty,
+				"text": map[string]interface{}{
+					"type":        "string",
+					"description": "Text to type",
+				},
+				"enter": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Press enter after the text, unless keys are given",
+					"default":     true,
+				},
+				"keys": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string", "enum": keys},
+					"description": "Keys pressed after the text, e.g. [\"ctrl-c\"] or [\"down\", \"enter\"]",
+				},
+			},
+			"required": []string{"session_id"},
+		},
+		Handler: handleConsoleSend,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_console_read",
+		Description: "Return the console output of a session not read yet, waiting for a pattern or for the console to go quiet. Escape sequences are removed",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"session_id": sessionIDProperty,
+				"wait_for":   waitForProperty,
+				"timeout":    timeoutProperty,
+			},
+			"required": []string{"session_id"},
+		},
+		Handler: handleConsoleRead,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_console_close",
+		Description: "Close a console session and return its unread output. The guest stays logged in as it was, log out first if needed",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"session_id": sessionIDProperty,
+			},
+			"required": []string{"session_id"},
+		},
+		Handler: handleConsoleClose,
+	})
+}
+
+// handleConsoleOpen is the tools/call handler for vm_console_open
+func handleConsoleOpen(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ConsoleOpenParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if fixtures != nil {
+		return "", errors.New("interactive console sessions cannot be recorded or replayed")
+	}
+	if simulation != nil {
+		return "", errors.New("interactive console sessions are not available in simulation mode")
+	}
+
+	s, err := openConsoleSession(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return "", err
+	}
+	// Give vm-exec time to attach, the guest may print nothing until input
+	// arrives
+	result := s.readOutput(ctx, nil, 2*time.Second)
+	if result.Closed {
+		closeConsoleSession(s)
+		return "", fmt.Errorf("failed to attach to the console of %s/%s: %s", params.Namespace, params.VMName, result.Error)
+	}
+	return formatJSON(result)
+}
+
+// handleConsoleSend is the tools/call handler for vm_console_send
+func handleConsoleSend(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ConsoleSendParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	s, err := lookupConsoleSession(ctx, params.SessionID)
+	if err != nil {
+		return "", err
+	}
+
+	input := params.Text
+	for _, key := range params.Keys {
+		sequence, ok := consoleKeys[key]
+		if !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("unknown key '%s'", key)}
+		}
+		input += sequence
+	}
+	if len(params.Keys) == 0 && (params.Enter == nil || *params.Enter) {
+		input += consoleKeys["enter"]
+	}
+	if input == "" {
+		return "", missingArgument("text or keys")
+	}
+
+	if err := s.send(input); err != nil {
+		return "", err
+	}
+	return formatJSON(map[string]interface{}{"sessionId": s.id, "sent": len(input)})
+}
+
+// handleConsoleRead is the tools/call handler for vm_console_read
+func handleConsoleRead(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ConsoleReadParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Timeout < 0 || params.Timeout > maxConsoleReadTimeout {
+		return "", &invalidParamsError{err: fmt.Errorf("timeout must be between 0 and %d", maxConsoleReadTimeout)}
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultConsoleReadTimeout
+	}
+	var waitFor *regexp.Regexp
+	if params.WaitFor != "" {
+		var err error
+		if waitFor, err = regexp.Compile(params.WaitFor); err != nil {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid wait_for: %v", err)}
+		}
+	}
+	s, err := lookupConsoleSession(ctx, params.SessionID)
+	if err != nil {
+		return "", err
+	}
+
+	return formatJSON(s.readOutput(ctx, waitFor, time.Duration(params.Timeout)*time.Second))
+}
+
+// handleConsoleClose is the tools/call handler for vm_console_close
+func handleConsoleClose(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ConsoleReadParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	s, err := lookupConsoleSession(ctx, params.SessionID)
+	if err != nil {
+		return "", err
+	}
+
+	closeConsoleSession(s)
+	result := s.readOutput(ctx, nil, 0)
+	result.Closed = true
+	return formatJSON(result)
+}
+
+// openConsoleSession starts vm-exec --attach for the VM and registers the
+// session
+func openConsoleSession(ctx context.Context, namespace, vmName string) (*consoleSession, error) {
+	consoleSessions.janitor.Do(func() { go closeIdleConsoles() })
+
+	consoleSessions.mu.Lock()
+	open := len(consoleSessions.sessions)
+	consoleSessions.mu.Unlock()
+	if open >= maxConsoleSessions {
+		return nil, fmt.Errorf("%d console sessions are open already, close one with vm_console_close", open)
+	}
+
+	vmExecPath, err := findVMExecBinary()
+	if err != nil {
+		return nil, fmt.Errorf("vm-exec binary not found: %v", err)
+	}
+	args := append(kubeconfigArgs(ctx), "-n", namespace, "-v", vmName, "--attach", "--progress")
+	logMessage(LogDebug, "vm-exec", "%s %s", vmExecPath, strings.Join(args, " "))
+
+	cmd := exec.Command(vmExecPath, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &lockedBuffer{}
+	// The phases time the connection to the console
+	progress := &vmExecProgressWriter{output: stderr}
+	cmd.Stderr = progress
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start vm-exec: %v", err)
+	}
+
+	s := &consoleSession{
+		id:        consoleSessionID(),
+		namespace: namespace,
+		vmName:    vmName,
+		owner:     identityName(ctx),
+		cmd:       cmd,
+		stdin:     stdin,
+		changed:   make(chan struct{}),
+		lastUsed:  clock.Now(),
+	}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				s.append(buf[:n])
+			}
+			if err != nil {
+				break
+			}
+		}
+		// stdout is drained, vm-exec can be waited for
+		waitErr := cmd.Wait()
+		progress.flush()
+		s.mu.Lock()
+		if !s.closed && waitErr != nil {
+			s.err = strings.TrimSpace(stderr.String())
+			if s.err == "" {
+				s.err = waitErr.Error()
+			}
+		}
+		s.closed = true
+		s.notifyLocked()
+		s.mu.Unlock()
+	}()
+
+	consoleSessions.mu.Lock()
+	consoleSessions.sessions[s.id] = s
+	consoleSessions.mu.Unlock()
+	logMessage(LogInfo, "console", "Opened console session %s to %s/%s", s.id, namespace, vmName)
+	return s, nil
+}
+
+// consoleSessionID returns the ID of a new session, random enough that the
+// sessions of other clients cannot be guessed
+func consoleSessionID() string {
+	suffix := make([]byte, 16)
+	rand.Read(suffix)
+	return "console-" + hex.EncodeToString(suffix)
+}
+
+// lookupConsoleSession returns the open session with the ID, if the caller
+// opened it
+func lookupConsoleSession(ctx context.Context, id string) (*consoleSession, error) {
+	if id == "" {
+		return nil, missingArgument("session_id")
+	}
+	consoleSessions.mu.Lock()
+	defer consoleSessions.mu.Unlock()
+	s, ok := consoleSessions.sessions[id]
+	// The sessions of other identities are not told apart from missing ones
+	if !ok || s.owner != identityName(ctx) {
+		return nil, &invalidParamsError{err: fmt.Errorf("no console session '%s', open one with vm_console_open", id)}
+	}
+	return s, nil
+}
+
+// closeConsoleSession unregisters the session and stops its vm-exec
+func closeConsoleSession(s *consoleSession) {
+	consoleSessions.mu.Lock()
+	delete(consoleSessions.sessions, s.id)
+	consoleSessions.mu.Unlock()
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.stdin.Close()
+	s.cmd.Process.Kill()
+	logMessage(LogInfo, "console", "Closed console session %s", s.id)
+}
+
+// closeIdleConsoles closes the sessions unused for the idle timeout
+func closeIdleConsoles() {
+	for {
+		<-clock.After(time.Minute)
+
+		consoleSessions.mu.Lock()
+		var idle []*consoleSession
+		for _, s := range consoleSessions.sessions {
+			s.mu.Lock()
+			if clock.Now().Sub(s.lastUsed) >= consoleSessionIdleTimeout {
+				idle = append(idle, s)
+			}
+			s.mu.Unlock()
+		}
+		consoleSessions.mu.Unlock()
+		for _, s := range idle {
+			closeConsoleSession(s)
+		}
+	}
+}
+
+// closeConsoleSessions closes every session, before the server exits
+func closeConsoleSessions() {
+	consoleSessions.mu.Lock()
+	sessions := make([]*consoleSession, 0, len(consoleSessions.sessions))
+	for _, s := range consoleSessions.sessions {
+		sessions = append(sessions, s)
+	}
+	consoleSessions.mu.Unlock()
+	for _, s := range sessions {
+		closeConsoleSession(s)
+	}
+}
+
+// append adds console output, dropping the oldest bytes beyond the buffer
+// size
+func (s *consoleSession) append(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.output = append(s.output, data...)
+	if excess := len(s.output) - consoleBufferSize; excess > 0 {
+		s.output = append([]byte(nil), s.output[excess:]...)
+		s.start += excess
+	}
+	s.notifyLocked()
+}
+
+// notifyLocked wakes up the reads waiting for output. s.mu must be held.
+func (s *consoleSession) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// send writes input to the console
+func (s *consoleSession) send(input string) error {
+	s.mu.Lock()
+	closed, problem := s.closed, s.err
+	s.lastUsed = clock.Now()
+	s.mu.Unlock()
+	if closed {
+		return fmt.Errorf("console session %s is closed: %s", s.id, problem)
+	}
+	if _, err := io.WriteString(s.stdin, input); err != nil {
+		return fmt.Errorf("failed to write to console session %s: %v", s.id, err)
+	}
+	return nil
+}
+
+// readOutput waits until the unread output matches waitFor, or without a
+// pattern until the console stayed quiet for consoleQuietPeriod, at most for
+// timeout, and returns the unread output
+func (s *consoleSession) readOutput(ctx context.Context, waitFor *regexp.Regexp, timeout time.Duration) *ConsoleSessionResult {
+	deadline := clock.After(timeout)
+	for {
+		s.mu.Lock()
+		unread := s.output[max(s.read-s.start, 0):]
+		done := s.closed
+		if waitFor != nil && waitFor.Match(cleanConsoleOutput(unread)) {
+			done = true
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		if done || timeout == 0 {
+			break
+		}
+
+		var quiet <-chan time.Time
+		if waitFor == nil && len(unread) > 0 {
+			quiet = clock.After(consoleQuietPeriod)
+		}
+		timedOut := false
+		select {
+		case <-changed:
+			continue
+		case <-quiet:
+		case <-deadline:
+			timedOut = true
+		case <-ctx.Done():
+			timedOut = true
+		}
+		if timedOut || quiet != nil {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := &ConsoleSessionResult{
+		SessionID: s.id,
+		Namespace: s.namespace,
+		VMName:    s.vmName,
+		Closed:    s.closed,
+		Error:     s.err,
+	}
+	offset := s.read - s.start
+	if offset < 0 {
+		result.Dropped = -offset
+		offset = 0
+	}
+	result.Output = string(cleanConsoleOutput(s.output[offset:]))
+	if waitFor != nil {
+		matched := waitFor.MatchString(result.Output)
+		result.Matched = &matched
+	}
+	s.read = s.start + len(s.output)
+	s.lastUsed = clock.Now()
+	return result
+}
+
+// consoleEscapeRegex matches terminal escape sequences emitted by guest
+// consoles
+var consoleEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[()][0-9A-B]`)
+
+// cleanConsoleOutput removes escape sequences and carriage returns
+func cleanConsoleOutput(output []byte) []byte {
+	output = consoleEscapeRegex.ReplaceAll(output, nil)
+	output = []byte(strings.ReplaceAll(string(output), "\r\n", "\n"))
+	return []byte(strings.ReplaceAll(string(output), "\r", ""))
+}
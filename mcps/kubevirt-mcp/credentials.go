@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// credentialsKeyEnv holds the base64 encoded 32-byte key encrypting the
+	// cached credentials. It is only read from the environment so the key
+	// does not end up in a file or the process arguments.
+	credentialsKeyEnv = "KUBEVIRT_MCP_CREDENTIALS_KEY"
+	// credentialsKeySecretEnv names the namespace/name of a Secret holding
+	// the key under credentialsKeySecretKey, like keySecret of the
+	// credentials section and the --credentials-key-secret flag
+	credentialsKeySecretEnv = "KUBEVIRT_MCP_CREDENTIALS_KEY_SECRET"
+	credentialsKeySecretKey = "key"
+
+	// encryptedSuffix is appended to the path of encrypted credentials
+	encryptedSuffix = ".enc"
+	// credentialMagic starts encrypted credentials, followed by the nonce
+	// and the NaCl secretbox
+	credentialMagic = "kubevirt-mcp-credential-v1\n"
+)
+
+// Kinds of cached credentials
+const (
+	credentialLogin = "login"
+	credentialSSH   = "ssh"
+)
+
+// CredentialsListParams represents the parameters for listing the cached
+// credentials
+type CredentialsListParams struct {
+	Format string `json:"format,omitempty"`
+}
+
+// CredentialsForgetParams represents the parameters for deleting cached
+// credentials
+type CredentialsForgetParams struct {
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name,omitempty"`
+	All  bool   `json:"all,omitempty"`
+}
+
+// CachedCredential is a credential kept in the state directory
+type CachedCredential struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Encrypted bool   `json:"encrypted"`
+	User      string `json:"user,omitempty"`
+	Modified  string `json:"modified"`
+}
+
+// CredentialsListResult is the credentials_list tool result
+type CredentialsListResult struct {
+	Encryption  bool               `json:"encryption"`
+	KeySource   string             `json:"keySource,omitempty"`
+	Credentials []CachedCredential `json:"credentials"`
+	Note        string             `json:"note,omitempty"`
+}
+
+// CredentialsForgetResult is the credentials_forget tool result
+type CredentialsForgetResult struct {
+	Forgotten []CachedCredential `json:"forgotten"`
+}
+
+// credentialsKey is the key encrypting the cached credentials, nil when
+// they are stored in clear
+var credentialsKey *[32]byte
+
+// credentialsKeySource tells where the key came from, for credentials_list
+var credentialsKeySource string
+
+// decryptedCredentials holds the decrypted copies handed to kubectl, vm-exec
+// and ssh, which need a file. They live in a private directory of the
+// runtime directory, removed when the server exits.
+var decryptedCredentials = struct {
+	sync.Mutex
+	dir   string
+	files map[string]decryptedCredential
+}{files: map[string]decryptedCredential{}}
+
+// decryptedCredential is the decrypted copy of an encrypted credential
+type decryptedCredential struct {
+	path     string
+	modified time.Time
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "credentials_list",
+		Description: "List the credentials the server caches in its state directory: the cluster_login kubeconfig and the vm_ssh_bootstrap private keys, and whether they are encrypted at rest. No secret is returned",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleCredentialsList,
+	})
+	registerTool(Tool{
+		Name:        "credentials_forget",
+		Description: "Delete cached credentials from the state directory: the cluster_login kubeconfig or the SSH key pair of a VM. Secrets stored in the cluster and keys injected into guests are left alone",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"kind": map[string]interface{}{
+					"type":        "string",
+					"description": "Kind of credential, as listed by credentials_list",
+					"enum":        []string{credentialLogin, credentialSSH},
+				},
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Credential to delete, namespace/vm for SSH keys, not needed for the login kubeconfig",
+				},
+				"all": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Delete every cached credential",
+					"default":     false,
+				},
+			},
+		},
+		Handler: handleCredentialsForget,
+	})
+}
+
+// startCredentials loads the key encrypting the cached credentials, when
+// one is configured, and encrypts the credentials cached in clear before
+func startCredentials() error {
+	key, source, err := loadCredentialsKey()
+	if err != nil || key == nil {
+		return err
+	}
+	credentialsKey = key
+	credentialsKeySource = source
+
+	for _, credential := range cachedCredentials() {
+		if credential.Encrypted {
+			continue
+		}
+		data, err := os.ReadFile(credential.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", credential.Path, err)
+		}
+		if err := writeCredential(credential.Path, data); err != nil {
+			return err
+		}
+		logMessage(LogInfo, "credentials", "Encrypted cached credential %s", credential.Path)
+	}
+	return nil
+}
+
+// loadCredentialsKey reads the key from credentialsKeyEnv, else from the
+// configured Secret. The Secret is read with KUBECONFIG or the default
+// kubeconfig, never with the cluster_login kubeconfig it may encrypt.
+func loadCredentialsKey() (*[32]byte, string, error) {
+	var encoded, source string
+	if value := os.Getenv(credentialsKeyEnv); value != "" {
+		encoded, source = value, credentialsKeyEnv
+	} else if secret := serverConfig.Credentials.KeySecret; secret != "" {
+		namespace, name, ok := strings.Cut(secret, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, "", fmt.Errorf("invalid credentials key Secret %q, use namespace/name", secret)
+		}
+		ctx, cancel := clock.WithTimeout(context.Background(), timeoutFor(timeoutKubectl))
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "kubectl", "get", "secret", name, "-n", namespace, "-o", "jsonpath={.data."+credentialsKeySecretKey+"}")
+		output, err := commandOutput(ctx, cmd, false)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read the credentials key Secret %s: %v", secret, err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid data in the credentials key Secret %s: %v", secret, err)
+		}
+		// The Secret can hold the raw key or its base64 text
+		encoded, source = string(decoded), "Secret "+secret
+		if len(decoded) == 32 {
+			encoded = base64.StdEncoding.EncodeToString(decoded)
+		}
+	} else {
+		return nil, "", nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw) != 32 {
+		return nil, "", fmt.Errorf("the credentials key of %s must be 32 bytes encoded in base64, e.g. from openssl rand -base64 32", source)
+	}
+	var key [32]byte
+	copy(key[:], raw)
+	return &key, source, nil
+}
+
+// writeCredential stores a credential of the state directory, encrypted
+// when a key is configured, replacing the other form
+func writeCredential(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if credentialsKey == nil {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+		os.Remove(path + encryptedSuffix)
+		return nil
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := append([]byte(credentialMagic), nonce[:]...)
+	sealed = secretbox.Seal(sealed, data, &nonce, credentialsKey)
+	if err := os.WriteFile(path+encryptedSuffix, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path+encryptedSuffix, err)
+	}
+	os.Remove(path)
+	return nil
+}
+
+// readCredential returns the content of a credential of the state directory
+func readCredential(path string) ([]byte, error) {
+	sealed, err := os.ReadFile(path + encryptedSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if credentialsKey == nil {
+		return nil, fmt.Errorf("%s is encrypted, set %s or the credentials key Secret", path+encryptedSuffix, credentialsKeyEnv)
+	}
+	sealed, ok := bytes.CutPrefix(sealed, []byte(credentialMagic))
+	if !ok || len(sealed) < 24 {
+		return nil, fmt.Errorf("%s is not an encrypted credential", path+encryptedSuffix)
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	data, ok := secretbox.Open(nil, sealed[24:], &nonce, credentialsKey)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt %s, wrong credentials key", path+encryptedSuffix)
+	}
+	return data, nil
+}
+
+// credentialStored reports whether a credential is stored at path, in clear
+// or encrypted
+func credentialStored(path string) bool {
+	if _, err := os.Stat(path + encryptedSuffix); err == nil {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// credentialFile returns a file with the credential stored at path, for
+// the commands that read it from a file: path itself when it is stored in
+// clear, else a decrypted copy. It reports false when nothing is stored.
+func credentialFile(path string) (string, bool) {
+	info, err := os.Stat(path + encryptedSuffix)
+	if err != nil {
+		if _, err := os.Stat(path); err != nil {
+			return "", false
+		}
+		return path, true
+	}
+
+	decryptedCredentials.Lock()
+	defer decryptedCredentials.Unlock()
+	if cached, ok := decryptedCredentials.files[path]; ok && cached.modified.Equal(info.ModTime()) {
+		if _, err := os.Stat(cached.path); err == nil {
+			return cached.path, true
+		}
+	}
+
+	data, err := readCredential(path)
+	if err != nil {
+		logMessage(LogError, "credentials", "%v", err)
+		return "", false
+	}
+	if decryptedCredentials.dir == "" {
+		dir, err := os.MkdirTemp(os.Getenv("XDG_RUNTIME_DIR"), "kubevirt-mcp-credentials-")
+		if err != nil {
+			logMessage(LogError, "credentials", "Failed to create the directory of decrypted credentials: %v", err)
+			return "", false
+		}
+		decryptedCredentials.dir = dir
+	}
+	// Copies are named after the stored path, so the SSH keys of VMs with
+	// the same key file name do not collide
+	sum := sha256.Sum256([]byte(path))
+	copyPath := filepath.Join(decryptedCredentials.dir, hex.EncodeToString(sum[:8])+"-"+filepath.Base(path))
+	if err := os.WriteFile(copyPath, data, 0600); err != nil {
+		logMessage(LogError, "credentials", "Failed to write decrypted %s: %v", path, err)
+		return "", false
+	}
+	decryptedCredentials.files[path] = decryptedCredential{path: copyPath, modified: info.ModTime()}
+	return copyPath, true
+}
+
+// removeDecryptedCredentials deletes the decrypted copies, called on exit
+func removeDecryptedCredentials() {
+	decryptedCredentials.Lock()
+	defer decryptedCredentials.Unlock()
+	if decryptedCredentials.dir != "" {
+		os.RemoveAll(decryptedCredentials.dir)
+		decryptedCredentials.dir = ""
+	}
+	decryptedCredentials.files = map[string]decryptedCredential{}
+}
+
+// forgetCredential deletes a stored credential in both forms along with
+// its decrypted copy
+func forgetCredential(path string) {
+	os.Remove(path)
+	os.Remove(path + encryptedSuffix)
+	decryptedCredentials.Lock()
+	if cached, ok := decryptedCredentials.files[path]; ok {
+		os.Remove(cached.path)
+		delete(decryptedCredentials.files, path)
+	}
+	decryptedCredentials.Unlock()
+}
+
+// cachedCredentials lists the credentials of the state directory
+func cachedCredentials() []CachedCredential {
+	var credentials []CachedCredential
+	add := func(kind, name, path, user string) {
+		credential := CachedCredential{Kind: kind, Name: name, Path: path, User: user}
+		info, err := os.Stat(path + encryptedSuffix)
+		if err == nil {
+			credential.Encrypted = true
+		} else if info, err = os.Stat(path); err != nil {
+			return
+		}
+		credential.Modified = info.ModTime().UTC().Format(time.RFC3339)
+		credentials = append(credentials, credential)
+	}
+
+	add(credentialLogin, "kubeconfig", loginKubeconfigPath(), "")
+	dirs, _ := filepath.Glob(filepath.Join(stateDir(), "ssh", "*", "*"))
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		namespace, vmName := filepath.Base(filepath.Dir(dir)), filepath.Base(dir)
+		user, _ := os.ReadFile(filepath.Join(dir, sshUserFile))
+		add(credentialSSH, namespace+"/"+vmName, filepath.Join(dir, sshKeyFile), strings.TrimSpace(string(user)))
+	}
+	return credentials
+}
+
+// handleCredentialsList is the tools/call handler for credentials_list
+func handleCredentialsList(ctx context.Context, args json.RawMessage) (string, error) {
+	var params CredentialsListParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	result := &CredentialsListResult{
+		Encryption:  credentialsKey != nil,
+		KeySource:   credentialsKeySource,
+		Credentials: cachedCredentials(),
+	}
+	if result.Credentials == nil {
+		result.Credentials = []CachedCredential{}
+	}
+	if !result.Encryption {
+		result.Note = "credentials are stored in clear, set " + credentialsKeyEnv + " or the credentials key Secret to encrypt them"
+		for _, credential := range result.Credentials {
+			if credential.Encrypted {
+				result.Note = "encrypted credentials cannot be used without their key, set " + credentialsKeyEnv + " or the credentials key Secret"
+				break
+			}
+		}
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// handleCredentialsForget is the tools/call handler for credentials_forget
+func handleCredentialsForget(ctx context.Context, args json.RawMessage) (string, error) {
+	var params CredentialsForgetParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if !params.All && params.Kind == "" {
+		return "", &invalidParamsError{err: errors.New("set kind, or all to forget every credential")}
+	}
+	if params.Kind != "" && params.Kind != credentialLogin && params.Kind != credentialSSH {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown kind '%s', use %s or %s", params.Kind, credentialLogin, credentialSSH)}
+	}
+	if params.Kind == credentialSSH && params.Name == "" && !params.All {
+		return "", missingArgument("name")
+	}
+
+	result := &CredentialsForgetResult{Forgotten: []CachedCredential{}}
+	for _, credential := range cachedCredentials() {
+		if !params.All && (credential.Kind != params.Kind || (params.Kind == credentialSSH && credential.Name != params.Name)) {
+			continue
+		}
+		forgetCredential(credential.Path)
+		if credential.Kind == credentialSSH {
+			os.RemoveAll(filepath.Dir(credential.Path))
+		}
+		logMessage(LogInfo, "credentials", "Forgot %s credential %s", credential.Kind, credential.Name)
+		result.Forgotten = append(result.Forgotten, credential)
+	}
+	if len(result.Forgotten) == 0 && !params.All {
+		return "", &invalidParamsError{err: fmt.Errorf("no cached %s credential %s, see credentials_list", params.Kind, params.Name)}
+	}
+	return formatJSON(result)
+}
+
+// tables renders the cached credentials
+func (r *CredentialsListResult) tables() []table {
+	credentials := table{title: "Cached credentials", headers: []string{"KIND", "NAME", "USER", "ENCRYPTED", "MODIFIED", "PATH"}}
+	for _, c := range r.Credentials {
+		path := c.Path
+		if c.Encrypted {
+			path += encryptedSuffix
+		}
+		credentials.rows = append(credentials.rows, []string{c.Kind, c.Name, c.User, fmt.Sprint(c.Encrypted), c.Modified, path})
+	}
+	tables := []table{credentials}
+	if r.Note != "" {
+		tables = append(tables, table{title: "Notes", headers: []string{"NOTE"}, rows: [][]string{{r.Note}}})
+	}
+	return tables
+}
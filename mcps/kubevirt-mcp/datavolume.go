@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDataVolumeTimeout = 600
+
+	dataVolumeSucceeded = "Succeeded"
+	dataVolumeFailed    = "Failed"
+
+	// bindImmediateAnnotation makes CDI populate a DataVolume on a
+	// WaitForFirstConsumer storage class before a VM uses it
+	bindImmediateAnnotation = "cdi.kubevirt.io/storage.bind.immediate.requested"
+)
+
+// DataVolumeParams represents the parameters of the DataVolume tools
+type DataVolumeParams struct {
+	Name          string `json:"name,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+	AllNamespaces bool   `json:"all_namespaces,omitempty"`
+	URL           string `json:"url,omitempty"`
+	SourcePVC     string `json:"source_pvc,omitempty"`
+	Size          string `json:"size,omitempty"`
+	StorageClass  string `json:"storage_class,omitempty"`
+	Wait          bool   `json:"wait,omitempty"`
+	Timeout       int    `json:"timeout,omitempty"`
+	Format        string `json:"format,omitempty"`
+}
+
+type dataVolume struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Source struct {
+			HTTP *struct {
+				URL string `json:"url"`
+			} `json:"http,omitempty"`
+			Registry *struct {
+				URL string `json:"url"`
+			} `json:"registry,omitempty"`
+			PVC *struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"pvc,omitempty"`
+			Upload *struct{} `json:"upload,omitempty"`
+			Blank  *struct{} `json:"blank,omitempty"`
+		} `json:"source"`
+		SourceRef *struct {
+			Kind      string `json:"kind"`
+			Namespace string `json:"namespace,omitempty"`
+			Name      string `json:"name"`
+		} `json:"sourceRef,omitempty"`
+		Storage *dataVolumeStorage `json:"storage,omitempty"`
+		PVC     *dataVolumeStorage `json:"pvc,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase        string      `json:"phase,omitempty"`
+		Progress     string      `json:"progress,omitempty"`
+		RestartCount int         `json:"restartCount,omitempty"`
+		Conditions   []Condition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+type dataVolumeStorage struct {
+	StorageClassName string `json:"storageClassName,omitempty"`
+	Resources        struct {
+		Requests map[string]string `json:"requests,omitempty"`
+	} `json:"resources,omitempty"`
+}
+
+// DataVolumeInfo reports a DataVolume
+type DataVolumeInfo struct {
+	Name         string `json:"name"`
+	Namespace    string `json:"namespace"`
+	Source       string `json:"source,omitempty"`
+	Size         string `json:"size,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	Progress     string `json:"progress,omitempty"`
+	Restarts     int    `json:"restarts,omitempty"`
+	Message      string `json:"message,omitempty"`
+	Age          string `json:"age,omitempty"`
+}
+
+// DataVolumeResult is the result of the DataVolume tools
+type DataVolumeResult struct {
+	DataVolume  *DataVolumeInfo  `json:"dataVolume,omitempty"`
+	DataVolumes []DataVolumeInfo `json:"dataVolumes,omitempty"`
+	Duration    string           `json:"duration,omitempty"`
+	Note        string           `json:"note,omitempty"`
+}
+
+func init() {
+	namespace := map[string]interface{}{
+		"type":        "string",
+		"description": "Kubernetes namespace of the DataVolume",
+		"default":     "default",
+	}
+	wait := map[string]interface{}{
+		"type":        "boolean",
+		"description": "Wait until the import or clone succeeded or failed, reporting its progress",
+		"default":     false,
+	}
+	timeout := map[string]interface{}{
+		"type":        "integer",
+		"description": "Timeout in seconds when waiting (default: 600)",
+		"default":     defaultDataVolumeTimeout,
+	}
+
+	registerTool(Tool{
+		Name:        "dv_create",
+		Description: "Create a CDI DataVolume importing a disk image from an HTTP(S) URL or a container registry (docker://), or cloning a PVC, optionally waiting for the import. Use it as a VM disk with vm_create data_volume",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the DataVolume",
+				},
+				"namespace": namespace,
+				"url": map[string]interface{}{
+					"type":        "string",
+					"description": "Image to import: http(s):// for a qcow2, raw or iso file, possibly compressed, docker:// for a containerdisk",
+				},
+				"source_pvc": map[string]interface{}{
+					"type":        "string",
+					"description": "PVC to clone, [namespace/]name",
+				},
+				"size": map[string]interface{}{
+					"type":        "string",
+					"description": "Size of the disk, e.g. 10Gi; required for imports, defaults to the source size for clones",
+				},
+				"storage_class": map[string]interface{}{
+					"type":        "string",
+					"description": "StorageClass of the disk (default: the cluster default)",
+				},
+				"wait":    wait,
+				"timeout": timeout,
+			},
+			"required": []string{"name"},
+		},
+		Handler: handleDataVolumeCreate,
+	})
+
+	registerTool(Tool{
+		Name:        "dv_status",
+		Description: "Report the phase, import or clone progress, restarts and error message of a DataVolume, optionally waiting until it succeeded or failed",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the DataVolume",
+				},
+				"namespace": namespace,
+				"wait":      wait,
+				"timeout":   timeout,
+			},
+			"required": []string{"name"},
+		},
+		Handler: handleDataVolumeStatus,
+	})
+
+	registerTool(Tool{
+		Name:        "dv_list",
+		Description: "List DataVolumes with their source, size, phase, progress and restarts",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace to list DataVolumes in",
+					"default":     "default",
+				},
+				"all_namespaces": map[string]interface{}{
+					"type":        "boolean",
+					"description": "List DataVolumes across all namespaces",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleDataVolumeList,
+	})
+}
+
+// decodeDataVolumeParams decodes and validates the DataVolume tool arguments
+func decodeDataVolumeParams(args json.RawMessage, nameRequired bool) (DataVolumeParams, error) {
+	var params DataVolumeParams
+	if err := decodeArguments(args, &params); err != nil {
+		return params, err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return params, err
+	}
+	if nameRequired && params.Name == "" {
+		return params, missingArgument("name")
+	}
+	if params.Timeout < 0 {
+		return params, &invalidParamsError{err: errors.New("timeout cannot be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultDataVolumeTimeout
+	}
+	return params, nil
+}
+
+// handleDataVolumeCreate is the tools/call handler for dv_create
+func handleDataVolumeCreate(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeDataVolumeParams(args, true)
+	if err != nil {
+		return "", err
+	}
+	if !vmNameRegex.MatchString(params.Name) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid DataVolume name %q, use lowercase letters, digits and dashes", params.Name)}
+	}
+	source, err := dataVolumeSource(params)
+	if err != nil {
+		return "", &invalidParamsError{err: err}
+	}
+	if params.Size != "" {
+		if _, ok := parseQuantity(params.Size); !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid size %q", params.Size)}
+		}
+	} else if params.SourcePVC == "" {
+		return "", &invalidParamsError{err: errors.New("size is required for imports")}
+	}
+
+	storage := map[string]interface{}{}
+	if params.Size != "" {
+		storage["resources"] = map[string]interface{}{
+			"requests": map[string]interface{}{"storage": params.Size},
+		}
+	}
+	if params.StorageClass != "" {
+		storage["storageClassName"] = params.StorageClass
+	}
+	// spec.storage rather than spec.pvc lets CDI pick the access and volume
+	// modes from the StorageProfile
+	if err := createObject(ctx, map[string]interface{}{
+		"apiVersion": "cdi.kubevirt.io/v1beta1",
+		"kind":       "DataVolume",
+		"metadata": map[string]interface{}{
+			"name":        params.Name,
+			"namespace":   params.Namespace,
+			"labels":      managedLabels("dv_create", false),
+			"annotations": map[string]string{bindImmediateAnnotation: "true"},
+		},
+		"spec": map[string]interface{}{
+			"source":  source,
+			"storage": storage,
+		},
+	}); err != nil {
+		return "", fmt.Errorf("failed to create DataVolume: %v", err)
+	}
+	logMessage(LogInfo, "storage", "Created DataVolume %s/%s", params.Namespace, params.Name)
+
+	result, err := dataVolumeStatus(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	if result.DataVolume.Phase != dataVolumeSucceeded {
+		result.Note = "the DataVolume can be used by a VM right away, the VM starts once the import finished"
+	}
+	return formatJSON(result)
+}
+
+// handleDataVolumeStatus is the tools/call handler for dv_status
+func handleDataVolumeStatus(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeDataVolumeParams(args, true)
+	if err != nil {
+		return "", err
+	}
+	result, err := dataVolumeStatus(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// handleDataVolumeList is the tools/call handler for dv_list
+func handleDataVolumeList(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeDataVolumeParams(args, false)
+	if err != nil {
+		return "", err
+	}
+
+	var list struct {
+		Items []dataVolume `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &list, append([]string{"get", "datavolumes.cdi.kubevirt.io"}, namespaceArgs(params.Namespace, params.AllNamespaces)...)...); err != nil {
+		return "", cdiError(err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i].Metadata, list.Items[j].Metadata
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	result := &DataVolumeResult{DataVolumes: []DataVolumeInfo{}}
+	for _, dv := range list.Items {
+		result.DataVolumes = append(result.DataVolumes, dataVolumeInfo(dv))
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// dataVolumeSource returns the source of the DataVolume to create
+func dataVolumeSource(params DataVolumeParams) (map[string]interface{}, error) {
+	switch {
+	case params.URL != "" && params.SourcePVC != "":
+		return nil, errors.New("url and source_pvc are mutually exclusive")
+	case strings.HasPrefix(params.URL, "docker://"):
+		return map[string]interface{}{"registry": map[string]interface{}{"url": params.URL}}, nil
+	case strings.HasPrefix(params.URL, "http://") || strings.HasPrefix(params.URL, "https://"):
+		return map[string]interface{}{"http": map[string]interface{}{"url": params.URL}}, nil
+	case params.URL != "":
+		return nil, fmt.Errorf("unsupported url %q, use http(s):// or docker://", params.URL)
+	case params.SourcePVC != "":
+		namespace, name, found := strings.Cut(params.SourcePVC, "/")
+		if !found {
+			namespace, name = params.Namespace, params.SourcePVC
+		}
+		return map[string]interface{}{"pvc": map[string]interface{}{"namespace": namespace, "name": name}}, nil
+	}
+	return nil, errors.New("url or source_pvc is required")
+}
+
+// dataVolumeStatus returns the DataVolume, polling until it succeeded or
+// failed when waiting
+func dataVolumeStatus(ctx context.Context, params DataVolumeParams) (*DataVolumeResult, error) {
+	start := clock.Now()
+	deadline := start.Add(time.Duration(params.Timeout) * time.Second)
+	for {
+		var dv dataVolume
+		if err := runKubectlJSON(ctx, &dv, "get", "datavolumes.cdi.kubevirt.io", params.Name, "-n", params.Namespace); err != nil {
+			return nil, cdiError(err)
+		}
+		info := dataVolumeInfo(dv)
+		result := &DataVolumeResult{DataVolume: &info}
+		switch {
+		case !params.Wait:
+			return result, nil
+		case info.Phase == dataVolumeSucceeded:
+			result.Duration = humanDuration(clock.Now().Sub(start))
+			return result, nil
+		case info.Phase == dataVolumeFailed:
+			return nil, fmt.Errorf("DataVolume %s/%s failed: %s", params.Namespace, params.Name, info.Message)
+		}
+
+		if clock.Now().After(deadline) {
+			return nil, fmt.Errorf("DataVolume %s/%s did not succeed within %ds (phase %s, progress %s, restarts %d): %s", params.Namespace, params.Name, params.Timeout, info.Phase, info.Progress, info.Restarts, info.Message)
+		}
+		reportProgress(ctx, "DataVolume %s/%s: %s %s", params.Namespace, params.Name, info.Phase, info.Progress)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for DataVolume %s/%s cancelled", params.Namespace, params.Name)
+		case <-clock.After(2 * time.Second):
+		}
+	}
+}
+
+// dataVolumeInfo summarizes a DataVolume
+func dataVolumeInfo(dv dataVolume) DataVolumeInfo {
+	info := DataVolumeInfo{
+		Name:      dv.Metadata.Name,
+		Namespace: dv.Metadata.Namespace,
+		Phase:     dv.Status.Phase,
+		Progress:  dv.Status.Progress,
+		Restarts:  dv.Status.RestartCount,
+		Age:       since(dv.Metadata.CreationTimestamp),
+	}
+	if info.Progress == "N/A" {
+		info.Progress = ""
+	}
+
+	source := dv.Spec.Source
+	switch {
+	case source.HTTP != nil:
+		info.Source = source.HTTP.URL
+	case source.Registry != nil:
+		info.Source = source.Registry.URL
+	case source.PVC != nil:
+		info.Source = "pvc " + source.PVC.Namespace + "/" + source.PVC.Name
+	case source.Upload != nil:
+		info.Source = "upload"
+	case source.Blank != nil:
+		info.Source = "blank"
+	case dv.Spec.SourceRef != nil:
+		info.Source = strings.ToLower(dv.Spec.SourceRef.Kind) + " " + dv.Spec.SourceRef.Name
+	}
+
+	storage := dv.Spec.Storage
+	if storage == nil {
+		storage = dv.Spec.PVC
+	}
+	if storage != nil {
+		info.Size = storage.Resources.Requests["storage"]
+		info.StorageClass = storage.StorageClassName
+	}
+
+	// The Running condition explains import errors and retries, the Bound
+	// condition a claim waiting for its volume
+	if dv.Status.Phase != dataVolumeSucceeded {
+		for _, conditionType := range []string{"Running", "Bound"} {
+			for _, cond := range dv.Status.Conditions {
+				if cond.Type == conditionType && cond.Message != "" && info.Message == "" && (cond.Status != "True" || cond.Reason == "Error") {
+					info.Message = cond.Message
+				}
+			}
+		}
+	}
+	return info
+}
+
+// cdiError points to CDI when the cluster does not know DataVolumes
+func cdiError(err error) error {
+	if strings.Contains(err.Error(), "doesn't have a resource type") {
+		return fmt.Errorf("DataVolumes are not available, is CDI installed?: %v", err)
+	}
+	return err
+}
+
+// tables renders the DataVolumes as a table
+func (r *DataVolumeResult) tables() []table {
+	dataVolumes := table{title: "DataVolumes", headers: []string{"NAMESPACE", "NAME", "SOURCE", "SIZE", "PHASE", "PROGRESS", "RESTARTS", "AGE", "MESSAGE"}}
+	for _, dv := range r.DataVolumes {
+		dataVolumes.rows = append(dataVolumes.rows, []string{dv.Namespace, dv.Name, dv.Source, dv.Size, dv.Phase, dv.Progress, fmt.Sprint(dv.Restarts), dv.Age, dv.Message})
+	}
+	return []table{dataVolumes}
+}
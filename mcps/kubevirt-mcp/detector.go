@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,21 +29,60 @@ type Config struct {
 	} `json:"docs"`
 }
 
+// loadConfig reads config.json from configJSONPaths, the first one found
+// wins, and applies the docs folders of the server configuration on top
 func loadConfig() (*Config, error) {
-	configPath := filepath.Join("config", "config.json")
-	data, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %v", err)
-	}
-
 	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	found := false
+	for _, path := range configJSONPaths() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		found = true
+		break
 	}
 
+	if docs := serverConfig.Docs; docs.Kubernetes != "" || docs.OpenShift != "" {
+		if docs.Kubernetes != "" {
+			config.Docs.Kubernetes = docs.Kubernetes
+		}
+		if docs.OpenShift != "" {
+			config.Docs.OpenShift = docs.OpenShift
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("failed to read config file: no config/config.json in the working directory, next to or above the executable, or in the XDG config directory, and no docs settings")
+	}
 	return &config, nil
 }
 
+// configJSONPaths returns where config.json is looked for:
+// config/config.json of the working directory, of the executable directory
+// and of its parents, e.g. the repository root for bin/kubevirt-mcp, and
+// kubevirt-mcp/config.json of the XDG config directory
+func configJSONPaths() []string {
+	paths := []string{filepath.Join("config", "config.json")}
+	if dir, err := executableDir(); err == nil {
+		for {
+			paths = append(paths, filepath.Join(dir, "config", "config.json"))
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "kubevirt-mcp", "config.json"))
+	}
+	return paths
+}
+
 func detectClusterType(kubeconfigPath string) (string, string, error) {
 	// Load configuration
 	config, err := loadConfig()
@@ -57,7 +99,7 @@ func detectClusterType(kubeconfigPath string) (string, string, error) {
 		cmd = exec.Command("kubectl", "api-resources")
 	}
 
-	output, err := cmd.Output()
+	output, err := commandOutput(context.Background(), cmd, false)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to detect cluster type: %v", err)
 	}
@@ -70,116 +112,415 @@ func detectClusterType(kubeconfigPath string) (string, string, error) {
 	return "kubernetes", config.Docs.Kubernetes, nil
 }
 
-func detectKubevirtciCluster() (string, error) {
+// Environment variables of the kubeconfigs tried first and last, also set
+// with detection.kubeconfig and detection.globalKubeconfig
+const (
+	kubeconfigEnv       = "KUBECONFIG"
+	globalKubeconfigEnv = "GLOBAL_KUBECONFIG"
+)
+
+// Sources detect_kubevirtci_cluster finds a cluster through, in the order
+// they are tried
+const (
+	detectionSourceKubeconfigEnv = "KUBECONFIG"
+	detectionSourceLogin         = "cluster_login"
+	detectionSourceKubevirtci    = "kubevirtci"
+	detectionSourceInCluster     = "in-cluster"
+	detectionSourceKubeConfig    = "~/.kube/config"
+	detectionSourceGlobal        = "GLOBAL_KUBECONFIG"
+	detectionSourceRegistry      = "clusters.yaml"
+	detectionSourceSimulation    = "simulation"
+)
+
+// ClusterDetection is the structured result of detect_kubevirtci_cluster
+type ClusterDetection struct {
+	Found                bool     `json:"found"`
+	Source               string   `json:"source,omitempty"`
+	Kubeconfig           string   `json:"kubeconfig,omitempty"`
+	Provider             string   `json:"provider,omitempty"`
+	AuthMode             string   `json:"authMode,omitempty"`
+	ClusterType          string   `json:"clusterType,omitempty"`
+	KubeVirtVersion      string   `json:"kubevirtVersion,omitempty"`
+	DocsFolder           string   `json:"docsFolder,omitempty"`
+	DocsResources        string   `json:"docsResources,omitempty"`
+	SetupCommands        []string `json:"setupCommands,omitempty"`
+	VerificationCommands []string `json:"verificationCommands,omitempty"`
+}
+
+// clusterDetectionSchema is the output schema of detect_kubevirtci_cluster
+func clusterDetectionSchema() map[string]interface{} {
+	str := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "string", "description": description}
+	}
+	commands := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": description}
+	}
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"found":                map[string]interface{}{"type": "boolean", "description": "Whether an accessible cluster was found"},
+			"source":               str("Where the cluster was found: clusters.yaml, KUBECONFIG, cluster_login, kubevirtci, in-cluster, ~/.kube/config, GLOBAL_KUBECONFIG or simulation"),
+			"kubeconfig":           str("Path of the kubeconfig, empty for in-cluster authentication"),
+			"provider":             str("kubevirtci provider, e.g. k8s-1.30"),
+			"authMode":             str("How the client authenticates: token, client-certificate, exec, auth-provider, basic, serviceaccount or none"),
+			"clusterType":          str("kubernetes, openshift, or kubevirtci for registered clusters"),
+			"kubevirtVersion":      str("Observed KubeVirt version, empty when KubeVirt is not installed"),
+			"docsFolder":           str("Documentation folder for the cluster type"),
+			"docsResources":        str("URI prefix of the documents of the docs folder, listed by resources/list and read with resources/read"),
+			"setupCommands":        commands("Shell commands selecting the cluster"),
+			"verificationCommands": commands("Commands verifying the cluster and KubeVirt"),
+		},
+		"required": []string{"found"},
+	}
+}
+
+func detectKubevirtciCluster(ctx context.Context) (*ClusterDetection, error) {
+	if simulation != nil {
+		return clusterDetected(ctx, detectionSourceSimulation, "")
+	}
+
+	// A registered cluster selected by the call is described as is
+	if cluster, ok := selectedCluster(ctx); ok {
+		if registered, ok := clusters[cluster.Name]; ok && registered.Kubeconfig == cluster.Kubeconfig {
+			return registeredClusterDetected(ctx, registered)
+		}
+	}
+
 	// Try sources in priority order until we find a working cluster
 
 	// First, try KUBECONFIG environment variable
-	existingKubeconfig := os.Getenv("KUBECONFIG")
+	existingKubeconfig := expandHome(serverConfig.Detection.Kubeconfig)
 	if existingKubeconfig != "" {
+		logMessage(LogInfo, "cluster-detection", "Trying KUBECONFIG %s", existingKubeconfig)
+		reportProgress(ctx, "Trying KUBECONFIG %s", existingKubeconfig)
 		if _, err := os.Stat(existingKubeconfig); err == nil {
 			clusterInfo := testClusterConnectivity(existingKubeconfig)
 			if clusterInfo.Found {
-				clusterType, docsPath, err := detectClusterType(existingKubeconfig)
-				if err != nil {
-					return "", fmt.Errorf("cluster detection failed: %v", err)
-				}
-				result := fmt.Sprintf(`Cluster Available via KUBECONFIG environment variable
-
-Setup Commands:
-   export KUBECONFIG=%s
-   export CLUSTER_TYPE=%s
-   export DOCS_FOLDER=%s
+				return clusterDetected(ctx, detectionSourceKubeconfigEnv, existingKubeconfig)
+			}
+		}
+	}
 
-Verification:
-   kubectl get nodes
-   kubectl get kubevirt -n kubevirt
+	// Then the kubeconfig written by cluster_login
+	if loginKubeconfig, ok := credentialFile(loginKubeconfigPath()); ok {
+		logMessage(LogInfo, "cluster-detection", "Trying cluster_login kubeconfig %s", loginKubeconfig)
+		reportProgress(ctx, "Trying cluster_login kubeconfig %s", loginKubeconfig)
+		clusterInfo := testClusterConnectivity(loginKubeconfig)
+		if clusterInfo.Found {
+			return clusterDetected(ctx, detectionSourceLogin, loginKubeconfig)
+		}
+	}
 
-Ready to use %s cluster!`, existingKubeconfig, clusterType, docsPath, clusterType)
-				return result, nil
-			}
+	// Then kubevirtci clusters brought up with cluster-up
+	for _, kubevirtciKubeconfig := range kubevirtciKubeconfigs() {
+		provider := kubevirtciProvider(kubevirtciKubeconfig)
+		logMessage(LogInfo, "cluster-detection", "Trying kubevirtci %s kubeconfig %s", provider, kubevirtciKubeconfig)
+		reportProgress(ctx, "Trying kubevirtci %s kubeconfig %s", provider, kubevirtciKubeconfig)
+		clusterInfo := testClusterConnectivity(kubevirtciKubeconfig)
+		if !clusterInfo.Found {
+			continue
 		}
+		detection, err := clusterDetected(ctx, detectionSourceKubevirtci, kubevirtciKubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		setDetectedKubevirtci(kubevirtciKubeconfig)
+		return detection, nil
 	}
 
 	// Second, try in-cluster authentication (running in a pod)
+	logMessage(LogInfo, "cluster-detection", "Trying in-cluster authentication")
+	reportProgress(ctx, "Trying in-cluster authentication")
 	clusterInfo := testInClusterConnectivity()
 	if clusterInfo.Found {
-		clusterType, docsPath, err := detectClusterType("")
-		if err != nil {
-			return "", fmt.Errorf("cluster detection failed: %v", err)
-		}
-		result := fmt.Sprintf(`Cluster Available via in-cluster authentication
-
-Environment: Running inside Kubernetes pod
-   Service account authentication active
-   No kubeconfig configuration needed
-   export CLUSTER_TYPE=%s
-   export DOCS_FOLDER=%s
-
-Verification:
-   kubectl get nodes
-   kubectl get kubevirt -n kubevirt
-
-Ready to use %s cluster!`, clusterType, docsPath, clusterType)
-		return result, nil
+		return clusterDetected(ctx, detectionSourceInCluster, "")
 	}
 
 	// Third, try ~/.kube/config
 	homeDir, err := os.UserHomeDir()
 	if err == nil {
 		defaultKubeconfig := homeDir + "/.kube/config"
+		logMessage(LogInfo, "cluster-detection", "Trying %s", defaultKubeconfig)
+		reportProgress(ctx, "Trying %s", defaultKubeconfig)
 		if _, err := os.Stat(defaultKubeconfig); err == nil {
 			clusterInfo := testClusterConnectivity(defaultKubeconfig)
 			if clusterInfo.Found {
-				clusterType, docsPath, err := detectClusterType(defaultKubeconfig)
-				if err != nil {
-					return "", fmt.Errorf("cluster detection failed: %v", err)
-				}
-				result := fmt.Sprintf(`Cluster Available via ~/.kube/config
-
-Setup Commands:
-   export KUBECONFIG=%s
-   export CLUSTER_TYPE=%s
-   export DOCS_FOLDER=%s
-
-Verification:
-   kubectl get nodes
-   kubectl get kubevirt -n kubevirt
-
-Ready to use %s cluster!`, defaultKubeconfig, clusterType, docsPath, clusterType)
-				return result, nil
+				return clusterDetected(ctx, detectionSourceKubeConfig, defaultKubeconfig)
 			}
 		}
 	}
 
 	// Fourth, try GLOBAL_KUBECONFIG environment variable
-	globalKubeconfig := os.Getenv("GLOBAL_KUBECONFIG")
+	globalKubeconfig := expandHome(serverConfig.Detection.GlobalKubeconfig)
 	if globalKubeconfig != "" {
+		logMessage(LogInfo, "cluster-detection", "Trying GLOBAL_KUBECONFIG %s", globalKubeconfig)
+		reportProgress(ctx, "Trying GLOBAL_KUBECONFIG %s", globalKubeconfig)
 		if _, err := os.Stat(globalKubeconfig); err == nil {
 			clusterInfo := testClusterConnectivity(globalKubeconfig)
 			if clusterInfo.Found {
-				clusterType, docsPath, err := detectClusterType(globalKubeconfig)
-				if err != nil {
-					return "", fmt.Errorf("cluster detection failed: %v", err)
-				}
-				result := fmt.Sprintf(`Cluster Available via GLOBAL_KUBECONFIG
+				return clusterDetected(ctx, detectionSourceGlobal, globalKubeconfig)
+			}
+		}
+	}
+
+	// No working cluster found
+	logMessage(LogWarning, "cluster-detection", "No accessible cluster found")
+	return &ClusterDetection{Found: false}, nil
+}
+
+// clusterDetected describes the accessible cluster found through source,
+// kubeconfig is empty for in-cluster authentication
+func clusterDetected(ctx context.Context, source, kubeconfig string) (*ClusterDetection, error) {
+	clusterType, docsPath, err := detectClusterType(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("cluster detection failed: %v", err)
+	}
+
+	detection := &ClusterDetection{
+		Found:           true,
+		Source:          source,
+		Kubeconfig:      kubeconfig,
+		AuthMode:        detectAuthMode(ctx, kubeconfig),
+		ClusterType:     clusterType,
+		KubeVirtVersion: detectKubeVirtVersion(ctx, kubeconfig),
+		DocsFolder:      docsPath,
+		DocsResources:   docsResourcesURI(docsPath),
+		VerificationCommands: []string{
+			"kubectl get nodes",
+			"kubectl get kubevirt -n kubevirt",
+		},
+	}
+	if kubeconfig != "" {
+		detection.SetupCommands = append(detection.SetupCommands, "export KUBECONFIG="+kubeconfig)
+	}
+	if source == detectionSourceKubevirtci {
+		detection.Provider = kubevirtciProvider(kubeconfig)
+		detection.SetupCommands = append(detection.SetupCommands, "export KUBEVIRT_PROVIDER="+detection.Provider)
+	}
+	detection.SetupCommands = append(detection.SetupCommands,
+		"export CLUSTER_TYPE="+clusterType,
+		"export DOCS_FOLDER="+docsPath,
+	)
+	return detection, nil
+}
 
-Setup Commands:
-   export KUBECONFIG=%s
-   export CLUSTER_TYPE=%s
-   export DOCS_FOLDER=%s
+// registeredClusterDetected describes a cluster of the registry, using its
+// configured type and docs folder instead of detecting them
+func registeredClusterDetected(ctx context.Context, cluster clusterTarget) (*ClusterDetection, error) {
+	logMessage(LogInfo, "cluster-detection", "Trying registered cluster %s", cluster.Name)
+	reportProgress(ctx, "Trying registered cluster %s", cluster.Name)
+	if info := testContextConnectivity(cluster.Kubeconfig, cluster.Context); !info.Found {
+		logMessage(LogWarning, "cluster-detection", "Registered cluster %s is not accessible", cluster.Name)
+		return &ClusterDetection{Found: false}, nil
+	}
 
-Verification:
-   kubectl get nodes
-   kubectl get kubevirt -n kubevirt
+	clusterType, docsPath := cluster.Type, cluster.Docs
+	if clusterType == "" {
+		detected, detectedDocs, err := detectClusterType(cluster.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("cluster detection failed: %v", err)
+		}
+		clusterType = detected
+		if docsPath == "" {
+			docsPath = detectedDocs
+		}
+	} else if docsPath == "" {
+		docsPath = clusterTypeDocs(clusterType)
+	}
+
+	detection := &ClusterDetection{
+		Found:           true,
+		Source:          detectionSourceRegistry,
+		Kubeconfig:      cluster.Kubeconfig,
+		AuthMode:        detectAuthMode(ctx, cluster.Kubeconfig),
+		ClusterType:     clusterType,
+		KubeVirtVersion: detectKubeVirtVersion(ctx, cluster.Kubeconfig),
+		DocsFolder:      docsPath,
+		DocsResources:   docsResourcesURI(docsPath),
+		SetupCommands:   []string{"export KUBECONFIG=" + cluster.Kubeconfig},
+		VerificationCommands: []string{
+			"kubectl get nodes",
+			"kubectl get kubevirt -n kubevirt",
+		},
+	}
+	if cluster.Context != "" {
+		detection.SetupCommands = append(detection.SetupCommands, "kubectl config use-context "+cluster.Context)
+	}
+	if clusterType == clusterTypeKubevirtci {
+		detection.Provider = kubevirtciProvider(cluster.Kubeconfig)
+		detection.SetupCommands = append(detection.SetupCommands, "export KUBEVIRT_PROVIDER="+detection.Provider)
+	}
+	detection.SetupCommands = append(detection.SetupCommands,
+		"export CLUSTER_TYPE="+clusterType,
+		"export DOCS_FOLDER="+docsPath,
+	)
+	return detection, nil
+}
+
+// clusterTypeDocs returns the docs folder of config.json for a cluster type,
+// kubevirtci clusters use the Kubernetes docs
+func clusterTypeDocs(clusterType string) string {
+	config, err := loadConfig()
+	if err != nil {
+		return ""
+	}
+	if clusterType == clusterTypeOpenShift {
+		return config.Docs.OpenShift
+	}
+	return config.Docs.Kubernetes
+}
 
-Ready to use %s cluster!`, globalKubeconfig, clusterType, docsPath, clusterType)
-				return result, nil
+// validateClusters checks the kubeconfig, context, docs folder and
+// connectivity of the registered clusters in parallel. Clusters that cannot be reached stay
+// registered, since they may come up later, but are reported as unreachable.
+func validateClusters(registry map[string]clusterTarget) map[string]clusterTarget {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, cluster := range registry {
+		wg.Add(1)
+		go func(name string, cluster clusterTarget) {
+			defer wg.Done()
+			if cluster.Docs != "" {
+				if _, err := os.Stat(cluster.Docs); err != nil {
+					logMessage(LogWarning, "clusters", "Registered cluster %s: using the default docs folder, %v", name, err)
+					cluster.Docs = ""
+				}
 			}
+			cluster.Problem = clusterProblem(cluster)
+			cluster.Reachable = cluster.Problem == ""
+			if cluster.Reachable {
+				logMessage(LogInfo, "clusters", "Registered cluster %s is reachable", name)
+			} else {
+				logMessage(LogWarning, "clusters", "Registered cluster %s: %s", name, cluster.Problem)
+			}
+			mu.Lock()
+			registry[name] = cluster
+			mu.Unlock()
+		}(name, cluster)
+	}
+	wg.Wait()
+	return registry
+}
+
+// clusterProblem returns why a registered cluster cannot be used, empty
+// when it is reachable
+func clusterProblem(cluster clusterTarget) string {
+	if _, err := os.Stat(cluster.Kubeconfig); err != nil {
+		return fmt.Sprintf("kubeconfig %s: %v", cluster.Kubeconfig, err)
+	}
+	if cluster.Context != "" {
+		contexts, err := kubeconfigContexts(cluster.Kubeconfig)
+		if err != nil {
+			return err.Error()
 		}
+		if !containsString(contexts, cluster.Context) {
+			return fmt.Sprintf("context '%s' not found in %s", cluster.Context, cluster.Kubeconfig)
+		}
+	}
+	if info := testContextConnectivity(cluster.Kubeconfig, cluster.Context); !info.Found {
+		return info.Message
 	}
+	return ""
+}
 
-	// No working cluster found
-	return "No accessible cluster found using any configured kubeconfig source", nil
+// detectKubeVirtVersion returns the KubeVirt version observed by the KubeVirt
+// CR, empty when it cannot be read
+func detectKubeVirtVersion(ctx context.Context, kubeconfig string) string {
+	ctx, cancel := clock.WithTimeout(ctx, timeoutFor(timeoutDetection))
+	defer cancel()
+
+	args := []string{"get", "kubevirt", "-A", "-o", "jsonpath={.items[0].status.observedKubeVirtVersion}"}
+	if kubeconfig != "" {
+		args = append(args, "--kubeconfig", kubeconfig)
+	}
+	output, err := commandOutput(ctx, exec.CommandContext(ctx, "kubectl", args...), false)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// detectAuthMode returns how the current user of a kubeconfig authenticates
+func detectAuthMode(ctx context.Context, kubeconfig string) string {
+	if kubeconfig == "" {
+		return "serviceaccount"
+	}
+
+	ctx, cancel := clock.WithTimeout(ctx, timeoutFor(timeoutDetection))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "kubectl", "config", "view", "--minify", "-o", "json", "--kubeconfig", kubeconfig)
+	output, err := commandOutput(ctx, cmd, false)
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		Users []struct {
+			User map[string]interface{} `json:"user"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(output, &config); err != nil || len(config.Users) == 0 {
+		return ""
+	}
+
+	user := config.Users[0].User
+	for _, mode := range []struct{ key, name string }{
+		{"exec", "exec"},
+		{"auth-provider", "auth-provider"},
+		{"token", "token"},
+		{"tokenFile", "token"},
+		{"client-certificate-data", "client-certificate"},
+		{"client-certificate", "client-certificate"},
+		{"username", "basic"},
+	} {
+		if _, ok := user[mode.key]; ok {
+			return mode.name
+		}
+	}
+	return "none"
+}
+
+// text renders the detection for humans
+func (d *ClusterDetection) text() string {
+	if !d.Found {
+		return "No accessible cluster found using any configured kubeconfig source"
+	}
+
+	var b strings.Builder
+	switch d.Source {
+	case detectionSourceKubeconfigEnv:
+		b.WriteString("Cluster Available via KUBECONFIG environment variable\n\n")
+	case detectionSourceKubevirtci:
+		fmt.Fprintf(&b, "Cluster Available via kubevirtci (%s)\n\n", d.Provider)
+		b.WriteString("The MCP tools use this cluster from now on, no export needed.\n\n")
+	case detectionSourceInCluster:
+		b.WriteString("Cluster Available via in-cluster authentication\n\n")
+	default:
+		fmt.Fprintf(&b, "Cluster Available via %s\n\n", d.Source)
+	}
+
+	if d.KubeVirtVersion != "" {
+		fmt.Fprintf(&b, "KubeVirt version: %s\n\n", d.KubeVirtVersion)
+	}
+
+	if d.Source == detectionSourceInCluster {
+		b.WriteString("Environment: Running inside Kubernetes pod\n")
+		b.WriteString("   Service account authentication active\n")
+		b.WriteString("   No kubeconfig configuration needed\n")
+	} else {
+		b.WriteString("Setup Commands:\n")
+	}
+	for _, command := range d.SetupCommands {
+		b.WriteString("   " + command + "\n")
+	}
+
+	b.WriteString("\nVerification:\n")
+	for _, command := range d.VerificationCommands {
+		b.WriteString("   " + command + "\n")
+	}
+
+	fmt.Fprintf(&b, "\nReady to use %s cluster!", d.ClusterType)
+	return b.String()
 }
 
 // testInClusterConnectivity tests cluster connectivity using in-cluster authentication
@@ -191,18 +532,19 @@ func testInClusterConnectivity() ClusterInfo {
 	}
 
 	// Test kubectl connectivity without kubeconfig (uses in-cluster auth) with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := clock.WithTimeout(context.Background(), timeoutFor(timeoutDetection))
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "kubectl", "get", "pods")
-	output, err := cmd.CombinedOutput()
+	output, err := commandOutput(ctx, cmd, true)
 
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			info.Message = "kubectl in-cluster connectivity test timed out after 5 seconds"
+			info.Message = fmt.Sprintf("kubectl in-cluster connectivity test timed out after %v", timeoutFor(timeoutDetection))
 		} else {
 			info.Message = fmt.Sprintf("kubectl in-cluster connectivity test failed: %v\nOutput: %s", err, string(output))
 		}
+		logMessage(LogInfo, "cluster-detection", "%s: %s", info.Kubeconfig, info.Message)
 		return info
 	}
 
@@ -213,24 +555,35 @@ func testInClusterConnectivity() ClusterInfo {
 }
 
 func testClusterConnectivity(kubeconfigPath string) ClusterInfo {
+	return testContextConnectivity(kubeconfigPath, "")
+}
+
+// testContextConnectivity tests cluster connectivity using a context of a
+// kubeconfig, its current context when kubeContext is empty
+func testContextConnectivity(kubeconfigPath, kubeContext string) ClusterInfo {
 	info := ClusterInfo{
 		Found:      false,
 		Kubeconfig: kubeconfigPath,
 	}
 
 	// Test kubectl connectivity with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := clock.WithTimeout(context.Background(), timeoutFor(timeoutDetection))
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "kubectl", "cluster-info", "--kubeconfig", kubeconfigPath)
-	output, err := cmd.CombinedOutput()
+	args := []string{"cluster-info", "--kubeconfig", kubeconfigPath}
+	if kubeContext != "" {
+		args = append(args, "--context", kubeContext)
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	output, err := commandOutput(ctx, cmd, true)
 
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
-			info.Message = "kubectl connectivity test timed out after 5 seconds"
+			info.Message = fmt.Sprintf("kubectl connectivity test timed out after %v", timeoutFor(timeoutDetection))
 		} else {
 			info.Message = fmt.Sprintf("kubectl connectivity test failed: %v\nOutput: %s", err, string(output))
 		}
+		logMessage(LogInfo, "cluster-detection", "%s: %s", info.Kubeconfig, info.Message)
 		return info
 	}
 
@@ -240,35 +593,135 @@ func testClusterConnectivity(kubeconfigPath string) ClusterInfo {
 	return info
 }
 
+// envNameRegex matches the environment variable names vm_exec accepts
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 // VMExecParams represents the parameters for VM command execution
 type VMExecParams struct {
-	Namespace string `json:"namespace"`
-	VMName    string `json:"vm_name"`
-	Command   string `json:"command"`
-	Timeout   int    `json:"timeout,omitempty"`
-	Verbose   bool   `json:"verbose,omitempty"`
+	Namespace string   `json:"namespace"`
+	VMName    string   `json:"vm_name"`
+	Command   string   `json:"command"`
+	Commands  []string `json:"commands,omitempty"`
+	Timeout   int      `json:"timeout,omitempty"`
+	Verbose   bool     `json:"verbose,omitempty"`
+	Method    string   `json:"method,omitempty"`
+	Shell     string   `json:"shell,omitempty"`
+
+	NormalizeLocale bool `json:"normalize_locale,omitempty"`
+	SeparateStderr  bool `json:"separate_stderr,omitempty"`
+
+	Env   map[string]string `json:"env,omitempty"`
+	Cwd   string            `json:"cwd,omitempty"`
+	RunAs string            `json:"run_as,omitempty"`
+
+	// MaxOutput, OutputFile and Continue page the output of vm_exec, see
+	// limitVMExecOutput. They are not passed to vm-exec.
+	MaxOutput  int    `json:"max_output,omitempty"`
+	OutputFile bool   `json:"output_file,omitempty"`
+	Continue   string `json:"continue,omitempty"`
+
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
 }
 
-// executeVMCommand executes a command on a KubeVirt VM using the vm-exec tool
-func executeVMCommand(params VMExecParams) (string, error) {
-	// Find vm-exec binary path
-	vmExecPath, err := findVMExecBinary()
+// VMExecResult is the vm-exec --output json result of a command
+type VMExecResult struct {
+	Command    string `json:"command,omitempty"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr,omitempty"`
+	ExitCode   int    `json:"exit_code"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	VMType     string `json:"vm_type"`
+
+	// Set by limitVMExecOutput when vm_exec cut the output or kept it
+	StdoutBytes    int    `json:"stdout_bytes,omitempty"`
+	StderrBytes    int    `json:"stderr_bytes,omitempty"`
+	Continue       string `json:"continue,omitempty"`
+	StderrContinue string `json:"stderr_continue,omitempty"`
+	OutputFile     string `json:"output_file,omitempty"`
+	StderrFile     string `json:"stderr_file,omitempty"`
+}
+
+// executeVMCommand executes a command on a KubeVirt VM using the vm-exec tool.
+// It returns the vm-exec JSON document, so the exit code of the command is
+// reported instead of being scraped from the output.
+func executeVMCommand(ctx context.Context, params VMExecParams) (string, error) {
+	ctx, span := startSpan(ctx, "vm-exec", spanKindClient)
+	span.setAttribute("k8s.namespace.name", params.Namespace)
+	span.setAttribute("kubevirt.vm.name", params.VMName)
+	if params.Method != "" {
+		span.setAttribute("vm_exec.method", params.Method)
+	}
+	commands := len(params.Commands)
+	if params.Command != "" {
+		commands++
+	}
+	span.setAttribute("vm_exec.commands", commands)
+
+	var output string
+	var err error
+	if sessionPoolEnabled(params) {
+		span.setAttribute("vm_exec.pooled", true)
+		output, err = vmExecSessions.execute(ctx, params)
+	} else {
+		output, err = runVMCommand(ctx, params)
+	}
+	if code := resultExitCode(output); code != nil {
+		span.setAttribute("vm_exec.exit_code", *code)
+	}
+	span.end(err)
+	return output, err
+}
+
+// runVMCommand executes the commands in a new vm-exec, see executeVMCommand
+func runVMCommand(ctx context.Context, params VMExecParams) (string, error) {
+	args, env, err := vmExecArgs(params)
+	if err != nil {
+		return "", err
+	}
+	if params.Command != "" {
+		args = append(args, "-c", params.Command)
+	}
+	for _, command := range params.Commands {
+		args = append(args, "-c", command)
+	}
+	args = append(args, "--output", "json")
+
+	steps := len(params.Commands)
+	if params.Command != "" {
+		steps++
+	}
+	_, stdout, err := runVMExecOutput(ctx, vmExecDeadline(params.Timeout, steps), args, env)
+	return stdout, err
+}
+
+// runGuestCommand executes a single command on a VM, failing when the
+// command exits non-zero
+func runGuestCommand(ctx context.Context, params VMExecParams) (*VMExecResult, error) {
+	output, err := executeVMCommand(ctx, params)
 	if err != nil {
-		return "", fmt.Errorf("vm-exec binary not found: %v", err)
+		return nil, err
 	}
 
+	var result VMExecResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse vm-exec output: %v", err)
+	}
+	if result.ExitCode != 0 {
+		return nil, fmt.Errorf("command exited with code %d: %s", result.ExitCode, result.Stdout+result.Stderr)
+	}
+	return &result, nil
+}
+
+// vmExecArgs returns the vm-exec arguments and environment selecting the VM,
+// the execution method and the console credentials
+func vmExecArgs(params VMExecParams) ([]string, []string, error) {
 	// Build command arguments
 	args := []string{
 		"-n", params.Namespace,
 		"-v", params.VMName,
-		"-c", params.Command,
-	}
-
-	// Add kubeconfig only if we have one available
-	kubeconfigPath := findKubeconfigPath()
-	// If no kubeconfig, kubectl will automatically try in-cluster authentication
-	if kubeconfigPath != "" {
-		args = append([]string{"--kubeconfig", kubeconfigPath}, args...)
 	}
 
 	// Add optional parameters
@@ -278,30 +731,174 @@ func executeVMCommand(params VMExecParams) (string, error) {
 	if params.Verbose {
 		args = append(args, "--verbose")
 	}
+	if params.Method != "" {
+		args = append(args, "--method", params.Method)
+	}
+	if params.Shell != "" {
+		args = append(args, "--shell", params.Shell)
+	}
+	if params.NormalizeLocale {
+		args = append(args, "--normalize-locale")
+	}
+	if params.SeparateStderr {
+		args = append(args, "--separate-stderr")
+	}
+	for _, name := range sortedKeys(params.Env) {
+		args = append(args, "--env", name+"="+params.Env[name])
+	}
+	if params.Cwd != "" {
+		args = append(args, "--cwd", params.Cwd)
+	}
+	if params.RunAs != "" {
+		args = append(args, "--run-as", params.RunAs)
+	}
+	if limit := serverConfig.Output.CaptureLimit; limit > 0 {
+		args = append(args, "--max-output", fmt.Sprintf("%d", limit))
+	}
+	if params.Username != "" {
+		args = append(args, "--username", params.Username)
+	}
+	credentialsFile, err := credentialsFilePath(params.CredentialsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if credentialsFile != "" {
+		args = append(args, "--credentials-file", credentialsFile)
+	}
+	// SSH logs in with the key of vm_ssh_bootstrap when there is one
+	if params.Method == "" || params.Method == "auto" || params.Method == "ssh" {
+		if key, ok := lookupSSHKey(params.Namespace, params.VMName); ok {
+			args = append(args, "--ssh-key", key.PrivateKeyPath, "--ssh-user", key.User)
+		}
+	}
+
+	// Console timeouts are only passed when overridden, vm-exec has the same
+	// defaults
+	for _, override := range []struct{ flag, name string }{
+		{"--connect-timeout", timeoutConsoleConnect},
+		{"--login-timeout", timeoutConsoleLogin},
+		{"--prompt-timeout", timeoutConsolePrompt},
+	} {
+		if d, ok := serverConfig.Timeouts[override.name]; ok {
+			args = append(args, override.flag, d.String())
+		}
+	}
+	if retries := serverConfig.Console.Retries; retries != defaultConsoleRetries {
+		args = append(args, "--console-retries", fmt.Sprintf("%d", retries))
+	}
+	if backoff := serverConfig.Console.RetryBackoff; backoff != defaultConsoleRetryBackoff {
+		args = append(args, "--retry-backoff", backoff.String())
+	}
+
+	var env []string
+	if params.Password != "" {
+		// Pass the password through the environment to keep it out of the process list
+		env = append(env, "VM_EXEC_PASSWORD="+params.Password)
+	}
+
+	return args, env, nil
+}
+
+// runVMExec runs the vm-exec binary against the detected cluster with the
+// given arguments and extra environment variables. vm-exec gives up after
+// deadline and is killed shortly after if it does not.
+func runVMExec(ctx context.Context, deadline time.Duration, args []string, env []string) (string, error) {
+	output, _, err := runVMExecOutput(ctx, deadline, args, env)
+	return output, err
+}
+
+// runVMExecOutput runs vm-exec like runVMExec and also returns its stdout
+// alone, which holds the JSON document with --output json
+func runVMExecOutput(ctx context.Context, deadline time.Duration, args []string, env []string) (string, string, error) {
+	// Select the cluster of the tool call; without a kubeconfig vm-exec
+	// falls back to in-cluster authentication
+	args = append(kubeconfigArgs(ctx), args...)
+	args = append(args, "--deadline", deadline.String())
+
+	output, stdout, err := recorded(ctx, "vm-exec", args, nil, func() (string, string, error) {
+		return execVMExec(ctx, deadline, args, env)
+	})
+	observeVMExecError(err)
+	return output, stdout, err
+}
+
+// execVMExec runs the vm-exec binary, see runVMExecOutput
+func execVMExec(ctx context.Context, deadline time.Duration, args []string, env []string) (string, string, error) {
+	// The hard timeout is independent of the caller's context, a hanging
+	// console must not hold the tool call forever
+	callCtx := ctx
+	ctx, cancel := clock.WithTimeout(ctx, deadline+vmExecKillGrace)
+	defer cancel()
+
+	// Find vm-exec binary path
+	vmExecPath, err := findVMExecBinary()
+	if err != nil {
+		return "", "", fmt.Errorf("vm-exec binary not found: %v", err)
+	}
 
 	// Execute vm-exec command
-	cmd := exec.Command(vmExecPath, args...)
-	output, err := cmd.CombinedOutput()
+	logMessage(LogDebug, "vm-exec", "%s %s", vmExecPath, strings.Join(args, " "))
+	// Cancelling ctx kills vm-exec, which closes its console stream
+	cmd := exec.CommandContext(ctx, vmExecPath, args...)
+	// Do not wait for processes that inherited the output pipes after the kill
+	cmd.WaitDelay = time.Second
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 
+	// vm-exec reports its phases on stderr when asked to, forward them as
+	// progress notifications and keep the rest of the output
+	output := &lockedBuffer{}
+	stdout := &lockedBuffer{}
+	cmd.Stdout = io.MultiWriter(stdout, output)
+	// The phases are always asked for, they time the connection
+	progress := &vmExecProgressWriter{output: output, span: spanFromContext(ctx)}
+	if progressEnabled(ctx) {
+		progress.ctx = ctx
+	}
+	cmd.Args = append(cmd.Args, "--progress")
+	cmd.Stderr = progress
+	err = cmd.Run()
+	progress.flush()
+	progress.endPhase(err)
+
+	if callCtx.Err() != nil {
+		return "", "", fmt.Errorf("vm-exec cancelled")
+	}
+	if ctx.Err() != nil {
+		logMessage(LogWarning, "vm-exec", "vm-exec did not finish within %v and was killed", deadline+vmExecKillGrace)
+		return "", "", fmt.Errorf("vm-exec did not finish within %v and was killed\nOutput: %s", deadline+vmExecKillGrace, output.String())
+	}
 	if err != nil {
-		return "", fmt.Errorf("vm-exec failed: %v\nOutput: %s", err, string(output))
+		logMessage(LogWarning, "vm-exec", "vm-exec failed: %v", err)
+		return "", "", fmt.Errorf("vm-exec failed: %v\nOutput: %s%s", err, output.String(), pausedHint(output.String()))
 	}
 
-	return string(output), nil
+	return output.String(), stdout.String(), nil
 }
 
 // findKubeconfigPath finds the kubeconfig file path using the same logic as detectKubevirtciCluster
 func findKubeconfigPath() string {
 	// First, check if KUBECONFIG environment variable is set
-	existingKubeconfig := os.Getenv("KUBECONFIG")
+	existingKubeconfig := expandHome(serverConfig.Detection.Kubeconfig)
 	if existingKubeconfig != "" {
 		if _, err := os.Stat(existingKubeconfig); err == nil {
 			return existingKubeconfig
 		}
 	}
 
+	// Then the kubeconfig written by cluster_login
+	if loginKubeconfig, ok := credentialFile(loginKubeconfigPath()); ok {
+		return loginKubeconfig
+	}
+
+	// Then the kubevirtci cluster found by detect_kubevirtci_cluster
+	if kubevirtciKubeconfig := detectedKubevirtci(); kubevirtciKubeconfig != "" {
+		return kubevirtciKubeconfig
+	}
+
 	// Second, check GLOBAL_KUBECONFIG
-	globalKubeconfig := os.Getenv("GLOBAL_KUBECONFIG")
+	globalKubeconfig := expandHome(serverConfig.Detection.GlobalKubeconfig)
 	if globalKubeconfig != "" {
 		if _, err := os.Stat(globalKubeconfig); err == nil {
 			return globalKubeconfig
@@ -317,11 +914,38 @@ func findKubeconfigPath() string {
 		}
 	}
 
+	// Last, a kubevirtci cluster that was not detected yet
+	if found := kubevirtciKubeconfigs(); len(found) > 0 {
+		return found[0]
+	}
+
 	return ""
 }
 
-// findVMExecBinary locates the vm-exec binary
+// vmExecPathEnv sets the vm-exec binary, like vmExecPath in the
+// configuration file and the --vm-exec flag
+const vmExecPathEnv = "KUBEVIRT_MCP_VM_EXEC"
+
+// Environment variables configuring the console retries of vm-exec, see
+// ConsoleConfig. The defaults are the ones of vm-exec, the settings are only
+// passed to it when they differ.
+const (
+	consoleRetriesEnv      = "KUBEVIRT_MCP_CONSOLE_RETRIES"
+	consoleRetryBackoffEnv = "KUBEVIRT_MCP_CONSOLE_RETRY_BACKOFF"
+
+	defaultConsoleRetries      = 2
+	defaultConsoleRetryBackoff = 2 * time.Second
+)
+
+// findVMExecBinary locates the vm-exec binary, by default next to the server
 func findVMExecBinary() (string, error) {
+	if path := serverConfig.VMExecPath; path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+
 	// Get the current executable directory
 	execPath, err := os.Executable()
 	if err != nil {
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// objectYAML returns the object as YAML without the fields that change on
+// every write (managedFields, resourceVersion, generation) and without
+// status, so the diff only shows what the mutation changed. It returns an
+// empty string when the object does not exist.
+func objectYAML(ctx context.Context, resource, name, namespace string) string {
+	args := []string{"get", resource, name, "--ignore-not-found", "-o", "json"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	output, err := runKubectl(ctx, args...)
+	if err != nil || len(strings.TrimSpace(string(output))) == 0 {
+		return ""
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(output, &obj); err != nil {
+		return ""
+	}
+	return cleanObjectYAML(obj)
+}
+
+// cleanObjectYAML renders obj as YAML without status and the metadata
+// fields that change on every write
+func cleanObjectYAML(obj map[string]interface{}) string {
+	delete(obj, "status")
+	if metadata, ok := obj["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "managedFields")
+		delete(metadata, "resourceVersion")
+		delete(metadata, "generation")
+	}
+
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// mutationDiff snapshots the object before and after mutate and returns the
+// unified diff of the two. The diff is best effort: when the object cannot be
+// read the diff is empty, only an error of mutate is returned.
+func mutationDiff(ctx context.Context, resource, name, namespace string, mutate func() error) (string, error) {
+	before := objectYAML(ctx, resource, name, namespace)
+	if err := mutate(); err != nil {
+		return "", err
+	}
+	after := objectYAML(ctx, resource, name, namespace)
+
+	label := resource + "/" + name
+	if namespace != "" {
+		label = namespace + "/" + label
+	}
+	return unifiedDiff("a/"+label, "b/"+label, before, after), nil
+}
+
+// unifiedDiff renders the line diff of two texts in the unified format, or an
+// empty string when their lines are equal
+func unifiedDiff(fromName, toName, from, to string) string {
+	if from == to {
+		return ""
+	}
+	a, b := splitLines(from), splitLines(to)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk the table into an edit script of ' ', '-' and '+' lines
+	type edit struct {
+		op           byte
+		line         string
+		aLine, bLine int
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	for start := 0; start < len(edits); {
+		// Find the next change and extend the hunk while changes are close
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		first := max(start-diffContext, 0)
+		last := start
+		for k := start; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				last = k
+			} else if k-last > 2*diffContext {
+				break
+			}
+		}
+		end := min(last+diffContext+1, len(edits))
+
+		aCount, bCount := 0, 0
+		for _, e := range edits[first:end] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(edits[first].aLine, aCount), hunkRange(edits[first].bLine, bCount))
+		for _, e := range edits[first:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+		start = end
+	}
+	if out.Len() == 0 {
+		return ""
+	}
+	return fmt.Sprintf("--- %s\n+++ %s\n", fromName, toName) + out.String()
+}
+
+// hunkRange renders the start,count of a hunk header. Lines are 1-based and an
+// empty range refers to the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits text into lines without their line endings
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
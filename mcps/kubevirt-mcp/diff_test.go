@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	// numbers returns the lines 1 to 10, with the given lines replaced
+	numbers := func(replace map[int]string) string {
+		var b strings.Builder
+		for i := 1; i <= 10; i++ {
+			if line, ok := replace[i]; ok {
+				b.WriteString(line + "\n")
+			} else {
+				b.WriteString(strconv.Itoa(i) + "\n")
+			}
+		}
+		return b.String()
+	}
+	ten := numbers(nil)
+	const header = "--- a/vm\n+++ b/vm\n"
+	tests := []struct {
+		name     string
+		from, to string
+		want     string
+	}{
+		{"equal", ten, ten, ""},
+		{"missing final line ending", "a\nb", "a\nb\n", ""},
+		{
+			"change with context", ten, numbers(map[int]string{5: "five"}),
+			header + "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"changes far apart", ten, numbers(map[int]string{1: "one", 10: "ten"}),
+			header + "@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			"changes 6 lines apart share a hunk", ten, numbers(map[int]string{1: "one", 8: "eight"}),
+			header + "@@ -1,10 +1,10 @@\n-1\n+one\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n 9\n 10\n",
+		},
+		{
+			"changes 7 lines apart", ten, numbers(map[int]string{1: "one", 9: "nine"}),
+			header + "@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -6,5 +6,5 @@\n 6\n 7\n 8\n-9\n+nine\n 10\n",
+		},
+		{
+			"insertion", ten, strings.Replace(ten, "5\n", "5\nx\n", 1),
+			header + "@@ -3,6 +3,7 @@\n 3\n 4\n 5\n+x\n 6\n 7\n 8\n",
+		},
+		{"append", "a\nb\n", "a\nb\nc\n", header + "@@ -1,2 +1,3 @@\n a\n b\n+c\n"},
+		{"created", "", "a\nb\n", header + "@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"deleted", "a\nb\n", "", header + "@@ -1,2 +0,0 @@\n-a\n-b\n"},
+		{"replaced", "a\n", "b\n", header + "@@ -1,1 +1,1 @@\n-a\n+b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("a/vm", "b/vm", tt.from, tt.to); got != tt.want {
+				t.Fatalf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variables configuring where vm_dns publishes the hostnames,
+// see DNSConfig
+const (
+	dnsProviderEnv = "KUBEVIRT_MCP_DNS_PROVIDER"
+	dnsZoneEnv     = "KUBEVIRT_MCP_DNS_ZONE"
+	dnsAPIURLEnv   = "KUBEVIRT_MCP_DNS_API_URL"
+	dnsServerIDEnv = "KUBEVIRT_MCP_DNS_SERVER_ID"
+	// dnsAPIKeyEnv holds the key of the PowerDNS API. It is only read from
+	// the environment so the key does not end up in a file or the process
+	// arguments.
+	dnsAPIKeyEnv = "KUBEVIRT_MCP_DNS_API_KEY"
+
+	dnsProviderExternalDNS = "external-dns"
+	dnsProviderPowerDNS    = "powerdns"
+
+	defaultDNSServerID = "localhost"
+	defaultDNSTTL      = 300
+
+	// The annotations external-dns reads the records of a Service from
+	externalDNSHostnameAnnotation = "external-dns.alpha.kubernetes.io/hostname"
+	externalDNSTTLAnnotation      = "external-dns.alpha.kubernetes.io/ttl"
+)
+
+// dnsNameRegex matches the hostnames vm_dns publishes, lower case labels
+// separated by dots
+var dnsNameRegex = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?\.)*[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// VMDNSParams represents the parameters of the vm_dns tool
+type VMDNSParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Hostname  string `json:"hostname,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Expose    []int  `json:"expose,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+	Remove    bool   `json:"remove,omitempty"`
+}
+
+// DNSRecord is a record vm_dns wrote to the DNS provider
+type DNSRecord struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl,omitempty"`
+	Content []string `json:"content,omitempty"`
+}
+
+// VMDNSResult is the vm_dns tool result
+type VMDNSResult struct {
+	VM             string     `json:"vm"`
+	Hostname       string     `json:"hostname"`
+	Provider       string     `json:"provider"`
+	Action         string     `json:"action"`
+	Service        string     `json:"service"`
+	ServiceType    string     `json:"serviceType"`
+	ServiceCreated bool       `json:"serviceCreated,omitempty"`
+	Addresses      []string   `json:"addresses,omitempty"`
+	Record         *DNSRecord `json:"record,omitempty"`
+	Diff           string     `json:"diff,omitempty"`
+	Note           string     `json:"note,omitempty"`
+}
+
+// exposedService is a Service with the fields telling how it is reached
+// from outside the cluster
+type exposedService struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Type     string            `json:"type"`
+		Selector map[string]string `json:"selector,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP       string `json:"ip,omitempty"`
+				Hostname string `json:"hostname,omitempty"`
+			} `json:"ingress,omitempty"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_dns",
+		Description: "Publish the hostname of a VM on the LoadBalancer or NodePort Service exposing it, so the VM is reachable by name from outside the cluster. The external-dns provider annotates the Service for external-dns, the powerdns provider writes the record through the PowerDNS API set in the dns configuration. With expose a LoadBalancer Service is created first when none exposes the VM, with remove the hostname is withdrawn",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"hostname": map[string]interface{}{
+					"type":        "string",
+					"description": "Fully qualified hostname of the VM (default: <vm_name>.<namespace>.<zone> with the zone of the dns configuration); the powerdns provider only writes the default name",
+				},
+				"service": map[string]interface{}{
+					"type":        "string",
+					"description": "Service carrying the hostname, needed when several LoadBalancer or NodePort Services expose the VM",
+				},
+				"expose": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "integer"},
+					"description": "TCP ports of a LoadBalancer Service created when none exposes the VM, e.g. [22, 80]",
+				},
+				"ttl": map[string]interface{}{
+					"type":        "integer",
+					"description": "TTL of the record in seconds (default: 300)",
+				},
+				"remove": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Withdraw the hostname instead of publishing it",
+					"default":     false,
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMDNS,
+	})
+}
+
+// handleVMDNS is the tools/call handler for vm_dns
+func handleVMDNS(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMDNSParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.TTL < 0 {
+		return "", &invalidParamsError{err: errors.New("ttl must not be negative")}
+	}
+	if params.TTL == 0 {
+		params.TTL = defaultDNSTTL
+	}
+	for _, port := range params.Expose {
+		if port < 1 || port > 65535 {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid port %d in expose", port)}
+		}
+	}
+
+	zone := strings.TrimSuffix(strings.ToLower(serverConfig.DNS.Zone), ".")
+	hostname := strings.TrimSuffix(strings.ToLower(params.Hostname), ".")
+	if hostname == "" {
+		if zone == "" {
+			return "", &invalidParamsError{err: errors.New("hostname is required when the dns configuration sets no zone")}
+		}
+		hostname = params.VMName + "." + params.Namespace + "." + zone
+	}
+	if !dnsNameRegex.MatchString(hostname) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid hostname '%s'", params.Hostname)}
+	}
+	params.Hostname = hostname
+
+	provider := serverConfig.DNS.Provider
+	switch provider {
+	case "", dnsProviderExternalDNS:
+		provider = dnsProviderExternalDNS
+	case dnsProviderPowerDNS:
+		if serverConfig.DNS.APIURL == "" || zone == "" {
+			return "", fmt.Errorf("the powerdns provider needs the apiURL and zone of the dns configuration")
+		}
+		// Records are replaced and deleted whole, so only the names the
+		// server owns are written, never the apex or records of other
+		// applications in the zone
+		if owned := params.VMName + "." + params.Namespace + "." + zone; hostname != owned {
+			return "", &invalidParamsError{err: fmt.Errorf("the powerdns provider only writes the <vm_name>.<namespace>.<zone> names of VMs, %s, leave hostname unset", owned)}
+		}
+	default:
+		return "", fmt.Errorf("unknown DNS provider '%s', use %s or %s", provider, dnsProviderExternalDNS, dnsProviderPowerDNS)
+	}
+
+	result, err := publishVMHostname(ctx, params, provider)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// publishVMHostname finds or creates the Service exposing the VM and
+// publishes or withdraws its hostname with the provider
+func publishVMHostname(ctx context.Context, params VMDNSParams, provider string) (*VMDNSResult, error) {
+	var vm VirtualMachine
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+
+	svc, err := vmExternalService(ctx, vm, params)
+	if err != nil {
+		return nil, err
+	}
+	result := &VMDNSResult{
+		VM:       params.VMName,
+		Hostname: params.Hostname,
+		Provider: provider,
+		Action:   "published",
+	}
+	if params.Remove {
+		result.Action = "removed"
+	}
+	if svc == nil {
+		if params.Remove || len(params.Expose) == 0 {
+			return nil, fmt.Errorf("no LoadBalancer or NodePort Service exposes VM '%s', pass expose with the ports of one to create", params.VMName)
+		}
+		if svc, err = createVMLoadBalancer(ctx, params); err != nil {
+			return nil, err
+		}
+		result.ServiceCreated = true
+	}
+	result.Service, result.ServiceType = svc.Metadata.Name, svc.Spec.Type
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			result.Addresses = append(result.Addresses, ingress.IP)
+		} else if ingress.Hostname != "" {
+			result.Addresses = append(result.Addresses, ingress.Hostname)
+		}
+	}
+
+	if provider == dnsProviderPowerDNS {
+		if err := publishPowerDNSRecord(ctx, params, svc, result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	result.Diff, err = annotateExternalDNS(ctx, params, svc)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case params.Remove:
+		result.Note = "external-dns deletes the record on its next sync if its policy allows deletions"
+	case svc.Spec.Type == "LoadBalancer" && len(result.Addresses) == 0:
+		result.Note = "the load balancer has no address yet, external-dns publishes the record once it has one"
+	default:
+		result.Note = "external-dns publishes the record on its next sync"
+	}
+	return result, nil
+}
+
+// vmExternalService returns the LoadBalancer or NodePort Service selecting
+// the pods of the VM, the one named by service when it is set, or nil when
+// there is none
+func vmExternalService(ctx context.Context, vm VirtualMachine, params VMDNSParams) (*exposedService, error) {
+	// Services select the virt-launcher pod, which carries the VM template
+	// labels and the name of the VM
+	podLabels := map[string]string{launcherVMNameLabel: params.VMName}
+	for key, value := range vm.Spec.Template.Metadata.Labels {
+		podLabels[key] = value
+	}
+
+	if params.Service != "" {
+		var svc exposedService
+		found, err := getOptionalObject(ctx, &svc, "service", params.Service, params.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("service '%s' not found in namespace '%s'", params.Service, params.Namespace)
+		}
+		if !selectsLabels(svc.Spec.Selector, podLabels) {
+			return nil, fmt.Errorf("service '%s' does not select the pods of VM '%s'", params.Service, params.VMName)
+		}
+		if svc.Spec.Type != "LoadBalancer" && svc.Spec.Type != "NodePort" {
+			return nil, fmt.Errorf("service '%s' is of type %s, only LoadBalancer and NodePort Services are reachable from outside the cluster", params.Service, svc.Spec.Type)
+		}
+		return &svc, nil
+	}
+
+	var services struct {
+		Items []exposedService `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &services, "get", "services", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	var exposing []exposedService
+	for _, svc := range services.Items {
+		if (svc.Spec.Type == "LoadBalancer" || svc.Spec.Type == "NodePort") && selectsLabels(svc.Spec.Selector, podLabels) {
+			exposing = append(exposing, svc)
+		}
+	}
+	switch len(exposing) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &exposing[0], nil
+	}
+
+	// A hostname being withdrawn is looked for on the Services carrying it
+	var names []string
+	var carrying []*exposedService
+	for i, svc := range exposing {
+		names = append(names, svc.Metadata.Name)
+		if containsString(splitHostnames(svc.Metadata.Annotations[externalDNSHostnameAnnotation]), params.Hostname) {
+			carrying = append(carrying, &exposing[i])
+		}
+	}
+	if params.Remove && len(carrying) == 1 {
+		return carrying[0], nil
+	}
+	sort.Strings(names)
+	return nil, &invalidParamsError{err: fmt.Errorf("several Services expose VM '%s', pick one with service: %s", params.VMName, strings.Join(names, ", "))}
+}
+
+// createVMLoadBalancer creates a LoadBalancer Service exposing the ports of
+// the VM
+func createVMLoadBalancer(ctx context.Context, params VMDNSParams) (*exposedService, error) {
+	name := params.VMName + "-external"
+	var ports []interface{}
+	for _, port := range params.Expose {
+		ports = append(ports, map[string]interface{}{
+			"name":       fmt.Sprintf("tcp-%d", port),
+			"protocol":   "TCP",
+			"port":       port,
+			"targetPort": port,
+		})
+	}
+	manifest := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": params.Namespace,
+			"labels":    managedLabels("vm_dns", false),
+		},
+		"spec": map[string]interface{}{
+			"type":     "LoadBalancer",
+			"selector": map[string]string{launcherVMNameLabel: params.VMName},
+			"ports":    ports,
+		},
+	}
+	if err := createObject(ctx, manifest); err != nil {
+		return nil, fmt.Errorf("failed to create service '%s': %v", name, err)
+	}
+	var svc exposedService
+	if err := runKubectlJSON(ctx, &svc, "get", "service", name, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	return &svc, nil
+}
+
+// annotateExternalDNS adds the hostname to the external-dns annotation of
+// the Service, or takes it out with remove, keeping the other hostnames
+func annotateExternalDNS(ctx context.Context, params VMDNSParams, svc *exposedService) (string, error) {
+	hostnames := splitHostnames(svc.Metadata.Annotations[externalDNSHostnameAnnotation])
+	var kept []string
+	for _, hostname := range hostnames {
+		if hostname != params.Hostname {
+			kept = append(kept, hostname)
+		}
+	}
+	if params.Remove && len(kept) == len(hostnames) {
+		return "", fmt.Errorf("service '%s' does not carry hostname '%s'", svc.Metadata.Name, params.Hostname)
+	}
+
+	args := []string{"annotate", "service", svc.Metadata.Name, "-n", params.Namespace, "--overwrite"}
+	switch {
+	case !params.Remove:
+		args = append(args,
+			externalDNSHostnameAnnotation+"="+strings.Join(append(kept, params.Hostname), ","),
+			fmt.Sprintf("%s=%d", externalDNSTTLAnnotation, params.TTL))
+	case len(kept) == 0:
+		args = append(args, externalDNSHostnameAnnotation+"-", externalDNSTTLAnnotation+"-")
+	default:
+		args = append(args, externalDNSHostnameAnnotation+"="+strings.Join(kept, ","))
+	}
+	return mutationDiff(ctx, "service", svc.Metadata.Name, params.Namespace, func() error {
+		_, err := runKubectl(ctx, args...)
+		return err
+	})
+}
+
+// splitHostnames returns the hostnames of an external-dns annotation
+func splitHostnames(annotation string) []string {
+	var hostnames []string
+	for _, hostname := range strings.Split(annotation, ",") {
+		if hostname = strings.TrimSuffix(strings.TrimSpace(hostname), "."); hostname != "" {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames
+}
+
+// publishPowerDNSRecord replaces or deletes the record of the hostname in
+// the PowerDNS zone. The record points at the load balancer of the
+// Service: A or AAAA records for its addresses, a CNAME for its hostname.
+func publishPowerDNSRecord(ctx context.Context, params VMDNSParams, svc *exposedService, result *VMDNSResult) error {
+	record := &DNSRecord{Name: params.Hostname + ".", Type: "A", TTL: params.TTL}
+	if !params.Remove {
+		if svc.Spec.Type != "LoadBalancer" {
+			return fmt.Errorf("the powerdns provider needs a LoadBalancer Service, service '%s' is of type %s", svc.Metadata.Name, svc.Spec.Type)
+		}
+		if len(result.Addresses) == 0 {
+			return fmt.Errorf("the load balancer of service '%s' has no address yet, try again once it is provisioned", svc.Metadata.Name)
+		}
+		// The first address picks the type, a record holds one type only
+		record.Type = addressRecordType(result.Addresses[0])
+		if record.Type == "CNAME" {
+			record.Content = []string{strings.TrimSuffix(result.Addresses[0], ".") + "."}
+		}
+		for _, address := range result.Addresses {
+			if record.Type != "CNAME" && addressRecordType(address) == record.Type {
+				record.Content = append(record.Content, address)
+			}
+		}
+		if err := patchPowerDNSRRSets(ctx, "REPLACE", record); err != nil {
+			return err
+		}
+		result.Record = record
+	} else {
+		// The load balancer may have changed its addresses since the record
+		// was written, the name is deleted in all the address types
+		var records []*DNSRecord
+		for _, recordType := range []string{"A", "AAAA", "CNAME"} {
+			records = append(records, &DNSRecord{Name: record.Name, Type: recordType})
+		}
+		if err := patchPowerDNSRRSets(ctx, "DELETE", records...); err != nil {
+			return err
+		}
+		result.Record = &DNSRecord{Name: record.Name, Type: "A, AAAA, CNAME"}
+	}
+	if simulation != nil {
+		result.Note = "simulated, the PowerDNS API was not called"
+	}
+	return nil
+}
+
+// addressRecordType returns the type of the record pointing at a load
+// balancer address
+func addressRecordType(address string) string {
+	switch ip := net.ParseIP(address); {
+	case ip == nil:
+		return "CNAME"
+	case ip.To4() == nil:
+		return "AAAA"
+	}
+	return "A"
+}
+
+// patchPowerDNSRRSets sends the changes of RRsets to the zone of the dns
+// configuration through the PowerDNS HTTP API, in one request so they are
+// applied together
+func patchPowerDNSRRSets(ctx context.Context, changeType string, records ...*DNSRecord) error {
+	var rrsets []interface{}
+	for _, record := range records {
+		rrset := map[string]interface{}{
+			"name":       record.Name,
+			"type":       record.Type,
+			"changetype": changeType,
+		}
+		if changeType == "REPLACE" {
+			var contents []interface{}
+			for _, content := range record.Content {
+				contents = append(contents, map[string]interface{}{"content": content, "disabled": false})
+			}
+			rrset["ttl"], rrset["records"] = record.TTL, contents
+		}
+		rrsets = append(rrsets, rrset)
+	}
+	if simulation != nil {
+		logMessage(LogInfo, "dns", "Simulated the %s of %d RRsets of %s", strings.ToLower(changeType), len(rrsets), records[0].Name)
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{"rrsets": rrsets})
+	if err != nil {
+		return err
+	}
+
+	serverID := serverConfig.DNS.ServerID
+	if serverID == "" {
+		serverID = defaultDNSServerID
+	}
+	zone := strings.TrimSuffix(serverConfig.DNS.Zone, ".") + "."
+	endpoint := fmt.Sprintf("%s/api/v1/servers/%s/zones/%s", strings.TrimSuffix(serverConfig.DNS.APIURL, "/"), url.PathEscape(serverID), url.PathEscape(zone))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid PowerDNS API URL: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", os.Getenv(dnsAPIKeyEnv))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the PowerDNS API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PowerDNS API refused the %s of %s: %s %s", strings.ToLower(changeType), records[0].Name, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
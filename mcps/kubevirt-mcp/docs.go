@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// docsScheme prefixes the URIs of the documents of the docs folders, e.g.
+// kubevirt-mcp://docs/kubernetes/docs/network/interfaces.md
+const docsScheme = "kubevirt-mcp://docs/"
+
+const (
+	// maxDocFiles bounds the documents listed per docs folder
+	maxDocFiles = 5000
+	// docPageSize is the size in bytes of a page of a document read via
+	// resources/read, longer documents are read with ?page=N
+	docPageSize = 64 * 1024
+)
+
+// docMimeTypes holds the MIME types of the document extensions served,
+// other files such as images are left out
+var docMimeTypes = map[string]string{
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".adoc":     "text/asciidoc",
+	".asciidoc": "text/asciidoc",
+	".rst":      "text/x-rst",
+	".txt":      "text/plain",
+	".html":     "text/html",
+	".yaml":     "application/yaml",
+	".yml":      "application/yaml",
+	".json":     "application/json",
+}
+
+// docsRoot is a docs folder served as resources under docsScheme + name
+type docsRoot struct {
+	name  string
+	path  string
+	label string
+}
+
+// docsRoots returns the docs folders of config.json and the docs folders of
+// the registered clusters that differ from them
+func docsRoots() []docsRoot {
+	var roots []docsRoot
+	seen := map[string]bool{}
+	add := func(name, path, label string) {
+		if path == "" {
+			return
+		}
+		path = filepath.Clean(expandHome(path))
+		if seen[path] {
+			return
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return
+		}
+		seen[path] = true
+		roots = append(roots, docsRoot{name: name, path: path, label: label})
+	}
+
+	if config, err := loadConfig(); err == nil {
+		add("kubernetes", config.Docs.Kubernetes, "Kubernetes docs")
+		add("openshift", config.Docs.OpenShift, "OpenShift docs")
+	}
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add("cluster-"+name, clusters[name].Docs, "Docs of cluster "+name)
+	}
+	return roots
+}
+
+// docsResourcesURI returns the URI prefix of the documents of a docs folder,
+// empty when the folder is not served
+func docsResourcesURI(path string) string {
+	if path == "" {
+		return ""
+	}
+	path = filepath.Clean(expandHome(path))
+	for _, root := range docsRoots() {
+		if root.path == path {
+			return docsScheme + root.name + "/"
+		}
+	}
+	return ""
+}
+
+// docResources lists the documents of the docs folders in the shape expected
+// by resources/list, hidden files and folders are skipped
+func docResources() []map[string]interface{} {
+	resources := []map[string]interface{}{}
+	for _, root := range docsRoots() {
+		count := 0
+		filepath.WalkDir(root.path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") && path != root.path {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			mimeType, ok := docMimeTypes[strings.ToLower(filepath.Ext(path))]
+			if d.IsDir() || !ok {
+				return nil
+			}
+			if count == maxDocFiles {
+				logMessage(LogWarning, "resources", "Listing only the first %d documents of %s", maxDocFiles, root.path)
+				return filepath.SkipAll
+			}
+			rel, _ := filepath.Rel(root.path, path)
+			if d.Type()&fs.ModeSymlink != 0 {
+				if _, err := docPath(root.path, filepath.ToSlash(rel)); err != nil {
+					return nil
+				}
+			}
+			count++
+			resource := map[string]interface{}{
+				"uri":         docsScheme + root.name + "/" + filepath.ToSlash(rel),
+				"name":        filepath.ToSlash(rel),
+				"description": root.label,
+				"mimeType":    mimeType,
+			}
+			if info, err := d.Info(); err == nil {
+				resource["size"] = info.Size()
+			}
+			resources = append(resources, resource)
+			return nil
+		})
+	}
+	return resources
+}
+
+// readDocResource returns a page of a document of a docs folder for
+// resources/read, documents longer than docPageSize end with a pointer to
+// the next page
+func readDocResource(uri string) (map[string]interface{}, error) {
+	rest, query, _ := strings.Cut(strings.TrimPrefix(uri, docsScheme), "?")
+	rootName, rel, ok := strings.Cut(rest, "/")
+	if !ok || rootName == "" || rel == "" {
+		return nil, &invalidParamsError{err: fmt.Errorf("invalid docs resource %s, use %s<folder>/<path>", uri, docsScheme)}
+	}
+
+	page := 1
+	if query != "" {
+		value, found := strings.CutPrefix(query, "page=")
+		n, err := strconv.Atoi(value)
+		if !found || err != nil || n < 1 {
+			return nil, &invalidParamsError{err: fmt.Errorf("invalid docs resource query %q, use ?page=N", query)}
+		}
+		page = n
+	}
+
+	var root *docsRoot
+	for _, r := range docsRoots() {
+		if r.name == rootName {
+			root = &r
+			break
+		}
+	}
+	if root == nil {
+		return nil, &invalidParamsError{err: fmt.Errorf("unknown docs folder %s", rootName)}
+	}
+
+	path, err := docPath(root.path, rel)
+	if err != nil {
+		return nil, &invalidParamsError{err: err}
+	}
+	mimeType, ok := docMimeTypes[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, &invalidParamsError{err: fmt.Errorf("%s is not a document", rel)}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", rel, err)
+	}
+
+	pages := docPages(string(data))
+	if page > len(pages) {
+		return nil, &invalidParamsError{err: fmt.Errorf("page %d out of range, %s has %d pages", page, rel, len(pages))}
+	}
+	text := pages[page-1]
+	if page < len(pages) {
+		text += fmt.Sprintf("\n\n[Page %d of %d, continue with resources/read %s%s/%s?page=%d]", page, len(pages), docsScheme, rootName, rel, page+1)
+	}
+	return map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{"uri": uri, "mimeType": mimeType, "text": text},
+		},
+	}, nil
+}
+
+// docPath resolves the path of a document relative to a docs folder,
+// refusing paths and symlinks leading out of it
+func docPath(root, rel string) (string, error) {
+	if filepath.IsAbs(rel) || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("invalid document path %s", rel)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve docs folder: %v", err)
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", fmt.Errorf("document %s not found", rel)
+	}
+	if inside, err := filepath.Rel(resolvedRoot, path); err != nil || !filepath.IsLocal(inside) {
+		return "", fmt.Errorf("document %s is outside of the docs folder", rel)
+	}
+	return path, nil
+}
+
+// docPages splits a document into pages of at most docPageSize bytes, cut at
+// line ends where possible and never inside a UTF-8 character
+func docPages(text string) []string {
+	var pages []string
+	for len(text) > docPageSize {
+		cut := strings.LastIndexByte(text[:docPageSize], '\n') + 1
+		if cut == 0 {
+			cut = docPageSize
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		pages = append(pages, text[:cut])
+		text = text[cut:]
+	}
+	return append(pages, text)
+}
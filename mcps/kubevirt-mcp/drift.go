@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDriftFields bounds the differing fields listed per VM
+const maxDriftFields = 50
+
+// Kinds of the differences of a VM from the reference
+const (
+	driftChanged = "changed"
+	driftMissing = "missing"
+	driftExtra   = "extra"
+)
+
+// defaultDriftFields are the parts of the VMs compared when fields is not set
+var defaultDriftFields = []string{"spec"}
+
+// defaultDriftIgnore are the fields set per VM, which differ across any
+// fleet
+var defaultDriftIgnore = []string{
+	"spec.template.spec.domain.firmware.uuid",
+	"spec.template.spec.domain.firmware.serial",
+	"spec.template.spec.domain.devices.interfaces[*].macAddress",
+	"spec.template.spec.hostname",
+}
+
+// VMDriftParams represents the parameters of vm_drift
+type VMDriftParams struct {
+	Namespace   string   `json:"namespace,omitempty"`
+	Selector    string   `json:"selector,omitempty"`
+	Reference   string   `json:"reference,omitempty"`
+	ReferenceVM string   `json:"reference_vm,omitempty"`
+	Fields      []string `json:"fields,omitempty"`
+	Ignore      []string `json:"ignore,omitempty"`
+	Strict      bool     `json:"strict,omitempty"`
+	Format      string   `json:"format,omitempty"`
+}
+
+// DriftField is a field of a VM differing from the reference
+type DriftField struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// VMDrift holds the differences of one VM from the reference
+type VMDrift struct {
+	Name        string       `json:"name"`
+	InSync      bool         `json:"inSync"`
+	Differences []DriftField `json:"differences,omitempty"`
+	// Omitted counts the differences beyond maxDriftFields
+	Omitted int `json:"omitted,omitempty"`
+}
+
+// VMDriftResult is the vm_drift tool result
+type VMDriftResult struct {
+	Namespace string    `json:"namespace"`
+	Selector  string    `json:"selector,omitempty"`
+	Reference string    `json:"reference"`
+	Fields    []string  `json:"fields"`
+	Ignored   []string  `json:"ignored"`
+	Strict    bool      `json:"strict"`
+	Drifted   int       `json:"drifted"`
+	VMs       []VMDrift `json:"vms"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_drift",
+		Description: "Compare a fleet of VMs, all the VMs of a namespace or those matching a label selector, with a reference VirtualMachine manifest or VM and report the fields of each VM that differ from it, to keep lab fleets consistent",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VMs",
+					"default":     "default",
+				},
+				"selector": map[string]interface{}{
+					"type":        "string",
+					"description": "Label selector of the VMs compared, e.g. app=lab (default: every VM of the namespace)",
+				},
+				"reference": map[string]interface{}{
+					"type":        "string",
+					"description": "YAML or JSON manifest of the reference VirtualMachine",
+				},
+				"reference_vm": map[string]interface{}{
+					"type":        "string",
+					"description": "VM of the namespace used as the reference instead of a manifest, it is left out of the comparison",
+				},
+				"fields": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Paths compared, e.g. spec.template.spec.domain or metadata.labels (default: spec)",
+				},
+				"ignore": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Paths left out in addition to the per-VM firmware uuid and serial, MAC addresses and hostname; * matches one segment and list items are named, e.g. spec.template.spec.volumes[*].dataVolume",
+				},
+				"strict": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also report the fields a VM sets and the reference does not, such as defaults added by KubeVirt",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleVMDrift,
+	})
+}
+
+// handleVMDrift is the tools/call handler for vm_drift
+func handleVMDrift(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMDriftParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Reference == "" && params.ReferenceVM == "" {
+		return "", missingArgument("reference or reference_vm")
+	}
+	if params.Reference != "" && params.ReferenceVM != "" {
+		return "", &invalidParamsError{err: errors.New("reference and reference_vm cannot be combined")}
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if len(params.Fields) == 0 {
+		params.Fields = defaultDriftFields
+	}
+
+	result, err := vmDrift(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// vmDrift compares the selected VMs with the reference
+func vmDrift(ctx context.Context, params VMDriftParams) (*VMDriftResult, error) {
+	reference, name, err := driftReference(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"get", "virtualmachines", "-n", params.Namespace}
+	if params.Selector != "" {
+		args = append(args, "-l", params.Selector)
+	}
+	var vms struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &vms, args...); err != nil {
+		return nil, err
+	}
+
+	result := &VMDriftResult{
+		Namespace: params.Namespace,
+		Selector:  params.Selector,
+		Reference: name,
+		Fields:    params.Fields,
+		Ignored:   append(append([]string{}, defaultDriftIgnore...), params.Ignore...),
+		Strict:    params.Strict,
+		VMs:       []VMDrift{},
+	}
+	if params.ReferenceVM != "" {
+		result.Reference = "vm/" + params.ReferenceVM
+	}
+
+	expected := driftLeaves(reference, params.Fields)
+	for _, vm := range vms.Items {
+		vmName, _ := nestedMap(vm, "metadata")["name"].(string)
+		if params.ReferenceVM != "" && vmName == params.ReferenceVM {
+			continue
+		}
+		drift := VMDrift{Name: vmName}
+		for _, difference := range compareDriftLeaves(expected, driftLeaves(vm, params.Fields), name, vmName, result.Ignored, params.Strict) {
+			if len(drift.Differences) == maxDriftFields {
+				drift.Omitted++
+				continue
+			}
+			drift.Differences = append(drift.Differences, difference)
+		}
+		drift.InSync = len(drift.Differences) == 0
+		if !drift.InSync {
+			result.Drifted++
+		}
+		result.VMs = append(result.VMs, drift)
+	}
+	sort.Slice(result.VMs, func(i, j int) bool { return result.VMs[i].Name < result.VMs[j].Name })
+	return result, nil
+}
+
+// driftReference returns the reference VM and its name, from the manifest
+// or the reference VM
+func driftReference(ctx context.Context, params VMDriftParams) (map[string]interface{}, string, error) {
+	if params.ReferenceVM != "" {
+		vm := map[string]interface{}{}
+		if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.ReferenceVM, "-n", params.Namespace); err != nil {
+			return nil, "", err
+		}
+		return vm, params.ReferenceVM, nil
+	}
+
+	objects, err := parseManifest(params.Reference, params.Namespace)
+	if err != nil {
+		return nil, "", &invalidParamsError{err: err}
+	}
+	if len(objects) != 1 || objects[0]["kind"] != "VirtualMachine" {
+		return nil, "", &invalidParamsError{err: errors.New("reference must be a single VirtualMachine")}
+	}
+	name, _ := nestedMap(objects[0], "metadata")["name"].(string)
+	return objects[0], name, nil
+}
+
+// driftFields holds the compared fields of a VM: the leaf values by path,
+// and the list items by path so an item added or removed as a whole is
+// reported once
+type driftFields struct {
+	leaves map[string]interface{}
+	items  map[string]interface{}
+}
+
+// driftLeaves flattens the compared fields of a VM. Items of lists whose
+// items all have a name are keyed by it, so reordered disks or interfaces
+// do not drift, the others by index.
+func driftLeaves(vm map[string]interface{}, fields []string) driftFields {
+	all := driftFields{leaves: map[string]interface{}{}, items: map[string]interface{}{}}
+	flattenDriftValue("", vm, all)
+	compared := driftFields{leaves: map[string]interface{}{}, items: map[string]interface{}{}}
+	for _, from := range []struct{ all, compared map[string]interface{} }{{all.leaves, compared.leaves}, {all.items, compared.items}} {
+		for leaf, value := range from.all {
+			for _, field := range fields {
+				if leaf == field || strings.HasPrefix(leaf, field+".") || strings.HasPrefix(leaf, field+"[") {
+					from.compared[leaf] = value
+					break
+				}
+			}
+		}
+	}
+	return compared
+}
+
+// flattenDriftValue adds the leaves and list items of value below prefix
+func flattenDriftValue(prefix string, value interface{}, fields driftFields) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 && prefix != "" {
+			fields.leaves[prefix] = v
+		}
+		for key, child := range v {
+			if prefix == "" {
+				flattenDriftValue(key, child, fields)
+			} else {
+				flattenDriftValue(prefix+"."+key, child, fields)
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			fields.leaves[prefix] = v
+		}
+		named := true
+		for _, item := range v {
+			if m, ok := item.(map[string]interface{}); !ok || m["name"] == nil {
+				named = false
+				break
+			}
+		}
+		for i, item := range v {
+			key := strconv.Itoa(i)
+			if named {
+				key = fmt.Sprint(item.(map[string]interface{})["name"])
+			}
+			fields.items[prefix+"["+key+"]"] = item
+			flattenDriftValue(prefix+"["+key+"]", item, fields)
+		}
+	default:
+		fields.leaves[prefix] = value
+	}
+}
+
+// compareDriftLeaves lists the differences of a VM from the reference. The
+// name of the reference in its string values stands for the VM's own name,
+// so per-VM names such as DataVolumes match. List items only one of them
+// has are reported as a whole, other fields the VM sets only with strict.
+func compareDriftLeaves(expected, actual driftFields, referenceName, vmName string, ignore []string, strict bool) []DriftField {
+	var differences []DriftField
+	var wholeItems []string
+	for _, item := range sortedKeys(expected.items) {
+		if _, ok := actual.items[item]; !ok && !driftIgnored(item, ignore) && !underAny(item, wholeItems) {
+			wholeItems = append(wholeItems, item)
+			differences = append(differences, DriftField{Path: item, Kind: driftMissing, Expected: leafValue(expected.items[item], true), Actual: leafValue(nil, false)})
+		}
+	}
+	for _, item := range sortedKeys(actual.items) {
+		if _, ok := expected.items[item]; !ok && !driftIgnored(item, ignore) && !underAny(item, wholeItems) {
+			wholeItems = append(wholeItems, item)
+			differences = append(differences, DriftField{Path: item, Kind: driftExtra, Expected: leafValue(nil, false), Actual: leafValue(actual.items[item], true)})
+		}
+	}
+
+	for _, leaf := range sortedKeys(expected.leaves) {
+		if driftIgnored(leaf, ignore) || underAny(leaf, wholeItems) {
+			continue
+		}
+		want := expected.leaves[leaf]
+		if s, ok := want.(string); ok && referenceName != "" && vmName != "" {
+			want = strings.ReplaceAll(s, referenceName, vmName)
+		}
+		got, ok := actual.leaves[leaf]
+		switch {
+		case !ok:
+			differences = append(differences, DriftField{Path: leaf, Kind: driftMissing, Expected: leafValue(want, true), Actual: leafValue(nil, false)})
+		case !reflect.DeepEqual(want, got):
+			differences = append(differences, DriftField{Path: leaf, Kind: driftChanged, Expected: leafValue(want, true), Actual: leafValue(got, true)})
+		}
+	}
+	if strict {
+		for _, leaf := range sortedKeys(actual.leaves) {
+			if _, ok := expected.leaves[leaf]; ok || driftIgnored(leaf, ignore) || underAny(leaf, wholeItems) {
+				continue
+			}
+			differences = append(differences, DriftField{Path: leaf, Kind: driftExtra, Expected: leafValue(nil, false), Actual: leafValue(actual.leaves[leaf], true)})
+		}
+	}
+	sort.SliceStable(differences, func(i, j int) bool { return differences[i].Path < differences[j].Path })
+	return differences
+}
+
+// underAny reports whether a path is one of the list items or below one
+func underAny(leaf string, items []string) bool {
+	for _, item := range items {
+		if leaf == item || strings.HasPrefix(leaf, item+".") || strings.HasPrefix(leaf, item+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// driftIgnored reports whether a leaf is an ignored path or below one
+func driftIgnored(leaf string, ignore []string) bool {
+	segments := driftSegments(leaf)
+	for _, pattern := range ignore {
+		patternSegments := driftSegments(pattern)
+		if len(patternSegments) > len(segments) {
+			continue
+		}
+		if matched, err := path.Match(strings.Join(patternSegments, "/"), strings.Join(segments[:len(patternSegments)], "/")); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// driftSegments splits a path such as a.b[x].c into a, b, x and c
+func driftSegments(leaf string) []string {
+	leaf = strings.NewReplacer("[", ".", "]", "").Replace(leaf)
+	return strings.Split(leaf, ".")
+}
+
+// tables renders the drift of the VMs
+func (r *VMDriftResult) tables() []table {
+	summary := table{
+		title:   fmt.Sprintf("Drift from %s in %s (%d of %d VMs drifted)", r.Reference, r.Namespace, r.Drifted, len(r.VMs)),
+		headers: []string{"VM", "IN SYNC", "DIFFERENCES"},
+	}
+	fields := table{title: "Differences", headers: []string{"VM", "FIELD", "KIND", "EXPECTED", "ACTUAL"}}
+	for _, vm := range r.VMs {
+		count := strconv.Itoa(len(vm.Differences) + vm.Omitted)
+		summary.rows = append(summary.rows, []string{vm.Name, strconv.FormatBool(vm.InSync), count})
+		for _, difference := range vm.Differences {
+			fields.rows = append(fields.rows, []string{vm.Name, difference.Path, difference.Kind, difference.Expected, difference.Actual})
+		}
+		if vm.Omitted > 0 {
+			fields.rows = append(fields.rows, []string{vm.Name, fmt.Sprintf("(%d more)", vm.Omitted), "", "", ""})
+		}
+	}
+	if len(fields.rows) == 0 {
+		return []table{summary}
+	}
+	return []table{summary, fields}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCompareDriftLeaves(t *testing.T) {
+	const reference = `{"spec":{"runStrategy":"Always","dataVolumeTemplates":[{"metadata":{"name":"ref-root"}}],"template":{"spec":{
+		"domain":{"cpu":{"cores":2},"firmware":{"uuid":"1"},"devices":{
+			"disks":[{"name":"root","disk":{"bus":"virtio"}},{"name":"data","disk":{"bus":"virtio"}}],
+			"interfaces":[{"name":"default","masquerade":{},"macAddress":"02:00:00:00:00:01"}]}},
+		"nodeSelector":{"zone":"a"},
+		"tolerations":[{"key":"gpu"},{"key":"spot"}]}}}}`
+	tests := []struct {
+		name   string
+		vm     string
+		fields []string
+		ignore []string
+		strict bool
+		want   []string
+	}{
+		{
+			name: "in sync with per-VM fields",
+			vm: `{"spec":{"runStrategy":"Always","dataVolumeTemplates":[{"metadata":{"name":"vm-root"}}],"template":{"spec":{
+				"domain":{"cpu":{"cores":2},"firmware":{"uuid":"2"},"devices":{
+					"disks":[{"name":"data","disk":{"bus":"virtio"}},{"name":"root","disk":{"bus":"virtio"}}],
+					"interfaces":[{"name":"default","masquerade":{},"macAddress":"02:00:00:00:00:02"}]}},
+				"nodeSelector":{"zone":"a"},
+				"tolerations":[{"key":"gpu"},{"key":"spot"}]}}}}`,
+		},
+		{
+			name: "changed, missing and reordered values",
+			vm: `{"spec":{"runStrategy":"Halted","dataVolumeTemplates":[{"metadata":{"name":"other-root"}}],"template":{"spec":{
+				"domain":{"devices":{
+					"disks":[{"name":"root","disk":{"bus":"sata"}},{"name":"data","disk":{"bus":"virtio"}}],
+					"interfaces":[{"name":"default","masquerade":{}}]}},
+				"nodeSelector":{"zone":"a","gpu":"true"},
+				"tolerations":[{"key":"spot"},{"key":"gpu"}]}}}}`,
+			want: []string{
+				`changed spec.dataVolumeTemplates[0].metadata.name "vm-root" "other-root"`,
+				`changed spec.runStrategy "Always" "Halted"`,
+				`missing spec.template.spec.domain.cpu.cores 2 (none)`,
+				`changed spec.template.spec.domain.devices.disks[root].disk.bus "virtio" "sata"`,
+				`changed spec.template.spec.tolerations[0].key "gpu" "spot"`,
+				`changed spec.template.spec.tolerations[1].key "spot" "gpu"`,
+			},
+		},
+		{
+			name:   "extra fields with strict",
+			vm:     `{"spec":{"runStrategy":"Always","template":{"spec":{"nodeSelector":{"zone":"a","gpu":"true"}}}}}`,
+			fields: []string{"spec.runStrategy", "spec.template.spec.nodeSelector"},
+			strict: true,
+			want:   []string{`extra spec.template.spec.nodeSelector.gpu (none) "true"`},
+		},
+		{
+			name: "list items as a whole",
+			vm: `{"spec":{"template":{"spec":{"domain":{"devices":{
+				"disks":[{"name":"root","disk":{"bus":"virtio"}},{"name":"scratch","disk":{"bus":"virtio"}}]}}}}}}`,
+			fields: []string{"spec.template.spec.domain.devices.disks"},
+			want: []string{
+				`missing spec.template.spec.domain.devices.disks[data] {"disk":{"bus":"virtio"},"name":"data"} (none)`,
+				`extra spec.template.spec.domain.devices.disks[scratch] (none) {"disk":{"bus":"virtio"},"name":"scratch"}`,
+			},
+		},
+		{
+			name:   "ignored patterns",
+			vm:     `{"spec":{"runStrategy":"Halted","template":{"spec":{"domain":{"cpu":{"cores":4}},"tolerations":[{"key":"other"}]}}}}`,
+			fields: []string{"spec.runStrategy", "spec.template.spec.domain.cpu", "spec.template.spec.tolerations"},
+			ignore: []string{"spec.runStrategy", "spec.template.spec.domain.*", "spec.template.spec.tolerations[*]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expected, actual map[string]interface{}
+			if err := json.Unmarshal([]byte(reference), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.vm), &actual); err != nil {
+				t.Fatal(err)
+			}
+			fields := tt.fields
+			if fields == nil {
+				fields = defaultDriftFields
+			}
+			ignore := append(append([]string{}, defaultDriftIgnore...), tt.ignore...)
+			differences := compareDriftLeaves(driftLeaves(expected, fields), driftLeaves(actual, fields), "ref", "vm", ignore, tt.strict)
+			var got []string
+			for _, d := range differences {
+				got = append(got, d.Kind+" "+d.Path+" "+d.Expected+" "+d.Actual)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("differences =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Eviction strategies of VMIs and of the cluster
+const (
+	evictionNone                  = "None"
+	evictionLiveMigrate           = "LiveMigrate"
+	evictionLiveMigrateIfPossible = "LiveMigrateIfPossible"
+	evictionExternal              = "External"
+	// evictionClusterDefault removes the strategy of a VM, so the cluster
+	// wide one applies
+	evictionClusterDefault = "cluster"
+)
+
+// What draining the node of a VMI does to it
+const (
+	drainMigrate  = "migrate"
+	drainShutdown = "shutdown"
+	drainBlock    = "block"
+)
+
+// createdByLabel is set by KubeVirt to the VMI UID on its virt-launcher pods
+// and disruption budgets
+const createdByLabel = "kubevirt.io/created-by"
+
+// EvictionReportParams represents the parameters of vm_eviction_report
+type EvictionReportParams struct {
+	Namespace     string `json:"namespace,omitempty"`
+	AllNamespaces bool   `json:"all_namespaces,omitempty"`
+	Node          string `json:"node,omitempty"`
+	Format        string `json:"format,omitempty"`
+}
+
+// VMIEvictionPosture is what a node drain does to a VMI and why
+type VMIEvictionPosture struct {
+	Namespace        string   `json:"namespace"`
+	Name             string   `json:"name"`
+	Node             string   `json:"node,omitempty"`
+	EvictionStrategy string   `json:"evictionStrategy"`
+	StrategySource   string   `json:"strategySource"`
+	LiveMigratable   string   `json:"liveMigratable,omitempty"`
+	DrainEffect      string   `json:"drainEffect"`
+	Reasons          []string `json:"reasons,omitempty"`
+	PDBs             []string `json:"pdbs,omitempty"`
+}
+
+// DisruptionBudget is a PodDisruptionBudget covering virt-launcher pods
+type DisruptionBudget struct {
+	Namespace          string   `json:"namespace"`
+	Name               string   `json:"name"`
+	CreatedBy          string   `json:"createdBy"`
+	MinAvailable       string   `json:"minAvailable,omitempty"`
+	MaxUnavailable     string   `json:"maxUnavailable,omitempty"`
+	CurrentHealthy     int      `json:"currentHealthy"`
+	DesiredHealthy     int      `json:"desiredHealthy"`
+	DisruptionsAllowed int      `json:"disruptionsAllowed"`
+	VMIs               []string `json:"vmis"`
+	Blocking           bool     `json:"blocking"`
+}
+
+// NodeDrainPosture sums what draining a node does to its VMIs
+type NodeDrainPosture struct {
+	Node     string `json:"node"`
+	VMIs     int    `json:"vmis"`
+	Migrate  int    `json:"migrate"`
+	Shutdown int    `json:"shutdown"`
+	Blocking int    `json:"blocking"`
+}
+
+// EvictionReportResult is the vm_eviction_report tool result
+type EvictionReportResult struct {
+	Namespace       string               `json:"namespace,omitempty"`
+	Node            string               `json:"node,omitempty"`
+	ClusterStrategy string               `json:"clusterEvictionStrategy"`
+	Blocking        int                  `json:"blocking"`
+	VMIs            []VMIEvictionPosture `json:"vmis"`
+	PDBs            []DisruptionBudget   `json:"pdbs"`
+	Nodes           []NodeDrainPosture   `json:"nodes"`
+	Notes           []string             `json:"notes,omitempty"`
+}
+
+// EvictionStrategyParams represents the parameters of vm_eviction_strategy
+type EvictionStrategyParams struct {
+	Namespace string   `json:"namespace,omitempty"`
+	VMNames   []string `json:"vm_names,omitempty"`
+	Strategy  string   `json:"strategy,omitempty"`
+	Confirm   bool     `json:"confirm,omitempty"`
+}
+
+// EvictionStrategyChange is the eviction strategy change of one VM
+type EvictionStrategyChange struct {
+	Name            string `json:"name"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Changed         bool   `json:"changed"`
+	Applied         bool   `json:"applied"`
+	RestartRequired bool   `json:"restartRequired,omitempty"`
+	Diff            string `json:"diff,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// EvictionStrategyResult is the vm_eviction_strategy tool result
+type EvictionStrategyResult struct {
+	Namespace string                   `json:"namespace"`
+	Strategy  string                   `json:"strategy"`
+	Confirmed bool                     `json:"confirmed"`
+	VMs       []EvictionStrategyChange `json:"vms"`
+	Note      string                   `json:"note,omitempty"`
+}
+
+// evictionVMI holds the fields of a VMI deciding what a drain does to it
+type evictionVMI struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		EvictionStrategy string `json:"evictionStrategy,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase              string          `json:"phase,omitempty"`
+		NodeName           string          `json:"nodeName,omitempty"`
+		EvacuationNodeName string          `json:"evacuationNodeName,omitempty"`
+		Conditions         []Condition     `json:"conditions,omitempty"`
+		MigrationState     *MigrationState `json:"migrationState,omitempty"`
+	} `json:"status"`
+}
+
+// launcherPod holds the labels and owner of a virt-launcher pod
+type launcherPod struct {
+	Metadata struct {
+		ObjectMeta
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+	Status struct {
+		Phase string `json:"phase,omitempty"`
+	} `json:"status"`
+}
+
+type podDisruptionBudget struct {
+	Metadata struct {
+		ObjectMeta
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		MinAvailable   interface{}    `json:"minAvailable,omitempty"`
+		MaxUnavailable interface{}    `json:"maxUnavailable,omitempty"`
+		Selector       *labelSelector `json:"selector,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		CurrentHealthy     int `json:"currentHealthy"`
+		DesiredHealthy     int `json:"desiredHealthy"`
+		DisruptionsAllowed int `json:"disruptionsAllowed"`
+	} `json:"status"`
+}
+
+// labelSelector is a Kubernetes label selector
+type labelSelector struct {
+	MatchLabels      map[string]string `json:"matchLabels,omitempty"`
+	MatchExpressions []struct {
+		Key      string   `json:"key"`
+		Operator string   `json:"operator"`
+		Values   []string `json:"values,omitempty"`
+	} `json:"matchExpressions,omitempty"`
+}
+
+// matches reports whether labels match the selector. Like for the
+// PodDisruptionBudgets of policy/v1 a missing selector matches nothing and
+// an empty one everything.
+func (s *labelSelector) matches(labels map[string]string) bool {
+	if s == nil {
+		return false
+	}
+	for key, value := range s.MatchLabels {
+		if labels[key] != value {
+			return false
+		}
+	}
+	for _, expr := range s.MatchExpressions {
+		value, ok := labels[expr.Key]
+		switch expr.Operator {
+		case "In":
+			if !ok || !containsString(expr.Values, value) {
+				return false
+			}
+		case "NotIn":
+			if ok && containsString(expr.Values, value) {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_eviction_report",
+		Description: "Report the eviction posture of running VMIs: their effective eviction strategy, the PodDisruptionBudgets covering their virt-launcher pods, and whether a node drain migrates them, shuts them down or is blocked by them, and why",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VMIs",
+					"default":     "default",
+				},
+				"all_namespaces": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Report the VMIs of all namespaces",
+					"default":     false,
+				},
+				"node": map[string]interface{}{
+					"type":        "string",
+					"description": "Only report the VMIs running on this node, e.g. before draining it",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleEvictionReport,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_eviction_strategy",
+		Description: "Set the eviction strategy of selected VMs, e.g. to LiveMigrateIfPossible or None so VMs that cannot migrate stop blocking a node drain, or back to the cluster default after maintenance. Only previews the change unless confirm is set",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VMs",
+					"default":     "default",
+				},
+				"vm_names": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Names of the VMs to change",
+				},
+				"strategy": map[string]interface{}{
+					"type":        "string",
+					"description": "New eviction strategy; cluster removes the VM's own strategy so the cluster wide one applies",
+					"enum":        []string{evictionLiveMigrateIfPossible, evictionNone, evictionLiveMigrate, evictionExternal, evictionClusterDefault},
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Must be true to patch the VMs; without it the tool only previews the change",
+					"default":     false,
+				},
+			},
+			"required": []string{"vm_names", "strategy"},
+		},
+		Handler: handleEvictionStrategy,
+	})
+}
+
+// handleEvictionReport is the tools/call handler for vm_eviction_report
+func handleEvictionReport(ctx context.Context, args json.RawMessage) (string, error) {
+	var params EvictionReportParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := evictionReport(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// clusterEvictionStrategy returns the cluster wide eviction strategy of the
+// KubeVirt CR, None when it sets none
+func clusterEvictionStrategy(ctx context.Context) (string, error) {
+	_, kvRaw, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return evictionNone, err
+	}
+	if strategy := stringField(nestedMap(kvRaw, "spec", "configuration"), "evictionStrategy"); strategy != "" {
+		return strategy, nil
+	}
+	return evictionNone, nil
+}
+
+// evictionReport evaluates the eviction posture of the VMIs in scope
+func evictionReport(ctx context.Context, params EvictionReportParams) (*EvictionReportResult, error) {
+	result := &EvictionReportResult{Node: params.Node, VMIs: []VMIEvictionPosture{}, PDBs: []DisruptionBudget{}, Nodes: []NodeDrainPosture{}}
+	if !params.AllNamespaces {
+		result.Namespace = params.Namespace
+	}
+
+	clusterStrategy, err := clusterEvictionStrategy(ctx)
+	if err != nil {
+		result.Notes = append(result.Notes, "KubeVirt CR not readable, cluster eviction strategy None assumed")
+	}
+	result.ClusterStrategy = clusterStrategy
+
+	reportProgress(ctx, "reading VMIs, virt-launcher pods and disruption budgets")
+	scope := namespaceArgs(params.Namespace, params.AllNamespaces)
+	var vmis struct {
+		Items []evictionVMI `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &vmis, append([]string{"get", "virtualmachineinstances"}, scope...)...); err != nil {
+		return nil, err
+	}
+	var pods struct {
+		Items []launcherPod `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &pods, append([]string{"get", "pods", "-l", "kubevirt.io=virt-launcher"}, scope...)...); err != nil {
+		return nil, err
+	}
+	var pdbs struct {
+		Items []podDisruptionBudget `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &pdbs, append([]string{"get", "poddisruptionbudgets.policy"}, scope...)...); err != nil {
+		return nil, err
+	}
+
+	// The active virt-launcher pods of each VMI, a migrating VMI has two
+	podsByVMI := map[string][]launcherPod{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		for _, owner := range pod.Metadata.OwnerReferences {
+			if owner.Kind == "VirtualMachineInstance" {
+				key := pod.Metadata.Namespace + "/" + owner.Name
+				podsByVMI[key] = append(podsByVMI[key], pod)
+			}
+		}
+	}
+
+	// The disruption budgets covering the pods of each VMI
+	budgetsByVMI := map[string][]*DisruptionBudget{}
+	for _, pdb := range pdbs.Items {
+		budget := DisruptionBudget{
+			Namespace:          pdb.Metadata.Namespace,
+			Name:               pdb.Metadata.Name,
+			CreatedBy:          "user",
+			MinAvailable:       intOrString(pdb.Spec.MinAvailable),
+			MaxUnavailable:     intOrString(pdb.Spec.MaxUnavailable),
+			CurrentHealthy:     pdb.Status.CurrentHealthy,
+			DesiredHealthy:     pdb.Status.DesiredHealthy,
+			DisruptionsAllowed: pdb.Status.DisruptionsAllowed,
+			VMIs:               []string{},
+		}
+		for _, owner := range pdb.Metadata.OwnerReferences {
+			if owner.Kind == "VirtualMachineInstance" || owner.Kind == "VirtualMachineInstanceMigration" {
+				budget.CreatedBy = "kubevirt"
+			}
+		}
+		if _, ok := pdb.Metadata.Labels[createdByLabel]; ok {
+			budget.CreatedBy = "kubevirt"
+		}
+		for key, vmiPods := range podsByVMI {
+			namespace, name, _ := strings.Cut(key, "/")
+			if namespace != pdb.Metadata.Namespace {
+				continue
+			}
+			for _, pod := range vmiPods {
+				if pdb.Spec.Selector.matches(pod.Metadata.Labels) {
+					budget.VMIs = append(budget.VMIs, name)
+					break
+				}
+			}
+		}
+		if len(budget.VMIs) == 0 {
+			continue
+		}
+		sort.Strings(budget.VMIs)
+		// The budgets KubeVirt creates never allow a disruption, evictions
+		// go through virt-api, which migrates the VMI instead
+		budget.Blocking = budget.CreatedBy == "user" && budget.DisruptionsAllowed == 0
+		result.PDBs = append(result.PDBs, budget)
+	}
+	for i := range result.PDBs {
+		budget := &result.PDBs[i]
+		for _, name := range budget.VMIs {
+			key := budget.Namespace + "/" + name
+			budgetsByVMI[key] = append(budgetsByVMI[key], budget)
+		}
+	}
+
+	nodes := map[string]*NodeDrainPosture{}
+	for _, vmi := range vmis.Items {
+		if params.Node != "" && vmi.Status.NodeName != params.Node {
+			continue
+		}
+		if vmi.Status.Phase != "Running" && vmi.Status.Phase != "Scheduled" {
+			continue
+		}
+		posture := vmiEvictionPosture(vmi, clusterStrategy, budgetsByVMI[vmi.Metadata.Namespace+"/"+vmi.Metadata.Name])
+		result.VMIs = append(result.VMIs, posture)
+
+		node := nodes[posture.Node]
+		if node == nil {
+			node = &NodeDrainPosture{Node: posture.Node}
+			nodes[posture.Node] = node
+		}
+		node.VMIs++
+		switch posture.DrainEffect {
+		case drainMigrate:
+			node.Migrate++
+		case drainShutdown:
+			node.Shutdown++
+		case drainBlock:
+			node.Blocking++
+			result.Blocking++
+		}
+	}
+
+	effects := map[string]int{drainBlock: 0, drainShutdown: 1, drainMigrate: 2}
+	sort.Slice(result.VMIs, func(i, j int) bool {
+		a, b := result.VMIs[i], result.VMIs[j]
+		if effects[a.DrainEffect] != effects[b.DrainEffect] {
+			return effects[a.DrainEffect] < effects[b.DrainEffect]
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	for _, node := range nodes {
+		result.Nodes = append(result.Nodes, *node)
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool {
+		if result.Nodes[i].Blocking != result.Nodes[j].Blocking {
+			return result.Nodes[i].Blocking > result.Nodes[j].Blocking
+		}
+		return result.Nodes[i].Node < result.Nodes[j].Node
+	})
+	sort.Slice(result.PDBs, func(i, j int) bool {
+		if result.PDBs[i].Blocking != result.PDBs[j].Blocking {
+			return result.PDBs[i].Blocking
+		}
+		if result.PDBs[i].Namespace != result.PDBs[j].Namespace {
+			return result.PDBs[i].Namespace < result.PDBs[j].Namespace
+		}
+		return result.PDBs[i].Name < result.PDBs[j].Name
+	})
+
+	if result.Blocking > 0 {
+		result.Notes = append(result.Notes, "kubectl drain retries the evictions of blocking VMIs until it times out; migrate or stop them, fix what keeps them from migrating, or relax their eviction strategy with vm_eviction_strategy")
+	}
+	return result, nil
+}
+
+// vmiEvictionPosture decides what draining the node of a VMI does to it
+func vmiEvictionPosture(vmi evictionVMI, clusterStrategy string, budgets []*DisruptionBudget) VMIEvictionPosture {
+	posture := VMIEvictionPosture{
+		Namespace:        vmi.Metadata.Namespace,
+		Name:             vmi.Metadata.Name,
+		Node:             vmi.Status.NodeName,
+		EvictionStrategy: vmi.Spec.EvictionStrategy,
+		StrategySource:   "vmi",
+		LiveMigratable:   conditionStatus(vmi.Status.Conditions, "LiveMigratable"),
+	}
+	if posture.EvictionStrategy == "" {
+		posture.EvictionStrategy = clusterStrategy
+		posture.StrategySource = "cluster"
+	}
+	notMigratable := "not live migratable"
+	for _, cond := range vmi.Status.Conditions {
+		if cond.Type == "LiveMigratable" && cond.Status == "False" {
+			notMigratable = strings.TrimSpace(fmt.Sprintf("not live migratable: %s %s", cond.Reason, cond.Message))
+		}
+	}
+	migratable := posture.LiveMigratable != "False"
+
+	switch posture.EvictionStrategy {
+	case evictionLiveMigrate:
+		if migratable {
+			posture.DrainEffect = drainMigrate
+		} else {
+			posture.DrainEffect = drainBlock
+			posture.Reasons = append(posture.Reasons, "evictionStrategy LiveMigrate but "+notMigratable+", virt-api denies its eviction")
+		}
+	case evictionLiveMigrateIfPossible:
+		if migratable {
+			posture.DrainEffect = drainMigrate
+		} else {
+			posture.DrainEffect = drainShutdown
+			posture.Reasons = append(posture.Reasons, "evictionStrategy LiveMigrateIfPossible and "+notMigratable+", the VMI is shut down")
+		}
+	case evictionExternal:
+		posture.DrainEffect = drainBlock
+		posture.Reasons = append(posture.Reasons, "evictionStrategy External, the eviction is denied and the VMI marked for an external controller to evacuate")
+	default:
+		posture.DrainEffect = drainShutdown
+		posture.Reasons = append(posture.Reasons, "evictionStrategy "+posture.EvictionStrategy+", the VMI is shut down and only comes back if its run strategy restarts it")
+	}
+
+	for _, budget := range budgets {
+		posture.PDBs = append(posture.PDBs, budget.Name)
+		if budget.Blocking {
+			posture.DrainEffect = drainBlock
+			posture.Reasons = append(posture.Reasons, fmt.Sprintf("PodDisruptionBudget %s allows no disruption (%d of %d healthy)", budget.Name, budget.CurrentHealthy, budget.DesiredHealthy))
+		}
+	}
+	if vmi.Status.EvacuationNodeName != "" {
+		posture.Reasons = append(posture.Reasons, "being evacuated from node "+vmi.Status.EvacuationNodeName)
+	}
+	if state := vmi.Status.MigrationState; state != nil && !state.Completed && !state.Failed {
+		posture.Reasons = append(posture.Reasons, "a migration is in progress")
+	}
+	return posture
+}
+
+// intOrString formats an int-or-string field such as minAvailable
+func intOrString(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// handleEvictionStrategy is the tools/call handler for vm_eviction_strategy
+func handleEvictionStrategy(ctx context.Context, args json.RawMessage) (string, error) {
+	var params EvictionStrategyParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if len(params.VMNames) == 0 {
+		return "", missingArgument("vm_names")
+	}
+	if params.Strategy == "" {
+		return "", missingArgument("strategy")
+	}
+	switch params.Strategy {
+	case evictionLiveMigrateIfPossible, evictionNone, evictionLiveMigrate, evictionExternal, evictionClusterDefault:
+	default:
+		return "", &invalidParamsError{err: fmt.Errorf("unknown strategy %q", params.Strategy)}
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := setEvictionStrategy(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// setEvictionStrategy patches the eviction strategy of the VM templates, or
+// previews the change without confirm
+func setEvictionStrategy(ctx context.Context, params EvictionStrategyParams) (*EvictionStrategyResult, error) {
+	result := &EvictionStrategyResult{Namespace: params.Namespace, Strategy: params.Strategy, Confirmed: params.Confirm, VMs: []EvictionStrategyChange{}}
+	clusterStrategy, _ := clusterEvictionStrategy(ctx)
+
+	var value interface{} = params.Strategy
+	if params.Strategy == evictionClusterDefault {
+		value = nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{"evictionStrategy": value}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode patch: %v", err)
+	}
+
+	for _, name := range params.VMNames {
+		change := EvictionStrategyChange{Name: name}
+		var vm struct {
+			Spec struct {
+				Template struct {
+					Spec struct {
+						EvictionStrategy string `json:"evictionStrategy,omitempty"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", name, "-n", params.Namespace); err != nil {
+			change.Error = err.Error()
+			result.VMs = append(result.VMs, change)
+			continue
+		}
+		current := vm.Spec.Template.Spec.EvictionStrategy
+		change.From = evictionStrategyLabel(current, clusterStrategy)
+		target := params.Strategy
+		if target == evictionClusterDefault {
+			target = ""
+		}
+		change.To = evictionStrategyLabel(target, clusterStrategy)
+		change.Changed = current != target
+		if !change.Changed || !params.Confirm {
+			result.VMs = append(result.VMs, change)
+			continue
+		}
+
+		diff, err := mutationDiff(ctx, "virtualmachine", name, params.Namespace, func() error {
+			_, err := runKubectl(ctx, "patch", "virtualmachine", name, "-n", params.Namespace, "--type=merge", "-p", string(patch))
+			return err
+		})
+		if err != nil {
+			change.Error = err.Error()
+			result.VMs = append(result.VMs, change)
+			continue
+		}
+		logMessage(LogInfo, "eviction", "Set eviction strategy of %s/%s to %s", params.Namespace, name, change.To)
+		change.Applied = true
+		change.Diff = diff
+
+		var updated VirtualMachine
+		if err := runKubectlJSON(ctx, &updated, "get", "virtualmachine", name, "-n", params.Namespace); err == nil {
+			change.RestartRequired = conditionStatus(updated.Status.Conditions, "RestartRequired") == "True"
+		}
+		result.VMs = append(result.VMs, change)
+	}
+
+	if !params.Confirm {
+		result.Note = "Preview only, set confirm to true to patch the VMs"
+	} else {
+		result.Note = "Running VMIs of VMs with restartRequired keep their eviction strategy until the VM is restarted; check the result with vm_eviction_report"
+	}
+	return result, nil
+}
+
+// evictionStrategyLabel describes the strategy a VM sets, or the cluster
+// strategy it falls back to
+func evictionStrategyLabel(strategy, clusterStrategy string) string {
+	if strategy == "" {
+		return clusterStrategy + " (cluster)"
+	}
+	return strategy
+}
+
+// tables renders the nodes, the VMIs and the disruption budgets
+func (r *EvictionReportResult) tables() []table {
+	title := "Node drain posture"
+	if r.Node != "" {
+		title += " of " + r.Node
+	}
+	nodes := table{title: fmt.Sprintf("%s (cluster evictionStrategy %s, %d blocking)", title, r.ClusterStrategy, r.Blocking), headers: []string{"NODE", "VMIS", "MIGRATE", "SHUTDOWN", "BLOCKING"}}
+	for _, n := range r.Nodes {
+		nodes.rows = append(nodes.rows, []string{n.Node, strconv.Itoa(n.VMIs), strconv.Itoa(n.Migrate), strconv.Itoa(n.Shutdown), strconv.Itoa(n.Blocking)})
+	}
+
+	vmis := table{title: "VMIs", headers: []string{"NAMESPACE", "NAME", "NODE", "STRATEGY", "MIGRATABLE", "DRAIN", "PDBS", "REASONS"}}
+	for _, v := range r.VMIs {
+		strategy := v.EvictionStrategy
+		if v.StrategySource == "cluster" {
+			strategy += " (cluster)"
+		}
+		vmis.rows = append(vmis.rows, []string{v.Namespace, v.Name, v.Node, strategy, v.LiveMigratable, v.DrainEffect, strings.Join(v.PDBs, ","), strings.Join(v.Reasons, "; ")})
+	}
+
+	pdbs := table{title: "PodDisruptionBudgets", headers: []string{"NAMESPACE", "NAME", "CREATED BY", "MIN AVAILABLE", "MAX UNAVAILABLE", "HEALTHY", "ALLOWED", "VMIS", "BLOCKING"}}
+	for _, p := range r.PDBs {
+		pdbs.rows = append(pdbs.rows, []string{p.Namespace, p.Name, p.CreatedBy, p.MinAvailable, p.MaxUnavailable, fmt.Sprintf("%d/%d", p.CurrentHealthy, p.DesiredHealthy), strconv.Itoa(p.DisruptionsAllowed), strings.Join(p.VMIs, ","), strconv.FormatBool(p.Blocking)})
+	}
+	tables := []table{nodes, vmis, pdbs}
+	if len(r.Notes) > 0 {
+		notes := table{title: "Notes", headers: []string{"NOTE"}}
+		for _, note := range r.Notes {
+			notes.rows = append(notes.rows, []string{note})
+		}
+		tables = append(tables, notes)
+	}
+	return tables
+}
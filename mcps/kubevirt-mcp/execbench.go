@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exec methods compared by vm_exec_benchmark. console and agent are the
+// vm-exec methods, ssh runs virtctl ssh with the key of vm_ssh_bootstrap.
+const (
+	execMethodConsole = "console"
+	execMethodAgent   = "agent"
+	execMethodSSH     = "ssh"
+
+	defaultBenchIterations   = 5
+	maxBenchIterations       = 50
+	defaultBenchPayloadBytes = 16384
+)
+
+var execMethods = []string{execMethodConsole, execMethodAgent, execMethodSSH}
+
+// ExecBenchmarkParams represents the parameters of vm_exec_benchmark
+type ExecBenchmarkParams struct {
+	Namespace    string   `json:"namespace,omitempty"`
+	VMName       string   `json:"vm_name"`
+	Methods      []string `json:"methods,omitempty"`
+	Iterations   int      `json:"iterations,omitempty"`
+	PayloadBytes *int     `json:"payload_bytes,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	Password     string   `json:"password,omitempty"`
+	Format       string   `json:"format,omitempty"`
+}
+
+// ExecMethodBenchmark is the latency and throughput of one exec method
+type ExecMethodBenchmark struct {
+	Method         string  `json:"method"`
+	Iterations     int     `json:"iterations"`
+	Errors         int     `json:"errors"`
+	P50Ms          float64 `json:"p50Ms,omitempty"`
+	P90Ms          float64 `json:"p90Ms,omitempty"`
+	MaxMs          float64 `json:"maxMs,omitempty"`
+	PayloadBytes   int     `json:"payloadBytes,omitempty"`
+	ThroughputKBps float64 `json:"throughputKBps,omitempty"`
+	Skipped        string  `json:"skipped,omitempty"`
+	LastError      string  `json:"lastError,omitempty"`
+}
+
+// ExecBenchmarkResult is the vm_exec_benchmark tool result
+type ExecBenchmarkResult struct {
+	Namespace      string                `json:"namespace"`
+	VMName         string                `json:"vmName"`
+	Methods        []ExecMethodBenchmark `json:"methods"`
+	Recommendation string                `json:"recommendation"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_exec_benchmark",
+		Description: "Measure the latency and output throughput of the exec methods (serial console, guest agent and ssh) against a VM and recommend the one to prefer. ssh needs virtctl and a key from vm_ssh_bootstrap",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"methods": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string", "enum": execMethods},
+					"description": "Exec methods to compare (default: all)",
+				},
+				"iterations": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("Number of commands timed per method, at most %d", maxBenchIterations),
+					"default":     defaultBenchIterations,
+				},
+				"payload_bytes": map[string]interface{}{
+					"type":        "integer",
+					"description": "Size of the output transferred once per method to measure throughput, 0 to skip",
+					"default":     defaultBenchPayloadBytes,
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleExecBenchmark,
+	})
+}
+
+// handleExecBenchmark is the tools/call handler for vm_exec_benchmark
+func handleExecBenchmark(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ExecBenchmarkParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if len(params.Methods) == 0 {
+		params.Methods = execMethods
+	}
+	for _, method := range params.Methods {
+		if !containsString(execMethods, method) {
+			return "", &invalidParamsError{err: fmt.Errorf("unsupported method %s", method)}
+		}
+	}
+	if params.Iterations == 0 {
+		params.Iterations = defaultBenchIterations
+	}
+	if params.Iterations < 1 || params.Iterations > maxBenchIterations {
+		return "", &invalidParamsError{err: fmt.Errorf("iterations must be between 1 and %d", maxBenchIterations)}
+	}
+	if params.PayloadBytes == nil {
+		payloadBytes := defaultBenchPayloadBytes
+		params.PayloadBytes = &payloadBytes
+	}
+
+	result := benchmarkExecMethods(ctx, params)
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// benchmarkExecMethods times each method in turn, so they do not compete for
+// the VM
+func benchmarkExecMethods(ctx context.Context, params ExecBenchmarkParams) *ExecBenchmarkResult {
+	result := &ExecBenchmarkResult{Namespace: params.Namespace, VMName: params.VMName}
+	for _, method := range params.Methods {
+		reportProgress(ctx, "benchmarking %s exec", method)
+		result.Methods = append(result.Methods, benchmarkExecMethod(ctx, params, method))
+	}
+	result.Recommendation = recommendExecMethod(result.Methods)
+	return result
+}
+
+// benchmarkExecMethod runs a no-op command iterations times to measure the
+// round trip of a method, then transfers the payload once
+func benchmarkExecMethod(ctx context.Context, params ExecBenchmarkParams, method string) ExecMethodBenchmark {
+	bench := ExecMethodBenchmark{Method: method, Iterations: params.Iterations}
+	if reason := execMethodUnavailable(params.Namespace, params.VMName, method); reason != "" {
+		bench.Skipped = reason
+		return bench
+	}
+
+	var latencies []time.Duration
+	for i := 0; i < params.Iterations && ctx.Err() == nil; i++ {
+		start := time.Now()
+		if _, err := execWithMethod(ctx, params, method, "true"); err != nil {
+			bench.Errors++
+			bench.LastError = err.Error()
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		bench.P50Ms = milliseconds(percentile(latencies, 50))
+		bench.P90Ms = milliseconds(percentile(latencies, 90))
+		bench.MaxMs = milliseconds(latencies[len(latencies)-1])
+	}
+
+	if *params.PayloadBytes <= 0 || len(latencies) == 0 || ctx.Err() != nil {
+		return bench
+	}
+	start := time.Now()
+	output, err := execWithMethod(ctx, params, method, payloadCommand(*params.PayloadBytes))
+	elapsed := time.Since(start)
+	if err == nil && strings.Count(output, "x") < *params.PayloadBytes {
+		err = fmt.Errorf("payload truncated to %d of %d bytes", strings.Count(output, "x"), *params.PayloadBytes)
+	}
+	if err != nil {
+		bench.Errors++
+		bench.LastError = err.Error()
+		return bench
+	}
+	bench.PayloadBytes = *params.PayloadBytes
+	bench.ThroughputKBps = float64(int(float64(*params.PayloadBytes)/1024/elapsed.Seconds()*10)) / 10
+	return bench
+}
+
+// payloadCommand prints n bytes in one line, with tools found on busybox
+// guests such as CirrOS as well
+func payloadCommand(n int) string {
+	return fmt.Sprintf(`head -c %d /dev/zero | tr '\000' x`, n)
+}
+
+// execMethodUnavailable returns why a method cannot be benchmarked, empty
+// when it can
+func execMethodUnavailable(namespace, vmName, method string) string {
+	if method != execMethodSSH {
+		return ""
+	}
+	if fixtures == nil {
+		if _, err := exec.LookPath("virtctl"); err != nil {
+			return "virtctl not found in PATH"
+		}
+	}
+	if _, ok := lookupSSHKey(namespace, vmName); !ok {
+		return "no SSH key for the VM, run vm_ssh_bootstrap first"
+	}
+	return ""
+}
+
+// execWithMethod runs a command on the VM with the given method and returns
+// its output
+func execWithMethod(ctx context.Context, params ExecBenchmarkParams, method, command string) (string, error) {
+	if method == execMethodSSH {
+		return runSSHCommand(ctx, params.Namespace, params.VMName, command)
+	}
+	result, err := runGuestCommand(ctx, VMExecParams{
+		Namespace: params.Namespace,
+		VMName:    params.VMName,
+		Command:   command,
+		Method:    method,
+		Username:  params.Username,
+		Password:  params.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.Stdout, nil
+}
+
+// runSSHCommand runs a command over virtctl ssh with the bootstrapped key of
+// the VM
+func runSSHCommand(ctx context.Context, namespace, vmName, command string) (string, error) {
+	key, ok := lookupSSHKey(namespace, vmName)
+	if !ok {
+		return "", errors.New("no SSH key for the VM, run vm_ssh_bootstrap first")
+	}
+	args := append(kubeconfigArgs(ctx), "ssh",
+		"-n", namespace,
+		"-i", key.PrivateKeyPath,
+		"-l", key.User,
+		"--local-ssh-opts=-oStrictHostKeyChecking=no",
+		"--local-ssh-opts=-oUserKnownHostsFile=/dev/null",
+		"-c", command,
+		"vmi/"+vmName,
+	)
+	output, err := commandOutput(ctx, exec.CommandContext(ctx, "virtctl", args...), false)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("virtctl ssh failed: %v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("virtctl ssh failed: %v", err)
+	}
+	return string(output), nil
+}
+
+// recommendExecMethod recommends the method with the lowest median latency
+// among those that never failed, and the fastest one for large outputs when
+// it differs
+func recommendExecMethod(methods []ExecMethodBenchmark) string {
+	var fastest, widest *ExecMethodBenchmark
+	for i := range methods {
+		bench := &methods[i]
+		if bench.Skipped != "" || bench.Errors > 0 {
+			continue
+		}
+		if fastest == nil || bench.P50Ms < fastest.P50Ms {
+			fastest = bench
+		}
+		if bench.ThroughputKBps > 0 && (widest == nil || bench.ThroughputKBps > widest.ThroughputKBps) {
+			widest = bench
+		}
+	}
+	if fastest == nil {
+		return "No exec method succeeded on every call, see lastError"
+	}
+
+	recommendation := fmt.Sprintf("Prefer %s: lowest median latency (%.0fms)", fastest.Method, fastest.P50Ms)
+	if widest != nil && widest != fastest {
+		recommendation += fmt.Sprintf("; use %s for large outputs (%.1f KB/s vs %.1f KB/s)", widest.Method, widest.ThroughputKBps, fastest.ThroughputKBps)
+	}
+	return recommendation
+}
+
+// tables renders the methods and the recommendation as tables
+func (r *ExecBenchmarkResult) tables() []table {
+	methods := table{
+		title:   fmt.Sprintf("Exec methods of %s/%s", r.Namespace, r.VMName),
+		headers: []string{"METHOD", "ITERATIONS", "ERRORS", "P50 MS", "P90 MS", "MAX MS", "KB/S", "NOTE"},
+	}
+	for _, bench := range r.Methods {
+		note := bench.Skipped
+		if note == "" {
+			note = strings.SplitN(bench.LastError, "\n", 2)[0]
+		}
+		methods.rows = append(methods.rows, []string{
+			bench.Method,
+			strconv.Itoa(bench.Iterations),
+			strconv.Itoa(bench.Errors),
+			strconv.FormatFloat(bench.P50Ms, 'f', 1, 64),
+			strconv.FormatFloat(bench.P90Ms, 'f', 1, 64),
+			strconv.FormatFloat(bench.MaxMs, 'f', 1, 64),
+			strconv.FormatFloat(bench.ThroughputKBps, 'f', 1, 64),
+			note,
+		})
+	}
+	recommendation := table{title: "Recommendation", headers: []string{"RECOMMENDATION"}, rows: [][]string{{r.Recommendation}}}
+	return []table{methods, recommendation}
+}
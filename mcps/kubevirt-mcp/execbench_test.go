@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// benchVMEnv selects the VM the exec benchmarks run against, as
+// namespace/name, e.g. on a kubevirtci cluster:
+//
+//	KUBEVIRT_MCP_BENCH_VM=default/cirros go test -run '^$' -bench Exec
+const benchVMEnv = "KUBEVIRT_MCP_BENCH_VM"
+
+// benchVM returns the parameters of the benchmarked VM, skipping the
+// benchmark when none is configured or the method is not available
+func benchVM(b *testing.B, method string) ExecBenchmarkParams {
+	vm := os.Getenv(benchVMEnv)
+	if vm == "" {
+		b.Skipf("%s is not set", benchVMEnv)
+	}
+	params := ExecBenchmarkParams{Namespace: "default", VMName: vm}
+	if namespace, name, ok := strings.Cut(vm, "/"); ok {
+		params.Namespace, params.VMName = namespace, name
+	}
+	if reason := execMethodUnavailable(params.Namespace, params.VMName, method); reason != "" {
+		b.Skip(reason)
+	}
+	return params
+}
+
+// benchmarkExecLatency times the round trip of a no-op command
+func benchmarkExecLatency(b *testing.B, method string) {
+	params := benchVM(b, method)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := execWithMethod(context.Background(), params, method, "true"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkExecThroughput times the transfer of a large command output
+func benchmarkExecThroughput(b *testing.B, method string) {
+	params := benchVM(b, method)
+	command := payloadCommand(defaultBenchPayloadBytes)
+	b.SetBytes(defaultBenchPayloadBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		output, err := execWithMethod(context.Background(), params, method, command)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if strings.Count(output, "x") < defaultBenchPayloadBytes {
+			b.Fatalf("payload truncated to %d bytes", strings.Count(output, "x"))
+		}
+	}
+}
+
+func BenchmarkExecConsoleLatency(b *testing.B)    { benchmarkExecLatency(b, execMethodConsole) }
+func BenchmarkExecAgentLatency(b *testing.B)      { benchmarkExecLatency(b, execMethodAgent) }
+func BenchmarkExecSSHLatency(b *testing.B)        { benchmarkExecLatency(b, execMethodSSH) }
+func BenchmarkExecConsoleThroughput(b *testing.B) { benchmarkExecThroughput(b, execMethodConsole) }
+func BenchmarkExecAgentThroughput(b *testing.B)   { benchmarkExecThroughput(b, execMethodAgent) }
+func BenchmarkExecSSHThroughput(b *testing.B)     { benchmarkExecThroughput(b, execMethodSSH) }
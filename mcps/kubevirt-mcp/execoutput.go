@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Environment variables configuring the size of vm_exec results, see
+// OutputConfig
+const (
+	outputMaxSizeEnv      = "KUBEVIRT_MCP_OUTPUT_MAX_SIZE"
+	outputCaptureLimitEnv = "KUBEVIRT_MCP_OUTPUT_CAPTURE_LIMIT"
+	outputDirEnv          = "KUBEVIRT_MCP_OUTPUT_DIR"
+	outputRetentionEnv    = "KUBEVIRT_MCP_OUTPUT_RETENTION"
+
+	defaultOutputMaxSize      = 64 * 1024
+	defaultOutputCaptureLimit = 16 * 1024 * 1024
+	defaultOutputRetention    = time.Hour
+
+	// outputPagePrefix starts the names of the files kept for paging, they
+	// are deleted after the retention. Files asked for with output_file are
+	// kept.
+	outputPagePrefix = "page-"
+)
+
+// outputFileRegex matches the names of the output files a continue token
+// may refer to
+var outputFileRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// VMExecPage is the vm_exec result of a continue token, the next page of
+// the output of a command
+type VMExecPage struct {
+	Output   string `json:"output"`
+	Offset   int    `json:"offset"`
+	Bytes    int    `json:"bytes"`
+	Continue string `json:"continue,omitempty"`
+}
+
+// outputDir returns the directory of the output kept for paging and
+// output_file
+func outputDir() string {
+	if dir := serverConfig.Output.Dir; dir != "" {
+		return expandHome(dir)
+	}
+	return filepath.Join(stateDir(), "output")
+}
+
+// outputMaxSize returns the bytes of each stream returned at once, 0 for no
+// limit
+func outputMaxSize(params VMExecParams) int {
+	if params.MaxOutput > 0 {
+		return params.MaxOutput
+	}
+	return serverConfig.Output.MaxSize
+}
+
+// limitVMExecOutput cuts the stdout and stderr of the vm-exec JSON document
+// to the page size, keeping the rest in a file the continue tokens read on,
+// and writes them to files the client can open with output_file
+func limitVMExecOutput(params VMExecParams, output string) (string, error) {
+	maxSize := outputMaxSize(params)
+	if maxSize <= 0 && !params.OutputFile {
+		return output, nil
+	}
+
+	var results []VMExecResult
+	batch := strings.HasPrefix(strings.TrimSpace(output), "[")
+	if batch {
+		if err := json.Unmarshal([]byte(output), &results); err != nil {
+			return "", fmt.Errorf("failed to parse vm-exec output: %v", err)
+		}
+	} else {
+		var result VMExecResult
+		if err := json.Unmarshal([]byte(output), &result); err != nil {
+			return "", fmt.Errorf("failed to parse vm-exec output: %v", err)
+		}
+		results = []VMExecResult{result}
+	}
+
+	changed := false
+	for i := range results {
+		result := &results[i]
+		prefix := fmt.Sprintf("%s-%s", params.Namespace, params.VMName)
+		if batch {
+			prefix += fmt.Sprintf("-%d", i+1)
+		}
+		stdout, err := keepOutput(result.Stdout, prefix+".stdout", maxSize, params.OutputFile)
+		if err != nil {
+			return "", err
+		}
+		stderr, err := keepOutput(result.Stderr, prefix+".stderr", maxSize, params.OutputFile && result.Stderr != "")
+		if err != nil {
+			return "", err
+		}
+		if stdout.cut || stderr.cut || stdout.path != "" || stderr.path != "" {
+			changed = true
+		}
+		result.Stdout, result.OutputFile, result.Continue = stdout.text, stdout.path, stdout.token
+		result.Stderr, result.StderrFile, result.StderrContinue = stderr.text, stderr.path, stderr.token
+		if stdout.cut {
+			result.Truncated, result.StdoutBytes = true, stdout.size
+		}
+		if stderr.cut {
+			result.Truncated, result.StderrBytes = true, stderr.size
+		}
+	}
+	if !changed {
+		return output, nil
+	}
+
+	var document interface{} = results[0]
+	if batch {
+		document = results
+	}
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// keptOutput is a stream of a command once limitVMExecOutput handled it
+type keptOutput struct {
+	text  string
+	size  int
+	cut   bool
+	path  string
+	token string
+}
+
+// keepOutput returns the first page of a stream, writing it whole to a
+// kept file with keep or to a page file when it does not fit in one page
+func keepOutput(text, name string, maxSize int, keep bool) (keptOutput, error) {
+	kept := keptOutput{text: text, size: len(text)}
+	cut := maxSize > 0 && len(text) > maxSize
+	if !cut && !keep {
+		return kept, nil
+	}
+
+	// Random suffixes keep the files of other clients out of reach of
+	// guessed continue tokens
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	fileName := fmt.Sprintf("%s-%s-%s", clock.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix), name)
+	if !keep {
+		fileName = outputPagePrefix + fileName
+	}
+	path, err := writeOutputFile(fileName, text)
+	if err != nil {
+		return kept, err
+	}
+	if keep {
+		kept.path = path
+	}
+	if cut {
+		kept.cut = true
+		kept.text, kept.token = outputPage(text, fileName, 0, maxSize)
+	}
+	return kept, nil
+}
+
+// writeOutputFile writes output to the output directory, first deleting the
+// page files past the retention
+func writeOutputFile(fileName, output string) (string, error) {
+	dir := outputDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %v", err)
+	}
+	sweepOutputPages(dir)
+	path := filepath.Join(dir, fileName)
+	if err := os.WriteFile(path, []byte(output), 0600); err != nil {
+		return "", fmt.Errorf("failed to keep the output: %v", err)
+	}
+	return path, nil
+}
+
+// sweepOutputPages deletes the page files older than the retention
+func sweepOutputPages(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	expired := clock.Now().Add(-serverConfig.Output.Retention)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), outputPagePrefix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(expired) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// outputPage returns the page of output starting at offset, ending on a
+// character boundary with a marker, and the token of the next page when
+// there is one
+func outputPage(output, fileName string, offset, maxSize int) (string, string) {
+	end := len(output)
+	if maxSize > 0 && end-offset > maxSize {
+		end = offset + maxSize
+		for end > offset && !utf8.RuneStart(output[end]) {
+			end--
+		}
+	}
+	page := output[offset:end]
+	if end == len(output) {
+		return page, ""
+	}
+	marker := fmt.Sprintf("\n... output truncated, bytes %d-%d of %d shown, call vm_exec with continue to read on ...\n", offset, end, len(output))
+	return page + marker, encodeContinueToken(fileName, end)
+}
+
+// encodeContinueToken returns the token of the page at offset of a file
+func encodeContinueToken(fileName string, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fileName + ":" + strconv.Itoa(offset)))
+}
+
+// decodeContinueToken returns the file and offset of a continue token
+func decodeContinueToken(token string) (string, int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", 0, errors.New("invalid continue token")
+	}
+	fileName, offset, ok := strings.Cut(string(data), ":")
+	position, err := strconv.Atoi(offset)
+	if !ok || err != nil || position < 0 || !outputFileRegex.MatchString(fileName) {
+		return "", 0, errors.New("invalid continue token")
+	}
+	return fileName, position, nil
+}
+
+// continueVMExecOutput returns the page of kept output a continue token
+// points to
+func continueVMExecOutput(params VMExecParams) (string, error) {
+	fileName, offset, err := decodeContinueToken(params.Continue)
+	if err != nil {
+		return "", &invalidParamsError{err: err}
+	}
+	data, err := os.ReadFile(filepath.Join(outputDir(), fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", &invalidParamsError{err: fmt.Errorf("the output of the continue token is gone, it is kept for %v", serverConfig.Output.Retention)}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the kept output: %v", err)
+	}
+	if offset > len(data) {
+		return "", &invalidParamsError{err: errors.New("invalid continue token")}
+	}
+
+	page := VMExecPage{Offset: offset, Bytes: len(data)}
+	page.Output, page.Continue = outputPage(string(data), fileName, offset, outputMaxSize(params))
+	return formatJSON(page)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// execNamespacesEnv restricts the guest access tools to namespaces, like
+	// exec.namespaces in the configuration file and the --exec-namespaces flag
+	execNamespacesEnv = "KUBEVIRT_MCP_EXEC_NAMESPACES"
+	// execCredentialsDirEnv is the directory of the credentials files the
+	// guest access tools may name, like exec.credentialsDir and the
+	// --exec-credentials-dir flag
+	execCredentialsDirEnv = "KUBEVIRT_MCP_EXEC_CREDENTIALS_DIR"
+)
+
+// defaultExecDeny are the destructive guest commands refused unless the
+// configuration file sets its own exec.deny patterns
+var defaultExecDeny = []string{
+	// rm of the root directory or all of its entries
+	`\brm\s+(-{1,2}\S+\s+)*/\*?(\s|;|&|\||$)`,
+	`\bmkfs(\.\w+)?\b`,
+	`\bdd\b.*\bof=/dev/(sd|vd|hd|xvd|nvme|mmcblk|dm-|mapper/)`,
+	`>\s*/dev/(sd|vd|hd|xvd|nvme|mmcblk|dm-|mapper/)`,
+	`\b(wipefs|shred|blkdiscard)\b.*/dev/`,
+	// rm of all entries after changing to the root directory, also the
+	// cwd of vm_exec
+	`\bcd\s+'?/'?\s*(;|&&|\|\|).*\brm\s+(-{1,2}\S+\s+)*\*`,
+	// fork bomb
+	`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`,
+}
+
+// defaultExecConfirm are the guest commands run only with confirm set to
+// true unless the configuration file sets its own exec.confirm patterns
+var defaultExecConfirm = []string{
+	`\b(shutdown|poweroff|reboot|halt)\b`,
+	`\binit\s+[06]\b`,
+}
+
+// execGuardedTools are the tools giving access to guests, restricted to
+// the namespaces of the exec policy. The commands they take, if any, are
+// checked against the deny and confirm patterns.
+var execGuardedTools = map[string]bool{
+	"vm_exec":                 true,
+	"vm_exec_benchmark":       true,
+	"vm_console_open":         true,
+	"vm_console_send":         true,
+	"vm_file_put":             true,
+	"vm_file_get":             true,
+	"vm_ssh_bootstrap":        true,
+	"vm_clock_drift":          true,
+	"vm_wait_ready":           true,
+	"vm_boot_time":            true,
+	"vmi_migration_benchmark": true,
+	"vmi_migration_ping":      true,
+}
+
+// execCommandTools are the guarded tools taking commands. The text of
+// vm_console_send is not checked: a raw console can type a command in
+// pieces, with keys or from the shell history, so console sessions are only
+// held to the namespaces.
+var execCommandTools = map[string]bool{
+	"vm_exec": true,
+}
+
+// execPattern is a compiled deny or confirm pattern
+type execPattern struct {
+	source string
+	regex  *regexp.Regexp
+}
+
+// execPolicy holds the compiled patterns of the exec policy
+var execPolicy struct {
+	deny    []execPattern
+	confirm []execPattern
+}
+
+// startExecPolicy compiles the patterns of the exec policy, so an invalid
+// pattern stops the server instead of letting commands through
+func startExecPolicy() error {
+	config := serverConfig.Exec
+	var err error
+	if execPolicy.deny, err = compileExecPatterns("deny", config.Deny); err != nil {
+		return err
+	}
+	if execPolicy.confirm, err = compileExecPatterns("confirm", config.Confirm); err != nil {
+		return err
+	}
+	if len(config.Namespaces) > 0 {
+		logMessage(LogInfo, "exec-policy", "Guest access restricted to the namespaces %s", strings.Join(config.Namespaces, ", "))
+	}
+	return nil
+}
+
+func compileExecPatterns(kind string, patterns []string) ([]execPattern, error) {
+	compiled := make([]execPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exec %s pattern %q: %v", kind, pattern, err)
+		}
+		compiled = append(compiled, execPattern{source: pattern, regex: regex})
+	}
+	return compiled, nil
+}
+
+// matchExecPattern returns the first pattern matching a command
+func matchExecPattern(patterns []execPattern, command string) (string, bool) {
+	for _, pattern := range patterns {
+		if pattern.regex.MatchString(command) {
+			return pattern.source, true
+		}
+	}
+	return "", false
+}
+
+// checkExecPolicy applies the exec policy to a call of a guest access tool:
+// the namespace must be allowed, no command may match a deny pattern, and
+// commands matching a confirm pattern need confirm set to true. Commands
+// are the command and commands of vm_exec, as they run with its cwd, env
+// and run_as.
+func checkExecPolicy(tool Tool, args json.RawMessage) error {
+	if !execGuardedTools[tool.Name] {
+		return nil
+	}
+	var params struct {
+		Namespace string            `json:"namespace"`
+		SessionID string            `json:"session_id"`
+		Continue  string            `json:"continue"`
+		Command   string            `json:"command"`
+		Commands  []string          `json:"commands"`
+		Cwd       string            `json:"cwd"`
+		Env       map[string]string `json:"env"`
+		RunAs     string            `json:"run_as"`
+		Confirm   bool              `json:"confirm"`
+
+		CredentialsFile string `json:"credentials_file"`
+	}
+	if len(args) > 0 {
+		json.Unmarshal(args, &params)
+	}
+
+	// Sessions and output pages were checked when they were opened
+	if namespaces := serverConfig.Exec.Namespaces; len(namespaces) > 0 && params.SessionID == "" && params.Continue == "" {
+		namespace := params.Namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		if !matchesAny(namespaces, namespace) {
+			logMessage(LogWarning, "exec-policy", "Denied %s in namespace %s", tool.Name, namespace)
+			return &accessDeniedError{err: fmt.Errorf("%s is not allowed in namespace %s, guest access is limited to %s", tool.Name, namespace, strings.Join(namespaces, ", "))}
+		}
+	}
+	if _, err := credentialsFilePath(params.CredentialsFile); err != nil {
+		return err
+	}
+
+	var commands []string
+	if execCommandTools[tool.Name] {
+		for _, command := range append([]string{params.Command}, params.Commands...) {
+			if command != "" {
+				commands = append(commands, runContextCommands(command, params.Cwd, params.Env, params.RunAs)...)
+			}
+		}
+	}
+	for _, command := range commands {
+		if pattern, ok := matchExecPattern(execPolicy.deny, command); ok {
+			logMessage(LogWarning, "exec-policy", "Denied %s of %q matching %s", tool.Name, command, pattern)
+			return &accessDeniedError{err: fmt.Errorf("command %q is refused by the exec policy, it matches %s", command, pattern)}
+		}
+	}
+	if params.Confirm {
+		return nil
+	}
+	for _, command := range commands {
+		if pattern, ok := matchExecPattern(execPolicy.confirm, command); ok {
+			return &invalidParamsError{err: fmt.Errorf("command %q matches %s and requires confirmation, call again with confirm set to true after checking with the user", command, pattern)}
+		}
+	}
+	return nil
+}
+
+// credentialsFilePath returns the path of the credentials_file of a guest
+// access tool, "" when none is given. vm-exec reads the file on the server,
+// so clients only name files of the credentials directory.
+func credentialsFilePath(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	dir := serverConfig.Exec.CredentialsDir
+	if dir == "" {
+		return "", &invalidParamsError{err: fmt.Errorf("credentials_file is not available, the server has no credentials directory (exec.credentialsDir)")}
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid credentials_file '%s', it must name a file of the credentials directory", name)}
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// runContextCommands returns a command the way vm-exec runs it with the cwd,
+// env and run_as of vm_exec, so the patterns see the directory and user
+// changes too. With run_as the script sudo runs is returned unquoted as
+// well.
+func runContextCommands(command, cwd string, env map[string]string, runAs string) []string {
+	var script []string
+	if cwd != "" {
+		script = append(script, "cd "+shellQuote(cwd)+" || exit 1")
+	}
+	for _, name := range sortedKeys(env) {
+		script = append(script, "export "+name+"="+shellQuote(env[name]))
+	}
+	if len(script) == 0 && runAs == "" {
+		return []string{command}
+	}
+	script = append(script, command)
+	if runAs != "" {
+		inner := strings.Join(script, "; ")
+		return []string{"sudo -n -u " + shellQuote(runAs) + " -- sh -c " + shellQuote(inner), inner}
+	}
+	return []string{"(" + strings.Join(script, "; ") + ")"}
+}
+
+// shellQuote quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// explainCacheTTL is how long a cached OpenAPI document is used without
+	// asking the cluster again. Older documents are still used when the
+	// cluster cannot be reached.
+	explainCacheTTL = time.Hour
+	// maxExplainDepth bounds the fields listed with recursive, and the
+	// references followed in schemas referencing themselves
+	maxExplainDepth = 12
+	// maxExplainNotes is the number of docs excerpts returned
+	maxExplainNotes = 3
+	// maxExplainExcerpt bounds the size of a docs excerpt in bytes
+	maxExplainExcerpt = 800
+)
+
+// explainKind is a resource kubevirt_explain documents
+type explainKind struct {
+	group string
+	kind  string
+}
+
+// explainKinds maps the names, plurals and short names of the KubeVirt and
+// CDI resources to their kind
+var explainKinds = map[string]explainKind{}
+
+func init() {
+	for _, k := range []struct {
+		explainKind
+		names []string
+	}{
+		{explainKind{"kubevirt.io", "VirtualMachine"}, []string{"vm", "vms"}},
+		{explainKind{"kubevirt.io", "VirtualMachineInstance"}, []string{"vmi", "vmis"}},
+		{explainKind{"kubevirt.io", "VirtualMachineInstanceMigration"}, []string{"vmim", "vmims"}},
+		{explainKind{"kubevirt.io", "VirtualMachineInstanceReplicaSet"}, []string{"vmirs", "vmirss"}},
+		{explainKind{"kubevirt.io", "KubeVirt"}, []string{"kv", "kvs"}},
+		{explainKind{"pool.kubevirt.io", "VirtualMachinePool"}, []string{"vmpool", "vmpools"}},
+		{explainKind{"snapshot.kubevirt.io", "VirtualMachineSnapshot"}, []string{"vmsnapshot", "vmsnapshots"}},
+		{explainKind{"snapshot.kubevirt.io", "VirtualMachineRestore"}, []string{"vmrestore", "vmrestores"}},
+		{explainKind{"export.kubevirt.io", "VirtualMachineExport"}, []string{"vmexport", "vmexports"}},
+		{explainKind{"instancetype.kubevirt.io", "VirtualMachineInstancetype"}, []string{"vminstancetype", "instancetype"}},
+		{explainKind{"instancetype.kubevirt.io", "VirtualMachineClusterInstancetype"}, []string{"vmclusterinstancetype", "clusterinstancetype"}},
+		{explainKind{"instancetype.kubevirt.io", "VirtualMachinePreference"}, []string{"vmpref", "vmprefs", "preference"}},
+		{explainKind{"instancetype.kubevirt.io", "VirtualMachineClusterPreference"}, []string{"vmcpref", "vmcprefs", "clusterpreference"}},
+		{explainKind{"migrations.kubevirt.io", "MigrationPolicy"}, []string{"migrationpolicy"}},
+		{explainKind{"cdi.kubevirt.io", "DataVolume"}, []string{"dv", "dvs"}},
+		{explainKind{"cdi.kubevirt.io", "DataSource"}, []string{"das"}},
+		{explainKind{"cdi.kubevirt.io", "DataImportCron"}, []string{"dic", "dics"}},
+		{explainKind{"cdi.kubevirt.io", "CDI"}, nil},
+	} {
+		kind := strings.ToLower(k.kind)
+		explainKinds[kind] = k.explainKind
+		explainKinds[kind+"s"] = k.explainKind
+		for _, name := range k.names {
+			explainKinds[name] = k.explainKind
+		}
+	}
+
+	registerTool(Tool{
+		Name:        "kubevirt_explain",
+		Description: "Explain a field of a KubeVirt or CDI resource, e.g. vm.spec.runStrategy or vmi.spec.domain.cpu.dedicatedCpuPlacement: its type, description, allowed values and sub-fields from the cluster's OpenAPI schema, plus excerpts of the docs folders mentioning it. Schemas are cached in the state directory, so fields are explained offline once fetched",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"field": map[string]interface{}{
+					"type":        "string",
+					"description": "Resource and field path, e.g. vm.spec.template.spec.domain.devices.disks.disk.bus; a resource alone explains its top level fields",
+				},
+				"recursive": map[string]interface{}{
+					"type":        "boolean",
+					"description": "List every field below the field with its type, without descriptions",
+					"default":     false,
+				},
+				"refresh": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Fetch the schema from the cluster even when a recent one is cached, e.g. after a KubeVirt upgrade",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"field"},
+		},
+		Handler: handleExplain,
+	})
+}
+
+// ExplainParams represents the parameters of kubevirt_explain
+type ExplainParams struct {
+	Field     string `json:"field"`
+	Recursive bool   `json:"recursive,omitempty"`
+	Refresh   bool   `json:"refresh,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// ExplainField is a sub-field of the field explained
+type ExplainField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ExplainNote is an excerpt of a document of the docs folders mentioning
+// the field
+type ExplainNote struct {
+	URI     string `json:"uri"`
+	Excerpt string `json:"excerpt"`
+}
+
+// ExplainResult is the kubevirt_explain tool result
+type ExplainResult struct {
+	Kind        string         `json:"kind"`
+	APIVersion  string         `json:"apiVersion"`
+	Field       string         `json:"field"`
+	Type        string         `json:"type"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Enum        []interface{}  `json:"enum,omitempty"`
+	Default     interface{}    `json:"default,omitempty"`
+	Fields      []ExplainField `json:"fields,omitempty"`
+	Notes       []ExplainNote  `json:"notes,omitempty"`
+	// Source is cluster, or cache when a cached schema was used
+	Source   string `json:"source"`
+	CachedAt string `json:"cachedAt,omitempty"`
+}
+
+// openAPISchemas holds the schemas of an OpenAPI v3 group version document
+type openAPISchemas map[string]map[string]interface{}
+
+func handleExplain(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ExplainParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Field == "" {
+		return "", missingArgument("field")
+	}
+
+	segments := strings.Split(strings.Trim(params.Field, "."), ".")
+	kind, ok := explainKinds[strings.ToLower(segments[0])]
+	if !ok {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown resource %q, use a KubeVirt or CDI resource such as vm, vmi, vmim, kubevirt, vmsnapshot, instancetype or dv", segments[0])}
+	}
+	path := make([]string, 0, len(segments)-1)
+	for _, segment := range segments[1:] {
+		// Array fields may be written disks[] or disks[0]
+		if i := strings.IndexByte(segment, '['); i >= 0 {
+			segment = segment[:i]
+		}
+		if segment == "" {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid field path %q", params.Field)}
+		}
+		path = append(path, segment)
+	}
+
+	version, schemas, cachedAt, err := loadOpenAPISchemas(ctx, kind.group, params.Refresh)
+	if err != nil {
+		return "", err
+	}
+	root, ok := kindSchema(schemas, kind, version)
+	if !ok {
+		return "", fmt.Errorf("the OpenAPI schema of %s/%s has no %s", kind.group, version, kind.kind)
+	}
+
+	result := ExplainResult{Kind: kind.kind, APIVersion: kind.group + "/" + version, Field: kind.kind, Source: "cluster"}
+	if !cachedAt.IsZero() {
+		result.Source = "cache"
+		result.CachedAt = cachedAt.UTC().Format(time.RFC3339)
+	}
+
+	schema := schemas.resolve(root)
+	for i, segment := range path {
+		parent := schemas.elements(schema)
+		properties, _ := parent["properties"].(map[string]interface{})
+		child, ok := properties[segment].(map[string]interface{})
+		if !ok {
+			at := strings.Join(append([]string{result.Field}, path[:i]...), ".")
+			return "", &invalidParamsError{err: fmt.Errorf("field %s does not exist in %s, its fields are %s", segment, at, strings.Join(sortedKeys(properties), ", "))}
+		}
+		result.Required = requires(parent, segment)
+		schema = schemas.resolve(child)
+	}
+	if len(path) > 0 {
+		result.Field = kind.kind + "." + strings.Join(path, ".")
+	}
+	result.Type = schemas.typeName(schema)
+	result.Description, _ = schema["description"].(string)
+	result.Enum, _ = schema["enum"].([]interface{})
+	result.Default = schema["default"]
+
+	if params.Recursive {
+		result.Fields = schemas.recursiveFields(schemas.elements(schema), "", 0)
+	} else {
+		result.Fields = schemas.fields(schemas.elements(schema))
+	}
+
+	term := kind.kind
+	parentTerm := ""
+	if len(path) > 0 {
+		term = path[len(path)-1]
+		if len(path) > 1 {
+			parentTerm = path[len(path)-2]
+		}
+	}
+	result.Notes = docsNotes(term, parentTerm)
+
+	return formatResult(params.Format, result, result.tables)
+}
+
+// loadOpenAPISchemas returns the OpenAPI v3 schemas of the preferred version
+// of an API group, from the cache of the state directory when it is recent,
+// else from the cluster. The cache is used whatever its age when the cluster
+// cannot be reached. cachedAt tells when a cached schema was fetched, zero
+// for a schema fetched now.
+func loadOpenAPISchemas(ctx context.Context, group string, refresh bool) (string, openAPISchemas, time.Time, error) {
+	dir := openAPICacheDir(ctx)
+	cachedVersion, cachedPath, cachedAt := cachedOpenAPIDocument(dir, group)
+	if cachedPath != "" && !refresh && clock.Now().Sub(cachedAt) < explainCacheTTL {
+		if schemas, err := readOpenAPISchemas(cachedPath); err == nil {
+			return cachedVersion, schemas, cachedAt, nil
+		}
+	}
+
+	version, document, err := fetchOpenAPIDocument(ctx, group)
+	if err != nil {
+		if cachedPath == "" {
+			return "", nil, time.Time{}, err
+		}
+		logMessage(LogWarning, "explain", "Using the schema of %s/%s cached at %s: %v", group, cachedVersion, cachedAt.Format(time.RFC3339), err)
+		schemas, cacheErr := readOpenAPISchemas(cachedPath)
+		if cacheErr != nil {
+			return "", nil, time.Time{}, err
+		}
+		return cachedVersion, schemas, cachedAt, nil
+	}
+
+	schemas, err := decodeOpenAPISchemas(document)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err == nil {
+		if cachedPath != "" {
+			os.Remove(cachedPath)
+		}
+		os.WriteFile(filepath.Join(dir, group+"_"+version+".json"), document, 0600)
+	}
+	return version, schemas, time.Time{}, nil
+}
+
+// openAPICacheDir returns the directory caching the OpenAPI documents of the
+// cluster of the call
+func openAPICacheDir(ctx context.Context) string {
+	name := "default"
+	if cluster, ok := selectedCluster(ctx); ok {
+		name = cluster.Name
+	}
+	return filepath.Join(stateDir(), "openapi", name)
+}
+
+// cachedOpenAPIDocument returns the version, path and modification time of
+// the cached document of an API group, if any
+func cachedOpenAPIDocument(dir, group string) (string, string, time.Time) {
+	paths, _ := filepath.Glob(filepath.Join(dir, group+"_*.json"))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), group+"_"), ".json")
+		return version, path, info.ModTime()
+	}
+	return "", "", time.Time{}
+}
+
+// fetchOpenAPIDocument fetches the OpenAPI v3 document of the preferred
+// version of an API group served by the cluster
+func fetchOpenAPIDocument(ctx context.Context, group string) (string, []byte, error) {
+	output, err := runKubectl(ctx, "get", "--raw", "/openapi/v3")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch the OpenAPI index: %v", err)
+	}
+	var index struct {
+		Paths map[string]struct {
+			ServerRelativeURL string `json:"serverRelativeURL"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(output, &index); err != nil {
+		return "", nil, fmt.Errorf("failed to parse the OpenAPI index: %v", err)
+	}
+
+	var versions []string
+	for path := range index.Paths {
+		if version, ok := strings.CutPrefix(path, "apis/"+group+"/"); ok && !strings.Contains(version, "/") {
+			versions = append(versions, version)
+		}
+	}
+	if len(versions) == 0 {
+		return "", nil, fmt.Errorf("the cluster does not serve the %s API, is it installed?", group)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versionPriority(versions[i]) > versionPriority(versions[j]) })
+	version := versions[0]
+
+	url := index.Paths["apis/"+group+"/"+version].ServerRelativeURL
+	if url == "" {
+		url = "/openapi/v3/apis/" + group + "/" + version
+	}
+	document, err := runKubectl(ctx, "get", "--raw", url)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch the OpenAPI schema of %s/%s: %v", group, version, err)
+	}
+	return version, document, nil
+}
+
+// apiVersionPattern matches Kubernetes API versions such as v1beta2
+var apiVersionPattern = regexp.MustCompile(`^v(\d+)(?:(alpha|beta)(\d+))?$`)
+
+// versionPriority orders API versions like Kubernetes does: GA versions
+// first, then beta and alpha ones, higher numbers first
+func versionPriority(version string) int {
+	match := apiVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return 0
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[3])
+	stability := map[string]int{"": 3, "beta": 2, "alpha": 1}[match[2]]
+	return stability*1000000 + major*1000 + minor
+}
+
+func readOpenAPISchemas(path string) (openAPISchemas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cached schema: %v", err)
+	}
+	return decodeOpenAPISchemas(data)
+}
+
+func decodeOpenAPISchemas(document []byte) (openAPISchemas, error) {
+	var parsed struct {
+		Components struct {
+			Schemas openAPISchemas `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(document, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse the OpenAPI schema: %v", err)
+	}
+	return parsed.Components.Schemas, nil
+}
+
+// kindSchema returns the schema of a kind, tagged with its group, version and
+// kind by x-kubernetes-group-version-kind
+func kindSchema(schemas openAPISchemas, kind explainKind, version string) (map[string]interface{}, bool) {
+	for _, schema := range schemas {
+		gvks, _ := schema["x-kubernetes-group-version-kind"].([]interface{})
+		for _, gvk := range gvks {
+			gvk, _ := gvk.(map[string]interface{})
+			if gvk["group"] == kind.group && gvk["version"] == version && gvk["kind"] == kind.kind {
+				return schema, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// resolve follows the $ref of a schema, also when wrapped in a single allOf
+// as OpenAPI v3 does to document a reference, keeping the description and
+// default of the referencing schema
+func (s openAPISchemas) resolve(schema map[string]interface{}) map[string]interface{} {
+	for depth := 0; depth < maxExplainDepth; depth++ {
+		target := schema
+		if allOf, ok := schema["allOf"].([]interface{}); ok && len(allOf) == 1 {
+			target, _ = allOf[0].(map[string]interface{})
+		}
+		ref, _ := target["$ref"].(string)
+		if ref == "" {
+			return schema
+		}
+		referenced, ok := s[strings.TrimPrefix(ref, "#/components/schemas/")]
+		if !ok {
+			return schema
+		}
+		merged := make(map[string]interface{}, len(referenced)+2)
+		for k, v := range referenced {
+			merged[k] = v
+		}
+		for _, k := range []string{"description", "default"} {
+			if v, ok := schema[k]; ok {
+				merged[k] = v
+			}
+		}
+		schema = merged
+	}
+	return schema
+}
+
+// elements returns the schema of the elements of arrays, so paths go
+// through list fields like kubectl explain does
+func (s openAPISchemas) elements(schema map[string]interface{}) map[string]interface{} {
+	for depth := 0; depth < maxExplainDepth && schema["type"] == "array"; depth++ {
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		schema = s.resolve(items)
+	}
+	return schema
+}
+
+// typeName returns the type of a schema in the notation of kubectl explain
+func (s openAPISchemas) typeName(schema map[string]interface{}) string {
+	schema = s.resolve(schema)
+	switch schema["type"] {
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		return "[]" + s.typeName(items)
+	case "object":
+		if _, ok := schema["properties"]; !ok {
+			if values, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				return "map[string]" + s.typeName(values)
+			}
+		}
+		return "Object"
+	case nil:
+		if schema["x-kubernetes-int-or-string"] == true {
+			return "IntOrString"
+		}
+		return "Object"
+	}
+	return fmt.Sprint(schema["type"])
+}
+
+// fields returns the properties of a schema with their descriptions
+func (s openAPISchemas) fields(schema map[string]interface{}) []ExplainField {
+	properties, _ := schema["properties"].(map[string]interface{})
+	fields := make([]ExplainField, 0, len(properties))
+	for _, name := range sortedKeys(properties) {
+		property, _ := properties[name].(map[string]interface{})
+		property = s.resolve(property)
+		description, _ := property["description"].(string)
+		fields = append(fields, ExplainField{
+			Name:        name,
+			Type:        s.typeName(property),
+			Required:    requires(schema, name),
+			Description: description,
+		})
+	}
+	return fields
+}
+
+// recursiveFields returns every field below a schema as a dotted path
+func (s openAPISchemas) recursiveFields(schema map[string]interface{}, prefix string, depth int) []ExplainField {
+	var fields []ExplainField
+	properties, _ := schema["properties"].(map[string]interface{})
+	for _, name := range sortedKeys(properties) {
+		property, _ := properties[name].(map[string]interface{})
+		property = s.resolve(property)
+		fields = append(fields, ExplainField{
+			Name:     prefix + name,
+			Type:     s.typeName(property),
+			Required: requires(schema, name),
+		})
+		if depth+1 < maxExplainDepth {
+			fields = append(fields, s.recursiveFields(s.elements(property), prefix+name+".", depth+1)...)
+		}
+	}
+	return fields
+}
+
+// docsNotes returns excerpts of the documents of the docs folders mentioning
+// a field, those also mentioning its parent field first
+func docsNotes(term, parentTerm string) []ExplainNote {
+	pattern, err := regexp.Compile(`\b` + regexp.QuoteMeta(term) + `\b`)
+	if err != nil {
+		return nil
+	}
+	roots := map[string]string{}
+	for _, root := range docsRoots() {
+		roots[root.name] = root.path
+	}
+
+	type match struct {
+		note  ExplainNote
+		score int
+	}
+	var matches []match
+	for _, resource := range docResources() {
+		uri, _ := resource["uri"].(string)
+		rootName, rel, _ := strings.Cut(strings.TrimPrefix(uri, docsScheme), "/")
+		path, err := docPath(roots[rootName], rel)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		text := string(data)
+		found := pattern.FindAllStringIndex(text, -1)
+		if len(found) == 0 {
+			continue
+		}
+		score := len(found)
+		if parentTerm != "" && strings.Contains(text, parentTerm) {
+			score += 10
+		}
+		matches = append(matches, match{note: ExplainNote{URI: uri, Excerpt: docExcerpt(text, found[0][0])}, score: score})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	var notes []ExplainNote
+	for i := 0; i < len(matches) && i < maxExplainNotes; i++ {
+		notes = append(notes, matches[i].note)
+	}
+	return notes
+}
+
+// docExcerpt returns the lines of a document around an offset
+func docExcerpt(text string, offset int) string {
+	lines := strings.Split(text, "\n")
+	line := strings.Count(text[:offset], "\n")
+	start, end := max(line-2, 0), min(line+5, len(lines))
+	excerpt := strings.TrimSpace(strings.Join(lines[start:end], "\n"))
+	if len(excerpt) > maxExplainExcerpt {
+		excerpt = strings.ToValidUTF8(excerpt[:maxExplainExcerpt], "") + "..."
+	}
+	return excerpt
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// requires reports whether a schema lists a property as required
+func requires(schema map[string]interface{}, name string) bool {
+	required, _ := schema["required"].([]interface{})
+	for _, item := range required {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ExplainResult) tables() []table {
+	required := ""
+	if r.Required {
+		required = "yes"
+	}
+	enum := make([]string, 0, len(r.Enum))
+	for _, value := range r.Enum {
+		enum = append(enum, fmt.Sprint(value))
+	}
+	tables := []table{{
+		title:   r.Field,
+		headers: []string{"API Version", "Type", "Required", "Values", "Source", "Description"},
+		rows:    [][]string{{r.APIVersion, r.Type, required, strings.Join(enum, ", "), r.Source, r.Description}},
+	}}
+	if len(r.Fields) > 0 {
+		rows := make([][]string, 0, len(r.Fields))
+		for _, field := range r.Fields {
+			required := ""
+			if field.Required {
+				required = "yes"
+			}
+			rows = append(rows, []string{field.Name, field.Type, required, field.Description})
+		}
+		tables = append(tables, table{title: "Fields", headers: []string{"Name", "Type", "Required", "Description"}, rows: rows})
+	}
+	if len(r.Notes) > 0 {
+		rows := make([][]string, 0, len(r.Notes))
+		for _, note := range r.Notes {
+			rows = append(rows, []string{note.URI, note.Excerpt})
+		}
+		tables = append(tables, table{title: "Docs", headers: []string{"Document", "Excerpt"}, rows: rows})
+	}
+	return tables
+}
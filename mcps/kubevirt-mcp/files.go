@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"unicode/utf8"
+)
+
+const (
+	fileEncodingText   = "text"
+	fileEncodingBase64 = "base64"
+)
+
+// FileTransferParams represents the parameters for the vm_file_put and vm_file_get tools
+type FileTransferParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Path      string `json:"path"`
+	Content   string `json:"content,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Mode      string `json:"mode,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+	Method    string `json:"method,omitempty"`
+
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+}
+
+// FileGetResult is the vm_file_get tool result
+type FileGetResult struct {
+	Path     string `json:"path"`
+	Size     int    `json:"size"`
+	Encoding string `json:"encoding"`
+	Content  string `json:"content"`
+}
+
+func init() {
+	connectionProperties := func() map[string]interface{} {
+		return map[string]interface{}{
+			"namespace": map[string]interface{}{
+				"type":        "string",
+				"description": "Kubernetes namespace containing the VM",
+				"default":     "default",
+			},
+			"vm_name": map[string]interface{}{
+				"type":        "string",
+				"description": "Name of the VM or VMI",
+			},
+			"path": map[string]interface{}{
+				"type":        "string",
+				"description": "Absolute path of the file inside the guest",
+			},
+			"timeout": map[string]interface{}{
+				"type":        "integer",
+				"description": "Timeout in seconds (default: 60)",
+				"default":     60,
+			},
+			"method": map[string]interface{}{
+				"type":        "string",
+				"description": "Transfer method: auto uses guest agent file operations when connected and base64 over the console otherwise",
+				"enum":        []string{"auto", "agent", "console"},
+				"default":     "auto",
+			},
+			"username": map[string]interface{}{
+				"type":        "string",
+				"description": "Console login username, overrides the VM type default",
+			},
+			"password": map[string]interface{}{
+				"type":        "string",
+				"description": "Console login password, overrides the VM type default",
+			},
+			"credentials_file": map[string]interface{}{
+				"type":        "string",
+				"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+			},
+		}
+	}
+
+	putProperties := connectionProperties()
+	putProperties["content"] = map[string]interface{}{
+		"type":        "string",
+		"description": "File content, at most 1 MiB",
+	}
+	putProperties["encoding"] = map[string]interface{}{
+		"type":        "string",
+		"description": "Encoding of content",
+		"enum":        []string{fileEncodingText, fileEncodingBase64},
+		"default":     fileEncodingText,
+	}
+	putProperties["mode"] = map[string]interface{}{
+		"type":        "string",
+		"description": "Octal permissions for the file, e.g. 0755",
+	}
+
+	registerTool(Tool{
+		Name:        "vm_file_put",
+		Description: "Write a small file (up to 1 MiB) into a VM using guest agent file operations or base64 chunks over the serial console",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": putProperties,
+			"required":   []string{"vm_name", "path", "content"},
+		},
+		Handler: handleFilePut,
+	})
+
+	getProperties := connectionProperties()
+	getProperties["encoding"] = map[string]interface{}{
+		"type":        "string",
+		"description": "Encoding of the returned content, defaults to text for UTF-8 files and base64 otherwise",
+		"enum":        []string{fileEncodingText, fileEncodingBase64},
+	}
+
+	registerTool(Tool{
+		Name:        "vm_file_get",
+		Description: "Read a small file (up to 1 MiB) from a VM using guest agent file operations or base64 over the serial console",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": getProperties,
+			"required":   []string{"vm_name", "path"},
+		},
+		Handler: handleFileGet,
+	})
+}
+
+// decodeFileTransferParams validates the arguments shared by the file tools
+func decodeFileTransferParams(args json.RawMessage) (FileTransferParams, error) {
+	var params FileTransferParams
+	if err := decodeArguments(args, &params); err != nil {
+		return params, err
+	}
+	if params.VMName == "" {
+		return params, missingArgument("vm_name")
+	}
+	if params.Path == "" {
+		return params, missingArgument("path")
+	}
+	if params.Encoding != "" && params.Encoding != fileEncodingText && params.Encoding != fileEncodingBase64 {
+		return params, &invalidParamsError{err: fmt.Errorf("unsupported encoding '%s'", params.Encoding)}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = 60
+	}
+	return params, nil
+}
+
+// fileTransferArgs returns the vm-exec arguments and environment for a transfer
+func fileTransferArgs(params FileTransferParams) ([]string, []string, error) {
+	return vmExecArgs(VMExecParams{
+		Namespace:       params.Namespace,
+		VMName:          params.VMName,
+		Timeout:         params.Timeout,
+		Method:          params.Method,
+		Username:        params.Username,
+		Password:        params.Password,
+		CredentialsFile: params.CredentialsFile,
+	})
+}
+
+// fileTransferSteps is the number of command timeouts in the deadline of a
+// transfer, like the default deadline of vm-exec
+const fileTransferSteps = 4
+
+// handleFilePut is the tools/call handler for vm_file_put
+func handleFilePut(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeFileTransferParams(args)
+	if err != nil {
+		return "", err
+	}
+
+	data := []byte(params.Content)
+	if params.Encoding == fileEncodingBase64 {
+		data, err = base64.StdEncoding.DecodeString(params.Content)
+		if err != nil {
+			return "", &invalidParamsError{err: fmt.Errorf("content is not valid base64: %v", err)}
+		}
+	}
+
+	localFile, err := os.CreateTemp("", "vm-file-put-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(localFile.Name())
+	_, err = localFile.Write(data)
+	localFile.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write temporary file: %v", err)
+	}
+
+	execArgs, env, err := fileTransferArgs(params)
+	if err != nil {
+		return "", err
+	}
+	execArgs = append(execArgs, "--put-file", params.Path, "--local-file", localFile.Name())
+	if params.Mode != "" {
+		execArgs = append(execArgs, "--file-mode", params.Mode)
+	}
+	if _, err := runVMExec(ctx, vmExecDeadline(params.Timeout, fileTransferSteps), execArgs, env); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Wrote %d bytes to %s on VM %s/%s", len(data), params.Path, params.Namespace, params.VMName), nil
+}
+
+// handleFileGet is the tools/call handler for vm_file_get
+func handleFileGet(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeFileTransferParams(args)
+	if err != nil {
+		return "", err
+	}
+
+	localFile, err := os.CreateTemp("", "vm-file-get-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	localFile.Close()
+	defer os.Remove(localFile.Name())
+
+	execArgs, env, err := fileTransferArgs(params)
+	if err != nil {
+		return "", err
+	}
+	execArgs = append(execArgs, "--get-file", params.Path, "--local-file", localFile.Name())
+	if _, err := runVMExec(ctx, vmExecDeadline(params.Timeout, fileTransferSteps), execArgs, env); err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(localFile.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read temporary file: %v", err)
+	}
+
+	result := FileGetResult{Path: params.Path, Size: len(data), Encoding: params.Encoding}
+	if result.Encoding == "" {
+		result.Encoding = fileEncodingText
+		if !utf8.Valid(data) {
+			result.Encoding = fileEncodingBase64
+		}
+	}
+	if result.Encoding == fileEncodingBase64 {
+		result.Content = base64.StdEncoding.EncodeToString(data)
+	} else {
+		result.Content = string(data)
+	}
+	return formatJSON(result)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Output formats of the list and report tools
+const (
+	formatJSONOutput     = "json"
+	formatTableOutput    = "table"
+	formatMarkdownOutput = "markdown"
+	formatCSVOutput      = "csv"
+)
+
+// table is a tool result section rendered as rows and columns
+type table struct {
+	title   string
+	headers []string
+	rows    [][]string
+}
+
+// formatProperty is the input schema of the format argument
+func formatProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": "Output format: json, an aligned text table, a markdown table or csv",
+		"enum":        []string{formatJSONOutput, formatTableOutput, formatMarkdownOutput, formatCSVOutput},
+		"default":     formatJSONOutput,
+	}
+}
+
+// validateFormat rejects unknown output formats before a tool does any work
+func validateFormat(format string) error {
+	switch format {
+	case "", formatJSONOutput, formatTableOutput, formatMarkdownOutput, formatCSVOutput:
+		return nil
+	}
+	return &invalidParamsError{err: errors.New("unsupported format " + format)}
+}
+
+// formatResult renders a tool result as JSON, or renders the tables built by
+// tables in the requested format
+func formatResult(format string, v interface{}, tables func() []table) (string, error) {
+	if format == "" || format == formatJSONOutput {
+		return formatJSON(v)
+	}
+
+	var b strings.Builder
+	for i, t := range tables() {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		var err error
+		switch format {
+		case formatTableOutput:
+			err = writeTextTable(&b, t)
+		case formatMarkdownOutput:
+			writeMarkdownTable(&b, t)
+		case formatCSVOutput:
+			err = writeCSVTable(&b, t)
+		default:
+			return "", validateFormat(format)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to render %s: %v", t.title, err)
+		}
+	}
+	return b.String(), nil
+}
+
+// writeTextTable writes the table with columns aligned for monospace output
+func writeTextTable(b *strings.Builder, t table) error {
+	b.WriteString(t.title + ":\n")
+	if len(t.rows) == 0 {
+		b.WriteString("(none)\n")
+		return nil
+	}
+	w := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+	writeTextRow(w, t.headers)
+	for _, row := range t.rows {
+		writeTextRow(w, row)
+	}
+	return w.Flush()
+}
+
+// textCellReplacer keeps cells on one line and in their column, newlines and
+// tabs would break the alignment of the rows below
+var textCellReplacer = strings.NewReplacer("\r\n", " ", "\n", " ", "\t", " ")
+
+// writeTextRow writes one text table row
+func writeTextRow(w *tabwriter.Writer, cells []string) {
+	flattened := make([]string, len(cells))
+	for i, cell := range cells {
+		flattened[i] = textCellReplacer.Replace(cell)
+	}
+	fmt.Fprintln(w, strings.Join(flattened, "\t"))
+}
+
+// writeMarkdownTable writes the table as a GitHub flavored markdown table
+func writeMarkdownTable(b *strings.Builder, t table) {
+	b.WriteString("### " + t.title + "\n\n")
+	if len(t.rows) == 0 {
+		b.WriteString("_None_\n")
+		return
+	}
+	separators := make([]string, len(t.headers))
+	for i := range separators {
+		separators[i] = "---"
+	}
+	writeMarkdownRow(b, t.headers)
+	writeMarkdownRow(b, separators)
+	for _, row := range t.rows {
+		writeMarkdownRow(b, row)
+	}
+}
+
+// writeMarkdownRow writes one markdown table row, escaping cell content
+func writeMarkdownRow(b *strings.Builder, cells []string) {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		cell = strings.ReplaceAll(cell, "|", `\|`)
+		escaped[i] = strings.ReplaceAll(cell, "\n", "<br>")
+	}
+	b.WriteString("| " + strings.Join(escaped, " | ") + " |\n")
+}
+
+// writeCSVTable writes the table as CSV, preceded by a "# title" line so
+// several tables can share one result
+func writeCSVTable(b *strings.Builder, t table) error {
+	b.WriteString("# " + t.title + "\n")
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(t.headers)
+	w.WriteAll(t.rows)
+	if err := w.Error(); err != nil {
+		return err
+	}
+	b.Write(buf.Bytes())
+	return nil
+}
+
+// humanDuration renders a duration the way kubectl renders ages, with the two
+// most significant units, e.g. 45s, 12m, 5h3m or 3d4h
+func humanDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	minutes := int(d/time.Minute) % 60
+	seconds := int(d/time.Second) % 60
+
+	switch {
+	case days > 0 && hours > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case hours > 0 && minutes > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh", hours)
+	case minutes > 0:
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// since renders the time elapsed since t, or an empty string when t is unset.
+// LLM clients handle "3d4h" far more reliably than RFC3339 timestamps.
+func since(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return humanDuration(time.Since(t))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatResult(t *testing.T) {
+	tables := func() []table {
+		return []table{
+			{title: "VMs", headers: []string{"NAME", "STATUS", "NOTE"}, rows: [][]string{
+				{"web", "Running", "a|b"},
+				{"database", "Stopped", "line 1\nline 2"},
+				{"ci", "Paused", "say \"hi\",\tthen go"},
+			}},
+			{title: "Events", headers: []string{"REASON"}},
+		}
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"", "{\n  \"name\": \"web\"\n}"},
+		{formatJSONOutput, "{\n  \"name\": \"web\"\n}"},
+		{formatTableOutput, "VMs:\n" +
+			"NAME      STATUS   NOTE\n" +
+			"web       Running  a|b\n" +
+			"database  Stopped  line 1 line 2\n" +
+			"ci        Paused   say \"hi\", then go\n" +
+			"\n" +
+			"Events:\n(none)\n"},
+		{formatMarkdownOutput, "### VMs\n\n" +
+			"| NAME | STATUS | NOTE |\n" +
+			"| --- | --- | --- |\n" +
+			"| web | Running | a\\|b |\n" +
+			"| database | Stopped | line 1<br>line 2 |\n" +
+			"| ci | Paused | say \"hi\",\tthen go |\n" +
+			"\n" +
+			"### Events\n\n_None_\n"},
+		{formatCSVOutput, "# VMs\n" +
+			"NAME,STATUS,NOTE\n" +
+			"web,Running,a|b\n" +
+			"database,Stopped,\"line 1\nline 2\"\n" +
+			"ci,Paused,\"say \"\"hi\"\",\tthen go\"\n" +
+			"\n" +
+			"# Events\nREASON\n"},
+	}
+	for _, tt := range tests {
+		got, err := formatResult(tt.format, map[string]string{"name": "web"}, tables)
+		if err != nil {
+			t.Fatalf("formatResult(%q): %v", tt.format, err)
+		}
+		if got != tt.want {
+			t.Errorf("formatResult(%q) =\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+
+	if _, err := formatResult("yaml", nil, tables); err == nil {
+		t.Error("formatResult() accepted the yaml format")
+	}
+	if err := validateFormat("yaml"); err == nil {
+		t.Error("validateFormat() accepted the yaml format")
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Minute, "0s"},
+		{0, "0s"},
+		{45 * time.Second, "45s"},
+		{12*time.Minute + 30*time.Second, "12m"},
+		{time.Hour, "1h"},
+		{5*time.Hour + 3*time.Minute + 10*time.Second, "5h3m"},
+		{48 * time.Hour, "2d"},
+		{76*time.Hour + 59*time.Minute, "3d4h"},
+	}
+	for _, tt := range tests {
+		if got := humanDuration(tt.d); got != tt.want {
+			t.Errorf("humanDuration(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets run their seeds with go test and are fuzzed with e.g.
+//
+//	go test -run '^$' -fuzz FuzzDecodeRequest -fuzztime 1m
+
+func FuzzDecodeRequest(f *testing.F) {
+	for _, seed := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`,
+		`{"jsonrpc":"2.0","id":"a","method":"tools/call","params":{"name":"vm_list","arguments":{}}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"prompts/get","params":{"name":"diagnose_vm_boot","arguments":{"vm_name":"a"}}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"resources/list","params":{"cursor":"100"}}`,
+		`{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":1,"reason":"x"}}`,
+		`{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":{"a":[1]}}}`,
+		`{"jsonrpc":"2.0","id":[1,2],"method":5}`,
+		`{"jsonrpc":"2.0","id":null}`,
+		`[{"jsonrpc":"2.0","id":1,"method":"initialize"}]`,
+		`{"jsonrpc":"2.0","id":1,"method":"tools/list"`,
+		`null`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, rpcErr := decodeRequest(data)
+		if rpcErr != nil {
+			if rpcErr.Code != -32700 && rpcErr.Code != -32600 {
+				t.Fatalf("unexpected error code %d for %q", rpcErr.Code, data)
+			}
+			return
+		}
+		requestKey(req.conn, req.ID)
+		if isCancellation(req) {
+			cancelRequest(req)
+		}
+	})
+}
+
+func FuzzReadRequests(f *testing.F) {
+	f.Add([]byte("{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"tools/list\"}\n{\"jsonrpc\":\"2.0\",\"id\":2,\"method\":\"initialize\"}\n"))
+	f.Add([]byte("garbage\n{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"tools/list\"}"))
+	f.Add([]byte("\r\n\n{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"ping\"}\r\n"))
+	f.Add([]byte("{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"tools/list\"}{\"jsonrpc\":\"2.0\",\"id\":2}\n"))
+	f.Add([]byte("[{\"jsonrpc\":\"2.0\",\"id\":1,\"method\":\"tools/list\"},{\"jsonrpc\":\"2.0\",\"method\":\"notifications/initialized\"},7]\n[]\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		requests := make(chan JSONRPCRequest)
+		go readRequests(bytes.NewReader(data), output, requests)
+
+		// A malformed message must not stop the ones after it from being read
+		received := 0
+		for range requests {
+			received++
+		}
+		// Each line is one message or a batch of comma separated ones
+		if messages := bytes.Count(data, []byte("\n")) + bytes.Count(data, []byte(",")) + 1; received > messages {
+			t.Fatalf("read %d requests from at most %d messages", received, messages)
+		}
+	})
+}
+
+func FuzzToolArguments(f *testing.F) {
+	for _, seed := range []string{
+		`{}`,
+		`null`,
+		`{"vm_name":"fedora","namespace":"vms","timeout":30}`,
+		`{"vm_name":"fedora","path":"/tmp/x","content":"aGk=","encoding":"base64"}`,
+		`{"vm_name":"fedora","path":"/tmp/x","encoding":"rot13"}`,
+		`{"vm_name":"","commands":["uptime","df -h"],"method":"agent"}`,
+		`{"vm_name":7}`,
+		`{"timeout":1e40,"vm_name":"a"}`,
+		`{"summarize":"yes","format":"table"}`,
+		`{"iterations":-1,"payload_bytes":null}`,
+		`{"query":"owner=team-*,!temporary || env!=prod"}`,
+		`[]`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		args := json.RawMessage(data)
+
+		// Argument errors must be reported as invalid params, not as internal
+		// errors of the server
+		checkErr := func(err error) {
+			if err != nil && toolError(err).Code != -32602 {
+				t.Fatalf("arguments %q: error %v is not invalid params", data, err)
+			}
+		}
+
+		if params, err := decodeFileTransferParams(args); err == nil {
+			if params.VMName == "" || params.Path == "" || params.Namespace == "" {
+				t.Fatalf("arguments %q: accepted incomplete file transfer params %+v", data, params)
+			}
+		} else {
+			checkErr(err)
+		}
+		if params, err := decodeMigrationParams(args); err == nil {
+			if params.VMName == "" || params.Namespace == "" {
+				t.Fatalf("arguments %q: accepted incomplete migration params %+v", data, params)
+			}
+		} else {
+			checkErr(err)
+		}
+		if params, err := decodeSnapshotParams(args); err == nil {
+			if params.VMName == "" || params.Namespace == "" {
+				t.Fatalf("arguments %q: accepted incomplete snapshot params %+v", data, params)
+			}
+		} else {
+			checkErr(err)
+		}
+
+		for _, params := range []interface{}{
+			&VMExecParams{}, &VMListParams{}, &VMCreateParams{}, &VMDeleteParams{},
+			&VMInfoParams{}, &VMEventsParams{}, &LauncherLogsParams{}, &GCOrphansParams{}, &KubeVirtHealthParams{}, &ExecBenchmarkParams{}, &SSHBootstrapParams{}, &LoginParams{}, &PriorityReportParams{},
+			&VMTagParams{}, &VMSearchParams{}, &ConsoleOpenParams{}, &ConsoleSendParams{}, &ConsoleReadParams{}, &VMHistoryParams{},
+			&SnapshotScheduleParams{}, &SnapshotScheduleStatusParams{}, &StorageReclaimParams{}, &ImagePrepullParams{}, &VMWaitReadyParams{}, &VMCreateManyParams{},
+			&VMBootTimeParams{}, &VMPauseParams{}, &MigrationBenchmarkParams{}, &MemoryDumpParams{}, &MigrationPingParams{}, &DataVolumeParams{}, &ClockDriftParams{}, &HotplugParams{}, &KubeVirtCertsParams{}, &WebhookParams{}, &ApplyParams{}, &QuotaCheckParams{}, &MemoryOverheadParams{}, &EvictionReportParams{}, &EvictionStrategyParams{},
+			&CredentialsListParams{}, &CredentialsForgetParams{},
+			&PinSetParams{}, &PinListParams{}, &PinClearParams{},
+			&ExplainParams{}, &VMChangesParams{}, &VMInstancetypeParams{}, &RestartScheduleParams{}, &RestartScheduleStatusParams{}, &VMRolloutParams{}, &VMDriftParams{}, &VMDNSParams{},
+		} {
+			checkErr(decodeArguments(args, params))
+		}
+
+		var search VMSearchParams
+		if decodeArguments(args, &search) == nil {
+			_, err := parseTagQuery(search.Query)
+			checkErr(err)
+		}
+
+		wantsSummary(args)
+		var format struct {
+			Format string `json:"format"`
+		}
+		if decodeArguments(args, &format) == nil {
+			checkErr(validateFormat(format.Format))
+		}
+		if strings.Contains(string(data), `"vm_name"`) {
+			var exec VMExecParams
+			if decodeArguments(args, &exec) == nil {
+				_, _, err := vmExecArgs(exec)
+				checkErr(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables configuring the background sweep of orphaned
+// objects, see GCConfig. The sweep is enabled by setting an interval.
+const (
+	gcIntervalEnv = "KUBEVIRT_MCP_GC_INTERVAL"
+	gcMinAgeEnv   = "KUBEVIRT_MCP_GC_MIN_AGE"
+
+	// defaultGCMinAge leaves the objects of tool runs still in progress alone
+	defaultGCMinAge = time.Hour
+
+	// minGCInterval keeps the sweep from listing the cluster back to back
+	minGCInterval = time.Minute
+)
+
+// gcResources are the kinds of temporary objects the tools create
+var gcResources = []string{"virtualmachines.kubevirt.io", "pods", "persistentvolumeclaims", "services", "daemonsets.apps"}
+
+// GCOrphansParams represents the parameters of gc_orphans
+type GCOrphansParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	MinAge    string `json:"min_age,omitempty"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// GCOrphan is a temporary object left over by a failed tool run
+type GCOrphan struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Tool      string `json:"tool,omitempty"`
+	Age       string `json:"age"`
+	Deleted   bool   `json:"deleted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// GCOrphansResult is the gc_orphans tool result
+type GCOrphansResult struct {
+	Namespace string     `json:"namespace,omitempty"`
+	MinAge    string     `json:"minAge"`
+	DryRun    bool       `json:"dryRun,omitempty"`
+	Orphans   []GCOrphan `json:"orphans"`
+	Errors    []string   `json:"errors,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "gc_orphans",
+		Description: "Delete the temporary objects left over by failed tool runs, such as storage_probe PVCs and pods or cluster_smoketest VMs. Only objects labeled " + temporaryLabel + "=true and older than min_age are removed",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Only sweep this namespace (default: all namespaces)",
+				},
+				"min_age": map[string]interface{}{
+					"type":        "string",
+					"description": "Only delete objects older than this duration, so running tools keep their objects",
+					"default":     defaultGCMinAge.String(),
+				},
+				"dry_run": map[string]interface{}{
+					"type":        "boolean",
+					"description": "List the orphaned objects without deleting them",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleGCOrphans,
+	})
+}
+
+// handleGCOrphans is the tools/call handler for gc_orphans
+func handleGCOrphans(ctx context.Context, args json.RawMessage) (string, error) {
+	var params GCOrphansParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	minAge := defaultGCMinAge
+	if params.MinAge != "" {
+		d, err := time.ParseDuration(params.MinAge)
+		if err != nil || d < 0 {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid min_age '%s', use a duration such as 30m", params.MinAge)}
+		}
+		minAge = d
+	}
+
+	result, err := collectOrphans(ctx, params.Namespace, minAge, params.DryRun)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// orphanObject holds the fields of a temporary object needed to sweep it
+type orphanObject struct {
+	Kind     string     `json:"kind"`
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+// collectOrphans finds the temporary objects older than minAge and deletes
+// them unless dryRun is set. Kinds that cannot be listed, e.g. VMs on a
+// cluster without KubeVirt, are reported and skipped.
+func collectOrphans(ctx context.Context, namespace string, minAge time.Duration, dryRun bool) (*GCOrphansResult, error) {
+	result := &GCOrphansResult{Namespace: namespace, MinAge: minAge.String(), DryRun: dryRun, Orphans: []GCOrphan{}}
+	scope := namespaceArgs(namespace, namespace == "")
+	now := clock.Now()
+
+	for _, resource := range gcResources {
+		reportProgress(ctx, "looking for orphaned %s", resource)
+		var list struct {
+			Items []orphanObject `json:"items"`
+		}
+		args := append([]string{"get", resource, "-l", temporaryLabel + "=true"}, scope...)
+		if err := runKubectlJSON(ctx, &list, args...); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+
+		for _, obj := range list.Items {
+			age := now.Sub(obj.Metadata.CreationTimestamp)
+			if age < minAge {
+				continue
+			}
+			orphan := GCOrphan{
+				Kind:      obj.Kind,
+				Namespace: obj.Metadata.Namespace,
+				Name:      obj.Metadata.Name,
+				Tool:      obj.Metadata.Labels[toolLabel],
+				Age:       humanDuration(age),
+			}
+			if !dryRun {
+				_, err := runKubectl(ctx, "delete", resource, obj.Metadata.Name, "-n", obj.Metadata.Namespace, "--ignore-not-found", "--wait=false")
+				if err != nil {
+					orphan.Error = err.Error()
+				} else {
+					orphan.Deleted = true
+					logMessage(LogInfo, "gc", "Deleted orphaned %s %s/%s", strings.ToLower(obj.Kind), obj.Metadata.Namespace, obj.Metadata.Name)
+				}
+			}
+			result.Orphans = append(result.Orphans, orphan)
+		}
+	}
+
+	sort.SliceStable(result.Orphans, func(i, j int) bool {
+		a, b := result.Orphans[i], result.Orphans[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return result, nil
+}
+
+// startGC starts the background sweep of orphaned objects when an interval
+// is configured
+func startGC() error {
+	config := serverConfig.GC
+	if config.Interval == 0 {
+		return nil
+	}
+	if config.Interval < minGCInterval {
+		return fmt.Errorf("the garbage collection interval must be at least %v", minGCInterval)
+	}
+	minAge := config.MinAge
+
+	go func() {
+		for {
+			result, err := collectOrphans(context.Background(), "", minAge, false)
+			if err != nil {
+				logMessage(LogWarning, "gc", "Sweep failed: %v", err)
+			} else {
+				for _, problem := range result.Errors {
+					logMessage(LogWarning, "gc", "Sweep incomplete: %s", problem)
+				}
+				for _, orphan := range result.Orphans {
+					if orphan.Error != "" {
+						logMessage(LogWarning, "gc", "Failed to delete orphaned %s %s/%s: %s", strings.ToLower(orphan.Kind), orphan.Namespace, orphan.Name, orphan.Error)
+					}
+				}
+			}
+			<-clock.After(config.Interval)
+		}
+	}()
+	logMessage(LogInfo, "gc", "Sweeping orphaned objects older than %v every %v", minAge, config.Interval)
+	return nil
+}
+
+// tables renders the orphaned objects
+func (r *GCOrphansResult) tables() []table {
+	title := "Orphaned objects"
+	if r.DryRun {
+		title += " (dry run)"
+	}
+	orphans := table{title: title, headers: []string{"KIND", "NAMESPACE", "NAME", "TOOL", "AGE", "DELETED", "ERROR"}}
+	for _, o := range r.Orphans {
+		orphans.rows = append(orphans.rows, []string{o.Kind, o.Namespace, o.Name, o.Tool, o.Age, strconv.FormatBool(o.Deleted), o.Error})
+	}
+	tables := []table{orphans}
+	if len(r.Errors) > 0 {
+		errors := table{title: "Errors", headers: []string{"ERROR"}}
+		for _, e := range r.Errors {
+			errors.rows = append(errors.rows, []string{e})
+		}
+		tables = append(tables, errors)
+	}
+	return tables
+}
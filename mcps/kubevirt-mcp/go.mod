@@ -2,7 +2,10 @@ module kubevirt-mcp
 
 go 1.23.0
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	golang.org/x/crypto v0.36.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 replace (
 	k8s.io/api => k8s.io/api v0.32.5
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// hcoJSONPatchAnnotation lets HCO forward arbitrary JSON patches to the
+// KubeVirt CR. HCO reports itself as tainted while it is set, but it is the
+// only supported way to change KubeVirt settings HCO does not expose.
+const hcoJSONPatchAnnotation = "kubevirt.kubevirt.io/jsonpatch"
+
+// ManagedResource identifies the CR holding the KubeVirt configuration
+type ManagedResource struct {
+	Kind      string `json:"kind"`
+	Resource  string `json:"resource"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+type hyperConverged struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	} `json:"spec"`
+}
+
+type kubeVirtCR struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Configuration struct {
+			DeveloperConfiguration struct {
+				FeatureGates []string `json:"featureGates,omitempty"`
+			} `json:"developerConfiguration"`
+		} `json:"configuration"`
+	} `json:"spec"`
+	Status struct {
+		Phase                   string      `json:"phase,omitempty"`
+		ObservedKubeVirtVersion string      `json:"observedKubeVirtVersion,omitempty"`
+		Conditions              []Condition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// KubeVirtConfigResult is the kubevirt_config tool result
+type KubeVirtConfigResult struct {
+	HCOInstalled bool                   `json:"hcoInstalled"`
+	ManagedBy    ManagedResource        `json:"managedBy"`
+	FeatureGates map[string]bool        `json:"featureGates"`
+	Spec         map[string]interface{} `json:"spec"`
+	KubeVirt     map[string]interface{} `json:"kubevirtConfiguration"`
+	Note         string                 `json:"note,omitempty"`
+}
+
+// FeatureGateParams represents the parameters for toggling a feature gate
+type FeatureGateParams struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled"`
+	Confirm bool   `json:"confirm,omitempty"`
+}
+
+// FeatureGateResult reports where a feature gate change was applied
+type FeatureGateResult struct {
+	Name    string          `json:"name"`
+	Enabled bool            `json:"enabled"`
+	Target  ManagedResource `json:"target"`
+	Method  string          `json:"method"`
+	Warning string          `json:"warning,omitempty"`
+	Diff    string          `json:"diff,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "kubevirt_config",
+		Description: "Show the effective KubeVirt configuration (feature gates, tuning). When the HyperConverged Operator is installed the HCO CR is reported as the source of truth",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		Handler: handleKubeVirtConfig,
+	})
+
+	registerTool(Tool{
+		Name:        "kubevirt_feature_gate",
+		Description: "Enable or disable a KubeVirt feature gate. With HCO installed the change goes to the HyperConverged CR, since edits to the KubeVirt CR are reverted",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Feature gate name, e.g. HotplugVolumes (KubeVirt) or deployKubeSecondaryDNS (HCO)",
+				},
+				"enabled": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Whether the feature gate should be enabled",
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Must be true to forward a KubeVirt gate HCO does not expose through the " + hcoJSONPatchAnnotation + " annotation, which marks the HCO installation as unsupported",
+					"default":     false,
+				},
+			},
+			"required": []string{"name", "enabled"},
+		},
+		Handler: handleFeatureGate,
+	})
+}
+
+// detectHCO returns the HyperConverged CR, or nil when HCO is not installed
+func detectHCO(ctx context.Context) (*hyperConverged, map[string]interface{}, error) {
+	output, err := runKubectl(ctx, "get", "hyperconvergeds.hco.kubevirt.io", "--all-namespaces", "-o", "json")
+	if err != nil {
+		if strings.Contains(err.Error(), "doesn't have a resource type") {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse HyperConverged list: %v", err)
+	}
+	if len(list.Items) == 0 {
+		return nil, nil, nil
+	}
+
+	var hco hyperConverged
+	if err := json.Unmarshal(list.Items[0], &hco); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse HyperConverged: %v", err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(list.Items[0], &raw)
+
+	return &hco, raw, nil
+}
+
+// getKubeVirtCR returns the KubeVirt CR of the cluster
+func getKubeVirtCR(ctx context.Context) (*kubeVirtCR, map[string]interface{}, error) {
+	output, err := runKubectl(ctx, "get", "kubevirts.kubevirt.io", "--all-namespaces", "-o", "json")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse KubeVirt list: %v", err)
+	}
+	if len(list.Items) == 0 {
+		return nil, nil, fmt.Errorf("no KubeVirt CR found, is KubeVirt installed?")
+	}
+
+	var kv kubeVirtCR
+	if err := json.Unmarshal(list.Items[0], &kv); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse KubeVirt: %v", err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(list.Items[0], &raw)
+
+	return &kv, raw, nil
+}
+
+// handleKubeVirtConfig is the tools/call handler for kubevirt_config
+func handleKubeVirtConfig(ctx context.Context, args json.RawMessage) (string, error) {
+	kv, kvRaw, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return "", err
+	}
+	hco, hcoRaw, err := detectHCO(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	result := &KubeVirtConfigResult{
+		FeatureGates: map[string]bool{},
+		KubeVirt:     nestedMap(kvRaw, "spec", "configuration"),
+	}
+	for _, gate := range kv.Spec.Configuration.DeveloperConfiguration.FeatureGates {
+		result.FeatureGates[gate] = true
+	}
+
+	if hco == nil {
+		result.ManagedBy = ManagedResource{Kind: "KubeVirt", Resource: "kubevirts.kubevirt.io", Name: kv.Metadata.Name, Namespace: kv.Metadata.Namespace}
+		result.Spec = nestedMap(kvRaw, "spec")
+		return formatJSON(result)
+	}
+
+	result.HCOInstalled = true
+	result.ManagedBy = ManagedResource{Kind: "HyperConverged", Resource: "hyperconvergeds.hco.kubevirt.io", Name: hco.Metadata.Name, Namespace: hco.Metadata.Namespace}
+	result.Spec = nestedMap(hcoRaw, "spec")
+	// HCO feature gates are reported next to the KubeVirt ones they translate to
+	for gate, enabled := range hco.Spec.FeatureGates {
+		result.FeatureGates[gate] = enabled
+	}
+	if patch := hco.Metadata.Annotations[hcoJSONPatchAnnotation]; patch != "" {
+		result.Note = "HCO forwards a JSON patch to the KubeVirt CR via the " + hcoJSONPatchAnnotation + " annotation (unsupported configuration)"
+	} else {
+		result.Note = "Change settings on the HyperConverged CR, edits to the KubeVirt CR are reverted by HCO"
+	}
+
+	return formatJSON(result)
+}
+
+// handleFeatureGate is the tools/call handler for kubevirt_feature_gate
+func handleFeatureGate(ctx context.Context, args json.RawMessage) (string, error) {
+	var params FeatureGateParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Name == "" {
+		return "", missingArgument("name")
+	}
+	if params.Enabled == nil {
+		return "", missingArgument("enabled")
+	}
+
+	hco, _, err := detectHCO(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var result *FeatureGateResult
+	if hco != nil {
+		result, err = setHCOFeatureGate(ctx, hco, params.Name, *params.Enabled, params.Confirm)
+	} else {
+		result, err = setKubeVirtFeatureGate(ctx, params.Name, *params.Enabled)
+	}
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// setKubeVirtFeatureGate updates the feature gate list of the KubeVirt CR
+func setKubeVirtFeatureGate(ctx context.Context, name string, enabled bool) (*FeatureGateResult, error) {
+	kv, _, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	gates := []string{}
+	present := false
+	for _, gate := range kv.Spec.Configuration.DeveloperConfiguration.FeatureGates {
+		if gate == name {
+			present = true
+			if !enabled {
+				continue
+			}
+		}
+		gates = append(gates, gate)
+	}
+	if enabled && !present {
+		gates = append(gates, name)
+	}
+
+	patch, _ := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"configuration": map[string]interface{}{
+				"developerConfiguration": map[string]interface{}{"featureGates": gates},
+			},
+		},
+	})
+	diff, err := mutationDiff(ctx, "kubevirts.kubevirt.io", kv.Metadata.Name, kv.Metadata.Namespace, func() error {
+		_, err := runKubectl(ctx, "patch", "kubevirts.kubevirt.io", kv.Metadata.Name, "-n", kv.Metadata.Namespace, "--type=merge", "-p", string(patch))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeatureGateResult{
+		Name:    name,
+		Enabled: enabled,
+		Target:  ManagedResource{Kind: "KubeVirt", Resource: "kubevirts.kubevirt.io", Name: kv.Metadata.Name, Namespace: kv.Metadata.Namespace},
+		Method:  "spec.configuration.developerConfiguration.featureGates",
+		Diff:    diff,
+	}, nil
+}
+
+// setHCOFeatureGate sets an HCO feature gate, or forwards a KubeVirt feature
+// gate HCO does not know through the JSON patch annotation. The annotation
+// is only changed with confirm, and can only disable the gates it enabled.
+func setHCOFeatureGate(ctx context.Context, hco *hyperConverged, name string, enabled, confirm bool) (*FeatureGateResult, error) {
+	target := ManagedResource{Kind: "HyperConverged", Resource: "hyperconvergeds.hco.kubevirt.io", Name: hco.Metadata.Name, Namespace: hco.Metadata.Namespace}
+
+	if _, known := hco.Spec.FeatureGates[name]; known {
+		patch, _ := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{"featureGates": map[string]bool{name: enabled}},
+		})
+		diff, err := mutationDiff(ctx, target.Resource, target.Name, target.Namespace, func() error {
+			_, err := runKubectl(ctx, "patch", target.Resource, target.Name, "-n", target.Namespace, "--type=merge", "-p", string(patch))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &FeatureGateResult{Name: name, Enabled: enabled, Target: target, Method: "spec.featureGates", Diff: diff}, nil
+	}
+
+	var ops []map[string]interface{}
+	if existing := hco.Metadata.Annotations[hcoJSONPatchAnnotation]; existing != "" {
+		if err := json.Unmarshal([]byte(existing), &ops); err != nil {
+			return nil, fmt.Errorf("failed to parse existing %s annotation: %v", hcoJSONPatchAnnotation, err)
+		}
+	}
+
+	const gatesPath = "/spec/configuration/developerConfiguration/featureGates/-"
+	kept := []map[string]interface{}{}
+	for _, op := range ops {
+		if op["path"] == gatesPath && op["value"] == name {
+			continue
+		}
+		kept = append(kept, op)
+	}
+	if enabled {
+		kept = append(kept, map[string]interface{}{"op": "add", "path": gatesPath, "value": name})
+	}
+	method := "metadata.annotations[" + hcoJSONPatchAnnotation + "]"
+
+	if !enabled && len(kept) == len(ops) {
+		// The annotation does not add the gate, HCO enables it on its own
+		// and removing it from the KubeVirt CR would be reverted
+		kv, _, err := getKubeVirtCR(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, gate := range kv.Spec.Configuration.DeveloperConfiguration.FeatureGates {
+			if gate == name {
+				return nil, fmt.Errorf("feature gate %s is enabled by HCO on the KubeVirt CR, not through the %s annotation, and cannot be disabled from the HyperConverged CR", name, hcoJSONPatchAnnotation)
+			}
+		}
+		return &FeatureGateResult{Name: name, Enabled: false, Target: target, Method: method}, nil
+	}
+	if !confirm {
+		return nil, &invalidParamsError{err: fmt.Errorf("HCO does not expose feature gate %s, set confirm to true to forward it through the %s annotation, which marks the HCO installation as unsupported", name, hcoJSONPatchAnnotation)}
+	}
+
+	annotationValue, _ := json.Marshal(kept)
+	annotation := fmt.Sprintf("%s=%s", hcoJSONPatchAnnotation, string(annotationValue))
+	if len(kept) == 0 {
+		annotation = hcoJSONPatchAnnotation + "-"
+	}
+	diff, err := mutationDiff(ctx, target.Resource, target.Name, target.Namespace, func() error {
+		_, err := runKubectl(ctx, "annotate", target.Resource, target.Name, "-n", target.Namespace, "--overwrite", annotation)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &FeatureGateResult{
+		Name:    name,
+		Enabled: enabled,
+		Target:  target,
+		Method:  method,
+		Warning: "HCO does not expose this feature gate; it is forwarded to the KubeVirt CR through the JSON patch annotation, which marks the HCO installation as unsupported",
+		Diff:    diff,
+	}, nil
+}
+
+// nestedMap walks a decoded JSON object and returns the map at the given path
+func nestedMap(obj map[string]interface{}, path ...string) map[string]interface{} {
+	current := obj
+	for _, key := range path {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			return map[string]interface{}{}
+		}
+		current = next
+	}
+	return current
+}
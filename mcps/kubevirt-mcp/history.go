@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Environment variable configuring the lifecycle recorder, see
+// HistoryConfig. The recorder is enabled by setting an interval.
+const (
+	historyIntervalEnv = "KUBEVIRT_MCP_HISTORY_INTERVAL"
+
+	// minHistoryInterval keeps the recorder from listing the cluster back to
+	// back
+	minHistoryInterval = 10 * time.Second
+
+	// historyScheme is the URI prefix of the history resources, followed by
+	// <namespace>/<vm>
+	historyScheme = "kubevirt-mcp://history/"
+
+	defaultVMHistoryLimit = 100
+
+	// maxHistoryFileSize is the size of a recorded history file above which
+	// its oldest entries are dropped, keeping maxRecordedHistory
+	maxHistoryFileSize = 256 * 1024
+	maxRecordedHistory = 500
+
+	// historyMergeWindow is how close entries of the same transition from
+	// different sources must be to be reported once
+	historyMergeWindow = 30 * time.Second
+)
+
+// Lifecycle transitions of a VM timeline
+const (
+	historyCreated         = "created"
+	historyStarted         = "started"
+	historyRunning         = "running"
+	historyMigrated        = "migrated"
+	historyMigrationFailed = "migration-failed"
+	historyRestarted       = "restarted"
+	historyStopping        = "stopping"
+	historyStopped         = "stopped"
+	historyFailed          = "failed"
+	historyDeleted         = "deleted"
+)
+
+// Sources of the timeline entries
+const (
+	historyFromStatus    = "status"
+	historyFromEvents    = "events"
+	historyFromMigration = "migration"
+	historyFromRecorder  = "recorder"
+)
+
+// historyEventReasons maps the reasons of the VM and VMI events to the
+// transitions they report
+var historyEventReasons = map[string]string{
+	"SuccessfulCreate": historyStarted,
+	"SuccessfulDelete": historyStopped,
+	"Started":          historyRunning,
+	"ShuttingDown":     historyStopping,
+	"Stopped":          historyStopped,
+	"Migrated":         historyMigrated,
+	"FailedMigration":  historyMigrationFailed,
+}
+
+// VMHistoryParams represents the parameters of vm_history
+type VMHistoryParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Since     string `json:"since,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// HistoryEntry is a lifecycle transition of a VM
+type HistoryEntry struct {
+	Time     time.Time `json:"time"`
+	Ago      string    `json:"ago,omitempty"`
+	Event    string    `json:"event"`
+	Node     string    `json:"node,omitempty"`
+	FromNode string    `json:"fromNode,omitempty"`
+	Details  string    `json:"details,omitempty"`
+	Sources  []string  `json:"sources"`
+}
+
+// VMHistoryResult is the vm_history tool result
+type VMHistoryResult struct {
+	Namespace string         `json:"namespace"`
+	VMName    string         `json:"vmName"`
+	Since     string         `json:"since,omitempty"`
+	Recording bool           `json:"recording"`
+	Total     int            `json:"total"`
+	Entries   []HistoryEntry `json:"entries"`
+	Note      string         `json:"note,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_history",
+		Description: "Timeline of the lifecycle of a VM: created, started, running on which node, migrated from node A to B, restarted, stopped, failed. Built from the VM and VMI status, migrations, events and, when " + historyIntervalEnv + " is set, transitions recorded by the server, so it answers what happened to a VM while nobody was looking",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or standalone VMI",
+				},
+				"since": map[string]interface{}{
+					"type":        "string",
+					"description": "Only return transitions after this RFC 3339 timestamp or within this duration, e.g. 2024-05-01T18:00:00Z or 12h",
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of transitions to return, the most recent ones are kept",
+					"default":     defaultVMHistoryLimit,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMHistory,
+	})
+}
+
+// handleVMHistory is the tools/call handler for vm_history
+func handleVMHistory(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMHistoryParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Limit < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("limit must not be negative")}
+	}
+	if params.Limit == 0 {
+		params.Limit = defaultVMHistoryLimit
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if err := checkVMStateNames(params.Namespace, params.VMName); err != nil {
+		return "", err
+	}
+	var after time.Time
+	if params.Since != "" {
+		var err error
+		if after, err = parseSince(params.Since); err != nil {
+			return "", &invalidParamsError{err: err}
+		}
+	}
+
+	result, err := vmHistory(ctx, params, after)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// vmHistory builds the timeline of the VM from its current objects, its
+// events and the recorded transitions
+func vmHistory(ctx context.Context, params VMHistoryParams, after time.Time) (*VMHistoryResult, error) {
+	reportProgress(ctx, "reading the history of %s/%s", params.Namespace, params.VMName)
+	var vm VirtualMachine
+	vmFound, err := getOptionalObject(ctx, &vm, "virtualmachine", params.VMName, params.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	var vmi VirtualMachineInstance
+	vmiFound, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", params.VMName, params.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := readRecordedHistory(params.Namespace, params.VMName)
+	if err != nil {
+		return nil, err
+	}
+	if !vmFound && !vmiFound && len(recorded) == 0 {
+		return nil, fmt.Errorf("VM '%s' not found in namespace '%s' and no history was recorded for it", params.VMName, params.Namespace)
+	}
+
+	entries := recorded
+	if vmFound {
+		entries = append(entries, HistoryEntry{Time: vm.Metadata.CreationTimestamp, Event: historyCreated, Sources: []string{historyFromStatus}})
+	}
+	if vmiFound {
+		entries = append(entries, vmiHistory(vmi)...)
+
+		var migrations VirtualMachineInstanceMigrationList
+		if err := runKubectlJSON(ctx, &migrations, "get", "virtualmachineinstancemigrations", "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		for _, migration := range migrations.Items {
+			if migration.Spec.VMIName == params.VMName && !migration.Metadata.CreationTimestamp.Before(vmi.Metadata.CreationTimestamp) {
+				entries = append(entries, migrationHistory(migration)...)
+			}
+		}
+	}
+
+	var events struct {
+		Items []Event `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &events, "get", "events", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	for _, e := range events.Items {
+		if e.InvolvedObject.Kind == "Pod" || !isVMEvent(e, params.VMName) {
+			continue
+		}
+		if event, ok := historyEventReasons[e.Reason]; ok {
+			entries = append(entries, HistoryEntry{Time: e.lastSeen(), Event: event, Details: e.Message, Sources: []string{historyFromEvents}})
+		}
+	}
+
+	entries = mergeHistory(entries)
+	result := &VMHistoryResult{
+		Namespace: params.Namespace,
+		VMName:    params.VMName,
+		Since:     params.Since,
+		Recording: serverConfig.History.Interval > 0,
+		Entries:   []HistoryEntry{},
+	}
+	if !result.Recording {
+		result.Note = "Events expire after an hour by default, so older restarts and migrations may be missing. Set " + historyIntervalEnv + " to record every transition"
+	}
+	for _, entry := range entries {
+		if !after.IsZero() && !entry.Time.After(after) {
+			continue
+		}
+		entry.Ago = since(entry.Time)
+		result.Entries = append(result.Entries, entry)
+	}
+	result.Total = len(result.Entries)
+	if len(result.Entries) > params.Limit {
+		result.Entries = result.Entries[len(result.Entries)-params.Limit:]
+	}
+	return result, nil
+}
+
+// vmiHistory returns the transitions in the status of the VMI: its
+// creation and the phases it went through
+func vmiHistory(vmi VirtualMachineInstance) []HistoryEntry {
+	entries := []HistoryEntry{{Time: vmi.Metadata.CreationTimestamp, Event: historyStarted, Sources: []string{historyFromStatus}}}
+
+	// The VMI started on the source node of its last migration
+	node := vmi.Status.NodeName
+	if state := vmi.Status.MigrationState; state != nil && state.Completed && state.SourceNode != "" {
+		node = state.SourceNode
+	}
+	for _, transition := range vmi.Status.PhaseTransitionTimestamps {
+		entry := HistoryEntry{Time: transition.PhaseTransitionTimestamp, Sources: []string{historyFromStatus}}
+		switch transition.Phase {
+		case "Running":
+			entry.Event, entry.Node = historyRunning, node
+		case "Succeeded":
+			entry.Event, entry.Details = historyStopped, "the guest shut down"
+		case "Failed":
+			entry.Event = historyFailed
+		default:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if state := vmi.Status.MigrationState; state != nil && state.EndTimestamp != nil {
+		entries = append(entries, migrationStateHistory(*state, *state.EndTimestamp, historyFromStatus))
+	}
+	return entries
+}
+
+// migrationHistory returns the outcome of a migration of the VMI
+func migrationHistory(migration VirtualMachineInstanceMigration) []HistoryEntry {
+	if state := migration.Status.MigrationState; state != nil && state.EndTimestamp != nil {
+		return []HistoryEntry{migrationStateHistory(*state, *state.EndTimestamp, historyFromMigration)}
+	}
+	for _, transition := range migration.Status.PhaseTransitionTimestamps {
+		entry := HistoryEntry{Time: transition.PhaseTransitionTimestamp, Details: migration.Metadata.Name, Sources: []string{historyFromMigration}}
+		switch transition.Phase {
+		case migrationSucceeded:
+			entry.Event = historyMigrated
+		case migrationFailed:
+			entry.Event = historyMigrationFailed
+		default:
+			continue
+		}
+		return []HistoryEntry{entry}
+	}
+	return nil
+}
+
+// migrationStateHistory returns the transition a finished migration state
+// reports
+func migrationStateHistory(state MigrationState, end time.Time, source string) HistoryEntry {
+	entry := HistoryEntry{Time: end, Event: historyMigrated, FromNode: state.SourceNode, Node: state.TargetNode, Details: state.Mode, Sources: []string{source}}
+	if state.Failed || !state.Completed {
+		entry.Event, entry.Node = historyMigrationFailed, state.SourceNode
+		entry.FromNode = ""
+	}
+	return entry
+}
+
+// mergeHistory sorts the entries oldest first and folds the same transition
+// reported by several sources into one entry
+func mergeHistory(entries []HistoryEntry) []HistoryEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	var merged []HistoryEntry
+	for _, entry := range entries {
+		duplicate := false
+		for i := len(merged) - 1; i >= 0 && entry.Time.Sub(merged[i].Time) <= historyMergeWindow; i-- {
+			if merged[i].Event != entry.Event {
+				continue
+			}
+			existing := &merged[i]
+			if existing.Node == "" {
+				existing.Node = entry.Node
+			}
+			if existing.FromNode == "" {
+				existing.FromNode = entry.FromNode
+			}
+			if existing.Details == "" {
+				existing.Details = entry.Details
+			}
+			for _, source := range entry.Sources {
+				if !containsString(existing.Sources, source) {
+					existing.Sources = append(existing.Sources, source)
+				}
+			}
+			duplicate = true
+			break
+		}
+		if !duplicate {
+			merged = append(merged, entry)
+		}
+	}
+	return merged
+}
+
+// vmState is what the recorder last saw of a VM
+type vmState struct {
+	VM    bool   `json:"vm,omitempty"`
+	VMI   string `json:"vmi,omitempty"`
+	Phase string `json:"phase,omitempty"`
+	Node  string `json:"node,omitempty"`
+}
+
+// historyDir is the directory of the recorded transitions, one file of JSON
+// lines per VM
+func historyDir() string {
+	return filepath.Join(stateDir(), "history")
+}
+
+// historyFile returns the file of the recorded transitions of a VM. The names
+// must have passed checkVMStateNames.
+func historyFile(namespace, vmName string) string {
+	return filepath.Join(historyDir(), namespace, vmName+".jsonl")
+}
+
+// historyStateFile keeps the last state the recorder saw, so transitions
+// while the server was down are recorded when it comes back
+func historyStateFile() string {
+	return filepath.Join(historyDir(), "state.json")
+}
+
+// startHistory checks the recorder settings and starts recording the
+// lifecycle transitions of every VM when an interval is set
+func startHistory() error {
+	config := serverConfig.History
+	if config.Interval == 0 {
+		return nil
+	}
+	if config.Interval < minHistoryInterval {
+		return fmt.Errorf("the history interval must be at least %v", minHistoryInterval)
+	}
+
+	var states map[string]vmState
+	if data, err := os.ReadFile(historyStateFile()); err == nil {
+		if err := json.Unmarshal(data, &states); err != nil {
+			logMessage(LogWarning, "history", "Ignoring invalid %s: %v", historyStateFile(), err)
+			states = nil
+		}
+	}
+
+	go func() {
+		for {
+			current, err := recordHistory(context.Background(), states)
+			if err != nil {
+				logMessage(LogWarning, "history", "Recording failed: %v", err)
+			} else {
+				states = current
+			}
+			<-clock.After(config.Interval)
+		}
+	}()
+	logMessage(LogInfo, "history", "Recording VM lifecycle transitions every %v in %s", config.Interval, historyDir())
+	return nil
+}
+
+// recordHistory lists the VMs and VMIs of the cluster and records how they
+// changed since the previous states. Without previous states only the
+// states are saved.
+func recordHistory(ctx context.Context, previous map[string]vmState) (map[string]vmState, error) {
+	var vms VirtualMachineList
+	if err := runKubectlJSON(ctx, &vms, append([]string{"get", "virtualmachines"}, namespaceArgs("", true)...)...); err != nil {
+		return nil, err
+	}
+	var vmis VirtualMachineInstanceList
+	if err := runKubectlJSON(ctx, &vmis, append([]string{"get", "virtualmachineinstances"}, namespaceArgs("", true)...)...); err != nil {
+		return nil, err
+	}
+
+	current := map[string]vmState{}
+	vmByKey := map[string]VirtualMachine{}
+	vmiByKey := map[string]VirtualMachineInstance{}
+	for _, vm := range vms.Items {
+		key := vm.Metadata.Namespace + "/" + vm.Metadata.Name
+		vmByKey[key] = vm
+		current[key] = vmState{VM: true}
+	}
+	for _, vmi := range vmis.Items {
+		key := vmi.Metadata.Namespace + "/" + vmi.Metadata.Name
+		vmiByKey[key] = vmi
+		state := current[key]
+		state.VMI, state.Phase, state.Node = vmi.Metadata.UID, vmi.Status.Phase, vmi.Status.NodeName
+		current[key] = state
+	}
+
+	if previous != nil {
+		keys := map[string]bool{}
+		for key := range previous {
+			keys[key] = true
+		}
+		for key := range current {
+			keys[key] = true
+		}
+		for key := range keys {
+			entries := historyTransitions(previous[key], current[key], vmByKey[key], vmiByKey[key])
+			if len(entries) == 0 {
+				continue
+			}
+			namespace, name, _ := strings.Cut(key, "/")
+			if err := appendHistory(namespace, name, entries); err != nil {
+				logMessage(LogWarning, "history", "Failed to record the history of %s: %v", key, err)
+			}
+		}
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(historyDir(), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", historyDir(), err)
+	}
+	if err := os.WriteFile(historyStateFile(), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save the history state: %v", err)
+	}
+	return current, nil
+}
+
+// historyTransitions returns the transitions between two states of a VM
+func historyTransitions(prev, cur vmState, vm VirtualMachine, vmi VirtualMachineInstance) []HistoryEntry {
+	now := clock.Now().Truncate(time.Second)
+	entry := func(t time.Time, event string) HistoryEntry {
+		if t.IsZero() {
+			t = now
+		}
+		return HistoryEntry{Time: t, Event: event, Sources: []string{historyFromRecorder}}
+	}
+
+	var entries []HistoryEntry
+	if !prev.VM && cur.VM {
+		entries = append(entries, entry(vm.Metadata.CreationTimestamp, historyCreated))
+	}
+	switch {
+	case prev.VMI == "" && cur.VMI != "":
+		e := entry(vmi.Metadata.CreationTimestamp, historyStarted)
+		e.Node = cur.Node
+		entries = append(entries, e)
+	case prev.VMI != "" && cur.VMI == "":
+		e := entry(now, historyStopped)
+		e.Node = prev.Node
+		entries = append(entries, e)
+	case prev.VMI != cur.VMI:
+		e := entry(vmi.Metadata.CreationTimestamp, historyRestarted)
+		e.FromNode, e.Node = prev.Node, cur.Node
+		entries = append(entries, e)
+	case prev.Node != "" && cur.Node != "" && prev.Node != cur.Node:
+		e := entry(now, historyMigrated)
+		if state := vmi.Status.MigrationState; state != nil && state.EndTimestamp != nil {
+			e.Time = *state.EndTimestamp
+		}
+		e.FromNode, e.Node = prev.Node, cur.Node
+		entries = append(entries, e)
+	}
+	if cur.VMI != "" && (prev.VMI != cur.VMI || prev.Phase != cur.Phase) {
+		var event, details string
+		switch cur.Phase {
+		case "Running":
+			event = historyRunning
+		case "Succeeded":
+			event, details = historyStopped, "the guest shut down"
+		case "Failed":
+			event = historyFailed
+		}
+		if event != "" && (prev.VMI == cur.VMI || event != historyRunning) {
+			e := entry(now, event)
+			for _, transition := range vmi.Status.PhaseTransitionTimestamps {
+				if transition.Phase == cur.Phase {
+					e.Time = transition.PhaseTransitionTimestamp
+				}
+			}
+			e.Node, e.Details = cur.Node, details
+			entries = append(entries, e)
+		}
+	}
+	if prev.VM && !cur.VM {
+		entries = append(entries, entry(now, historyDeleted))
+	}
+	return entries
+}
+
+// appendHistory adds entries to the recorded history of a VM, dropping the
+// oldest ones once the file grows too large
+func appendHistory(namespace, vmName string, entries []HistoryEntry) error {
+	path := historyFile(namespace, vmName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		logMessage(LogDebug, "history", "%s/%s %s %s", namespace, vmName, entry.Event, entry.Node)
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil || info.Size() <= maxHistoryFileSize {
+		return err
+	}
+
+	recorded, err := readRecordedHistory(namespace, vmName)
+	if err != nil {
+		return err
+	}
+	if len(recorded) > maxRecordedHistory {
+		recorded = recorded[len(recorded)-maxRecordedHistory:]
+	}
+	var data []byte
+	for _, entry := range recorded {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readRecordedHistory returns the recorded transitions of a VM, none when
+// nothing was recorded
+func readRecordedHistory(namespace, vmName string) ([]HistoryEntry, error) {
+	file, err := os.Open(historyFile(namespace, vmName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the recorded history: %v", err)
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		// A line being written by the recorder is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the recorded history: %v", err)
+	}
+	return entries, nil
+}
+
+// historyResources lists a resource for every VM with recorded history
+func historyResources() []map[string]interface{} {
+	resources := []map[string]interface{}{}
+	paths, _ := filepath.Glob(filepath.Join(historyDir(), "*", "*.jsonl"))
+	for _, path := range paths {
+		namespace := filepath.Base(filepath.Dir(path))
+		name := strings.TrimSuffix(filepath.Base(path), ".jsonl")
+		resources = append(resources, map[string]interface{}{
+			"uri":         historyScheme + namespace + "/" + name,
+			"name":        fmt.Sprintf("History of %s/%s", namespace, name),
+			"description": "Lifecycle timeline of the VM, as returned by vm_history",
+			"mimeType":    "application/json",
+		})
+	}
+	return resources
+}
+
+// readHistoryResource returns the timeline of the VM of a history URI, any
+// VM can be read whether or not it was recorded
+func readHistoryResource(uri string) (map[string]interface{}, error) {
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(uri, historyScheme), "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return nil, &invalidParamsError{err: fmt.Errorf("invalid history resource %s, use %s<namespace>/<vm>", uri, historyScheme)}
+	}
+	if err := checkVMStateNames(namespace, name); err != nil {
+		return nil, err
+	}
+	result, err := vmHistory(context.Background(), VMHistoryParams{Namespace: namespace, VMName: name, Limit: maxRecordedHistory}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	text, err := formatJSON(result)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{"uri": uri, "mimeType": "application/json", "text": text},
+		},
+	}, nil
+}
+
+// tables renders the timeline oldest first
+func (r *VMHistoryResult) tables() []table {
+	title := fmt.Sprintf("History of %s/%s", r.Namespace, r.VMName)
+	if len(r.Entries) < r.Total {
+		title += fmt.Sprintf(" (%d most recent of %d)", len(r.Entries), r.Total)
+	}
+	history := table{title: title, headers: []string{"TIME", "AGO", "EVENT", "NODE", "DETAILS", "SOURCES"}}
+	for _, e := range r.Entries {
+		node := e.Node
+		if e.FromNode != "" {
+			node = e.FromNode + " -> " + e.Node
+		}
+		history.rows = append(history.rows, []string{e.Time.Format(time.RFC3339), e.Ago, e.Event, node, e.Details, strings.Join(e.Sources, ",")})
+	}
+	tables := []table{history}
+	if r.Note != "" {
+		tables = append(tables, table{title: "Note", headers: []string{"NOTE"}, rows: [][]string{{r.Note}}})
+	}
+	return tables
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHotplugTimeout = 120
+	defaultHotplugBus     = "scsi"
+
+	// hotplugReady is the volume status phase of an attached volume
+	hotplugReady = "Ready"
+)
+
+// serialRegex matches the disk serials KubeVirt accepts
+var serialRegex = regexp.MustCompile(`^[A-Za-z0-9_.+-]{1,36}$`)
+
+// HotplugParams represents the parameters of vm_addvolume and vm_removevolume
+type HotplugParams struct {
+	Namespace    string `json:"namespace,omitempty"`
+	VMName       string `json:"vm_name"`
+	VolumeName   string `json:"volume_name"`
+	ClaimName    string `json:"claim_name,omitempty"`
+	Size         string `json:"size,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+	Bus          string `json:"bus,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Persist      bool   `json:"persist,omitempty"`
+	DryRun       bool   `json:"dry_run,omitempty"`
+	DeleteVolume bool   `json:"delete_volume,omitempty"`
+	Timeout      int    `json:"timeout,omitempty"`
+}
+
+// HotplugResult is the result of vm_addvolume and vm_removevolume
+type HotplugResult struct {
+	Namespace    string `json:"namespace"`
+	VMName       string `json:"vmName"`
+	Action       string `json:"action"`
+	Volume       string `json:"volume"`
+	Claim        string `json:"claim,omitempty"`
+	ClaimCreated bool   `json:"claimCreated,omitempty"`
+	ClaimDeleted bool   `json:"claimDeleted,omitempty"`
+	Bus          string `json:"bus,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+	Persist      bool   `json:"persist"`
+	DryRun       bool   `json:"dryRun,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	Target       string `json:"target,omitempty"`
+	Duration     string `json:"duration,omitempty"`
+	Note         string `json:"note,omitempty"`
+}
+
+func init() {
+	properties := func(extra map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{
+			"namespace": map[string]interface{}{
+				"type":        "string",
+				"description": "Kubernetes namespace containing the VM",
+				"default":     "default",
+			},
+			"vm_name": map[string]interface{}{
+				"type":        "string",
+				"description": "Name of the VM",
+			},
+			"volume_name": map[string]interface{}{
+				"type":        "string",
+				"description": "Name of the volume in the VM spec",
+			},
+			"persist": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Change the VM spec so that the change survives a restart, instead of the running VMI only",
+				"default":     false,
+			},
+			"dry_run": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Only validate the request on the server, nothing is changed",
+				"default":     false,
+			},
+			"timeout": map[string]interface{}{
+				"type":        "integer",
+				"description": "Timeout in seconds for the VMI to report the change (default: 120)",
+				"default":     defaultHotplugTimeout,
+			},
+		}
+		for name, property := range extra {
+			properties[name] = property
+		}
+		return properties
+	}
+
+	registerTool(Tool{
+		Name:        "vm_addvolume",
+		Description: "Hotplug a disk into a running VM through the addvolume subresource: an existing PVC or DataVolume, or a new blank scratch disk of the given size, and wait until the guest sees it",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": properties(map[string]interface{}{
+				"claim_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Existing PVC or DataVolume to attach (default: a new blank DataVolume named after volume_name when size is set)",
+				},
+				"size": map[string]interface{}{
+					"type":        "string",
+					"description": "Size of a new blank scratch DataVolume to create and attach, e.g. 1Gi",
+				},
+				"storage_class": map[string]interface{}{
+					"type":        "string",
+					"description": "StorageClass of the scratch DataVolume (default: the cluster default)",
+				},
+				"bus": map[string]interface{}{
+					"type":        "string",
+					"description": "Disk bus",
+					"enum":        []string{"scsi", "virtio"},
+					"default":     defaultHotplugBus,
+				},
+				"serial": map[string]interface{}{
+					"type":        "string",
+					"description": "Disk serial, shown in /dev/disk/by-id in the guest",
+				},
+			}),
+			"required": []string{"vm_name", "volume_name"},
+		},
+		Handler: handleAddVolume,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_removevolume",
+		Description: "Unplug a hotplugged disk from a running VM through the removevolume subresource, optionally deleting its claim",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": properties(map[string]interface{}{
+				"delete_volume": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Delete the DataVolume or PVC once it is unplugged, e.g. a scratch disk created by vm_addvolume",
+					"default":     false,
+				},
+			}),
+			"required": []string{"vm_name", "volume_name"},
+		},
+		Handler: handleRemoveVolume,
+	})
+}
+
+// decodeHotplugParams decodes and validates the hotplug tool arguments
+func decodeHotplugParams(args json.RawMessage) (HotplugParams, error) {
+	var params HotplugParams
+	if err := decodeArguments(args, &params); err != nil {
+		return params, err
+	}
+	if params.VMName == "" {
+		return params, missingArgument("vm_name")
+	}
+	if params.VolumeName == "" {
+		return params, missingArgument("volume_name")
+	}
+	if !vmNameRegex.MatchString(params.VolumeName) {
+		return params, &invalidParamsError{err: fmt.Errorf("invalid volume name %q, use lowercase letters, digits and dashes", params.VolumeName)}
+	}
+	if params.Timeout < 0 {
+		return params, &invalidParamsError{err: errors.New("timeout cannot be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultHotplugTimeout
+	}
+	return params, nil
+}
+
+// handleAddVolume is the tools/call handler for vm_addvolume
+func handleAddVolume(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeHotplugParams(args)
+	if err != nil {
+		return "", err
+	}
+	if params.ClaimName == "" && params.Size == "" {
+		return "", &invalidParamsError{err: errors.New("claim_name or size is required")}
+	}
+	if params.Size != "" {
+		if _, ok := parseQuantity(params.Size); !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid size %q", params.Size)}
+		}
+	}
+	if params.Bus == "" {
+		params.Bus = defaultHotplugBus
+	}
+	if params.Bus != "scsi" && params.Bus != "virtio" {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported bus %q, hotplugged disks use scsi or virtio", params.Bus)}
+	}
+	if params.Serial != "" && !serialRegex.MatchString(params.Serial) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid serial %q, use at most 36 letters, digits and _.+-", params.Serial)}
+	}
+	if params.ClaimName == "" {
+		params.ClaimName = params.VolumeName
+	}
+
+	result, err := addVolume(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// handleRemoveVolume is the tools/call handler for vm_removevolume
+func handleRemoveVolume(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeHotplugParams(args)
+	if err != nil {
+		return "", err
+	}
+	result, err := removeVolume(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// addVolume creates the scratch DataVolume when asked, calls addvolume and
+// waits until the VMI reports the volume ready
+func addVolume(ctx context.Context, params HotplugParams) (*HotplugResult, error) {
+	result := &HotplugResult{
+		Namespace: params.Namespace,
+		VMName:    params.VMName,
+		Action:    "add",
+		Volume:    params.VolumeName,
+		Claim:     params.ClaimName,
+		Bus:       params.Bus,
+		Serial:    params.Serial,
+		Persist:   params.Persist,
+		DryRun:    params.DryRun,
+	}
+	if !params.Persist {
+		if _, err := getRunningVMIObject(ctx, params.Namespace, params.VMName); err != nil {
+			return nil, fmt.Errorf("%v, or use persist to add the volume to the VM spec", err)
+		}
+	}
+
+	source := "persistentVolumeClaim"
+	if params.Size != "" {
+		source = "dataVolume"
+		if !params.DryRun {
+			if err := createScratchDataVolume(ctx, params); err != nil {
+				return nil, err
+			}
+			result.ClaimCreated = true
+		}
+	} else {
+		var dv dataVolume
+		// Clusters without CDI only have PVCs
+		if found, err := getOptionalObject(ctx, &dv, "datavolumes.cdi.kubevirt.io", params.ClaimName, params.Namespace); err == nil && found {
+			source = "dataVolume"
+		}
+	}
+
+	disk := map[string]interface{}{
+		"name": params.VolumeName,
+		"disk": map[string]interface{}{"bus": params.Bus},
+	}
+	if params.Serial != "" {
+		disk["serial"] = params.Serial
+	}
+	volumeSource := map[string]interface{}{"hotpluggable": true}
+	if source == "dataVolume" {
+		volumeSource["name"] = params.ClaimName
+	} else {
+		volumeSource["claimName"] = params.ClaimName
+	}
+	options := map[string]interface{}{
+		"name":         params.VolumeName,
+		"disk":         disk,
+		"volumeSource": map[string]interface{}{source: volumeSource},
+	}
+
+	start := clock.Now()
+	if err := callHotplugSubresource(ctx, params, "addvolume", options); err != nil {
+		return nil, err
+	}
+	if params.DryRun {
+		result.Note = "dry run, the request is valid and nothing was changed"
+		if params.Size != "" {
+			result.Note += "; the scratch DataVolume was not created"
+		}
+		return result, nil
+	}
+
+	status, err := waitHotplug(ctx, params, func(status *VolumeStatus) bool { return status != nil && status.Phase == hotplugReady })
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		result.Note = "the VM is not running, the volume is attached when it starts"
+		return result, nil
+	}
+	result.Phase, result.Target = status.Phase, status.Target
+	result.Duration = humanDuration(clock.Now().Sub(start))
+	if params.Serial != "" {
+		result.Note = "the disk is /dev/disk/by-id/*" + params.Serial + " in the guest"
+	}
+	return result, nil
+}
+
+// removeVolume calls removevolume, waits until the VMI dropped the volume
+// and optionally deletes its claim
+func removeVolume(ctx context.Context, params HotplugParams) (*HotplugResult, error) {
+	result := &HotplugResult{
+		Namespace: params.Namespace,
+		VMName:    params.VMName,
+		Action:    "remove",
+		Volume:    params.VolumeName,
+		Persist:   params.Persist,
+		DryRun:    params.DryRun,
+	}
+
+	// The claim is looked up before the volume disappears from the spec
+	var claim, kind string
+	if params.DeleteVolume {
+		var vmi VirtualMachineInstance
+		found, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", params.VMName, params.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		volumes := vmi.Spec.Volumes
+		if !found {
+			var vm VirtualMachine
+			if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+				return nil, err
+			}
+			volumes = vm.Spec.Template.Spec.Volumes
+		}
+		for _, volume := range volumes {
+			switch {
+			case volume.Name != params.VolumeName:
+			case volume.DataVolume != nil:
+				claim, kind = volume.DataVolume.Name, "datavolumes.cdi.kubevirt.io"
+			case volume.PersistentVolumeClaim != nil:
+				claim, kind = volume.PersistentVolumeClaim.ClaimName, "persistentvolumeclaim"
+			}
+		}
+		if claim == "" {
+			return nil, fmt.Errorf("VM %s/%s has no volume %s backed by a DataVolume or PVC", params.Namespace, params.VMName, params.VolumeName)
+		}
+		result.Claim = claim
+	}
+
+	if err := callHotplugSubresource(ctx, params, "removevolume", map[string]interface{}{"name": params.VolumeName}); err != nil {
+		return nil, err
+	}
+	if params.DryRun {
+		result.Note = "dry run, the request is valid and nothing was changed"
+		return result, nil
+	}
+
+	start := clock.Now()
+	if _, err := waitHotplug(ctx, params, func(status *VolumeStatus) bool { return status == nil }); err != nil {
+		return nil, err
+	}
+	result.Duration = humanDuration(clock.Now().Sub(start))
+
+	if claim != "" {
+		if _, err := runKubectl(ctx, "delete", kind, claim, "-n", params.Namespace, "--ignore-not-found", "--wait=false"); err != nil {
+			return nil, fmt.Errorf("volume %s was removed but deleting %s failed: %v", params.VolumeName, claim, err)
+		}
+		result.ClaimDeleted = true
+	}
+	return result, nil
+}
+
+// createScratchDataVolume creates the blank DataVolume of a scratch disk and
+// waits until CDI prepared it
+func createScratchDataVolume(ctx context.Context, params HotplugParams) error {
+	storage := map[string]interface{}{
+		"resources": map[string]interface{}{
+			"requests": map[string]interface{}{"storage": params.Size},
+		},
+	}
+	if params.StorageClass != "" {
+		storage["storageClassName"] = params.StorageClass
+	}
+	if err := createObject(ctx, map[string]interface{}{
+		"apiVersion": "cdi.kubevirt.io/v1beta1",
+		"kind":       "DataVolume",
+		"metadata": map[string]interface{}{
+			"name":        params.ClaimName,
+			"namespace":   params.Namespace,
+			"labels":      managedLabels("vm_addvolume", false),
+			"annotations": map[string]string{bindImmediateAnnotation: "true"},
+		},
+		"spec": map[string]interface{}{
+			"source":  map[string]interface{}{"blank": map[string]interface{}{}},
+			"storage": storage,
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to create scratch DataVolume: %v", cdiError(err))
+	}
+
+	reportProgress(ctx, "waiting for scratch DataVolume %s/%s", params.Namespace, params.ClaimName)
+	_, err := dataVolumeStatus(ctx, DataVolumeParams{Name: params.ClaimName, Namespace: params.Namespace, Wait: true, Timeout: params.Timeout})
+	return err
+}
+
+// callHotplugSubresource calls addvolume or removevolume on the VM when the
+// change persists, on the VMI otherwise
+func callHotplugSubresource(ctx context.Context, params HotplugParams, subresource string, options map[string]interface{}) error {
+	if params.DryRun {
+		options["dryRun"] = []string{"All"}
+	}
+	body, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	resource := "virtualmachineinstances"
+	if params.Persist {
+		resource = "virtualmachines"
+	}
+	path := fmt.Sprintf("/apis/subresources.kubevirt.io/v1/namespaces/%s/%s/%s/%s", params.Namespace, resource, params.VMName, subresource)
+	logMessage(LogInfo, "storage", "Calling %s of volume %s on %s %s/%s", subresource, params.VolumeName, strings.TrimSuffix(resource, "s"), params.Namespace, params.VMName)
+	if _, err := runKubectlWithInput(ctx, body, "replace", "--raw", path, "-f", "-"); err != nil {
+		return fmt.Errorf("%s of volume %s on VM %s/%s failed: %v", subresource, params.VolumeName, params.Namespace, params.VMName, err)
+	}
+	return nil
+}
+
+// waitHotplug polls the volume status of the VMI until done returns true
+// and returns the last status of the volume. It returns right away when the
+// VM is not running.
+func waitHotplug(ctx context.Context, params HotplugParams, done func(*VolumeStatus) bool) (*VolumeStatus, error) {
+	reportProgress(ctx, "waiting for VMI %s/%s to report volume %s", params.Namespace, params.VMName, params.VolumeName)
+	deadline := clock.Now().Add(time.Duration(params.Timeout) * time.Second)
+	for {
+		var vmi VirtualMachineInstance
+		found, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", params.VMName, params.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !found || vmi.Status.Phase != "Running" {
+			return nil, nil
+		}
+		var status *VolumeStatus
+		for i := range vmi.Status.VolumeStatus {
+			if vmi.Status.VolumeStatus[i].Name == params.VolumeName {
+				status = &vmi.Status.VolumeStatus[i]
+			}
+		}
+		if done(status) {
+			return status, nil
+		}
+
+		if clock.Now().After(deadline) {
+			phase := "absent"
+			if status != nil {
+				phase = status.Phase
+				if status.Reason != "" {
+					phase += " (" + status.Reason + ")"
+				}
+			}
+			return nil, fmt.Errorf("volume %s of VMI %s/%s is still %s after %ds", params.VolumeName, params.Namespace, params.VMName, phase, params.Timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for volume %s of VMI %s/%s cancelled", params.VolumeName, params.Namespace, params.VMName)
+		case <-clock.After(time.Second):
+		}
+	}
+}
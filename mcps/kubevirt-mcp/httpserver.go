@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Environment variables configuring the HTTP transport, see HTTPConfig. The
+// transport replaces stdio when an address is set.
+const (
+	httpAddrEnv     = "KUBEVIRT_MCP_HTTP_ADDR"
+	httpTLSCertEnv  = "KUBEVIRT_MCP_HTTP_TLS_CERT"
+	httpTLSKeyEnv   = "KUBEVIRT_MCP_HTTP_TLS_KEY"
+	httpClientCAEnv = "KUBEVIRT_MCP_HTTP_CLIENT_CA"
+)
+
+const (
+	// mcpPath is the endpoint of the HTTP transport
+	mcpPath = "/mcp"
+	// sessionHeader carries the session ID returned by initialize
+	sessionHeader = "Mcp-Session-Id"
+	// maxHTTPBody bounds the size of a POSTed message or batch
+	maxHTTPBody = 16 << 20
+	// httpSessionIdleTimeout ends the sessions unused for this long
+	httpSessionIdleTimeout = time.Hour
+)
+
+// httpSession is a client session, bound to the identity that initialized it
+type httpSession struct {
+	identity *Identity
+	lastUsed time.Time
+}
+
+// httpTransport serves JSON-RPC messages POSTed to mcpPath, answering each
+// POST with the response or the batch of responses. Every request must
+// authenticate, and the session can only be used by the identity that
+// started it.
+type httpTransport struct {
+	identities []*Identity
+	slots      chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*httpSession
+}
+
+// activeHTTPTransport is the running HTTP transport, whose sessions are
+// reported by the metrics
+var activeHTTPTransport atomic.Pointer[httpTransport]
+
+// serveHTTP serves MCP over HTTP until the listener fails or the server
+// shuts down. Requests handled at once are bounded by slots, nil for no
+// limit.
+func serveHTTP(slots chan struct{}) error {
+	config := serverConfig.HTTP
+	if config.Identities == "" {
+		return fmt.Errorf("the HTTP transport needs an identities file, set --identities or %s", identitiesEnv)
+	}
+	identities, err := loadIdentities(config.Identities)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := transportTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	transport := &httpTransport{identities: identities, slots: slots, sessions: map[string]*httpSession{}}
+	activeHTTPTransport.Store(transport)
+	mux := http.NewServeMux()
+	mux.Handle(mcpPath, transport)
+	mux.HandleFunc("/metrics", serveMetrics)
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         tlsConfig,
+		// Request contexts derive from serverCtx, so a shutdown cancels
+		// the running calls
+		BaseContext: func(net.Listener) context.Context { return serverCtx },
+	}
+
+	// On shutdown the listener is closed and the cancelled calls get the
+	// shutdown timeout to answer
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-serverCtx.Done()
+		ctx, cancel := clock.WithTimeout(context.Background(), timeoutFor(timeoutShutdown))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Requests still running after %v, exiting", timeoutFor(timeoutShutdown))
+		}
+	}()
+
+	logMessage(LogInfo, "http", "Serving MCP on %s%s for %d identities", config.Addr, mcpPath, len(identities))
+	if tlsConfig == nil {
+		logMessage(LogWarning, "http", "The HTTP transport has no TLS certificate, bearer tokens are sent in clear")
+		err = server.ListenAndServe()
+	} else {
+		// The certificate is already in the TLS configuration
+		err = server.ListenAndServeTLS("", "")
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+		return nil
+	}
+	return err
+}
+
+// transportTLSConfig returns the TLS configuration of the HTTP transport and
+// the TCP listener, nil when no certificate is set. With a client CA the
+// client certificates are verified, clients without one can still use a
+// bearer token.
+func transportTLSConfig() (*tls.Config, error) {
+	config := serverConfig.HTTP
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("set both the TLS certificate and key")
+	}
+	if config.TLSCert == "" {
+		if config.ClientCA != "" {
+			return nil, fmt.Errorf("client certificates need the TLS certificate and key")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(expandHome(config.TLSCert), expandHome(config.TLSKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if config.ClientCA != "" {
+		pem, err := os.ReadFile(expandHome(config.ClientCA))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA %s", config.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// clientCertIdentity returns the identity of the verified client certificate
+// of a TLS connection
+func clientCertIdentity(identities []*Identity, state *tls.ConnectionState) (*Identity, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil, false
+	}
+	return identityForCN(identities, state.VerifiedChains[0][0].Subject.CommonName)
+}
+
+// authenticate returns the identity of a verified client certificate, else
+// of the bearer token of the request
+func (t *httpTransport) authenticate(r *http.Request) (*Identity, bool) {
+	if identity, ok := clientCertIdentity(t.identities, r.TLS); ok {
+		return identity, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		return nil, false
+	}
+	return identityForToken(t.identities, strings.TrimSpace(token))
+}
+
+func (t *httpTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity, ok := t.authenticate(r)
+	if !ok {
+		logMessage(LogWarning, "http", "Rejected unauthenticated request from %s", r.RemoteAddr)
+		loginFailuresTotal.inc("http")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kubevirt-mcp"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		t.servePost(w, r, identity)
+	case http.MethodDelete:
+		id := r.Header.Get(sessionHeader)
+		if !t.useSession(id, identity) {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		t.mu.Lock()
+		delete(t.sessions, id)
+		t.mu.Unlock()
+		forgetPins("http/" + id)
+		logMessage(LogInfo, "http", "Session of identity %s ended", identity.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "use POST to send JSON-RPC messages", http.StatusMethodNotAllowed)
+	}
+}
+
+// servePost handles a POSTed message or batch and writes back the responses,
+// 202 Accepted when there is none such as for notifications
+func (t *httpTransport) servePost(w http.ResponseWriter, r *http.Request, identity *Identity) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHTTPBody))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	data = bytes.TrimSpace(data)
+	batch := len(data) > 0 && data[0] == '['
+	messages := []json.RawMessage{data}
+	if batch {
+		var rpcErr *RPCError
+		if messages, rpcErr = decodeBatch(data); rpcErr != nil {
+			writeHTTPJSON(w, JSONRPCResponse{JSONRPC: "2.0", ID: nil, Error: rpcErr})
+			return
+		}
+	}
+
+	id := r.Header.Get(sessionHeader)
+	if id == "" {
+		if !startsSession(messages) {
+			http.Error(w, "missing "+sessionHeader+" header, send initialize first", http.StatusBadRequest)
+			return
+		}
+		if id, err = t.startSession(identity); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if !t.useSession(id, identity) {
+		http.Error(w, "unknown session, send initialize again", http.StatusNotFound)
+		return
+	}
+	w.Header().Set(sessionHeader, id)
+
+	// The request context is cancelled when the client disconnects, which
+	// cancels the calls of the POST
+	ctx := withSession(withIdentity(r.Context(), identity), id)
+	responses := make([]*JSONRPCResponse, len(messages))
+	var pending sync.WaitGroup
+	for i, message := range messages {
+		pending.Add(1)
+		go func(i int, message json.RawMessage) {
+			defer pending.Done()
+			responses[i] = t.handleMessage(ctx, message)
+		}(i, message)
+	}
+	pending.Wait()
+
+	var sent []JSONRPCResponse
+	for _, resp := range responses {
+		if resp != nil {
+			sent = append(sent, *resp)
+		}
+	}
+	switch {
+	case len(sent) == 0:
+		w.WriteHeader(http.StatusAccepted)
+	case batch:
+		writeHTTPJSON(w, sent)
+	default:
+		writeHTTPJSON(w, sent[0])
+	}
+}
+
+// handleMessage handles one message like the stdio loop does, returning nil
+// when it gets no response. Cancellations are ignored, an HTTP client
+// cancels by closing the connection.
+func (t *httpTransport) handleMessage(ctx context.Context, message json.RawMessage) *JSONRPCResponse {
+	req, rpcErr := decodeRequest(message)
+	switch {
+	case rpcErr != nil:
+		log.Printf("Failed to decode JSON-RPC request: %s", rpcErr.Message)
+		return &JSONRPCResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+	case req.JSONRPC != "2.0":
+		log.Printf("Invalid JSON-RPC version: %s", req.JSONRPC)
+		return nil
+	case req.Method == "":
+		return &JSONRPCResponse{JSONRPC: "2.0", ID: safeID(req.ID), Error: &RPCError{Code: -32600, Message: "Invalid Request: missing method"}}
+	case isCancellation(req), req.ID == nil && strings.HasPrefix(req.Method, "notifications/"):
+		return nil
+	}
+
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+			defer func() { <-t.slots }()
+		case <-ctx.Done():
+			if shuttingDown(ctx) {
+				resp := shutdownResponse(req)
+				return &resp
+			}
+			return nil
+		}
+	}
+	resp := handleRequest(ctx, req)
+	if shuttingDown(ctx) {
+		if resp.Error != nil {
+			resp = shutdownResponse(req)
+		}
+	} else if ctx.Err() != nil {
+		log.Printf("Request %v cancelled", req.ID)
+		return nil
+	}
+	return &resp
+}
+
+// startsSession reports whether the messages initialize a session
+func startsSession(messages []json.RawMessage) bool {
+	for _, message := range messages {
+		if req, rpcErr := decodeRequest(message); rpcErr == nil && req.Method == "initialize" {
+			return true
+		}
+	}
+	return false
+}
+
+// startSession creates a session of an identity, ending the idle ones
+func (t *httpTransport) startSession(identity *Identity) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate session ID: %v", err)
+	}
+	id := hex.EncodeToString(buf)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for other, session := range t.sessions {
+		if time.Since(session.lastUsed) > httpSessionIdleTimeout {
+			delete(t.sessions, other)
+			forgetPins("http/" + other)
+		}
+	}
+	t.sessions[id] = &httpSession{identity: identity, lastUsed: time.Now()}
+	logMessage(LogInfo, "http", "Session started for identity %s", identity.Name)
+	return id, nil
+}
+
+// useSession reports whether a session exists for the identity and marks
+// it used. The session of another identity is reported as unknown.
+func (t *httpTransport) useSession(id string, identity *Identity) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	session, ok := t.sessions[id]
+	if !ok || session.identity != identity || time.Since(session.lastUsed) > httpSessionIdleTimeout {
+		return false
+	}
+	session.lastUsed = time.Now()
+	return true
+}
+
+// writeHTTPJSON writes a JSON-RPC response or batch of responses
+func writeHTTPJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// identitiesEnv points to the YAML file of the clients allowed on the HTTP
+// transport and the listener, like identities of the http section and the
+// --identities flag
+const identitiesEnv = "KUBEVIRT_MCP_IDENTITIES"
+
+// accessDeniedCode is the JSON-RPC error code of calls the policy of the
+// caller identity refuses
+const accessDeniedCode = -32003
+
+// Identity is a client of the HTTP transport or the listener, authenticated
+// by a bearer token or a client certificate, and the policy applied to its
+// calls
+type Identity struct {
+	Name string `yaml:"name"`
+	// TokenSHA256 is the hex SHA-256 of the bearer token, so the file holds
+	// no usable secret
+	TokenSHA256 string `yaml:"tokenSHA256"`
+	// ClientCN is the common name of the client certificate, verified
+	// against the client CA
+	ClientCN string `yaml:"clientCN"`
+	// Namespaces limits the namespaces of the calls, glob patterns such as
+	// team-a-* are allowed. Empty allows every namespace.
+	Namespaces []string `yaml:"namespaces"`
+	// ReadOnly only allows the tools that leave the cluster and the guests
+	// unchanged
+	ReadOnly bool `yaml:"readOnly"`
+	// Tools limits the tools the identity may call, glob patterns such as
+	// vm_snapshot* are allowed. Empty allows every tool.
+	Tools []string `yaml:"tools"`
+	// DeniedTools are refused even when Tools allows them
+	DeniedTools []string `yaml:"deniedTools"`
+}
+
+// identitiesFile is the layout of the identities file
+type identitiesFile struct {
+	Identities []*Identity `yaml:"identities"`
+}
+
+// readOnlyTools lists the tools read-only identities may call. Tools are
+// considered mutating unless listed, so new tools stay out of reach of
+// read-only identities until reviewed.
+var readOnlyTools = map[string]bool{
+	"cluster_list":                true,
+	"vm_list":                     true,
+	"vm_info":                     true,
+	"vm_events":                   true,
+	"vm_history":                  true,
+	"vm_changes":                  true,
+	"vm_drift":                    true,
+	"vm_search":                   true,
+	"vm_wait_ready":               true,
+	"vm_boot_time":                true,
+	"vm_clock_drift":              true,
+	"vm_quota_check":              true,
+	"vm_memory_overhead":          true,
+	"vm_priority_report":          true,
+	"vm_eviction_report":          true,
+	"vm_validate_template":        true,
+	"vm_console_links":            true,
+	"vm_console_log":              true,
+	"vm_launcher_logs":            true,
+	"vm_file_get":                 true,
+	"vm_snapshot_status":          true,
+	"vm_snapshot_schedule_status": true,
+	"vm_restart_schedule_status":  true,
+	"vmi_migration_status":        true,
+	"dv_status":                   true,
+	"dv_list":                     true,
+	"kubevirt_config":             true,
+	"kubevirt_explain":            true,
+	"kubevirt_health":             true,
+	"kubevirt_certs":              true,
+	"kubevirt_webhooks":           true,
+	"monitor_status":              true,
+	"pin_set":                     true,
+	"pin_list":                    true,
+	"pin_clear":                   true,
+}
+
+// accessDeniedError is returned for calls refused by the policy of the
+// caller identity
+type accessDeniedError struct {
+	err error
+}
+
+func (e *accessDeniedError) Error() string {
+	return "Access denied: " + e.err.Error()
+}
+
+func (e *accessDeniedError) Unwrap() error {
+	return e.err
+}
+
+// identityKey is the context key of the caller identity
+type identityKey struct{}
+
+// withIdentity returns a context carrying the identity of the caller
+func withIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// callerIdentity returns the identity of the caller, none on stdio
+func callerIdentity(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok && identity != nil
+}
+
+// loadIdentities reads and validates the identities file
+func loadIdentities(file string) ([]*Identity, error) {
+	data, err := os.ReadFile(expandHome(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identities: %v", err)
+	}
+	var parsed identitiesFile
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&parsed); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse identities %s: %v", file, err)
+	}
+
+	names := map[string]bool{}
+	for i, identity := range parsed.Identities {
+		if identity == nil || identity.Name == "" {
+			return nil, fmt.Errorf("identity %d has no name", i+1)
+		}
+		if names[identity.Name] {
+			return nil, fmt.Errorf("identity %s is defined twice", identity.Name)
+		}
+		names[identity.Name] = true
+		if identity.TokenSHA256 == "" && identity.ClientCN == "" {
+			return nil, fmt.Errorf("identity %s needs a tokenSHA256 or a clientCN", identity.Name)
+		}
+		if identity.TokenSHA256 != "" {
+			identity.TokenSHA256 = strings.ToLower(identity.TokenSHA256)
+			if sum, err := hex.DecodeString(identity.TokenSHA256); err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("identity %s: tokenSHA256 is not a hex SHA-256", identity.Name)
+			}
+		}
+		for _, pattern := range identity.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("identity %s: invalid namespace pattern %q", identity.Name, pattern)
+			}
+		}
+		for _, pattern := range append(append([]string{}, identity.Tools...), identity.DeniedTools...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("identity %s: invalid tool pattern %q", identity.Name, pattern)
+			}
+			if !strings.ContainsAny(pattern, `*?[\`) {
+				if !toolRegistered(pattern) {
+					return nil, fmt.Errorf("identity %s: unknown tool %s", identity.Name, pattern)
+				}
+			}
+		}
+	}
+	if len(parsed.Identities) == 0 {
+		return nil, fmt.Errorf("%s defines no identity", file)
+	}
+	return parsed.Identities, nil
+}
+
+// identityForToken returns the identity of a bearer token
+func identityForToken(identities []*Identity, token string) (*Identity, bool) {
+	sum := sha256.Sum256([]byte(token))
+	digest := hex.EncodeToString(sum[:])
+	for _, identity := range identities {
+		if identity.TokenSHA256 != "" && subtle.ConstantTimeCompare([]byte(identity.TokenSHA256), []byte(digest)) == 1 {
+			return identity, true
+		}
+	}
+	return nil, false
+}
+
+// identityForCN returns the identity of a verified client certificate
+func identityForCN(identities []*Identity, cn string) (*Identity, bool) {
+	for _, identity := range identities {
+		if identity.ClientCN != "" && identity.ClientCN == cn {
+			return identity, true
+		}
+	}
+	return nil, false
+}
+
+// allowsNamespace reports whether the identity may work in a namespace
+func (i *Identity) allowsNamespace(namespace string) bool {
+	return len(i.Namespaces) == 0 || matchesAny(i.Namespaces, namespace)
+}
+
+// defaultNamespace returns the first namespace of the identity that is not a
+// pattern, used by the calls that set none
+func (i *Identity) defaultNamespace() string {
+	for _, pattern := range i.Namespaces {
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// allowsTool reports whether the identity may call a tool at all, the
+// namespaces of the call are checked by authorizeToolCall
+func (i *Identity) allowsTool(tool Tool) bool {
+	return i.toolRefusal(tool) == ""
+}
+
+// toolRefusal returns why the identity may not call a tool, empty when it may
+func (i *Identity) toolRefusal(tool Tool) string {
+	if len(i.Tools) > 0 && !matchesAny(i.Tools, tool.Name) {
+		return fmt.Sprintf("identity %s may not call %s", i.Name, tool.Name)
+	}
+	if matchesAny(i.DeniedTools, tool.Name) {
+		return fmt.Sprintf("identity %s may not call %s", i.Name, tool.Name)
+	}
+	if readOnlyTools[tool.Name] {
+		return ""
+	}
+	if i.ReadOnly {
+		return fmt.Sprintf("identity %s is read-only and %s changes the cluster", i.Name, tool.Name)
+	}
+	// Mutating tools without a namespace act on the whole cluster
+	if len(i.Namespaces) > 0 && !hasNamespaceArgument(tool) {
+		return fmt.Sprintf("identity %s is limited to namespaces and %s acts on the whole cluster", i.Name, tool.Name)
+	}
+	return ""
+}
+
+// matchesAny reports whether a name matches one of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNamespaceArgument reports whether a tool takes a namespace argument
+func hasNamespaceArgument(tool Tool) bool {
+	properties, ok := tool.InputSchema["properties"].(map[string]interface{})
+	return ok && properties["namespace"] != nil
+}
+
+// identityTools filters tools/list down to the tools the caller may call
+func identityTools(ctx context.Context, tools []map[string]interface{}) []map[string]interface{} {
+	identity, ok := callerIdentity(ctx)
+	if !ok {
+		return tools
+	}
+	allowed := make([]map[string]interface{}, 0, len(tools))
+	for _, definition := range tools {
+		if tool, ok := lookupTool(definition["name"].(string)); ok && identity.allowsTool(tool) {
+			allowed = append(allowed, definition)
+		}
+	}
+	return allowed
+}
+
+// authorizeToolCall applies the policy of the caller identity to a tool
+// call: identities only reach the tools they are allowed, read-only ones
+// only readOnlyTools, and identities limited to namespaces must name an
+// allowed namespace. Calls on stdio have no identity and are not restricted.
+func authorizeToolCall(ctx context.Context, tool Tool, args json.RawMessage) error {
+	identity, ok := callerIdentity(ctx)
+	if !ok {
+		return nil
+	}
+	if refusal := identity.toolRefusal(tool); refusal != "" {
+		return &accessDeniedError{err: errors.New(refusal)}
+	}
+	if len(identity.Namespaces) == 0 || !hasNamespaceArgument(tool) {
+		return nil
+	}
+
+	var params struct {
+		Namespace     string `json:"namespace"`
+		AllNamespaces bool   `json:"all_namespaces"`
+		Manifest      string `json:"manifest"`
+	}
+	json.Unmarshal(args, &params)
+	if params.AllNamespaces {
+		return &accessDeniedError{err: fmt.Errorf("identity %s is limited to namespaces %s, all_namespaces is not allowed", identity.Name, strings.Join(identity.Namespaces, ", "))}
+	}
+	// Without a namespace some tools default to default and others to every
+	// namespace, both of which may be out of reach
+	if params.Namespace == "" {
+		return &invalidParamsError{err: fmt.Errorf("namespace is required, identity %s is limited to namespaces %s", identity.Name, strings.Join(identity.Namespaces, ", "))}
+	}
+	namespaces := []string{params.Namespace}
+
+	// Manifest objects can set their own namespace
+	if tool.Name == "kubevirt_apply" && params.Manifest != "" {
+		objects, err := parseManifest(params.Manifest, params.Namespace)
+		if err != nil {
+			return &invalidParamsError{err: err}
+		}
+		for _, obj := range objects {
+			metadata := obj["metadata"].(map[string]interface{})
+			namespace, _ := metadata["namespace"].(string)
+			if namespace == "" {
+				return &accessDeniedError{err: fmt.Errorf("identity %s is limited to namespaces %s, cluster-scoped %s %v cannot be applied", identity.Name, strings.Join(identity.Namespaces, ", "), obj["kind"], metadata["name"])}
+			}
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	for _, namespace := range namespaces {
+		if !identity.allowsNamespace(namespace) {
+			return &accessDeniedError{err: fmt.Errorf("identity %s may not use namespace %s", identity.Name, namespace)}
+		}
+	}
+	return nil
+}
+
+// identityResource reports whether the caller may see a resource: VM
+// histories of its namespaces and the raw results of its own calls
+func identityResource(ctx context.Context, uri, owner string) bool {
+	identity, ok := callerIdentity(ctx)
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(uri, historyScheme) {
+		namespace, _, _ := strings.Cut(strings.TrimPrefix(uri, historyScheme), "/")
+		return identity.allowsNamespace(namespace)
+	}
+	if strings.HasPrefix(uri, rawResultsScheme) {
+		return owner == identity.Name
+	}
+	return true
+}
+
+// identityName returns the name of the caller identity, empty on stdio
+func identityName(ctx context.Context) string {
+	if identity, ok := callerIdentity(ctx); ok {
+		return identity.Name
+	}
+	return ""
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPrepullHelperImage provides the static busybox binary copied
+	// into the pod, containerdisk images have no shell or binary to run
+	defaultPrepullHelperImage = "quay.io/quay/busybox:latest"
+	defaultPrepullTimeout     = 600
+
+	// prepullLabel selects the pods of a pre-pull DaemonSet
+	prepullLabel = "kubevirt-mcp/prepull"
+
+	// prepullToolsDir is where the helper binary is copied to in every
+	// container of the pod
+	prepullToolsDir = "/kubevirt-mcp"
+)
+
+// ImagePrepullParams represents the parameters of image_prepull
+type ImagePrepullParams struct {
+	Namespace    string            `json:"namespace,omitempty"`
+	Images       []string          `json:"images"`
+	Nodes        []string          `json:"nodes,omitempty"`
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	HelperImage  string            `json:"helper_image,omitempty"`
+	Timeout      int               `json:"timeout,omitempty"`
+	Format       string            `json:"format,omitempty"`
+}
+
+// PrepullNode reports the pre-pull on a node
+type PrepullNode struct {
+	Node   string `json:"node"`
+	Pulled bool   `json:"pulled"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ImagePrepullResult is the image_prepull tool result
+type ImagePrepullResult struct {
+	Images   []string      `json:"images"`
+	Nodes    []PrepullNode `json:"nodes"`
+	Pulled   int           `json:"pulled"`
+	Duration string        `json:"duration"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "image_prepull",
+		Description: "Pre-pull containerdisk images onto all nodes, or the selected ones, with a temporary DaemonSet, so later VM starts do not wait for the registry. Reports the nodes where pulling failed",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Namespace to create the temporary DaemonSet in",
+					"default":     "default",
+				},
+				"images": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Images to pull, e.g. quay.io/containerdisks/fedora:latest",
+				},
+				"nodes": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Only pull on these nodes (default: every node, including tainted ones)",
+				},
+				"node_selector": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": map[string]interface{}{"type": "string"},
+					"description":          "Only pull on the nodes with these labels",
+				},
+				"helper_image": map[string]interface{}{
+					"type":        "string",
+					"description": "Image providing a static /bin/busybox, run from the pulled images since containerdisks have no binaries",
+					"default":     defaultPrepullHelperImage,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for pulling on every node (default: 600)",
+					"default":     defaultPrepullTimeout,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"images"},
+		},
+		Handler: handleImagePrepull,
+	})
+}
+
+// handleImagePrepull is the tools/call handler for image_prepull
+func handleImagePrepull(ctx context.Context, args json.RawMessage) (string, error) {
+	var params ImagePrepullParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if len(params.Images) == 0 {
+		return "", missingArgument("images")
+	}
+	for _, image := range params.Images {
+		if strings.TrimSpace(image) == "" || strings.ContainsAny(image, " \t\n") {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid image '%s'", image)}
+		}
+	}
+	if params.Timeout < 0 {
+		return "", &invalidParamsError{err: errors.New("timeout cannot be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.HelperImage == "" {
+		params.HelperImage = defaultPrepullHelperImage
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultPrepullTimeout
+	}
+
+	result, err := prepullImages(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// prepullDaemonSet returns the DaemonSet pulling the images. Its first init
+// container copies busybox into a shared volume, then every image runs it
+// as an init container that exits right away. The pod is ready once all the
+// images are pulled.
+func prepullDaemonSet(name string, params ImagePrepullParams) map[string]interface{} {
+	labels := managedLabels("image_prepull", true)
+	labels[prepullLabel] = name
+	tools := []map[string]interface{}{{"name": "tools", "mountPath": prepullToolsDir}}
+
+	initContainers := []map[string]interface{}{{
+		"name":         "tools",
+		"image":        params.HelperImage,
+		"command":      []string{"/bin/busybox", "cp", "/bin/busybox", prepullToolsDir + "/busybox"},
+		"volumeMounts": tools,
+	}}
+	for i, image := range params.Images {
+		initContainers = append(initContainers, map[string]interface{}{
+			"name":            fmt.Sprintf("image-%d", i),
+			"image":           image,
+			"imagePullPolicy": "IfNotPresent",
+			"command":         []string{prepullToolsDir + "/busybox", "true"},
+			"volumeMounts":    tools,
+		})
+	}
+
+	podSpec := map[string]interface{}{
+		"terminationGracePeriodSeconds": 0,
+		// Pull on tainted nodes too, e.g. the control plane of kubevirtci
+		"tolerations":    []map[string]interface{}{{"operator": "Exists"}},
+		"initContainers": initContainers,
+		"containers": []map[string]interface{}{{
+			"name":    "pulled",
+			"image":   params.HelperImage,
+			"command": []string{"/bin/busybox", "sleep", "2147483647"},
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{"cpu": "1m", "memory": "4Mi"},
+			},
+		}},
+		"volumes": []map[string]interface{}{{"name": "tools", "emptyDir": map[string]interface{}{}}},
+	}
+	if len(params.NodeSelector) > 0 {
+		podSpec["nodeSelector"] = params.NodeSelector
+	}
+	if len(params.Nodes) > 0 {
+		podSpec["affinity"] = map[string]interface{}{
+			"nodeAffinity": map[string]interface{}{
+				"requiredDuringSchedulingIgnoredDuringExecution": map[string]interface{}{
+					"nodeSelectorTerms": []map[string]interface{}{{
+						"matchFields": []map[string]interface{}{{"key": "metadata.name", "operator": "In", "values": params.Nodes}},
+					}},
+				},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "DaemonSet",
+		"metadata":   map[string]interface{}{"name": name, "namespace": params.Namespace, "labels": labels},
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{"matchLabels": map[string]string{prepullLabel: name}},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec":     podSpec,
+			},
+		},
+	}
+}
+
+// prepullDaemonSetStatus holds the status fields of the DaemonSet
+type prepullDaemonSetStatus struct {
+	Metadata struct {
+		Generation int64 `json:"generation"`
+	} `json:"metadata"`
+	Status struct {
+		ObservedGeneration     int64 `json:"observedGeneration"`
+		DesiredNumberScheduled int   `json:"desiredNumberScheduled"`
+		NumberReady            int   `json:"numberReady"`
+	} `json:"status"`
+}
+
+// prepullPod holds the fields of a pre-pull pod needed to report its node
+type prepullPod struct {
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase                 string                   `json:"phase"`
+		InitContainerStatuses []prepullContainerStatus `json:"initContainerStatuses"`
+		ContainerStatuses     []prepullContainerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type prepullContainerStatus struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Ready bool   `json:"ready"`
+	State struct {
+		Waiting *struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"waiting"`
+		Terminated *struct {
+			ExitCode int    `json:"exitCode"`
+			Reason   string `json:"reason"`
+		} `json:"terminated"`
+	} `json:"state"`
+}
+
+// prepullImages creates the DaemonSet, waits until its pods are ready on
+// every selected node and always deletes it afterwards. The images stay in
+// the node caches.
+func prepullImages(ctx context.Context, params ImagePrepullParams) (*ImagePrepullResult, error) {
+	name := generateName("kubevirt-mcp-prepull-")
+	timeout := time.Duration(params.Timeout) * time.Second
+	start := clock.Now()
+
+	if err := createObject(ctx, prepullDaemonSet(name, params)); err != nil {
+		return nil, fmt.Errorf("failed to create pre-pull DaemonSet: %v", err)
+	}
+	// Cleanup also runs when the tool call was cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer runKubectl(cleanupCtx, "delete", "daemonset", name, "-n", params.Namespace, "--ignore-not-found", "--wait=false")
+
+	deadline := start.Add(timeout)
+	for {
+		var ds prepullDaemonSetStatus
+		if err := runKubectlJSON(ctx, &ds, "get", "daemonset", name, "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		observed := ds.Status.ObservedGeneration >= ds.Metadata.Generation && ds.Metadata.Generation > 0
+		if observed && ds.Status.DesiredNumberScheduled == 0 {
+			return nil, errors.New("no node matches the selected nodes")
+		}
+		if observed && ds.Status.NumberReady == ds.Status.DesiredNumberScheduled {
+			break
+		}
+		reportProgress(ctx, "pulled on %d of %d nodes", ds.Status.NumberReady, ds.Status.DesiredNumberScheduled)
+
+		if clock.Now().After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for the images to be pulled cancelled")
+		case <-clock.After(5 * time.Second):
+		}
+	}
+
+	var pods struct {
+		Items []prepullPod `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &pods, "get", "pods", "-n", params.Namespace, "-l", prepullLabel+"="+name); err != nil {
+		return nil, err
+	}
+
+	result := &ImagePrepullResult{Images: params.Images, Nodes: []PrepullNode{}, Duration: humanDuration(clock.Now().Sub(start))}
+	for _, pod := range pods.Items {
+		node := PrepullNode{Node: pod.Spec.NodeName, Error: prepullPodError(pod, params)}
+		node.Pulled = node.Error == "" && len(pod.Status.ContainerStatuses) > 0 && pod.Status.ContainerStatuses[0].Ready
+		if node.Pulled {
+			result.Pulled++
+		} else if node.Error == "" {
+			node.Error = fmt.Sprintf("not pulled within %v (pod %s)", timeout, strings.ToLower(pod.Status.Phase))
+		}
+		result.Nodes = append(result.Nodes, node)
+	}
+	sort.Slice(result.Nodes, func(i, j int) bool { return result.Nodes[i].Node < result.Nodes[j].Node })
+	return result, nil
+}
+
+// prepullPodError describes why a pre-pull pod is stuck, e.g. an image that
+// cannot be pulled or a helper image without a static busybox
+func prepullPodError(pod prepullPod, params ImagePrepullParams) string {
+	for _, status := range pod.Status.InitContainerStatuses {
+		image := status.Image
+		if i, err := strconv.Atoi(strings.TrimPrefix(status.Name, "image-")); err == nil && i < len(params.Images) {
+			image = params.Images[i]
+		}
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" && waiting.Reason != "PodInitializing" {
+			return strings.TrimSpace(fmt.Sprintf("%s: %s %s", image, waiting.Reason, waiting.Message))
+		}
+		if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+			return fmt.Sprintf("%s: container exited with code %d (%s)", image, terminated.ExitCode, terminated.Reason)
+		}
+	}
+	return ""
+}
+
+// tables renders the pre-pull result per node
+func (r *ImagePrepullResult) tables() []table {
+	nodes := table{
+		title:   fmt.Sprintf("Pulled on %d of %d nodes in %s", r.Pulled, len(r.Nodes), r.Duration),
+		headers: []string{"NODE", "PULLED", "ERROR"},
+	}
+	for _, n := range r.Nodes {
+		nodes.rows = append(nodes.rows, []string{n.Node, strconv.FormatBool(n.Pulled), n.Error})
+	}
+	images := table{title: "Images", headers: []string{"IMAGE"}}
+	for _, image := range r.Images {
+		images.rows = append(images.rows, []string{image})
+	}
+	return []table{nodes, images}
+}
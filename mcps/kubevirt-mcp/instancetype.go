@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels virt-controller sets on the ControllerRevisions of instance types
+// and preferences
+const (
+	revisionObjectNameLabel       = "instancetype.kubevirt.io/object-name"
+	revisionObjectKindLabel       = "instancetype.kubevirt.io/object-kind"
+	revisionObjectGenerationLabel = "instancetype.kubevirt.io/object-generation"
+	revisionObjectVersionLabel    = "instancetype.kubevirt.io/object-version"
+)
+
+// maxPinChanges bounds the changed fields listed per drifted pin
+const maxPinChanges = 20
+
+// instancetypeMatchers are the VM spec fields referencing an instance type or
+// a preference, with the kind used when the matcher has none
+var instancetypeMatchers = []struct {
+	field       string
+	defaultKind string
+}{
+	{"instancetype", "VirtualMachineClusterInstancetype"},
+	{"preference", "VirtualMachineClusterPreference"},
+}
+
+// VMInstancetypeParams represents the parameters of vm_instancetype
+type VMInstancetypeParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name,omitempty"`
+	Repin     bool   `json:"repin,omitempty"`
+	Confirm   bool   `json:"confirm,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// InstancetypePin is the ControllerRevision an instance type or preference of
+// a VM is pinned to, compared with the object as it is now
+type InstancetypePin struct {
+	Matcher           string   `json:"matcher"`
+	Kind              string   `json:"kind"`
+	Name              string   `json:"name"`
+	RevisionName      string   `json:"revisionName,omitempty"`
+	PinnedVersion     string   `json:"pinnedVersion,omitempty"`
+	PinnedGeneration  int64    `json:"pinnedGeneration,omitempty"`
+	CurrentGeneration int64    `json:"currentGeneration,omitempty"`
+	Drifted           bool     `json:"drifted"`
+	Changes           []string `json:"changes,omitempty"`
+	Problem           string   `json:"problem,omitempty"`
+	Repinned          bool     `json:"repinned,omitempty"`
+	NewRevisionName   string   `json:"newRevisionName,omitempty"`
+}
+
+// VMInstancetypePins holds the pins of one VM
+type VMInstancetypePins struct {
+	Name            string            `json:"name"`
+	Pins            []InstancetypePin `json:"pins"`
+	RestartRequired bool              `json:"restartRequired,omitempty"`
+	Diff            string            `json:"diff,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// VMInstancetypeResult is the vm_instancetype tool result
+type VMInstancetypeResult struct {
+	Namespace string               `json:"namespace"`
+	Repin     bool                 `json:"repin,omitempty"`
+	Confirmed bool                 `json:"confirmed,omitempty"`
+	VMs       []VMInstancetypePins `json:"vms"`
+	Drifted   int                  `json:"drifted"`
+	Notes     []string             `json:"notes,omitempty"`
+}
+
+// instancetypeMatcher is the instancetype or preference field of a VM spec
+type instancetypeMatcher struct {
+	Name         string `json:"name"`
+	Kind         string `json:"kind,omitempty"`
+	RevisionName string `json:"revisionName,omitempty"`
+}
+
+// instancetypeStatusRef is the instancetypeRef or preferenceRef of a VM
+// status, where newer KubeVirt versions record the pinned revision
+type instancetypeStatusRef struct {
+	Name                  string `json:"name"`
+	Kind                  string `json:"kind,omitempty"`
+	ControllerRevisionRef *struct {
+		Name string `json:"name"`
+	} `json:"controllerRevisionRef,omitempty"`
+}
+
+// instancetypeVM holds the fields of a VM referencing instance types
+type instancetypeVM struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Instancetype *instancetypeMatcher `json:"instancetype,omitempty"`
+		Preference   *instancetypeMatcher `json:"preference,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		InstancetypeRef *instancetypeStatusRef `json:"instancetypeRef,omitempty"`
+		PreferenceRef   *instancetypeStatusRef `json:"preferenceRef,omitempty"`
+		Conditions      []Condition            `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// matcher returns the matcher of a VM spec field and the revision it is
+// pinned to, from the spec or else the status
+func (vm *instancetypeVM) matcher(field string) (*instancetypeMatcher, string) {
+	matcher, ref := vm.Spec.Instancetype, vm.Status.InstancetypeRef
+	if field == "preference" {
+		matcher, ref = vm.Spec.Preference, vm.Status.PreferenceRef
+	}
+	if matcher == nil {
+		return nil, ""
+	}
+	revision := matcher.RevisionName
+	if revision == "" && ref != nil && ref.ControllerRevisionRef != nil {
+		revision = ref.ControllerRevisionRef.Name
+	}
+	return matcher, revision
+}
+
+// usesInstancetypes reports whether the VM references an instance type or a
+// preference
+func (vm *instancetypeVM) usesInstancetypes() bool {
+	return vm.Spec.Instancetype != nil || vm.Spec.Preference != nil
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_instancetype",
+		Description: "Show the ControllerRevisions the instance type and preference of VMs are pinned to, and whether the instance type or preference changed since (drift) with the changed fields. With repin and confirm, re-pins a VM to the latest version by clearing its revisionName so virt-controller captures a new revision",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VMs",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM; without it every VM of the namespace using an instance type or preference is reported",
+				},
+				"repin": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Re-pin the drifted instance type and preference of vm_name to their latest version. Running VMs get it on their next restart",
+					"default":     false,
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Must be true with repin to patch the VM; without it repin only previews the change",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleVMInstancetype,
+	})
+}
+
+// handleVMInstancetype is the tools/call handler for vm_instancetype
+func handleVMInstancetype(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMInstancetypeParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Repin && params.VMName == "" {
+		return "", &invalidParamsError{err: errors.New("repin needs vm_name, VMs are re-pinned one at a time")}
+	}
+	if params.Confirm && !params.Repin {
+		return "", &invalidParamsError{err: errors.New("confirm only applies to repin")}
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := vmInstancetypes(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// vmInstancetypes inspects the pins of the VMs and re-pins vm_name when
+// asked to
+func vmInstancetypes(ctx context.Context, params VMInstancetypeParams) (*VMInstancetypeResult, error) {
+	var vms []instancetypeVM
+	if params.VMName != "" {
+		var vm instancetypeVM
+		if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		if !vm.usesInstancetypes() {
+			return nil, &invalidParamsError{err: fmt.Errorf("VM %s/%s has no instancetype or preference", params.Namespace, params.VMName)}
+		}
+		vms = append(vms, vm)
+	} else {
+		var list struct {
+			Items []instancetypeVM `json:"items"`
+		}
+		if err := runKubectlJSON(ctx, &list, "get", "virtualmachines", "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		for _, vm := range list.Items {
+			if vm.usesInstancetypes() {
+				vms = append(vms, vm)
+			}
+		}
+	}
+
+	result := &VMInstancetypeResult{Namespace: params.Namespace, Repin: params.Repin, Confirmed: params.Repin && params.Confirm, VMs: []VMInstancetypePins{}}
+	for i := range vms {
+		vm := &vms[i]
+		reportProgress(ctx, "inspecting %s (%d/%d)", vm.Metadata.Name, i+1, len(vms))
+		pins := VMInstancetypePins{Name: vm.Metadata.Name, Pins: []InstancetypePin{}}
+		for _, m := range instancetypeMatchers {
+			matcher, revision := vm.matcher(m.field)
+			if matcher == nil {
+				continue
+			}
+			pin := inspectPin(ctx, params.Namespace, m.field, m.defaultKind, matcher, revision)
+			if pin.Drifted {
+				result.Drifted++
+			}
+			pins.Pins = append(pins.Pins, pin)
+		}
+		if params.Repin {
+			repinVM(ctx, params, vm, &pins)
+		}
+		result.VMs = append(result.VMs, pins)
+	}
+
+	switch {
+	case len(vms) == 0:
+		result.Notes = append(result.Notes, "No VM of the namespace uses an instance type or preference")
+	case params.Repin && !params.Confirm:
+		result.Notes = append(result.Notes, "Preview only, set confirm to true to re-pin the drifted instance type and preference")
+	case params.Repin:
+		result.Notes = append(result.Notes, "The VMI keeps the old revision until the VM restarts; check restartRequired and restart it when convenient")
+	case result.Drifted > 0:
+		result.Notes = append(result.Notes, "Drifted VMs keep the pinned revision, on restart too; re-pin one with repin and confirm to move it to the latest version")
+	}
+	return result, nil
+}
+
+// inspectPin compares the ControllerRevision a matcher is pinned to with the
+// current instance type or preference
+func inspectPin(ctx context.Context, namespace, field, defaultKind string, matcher *instancetypeMatcher, revisionName string) InstancetypePin {
+	pin := InstancetypePin{Matcher: field, Kind: matcher.Kind, Name: matcher.Name, RevisionName: revisionName}
+	if pin.Kind == "" {
+		pin.Kind = defaultKind
+	}
+	if revisionName == "" {
+		pin.Problem = "Not pinned yet, virt-controller pins the current version when it reconciles the VM"
+		return pin
+	}
+
+	var revision controllerRevision
+	if err := runKubectlJSON(ctx, &revision, "get", "controllerrevision", revisionName, "-n", namespace); err != nil {
+		pin.Problem = fmt.Sprintf("Pinned revision unavailable: %v", err)
+		return pin
+	}
+	pinnedSpec, ok := revision.Data["spec"].(map[string]interface{})
+	if !ok {
+		pin.Problem = fmt.Sprintf("Revision %s holds no %s spec", revisionName, pin.Kind)
+		return pin
+	}
+	labels := revision.Metadata.Labels
+	pin.PinnedVersion = labels[revisionObjectVersionLabel]
+	if pin.PinnedVersion == "" {
+		pin.PinnedVersion, _ = revision.Data["apiVersion"].(string)
+	}
+	pin.PinnedGeneration, _ = strconv.ParseInt(labels[revisionObjectGenerationLabel], 10, 64)
+	if metadata, ok := revision.Data["metadata"].(map[string]interface{}); ok && pin.PinnedGeneration == 0 {
+		if generation, ok := metadata["generation"].(float64); ok {
+			pin.PinnedGeneration = int64(generation)
+		}
+	}
+
+	args := []string{"get", strings.ToLower(pin.Kind), pin.Name}
+	if !strings.Contains(pin.Kind, "Cluster") {
+		args = append(args, "-n", namespace)
+	}
+	var current struct {
+		Metadata struct {
+			Generation int64 `json:"generation"`
+		} `json:"metadata"`
+		Spec map[string]interface{} `json:"spec"`
+	}
+	if err := runKubectlJSON(ctx, &current, args...); err != nil {
+		pin.Problem = fmt.Sprintf("The %s is gone, the VM keeps using its pinned revision: %v", pin.Kind, err)
+		return pin
+	}
+	pin.CurrentGeneration = current.Metadata.Generation
+
+	pin.Changes = specChanges(pinnedSpec, current.Spec)
+	pin.Drifted = len(pin.Changes) > 0
+	if len(pin.Changes) > maxPinChanges {
+		pin.Changes = append(pin.Changes[:maxPinChanges], fmt.Sprintf("and %d more", len(pin.Changes)-maxPinChanges))
+	}
+	return pin
+}
+
+// repinVM clears the revisionName of the drifted matchers of a VM, so
+// virt-controller pins their latest version, unless it is a preview
+func repinVM(ctx context.Context, params VMInstancetypeParams, vm *instancetypeVM, pins *VMInstancetypePins) {
+	spec := map[string]interface{}{}
+	for _, pin := range pins.Pins {
+		if pin.Drifted {
+			spec[pin.Matcher] = map[string]interface{}{"revisionName": nil}
+		}
+	}
+	if len(spec) == 0 || !params.Confirm {
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{"spec": spec})
+	if err != nil {
+		pins.Error = fmt.Sprintf("failed to encode patch: %v", err)
+		return
+	}
+	diff, err := mutationDiff(ctx, "virtualmachine", vm.Metadata.Name, params.Namespace, func() error {
+		_, err := runKubectl(ctx, "patch", "virtualmachine", vm.Metadata.Name, "-n", params.Namespace, "--type=merge", "-p", string(patch))
+		return err
+	})
+	if err != nil {
+		pins.Error = err.Error()
+		return
+	}
+	pins.Diff = diff
+	logMessage(LogInfo, "instancetype", "Re-pinned %s of %s/%s", strings.Join(sortedKeys(spec), " and "), params.Namespace, vm.Metadata.Name)
+
+	var updated instancetypeVM
+	if err := runKubectlJSON(ctx, &updated, "get", "virtualmachine", vm.Metadata.Name, "-n", params.Namespace); err != nil {
+		return
+	}
+	pins.RestartRequired = conditionStatus(updated.Status.Conditions, "RestartRequired") == "True"
+	for i := range pins.Pins {
+		pin := &pins.Pins[i]
+		if _, ok := spec[pin.Matcher]; !ok {
+			continue
+		}
+		pin.Repinned = true
+		if _, revision := updated.matcher(pin.Matcher); revision != pin.RevisionName {
+			pin.NewRevisionName = revision
+		}
+	}
+}
+
+// specChanges lists the fields differing between the pinned and the current
+// spec, as "path: pinned -> current"
+func specChanges(pinned, current map[string]interface{}) []string {
+	before, after := map[string]interface{}{}, map[string]interface{}{}
+	specLeaves("spec", pinned, before)
+	specLeaves("spec", current, after)
+	paths := sortedKeys(before)
+	for path := range after {
+		if _, ok := before[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var changes []string
+	for _, path := range paths {
+		old, hadOld := before[path]
+		now, hasNow := after[path]
+		if hadOld && hasNow && reflect.DeepEqual(old, now) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", path, leafValue(old, hadOld), leafValue(now, hasNow)))
+	}
+	return changes
+}
+
+// specLeaves flattens a spec into its leaf values by path. Lists are leaves,
+// their order matters.
+func specLeaves(path string, value interface{}, leaves map[string]interface{}) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		leaves[path] = value
+		return
+	}
+	for key, child := range m {
+		specLeaves(path+"."+key, child, leaves)
+	}
+}
+
+// leafValue renders a leaf of specChanges, (none) when it is not set
+func leafValue(value interface{}, set bool) string {
+	if !set {
+		return "(none)"
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// tables renders the pins of the VMs
+func (r *VMInstancetypeResult) tables() []table {
+	pins := table{title: fmt.Sprintf("Instance type pins in %s (%d drifted)", r.Namespace, r.Drifted), headers: []string{"VM", "MATCHER", "KIND", "NAME", "REVISION", "GENERATION", "DRIFTED", "CHANGES"}}
+	for _, vm := range r.VMs {
+		for _, pin := range vm.Pins {
+			generation := ""
+			if pin.PinnedGeneration != 0 || pin.CurrentGeneration != 0 {
+				generation = fmt.Sprintf("%d/%d", pin.PinnedGeneration, pin.CurrentGeneration)
+			}
+			revision := pin.RevisionName
+			if pin.NewRevisionName != "" {
+				revision += " -> " + pin.NewRevisionName
+			}
+			changes := pin.Changes
+			if len(changes) > 3 {
+				changes = append(changes[:3:3], fmt.Sprintf("+%d", len(pin.Changes)-3))
+			}
+			detail := strings.Join(changes, "; ")
+			if pin.Problem != "" {
+				detail = pin.Problem
+			}
+			pins.rows = append(pins.rows, []string{vm.Name, pin.Matcher, pin.Kind, pin.Name, revision, generation, strconv.FormatBool(pin.Drifted), detail})
+		}
+		if vm.Error != "" {
+			pins.rows = append(pins.rows, []string{vm.Name, "", "", "", "", "", "", "Error: " + vm.Error})
+		}
+	}
+	tables := []table{pins}
+	if len(r.Notes) > 0 {
+		notes := table{title: "Notes", headers: []string{"NOTE"}}
+		for _, note := range r.Notes {
+			notes.rows = append(notes.rows, []string{note})
+		}
+		tables = append(tables, notes)
+	}
+	return tables
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runKubectl runs kubectl against the cluster selected for the tool call and
+// returns its stdout. Without a selected cluster the kubeconfig is resolved
+// with findKubeconfigPath; when none is found kubectl falls back to in-cluster
+// authentication.
+func runKubectl(ctx context.Context, args ...string) ([]byte, error) {
+	return runKubectlWithInput(ctx, nil, args...)
+}
+
+// runKubectlWithInput is like runKubectl but feeds input to kubectl's stdin,
+// e.g. a manifest for "kubectl create -f -"
+func runKubectlWithInput(ctx context.Context, input []byte, args ...string) ([]byte, error) {
+	return runKubectlContext(ctx, timeoutFor(timeoutKubectl), input, args...)
+}
+
+// runKubectlContext runs kubectl until it completes, the timeout expires or
+// ctx is cancelled, e.g. because the client cancelled the tool call. The
+// timeout is for long running commands such as "kubectl wait".
+func runKubectlContext(parent context.Context, timeout time.Duration, input []byte, args ...string) ([]byte, error) {
+	ctx, cancel := clock.WithTimeout(parent, timeout)
+	defer cancel()
+
+	args = append(kubeconfigArgs(parent), args...)
+
+	logMessage(LogDebug, "kubectl", "kubectl %s", strings.Join(args, " "))
+
+	output, _, err := recorded(parent, "kubectl", args, input, func() (string, string, error) {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "kubectl", args...)
+		cmd.Stderr = &stderr
+		if input != nil {
+			cmd.Stdin = bytes.NewReader(input)
+		}
+
+		output, err := cmd.Output()
+		if err != nil {
+			if parent.Err() != nil {
+				return "", "", fmt.Errorf("kubectl %s cancelled", strings.Join(args, " "))
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return "", "", fmt.Errorf("kubectl %s timed out after %v", strings.Join(args, " "), timeout)
+			}
+			return "", "", fmt.Errorf("kubectl %s failed: %v\nOutput: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		return string(output), "", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(output), nil
+}
+
+// runKubectlJSON runs kubectl with "-o json" and decodes the output into v
+func runKubectlJSON(ctx context.Context, v interface{}, args ...string) error {
+	output, err := runKubectl(ctx, append(args, "-o", "json")...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(output, v); err != nil {
+		return fmt.Errorf("failed to parse kubectl output: %v", err)
+	}
+	return nil
+}
+
+// namespaceArgs returns the kubectl namespace flags for a tool call.
+// An empty namespace selects "default" unless allNamespaces is set.
+func namespaceArgs(namespace string, allNamespaces bool) []string {
+	if allNamespaces {
+		return []string{"--all-namespaces"}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return []string{"-n", namespace}
+}
+
+// createObject creates the given object with "kubectl create -f -"
+func createObject(ctx context.Context, obj interface{}) error {
+	manifest, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	_, err = runKubectlWithInput(ctx, manifest, "create", "-f", "-")
+	return err
+}
+
+// waitFor blocks until the resource meets the condition, using "kubectl wait".
+// condition is passed to --for, e.g. "condition=Ready" or "delete".
+func waitFor(ctx context.Context, namespace, resource, condition string, timeout time.Duration) error {
+	args := []string{"wait", "-n", namespace, resource, "--for=" + condition, fmt.Sprintf("--timeout=%ds", int(timeout.Seconds()))}
+	// Give kubectl a little longer than its own timeout so it can report the failure
+	_, err := runKubectlContext(ctx, timeout+10*time.Second, nil, args...)
+	return err
+}
+
+// formatJSON renders a tool result as indented JSON text
+func formatJSON(v interface{}) (string, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode result: %v", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The types below mirror the subset of the KubeVirt API that the tools read
+// from "kubectl -o json" output. They intentionally avoid depending on the
+// kubevirt.io/api module to keep the MCP server lightweight.
+
+type ObjectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace,omitempty"`
+	UID               string            `json:"uid,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	CreationTimestamp time.Time         `json:"creationTimestamp,omitempty"`
+}
+
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime,omitempty"`
+}
+
+type Volume struct {
+	Name          string `json:"name"`
+	ContainerDisk *struct {
+		Image string `json:"image"`
+	} `json:"containerDisk,omitempty"`
+	DataVolume *struct {
+		Name string `json:"name"`
+	} `json:"dataVolume,omitempty"`
+	PersistentVolumeClaim *struct {
+		ClaimName string `json:"claimName"`
+	} `json:"persistentVolumeClaim,omitempty"`
+	CloudInitNoCloud     *struct{} `json:"cloudInitNoCloud,omitempty"`
+	CloudInitConfigDrive *struct{} `json:"cloudInitConfigDrive,omitempty"`
+	EmptyDisk            *struct {
+		Capacity string `json:"capacity"`
+	} `json:"emptyDisk,omitempty"`
+	Secret *struct {
+		SecretName string `json:"secretName"`
+	} `json:"secret,omitempty"`
+	ConfigMap *struct {
+		Name string `json:"name"`
+	} `json:"configMap,omitempty"`
+}
+
+type VolumeStatus struct {
+	Name                      string `json:"name"`
+	Target                    string `json:"target,omitempty"`
+	Phase                     string `json:"phase,omitempty"`
+	Reason                    string `json:"reason,omitempty"`
+	PersistentVolumeClaimInfo *struct {
+		Capacity map[string]string `json:"capacity,omitempty"`
+	} `json:"persistentVolumeClaimInfo,omitempty"`
+}
+
+type CPUTopology struct {
+	Sockets int `json:"sockets,omitempty"`
+	Cores   int `json:"cores,omitempty"`
+	Threads int `json:"threads,omitempty"`
+}
+
+type DomainSpec struct {
+	CPU    *CPUTopology `json:"cpu,omitempty"`
+	Memory *struct {
+		Guest string `json:"guest,omitempty"`
+	} `json:"memory,omitempty"`
+	Resources struct {
+		Requests map[string]string `json:"requests,omitempty"`
+		Limits   map[string]string `json:"limits,omitempty"`
+	} `json:"resources,omitempty"`
+}
+
+type VMIInterface struct {
+	Name          string   `json:"name,omitempty"`
+	InterfaceName string   `json:"interfaceName,omitempty"`
+	IPAddress     string   `json:"ipAddress,omitempty"`
+	IPAddresses   []string `json:"ipAddresses,omitempty"`
+	MAC           string   `json:"mac,omitempty"`
+}
+
+type GuestOSInfo struct {
+	ID            string `json:"id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	PrettyName    string `json:"prettyName,omitempty"`
+	Version       string `json:"version,omitempty"`
+	KernelRelease string `json:"kernelRelease,omitempty"`
+}
+
+type PhaseTransitionTimestamp struct {
+	Phase                    string    `json:"phase"`
+	PhaseTransitionTimestamp time.Time `json:"phaseTransitionTimestamp"`
+}
+
+type MigrationState struct {
+	StartTimestamp *time.Time `json:"startTimestamp,omitempty"`
+	EndTimestamp   *time.Time `json:"endTimestamp,omitempty"`
+	SourceNode     string     `json:"sourceNode,omitempty"`
+	TargetNode     string     `json:"targetNode,omitempty"`
+	TargetPod      string     `json:"targetPod,omitempty"`
+	Mode           string     `json:"mode,omitempty"`
+	Completed      bool       `json:"completed,omitempty"`
+	Failed         bool       `json:"failed,omitempty"`
+}
+
+type VirtualMachineInstance struct {
+	Metadata struct {
+		ObjectMeta
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		Domain            DomainSpec `json:"domain"`
+		Volumes           []Volume   `json:"volumes,omitempty"`
+		PriorityClassName string     `json:"priorityClassName,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase        string         `json:"phase,omitempty"`
+		NodeName     string         `json:"nodeName,omitempty"`
+		Conditions   []Condition    `json:"conditions,omitempty"`
+		Interfaces   []VMIInterface `json:"interfaces,omitempty"`
+		GuestOSInfo  GuestOSInfo    `json:"guestOSInfo,omitempty"`
+		VolumeStatus []VolumeStatus `json:"volumeStatus,omitempty"`
+		Memory       *struct {
+			GuestAtBoot  string `json:"guestAtBoot,omitempty"`
+			GuestCurrent string `json:"guestCurrent,omitempty"`
+		} `json:"memory,omitempty"`
+		CurrentCPUTopology *CPUTopology `json:"currentCPUTopology,omitempty"`
+		FSFreezeStatus     string       `json:"fsFreezeStatus,omitempty"`
+
+		PhaseTransitionTimestamps []PhaseTransitionTimestamp `json:"phaseTransitionTimestamps,omitempty"`
+		MigrationState            *MigrationState            `json:"migrationState,omitempty"`
+	} `json:"status"`
+}
+
+type VirtualMachine struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		RunStrategy string `json:"runStrategy,omitempty"`
+		Template    struct {
+			Metadata ObjectMeta `json:"metadata"`
+			Spec     struct {
+				Volumes []Volume `json:"volumes,omitempty"`
+			} `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+	Status struct {
+		PrintableStatus string      `json:"printableStatus,omitempty"`
+		Ready           bool        `json:"ready,omitempty"`
+		Conditions      []Condition `json:"conditions,omitempty"`
+
+		MemoryDumpRequest *MemoryDumpRequest `json:"memoryDumpRequest,omitempty"`
+	} `json:"status"`
+}
+
+type MemoryDumpRequest struct {
+	ClaimName      string     `json:"claimName"`
+	Phase          string     `json:"phase"`
+	Remove         bool       `json:"remove,omitempty"`
+	StartTimestamp *time.Time `json:"startTimestamp,omitempty"`
+	EndTimestamp   *time.Time `json:"endTimestamp,omitempty"`
+	FileName       *string    `json:"fileName,omitempty"`
+	Message        string     `json:"message,omitempty"`
+}
+
+type VirtualMachineInstanceList struct {
+	Items []VirtualMachineInstance `json:"items"`
+}
+
+type VirtualMachineList struct {
+	Items []VirtualMachine `json:"items"`
+}
+
+// conditionStatus returns the status of the condition with the given type,
+// or an empty string when the condition is not present
+func conditionStatus(conditions []Condition, conditionType string) string {
+	for _, cond := range conditions {
+		if cond.Type == conditionType {
+			return cond.Status
+		}
+	}
+	return ""
+}
+
+// guessOS guesses the guest operating system using the same hints as vm-exec:
+// guest agent info first, then containerdisk image names, then the
+// kubevirt.io/os label.
+func guessOS(guestOS GuestOSInfo, volumes []Volume, labels map[string]string) string {
+	if guestOS.ID != "" {
+		return guestOS.ID
+	}
+
+	for _, volume := range volumes {
+		if volume.ContainerDisk == nil {
+			continue
+		}
+
+		image := volume.ContainerDisk.Image
+		for _, osType := range []string{"fedora", "cirros", "alpine", "ubuntu", "debian", "centos", "rhel"} {
+			if strings.Contains(image, osType) {
+				return osType
+			}
+		}
+	}
+
+	if os, exists := labels["kubevirt.io/os"]; exists {
+		return os
+	}
+
+	return ""
+}
+
+const (
+	// managedByLabel marks objects created by the MCP server
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "kubevirt-mcp"
+
+	// toolLabel records the tool that created an object
+	toolLabel = "kubevirt-mcp/tool"
+
+	// temporaryLabel marks objects a tool deletes before it returns, left
+	// over only when the tool run failed, see gc_orphans
+	temporaryLabel = "kubevirt-mcp/temporary"
+)
+
+// managedLabels returns the labels of an object created by a tool
+func managedLabels(toolName string, temporary bool) map[string]string {
+	labels := map[string]string{
+		managedByLabel: managedByValue,
+		toolLabel:      strings.ReplaceAll(toolName, "_", "-"),
+	}
+	if temporary {
+		labels[temporaryLabel] = "true"
+	}
+	return labels
+}
+
+// generateName returns prefix followed by a short random suffix, like
+// metadata.generateName does on the API server. The suffix is a counter when
+// recording or replaying fixtures.
+func generateName(prefix string) string {
+	if fixtures != nil {
+		return fixtures.generatedName(prefix)
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return prefix + hex.EncodeToString(suffix)
+}
+
+// Event is a Kubernetes event
+type Event struct {
+	Metadata       ObjectMeta `json:"metadata"`
+	InvolvedObject struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"involvedObject"`
+	Type           string    `json:"type"`
+	Reason         string    `json:"reason"`
+	Message        string    `json:"message"`
+	Count          int       `json:"count"`
+	FirstTimestamp time.Time `json:"firstTimestamp"`
+	LastTimestamp  time.Time `json:"lastTimestamp"`
+	EventTime      time.Time `json:"eventTime"`
+}
+
+// firstSeen returns when the event first occurred
+func (e Event) firstSeen() time.Time {
+	if !e.FirstTimestamp.IsZero() {
+		return e.FirstTimestamp
+	}
+	return e.lastSeen()
+}
+
+// lastSeen returns when the event last occurred
+func (e Event) lastSeen() time.Time {
+	switch {
+	case !e.LastTimestamp.IsZero():
+		return e.LastTimestamp
+	case !e.EventTime.IsZero():
+		return e.EventTime
+	}
+	return e.Metadata.CreationTimestamp
+}
+
+type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName          string `json:"nodeName,omitempty"`
+		Priority          *int   `json:"priority,omitempty"`
+		PriorityClassName string `json:"priorityClassName,omitempty"`
+		Containers        []struct {
+			Name      string `json:"name"`
+			Image     string `json:"image,omitempty"`
+			Resources struct {
+				Requests map[string]string `json:"requests,omitempty"`
+			} `json:"resources,omitempty"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase,omitempty"`
+	} `json:"status"`
+}
+
+type PodList struct {
+	Items []Pod `json:"items"`
+}
+
+// getLauncherPod returns the virt-launcher pod of a VMI, preferring a running one
+func getLauncherPod(ctx context.Context, namespace, vmiName string) (*Pod, error) {
+	var vmi VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &vmi, "get", "virtualmachineinstance", vmiName, "-n", namespace); err != nil {
+		return nil, err
+	}
+	return launcherPodOf(ctx, &vmi)
+}
+
+// launcherPodOf returns the virt-launcher pod of a fetched VMI, preferring a
+// running one
+func launcherPodOf(ctx context.Context, vmi *VirtualMachineInstance) (*Pod, error) {
+	var pods PodList
+	if err := runKubectlJSON(ctx, &pods, "get", "pods", "-n", vmi.Metadata.Namespace, "-l", "kubevirt.io/created-by="+vmi.Metadata.UID); err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, fmt.Errorf("no virt-launcher pod found for VMI '%s'", vmi.Metadata.Name)
+	}
+
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == "Running" {
+			return &pods.Items[i], nil
+		}
+	}
+	return &pods.Items[0], nil
+}
+
+// hasContainer reports whether the pod has a container with the given name
+func (p *Pod) hasContainer(name string) bool {
+	for _, container := range p.Spec.Containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// podRequests sums the CPU (in cores) and memory (in bytes) requests of the
+// pod containers
+func (p *Pod) podRequests() (float64, float64) {
+	var cpu, memory float64
+	for _, container := range p.Spec.Containers {
+		if value, ok := parseQuantity(container.Resources.Requests["cpu"]); ok {
+			cpu += value
+		}
+		if value, ok := parseQuantity(container.Resources.Requests["memory"]); ok {
+			memory += value
+		}
+	}
+	return cpu, memory
+}
+
+var quantityRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([a-zA-Z]*)$`)
+
+var quantitySuffixes = map[string]float64{
+	"":   1,
+	"m":  1e-3,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"E":  1e18,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+}
+
+// parseQuantity converts a Kubernetes quantity such as "2Gi" or "500m"
+func parseQuantity(quantity string) (float64, bool) {
+	match := quantityRegex.FindStringSubmatch(strings.TrimSpace(quantity))
+	if match == nil {
+		return 0, false
+	}
+	multiplier, ok := quantitySuffixes[match[2]]
+	if !ok {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return number * multiplier, true
+}
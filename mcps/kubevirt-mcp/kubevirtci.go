@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Environment variables locating kubevirtci clusters. KUBEVIRTCI_CONFIG_PATH
+// and KUBEVIRT_PROVIDER are the ones used by kubevirtci's cluster-up scripts.
+const (
+	kubevirtciConfigPathEnv  = "KUBEVIRTCI_CONFIG_PATH"
+	kubevirtProviderEnv      = "KUBEVIRT_PROVIDER"
+	kubevirtciSearchPathsEnv = "KUBEVIRT_MCP_KUBEVIRTCI_PATHS"
+
+	// kubevirtciConfigDir is where cluster-up writes the provider configs,
+	// relative to the kubevirt or kubevirtci checkout
+	kubevirtciConfigDir = "_ci-configs"
+)
+
+// kubevirtciDetected remembers the kubevirtci kubeconfig found by
+// detect_kubevirtci_cluster, so the tools use it without exporting KUBECONFIG
+var kubevirtciDetected struct {
+	sync.Mutex
+	path string
+}
+
+// kubevirtciSearchRoots returns the checkouts searched for _ci-configs
+func kubevirtciSearchRoots() []string {
+	var roots []string
+	roots = append(roots, serverConfig.Detection.KubevirtciPaths...)
+	if cwd, err := os.Getwd(); err == nil {
+		roots = append(roots, cwd)
+	}
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		roots = append(roots,
+			filepath.Join(homeDir, "kubevirt"),
+			filepath.Join(homeDir, "kubevirtci"),
+			filepath.Join(homeDir, "go", "src", "kubevirt.io", "kubevirt"),
+			filepath.Join(homeDir, "go", "src", "github.com", "kubevirt", "kubevirt"),
+			filepath.Join(homeDir, "go", "src", "github.com", "kubevirt", "kubevirtci"),
+		)
+	}
+	return roots
+}
+
+// kubevirtciKubeconfigs returns the kubeconfigs written by kubevirtci
+// cluster-up, those of KUBEVIRT_PROVIDER first and then the most recently
+// written ones first
+func kubevirtciKubeconfigs() []string {
+	var configDirs []string
+	if dir := expandHome(serverConfig.Detection.KubevirtciConfigPath); dir != "" {
+		configDirs = append(configDirs, dir)
+	}
+	for _, root := range kubevirtciSearchRoots() {
+		configDirs = append(configDirs, filepath.Join(root, kubevirtciConfigDir))
+	}
+
+	type candidate struct {
+		path      string
+		preferred bool
+		modTime   int64
+	}
+	provider := serverConfig.Detection.KubevirtProvider
+	seen := map[string]bool{}
+	var candidates []candidate
+	for _, dir := range configDirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", ".kubeconfig"))
+		for _, path := range matches {
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			candidates = append(candidates, candidate{
+				path:      path,
+				preferred: provider != "" && kubevirtciProvider(path) == provider,
+				modTime:   info.ModTime().UnixNano(),
+			})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].preferred != candidates[j].preferred {
+			return candidates[i].preferred
+		}
+		return candidates[i].modTime > candidates[j].modTime
+	})
+	paths := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		paths = append(paths, c.path)
+	}
+	return paths
+}
+
+// kubevirtciProvider returns the provider of a kubevirtci kubeconfig, e.g.
+// k8s-1.30 for _ci-configs/k8s-1.30/.kubeconfig
+func kubevirtciProvider(kubeconfig string) string {
+	return filepath.Base(filepath.Dir(kubeconfig))
+}
+
+// setDetectedKubevirtci remembers a working kubevirtci kubeconfig
+func setDetectedKubevirtci(kubeconfig string) {
+	kubevirtciDetected.Lock()
+	defer kubevirtciDetected.Unlock()
+	kubevirtciDetected.path = kubeconfig
+}
+
+// detectedKubevirtci returns the remembered kubevirtci kubeconfig if it
+// still exists
+func detectedKubevirtci() string {
+	kubevirtciDetected.Lock()
+	defer kubevirtciDetected.Unlock()
+	if kubevirtciDetected.path == "" {
+		return ""
+	}
+	if _, err := os.Stat(kubevirtciDetected.path); err != nil {
+		return ""
+	}
+	return kubevirtciDetected.path
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultHealthEventsLimit = 20
+
+// kubeVirtDeployments and kubeVirtDaemonSets are the control plane
+// components deployed by virt-operator, next to virt-operator itself
+var (
+	kubeVirtDeployments = []string{"virt-operator", "virt-api", "virt-controller"}
+	kubeVirtDaemonSets  = []string{"virt-handler"}
+)
+
+// KubeVirtHealthParams represents the parameters of kubevirt_health
+type KubeVirtHealthParams struct {
+	EventsLimit int    `json:"events_limit,omitempty"`
+	Format      string `json:"format,omitempty"`
+}
+
+// KubeVirtComponent is the readiness of a control plane deployment or
+// daemonset
+type KubeVirtComponent struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Desired   int    `json:"desired"`
+	Ready     int    `json:"ready"`
+	Available int    `json:"available"`
+	Updated   int    `json:"updated"`
+	Healthy   bool   `json:"healthy"`
+	Message   string `json:"message,omitempty"`
+}
+
+// KubeVirtEvent is a warning event of the KubeVirt namespace
+type KubeVirtEvent struct {
+	Object  string `json:"object"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	Count   int    `json:"count,omitempty"`
+	Age     string `json:"age,omitempty"`
+}
+
+// KubeVirtHealthResult is the kubevirt_health tool result
+type KubeVirtHealthResult struct {
+	Namespace     string              `json:"namespace"`
+	Phase         string              `json:"phase"`
+	Version       string              `json:"version,omitempty"`
+	Healthy       bool                `json:"healthy"`
+	Problems      []string            `json:"problems,omitempty"`
+	Conditions    []Condition         `json:"conditions,omitempty"`
+	Components    []KubeVirtComponent `json:"components"`
+	WarningEvents []KubeVirtEvent     `json:"warningEvents,omitempty"`
+}
+
+// workload holds the fields of deployments and daemonsets describing their
+// rollout
+type workload struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Replicas *int `json:"replicas,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Replicas               int `json:"replicas"`
+		ReadyReplicas          int `json:"readyReplicas"`
+		AvailableReplicas      int `json:"availableReplicas"`
+		UpdatedReplicas        int `json:"updatedReplicas"`
+		DesiredNumberScheduled int `json:"desiredNumberScheduled"`
+		NumberReady            int `json:"numberReady"`
+		NumberAvailable        int `json:"numberAvailable"`
+		UpdatedNumberScheduled int `json:"updatedNumberScheduled"`
+	} `json:"status"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "kubevirt_health",
+		Description: "Report the health of the KubeVirt control plane: KubeVirt CR phase and conditions, readiness of virt-operator, virt-api, virt-controller and virt-handler, and recent warning events. Use it when VMs do not start or stay pending",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"events_limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of recent warning events to report",
+					"default":     defaultHealthEventsLimit,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleKubeVirtHealth,
+	})
+}
+
+// handleKubeVirtHealth is the tools/call handler for kubevirt_health
+func handleKubeVirtHealth(ctx context.Context, args json.RawMessage) (string, error) {
+	var params KubeVirtHealthParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.EventsLimit < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("events_limit must not be negative")}
+	}
+	if params.EventsLimit == 0 {
+		params.EventsLimit = defaultHealthEventsLimit
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	result, err := kubeVirtHealth(ctx, params.EventsLimit)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// kubeVirtHealth checks the KubeVirt CR and the components in its namespace
+func kubeVirtHealth(ctx context.Context, eventsLimit int) (*KubeVirtHealthResult, error) {
+	reportProgress(ctx, "reading the KubeVirt CR")
+	kv, _, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespace := kv.Metadata.Namespace
+
+	result := &KubeVirtHealthResult{
+		Namespace:  namespace,
+		Phase:      kv.Status.Phase,
+		Version:    kv.Status.ObservedKubeVirtVersion,
+		Conditions: kv.Status.Conditions,
+	}
+	if result.Phase != "Deployed" {
+		result.Problems = append(result.Problems, fmt.Sprintf("KubeVirt CR %s is in phase %q, not Deployed", kv.Metadata.Name, result.Phase))
+	}
+	for _, cond := range kv.Status.Conditions {
+		if (cond.Type == "Degraded" && cond.Status == "True") || (cond.Type == "Available" && cond.Status != "True") {
+			result.Problems = append(result.Problems, fmt.Sprintf("KubeVirt CR condition %s=%s: %s", cond.Type, cond.Status, cond.Message))
+		}
+	}
+
+	reportProgress(ctx, "checking the control plane components in %s", namespace)
+	components, err := kubeVirtComponents(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	result.Components = components
+	for _, component := range components {
+		if !component.Healthy {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s %s: %s", component.Kind, component.Name, component.Message))
+		}
+	}
+
+	reportProgress(ctx, "reading warning events in %s", namespace)
+	events, err := warningEvents(ctx, namespace, eventsLimit)
+	if err != nil {
+		return nil, err
+	}
+	result.WarningEvents = events
+
+	result.Healthy = len(result.Problems) == 0
+	return result, nil
+}
+
+// kubeVirtComponents reports the readiness of the control plane deployments
+// and daemonsets, a missing one is reported as unhealthy
+func kubeVirtComponents(ctx context.Context, namespace string) ([]KubeVirtComponent, error) {
+	deployments, err := getWorkloads(ctx, "deployment", namespace, kubeVirtDeployments)
+	if err != nil {
+		return nil, err
+	}
+	daemonSets, err := getWorkloads(ctx, "daemonset", namespace, kubeVirtDaemonSets)
+	if err != nil {
+		return nil, err
+	}
+
+	var components []KubeVirtComponent
+	for _, name := range kubeVirtDeployments {
+		component := KubeVirtComponent{Name: name, Kind: "Deployment"}
+		w, found := deployments[name]
+		if found {
+			component.Desired = w.Status.Replicas
+			if w.Spec.Replicas != nil {
+				component.Desired = *w.Spec.Replicas
+			}
+			component.Ready, component.Available, component.Updated = w.Status.ReadyReplicas, w.Status.AvailableReplicas, w.Status.UpdatedReplicas
+		}
+		components = append(components, checkComponent(component, found))
+	}
+	for _, name := range kubeVirtDaemonSets {
+		component := KubeVirtComponent{Name: name, Kind: "DaemonSet"}
+		w, found := daemonSets[name]
+		if found {
+			component.Desired = w.Status.DesiredNumberScheduled
+			component.Ready, component.Available, component.Updated = w.Status.NumberReady, w.Status.NumberAvailable, w.Status.UpdatedNumberScheduled
+		}
+		components = append(components, checkComponent(component, found))
+	}
+	return components, nil
+}
+
+// checkComponent sets whether the component is healthy and why not
+func checkComponent(component KubeVirtComponent, found bool) KubeVirtComponent {
+	switch {
+	case !found:
+		component.Message = "not found"
+	case component.Desired == 0:
+		component.Message = "no replicas scheduled"
+	case component.Ready < component.Desired:
+		component.Message = fmt.Sprintf("%d of %d ready", component.Ready, component.Desired)
+	case component.Updated < component.Desired:
+		component.Message = fmt.Sprintf("rollout in progress, %d of %d updated", component.Updated, component.Desired)
+	default:
+		component.Healthy = true
+	}
+	return component
+}
+
+// getWorkloads returns the named deployments or daemonsets that exist
+func getWorkloads(ctx context.Context, kind, namespace string, names []string) (map[string]*workload, error) {
+	var list struct {
+		Items []workload `json:"items"`
+	}
+	args := append([]string{"get", kind}, names...)
+	output, err := runKubectl(ctx, append(args, "-n", namespace, "--ignore-not-found", "-o", "json")...)
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := map[string]*workload{}
+	if strings.TrimSpace(string(output)) == "" {
+		return workloads, nil
+	}
+	// A single name is returned as the object itself rather than a list
+	if len(names) == 1 {
+		var w workload
+		if err := json.Unmarshal(output, &w); err != nil {
+			return nil, fmt.Errorf("failed to parse kubectl output: %v", err)
+		}
+		list.Items = append(list.Items, w)
+	} else if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse kubectl output: %v", err)
+	}
+	for i := range list.Items {
+		workloads[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+	return workloads, nil
+}
+
+// warningEvents returns the most recent warning events of the namespace,
+// newest first
+func warningEvents(ctx context.Context, namespace string, limit int) ([]KubeVirtEvent, error) {
+	var list struct {
+		Items []Event `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &list, "get", "events", "-n", namespace, "--field-selector", "type=Warning"); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(list.Items, func(i, j int) bool {
+		return list.Items[i].lastSeen().After(list.Items[j].lastSeen())
+	})
+	if len(list.Items) > limit {
+		list.Items = list.Items[:limit]
+	}
+
+	var events []KubeVirtEvent
+	for _, e := range list.Items {
+		events = append(events, KubeVirtEvent{
+			Object:  strings.ToLower(e.InvolvedObject.Kind) + "/" + e.InvolvedObject.Name,
+			Reason:  e.Reason,
+			Message: e.Message,
+			Count:   e.Count,
+			Age:     since(e.lastSeen()),
+		})
+	}
+	return events, nil
+}
+
+// tables renders the health report as an overview followed by the
+// components, conditions and warning events
+func (r *KubeVirtHealthResult) tables() []table {
+	overview := table{title: "KubeVirt " + r.Namespace, headers: []string{"FIELD", "VALUE"}}
+	overview.rows = append(overview.rows,
+		[]string{"Phase", r.Phase},
+		[]string{"Version", r.Version},
+		[]string{"Healthy", strconv.FormatBool(r.Healthy)},
+	)
+	for _, problem := range r.Problems {
+		overview.rows = append(overview.rows, []string{"Problem", problem})
+	}
+
+	components := table{title: "Components", headers: []string{"NAME", "KIND", "DESIRED", "READY", "AVAILABLE", "UPDATED", "HEALTHY", "MESSAGE"}}
+	for _, c := range r.Components {
+		components.rows = append(components.rows, []string{
+			c.Name, c.Kind, strconv.Itoa(c.Desired), strconv.Itoa(c.Ready), strconv.Itoa(c.Available), strconv.Itoa(c.Updated), strconv.FormatBool(c.Healthy), c.Message,
+		})
+	}
+
+	conditions := table{title: "Conditions", headers: []string{"TYPE", "STATUS", "REASON", "MESSAGE"}}
+	for _, cond := range r.Conditions {
+		conditions.rows = append(conditions.rows, []string{cond.Type, cond.Status, cond.Reason, cond.Message})
+	}
+
+	events := table{title: "Warning events", headers: []string{"AGE", "OBJECT", "REASON", "COUNT", "MESSAGE"}}
+	for _, e := range r.WarningEvents {
+		events.rows = append(events.rows, []string{e.Age, e.Object, e.Reason, strconv.Itoa(e.Count), e.Message})
+	}
+
+	return []table{overview, components, conditions, events}
+}
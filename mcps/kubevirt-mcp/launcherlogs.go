@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// computeContainer runs virt-launcher, libvirt and QEMU
+	computeContainer = "compute"
+
+	defaultLauncherLogLines = 100
+
+	// maxLauncherLogFollow bounds how long logs are followed
+	maxLauncherLogFollow = 300
+)
+
+// LauncherLogsParams represents the parameters of vm_launcher_logs
+type LauncherLogsParams struct {
+	Namespace     string `json:"namespace,omitempty"`
+	VMName        string `json:"vm_name"`
+	Container     string `json:"container,omitempty"`
+	TailLines     int    `json:"tail_lines,omitempty"`
+	Since         string `json:"since,omitempty"`
+	Previous      bool   `json:"previous,omitempty"`
+	FollowSeconds int    `json:"follow_seconds,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_launcher_logs",
+		Description: "Tail or follow the logs of the virt-launcher pod backing a VMI, by default its compute container with the virt-launcher, libvirt and QEMU messages. The next debugging step after vm_events when a VMI fails to start, crashes or fails to migrate",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+				"container": map[string]interface{}{
+					"type":        "string",
+					"description": "Container of the virt-launcher pod, e.g. compute or guest-console-log",
+					"default":     computeContainer,
+				},
+				"tail_lines": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of trailing lines to return",
+					"default":     defaultLauncherLogLines,
+				},
+				"since": map[string]interface{}{
+					"type":        "string",
+					"description": "Only return lines logged after this RFC 3339 timestamp or within this duration, e.g. 2024-05-01T10:00:00Z or 10m",
+				},
+				"previous": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Return the logs of the previous instance of the container, after it restarted",
+				},
+				"follow_seconds": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("Keep streaming new lines for this many seconds before returning (at most %d)", maxLauncherLogFollow),
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleLauncherLogs,
+	})
+}
+
+// handleLauncherLogs is the tools/call handler for vm_launcher_logs
+func handleLauncherLogs(ctx context.Context, args json.RawMessage) (string, error) {
+	var params LauncherLogsParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.TailLines < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("tail_lines must not be negative")}
+	}
+	if params.FollowSeconds < 0 || params.FollowSeconds > maxLauncherLogFollow {
+		return "", &invalidParamsError{err: fmt.Errorf("follow_seconds must be between 0 and %d", maxLauncherLogFollow)}
+	}
+	if params.Previous && params.FollowSeconds > 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("previous logs cannot be followed")}
+	}
+
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Container == "" {
+		params.Container = computeContainer
+	}
+	if params.TailLines == 0 {
+		params.TailLines = defaultLauncherLogLines
+	}
+
+	logArgs := []string{"--tail", strconv.Itoa(params.TailLines)}
+	if params.Since != "" {
+		if t, err := time.Parse(time.RFC3339, params.Since); err == nil {
+			logArgs = append(logArgs, "--since-time="+t.Format(time.RFC3339))
+		} else if d, err := time.ParseDuration(params.Since); err == nil && d > 0 {
+			logArgs = append(logArgs, "--since="+d.String())
+		} else {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid since '%s', use an RFC 3339 timestamp or a duration such as 10m", params.Since)}
+		}
+	}
+	if params.Previous {
+		logArgs = append(logArgs, "--previous")
+	}
+
+	pod, err := getLauncherPod(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return "", err
+	}
+	if !pod.hasContainer(params.Container) {
+		var containers []string
+		for _, container := range pod.Spec.Containers {
+			containers = append(containers, container.Name)
+		}
+		return "", &invalidParamsError{err: fmt.Errorf("pod %s has no %s container, it has %s", pod.Metadata.Name, params.Container, strings.Join(containers, ", "))}
+	}
+
+	kubectlArgs := []string{"logs", pod.Metadata.Name, "-n", params.Namespace, "-c", params.Container}
+	var output []byte
+	if params.FollowSeconds > 0 {
+		reportProgress(ctx, "following %s/%s for %ds", pod.Metadata.Name, params.Container, params.FollowSeconds)
+		output, err = followKubectl(ctx, time.Duration(params.FollowSeconds)*time.Second, append(append(kubectlArgs, logArgs...), "--follow")...)
+	} else {
+		output, err = runKubectl(ctx, append(kubectlArgs, logArgs...)...)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	source := fmt.Sprintf("Source: %s/%s", pod.Metadata.Name, params.Container)
+	if params.FollowSeconds > 0 {
+		source += fmt.Sprintf(" (followed for %ds)", params.FollowSeconds)
+	}
+	return fmt.Sprintf("%s\n\n%s", source, string(output)), nil
+}
+
+// followKubectl runs a streaming kubectl command such as "logs --follow"
+// for the given duration and returns what it printed until then
+func followKubectl(parent context.Context, duration time.Duration, args ...string) ([]byte, error) {
+	ctx, cancel := clock.WithTimeout(parent, duration)
+	defer cancel()
+
+	args = append(kubeconfigArgs(parent), args...)
+
+	logMessage(LogDebug, "kubectl", "kubectl %s", strings.Join(args, " "))
+
+	output, _, err := recorded(parent, "kubectl", args, nil, func() (string, string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "kubectl", args...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		// Do not wait for children of kubectl still holding its output
+		cmd.WaitDelay = time.Second
+
+		err := cmd.Run()
+		switch {
+		case parent.Err() != nil:
+			return "", "", fmt.Errorf("kubectl %s cancelled", strings.Join(args, " "))
+		case ctx.Err() == context.DeadlineExceeded:
+			// Following ends when the duration is over
+			return stdout.String(), "", nil
+		case err != nil:
+			return "", "", fmt.Errorf("kubectl %s failed: %v\nOutput: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		return stdout.String(), "", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(output), nil
+}
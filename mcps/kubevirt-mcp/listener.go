@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listenEnv sets the Unix socket or TCP address served instead of stdio,
+// like listen in the configuration file and the --listen flag
+const listenEnv = "KUBEVIRT_MCP_LISTEN"
+
+const (
+	// listenerWriteTimeout bounds each write to a client of the listener, so
+	// a client that stops reading cannot block the notifications of the
+	// others
+	listenerWriteTimeout = 10 * time.Second
+	// listenerAuthTimeout bounds the wait for a client to authenticate
+	listenerAuthTimeout = 30 * time.Second
+)
+
+// listenerClients holds the streams of the connected clients without an
+// identity, which get the log notifications like stdout does
+var listenerClients = struct {
+	sync.Mutex
+	conns map[*rpcWriter]bool
+}{conns: map[*rpcWriter]bool{}}
+
+// listenerActive counts the connected clients, reported by the metrics
+var listenerActive atomic.Int64
+
+// listenerConns returns the streams of the connected clients
+func listenerConns() []*rpcWriter {
+	listenerClients.Lock()
+	defer listenerClients.Unlock()
+	conns := make([]*rpcWriter, 0, len(listenerClients.conns))
+	for conn := range listenerClients.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// connWriter writes to a client connection with a deadline
+type connWriter struct {
+	conn net.Conn
+}
+
+func (w connWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(listenerWriteTimeout))
+	return w.conn.Write(p)
+}
+
+// serveListener accepts clients on the listen address until the server
+// shuts down. Each connection carries newline delimited JSON-RPC like stdio
+// and is served concurrently with the others; requests handled at once are
+// bounded by slots, nil for no limit. With an identities file every client
+// must authenticate, which TCP clients always have to.
+func serveListener(slots chan struct{}) error {
+	var identities []*Identity
+	if serverConfig.HTTP.Identities != "" {
+		var err error
+		if identities, err = loadIdentities(serverConfig.HTTP.Identities); err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := transportTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	listener, err := listen(serverConfig.Listen)
+	if err != nil {
+		return err
+	}
+	if listener.Addr().Network() == "tcp" {
+		if identities == nil {
+			listener.Close()
+			return fmt.Errorf("the TCP listener needs an identities file, set --identities or %s", identitiesEnv)
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		} else {
+			logMessage(LogWarning, "listener", "The TCP listener has no TLS certificate, tokens are sent in clear")
+		}
+	}
+	go func() {
+		<-serverCtx.Done()
+		listener.Close()
+	}()
+
+	logMessage(LogInfo, "listener", "Serving MCP on %s %s", listener.Addr().Network(), listener.Addr())
+	if identities != nil {
+		logMessage(LogInfo, "listener", "Clients authenticate as one of %d identities", len(identities))
+	}
+
+	var clients sync.WaitGroup
+	for id := 1; ; id++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			if serverCtx.Err() != nil {
+				break
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("failed to accept client: %v", err)
+		}
+		clients.Add(1)
+		go func(id int, conn net.Conn) {
+			defer clients.Done()
+			serveConn(id, conn, slots, identities)
+		}(id, conn)
+	}
+
+	// The requests of every client are cancelled, let them answer
+	waitRequests(serverCtx, &clients)
+	return nil
+}
+
+// serveConn serves the requests of a client until it closes its side of the
+// connection. Like with stdin, the requests still running then complete.
+// With identities the client must authenticate first, its calls are then
+// restricted like those of the HTTP transport.
+func serveConn(id int, conn net.Conn, slots chan struct{}, identities []*Identity) {
+	defer conn.Close()
+	w := &rpcWriter{encoder: json.NewEncoder(connWriter{conn: conn})}
+
+	ctx := serverCtx
+	var input io.Reader = conn
+	if identities != nil {
+		reader := bufio.NewReader(conn)
+		identity, first, err := authenticateConn(conn, reader, identities)
+		if err != nil {
+			log.Printf("Client %d rejected: %v", id, err)
+			loginFailuresTotal.inc("listener")
+			req, _ := decodeRequest(first)
+			w.send(JSONRPCResponse{JSONRPC: "2.0", ID: safeID(req.ID), Error: toolError(&accessDeniedError{err: err})})
+			return
+		}
+		log.Printf("Client %d connected as identity %s", id, identity.Name)
+		ctx = withIdentity(ctx, identity)
+		// The first message was read to authenticate, serve it as well
+		input = io.MultiReader(bytes.NewReader(first), reader)
+	}
+
+	// The log notifications are about the calls of every client, so they
+	// are only sent when the clients are not told apart
+	if identities == nil {
+		log.Printf("Client %d connected", id)
+		listenerClients.Lock()
+		listenerClients.conns[w] = true
+		listenerClients.Unlock()
+		defer func() {
+			listenerClients.Lock()
+			delete(listenerClients.conns, w)
+			listenerClients.Unlock()
+		}()
+	}
+
+	listenerActive.Add(1)
+	defer listenerActive.Add(-1)
+	serveStream(ctx, input, w, slots)
+	forgetPins(connSession(w))
+	log.Printf("Client %d disconnected", id)
+}
+
+// authenticateConn returns the identity of a listener client: the identity
+// of its verified client certificate, else of the token in the _meta of its
+// first message, which must be initialize. The message read is returned so
+// it can be served.
+func authenticateConn(conn net.Conn, reader *bufio.Reader, identities []*Identity) (*Identity, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(listenerAuthTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		state := tlsConn.ConnectionState()
+		if identity, ok := clientCertIdentity(identities, &state); ok {
+			return identity, nil, nil
+		}
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil && len(bytes.TrimSpace(line)) == 0 {
+		return nil, nil, fmt.Errorf("no initialize request received: %v", err)
+	}
+	var req struct {
+		Method string `json:"method"`
+		Params struct {
+			Meta struct {
+				AuthToken string `json:"authToken"`
+			} `json:"_meta"`
+		} `json:"params"`
+	}
+	if err := json.Unmarshal(line, &req); err != nil || req.Method != "initialize" {
+		return nil, line, errors.New("authentication required, send initialize with the token in _meta.authToken first")
+	}
+	if req.Params.Meta.AuthToken == "" {
+		return nil, line, errors.New("authentication required, initialize has no _meta.authToken")
+	}
+	identity, ok := identityForToken(identities, req.Params.Meta.AuthToken)
+	if !ok {
+		return nil, line, errors.New("invalid token")
+	}
+	return identity, line, nil
+}
+
+// listen opens the listener of an address: unix:PATH for a Unix socket,
+// tcp:HOST:PORT for a TCP port, or systemd for the socket passed by systemd
+// socket activation
+func listen(address string) (net.Listener, error) {
+	if address == "systemd" {
+		return systemdListener()
+	}
+	if addr, ok := strings.CutPrefix(address, "tcp:"); ok {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+		}
+		return listener, nil
+	}
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("invalid listen address %q, use unix:PATH, tcp:HOST:PORT or systemd", address)
+	}
+
+	path = expandHome(path)
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	// Clients run vm_exec and change the cluster, only the server user may
+	// connect
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket left by a server that did not exit
+// cleanly, refusing to take over the socket of a running server
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another server is listening on %s", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdListener returns the first socket passed by systemd socket
+// activation, see sd_listen_fds(3)
+func systemdListener() (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fds < 1 {
+		return nil, fmt.Errorf("no socket passed by systemd, LISTEN_PID and LISTEN_FDS are not set for this process")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// Passed sockets start at file descriptor 3
+	file := os.NewFile(3, "systemd-socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use the socket passed by systemd: %v", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadCall is one entry of a load test mix, either a JSON-RPC method such as
+// tools/list or a tools/call of a tool
+type loadCall struct {
+	Method    string                 `yaml:"method"`
+	Tool      string                 `yaml:"tool"`
+	Arguments map[string]interface{} `yaml:"arguments"`
+	Weight    int                    `yaml:"weight"`
+}
+
+// defaultLoadMix is a read-only mix resembling an agent inspecting a cluster
+var defaultLoadMix = []loadCall{
+	{Method: "tools/list", Weight: 3},
+	{Tool: "vm_list", Weight: 5},
+	{Tool: "cluster_list", Weight: 1},
+	{Tool: "kubevirt_config", Weight: 1},
+	{Tool: "vm_priority_report", Weight: 1},
+}
+
+// label names the call in the report
+func (c loadCall) label() string {
+	if c.Tool != "" {
+		return c.Tool
+	}
+	return c.Method
+}
+
+// request returns the JSON-RPC method and params of the call
+func (c loadCall) request() (string, interface{}) {
+	if c.Tool == "" {
+		return c.Method, nil
+	}
+	arguments := c.Arguments
+	if arguments == nil {
+		arguments = map[string]interface{}{}
+	}
+	return "tools/call", map[string]interface{}{"name": c.Tool, "arguments": arguments}
+}
+
+// loadLoadMix reads a mix file, e.g.
+//
+//	calls:
+//	  - method: tools/list
+//	    weight: 2
+//	  - tool: vm_list
+//	    arguments: {namespace: default}
+//	    weight: 5
+func loadLoadMix(path string) ([]loadCall, error) {
+	if path == "" {
+		return defaultLoadMix, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mix: %v", err)
+	}
+	var file struct {
+		Calls []loadCall `yaml:"calls"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse mix %s: %v", path, err)
+	}
+	if len(file.Calls) == 0 {
+		return nil, fmt.Errorf("mix %s has no calls", path)
+	}
+	for i, call := range file.Calls {
+		if (call.Method == "") == (call.Tool == "") {
+			return nil, fmt.Errorf("call %d of mix %s needs either a method or a tool", i+1, path)
+		}
+		if call.Weight < 0 {
+			return nil, fmt.Errorf("call %d of mix %s has a negative weight", i+1, path)
+		}
+		if call.Weight == 0 {
+			file.Calls[i].Weight = 1
+		}
+	}
+	return file.Calls, nil
+}
+
+// pickLoadCall picks a call of the mix at random, in proportion to the weights
+func pickLoadCall(mix []loadCall, rng *rand.Rand) loadCall {
+	total := 0
+	for _, call := range mix {
+		total += call.Weight
+	}
+	n := rng.Intn(total)
+	for _, call := range mix {
+		if n < call.Weight {
+			return call
+		}
+		n -= call.Weight
+	}
+	return mix[len(mix)-1]
+}
+
+// rpcReply is a message received from the server under test, a response or
+// a notification
+type rpcReply struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// loadClient sends JSON-RPC requests to the server under test
+type loadClient interface {
+	call(ctx context.Context, method string, params interface{}) (*rpcReply, error)
+	notify(method string, params interface{}) error
+	close() error
+}
+
+// stdioClient drives a server process over its stdin and stdout, matching the
+// responses of concurrent requests by ID
+type stdioClient struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	mu     sync.Mutex
+	nextID int64
+	// pending maps request IDs to the channels waiting for their response,
+	// it is set to nil once the server exits
+	pending map[int64]chan *rpcReply
+	exited  chan struct{}
+}
+
+// startStdioClient starts the server command
+func startStdioClient(command []string, verbose bool) (*stdioClient, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	if verbose {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server stdin: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server stdout: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start server: %v", err)
+	}
+
+	c := &stdioClient{cmd: cmd, stdin: stdin, pending: map[int64]chan *rpcReply{}, exited: make(chan struct{})}
+	go c.readReplies(stdout)
+	return c, nil
+}
+
+// readReplies delivers the responses to the pending requests until the
+// server exits
+func (c *stdioClient) readReplies(stdout io.Reader) {
+	decoder := json.NewDecoder(stdout)
+	for {
+		var reply rpcReply
+		if err := decoder.Decode(&reply); err != nil {
+			break
+		}
+		if len(reply.ID) == 0 || reply.Method != "" {
+			// Progress and log notifications
+			continue
+		}
+		id, err := strconv.ParseInt(string(reply.ID), 10, 64)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- &reply
+		}
+	}
+
+	c.mu.Lock()
+	c.pending = nil
+	c.mu.Unlock()
+	close(c.exited)
+}
+
+func (c *stdioClient) call(ctx context.Context, method string, params interface{}) (*rpcReply, error) {
+	ch := make(chan *rpcReply, 1)
+	c.mu.Lock()
+	if c.pending == nil {
+		c.mu.Unlock()
+		return nil, errors.New("server exited")
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	err := c.write(JSONRPCRequest{JSONRPC: "2.0", ID: id, Method: method, Params: marshalParams(params)})
+	c.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-c.exited:
+		return nil, errors.New("server exited")
+	case <-ctx.Done():
+		c.mu.Lock()
+		if c.pending != nil {
+			delete(c.pending, id)
+		}
+		c.write(JSONRPCNotification{JSONRPC: "2.0", Method: "notifications/cancelled", Params: map[string]interface{}{"requestId": id, "reason": "load test timeout"}})
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *stdioClient) notify(method string, params interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(JSONRPCNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// write sends a message, c.mu must be held
+func (c *stdioClient) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// close closes the server stdin and waits for the running requests to answer
+func (c *stdioClient) close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// httpClient posts JSON-RPC requests to an MCP server behind HTTP, such as a
+// streamable HTTP gateway in front of the stdio server
+type httpClient struct {
+	url     string
+	client  *http.Client
+	nextID  int64
+	session atomic.Value
+}
+
+func (c *httpClient) call(ctx context.Context, method string, params interface{}) (*rpcReply, error) {
+	id := atomic.AddInt64(&c.nextID, 1)
+	body, err := c.post(ctx, JSONRPCRequest{JSONRPC: "2.0", ID: id, Method: method, Params: marshalParams(params)})
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range body {
+		if string(reply.ID) == strconv.FormatInt(id, 10) {
+			return reply, nil
+		}
+	}
+	return nil, errors.New("no response in the HTTP reply")
+}
+
+func (c *httpClient) notify(method string, params interface{}) error {
+	_, err := c.post(context.Background(), JSONRPCNotification{JSONRPC: "2.0", Method: method, Params: params})
+	return err
+}
+
+// post sends a message and returns the messages of the reply, sent either as
+// JSON or as server-sent events
+func (c *httpClient) post(ctx context.Context, message interface{}) ([]*rpcReply, error) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if session, _ := c.session.Load().(string); session != "" {
+		req.Header.Set("Mcp-Session-Id", session)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if session := resp.Header.Get("Mcp-Session-Id"); session != "" {
+		c.session.Store(session)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	var payloads [][]byte
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data:"); ok {
+				payloads = append(payloads, []byte(strings.TrimSpace(data)))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read event stream: %v", err)
+		}
+	} else {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %v", err)
+		}
+		payloads = append(payloads, body)
+	}
+
+	var replies []*rpcReply
+	for _, payload := range payloads {
+		if len(bytes.TrimSpace(payload)) == 0 {
+			continue
+		}
+		var reply rpcReply
+		if err := json.Unmarshal(payload, &reply); err != nil {
+			return nil, fmt.Errorf("failed to parse response: %v", err)
+		}
+		replies = append(replies, &reply)
+	}
+	return replies, nil
+}
+
+func (c *httpClient) close() error {
+	return nil
+}
+
+// marshalParams encodes the params of a request, nil when there are none
+func marshalParams(params interface{}) json.RawMessage {
+	if params == nil {
+		return nil
+	}
+	data, _ := json.Marshal(params)
+	return data
+}
+
+// loadSample is the outcome of one call of the load test
+type loadSample struct {
+	label   string
+	latency time.Duration
+	err     error
+}
+
+// LoadTestStats are the latencies and errors of the calls of one kind
+type LoadTestStats struct {
+	Call      string  `json:"call"`
+	Calls     int     `json:"calls"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+	P50Ms     float64 `json:"p50Ms"`
+	P90Ms     float64 `json:"p90Ms"`
+	P99Ms     float64 `json:"p99Ms"`
+	MaxMs     float64 `json:"maxMs"`
+	LastError string  `json:"lastError,omitempty"`
+}
+
+// LoadTestResult is the report of the loadtest subcommand
+type LoadTestResult struct {
+	Target      string          `json:"target"`
+	Concurrency int             `json:"concurrency"`
+	Calls       int             `json:"calls"`
+	Errors      int             `json:"errors"`
+	DurationMs  float64         `json:"durationMs"`
+	Throughput  float64         `json:"callsPerSecond"`
+	Stats       []LoadTestStats `json:"stats"`
+}
+
+// runLoadTest implements the loadtest subcommand: it replays a mix of tool
+// calls at the given concurrency against a server and reports latency
+// percentiles and error rates. It returns the process exit code.
+func runLoadTest(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	server := flags.String("server", "", "Server command to drive over stdio (default: this binary)")
+	url := flags.String("url", "", "URL of an MCP server behind HTTP, instead of a stdio server")
+	mixPath := flags.String("mix", "", "YAML file of the calls to replay and their weights (default: a read-only mix)")
+	concurrency := flags.Int("concurrency", 4, "Number of calls in flight at once")
+	requests := flags.Int("requests", 100, "Number of calls to make, ignored when -duration is set")
+	duration := flags.Duration("duration", 0, "Keep calling for this long, e.g. 5m")
+	timeout := flags.Duration("timeout", 2*time.Minute, "Timeout of each call, after which it is cancelled")
+	seed := flags.Int64("seed", 1, "Seed of the call mix, so runs are comparable")
+	format := flags.String("format", formatTableOutput, "Report format: json, table, markdown or csv")
+	verbose := flags.Bool("verbose", false, "Show the stderr of the stdio server")
+	maxErrorRate := flags.Float64("max-error-rate", 1, "Exit with 1 when the overall error rate is above this, e.g. 0.01")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *concurrency < 1 || (*duration <= 0 && *requests < 1) {
+		fmt.Fprintln(os.Stderr, "loadtest: -concurrency and -requests must be positive")
+		return 2
+	}
+	if err := validateFormat(*format); err != nil {
+		fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+		return 2
+	}
+
+	mix, err := loadLoadMix(*mixPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+		return 2
+	}
+
+	var client loadClient
+	var target string
+	if *url != "" {
+		client = &httpClient{url: *url, client: &http.Client{}}
+		target = *url
+	} else {
+		command := strings.Fields(*server)
+		if len(command) == 0 {
+			self, err := os.Executable()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "loadtest: failed to locate the server binary: %v\n", err)
+				return 1
+			}
+			command = []string{self}
+		}
+		stdio, err := startStdioClient(command, *verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+			return 1
+		}
+		client = stdio
+		target = strings.Join(command, " ")
+	}
+	defer client.close()
+
+	if err := initializeLoadClient(client, *timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+		return 1
+	}
+
+	result := driveLoad(client, mix, *concurrency, *requests, *duration, *timeout, *seed)
+	result.Target = target
+
+	report, err := formatResult(*format, result, result.tables)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "loadtest: %v\n", err)
+		return 1
+	}
+	fmt.Println(strings.TrimRight(report, "\n"))
+
+	if result.Calls > 0 && float64(result.Errors)/float64(result.Calls) > *maxErrorRate {
+		return 1
+	}
+	return 0
+}
+
+// initializeLoadClient performs the MCP handshake
+func initializeLoadClient(client loadClient, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	reply, err := client.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": "2024-11-05",
+		"clientInfo":      map[string]interface{}{"name": "kubevirt-mcp-loadtest", "version": "1.0.0"},
+		"capabilities":    map[string]interface{}{},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to initialize: %v", err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("failed to initialize: %s", reply.Error.Message)
+	}
+	return client.notify("notifications/initialized", nil)
+}
+
+// driveLoad makes the calls from concurrency workers, until requests calls
+// were made or, when set, duration elapsed
+func driveLoad(client loadClient, mix []loadCall, concurrency, requests int, duration, timeout time.Duration, seed int64) *LoadTestResult {
+	calls := make(chan loadCall)
+	go func() {
+		defer close(calls)
+		rng := rand.New(rand.NewSource(seed))
+		deadline := time.Now().Add(duration)
+		for i := 0; duration > 0 || i < requests; i++ {
+			if duration > 0 && time.Now().After(deadline) {
+				return
+			}
+			calls <- pickLoadCall(mix, rng)
+		}
+	}()
+
+	var mu sync.Mutex
+	var samples []loadSample
+	var workers sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for call := range calls {
+				sample := makeLoadCall(client, call, timeout)
+				mu.Lock()
+				samples = append(samples, sample)
+				mu.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+	elapsed := time.Since(start)
+
+	result := &LoadTestResult{
+		Concurrency: concurrency,
+		Calls:       len(samples),
+		DurationMs:  milliseconds(elapsed),
+		Stats:       loadStats(samples),
+	}
+	for _, sample := range samples {
+		if sample.err != nil {
+			result.Errors++
+		}
+	}
+	if elapsed > 0 {
+		result.Throughput = math.Round(float64(len(samples))/elapsed.Seconds()*100) / 100
+	}
+	return result
+}
+
+// makeLoadCall makes one call and measures it. JSON-RPC errors, such as a
+// failed kubectl command, count as errors of the call.
+func makeLoadCall(client loadClient, call loadCall, timeout time.Duration) loadSample {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	method, params := call.request()
+	start := time.Now()
+	reply, err := client.call(ctx, method, params)
+	sample := loadSample{label: call.label(), latency: time.Since(start), err: err}
+	if err == nil && reply.Error != nil {
+		sample.err = errors.New(reply.Error.Message)
+	}
+	return sample
+}
+
+// loadStats aggregates the samples per call, followed by the overall stats
+func loadStats(samples []loadSample) []LoadTestStats {
+	byLabel := map[string][]loadSample{}
+	var labels []string
+	for _, sample := range samples {
+		if _, ok := byLabel[sample.label]; !ok {
+			labels = append(labels, sample.label)
+		}
+		byLabel[sample.label] = append(byLabel[sample.label], sample)
+	}
+	sort.Strings(labels)
+
+	stats := make([]LoadTestStats, 0, len(labels)+1)
+	for _, label := range labels {
+		stats = append(stats, sampleStats(label, byLabel[label]))
+	}
+	return append(stats, sampleStats("all", samples))
+}
+
+// sampleStats computes the latency percentiles and error rate of samples
+func sampleStats(label string, samples []loadSample) LoadTestStats {
+	stats := LoadTestStats{Call: label, Calls: len(samples)}
+	if len(samples) == 0 {
+		return stats
+	}
+	latencies := make([]time.Duration, len(samples))
+	for i, sample := range samples {
+		latencies[i] = sample.latency
+		if sample.err != nil {
+			stats.Errors++
+			stats.LastError = sample.err.Error()
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.ErrorRate = math.Round(float64(stats.Errors)/float64(len(samples))*10000) / 10000
+	stats.P50Ms = milliseconds(percentile(latencies, 50))
+	stats.P90Ms = milliseconds(percentile(latencies, 90))
+	stats.P99Ms = milliseconds(percentile(latencies, 99))
+	stats.MaxMs = milliseconds(latencies[len(latencies)-1])
+	return stats
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// milliseconds converts a duration to milliseconds with a 0.1ms precision
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+// tables renders the load test report as tables
+func (r *LoadTestResult) tables() []table {
+	summary := table{
+		title:   "Load test",
+		headers: []string{"TARGET", "CONCURRENCY", "CALLS", "ERRORS", "DURATION", "CALLS/S"},
+		rows: [][]string{{
+			r.Target,
+			strconv.Itoa(r.Concurrency),
+			strconv.Itoa(r.Calls),
+			strconv.Itoa(r.Errors),
+			fmt.Sprintf("%.1fs", r.DurationMs/1000),
+			strconv.FormatFloat(r.Throughput, 'f', 2, 64),
+		}},
+	}
+	latency := table{
+		title:   "Latency (ms)",
+		headers: []string{"CALL", "CALLS", "ERRORS", "ERROR RATE", "P50", "P90", "P99", "MAX", "LAST ERROR"},
+	}
+	for _, s := range r.Stats {
+		latency.rows = append(latency.rows, []string{
+			s.Call,
+			strconv.Itoa(s.Calls),
+			strconv.Itoa(s.Errors),
+			fmt.Sprintf("%.2f%%", s.ErrorRate*100),
+			strconv.FormatFloat(s.P50Ms, 'f', 1, 64),
+			strconv.FormatFloat(s.P90Ms, 'f', 1, 64),
+			strconv.FormatFloat(s.P99Ms, 'f', 1, 64),
+			strconv.FormatFloat(s.MaxMs, 'f', 1, 64),
+			strings.SplitN(s.LastError, "\n", 2)[0],
+		})
+	}
+	return []table{summary, latency}
+}
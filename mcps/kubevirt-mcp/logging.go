@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// MCP log levels, ordered by increasing severity as in RFC 5424
+const (
+	LogDebug     = "debug"
+	LogInfo      = "info"
+	LogNotice    = "notice"
+	LogWarning   = "warning"
+	LogError     = "error"
+	LogCritical  = "critical"
+	LogAlert     = "alert"
+	LogEmergency = "emergency"
+)
+
+var logSeverity = map[string]int{
+	LogDebug:     0,
+	LogInfo:      1,
+	LogNotice:    2,
+	LogWarning:   3,
+	LogError:     4,
+	LogCritical:  5,
+	LogAlert:     6,
+	LogEmergency: 7,
+}
+
+var (
+	logLevelMu sync.Mutex
+	logLevel   = LogInfo
+)
+
+// setLogLevel sets the minimum level of the notifications/message entries
+// sent to the client, as requested with logging/setLevel
+func setLogLevel(level string) error {
+	if _, ok := logSeverity[level]; !ok {
+		return &invalidParamsError{err: fmt.Errorf("unknown log level '%s'", level)}
+	}
+	logLevelMu.Lock()
+	logLevel = level
+	logLevelMu.Unlock()
+	return nil
+}
+
+// logMessage sends a diagnostic as a notifications/message entry when its
+// level is at or above the client's log level. Everything but debug entries
+// is also written to stderr.
+func logMessage(level, logger, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if level != LogDebug {
+		log.Printf("[%s] %s: %s", level, logger, message)
+	}
+
+	logLevelMu.Lock()
+	enabled := logSeverity[level] >= logSeverity[logLevel]
+	logLevelMu.Unlock()
+	if !enabled {
+		return
+	}
+
+	sendNotification("notifications/message", map[string]interface{}{
+		"level":  level,
+		"logger": logger,
+		"data":   message,
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Login methods of cluster_login
+const (
+	loginToken    = "token"
+	loginPassword = "password"
+	loginOIDC     = "oidc"
+	loginExec     = "exec"
+
+	// openShiftChallengingClient is the OAuth client oc uses for username and
+	// password logins
+	openShiftChallengingClient = "openshift-challenging-client"
+
+	loginContext = "kubevirt-mcp"
+)
+
+// LoginParams represents the parameters for logging in to a cluster
+type LoginParams struct {
+	Server                string `json:"server"`
+	Method                string `json:"method,omitempty"`
+	Namespace             string `json:"namespace,omitempty"`
+	InsecureSkipTLSVerify bool   `json:"insecure_skip_tls_verify,omitempty"`
+	CertificateAuthority  string `json:"certificate_authority,omitempty"`
+
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	OIDCIssuerURL    string   `json:"oidc_issuer_url,omitempty"`
+	OIDCClientID     string   `json:"oidc_client_id,omitempty"`
+	OIDCClientSecret string   `json:"oidc_client_secret,omitempty"`
+	OIDCExtraScopes  []string `json:"oidc_extra_scopes,omitempty"`
+
+	ExecCommand string            `json:"exec_command,omitempty"`
+	ExecArgs    []string          `json:"exec_args,omitempty"`
+	ExecEnv     map[string]string `json:"exec_env,omitempty"`
+}
+
+// LoginResult reports the kubeconfig written by cluster_login
+type LoginResult struct {
+	Server      string `json:"server"`
+	Method      string `json:"method"`
+	Kubeconfig  string `json:"kubeconfig"`
+	ClusterType string `json:"clusterType,omitempty"`
+	User        string `json:"user,omitempty"`
+	Message     string `json:"message"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "cluster_login",
+		Description: "Log in to a cluster like 'oc login' with a token, OpenShift OAuth username/password, an OIDC issuer or a client-go exec credential plugin (e.g. for Kerberos), and use the resulting kubeconfig for all tools",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"server": map[string]interface{}{
+					"type":        "string",
+					"description": "API server URL, e.g. https://api.cluster.example.com:6443",
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "How to authenticate; defaults to token when a token is given and password when a username is given",
+					"enum":        []string{loginToken, loginPassword, loginOIDC, loginExec},
+				},
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Default namespace of the kubeconfig context",
+				},
+				"insecure_skip_tls_verify": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Skip verification of the API server certificate",
+					"default":     false,
+				},
+				"certificate_authority": map[string]interface{}{
+					"type":        "string",
+					"description": "Path to a CA bundle verifying the API and OAuth server certificates",
+				},
+				"token": map[string]interface{}{
+					"type":        "string",
+					"description": "Bearer token (method token), e.g. from the OpenShift console 'Copy login command'",
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "User name for the OpenShift OAuth server (method password)",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Password for the OpenShift OAuth server (method password)",
+				},
+				"oidc_issuer_url": map[string]interface{}{
+					"type":        "string",
+					"description": "OIDC issuer URL (method oidc), tokens are obtained by the kubectl oidc-login plugin",
+				},
+				"oidc_client_id": map[string]interface{}{
+					"type":        "string",
+					"description": "OIDC client ID (method oidc)",
+				},
+				"oidc_client_secret": map[string]interface{}{
+					"type":        "string",
+					"description": "OIDC client secret (method oidc), if the client is confidential",
+				},
+				"oidc_extra_scopes": map[string]interface{}{
+					"type":        "array",
+					"description": "Additional OIDC scopes (method oidc), e.g. groups",
+					"items":       map[string]interface{}{"type": "string"},
+				},
+				"exec_command": map[string]interface{}{
+					"type":        "string",
+					"description": "Credential plugin command (method exec), printing a client.authentication.k8s.io ExecCredential",
+				},
+				"exec_args": map[string]interface{}{
+					"type":        "array",
+					"description": "Arguments of the credential plugin (method exec)",
+					"items":       map[string]interface{}{"type": "string"},
+				},
+				"exec_env": map[string]interface{}{
+					"type":        "object",
+					"description": "Environment variables of the credential plugin (method exec)",
+					"additionalProperties": map[string]interface{}{
+						"type": "string",
+					},
+				},
+			},
+			"required": []string{"server"},
+		},
+		Handler: handleLogin,
+	})
+}
+
+// handleLogin is the tools/call handler for cluster_login
+func handleLogin(ctx context.Context, args json.RawMessage) (string, error) {
+	var params LoginParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Server == "" {
+		return "", missingArgument("server")
+	}
+	if params.Method == "" {
+		switch {
+		case params.Token != "":
+			params.Method = loginToken
+		case params.Username != "":
+			params.Method = loginPassword
+		case params.OIDCIssuerURL != "":
+			params.Method = loginOIDC
+		case params.ExecCommand != "":
+			params.Method = loginExec
+		default:
+			return "", &invalidParamsError{err: errors.New("provide token, username and password, oidc_issuer_url or exec_command")}
+		}
+	}
+
+	user, err := loginUser(ctx, params)
+	if err != nil {
+		var paramsErr *invalidParamsError
+		if !errors.As(err, &paramsErr) {
+			loginFailuresTotal.inc("cluster")
+		}
+		return "", err
+	}
+
+	stored := loginKubeconfigPath()
+	if err := writeLoginKubeconfig(stored, params, user); err != nil {
+		return "", err
+	}
+	if credentialsKey != nil {
+		stored += encryptedSuffix
+	}
+	logMessage(LogInfo, "login", "Wrote %s kubeconfig for %s to %s", params.Method, params.Server, stored)
+	path, ok := credentialFile(loginKubeconfigPath())
+	if !ok {
+		return "", fmt.Errorf("failed to read back the kubeconfig %s", stored)
+	}
+
+	result := &LoginResult{Server: params.Server, Method: params.Method, Kubeconfig: stored}
+	reportProgress(ctx, "testing connectivity to %s", params.Server)
+	clusterInfo := testClusterConnectivity(path)
+	if !clusterInfo.Found {
+		loginFailuresTotal.inc("cluster")
+		return "", fmt.Errorf("logged in but the cluster is not accessible: %s", clusterInfo.Message)
+	}
+	result.Message = "Logged in, the kubeconfig is used by all tools"
+	if clusterType, _, err := detectClusterType(path); err == nil {
+		result.ClusterType = clusterType
+	}
+	whoamiCtx, cancel := clock.WithTimeout(ctx, timeoutFor(timeoutLogin))
+	defer cancel()
+	if output, err := commandOutput(whoamiCtx, exec.CommandContext(whoamiCtx, "kubectl", "--kubeconfig", path, "auth", "whoami", "-o", "jsonpath={.status.userInfo.username}"), false); err == nil {
+		result.User = strings.TrimSpace(string(output))
+	}
+	if serverConfig.Detection.Kubeconfig != "" {
+		result.Message = "Logged in, but KUBECONFIG is set and takes precedence over the login kubeconfig"
+	}
+	return formatJSON(result)
+}
+
+// loginUser returns the kubeconfig user entry for the login method
+func loginUser(ctx context.Context, params LoginParams) (map[string]interface{}, error) {
+	switch params.Method {
+	case loginToken:
+		if params.Token == "" {
+			return nil, missingArgument("token")
+		}
+		return map[string]interface{}{"token": params.Token}, nil
+
+	case loginPassword:
+		if params.Username == "" || params.Password == "" {
+			return nil, missingArgument("username and password")
+		}
+		reportProgress(ctx, "requesting a token from the OpenShift OAuth server")
+		token, err := requestOAuthToken(params)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"token": token}, nil
+
+	case loginOIDC:
+		if params.OIDCIssuerURL == "" || params.OIDCClientID == "" {
+			return nil, missingArgument("oidc_issuer_url and oidc_client_id")
+		}
+		args := []string{"oidc-login", "get-token", "--oidc-issuer-url=" + params.OIDCIssuerURL, "--oidc-client-id=" + params.OIDCClientID}
+		if params.OIDCClientSecret != "" {
+			args = append(args, "--oidc-client-secret="+params.OIDCClientSecret)
+		}
+		for _, scope := range params.OIDCExtraScopes {
+			args = append(args, "--oidc-extra-scope="+scope)
+		}
+		if params.CertificateAuthority != "" {
+			args = append(args, "--certificate-authority="+params.CertificateAuthority)
+		}
+		return execUser("kubectl", args, nil), nil
+
+	case loginExec:
+		if params.ExecCommand == "" {
+			return nil, missingArgument("exec_command")
+		}
+		return execUser(params.ExecCommand, params.ExecArgs, params.ExecEnv), nil
+	}
+	return nil, &invalidParamsError{err: fmt.Errorf("unsupported login method '%s'", params.Method)}
+}
+
+// execUser returns a kubeconfig user delegating to a client-go credential plugin
+func execUser(command string, args []string, env map[string]string) map[string]interface{} {
+	plugin := map[string]interface{}{
+		"apiVersion":         "client.authentication.k8s.io/v1",
+		"command":            command,
+		"args":               args,
+		"interactiveMode":    "Never",
+		"provideClusterInfo": false,
+	}
+	var envVars []map[string]string
+	for name, value := range env {
+		envVars = append(envVars, map[string]string{"name": name, "value": value})
+	}
+	if len(envVars) > 0 {
+		plugin["env"] = envVars
+	}
+	return map[string]interface{}{"exec": plugin}
+}
+
+// requestOAuthToken obtains a token from the OpenShift OAuth server with the
+// challenging client, the way "oc login -u -p" does
+func requestOAuthToken(params LoginParams) (string, error) {
+	client, err := loginHTTPClient(params)
+	if err != nil {
+		return "", err
+	}
+
+	// The API server advertises the OAuth server
+	resp, err := client.Get(strings.TrimSuffix(params.Server, "/") + "/.well-known/oauth-authorization-server")
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the OAuth server: %v", err)
+	}
+	var metadata struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&metadata)
+	resp.Body.Close()
+	if err != nil || metadata.AuthorizationEndpoint == "" {
+		return "", fmt.Errorf("the server does not advertise an OpenShift OAuth server, use the token, oidc or exec method")
+	}
+
+	authorize := metadata.AuthorizationEndpoint + "?" + url.Values{
+		"response_type": {"token"},
+		"client_id":     {openShiftChallengingClient},
+	}.Encode()
+	req, err := http.NewRequest(http.MethodGet, authorize, nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(params.Username, params.Password)
+	req.Header.Set("X-CSRF-Token", "1")
+
+	// The token comes back in the fragment of the redirect location
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request a token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", fmt.Errorf("login failed for user '%s'", params.Username)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("unexpected OAuth response: %s", resp.Status)
+	}
+	fragment, err := url.ParseQuery(location.Fragment)
+	if err != nil || fragment.Get("access_token") == "" {
+		return "", fmt.Errorf("the OAuth server returned no token: %s", location.Query().Get("error_description"))
+	}
+	return fragment.Get("access_token"), nil
+}
+
+// loginHTTPClient returns an HTTP client honoring the TLS login parameters
+func loginHTTPClient(params LoginParams) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: params.InsecureSkipTLSVerify}
+	if params.CertificateAuthority != "" {
+		ca, err := os.ReadFile(params.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certificate authority: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", params.CertificateAuthority)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeoutFor(timeoutLogin),
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+// writeLoginKubeconfig writes a kubeconfig with a single context for the
+// server and user. It is only readable by the owner and encrypted when a
+// credentials key is set, as it may hold a token.
+func writeLoginKubeconfig(path string, params LoginParams, user map[string]interface{}) error {
+	cluster := map[string]interface{}{"server": params.Server}
+	if params.InsecureSkipTLSVerify {
+		cluster["insecure-skip-tls-verify"] = true
+	}
+	if params.CertificateAuthority != "" {
+		cluster["certificate-authority"] = params.CertificateAuthority
+	}
+	kubeContext := map[string]interface{}{"cluster": loginContext, "user": loginContext}
+	if params.Namespace != "" {
+		kubeContext["namespace"] = params.Namespace
+	}
+
+	data, err := yaml.Marshal(map[string]interface{}{
+		"apiVersion":      "v1",
+		"kind":            "Config",
+		"clusters":        []map[string]interface{}{{"name": loginContext, "cluster": cluster}},
+		"users":           []map[string]interface{}{{"name": loginContext, "user": user}},
+		"contexts":        []map[string]interface{}{{"name": loginContext, "context": kubeContext}},
+		"current-context": loginContext,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal kubeconfig: %v", err)
+	}
+	return writeCredential(path, data)
+}
+
+// loginKubeconfigPath returns the kubeconfig written by cluster_login, see
+// credentialFile for the file commands can read
+func loginKubeconfigPath() string {
+	return filepath.Join(stateDir(), "kubeconfig")
+}
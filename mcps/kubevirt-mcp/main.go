@@ -1,9 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"sync"
 )
 
 // Core MCP structures
@@ -12,6 +22,12 @@ type JSONRPCRequest struct {
 	ID      interface{}     `json:"id"`
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params,omitempty"`
+
+	// batch collects the response when the request is part of a batch
+	batch *rpcBatch
+	// conn is the stream the request was read from, stdout or a client
+	// connection of the listener
+	conn *rpcWriter
 }
 
 type JSONRPCResponse struct {
@@ -21,6 +37,53 @@ type JSONRPCResponse struct {
 	Error   *RPCError   `json:"error,omitempty"`
 }
 
+// JSONRPCNotification is a message without an ID that expects no response
+type JSONRPCNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// rpcWriter serializes the messages written to stdout or to a connection,
+// since notifications can be sent while a request is being handled
+type rpcWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (w *rpcWriter) send(v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Encode(v)
+}
+
+// maxConcurrencyEnv limits the number of requests handled at once, like
+// maxConcurrency in the configuration file and the --max-concurrency flag
+const maxConcurrencyEnv = "KUBEVIRT_MCP_MAX_CONCURRENCY"
+
+// resultBudget limits the size of tool results, nil when unlimited
+var resultBudget *contextBudget
+
+// output is the stdout writer shared by responses and notifications
+var output = &rpcWriter{}
+
+// sendNotification sends a JSON-RPC notification to every client
+func sendNotification(method string, params interface{}) {
+	for _, w := range append([]*rpcWriter{output}, listenerConns()...) {
+		notify(w, method, params)
+	}
+}
+
+// notify sends a JSON-RPC notification to one client
+func notify(w *rpcWriter, method string, params interface{}) {
+	if err := w.send(JSONRPCNotification{JSONRPC: "2.0", Method: method, Params: params}); err != nil {
+		log.Printf("Failed to send notification: %v", err)
+	}
+}
+
 // Helper function to ensure ID is never nil
 func safeID(id interface{}) interface{} {
 	if id == nil {
@@ -35,24 +98,133 @@ type RPCError struct {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		os.Exit(runLoadTest(os.Args[2:]))
+	}
+
 	log.SetOutput(os.Stderr)
+
+	config, err := loadConfiguration(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	serverConfig = config
+	handleSignals()
+	clusters = loadClusters()
+	fixtures = loadCassette()
+	if err := startCredentials(); err != nil {
+		log.Fatalf("Failed to load the credentials key: %v", err)
+	}
+	if err := startPolicy(); err != nil {
+		log.Fatalf("Failed to load the policy: %v", err)
+	}
+	if err := startExecPolicy(); err != nil {
+		log.Fatalf("Failed to load the exec policy: %v", err)
+	}
+	if err := startAudit(); err != nil {
+		log.Fatalf("Failed to open the audit log: %v", err)
+	}
+	if err := startTracing(); err != nil {
+		log.Fatalf("Failed to start tracing: %v", err)
+	}
+	if err := startSimulation(); err != nil {
+		log.Fatalf("Failed to start the simulation: %v", err)
+	}
 	log.Println("KubeVirt MCP server running")
 
-	decoder := json.NewDecoder(os.Stdin)
-	encoder := json.NewEncoder(os.Stdout)
+	monitoring, err := startMonitor()
+	if err != nil {
+		log.Fatalf("Failed to start conformance monitor: %v", err)
+	}
+	startMetrics()
+
+	if err := startGC(); err != nil {
+		log.Fatalf("Failed to start garbage collection: %v", err)
+	}
+
+	if err := startSessionPool(); err != nil {
+		log.Fatalf("Failed to start the session pool: %v", err)
+	}
+
+	if err := startHistory(); err != nil {
+		log.Fatalf("Failed to start the history recorder: %v", err)
+	}
+
+	if err := startSnapshotScheduler(); err != nil {
+		log.Fatalf("Failed to start the snapshot scheduler: %v", err)
+	}
+
+	if err := startRestartScheduler(); err != nil {
+		log.Fatalf("Failed to start the restart scheduler: %v", err)
+	}
+
+	resultBudget = loadContextBudget()
+
+	// Each request is handled on its own goroutine so a slow tool call does
+	// not block the others, optionally bounded by a maximum concurrency
+	slots, err := concurrencySlots()
+	if err != nil {
+		log.Fatalf("Failed to configure request handling: %v", err)
+	}
+
+	if serverConfig.HTTP.Addr != "" && serverConfig.Listen != "" {
+		log.Fatalf("Set either the HTTP address or the listen address, not both")
+	}
+	if serverConfig.HTTP.Addr != "" {
+		// Responses go back over HTTP, stdout stays unused
+		err := serveHTTP(slots)
+		closeServer()
+		if err != nil {
+			log.Fatalf("HTTP transport stopped: %v", err)
+		}
+		return
+	}
+
+	if serverConfig.Listen != "" {
+		// Every connection is served like stdio, which stays unused
+		err := serveListener(slots)
+		closeServer()
+		if err != nil {
+			log.Fatalf("Listener stopped: %v", err)
+		}
+		return
+	}
+
+	output.encoder = json.NewEncoder(os.Stdout)
+	serveStream(serverCtx, os.Stdin, output, slots)
+	closeServer()
+
+	if monitoring && serverCtx.Err() == nil {
+		// Keep serving metrics when deployed as a standalone monitor
+		log.Println("stdin closed, conformance monitor keeps running")
+		<-serverCtx.Done()
+	}
+}
+
+// serveStream serves the newline delimited requests of stdin or of a
+// listener connection until it is closed or ctx is done, sending the
+// responses to w. The requests still running are waited for before
+// returning.
+func serveStream(ctx context.Context, input io.Reader, w *rpcWriter, slots chan struct{}) {
+	// Requests are read on their own goroutine so cancellations are seen
+	// while a request is being handled
+	requests := make(chan JSONRPCRequest)
+	go readRequests(input, w, requests)
+	var pending sync.WaitGroup
 
 	for {
-		var req JSONRPCRequest
-		if err := decoder.Decode(&req); err != nil {
-			if err.Error() != "EOF" {
-				log.Printf("Failed to decode JSON-RPC request: %v", err)
-			}
+		req, ok := nextRequest(ctx, requests)
+		if !ok {
 			break
 		}
 
 		// Validate that we have a proper request
 		if req.JSONRPC != "2.0" {
 			log.Printf("Invalid JSON-RPC version: %s", req.JSONRPC)
+			skipResponse(req)
 			continue
 		}
 
@@ -64,18 +236,154 @@ func main() {
 				ID:      safeID(req.ID),
 				Error:   &RPCError{Code: -32600, Message: "Invalid Request: missing method"},
 			}
-			encoder.Encode(resp)
+			sendResponse(req, resp)
 			continue
 		}
 
-		resp := handleRequest(req)
-		if err := encoder.Encode(resp); err != nil {
-			log.Printf("Failed to encode response: %v", err)
+		// Notifications such as notifications/initialized get no response
+		if req.ID == nil && strings.HasPrefix(req.Method, "notifications/") {
+			skipResponse(req)
+			continue
 		}
+
+		// Register the request before it waits for a slot, so it can be
+		// cancelled while queued
+		reqCtx, done := startRequest(ctx, req)
+		pending.Add(1)
+		go func(req JSONRPCRequest) {
+			defer pending.Done()
+			defer done()
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+					defer func() { <-slots }()
+				case <-reqCtx.Done():
+					log.Printf("Request %v cancelled before it started", req.ID)
+					if shuttingDown(reqCtx) {
+						sendResponse(req, shutdownResponse(req))
+					} else {
+						skipResponse(req)
+					}
+					return
+				}
+			}
+			serveRequest(reqCtx, req)
+		}(req)
 	}
+
+	// Let the requests still running answer before returning
+	waitRequests(ctx, &pending)
 }
 
-func handleRequest(req JSONRPCRequest) JSONRPCResponse {
+// concurrencySlots returns a semaphore bounding the number of requests handled
+// at once, or nil when the maximum concurrency is unset or 0
+func concurrencySlots() (chan struct{}, error) {
+	limit := serverConfig.MaxConcurrency
+	if limit < 0 {
+		return nil, fmt.Errorf("invalid maximum concurrency %d", limit)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	return make(chan struct{}, limit), nil
+}
+
+// serveRequest handles a request and sends its response
+func serveRequest(ctx context.Context, req JSONRPCRequest) {
+	resp := handleRequest(ctx, req)
+
+	// Cancelled requests get no response, the client already gave up on
+	// them, unless the server cancelled them to shut down
+	if shuttingDown(ctx) {
+		if resp.Error != nil {
+			resp = shutdownResponse(req)
+		}
+	} else if ctx.Err() != nil {
+		log.Printf("Request %v cancelled", req.ID)
+		skipResponse(req)
+		return
+	}
+
+	if err := sendResponse(req, resp); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// readRequests decodes the requests of a stream until EOF, answering on w.
+// Cancellations are applied immediately, everything else is passed on to
+// requests. Messages are newline delimited, so a malformed one is answered
+// with a parse error without losing the following ones. A JSON array is a
+// batch.
+func readRequests(input io.Reader, w *rpcWriter, requests chan<- JSONRPCRequest) {
+	defer close(requests)
+	reader := bufio.NewReader(input)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if message := bytes.TrimSpace(line); len(message) > 0 {
+			if message[0] == '[' {
+				readBatch(message, w, requests)
+			} else {
+				dispatchMessage(message, w, nil, requests)
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF && !errors.Is(readErr, net.ErrClosed) {
+				log.Printf("Failed to read JSON-RPC request: %v", readErr)
+			}
+			return
+		}
+	}
+}
+
+// dispatchMessage decodes one JSON-RPC message of a stream or of a batch,
+// answers it when it is malformed and applies cancellations, passing
+// everything else on to requests
+func dispatchMessage(message []byte, w *rpcWriter, batch *rpcBatch, requests chan<- JSONRPCRequest) {
+	req, rpcErr := decodeRequest(message)
+	req.batch = batch
+	req.conn = w
+	switch {
+	case rpcErr != nil:
+		log.Printf("Failed to decode JSON-RPC request: %s", rpcErr.Message)
+		sendResponse(req, JSONRPCResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcErr})
+	case isCancellation(req):
+		cancelRequest(req)
+		skipResponse(req)
+	default:
+		requests <- req
+	}
+}
+
+// decodeRequest parses one JSON-RPC message, returning the error to send
+// back when it is not valid JSON or not a request object. The ID is kept
+// when it could be read, so the error can be matched to the request.
+func decodeRequest(line []byte) (JSONRPCRequest, *RPCError) {
+	var req JSONRPCRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return req, &RPCError{Code: -32600, Message: "Invalid Request: " + err.Error()}
+		}
+		return req, &RPCError{Code: -32700, Message: "Parse error: " + err.Error()}
+	}
+	return req, nil
+}
+
+// handleRequest answers a request, in a span when tracing is enabled
+func handleRequest(ctx context.Context, req JSONRPCRequest) JSONRPCResponse {
+	ctx, span := startRequestSpan(ctx, req)
+	resp := dispatchRequest(ctx, req)
+	if resp.Error != nil {
+		span.setAttribute("rpc.jsonrpc.error_code", resp.Error.Code)
+		span.end(errors.New(resp.Error.Message))
+	} else {
+		span.end(nil)
+	}
+	return resp
+}
+
+// dispatchRequest answers a request according to its method
+func dispatchRequest(ctx context.Context, req JSONRPCRequest) JSONRPCResponse {
 	switch req.Method {
 	case "initialize":
 		return JSONRPCResponse{
@@ -84,7 +392,12 @@ func handleRequest(req JSONRPCRequest) JSONRPCResponse {
 			Result: map[string]interface{}{
 				"protocolVersion": "2024-11-05",
 				"serverInfo":      map[string]interface{}{"name": "kubevirt-mcp", "version": "1.0.0"},
-				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"capabilities": map[string]interface{}{
+					"tools":     map[string]interface{}{},
+					"logging":   map[string]interface{}{},
+					"resources": map[string]interface{}{},
+					"prompts":   map[string]interface{}{},
+				},
 			},
 		}
 
@@ -93,128 +406,223 @@ func handleRequest(req JSONRPCRequest) JSONRPCResponse {
 			JSONRPC: "2.0",
 			ID:      safeID(req.ID),
 			Result: map[string]interface{}{
-				"tools": []map[string]interface{}{
-					{
-						"name":        "detect_kubevirtci_cluster",
-						"description": "Detect kubevirtci cluster and set KUBECONFIG",
-						"inputSchema": map[string]interface{}{
-							"type":       "object",
-							"properties": map[string]interface{}{},
-						},
-					},
-					{
-						"name":        "vm_exec",
-						"description": "Execute a command on a KubeVirt VM via console connection",
-						"inputSchema": map[string]interface{}{
-							"type": "object",
-							"properties": map[string]interface{}{
-								"namespace": map[string]interface{}{
-									"type":        "string",
-									"description": "Kubernetes namespace containing the VM",
-									"default":     "default",
-								},
-								"vm_name": map[string]interface{}{
-									"type":        "string",
-									"description": "Name of the VM or VMI to execute command on",
-								},
-								"command": map[string]interface{}{
-									"type":        "string",
-									"description": "Command to execute inside the VM",
-								},
-								"timeout": map[string]interface{}{
-									"type":        "integer",
-									"description": "Timeout in seconds (default: 30)",
-									"default":     30,
-								},
-								"verbose": map[string]interface{}{
-									"type":        "boolean",
-									"description": "Enable verbose console logging",
-									"default":     false,
-								},
-							},
-							"required": []string{"vm_name", "command"},
-						},
-					},
-				},
+				"tools": identityTools(ctx, listTools()),
 			},
 		}
 
-	case "tools/call":
+	case "resources/list":
 		var params struct {
-			Name      string          `json:"name"`
-			Arguments json.RawMessage `json:"arguments,omitempty"`
+			Cursor string `json:"cursor"`
 		}
 		json.Unmarshal(req.Params, &params)
 
-		if params.Name == "detect_kubevirtci_cluster" {
-			result, err := detectKubevirtciCluster()
-			if err != nil {
-				return JSONRPCResponse{
-					JSONRPC: "2.0",
-					ID:      safeID(req.ID),
-					Error:   &RPCError{Code: -32603, Message: err.Error()},
-				}
-			}
+		resources, nextCursor, err := listResources(ctx, params.Cursor)
+		if err != nil {
 			return JSONRPCResponse{
 				JSONRPC: "2.0",
 				ID:      safeID(req.ID),
-				Result: map[string]interface{}{
-					"content": []map[string]interface{}{
-						{"type": "text", "text": result},
-					},
-				},
+				Error:   toolError(err),
 			}
 		}
+		result := map[string]interface{}{"resources": resources}
+		if nextCursor != "" {
+			result["nextCursor"] = nextCursor
+		}
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Result:  result,
+		}
 
-		if params.Name == "vm_exec" {
-			var vmParams VMExecParams
-			if err := json.Unmarshal(params.Arguments, &vmParams); err != nil {
-				return JSONRPCResponse{
-					JSONRPC: "2.0",
-					ID:      safeID(req.ID),
-					Error:   &RPCError{Code: -32602, Message: "Invalid parameters: " + err.Error()},
-				}
-			}
+	case "resources/read":
+		var params struct {
+			URI string `json:"uri"`
+		}
+		json.Unmarshal(req.Params, &params)
 
-			// Set defaults if not provided
-			if vmParams.Namespace == "" {
-				vmParams.Namespace = "default"
-			}
-			if vmParams.Timeout == 0 {
-				vmParams.Timeout = 30
+		contents, err := readResource(ctx, params.URI)
+		if err != nil {
+			return JSONRPCResponse{
+				JSONRPC: "2.0",
+				ID:      safeID(req.ID),
+				Error:   toolError(err),
 			}
+		}
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Result:  contents,
+		}
 
-			result, err := executeVMCommand(vmParams)
-			if err != nil {
-				return JSONRPCResponse{
-					JSONRPC: "2.0",
-					ID:      safeID(req.ID),
-					Error:   &RPCError{Code: -32603, Message: err.Error()},
-				}
+	case "prompts/list":
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Result: map[string]interface{}{
+				"prompts": listPrompts(),
+			},
+		}
+
+	case "prompts/get":
+		var params struct {
+			Name      string            `json:"name"`
+			Arguments map[string]string `json:"arguments,omitempty"`
+		}
+		json.Unmarshal(req.Params, &params)
+
+		prompt, err := getPrompt(params.Name, params.Arguments)
+		if err != nil {
+			return JSONRPCResponse{
+				JSONRPC: "2.0",
+				ID:      safeID(req.ID),
+				Error:   toolError(err),
 			}
+		}
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Result:  prompt,
+		}
 
+	case "logging/setLevel":
+		var params struct {
+			Level string `json:"level"`
+		}
+		json.Unmarshal(req.Params, &params)
+
+		if err := setLogLevel(params.Level); err != nil {
 			return JSONRPCResponse{
 				JSONRPC: "2.0",
 				ID:      safeID(req.ID),
-				Result: map[string]interface{}{
-					"content": []map[string]interface{}{
-						{"type": "text", "text": result},
-					},
-				},
+				Error:   toolError(err),
 			}
 		}
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Result:  map[string]interface{}{},
+		}
 
+	case "tools/call":
+		start := clock.Now()
+		resp := callTool(ctx, req)
+		duration := clock.Now().Sub(start)
+		observeToolCall(req, resp, duration)
+		auditToolCall(ctx, req, resp, duration)
+		return resp
+
+	default:
 		return JSONRPCResponse{
 			JSONRPC: "2.0",
 			ID:      safeID(req.ID),
 			Error:   &RPCError{Code: -32601, Message: "Method not found"},
 		}
+	}
+}
 
-	default:
+// callTool handles a tools/call request: the call is completed with the
+// pinned and cluster arguments, checked against the identity and the
+// policies, then handled by the tool
+func callTool(ctx context.Context, req JSONRPCRequest) JSONRPCResponse {
+	var params struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments,omitempty"`
+		Meta      struct {
+			ProgressToken interface{} `json:"progressToken,omitempty"`
+		} `json:"_meta"`
+	}
+	json.Unmarshal(req.Params, &params)
+
+	tool, ok := lookupTool(params.Name)
+	if !ok {
 		return JSONRPCResponse{
 			JSONRPC: "2.0",
 			ID:      safeID(req.ID),
 			Error:   &RPCError{Code: -32601, Message: "Method not found"},
 		}
 	}
+
+	arguments, err := pinnedArguments(ctx, tool, params.Arguments)
+	if err != nil {
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Error:   toolError(err),
+		}
+	}
+	params.Arguments = arguments
+	ctx, err = withCluster(ctx, params.Arguments)
+	if err != nil {
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Error:   toolError(err),
+		}
+	}
+	params.Arguments = clusterArguments(ctx, tool, params.Arguments)
+	if err := authorizeToolCall(ctx, tool, params.Arguments); err != nil {
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Error:   toolError(err),
+		}
+	}
+	if err := evaluatePolicy(ctx, tool, params.Arguments); err != nil {
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Error:   toolError(err),
+		}
+	}
+	if err := checkExecPolicy(tool, params.Arguments); err != nil {
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Error:   toolError(err),
+		}
+	}
+	ctx = withProgress(ctx, params.Meta.ProgressToken)
+	ctx, structured := withStructuredContent(ctx)
+	result, err := tool.Handler(ctx, params.Arguments)
+	if err != nil {
+		return JSONRPCResponse{
+			JSONRPC: "2.0",
+			ID:      safeID(req.ID),
+			Error:   toolError(err),
+		}
+	}
+
+	// Artifacts keep the full result, the budget only applies to what
+	// is sent back to the client
+	artifacts := exportArtifacts(tool.Name, result)
+	note := ""
+	if len(artifacts) > 0 {
+		note = "full result in " + strings.Join(artifacts, ", ")
+	}
+	if wantsSummary(params.Arguments) {
+		if result, err = summarizeResult(ctx, tool.Name, result); err != nil {
+			return JSONRPCResponse{
+				JSONRPC: "2.0",
+				ID:      safeID(req.ID),
+				Error:   toolError(err),
+			}
+		}
+	}
+	toolResult := map[string]interface{}{
+		"content": []map[string]interface{}{
+			{"type": "text", "text": resultBudget.apply(result, note)},
+		},
+	}
+	if structured.value != nil {
+		toolResult["structuredContent"] = structured.value
+	}
+	if len(artifacts) > 0 {
+		toolResult["_meta"] = map[string]interface{}{"artifacts": artifacts}
+	}
+
+	return JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      safeID(req.ID),
+		Result:  toolResult,
+	}
 }
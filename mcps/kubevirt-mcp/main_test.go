@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		id      interface{}
+		method  string
+		code    int
+	}{
+		{"request", `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`, float64(1), "tools/list", 0},
+		{"string id", `{"jsonrpc":"2.0","id":"a","method":"ping"}`, "a", "ping", 0},
+		{"notification", `{"jsonrpc":"2.0","method":"notifications/initialized"}`, nil, "notifications/initialized", 0},
+		{"wrong type keeps the id", `{"jsonrpc":"2.0","id":7,"method":5}`, float64(7), "", -32600},
+		{"not an object", `7`, nil, "", -32600},
+		{"truncated", `{"jsonrpc":"2.0","id":1,"method":"tools/list"`, nil, "", -32700},
+		{"not JSON", `garbage`, nil, "", -32700},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, rpcErr := decodeRequest([]byte(tt.message))
+			code := 0
+			if rpcErr != nil {
+				code = rpcErr.Code
+			}
+			if code != tt.code || req.ID != tt.id || req.Method != tt.method {
+				t.Fatalf("decodeRequest() = id %v, method %q, error %+v, want id %v, method %q, code %d", req.ID, req.Method, rpcErr, tt.id, tt.method, tt.code)
+			}
+		})
+	}
+}
+
+func TestReadRequests(t *testing.T) {
+	input := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"tools/list"}`,
+		`garbage`,
+		"\r",
+		`{"jsonrpc":"2.0","id":2,"method":5}`,
+		`{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":99}}`,
+		`[]`,
+		// The last message needs no line ending
+		`{"jsonrpc":"2.0","id":3,"method":"ping"}`,
+	}, "\n")
+	var out bytes.Buffer
+	w := &rpcWriter{encoder: json.NewEncoder(&out)}
+	requests := make(chan JSONRPCRequest)
+	go readRequests(strings.NewReader(input), w, requests)
+
+	var methods []string
+	for req := range requests {
+		methods = append(methods, req.Method)
+	}
+	if want := []string{"tools/list", "ping"}; !reflect.DeepEqual(methods, want) {
+		t.Fatalf("requests = %q, want %q", methods, want)
+	}
+
+	type answer struct {
+		id   interface{}
+		code int
+	}
+	var answers []answer
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var resp JSONRPCResponse
+		if err := decoder.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, answer{resp.ID, resp.Error.Code})
+	}
+	want := []answer{{nil, -32700}, {float64(2), -32600}, {nil, -32600}}
+	if !reflect.DeepEqual(answers, want) {
+		t.Fatalf("responses = %+v, want %+v", answers, want)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	defaultMemoryDumpTimeout = 600
+
+	// memoryDumpOverhead is added to the guest memory when sizing a claim,
+	// for the dump headers and the filesystem
+	memoryDumpOverhead = 100 << 20
+	// cdiFilesystemOverhead is the default share of a Filesystem PVC that
+	// CDI reserves
+	cdiFilesystemOverhead = 0.055
+
+	memoryDumpCompleted = "Completed"
+	memoryDumpFailed    = "Failed"
+)
+
+// MemoryDumpParams represents the parameters of vm_memory_dump
+type MemoryDumpParams struct {
+	Namespace    string `json:"namespace,omitempty"`
+	VMName       string `json:"vm_name"`
+	ClaimName    string `json:"claim_name,omitempty"`
+	CreateClaim  bool   `json:"create_claim,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+	Remove       bool   `json:"remove,omitempty"`
+	Wait         bool   `json:"wait,omitempty"`
+	Timeout      int    `json:"timeout,omitempty"`
+}
+
+// MemoryDumpResult is the vm_memory_dump tool result
+type MemoryDumpResult struct {
+	Namespace    string `json:"namespace"`
+	VMName       string `json:"vmName"`
+	Action       string `json:"action"`
+	ClaimName    string `json:"claimName,omitempty"`
+	ClaimCreated bool   `json:"claimCreated,omitempty"`
+	ClaimSize    string `json:"claimSize,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	FileName     string `json:"fileName,omitempty"`
+	Duration     string `json:"duration,omitempty"`
+	Message      string `json:"message,omitempty"`
+	Note         string `json:"note,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_memory_dump",
+		Description: "Dump the memory of a running VM to a PVC through the KubeVirt memory-dump subresource, e.g. to collect crash artifacts of a hung guest, or remove the dump claim from the VM",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"claim_name": map[string]interface{}{
+					"type":        "string",
+					"description": "PVC receiving the dump, required unless create_claim is set (default with create_claim: generated from the VM name)",
+				},
+				"create_claim": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Create the PVC, sized from the guest memory",
+					"default":     false,
+				},
+				"storage_class": map[string]interface{}{
+					"type":        "string",
+					"description": "StorageClass of the created PVC (default: the cluster default)",
+				},
+				"remove": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Dissociate the dump PVC from the VM instead of dumping; the PVC and the dump are kept",
+					"default":     false,
+				},
+				"wait": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Wait until the dump completed or the PVC was removed",
+					"default":     false,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds when waiting (default: 600)",
+					"default":     defaultMemoryDumpTimeout,
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleMemoryDump,
+	})
+}
+
+// handleMemoryDump is the tools/call handler for vm_memory_dump
+func handleMemoryDump(ctx context.Context, args json.RawMessage) (string, error) {
+	var params MemoryDumpParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Timeout < 0 {
+		return "", &invalidParamsError{err: errors.New("timeout cannot be negative")}
+	}
+	if params.Remove && (params.CreateClaim || params.ClaimName != "") {
+		return "", &invalidParamsError{err: errors.New("remove removes the current dump claim, it cannot be combined with claim_name or create_claim")}
+	}
+	if !params.Remove && !params.CreateClaim && params.ClaimName == "" {
+		return "", &invalidParamsError{err: errors.New("claim_name is required unless create_claim is set")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultMemoryDumpTimeout
+	}
+
+	var result *MemoryDumpResult
+	var err error
+	if params.Remove {
+		result, err = removeMemoryDump(ctx, params)
+	} else {
+		result, err = dumpMemory(ctx, params)
+	}
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// dumpMemory creates the claim when asked, calls the memorydump subresource
+// and optionally waits until the dump completed
+func dumpMemory(ctx context.Context, params MemoryDumpParams) (*MemoryDumpResult, error) {
+	vmi, err := getRunningVMIObject(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return nil, err
+	}
+	result := &MemoryDumpResult{Namespace: params.Namespace, VMName: params.VMName, Action: "dump", ClaimName: params.ClaimName}
+
+	if params.CreateClaim {
+		size, err := memoryDumpSize(vmi)
+		if err != nil {
+			return nil, err
+		}
+		if result.ClaimName == "" {
+			result.ClaimName = generateName(params.VMName + "-memory-dump-")
+		}
+		spec := map[string]interface{}{
+			"accessModes": []string{"ReadWriteOnce"},
+			"volumeMode":  "Filesystem",
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{"storage": size},
+			},
+		}
+		if params.StorageClass != "" {
+			spec["storageClassName"] = params.StorageClass
+		}
+		if err := createObject(ctx, map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata": map[string]interface{}{
+				"name":      result.ClaimName,
+				"namespace": params.Namespace,
+				"labels":    managedLabels("vm_memory_dump", false),
+			},
+			"spec": spec,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to create memory dump claim: %v", err)
+		}
+		result.ClaimCreated, result.ClaimSize = true, size
+	}
+
+	// A previous dump to the same claim keeps its Completed phase until
+	// KubeVirt picks up the new request
+	var vm VirtualMachine
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	previous := vm.Status.MemoryDumpRequest
+
+	body, err := json.Marshal(map[string]interface{}{"claimName": result.ClaimName})
+	if err != nil {
+		return nil, err
+	}
+	start := clock.Now()
+	path := fmt.Sprintf("/apis/subresources.kubevirt.io/v1/namespaces/%s/virtualmachines/%s/memorydump", params.Namespace, params.VMName)
+	logMessage(LogInfo, "vm_memory_dump", "Dumping the memory of VM %s/%s to claim %s", params.Namespace, params.VMName, result.ClaimName)
+	if _, err := runKubectlWithInput(ctx, body, "replace", "--raw", path, "-f", "-"); err != nil {
+		return nil, fmt.Errorf("failed to dump the memory of VM %s/%s: %v", params.Namespace, params.VMName, err)
+	}
+
+	request, err := waitMemoryDump(ctx, params, func(request *MemoryDumpRequest) bool {
+		if request == nil || request.ClaimName != result.ClaimName || sameMemoryDump(request, previous) {
+			return false
+		}
+		return request.Phase == memoryDumpCompleted || request.Phase == memoryDumpFailed
+	})
+	if err != nil {
+		return nil, err
+	}
+	if request != nil && !sameMemoryDump(request, previous) {
+		result.Phase, result.Message = request.Phase, request.Message
+		if request.FileName != nil {
+			result.FileName = *request.FileName
+		}
+	}
+	switch {
+	case result.Phase == memoryDumpFailed:
+		return nil, fmt.Errorf("memory dump of VM %s/%s to claim %s failed: %s", params.Namespace, params.VMName, result.ClaimName, result.Message)
+	case result.Phase == memoryDumpCompleted:
+		result.Duration = humanDuration(clock.Now().Sub(start))
+		result.Note = "the dump stays on the claim, mount it in a pod to analyse it; vm_memory_dump with remove dissociates the claim from the VM"
+	default:
+		if result.Phase == "" {
+			result.Phase = "Requested"
+		}
+		result.Note = "the dump is in progress, the VM status.memoryDumpRequest reports its phase"
+	}
+	return result, nil
+}
+
+// removeMemoryDump calls the removememorydump subresource and optionally
+// waits until the claim is dissociated from the VM
+func removeMemoryDump(ctx context.Context, params MemoryDumpParams) (*MemoryDumpResult, error) {
+	var vm VirtualMachine
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	result := &MemoryDumpResult{Namespace: params.Namespace, VMName: params.VMName, Action: "remove"}
+	if vm.Status.MemoryDumpRequest == nil {
+		result.Note = "the VM has no memory dump claim"
+		return result, nil
+	}
+	result.ClaimName = vm.Status.MemoryDumpRequest.ClaimName
+
+	path := fmt.Sprintf("/apis/subresources.kubevirt.io/v1/namespaces/%s/virtualmachines/%s/removememorydump", params.Namespace, params.VMName)
+	logMessage(LogInfo, "vm_memory_dump", "Removing memory dump claim %s from VM %s/%s", result.ClaimName, params.Namespace, params.VMName)
+	if _, err := runKubectlWithInput(ctx, []byte("{}"), "replace", "--raw", path, "-f", "-"); err != nil {
+		return nil, fmt.Errorf("failed to remove the memory dump of VM %s/%s: %v", params.Namespace, params.VMName, err)
+	}
+
+	request, err := waitMemoryDump(ctx, params, func(request *MemoryDumpRequest) bool { return request == nil })
+	if err != nil {
+		return nil, err
+	}
+	if request != nil {
+		result.Phase = request.Phase
+		result.Note = "the claim is being dissociated from the VM"
+	} else {
+		result.Phase = "Removed"
+		result.Note = "the claim " + result.ClaimName + " and the dump on it are kept, delete the PVC when no longer needed"
+	}
+	return result, nil
+}
+
+// waitMemoryDump returns the memory dump request of the VM, polling until
+// done returns true when waiting
+func waitMemoryDump(ctx context.Context, params MemoryDumpParams, done func(*MemoryDumpRequest) bool) (*MemoryDumpRequest, error) {
+	deadline := clock.Now().Add(time.Duration(params.Timeout) * time.Second)
+	if params.Wait {
+		reportProgress(ctx, "waiting for the memory dump of VM %s/%s", params.Namespace, params.VMName)
+	}
+	for {
+		var vm VirtualMachine
+		if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		request := vm.Status.MemoryDumpRequest
+		if !params.Wait || done(request) {
+			return request, nil
+		}
+		if clock.Now().After(deadline) {
+			phase := "none"
+			if request != nil {
+				phase = request.Phase
+			}
+			return nil, fmt.Errorf("memory dump of VM %s/%s did not finish within %ds (phase %s)", params.Namespace, params.VMName, params.Timeout, phase)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for the memory dump of VM %s/%s cancelled", params.Namespace, params.VMName)
+		case <-clock.After(2 * time.Second):
+		}
+	}
+}
+
+// sameMemoryDump reports whether two requests are the same dump
+func sameMemoryDump(request, previous *MemoryDumpRequest) bool {
+	if previous == nil || previous.StartTimestamp == nil || request.StartTimestamp == nil {
+		return false
+	}
+	return request.ClaimName == previous.ClaimName && request.StartTimestamp.Equal(*previous.StartTimestamp)
+}
+
+// memoryDumpSize returns the claim size fitting a dump of the guest memory
+func memoryDumpSize(vmi *VirtualMachineInstance) (string, error) {
+	var memory string
+	switch {
+	case vmi.Status.Memory != nil && vmi.Status.Memory.GuestCurrent != "":
+		memory = vmi.Status.Memory.GuestCurrent
+	case vmi.Spec.Domain.Memory != nil && vmi.Spec.Domain.Memory.Guest != "":
+		memory = vmi.Spec.Domain.Memory.Guest
+	default:
+		memory = vmi.Spec.Domain.Resources.Requests["memory"]
+	}
+	bytes, ok := parseQuantity(memory)
+	if !ok {
+		return "", fmt.Errorf("cannot size the memory dump claim, the guest memory of VMI %s is unknown, pass claim_name", vmi.Metadata.Name)
+	}
+	size := (bytes + memoryDumpOverhead) / (1 - cdiFilesystemOverhead)
+	return fmt.Sprintf("%dMi", int64(math.Ceil(size/(1<<20)))), nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4"
+
+// durationBuckets are the upper bounds in seconds of the duration histograms
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// inc adds one to the counter of the label values
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(values, "\x00")]++
+	c.mu.Unlock()
+}
+
+// observe records a duration in the histogram of the label values
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	key := strings.Join(values, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	seconds := d.Seconds()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += seconds
+}
+
+// labelPairs renders the labels of a series key, with extra pairs appended
+func labelPairs(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+		}
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (c *counterVec) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(b, "%s%s %g\n", c.name, labelPairs(c.labels, key), c.values[key])
+	}
+}
+
+func (h *histogramVec) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, fmt.Sprintf("le=\"%g\"", bound)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, `le="+Inf"`), s.count)
+		fmt.Fprintf(b, "%s_sum%s %g\n", h.name, labelPairs(h.labels, key), s.sum)
+		fmt.Fprintf(b, "%s_count%s %d\n", h.name, labelPairs(h.labels, key), s.count)
+	}
+}
+
+// The metrics of the server, served on /metrics with those of the
+// conformance monitor
+var (
+	toolCallsTotal = newCounterVec("kubevirt_mcp_tool_calls_total",
+		"Number of tool calls by tool and result.", "tool", "result")
+	toolCallDuration = newHistogramVec("kubevirt_mcp_tool_call_duration_seconds",
+		"Duration of the tool calls.", durationBuckets, "tool")
+	consoleConnectDuration = newHistogramVec("kubevirt_mcp_console_connect_duration_seconds",
+		"Time vm-exec took to connect to a guest, until the console login prompt or the SSH session.", durationBuckets, "method")
+	loginFailuresTotal = newCounterVec("kubevirt_mcp_login_failures_total",
+		"Number of refused logins: guest console or SSH logins, cluster_login and transport authentication.", "kind")
+	clusterDetectionsTotal = newCounterVec("kubevirt_mcp_cluster_detection_attempts_total",
+		"Number of cluster detection attempts by source found and result.", "source", "result")
+)
+
+// observeToolCall records a tool call in the metrics. Calls of unknown
+// tools share one label value so clients cannot add series at will.
+func observeToolCall(req JSONRPCRequest, resp JSONRPCResponse, duration time.Duration) {
+	var params struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(req.Params, &params)
+	name := params.Name
+	if !toolRegistered(name) {
+		name = "unknown"
+	}
+	result := "success"
+	if resp.Error != nil {
+		switch resp.Error.Code {
+		case -32602:
+			result = "invalid_params"
+		case -32601:
+			result = "not_found"
+		case accessDeniedCode:
+			result = "denied"
+		default:
+			result = "error"
+		}
+	}
+	toolCallsTotal.inc(name, result)
+	toolCallDuration.observe(duration, name)
+}
+
+// observeClusterDetection records a detect_kubevirtci_cluster attempt
+func observeClusterDetection(detection *ClusterDetection, err error) {
+	switch {
+	case err != nil:
+		clusterDetectionsTotal.inc("none", "error")
+	case !detection.Found:
+		clusterDetectionsTotal.inc("none", "not_found")
+	default:
+		clusterDetectionsTotal.inc(detection.Source, "found")
+	}
+}
+
+// guestLoginFailed reports whether a vm-exec error is a refused console or
+// SSH login
+func guestLoginFailed(err error) bool {
+	var paramsErr *invalidParamsError
+	if err == nil || errors.As(err, &paramsErr) {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "failed to login to VM") || strings.Contains(message, "SSH login as ")
+}
+
+// observeVMExecError counts the refused guest logins of vm-exec errors
+func observeVMExecError(err error) {
+	if guestLoginFailed(err) {
+		loginFailuresTotal.inc("guest")
+	}
+}
+
+// activeSessions returns the open sessions by kind: HTTP transport
+// sessions, listener clients, interactive consoles and pooled vm-exec
+// sessions
+func activeSessions() map[string]int {
+	sessions := map[string]int{}
+	if t := activeHTTPTransport.Load(); t != nil {
+		t.mu.Lock()
+		sessions["http"] = len(t.sessions)
+		t.mu.Unlock()
+	}
+	sessions["listener"] = int(listenerActive.Load())
+	consoleSessions.mu.Lock()
+	sessions["console"] = len(consoleSessions.sessions)
+	consoleSessions.mu.Unlock()
+	vmExecSessions.mu.Lock()
+	sessions["vm_exec"] = len(vmExecSessions.sessions)
+	vmExecSessions.mu.Unlock()
+	return sessions
+}
+
+// serveMetrics renders the server metrics, and those of the conformance
+// monitor when it runs, in the Prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	toolCallsTotal.write(&b)
+	toolCallDuration.write(&b)
+	consoleConnectDuration.write(&b)
+	loginFailuresTotal.write(&b)
+	clusterDetectionsTotal.write(&b)
+
+	sessions := activeSessions()
+	b.WriteString("# HELP kubevirt_mcp_active_sessions Number of open sessions by kind.\n# TYPE kubevirt_mcp_active_sessions gauge\n")
+	for _, kind := range sortedKeys(sessions) {
+		fmt.Fprintf(&b, "kubevirt_mcp_active_sessions{kind=%q} %d\n", kind, sessions[kind])
+	}
+
+	if monitor != nil {
+		monitor.writeMetrics(&b)
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	fmt.Fprint(w, b.String())
+}
+
+// startMetrics serves /metrics on the metrics address when one is set. It
+// is the way to scrape the server in the stdio and listener modes, the
+// HTTP transport also serves /metrics next to the MCP endpoint.
+func startMetrics() {
+	addr := serverConfig.Monitor.MetricsAddr
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logMessage(LogError, "metrics", "Metrics endpoint stopped: %v", err)
+		}
+	}()
+	go func() {
+		<-serverCtx.Done()
+		// The standalone monitor keeps serving its metrics after stdin
+		// closes, until the server shuts down
+		server.Shutdown(context.Background())
+	}()
+	logMessage(LogInfo, "metrics", "Serving metrics on %s/metrics", addr)
+}
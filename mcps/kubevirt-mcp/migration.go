@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const defaultMigrationTimeout = 600
+
+// Migration phases that end a VirtualMachineInstanceMigration
+const (
+	migrationSucceeded = "Succeeded"
+	migrationFailed    = "Failed"
+)
+
+type VirtualMachineInstanceMigration struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		VMIName string `json:"vmiName"`
+	} `json:"spec"`
+	Status struct {
+		Phase                     string                     `json:"phase,omitempty"`
+		PhaseTransitionTimestamps []PhaseTransitionTimestamp `json:"phaseTransitionTimestamps,omitempty"`
+		MigrationState            *MigrationState            `json:"migrationState,omitempty"`
+	} `json:"status"`
+}
+
+type VirtualMachineInstanceMigrationList struct {
+	Items []VirtualMachineInstanceMigration `json:"items"`
+}
+
+// MigrationParams represents the parameters of the migration tools
+type MigrationParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Wait      bool   `json:"wait,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+}
+
+// MigrationPhase is a phase a migration went through and when
+type MigrationPhase struct {
+	Phase string    `json:"phase"`
+	Time  time.Time `json:"time"`
+	Ago   string    `json:"ago"`
+}
+
+// MigrationInfo reports a VirtualMachineInstanceMigration
+type MigrationInfo struct {
+	Name     string           `json:"name"`
+	Phase    string           `json:"phase"`
+	Created  string           `json:"created,omitempty"`
+	Duration string           `json:"duration,omitempty"`
+	Phases   []MigrationPhase `json:"phases,omitempty"`
+}
+
+// MigrationStatusResult is the vmi_migrate and vmi_migration_status tool result
+type MigrationStatusResult struct {
+	Namespace  string          `json:"namespace"`
+	VMName     string          `json:"vmName"`
+	Node       string          `json:"node,omitempty"`
+	Migration  *MigrationInfo  `json:"migration,omitempty"`
+	State      *MigrationState `json:"migrationState,omitempty"`
+	Summary    string          `json:"summary,omitempty"`
+	Migrations []MigrationInfo `json:"migrations,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vmi_migrate",
+		Description: "Live migrate a running VMI by creating a VirtualMachineInstanceMigration, optionally waiting for it to finish, and report source/target node and timings",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI to migrate",
+				},
+				"wait": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Wait for the migration to succeed or fail",
+					"default":     false,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds when waiting (default: 600)",
+					"default":     defaultMigrationTimeout,
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleMigrate,
+	})
+
+	registerTool(Tool{
+		Name:        "vmi_migration_status",
+		Description: "Report the migration state of a VMI (phase, source and target node, start/end times) and the history of its VirtualMachineInstanceMigrations",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleMigrationStatus,
+	})
+}
+
+// decodeMigrationParams decodes and validates the migration tool arguments
+func decodeMigrationParams(args json.RawMessage) (MigrationParams, error) {
+	var params MigrationParams
+	if err := decodeArguments(args, &params); err != nil {
+		return params, err
+	}
+	if params.VMName == "" {
+		return params, missingArgument("vm_name")
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultMigrationTimeout
+	}
+	return params, nil
+}
+
+// handleMigrate is the tools/call handler for vmi_migrate
+func handleMigrate(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeMigrationParams(args)
+	if err != nil {
+		return "", err
+	}
+
+	var vmi VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &vmi, "get", "virtualmachineinstance", params.VMName, "-n", params.Namespace); err != nil {
+		return "", err
+	}
+	if vmi.Status.Phase != "Running" {
+		return "", fmt.Errorf("VMI '%s' is not running (phase: %s)", params.VMName, vmi.Status.Phase)
+	}
+
+	name := generateName(params.VMName + "-migration-")
+	if err := startMigration(ctx, params.Namespace, params.VMName, name); err != nil {
+		return "", err
+	}
+	logMessage(LogInfo, "migration", "Started migration %s/%s of VMI %s on node %s", params.Namespace, name, params.VMName, vmi.Status.NodeName)
+
+	if params.Wait {
+		reportProgress(ctx, "waiting for migration %s to finish", name)
+		if err := waitForMigration(ctx, params.Namespace, name, time.Duration(params.Timeout)*time.Second); err != nil {
+			return "", err
+		}
+	}
+
+	result, err := migrationStatus(ctx, params.Namespace, params.VMName, name)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// handleMigrationStatus is the tools/call handler for vmi_migration_status
+func handleMigrationStatus(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeMigrationParams(args)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := migrationStatus(ctx, params.Namespace, params.VMName, "")
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// startMigration creates a VirtualMachineInstanceMigration of the VMI
+func startMigration(ctx context.Context, namespace, vmiName, name string) error {
+	return createObject(ctx, map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstanceMigration",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": namespace,
+			"labels":    managedLabels("vmi_migrate", false),
+		},
+		"spec": map[string]interface{}{"vmiName": vmiName},
+	})
+}
+
+// waitForMigration waits until the migration finished, failing when it did
+// not succeed
+func waitForMigration(ctx context.Context, namespace, name string, timeout time.Duration) error {
+	deadline := clock.Now().Add(timeout)
+	for {
+		var migration VirtualMachineInstanceMigration
+		if err := runKubectlJSON(ctx, &migration, "get", "virtualmachineinstancemigration", name, "-n", namespace); err != nil {
+			return err
+		}
+		switch migration.Status.Phase {
+		case migrationSucceeded:
+			return nil
+		case migrationFailed:
+			return fmt.Errorf("migration %s failed", name)
+		}
+
+		if clock.Now().After(deadline) {
+			return fmt.Errorf("migration %s did not finish within %v (phase %q)", name, timeout, migration.Status.Phase)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for migration %s cancelled", name)
+		case <-clock.After(2 * time.Second):
+		}
+	}
+}
+
+// migrationStatus reports the migration state of the VMI. With a migration
+// name that migration is reported, otherwise the most recent one.
+func migrationStatus(ctx context.Context, namespace, vmiName, migrationName string) (*MigrationStatusResult, error) {
+	var vmi VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &vmi, "get", "virtualmachineinstance", vmiName, "-n", namespace); err != nil {
+		return nil, err
+	}
+
+	var migrations VirtualMachineInstanceMigrationList
+	if err := runKubectlJSON(ctx, &migrations, "get", "virtualmachineinstancemigrations", "-n", namespace); err != nil {
+		return nil, err
+	}
+
+	result := &MigrationStatusResult{
+		Namespace: namespace,
+		VMName:    vmiName,
+		Node:      vmi.Status.NodeName,
+		State:     vmi.Status.MigrationState,
+		Summary:   migrationSummary(vmi.Status.MigrationState),
+	}
+
+	var owned []VirtualMachineInstanceMigration
+	for _, migration := range migrations.Items {
+		if migration.Spec.VMIName == vmiName {
+			owned = append(owned, migration)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].Metadata.CreationTimestamp.After(owned[j].Metadata.CreationTimestamp)
+	})
+
+	for _, migration := range owned {
+		info := migrationInfo(migration)
+		result.Migrations = append(result.Migrations, info)
+		if result.Migration == nil && (migrationName == "" || migration.Metadata.Name == migrationName) {
+			current := info
+			result.Migration = &current
+		}
+	}
+	return result, nil
+}
+
+// migrationInfo summarizes the phases of a migration and how long it took
+func migrationInfo(migration VirtualMachineInstanceMigration) MigrationInfo {
+	info := MigrationInfo{Name: migration.Metadata.Name, Phase: migration.Status.Phase}
+	if created := since(migration.Metadata.CreationTimestamp); created != "" {
+		info.Created = created + " ago"
+	}
+
+	var first, last time.Time
+	for _, transition := range migration.Status.PhaseTransitionTimestamps {
+		at := transition.PhaseTransitionTimestamp
+		info.Phases = append(info.Phases, MigrationPhase{Phase: transition.Phase, Time: at, Ago: since(at) + " ago"})
+		if first.IsZero() || at.Before(first) {
+			first = at
+		}
+		if at.After(last) {
+			last = at
+		}
+	}
+	if migration.Status.Phase == migrationSucceeded || migration.Status.Phase == migrationFailed {
+		if !first.IsZero() {
+			info.Duration = humanDuration(last.Sub(first))
+		}
+	} else if !first.IsZero() {
+		info.Duration = humanDuration(time.Since(first)) + " so far"
+	}
+	return info
+}
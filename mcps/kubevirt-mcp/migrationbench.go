@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMigrationBenchLoadMB = 256
+	defaultMigrationBenchWarmup = 10
+
+	// migrationBenchPort is the UDP port the probe pod receives the guest
+	// heartbeats on
+	migrationBenchPort = 9000
+
+	// heartbeatInterval is the pause between two guest heartbeats
+	heartbeatInterval = 10 * time.Millisecond
+
+	// migrationBenchStart starts the memory load and the heartbeats in the
+	// guest, preceded by the MB, IP, PORT and LIMIT variables. Both stop when
+	// the marker file is removed or after LIMIT seconds. stress-ng is used
+	// when installed, otherwise dd rewrites a file in tmpfs. The heartbeats
+	// are sent with nc, or bash /dev/udp when there is no nc.
+	migrationBenchStart = `m=/tmp/kubevirt-mcp-migbench; touch $m; end=$(( $(date +%s) + LIMIT )); d=/dev/shm; [ -d $d ] || d=/tmp; ` +
+		`if [ $MB -gt 0 ] && command -v stress-ng >/dev/null 2>&1; then stress-ng --vm 1 --vm-bytes ${MB}M --vm-keep --timeout ${LIMIT}s </dev/null >/dev/null 2>&1 & echo $! > $m; echo load=stress-ng; ` +
+		`elif [ $MB -gt 0 ]; then (while [ -e $m ] && [ $(date +%s) -lt $end ]; do dd if=/dev/zero of=$d/kubevirt-mcp-dirty bs=1M count=$MB conv=notrunc 2>/dev/null; done; rm -f $d/kubevirt-mcp-dirty) </dev/null >/dev/null 2>&1 & echo load=dd; fi; ` +
+		`if command -v nc >/dev/null 2>&1; then (while [ -e $m ] && [ $(date +%s) -lt $end ]; do echo x; sleep 0.01; done | nc -u $IP $PORT) </dev/null >/dev/null 2>&1 & echo heartbeat=nc; ` +
+		`elif command -v bash >/dev/null 2>&1; then bash -c "while [ -e $m ] && [ \$(date +%s) -lt $end ]; do echo x > /dev/udp/$IP/$PORT; sleep 0.01; done" </dev/null >/dev/null 2>&1 & echo heartbeat=bash; fi`
+
+	// migrationBenchStop stops the load and the heartbeats
+	migrationBenchStop = `m=/tmp/kubevirt-mcp-migbench; [ -s $m ] && kill $(cat $m) 2>/dev/null; rm -f $m; true`
+)
+
+// migrationInfoRegex matches the progress lines virt-launcher logs on the
+// migration source, e.g. "Migration info for <uid>: TimeElapsed:1200ms
+// DataProcessed:310MiB DataRemaining:12MiB ..."
+var (
+	migrationInfoRegex  = regexp.MustCompile(`Migration info for [^:]+:([^"]*)`)
+	migrationFieldRegex = regexp.MustCompile(`(\w+):(\d+)`)
+)
+
+// MigrationBenchmarkParams represents the parameters of vmi_migration_benchmark
+type MigrationBenchmarkParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	VMName          string `json:"vm_name"`
+	LoadMB          *int   `json:"load_mb,omitempty"`
+	Warmup          int    `json:"warmup,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"`
+	ProbeImage      string `json:"probe_image,omitempty"`
+	Method          string `json:"method,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Format          string `json:"format,omitempty"`
+}
+
+// MigrationTransferStats are the last progress values virt-launcher logged
+// for the migration
+type MigrationTransferStats struct {
+	DataProcessedMiB    int `json:"dataProcessedMiB"`
+	DataTotalMiB        int `json:"dataTotalMiB"`
+	MemoryBandwidthMbps int `json:"memoryBandwidthMbps"`
+	DirtyRateMbps       int `json:"dirtyRateMbps"`
+	Iterations          int `json:"iterations"`
+	ExpectedDowntimeMs  int `json:"expectedDowntimeMs"`
+}
+
+// MigrationBenchmarkResult is the vmi_migration_benchmark tool result
+type MigrationBenchmarkResult struct {
+	Namespace       string                  `json:"namespace"`
+	VMName          string                  `json:"vmName"`
+	Migration       string                  `json:"migration"`
+	SourceNode      string                  `json:"sourceNode,omitempty"`
+	TargetNode      string                  `json:"targetNode,omitempty"`
+	Mode            string                  `json:"mode,omitempty"`
+	LoadMB          int                     `json:"loadMB"`
+	LoadTool        string                  `json:"loadTool,omitempty"`
+	TotalSeconds    float64                 `json:"totalSeconds"`
+	TransferSeconds float64                 `json:"transferSeconds,omitempty"`
+	DowntimeMs      *float64                `json:"downtimeMs,omitempty"`
+	Heartbeats      int                     `json:"heartbeats"`
+	Transfer        *MigrationTransferStats `json:"transfer,omitempty"`
+	Notes           []string                `json:"notes,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vmi_migration_benchmark",
+		Description: "Live migrate a VM while the guest dirties memory and measure the total migration time, the downtime seen by guest heartbeats to a temporary probe pod, and the transferred data, dirty rate and iterations logged by virt-launcher",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI to migrate",
+				},
+				"load_mb": map[string]interface{}{
+					"type":        "integer",
+					"description": "MiB of guest memory rewritten continuously during the migration, with stress-ng when installed and dd to tmpfs otherwise; 0 migrates an idle guest",
+					"default":     defaultMigrationBenchLoadMB,
+				},
+				"warmup": map[string]interface{}{
+					"type":        "integer",
+					"description": "Seconds the load runs before the migration starts (default: 10)",
+					"default":     defaultMigrationBenchWarmup,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for the migration (default: 600)",
+					"default":     defaultMigrationTimeout,
+				},
+				"probe_image": map[string]interface{}{
+					"type":        "string",
+					"description": "Image of the probe pod receiving the heartbeats, it needs busybox udpsvd",
+					"default":     defaultPrepullHelperImage,
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "Execution method of the guest commands starting and stopping the load",
+					"enum":        []string{"auto", "agent", "ssh", "console"},
+					"default":     "auto",
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"credentials_file": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleMigrationBenchmark,
+	})
+}
+
+// handleMigrationBenchmark is the tools/call handler for vmi_migration_benchmark
+func handleMigrationBenchmark(ctx context.Context, args json.RawMessage) (string, error) {
+	var params MigrationBenchmarkParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.LoadMB != nil && *params.LoadMB < 0 {
+		return "", &invalidParamsError{err: errors.New("load_mb cannot be negative")}
+	}
+	if params.Warmup < 0 || params.Timeout < 0 {
+		return "", &invalidParamsError{err: errors.New("warmup and timeout cannot be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.LoadMB == nil {
+		loadMB := defaultMigrationBenchLoadMB
+		params.LoadMB = &loadMB
+	}
+	if params.Warmup == 0 {
+		params.Warmup = defaultMigrationBenchWarmup
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultMigrationTimeout
+	}
+	if params.ProbeImage == "" {
+		params.ProbeImage = defaultPrepullHelperImage
+	}
+
+	result, err := benchmarkMigration(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// benchmarkMigration starts the probe pod and the guest load, migrates the
+// VMI and collects the measurements. The probe pod and the load are always
+// removed afterwards.
+func benchmarkMigration(ctx context.Context, params MigrationBenchmarkParams) (*MigrationBenchmarkResult, error) {
+	vmi, err := getRunningVMIObject(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return nil, err
+	}
+	for _, cond := range vmi.Status.Conditions {
+		if cond.Type == "LiveMigratable" && cond.Status == "False" {
+			return nil, fmt.Errorf("VMI %s/%s is not live migratable: %s", params.Namespace, params.VMName, cond.Message)
+		}
+	}
+	sourcePod, err := launcherPodOf(ctx, vmi)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationBenchmarkResult{Namespace: params.Namespace, VMName: params.VMName, LoadMB: *params.LoadMB}
+	// Cleanup also runs when the tool call was cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+
+	reportProgress(ctx, "starting the heartbeat probe pod")
+	// udpsvd accepts the datagrams of every sender, the guest sends from a
+	// new address after the migration
+	probe, probeIP, err := startProbePod(ctx, params.Namespace, "kubevirt-mcp-migbench-", "vmi_migration_benchmark", nil, map[string]interface{}{
+		"containers": []map[string]interface{}{{
+			"name":    "probe",
+			"image":   params.ProbeImage,
+			"command": []string{"udpsvd", "0", strconv.Itoa(migrationBenchPort), "cat"},
+		}},
+	})
+	if probe != "" {
+		defer runKubectl(cleanupCtx, "delete", "pod", probe, "-n", params.Namespace, "--ignore-not-found", "--wait=false")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	guest := VMExecParams{
+		Namespace:       params.Namespace,
+		VMName:          params.VMName,
+		Timeout:         30,
+		Method:          params.Method,
+		Username:        params.Username,
+		Password:        params.Password,
+		CredentialsFile: params.CredentialsFile,
+	}
+	// The guest stops on its own after the longest the benchmark can take
+	limit := params.Warmup + params.Timeout + 120
+	start := guest
+	start.Command = fmt.Sprintf("MB=%d IP=%s PORT=%d LIMIT=%d; %s", *params.LoadMB, probeIP, migrationBenchPort, limit, migrationBenchStart)
+	reportProgress(ctx, "starting the guest load")
+	started, err := runGuestCommand(ctx, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the guest load: %v", err)
+	}
+	stop := guest
+	stop.Command = migrationBenchStop
+	stopped := false
+	defer func() {
+		if !stopped {
+			runGuestCommand(cleanupCtx, stop)
+		}
+	}()
+
+	heartbeat := ""
+	for _, line := range strings.Fields(started.Stdout) {
+		if tool, ok := strings.CutPrefix(line, "load="); ok {
+			result.LoadTool = tool
+		}
+		if tool, ok := strings.CutPrefix(line, "heartbeat="); ok {
+			heartbeat = tool
+		}
+	}
+	if heartbeat == "" {
+		result.Notes = append(result.Notes, "the guest has neither nc nor bash to send heartbeats, the downtime is not measured")
+	}
+
+	reportProgress(ctx, "warming up the load for %ds", params.Warmup)
+	select {
+	case <-ctx.Done():
+		return nil, errors.New("migration benchmark cancelled")
+	case <-clock.After(time.Duration(params.Warmup) * time.Second):
+	}
+
+	name := generateName(params.VMName + "-migration-")
+	if err := startMigration(ctx, params.Namespace, params.VMName, name); err != nil {
+		return nil, err
+	}
+	result.Migration = name
+	logMessage(LogInfo, "migration", "Started benchmark migration %s/%s of VMI %s on node %s", params.Namespace, name, params.VMName, vmi.Status.NodeName)
+	reportProgress(ctx, "waiting for migration %s to finish", name)
+	if err := waitForMigration(ctx, params.Namespace, name, time.Duration(params.Timeout)*time.Second); err != nil {
+		return nil, err
+	}
+
+	var migration VirtualMachineInstanceMigration
+	if err := runKubectlJSON(ctx, &migration, "get", "virtualmachineinstancemigration", name, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	for _, transition := range migration.Status.PhaseTransitionTimestamps {
+		if transition.Phase == migrationSucceeded {
+			result.TotalSeconds = roundSeconds(transition.PhaseTransitionTimestamp.Sub(migration.Metadata.CreationTimestamp))
+		}
+	}
+	var migrated VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &migrated, "get", "virtualmachineinstance", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	var transferEnd time.Time
+	if state := migrated.Status.MigrationState; state != nil {
+		result.SourceNode, result.TargetNode, result.Mode = state.SourceNode, state.TargetNode, state.Mode
+		if state.StartTimestamp != nil && state.EndTimestamp != nil {
+			transferEnd = *state.EndTimestamp
+			result.TransferSeconds = roundSeconds(state.EndTimestamp.Sub(*state.StartTimestamp))
+		}
+	}
+
+	// Heartbeats keep coming until the load is stopped, they show whether
+	// the network came back after the switchover
+	stopped = true
+	if _, err := runGuestCommand(ctx, stop); err != nil {
+		result.Notes = append(result.Notes, fmt.Sprintf("failed to stop the guest load, it stops on its own after %ds: %v", limit, err))
+	}
+
+	if heartbeat != "" {
+		logs, err := runKubectl(ctx, "logs", probe, "-n", params.Namespace, "--timestamps")
+		if err != nil {
+			result.Notes = append(result.Notes, fmt.Sprintf("failed to read the heartbeats: %v", err))
+		} else {
+			downtime, count, note := heartbeatDowntime(string(logs), migration.Metadata.CreationTimestamp, transferEnd)
+			result.DowntimeMs, result.Heartbeats = downtime, count
+			if note != "" {
+				result.Notes = append(result.Notes, note)
+			}
+		}
+	}
+
+	logs, err := runKubectl(ctx, "logs", sourcePod.Metadata.Name, "-n", params.Namespace, "-c", computeContainer)
+	if err != nil {
+		result.Notes = append(result.Notes, fmt.Sprintf("transfer stats unavailable, the source pod %s logs cannot be read: %v", sourcePod.Metadata.Name, err))
+	} else if result.Transfer = parseMigrationInfo(string(logs)); result.Transfer == nil {
+		result.Notes = append(result.Notes, "transfer stats unavailable, virt-launcher logged no migration progress")
+	}
+	return result, nil
+}
+
+// startProbePod creates a temporary pod with the given spec and returns its
+// name and, once it is ready, its IP. The name is returned whenever the pod
+// was created so that the caller can delete it.
+func startProbePod(ctx context.Context, namespace, prefix, toolName string, annotations map[string]string, spec map[string]interface{}) (string, string, error) {
+	name := generateName(prefix)
+	metadata := map[string]interface{}{
+		"name":      name,
+		"namespace": namespace,
+		"labels":    managedLabels(toolName, true),
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	spec["restartPolicy"] = "Never"
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   metadata,
+		"spec":       spec,
+	}
+	if err := createObject(ctx, pod); err != nil {
+		return "", "", fmt.Errorf("failed to create probe pod: %v", err)
+	}
+	if err := waitFor(ctx, namespace, "pod/"+name, "condition=Ready", 2*time.Minute); err != nil {
+		return name, "", fmt.Errorf("probe pod did not start: %v", err)
+	}
+
+	var status struct {
+		Status struct {
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	}
+	if err := runKubectlJSON(ctx, &status, "get", "pod", name, "-n", namespace); err != nil {
+		return name, "", err
+	}
+	if status.Status.PodIP == "" {
+		return name, "", fmt.Errorf("probe pod %s has no IP", name)
+	}
+	return name, status.Status.PodIP, nil
+}
+
+// heartbeatDowntime returns the longest gap between two heartbeats received
+// from the start of the migration until shortly after its end, less the
+// heartbeat interval. The probe pod logs a line per heartbeat, timestamped
+// by the container runtime.
+func heartbeatDowntime(logs string, migrationStart, transferEnd time.Time) (*float64, int, string) {
+	var beats []time.Time
+	for _, line := range strings.Split(logs, "\n") {
+		stamp, _, _ := strings.Cut(line, " ")
+		if t, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+			beats = append(beats, t)
+		}
+	}
+	sort.Slice(beats, func(i, j int) bool { return beats[i].Before(beats[j]) })
+	if len(beats) == 0 {
+		return nil, 0, "the probe pod received no heartbeats, check that the guest can reach the pod network"
+	}
+
+	windowEnd := beats[len(beats)-1]
+	if !transferEnd.IsZero() {
+		// Timestamps of the migration state have a one second precision
+		windowEnd = transferEnd.Add(10 * time.Second)
+		if beats[len(beats)-1].Before(transferEnd.Add(time.Second)) {
+			return nil, len(beats), "the heartbeats stopped during the migration, the guest network did not come back"
+		}
+	}
+
+	var longest time.Duration
+	var previous time.Time
+	for _, beat := range beats {
+		if beat.Before(migrationStart) {
+			previous = beat
+			continue
+		}
+		if beat.After(windowEnd) {
+			break
+		}
+		if !previous.IsZero() && beat.Sub(previous) > longest {
+			longest = beat.Sub(previous)
+		}
+		previous = beat
+	}
+	downtime := milliseconds(max(longest-heartbeatInterval, 0))
+	return &downtime, len(beats), ""
+}
+
+// parseMigrationInfo returns the values of the last migration progress line
+// of the virt-launcher logs, nil when there is none
+func parseMigrationInfo(logs string) *MigrationTransferStats {
+	matches := migrationInfoRegex.FindAllStringSubmatch(logs, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	fields := map[string]int{}
+	for _, field := range migrationFieldRegex.FindAllStringSubmatch(matches[len(matches)-1][1], -1) {
+		fields[field[1]], _ = strconv.Atoi(field[2])
+	}
+	return &MigrationTransferStats{
+		DataProcessedMiB:    fields["DataProcessed"],
+		DataTotalMiB:        fields["DataTotal"],
+		MemoryBandwidthMbps: fields["MemoryBandwidth"],
+		DirtyRateMbps:       fields["DirtyRate"],
+		Iterations:          fields["Iteration"],
+		ExpectedDowntimeMs:  fields["ExpectedDowntime"],
+	}
+}
+
+// tables renders the measurements and notes as a table
+func (r *MigrationBenchmarkResult) tables() []table {
+	downtime := "not measured"
+	if r.DowntimeMs != nil {
+		downtime = fmt.Sprintf("%.1fms (%d heartbeats)", *r.DowntimeMs, r.Heartbeats)
+	}
+	load := "none"
+	if r.LoadMB > 0 {
+		load = fmt.Sprintf("%d MiB (%s)", r.LoadMB, r.LoadTool)
+	}
+	summary := table{
+		title:   fmt.Sprintf("Migration %s of %s/%s", r.Migration, r.Namespace, r.VMName),
+		headers: []string{"MEASURE", "VALUE"},
+		rows: [][]string{
+			{"Nodes", r.SourceNode + " -> " + r.TargetNode},
+			{"Mode", r.Mode},
+			{"Memory load", load},
+			{"Total time", fmt.Sprintf("%.1fs", r.TotalSeconds)},
+			{"Transfer time", fmt.Sprintf("%.1fs", r.TransferSeconds)},
+			{"Downtime", downtime},
+		},
+	}
+	if t := r.Transfer; t != nil {
+		summary.rows = append(summary.rows,
+			[]string{"Data processed", fmt.Sprintf("%d of %d MiB", t.DataProcessedMiB, t.DataTotalMiB)},
+			[]string{"Memory bandwidth", fmt.Sprintf("%d Mbps", t.MemoryBandwidthMbps)},
+			[]string{"Dirty rate", fmt.Sprintf("%d Mbps", t.DirtyRateMbps)},
+			[]string{"Iterations", strconv.Itoa(t.Iterations)},
+			[]string{"Expected downtime", fmt.Sprintf("%dms", t.ExpectedDowntimeMs)},
+		)
+	}
+	for _, note := range r.Notes {
+		summary.rows = append(summary.rows, []string{"Note", note})
+	}
+	return []table{summary}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMigrationPingWarmup = 5
+
+	// migrationPingPort is the TCP port the probe pod accepts the guest
+	// connection on
+	migrationPingPort = 9001
+
+	// pingInterval is the pause between two pings of the probe pod
+	pingInterval = 200 * time.Millisecond
+
+	// migrationPingSettle is how long the probe keeps running after the
+	// migration, to see whether the connectivity came back
+	migrationPingSettle = 10 * time.Second
+
+	// migrationPingScript is run by the probe pod with the VM IP and the TCP
+	// port as $0 and $1. It logs a line per ping and per message received on
+	// the TCP connection, which is accepted once.
+	migrationPingScript = `(nc -l -p $1 | while read l; do echo tcp; done; echo tcp-closed) & ` +
+		`while :; do if ping -c 1 -W 1 $0 >/dev/null 2>&1; then echo ping-ok; else echo ping-lost; fi; sleep 0.2; done`
+
+	// migrationPingConnect opens the TCP connection from the guest, preceded
+	// by the IP, PORT and LIMIT variables, with nc or bash /dev/tcp. It sends
+	// a line every 200ms until the marker file is removed or after LIMIT
+	// seconds.
+	migrationPingConnect = `m=/tmp/kubevirt-mcp-migping; touch $m; end=$(( $(date +%s) + LIMIT )); ` +
+		`if command -v nc >/dev/null 2>&1; then (while [ -e $m ] && [ $(date +%s) -lt $end ]; do echo t; sleep 0.2; done | nc $IP $PORT) </dev/null >/dev/null 2>&1 & echo tcp=nc; ` +
+		`elif command -v bash >/dev/null 2>&1; then bash -c "exec 3<>/dev/tcp/$IP/$PORT && while [ -e $m ] && [ \$(date +%s) -lt $end ]; do echo t >&3; sleep 0.2; done" </dev/null >/dev/null 2>&1 & echo tcp=bash; fi`
+
+	migrationPingDisconnect = `rm -f /tmp/kubevirt-mcp-migping; true`
+)
+
+// MigrationPingParams represents the parameters of vmi_migration_ping
+type MigrationPingParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	VMName          string `json:"vm_name"`
+	Trigger         string `json:"trigger,omitempty"`
+	Interface       string `json:"interface,omitempty"`
+	TargetIP        string `json:"target_ip,omitempty"`
+	ProbeNetwork    string `json:"probe_network,omitempty"`
+	TCP             *bool  `json:"tcp,omitempty"`
+	Warmup          int    `json:"warmup,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"`
+	ProbeImage      string `json:"probe_image,omitempty"`
+	Method          string `json:"method,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Format          string `json:"format,omitempty"`
+}
+
+// TCPConnectionCheck reports whether the TCP connection from the guest
+// survived the migration
+type TCPConnectionCheck struct {
+	Established bool   `json:"established"`
+	Survived    bool   `json:"survived"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// MigrationPingResult is the vmi_migration_ping tool result
+type MigrationPingResult struct {
+	Namespace   string              `json:"namespace"`
+	VMName      string              `json:"vmName"`
+	Trigger     string              `json:"trigger"`
+	Migration   string              `json:"migration,omitempty"`
+	SourceNode  string              `json:"sourceNode,omitempty"`
+	TargetNode  string              `json:"targetNode,omitempty"`
+	TargetIP    string              `json:"targetIP"`
+	PingsSent   int                 `json:"pingsSent"`
+	PingsLost   int                 `json:"pingsLost"`
+	LossPercent float64             `json:"lossPercent"`
+	DowntimeMs  float64             `json:"downtimeMs"`
+	Restored    bool                `json:"restored"`
+	TCP         *TCPConnectionCheck `json:"tcp,omitempty"`
+	Notes       []string            `json:"notes,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vmi_migration_ping",
+		Description: "Ping a VM and hold a TCP connection with it from a temporary probe pod while it is live migrated, by a migration or by evicting its virt-launcher pod, and report the downtime, the dropped pings and whether the connection survived. Validates eviction strategies and network plugins",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI to migrate",
+				},
+				"trigger": map[string]interface{}{
+					"type":        "string",
+					"description": "migration creates a VirtualMachineInstanceMigration, evict evicts the virt-launcher pod like a node drain and relies on the VMI evictionStrategy",
+					"enum":        []string{"migration", "evict"},
+					"default":     "migration",
+				},
+				"interface": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VMI interface to ping (default: the first one with an IP)",
+				},
+				"target_ip": map[string]interface{}{
+					"type":        "string",
+					"description": "IP to ping instead of the interface IP reported by the VMI",
+				},
+				"probe_network": map[string]interface{}{
+					"type":        "string",
+					"description": "NetworkAttachmentDefinition attached to the probe pod, [namespace/]name, to reach a VM interface on a secondary network",
+				},
+				"tcp": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also hold a TCP connection opened by the guest to the probe pod, started through vm_exec",
+					"default":     true,
+				},
+				"warmup": map[string]interface{}{
+					"type":        "integer",
+					"description": "Seconds of pings before the migration starts (default: 5)",
+					"default":     defaultMigrationPingWarmup,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for the migration (default: 600)",
+					"default":     defaultMigrationTimeout,
+				},
+				"probe_image": map[string]interface{}{
+					"type":        "string",
+					"description": "Image of the probe pod, it needs busybox ping and nc",
+					"default":     defaultPrepullHelperImage,
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "Execution method of the guest command opening the TCP connection",
+					"enum":        []string{"auto", "agent", "ssh", "console"},
+					"default":     "auto",
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"credentials_file": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleMigrationPing,
+	})
+}
+
+// handleMigrationPing is the tools/call handler for vmi_migration_ping
+func handleMigrationPing(ctx context.Context, args json.RawMessage) (string, error) {
+	var params MigrationPingParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Trigger != "" && params.Trigger != "migration" && params.Trigger != "evict" {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported trigger '%s', use migration or evict", params.Trigger)}
+	}
+	if params.Warmup < 0 || params.Timeout < 0 {
+		return "", &invalidParamsError{err: errors.New("warmup and timeout cannot be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Trigger == "" {
+		params.Trigger = "migration"
+	}
+	if params.TCP == nil {
+		tcp := true
+		params.TCP = &tcp
+	}
+	if params.Warmup == 0 {
+		params.Warmup = defaultMigrationPingWarmup
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultMigrationTimeout
+	}
+	if params.ProbeImage == "" {
+		params.ProbeImage = defaultPrepullHelperImage
+	}
+
+	result, err := pingDuringMigration(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// pingDuringMigration starts the probe pod and the guest connection,
+// migrates the VMI and analyses what the probe pod logged. The probe pod and
+// the connection are always removed afterwards.
+func pingDuringMigration(ctx context.Context, params MigrationPingParams) (*MigrationPingResult, error) {
+	vmi, err := getRunningVMIObject(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return nil, err
+	}
+	for _, cond := range vmi.Status.Conditions {
+		if cond.Type == "LiveMigratable" && cond.Status == "False" {
+			return nil, fmt.Errorf("VMI %s/%s is not live migratable: %s", params.Namespace, params.VMName, cond.Message)
+		}
+	}
+	targetIP, err := pingTarget(vmi, params)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationPingResult{Namespace: params.Namespace, VMName: params.VMName, Trigger: params.Trigger, TargetIP: targetIP}
+	// Cleanup also runs when the tool call was cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+
+	reportProgress(ctx, "starting the probe pod pinging %s", targetIP)
+	var annotations map[string]string
+	if params.ProbeNetwork != "" {
+		annotations = map[string]string{"k8s.v1.cni.cncf.io/networks": params.ProbeNetwork}
+	}
+	probe, probeIP, err := startProbePod(ctx, params.Namespace, "kubevirt-mcp-migping-", "vmi_migration_ping", annotations, map[string]interface{}{
+		// Allows ICMP without NET_RAW, a safe sysctl
+		"securityContext": map[string]interface{}{
+			"sysctls": []map[string]interface{}{{"name": "net.ipv4.ping_group_range", "value": "0 2147483647"}},
+		},
+		"containers": []map[string]interface{}{{
+			"name":    "probe",
+			"image":   params.ProbeImage,
+			"command": []string{"/bin/sh", "-c", migrationPingScript, targetIP, strconv.Itoa(migrationPingPort)},
+		}},
+	})
+	if probe != "" {
+		defer runKubectl(cleanupCtx, "delete", "pod", probe, "-n", params.Namespace, "--ignore-not-found", "--wait=false")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	guest := VMExecParams{
+		Namespace:       params.Namespace,
+		VMName:          params.VMName,
+		Timeout:         30,
+		Method:          params.Method,
+		Username:        params.Username,
+		Password:        params.Password,
+		CredentialsFile: params.CredentialsFile,
+	}
+	if *params.TCP {
+		// The guest disconnects on its own after the longest the check can take
+		limit := params.Warmup + params.Timeout + 120
+		connect := guest
+		connect.Command = fmt.Sprintf("IP=%s PORT=%d LIMIT=%d; %s", probeIP, migrationPingPort, limit, migrationPingConnect)
+		reportProgress(ctx, "opening the TCP connection from the guest")
+		if started, err := runGuestCommand(ctx, connect); err != nil {
+			result.Notes = append(result.Notes, fmt.Sprintf("the TCP connection is not checked, starting it in the guest failed: %v", err))
+		} else if !strings.Contains(started.Stdout, "tcp=") {
+			result.Notes = append(result.Notes, "the TCP connection is not checked, the guest has neither nc nor bash")
+		} else {
+			result.TCP = &TCPConnectionCheck{}
+			disconnect := guest
+			disconnect.Command = migrationPingDisconnect
+			defer runGuestCommand(cleanupCtx, disconnect)
+		}
+	}
+
+	reportProgress(ctx, "pinging %s for %ds before the migration", targetIP, params.Warmup)
+	select {
+	case <-ctx.Done():
+		return nil, errors.New("migration ping cancelled")
+	case <-clock.After(time.Duration(params.Warmup) * time.Second):
+	}
+	logs, err := runKubectl(ctx, "logs", probe, "-n", params.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the probe pod logs: %v", err)
+	}
+	if !strings.Contains(string(logs), "ping-ok") {
+		return nil, fmt.Errorf("VM %s/%s does not answer pings to %s from the probe pod before the migration, check the guest firewall and the probe network", params.Namespace, params.VMName, targetIP)
+	}
+
+	triggered := clock.Now()
+	migrated, err := triggerMigration(ctx, params, vmi, result)
+	if err != nil {
+		return nil, err
+	}
+	transferEnd := clock.Now()
+	if state := migrated.Status.MigrationState; state != nil {
+		result.SourceNode, result.TargetNode = state.SourceNode, state.TargetNode
+		if state.EndTimestamp != nil {
+			transferEnd = *state.EndTimestamp
+		}
+	}
+
+	reportProgress(ctx, "pinging %s for %v after the migration", targetIP, migrationPingSettle)
+	select {
+	case <-ctx.Done():
+		return nil, errors.New("migration ping cancelled")
+	case <-clock.After(migrationPingSettle):
+	}
+	logs, err = runKubectl(ctx, "logs", probe, "-n", params.Namespace, "--timestamps")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the probe pod logs: %v", err)
+	}
+	// Timestamps of the migration state have a one second precision
+	analyzeProbeLogs(string(logs), triggered.Add(-time.Second), transferEnd.Add(time.Second), result)
+	return result, nil
+}
+
+// pingTarget returns the IP of the VMI to ping
+func pingTarget(vmi *VirtualMachineInstance, params MigrationPingParams) (string, error) {
+	if params.TargetIP != "" {
+		return params.TargetIP, nil
+	}
+	for _, iface := range vmi.Status.Interfaces {
+		if params.Interface != "" && iface.Name != params.Interface {
+			continue
+		}
+		if iface.IPAddress != "" {
+			return iface.IPAddress, nil
+		}
+		if len(iface.IPAddresses) > 0 {
+			return iface.IPAddresses[0], nil
+		}
+	}
+	if params.Interface != "" {
+		return "", fmt.Errorf("VMI %s/%s reports no IP on interface %s, pass target_ip", params.Namespace, params.VMName, params.Interface)
+	}
+	return "", fmt.Errorf("VMI %s/%s reports no IP, pass target_ip", params.Namespace, params.VMName)
+}
+
+// triggerMigration migrates the VMI with a migration or an eviction and
+// returns the migrated VMI
+func triggerMigration(ctx context.Context, params MigrationPingParams, vmi *VirtualMachineInstance, result *MigrationPingResult) (*VirtualMachineInstance, error) {
+	timeout := time.Duration(params.Timeout) * time.Second
+	if params.Trigger == "evict" {
+		pod, err := launcherPodOf(ctx, vmi)
+		if err != nil {
+			return nil, err
+		}
+		if err := evictPod(ctx, params.Namespace, pod.Metadata.Name); err != nil {
+			return nil, err
+		}
+		logMessage(LogInfo, "migration", "Evicted virt-launcher pod %s/%s of VMI %s", params.Namespace, pod.Metadata.Name, params.VMName)
+		reportProgress(ctx, "waiting for the evacuation of VMI %s/%s", params.Namespace, params.VMName)
+		return waitForEvacuation(ctx, vmi, timeout)
+	}
+
+	name := generateName(params.VMName + "-migration-")
+	if err := startMigration(ctx, params.Namespace, params.VMName, name); err != nil {
+		return nil, err
+	}
+	result.Migration = name
+	reportProgress(ctx, "waiting for migration %s to finish", name)
+	if err := waitForMigration(ctx, params.Namespace, name, timeout); err != nil {
+		return nil, err
+	}
+	var migrated VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &migrated, "get", "virtualmachineinstance", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	return &migrated, nil
+}
+
+// evictPod evicts a pod through the eviction API like a node drain. KubeVirt
+// answers with an error when it evacuates the VMI by a migration instead.
+func evictPod(ctx context.Context, namespace, name string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "policy/v1",
+		"kind":       "Eviction",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+	})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/eviction", namespace, name)
+	if _, err := runKubectlWithInput(ctx, body, "create", "--raw", path, "-f", "-"); err != nil && !strings.Contains(err.Error(), "evacuation") {
+		return fmt.Errorf("failed to evict pod %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// waitForEvacuation waits until the VMI finished a migration started after
+// the given VMI state, failing when the eviction shut the VMI down instead
+func waitForEvacuation(ctx context.Context, vmi *VirtualMachineInstance, timeout time.Duration) (*VirtualMachineInstance, error) {
+	namespace, name := vmi.Metadata.Namespace, vmi.Metadata.Name
+	var previous *time.Time
+	if vmi.Status.MigrationState != nil {
+		previous = vmi.Status.MigrationState.StartTimestamp
+	}
+	deadline := clock.Now().Add(timeout)
+	for {
+		var current VirtualMachineInstance
+		found, err := getOptionalObject(ctx, &current, "virtualmachineinstance", name, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if !found || current.Metadata.UID != vmi.Metadata.UID || current.Status.Phase == "Failed" || current.Status.Phase == "Succeeded" {
+			return nil, fmt.Errorf("the eviction shut VMI %s/%s down instead of migrating it, its evictionStrategy is not LiveMigrate", namespace, name)
+		}
+		if state := current.Status.MigrationState; state != nil && state.StartTimestamp != nil && (previous == nil || !state.StartTimestamp.Equal(*previous)) {
+			if state.Failed {
+				return nil, fmt.Errorf("the evacuation migration of VMI %s/%s failed", namespace, name)
+			}
+			if state.Completed {
+				return &current, nil
+			}
+		}
+
+		if clock.Now().After(deadline) {
+			return nil, fmt.Errorf("VMI %s/%s was not evacuated within %v", namespace, name, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for the evacuation of VMI %s/%s cancelled", namespace, name)
+		case <-clock.After(2 * time.Second):
+		}
+	}
+}
+
+// probeLine is a line of the probe pod logs
+type probeLine struct {
+	time time.Time
+	text string
+}
+
+// analyzeProbeLogs fills the ping and TCP measurements of the result from
+// the probe pod logs, timestamped by the container runtime. Pings count from
+// windowStart, the TCP connection survived when messages arrived after
+// transferEnd.
+func analyzeProbeLogs(logs string, windowStart, transferEnd time.Time, result *MigrationPingResult) {
+	var lines []probeLine
+	for _, line := range strings.Split(logs, "\n") {
+		stamp, text, _ := strings.Cut(line, " ")
+		if t, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+			lines = append(lines, probeLine{time: t, text: strings.TrimSpace(text)})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].time.Before(lines[j].time) })
+
+	var lastOK, outageFrom, last time.Time
+	var longest time.Duration
+	inOutage := false
+	for _, line := range lines {
+		switch line.text {
+		case "ping-ok":
+			if inOutage && line.time.Sub(outageFrom) > longest {
+				longest = line.time.Sub(outageFrom)
+			}
+			lastOK, inOutage = line.time, false
+		case "ping-lost":
+			if line.time.Before(windowStart) {
+				continue
+			}
+			result.PingsLost++
+			if !inOutage {
+				outageFrom, inOutage = lastOK, true
+				if outageFrom.IsZero() {
+					outageFrom = line.time
+				}
+			}
+		default:
+			continue
+		}
+		if !line.time.Before(windowStart) {
+			result.PingsSent++
+		}
+		last = line.time
+	}
+	result.Restored = !inOutage
+	if inOutage && last.Sub(outageFrom) > longest {
+		longest = last.Sub(outageFrom)
+	}
+	if result.PingsSent > 0 {
+		result.LossPercent = round2(float64(result.PingsLost) * 100 / float64(result.PingsSent))
+	}
+	if longest > 0 {
+		result.DowntimeMs = milliseconds(max(longest-pingInterval, 0))
+	}
+	if !result.Restored {
+		result.Notes = append(result.Notes, fmt.Sprintf("the VM did not answer pings again within %v after the migration, e.g. its IP changed with the pod (masquerade binding) or the network plugin did not move it", migrationPingSettle))
+	}
+
+	if result.TCP == nil {
+		return
+	}
+	// The logs are read before the guest disconnects, a closed connection
+	// broke during the migration
+	var closed time.Time
+	for _, line := range lines {
+		switch line.text {
+		case "tcp":
+			result.TCP.Established = true
+			if line.time.After(transferEnd) {
+				result.TCP.Survived = true
+			}
+		case "tcp-closed":
+			closed = line.time
+		}
+	}
+	switch {
+	case !result.TCP.Established:
+		result.TCP.Detail = "the guest did not connect to the probe pod"
+	case !closed.IsZero():
+		result.TCP.Survived = false
+		result.TCP.Detail = "the connection was closed at " + closed.Format(time.RFC3339)
+	case !result.TCP.Survived:
+		result.TCP.Detail = "no message arrived on the connection after the migration"
+	}
+}
+
+// tables renders the measurements and notes as a table
+func (r *MigrationPingResult) tables() []table {
+	title := fmt.Sprintf("Connectivity of %s/%s (%s) during the %s", r.Namespace, r.VMName, r.TargetIP, r.Trigger)
+	if r.Migration != "" {
+		title += " " + r.Migration
+	}
+	summary := table{
+		title:   title,
+		headers: []string{"MEASURE", "VALUE"},
+		rows: [][]string{
+			{"Nodes", r.SourceNode + " -> " + r.TargetNode},
+			{"Pings", fmt.Sprintf("%d sent, %d lost (%.2f%%)", r.PingsSent, r.PingsLost, r.LossPercent)},
+			{"Downtime", fmt.Sprintf("%.1fms", r.DowntimeMs)},
+			{"Restored", strconv.FormatBool(r.Restored)},
+		},
+	}
+	if r.TCP != nil {
+		tcp := "survived"
+		if !r.TCP.Survived {
+			tcp = "broken: " + r.TCP.Detail
+		}
+		summary.rows = append(summary.rows, []string{"TCP connection", tcp})
+	}
+	for _, note := range r.Notes {
+		summary.rows = append(summary.rows, []string{"Note", note})
+	}
+	return []table{summary}
+}
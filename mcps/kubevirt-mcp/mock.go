@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Environment variables selecting the record or replay mode. Only one of
+// them may be set.
+const (
+	recordDirEnv = "KUBEVIRT_MCP_RECORD_DIR"
+	replayDirEnv = "KUBEVIRT_MCP_REPLAY_DIR"
+)
+
+// fixture is a recorded kubectl or vm-exec invocation
+type fixture struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Input   string   `json:"input,omitempty"`
+	Output  string   `json:"output"`
+	Stdout  string   `json:"stdout,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// cassette records the cluster interactions to fixtures or replays them
+// without a cluster
+type cassette struct {
+	mu     sync.Mutex
+	dir    string
+	replay bool
+	// calls counts the invocations per fixture key, so repeated calls such as
+	// polling replay the recorded sequence
+	calls map[string]int
+	// names counts the generated names per prefix
+	names map[string]int
+}
+
+// fixtures is the cassette of the server, nil unless recording or replaying
+var fixtures *cassette
+
+// loadCassette reads the record/replay configuration, it returns nil when
+// the server talks to a real cluster only
+func loadCassette() *cassette {
+	recordDir := serverConfig.Fixtures.RecordDir
+	replayDir := serverConfig.Fixtures.ReplayDir
+	switch {
+	case recordDir != "" && replayDir != "":
+		logMessage(LogWarning, "mock", "Ignoring %s and %s, they are mutually exclusive", recordDirEnv, replayDirEnv)
+		return nil
+	case recordDir != "":
+		if err := os.MkdirAll(recordDir, 0755); err != nil {
+			logMessage(LogWarning, "mock", "Ignoring %s: %v", recordDirEnv, err)
+			return nil
+		}
+		return &cassette{dir: recordDir, calls: map[string]int{}, names: map[string]int{}}
+	case replayDir != "":
+		return &cassette{dir: replayDir, replay: true, calls: map[string]int{}, names: map[string]int{}}
+	}
+	return nil
+}
+
+// recorded runs a kubectl or vm-exec invocation through the cassette. run
+// returns the combined output, stdout alone when it differs, and the error.
+// Without a cassette run is called directly, in simulation mode it is not
+// called at all.
+func recorded(ctx context.Context, command string, args []string, input []byte, run func() (string, string, error)) (string, string, error) {
+	if simulation != nil {
+		return simulatedCommand(ctx, command, args, input)
+	}
+	if fixtures == nil {
+		return run()
+	}
+
+	args = fixtureArgs(args)
+	key := fixtureKey(command, args, input)
+	fixtures.mu.Lock()
+	call := fixtures.calls[key]
+	fixtures.calls[key]++
+	fixtures.mu.Unlock()
+
+	if fixtures.replay {
+		return fixtures.load(command, args, key, call)
+	}
+
+	output, stdout, err := run()
+	if ctx.Err() != nil {
+		// Cancelled calls depend on the client's timing, do not record them
+		return output, stdout, err
+	}
+	recording := fixture{Command: command, Args: args, Input: string(input), Output: output, Stdout: stdout}
+	if err != nil {
+		recording.Error = err.Error()
+	}
+	if saveErr := fixtures.save(key, call, recording); saveErr != nil {
+		logMessage(LogWarning, "mock", "Failed to record %s %s: %v", command, strings.Join(args, " "), saveErr)
+	}
+	return output, stdout, err
+}
+
+// commandOutput runs cmd through the cassette, returning its stdout or, when
+// combined is set, its stdout and stderr
+func commandOutput(ctx context.Context, cmd *exec.Cmd, combined bool) ([]byte, error) {
+	output, _, err := recorded(ctx, cmd.Args[0], cmd.Args[1:], nil, func() (string, string, error) {
+		var output []byte
+		var err error
+		if combined {
+			output, err = cmd.CombinedOutput()
+		} else {
+			output, err = cmd.Output()
+		}
+		return string(output), "", err
+	})
+	return []byte(output), err
+}
+
+// load returns the recorded result of a call. Calls past the recorded ones
+// get the last recording, e.g. the final phase of a polled object.
+func (c *cassette) load(command string, args []string, key string, call int) (string, string, error) {
+	for ; call >= 0; call-- {
+		data, err := os.ReadFile(c.path(key, call))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read fixture: %v", err)
+		}
+		var recording fixture
+		if err := json.Unmarshal(data, &recording); err != nil {
+			return "", "", fmt.Errorf("failed to parse fixture %s: %v", c.path(key, call), err)
+		}
+		if recording.Error != "" {
+			return recording.Output, recording.Stdout, errors.New(recording.Error)
+		}
+		return recording.Output, recording.Stdout, nil
+	}
+	return "", "", fmt.Errorf("no recorded fixture for %s %s in %s", command, strings.Join(args, " "), c.dir)
+}
+
+// save writes the recording of a call
+func (c *cassette) save(key string, call int, recording fixture) error {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(key, call), data, 0644)
+}
+
+func (c *cassette) path(key string, call int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%03d.json", key, call))
+}
+
+// generatedName returns a deterministic name in record and replay mode, so
+// objects created while replaying match the recorded ones
+func (c *cassette) generatedName(prefix string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[prefix]++
+	return fmt.Sprintf("%s%06x", prefix, c.names[prefix])
+}
+
+// fixtureArgs drops the arguments that depend on the machine or the client
+// rather than on the cluster interaction: the kubeconfig path, temporary
+// local files and progress reporting
+func fixtureArgs(args []string) []string {
+	normalized := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--kubeconfig", "--deadline":
+			i++
+		case "--local-file":
+			normalized = append(normalized, args[i], "<local-file>")
+			i++
+		case "--progress":
+		default:
+			normalized = append(normalized, args[i])
+		}
+	}
+	return normalized
+}
+
+// fixtureKey identifies an invocation by its command, arguments and input
+func fixtureKey(command string, args []string, input []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(command))
+	for _, arg := range args {
+		hash.Write([]byte{0})
+		hash.Write([]byte(arg))
+	}
+	hash.Write([]byte{0})
+	hash.Write(input)
+	return command + "-" + hex.EncodeToString(hash.Sum(nil))[:16]
+}
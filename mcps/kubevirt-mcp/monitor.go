@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the conformance monitor, see
+// MonitorConfig. The monitor is enabled by setting an interval.
+const (
+	monitorIntervalEnv  = "KUBEVIRT_MCP_MONITOR_INTERVAL"
+	monitorNamespaceEnv = "KUBEVIRT_MCP_MONITOR_NAMESPACE"
+	monitorMigrationEnv = "KUBEVIRT_MCP_MONITOR_MIGRATION"
+	metricsAddrEnv      = "KUBEVIRT_MCP_METRICS_ADDR"
+
+	// minMonitorInterval keeps the monitor from creating VMs back to back
+	minMonitorInterval = time.Minute
+)
+
+// MonitorStatus is the monitor_status tool result
+type MonitorStatus struct {
+	Enabled             bool             `json:"enabled"`
+	Interval            string           `json:"interval,omitempty"`
+	Namespace           string           `json:"namespace,omitempty"`
+	MetricsAddr         string           `json:"metricsAddr,omitempty"`
+	Runs                int              `json:"runs"`
+	Failures            int              `json:"failures"`
+	LastRun             *time.Time       `json:"lastRun,omitempty"`
+	LastRunAgo          string           `json:"lastRunAgo,omitempty"`
+	LastSuccess         *time.Time       `json:"lastSuccess,omitempty"`
+	LastSuccessAgo      string           `json:"lastSuccessAgo,omitempty"`
+	LastResult          *SmokeTestResult `json:"lastResult,omitempty"`
+	ConsecutiveFailures int              `json:"consecutiveFailures"`
+}
+
+// conformanceMonitor periodically runs the cluster smoke test
+type conformanceMonitor struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	params      SmokeTestParams
+	metricsAddr string
+
+	runs            int
+	failures        int
+	consecutiveFail int
+	lastRun         time.Time
+	lastSuccess     time.Time
+	lastResult      *SmokeTestResult
+	lastDuration    time.Duration
+}
+
+// monitor is the running conformance monitor, nil when it is disabled
+var monitor *conformanceMonitor
+
+func init() {
+	registerTool(Tool{
+		Name:        "monitor_status",
+		Description: "Report the results of the continuous conformance monitor, which periodically runs cluster_smoketest when the server is started with " + monitorIntervalEnv,
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			return formatJSON(monitorStatus())
+		},
+	})
+}
+
+// startMonitor starts the conformance monitor when it is configured. It
+// reports whether the monitor is running.
+func startMonitor() (bool, error) {
+	config := serverConfig.Monitor
+	interval := config.Interval
+	if interval == 0 {
+		return false, nil
+	}
+	if interval < minMonitorInterval {
+		return false, fmt.Errorf("the monitor interval must be at least %v", minMonitorInterval)
+	}
+
+	params := SmokeTestParams{
+		Namespace: config.Namespace,
+		Image:     defaultSmokeTestImage,
+		Timeout:   defaultSmokeTestTimeout,
+		Migration: config.Migration,
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	monitor = &conformanceMonitor{
+		interval:    interval,
+		params:      params,
+		metricsAddr: config.MetricsAddr,
+	}
+
+	go monitor.run()
+	logMessage(LogInfo, "monitor", "Conformance monitor running every %v in namespace %s", interval, params.Namespace)
+	return true, nil
+}
+
+// run executes the smoke test immediately and then once per interval
+func (m *conformanceMonitor) run() {
+	for {
+		start := time.Now()
+		result := runSmokeTest(context.Background(), m.params)
+
+		m.mu.Lock()
+		m.runs++
+		m.lastRun = start
+		m.lastResult = result
+		m.lastDuration = time.Since(start)
+		if result.Passed {
+			m.lastSuccess = start
+			m.consecutiveFail = 0
+		} else {
+			m.failures++
+			m.consecutiveFail++
+		}
+		m.mu.Unlock()
+
+		if result.Passed {
+			logMessage(LogInfo, "monitor", "Smoke test passed in %s", result.Duration)
+		} else {
+			logMessage(LogError, "monitor", "Smoke test failed: %s", failedSteps(result))
+		}
+
+		time.Sleep(m.interval)
+	}
+}
+
+// failedSteps summarizes the failed steps of a smoke test run
+func failedSteps(result *SmokeTestResult) string {
+	var failed []string
+	for _, step := range result.Steps {
+		if step.Status == smokeTestFailed {
+			failed = append(failed, fmt.Sprintf("%s (%s)", step.Name, step.Message))
+		}
+	}
+	return strings.Join(failed, ", ")
+}
+
+// monitorStatus returns a snapshot of the monitor state
+func monitorStatus() MonitorStatus {
+	if monitor == nil {
+		return MonitorStatus{}
+	}
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	status := MonitorStatus{
+		Enabled:             true,
+		Interval:            monitor.interval.String(),
+		Namespace:           monitor.params.Namespace,
+		MetricsAddr:         monitor.metricsAddr,
+		Runs:                monitor.runs,
+		Failures:            monitor.failures,
+		LastResult:          monitor.lastResult,
+		ConsecutiveFailures: monitor.consecutiveFail,
+	}
+	if !monitor.lastRun.IsZero() {
+		lastRun := monitor.lastRun
+		status.LastRun = &lastRun
+		status.LastRunAgo = since(lastRun) + " ago"
+	}
+	if !monitor.lastSuccess.IsZero() {
+		lastSuccess := monitor.lastSuccess
+		status.LastSuccess = &lastSuccess
+		status.LastSuccessAgo = since(lastSuccess) + " ago"
+	}
+	return status
+}
+
+// writeMetrics renders the monitor state in the Prometheus text format
+func (m *conformanceMonitor) writeMetrics(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := func(name, help, kind string, samples ...string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, sample := range samples {
+			fmt.Fprintf(b, "%s%s\n", name, sample)
+		}
+	}
+
+	metric("kubevirt_mcp_smoketest_runs_total", "Number of smoke test runs.", "counter",
+		fmt.Sprintf(" %d", m.runs))
+	metric("kubevirt_mcp_smoketest_failures_total", "Number of failed smoke test runs.", "counter",
+		fmt.Sprintf(" %d", m.failures))
+
+	if m.lastResult == nil {
+		return
+	}
+
+	success := 0
+	if m.lastResult.Passed {
+		success = 1
+	}
+	metric("kubevirt_mcp_smoketest_success", "Whether the last smoke test run passed.", "gauge",
+		fmt.Sprintf(" %d", success))
+	metric("kubevirt_mcp_smoketest_duration_seconds", "Duration of the last smoke test run.", "gauge",
+		fmt.Sprintf(" %g", m.lastDuration.Seconds()))
+	metric("kubevirt_mcp_smoketest_last_run_timestamp_seconds", "Start time of the last smoke test run.", "gauge",
+		fmt.Sprintf(" %d", m.lastRun.Unix()))
+	if !m.lastSuccess.IsZero() {
+		metric("kubevirt_mcp_smoketest_last_success_timestamp_seconds", "Start time of the last passing smoke test run.", "gauge",
+			fmt.Sprintf(" %d", m.lastSuccess.Unix()))
+	}
+
+	steps := append([]SmokeTestStep(nil), m.lastResult.Steps...)
+	sort.Slice(steps, func(i, j int) bool { return steps[i].Name < steps[j].Name })
+	var stepSuccess, stepDuration []string
+	for _, step := range steps {
+		if step.Status == smokeTestSkipped {
+			continue
+		}
+		passed := 0
+		if step.Status == smokeTestPassed {
+			passed = 1
+		}
+		stepSuccess = append(stepSuccess, fmt.Sprintf("{step=%q} %d", step.Name, passed))
+		if duration, err := time.ParseDuration(step.Duration); err == nil {
+			stepDuration = append(stepDuration, fmt.Sprintf("{step=%q} %g", step.Name, duration.Seconds()))
+		}
+	}
+	metric("kubevirt_mcp_smoketest_step_success", "Whether a step of the last smoke test run passed.", "gauge", stepSuccess...)
+	metric("kubevirt_mcp_smoketest_step_duration_seconds", "Duration of a step of the last smoke test run.", "gauge", stepDuration...)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// MemoryOverheadParams represents the parameters of vm_memory_overhead
+type MemoryOverheadParams struct {
+	Namespace string          `json:"namespace,omitempty"`
+	VMName    string          `json:"vm_name,omitempty"`
+	VM        json.RawMessage `json:"vm,omitempty"`
+	OS        string          `json:"os,omitempty"`
+	CPU       int             `json:"cpu,omitempty"`
+	Memory    string          `json:"memory,omitempty"`
+	Count     int             `json:"count,omitempty"`
+	Format    string          `json:"format,omitempty"`
+}
+
+// OverheadComponent is one term of KubeVirt's memory overhead formula
+type OverheadComponent struct {
+	Name   string `json:"name"`
+	Size   string `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// MemoryOverheadResult is the vm_memory_overhead tool result
+type MemoryOverheadResult struct {
+	Namespace           string              `json:"namespace"`
+	VM                  string              `json:"vm"`
+	Architecture        string              `json:"architecture"`
+	VCPUs               int                 `json:"vcpus"`
+	GuestMemory         string              `json:"guestMemory"`
+	Components          []OverheadComponent `json:"components"`
+	OverheadRatio       float64             `json:"overheadRatio"`
+	Overhead            string              `json:"overhead"`
+	RequestsMemory      string              `json:"requestsMemory"`
+	LimitsMemory        string              `json:"limitsMemory,omitempty"`
+	Hugepages           string              `json:"hugepages,omitempty"`
+	Count               int                 `json:"count"`
+	TotalRequestsMemory string              `json:"totalRequestsMemory,omitempty"`
+	Notes               []string            `json:"notes,omitempty"`
+}
+
+// launcherSpec holds the fields of a VMI spec that size its virt-launcher pod
+type launcherSpec struct {
+	Architecture string `json:"architecture,omitempty"`
+	Domain       struct {
+		DomainSpec
+		Memory *struct {
+			Guest     string `json:"guest,omitempty"`
+			Hugepages *struct {
+				PageSize string `json:"pageSize"`
+			} `json:"hugepages,omitempty"`
+		} `json:"memory,omitempty"`
+		Devices struct {
+			AutoattachGraphicsDevice *bool             `json:"autoattachGraphicsDevice,omitempty"`
+			HostDevices              []json.RawMessage `json:"hostDevices,omitempty"`
+			GPUs                     []json.RawMessage `json:"gpus,omitempty"`
+			Interfaces               []struct {
+				SRIOV *struct{} `json:"sriov,omitempty"`
+			} `json:"interfaces,omitempty"`
+			TPM             *struct{} `json:"tpm,omitempty"`
+			DownwardMetrics *struct{} `json:"downwardMetrics,omitempty"`
+		} `json:"devices"`
+		LaunchSecurity *struct {
+			SEV *struct{} `json:"sev,omitempty"`
+		} `json:"launchSecurity,omitempty"`
+	} `json:"domain"`
+	Volumes []struct {
+		DownwardMetrics *struct{} `json:"downwardMetrics,omitempty"`
+	} `json:"volumes,omitempty"`
+	LivenessProbe  *launcherProbe `json:"livenessProbe,omitempty"`
+	ReadinessProbe *launcherProbe `json:"readinessProbe,omitempty"`
+}
+
+type launcherProbe struct {
+	Exec *struct{} `json:"exec,omitempty"`
+}
+
+// launcherOverheads are the fixed terms of the overhead formula, as measured
+// by KubeVirt and rounded up to the MiB
+var launcherOverheads = []struct {
+	name, reason string
+	size         float64
+}{
+	{"virt-launcher-monitor", "process supervising virt-launcher", 25 << 20},
+	{"virt-launcher", "virt-launcher process", 100 << 20},
+	{"virtlogd", "libvirt log daemon", 25 << 20},
+	{"virtqemud", "libvirt QEMU daemon", 40 << 20},
+	{"qemu", "QEMU process outside of the guest memory", 30 << 20},
+}
+
+// overheadSettings are the KubeVirt settings the launcher pod is sized with
+type overheadSettings struct {
+	overheadRatio      float64
+	cpuAllocationRatio float64
+	architecture       string
+}
+
+func init() {
+	flavors := make([]string, 0, len(vmTemplates))
+	for flavor := range vmTemplates {
+		flavors = append(flavors, flavor)
+	}
+	sort.Strings(flavors)
+
+	registerTool(Tool{
+		Name:        "vm_memory_overhead",
+		Description: "Compute the memory request of the virt-launcher pod KubeVirt derives from a VM spec: the guest memory plus each term of KubeVirt's overhead formula (page tables, KubeVirt processes, vCPUs, graphics, VFIO, probes, TPM, SEV), scaled by additionalGuestMemoryOverheadRatio. Use it to size quotas and nodes",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of an existing VM",
+				},
+				"vm": map[string]interface{}{
+					"type":        "object",
+					"description": "VirtualMachine manifest",
+				},
+				"os": map[string]interface{}{
+					"type":        "string",
+					"description": "Without vm_name or vm, the vm_create flavor",
+					"enum":        flavors,
+					"default":     defaultVMCreateOS,
+				},
+				"cpu": map[string]interface{}{
+					"type":        "integer",
+					"description": "Without vm_name or vm, the vm_create CPU cores",
+					"default":     1,
+				},
+				"memory": map[string]interface{}{
+					"type":        "string",
+					"description": "Without vm_name or vm, the vm_create memory, defaults to the flavor's",
+				},
+				"count": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of such VMs, to get their total memory request",
+					"default":     1,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleMemoryOverhead,
+	})
+}
+
+// handleMemoryOverhead is the tools/call handler for vm_memory_overhead
+func handleMemoryOverhead(ctx context.Context, args json.RawMessage) (string, error) {
+	var params MemoryOverheadParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.VMName != "" && len(params.VM) > 0 {
+		return "", &invalidParamsError{err: errors.New("vm_name and vm are mutually exclusive")}
+	}
+	if params.Count < 0 {
+		return "", &invalidParamsError{err: errors.New("count must be positive")}
+	}
+	if params.Count == 0 {
+		params.Count = 1
+	}
+	if params.CPU < 0 {
+		return "", &invalidParamsError{err: errors.New("cpu must be positive")}
+	}
+	if params.Memory != "" {
+		if _, ok := parseQuantity(params.Memory); !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid memory %q", params.Memory)}
+		}
+	}
+	if params.OS == "" {
+		params.OS = defaultVMCreateOS
+	}
+	if _, ok := vmTemplates[params.OS]; !ok {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown os %q", params.OS)}
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	vm, label, _, err := quotaCheckVM(ctx, QuotaCheckParams{Namespace: params.Namespace, VMName: params.VMName, VM: params.VM, OS: params.OS, CPU: params.CPU, Memory: params.Memory})
+	if err != nil {
+		return "", err
+	}
+	result := &MemoryOverheadResult{Namespace: params.Namespace, VM: label, Count: params.Count}
+
+	settings, err := readOverheadSettings(ctx)
+	if err != nil {
+		result.Notes = append(result.Notes, "KubeVirt CR not readable, no additionalGuestMemoryOverheadRatio assumed")
+	}
+	spec := &vm.Spec.Template.Spec
+	result.Architecture = settings.architecture
+	if spec.Architecture != "" {
+		result.Architecture = spec.Architecture
+	}
+	result.OverheadRatio = settings.overheadRatio
+
+	overhead, components := memoryOverhead(spec, result.Architecture, settings.overheadRatio)
+	result.Components = components
+	result.Overhead = humanBytes(int64(overhead))
+	result.VCPUs = vcpusOf(spec)
+	guest := guestMemory(spec)
+	result.GuestMemory = humanBytes(int64(guest))
+
+	request := launcherMemoryRequest(spec, overhead)
+	result.RequestsMemory = humanBytes(int64(request))
+	if spec.Domain.Memory != nil && spec.Domain.Memory.Hugepages != nil {
+		result.Hugepages = fmt.Sprintf("%s of %s pages", humanBytes(int64(guest)), spec.Domain.Memory.Hugepages.PageSize)
+		result.Notes = append(result.Notes, "the guest memory is requested as hugepages-"+spec.Domain.Memory.Hugepages.PageSize+", the memory request only covers the overhead")
+	}
+	if limit, ok := parseQuantity(spec.Domain.Resources.Limits["memory"]); ok {
+		result.LimitsMemory = humanBytes(int64(limit + overhead))
+	} else {
+		result.Notes = append(result.Notes, "the VM sets no memory limit; LimitRange defaults or quotas requiring limits may add one, see vm_quota_check")
+	}
+	if params.Count > 1 {
+		result.TotalRequestsMemory = humanBytes(int64(request * float64(params.Count)))
+	}
+	if settings.overheadRatio == 1 {
+		result.Notes = append(result.Notes, "raise spec.configuration.additionalGuestMemoryOverheadRatio of the KubeVirt CR if virt-launcher pods are OOM killed")
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// readOverheadSettings reads the overhead ratio, CPU allocation ratio and
+// default architecture of the KubeVirt CR, returning the KubeVirt defaults
+// along with the error when it cannot be read
+func readOverheadSettings(ctx context.Context) (overheadSettings, error) {
+	settings := overheadSettings{overheadRatio: 1, cpuAllocationRatio: defaultCPUAllocationRatio, architecture: "amd64"}
+	_, kvRaw, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return settings, err
+	}
+	configuration := nestedMap(kvRaw, "spec", "configuration")
+	if ratio, ok := parseQuantity(stringField(configuration, "additionalGuestMemoryOverheadRatio")); ok && ratio > 0 {
+		settings.overheadRatio = ratio
+	}
+	if ratio, ok := nestedMap(configuration, "developerConfiguration")["cpuAllocationRatio"].(float64); ok && ratio > 0 {
+		settings.cpuAllocationRatio = ratio
+	}
+	if arch := stringField(nestedMap(configuration, "architectureConfiguration"), "defaultArchitecture"); arch != "" {
+		settings.architecture = arch
+	}
+	return settings, nil
+}
+
+// memoryOverhead computes the memory virt-controller adds to the guest
+// memory of the launcher pod, like KubeVirt's GetMemoryOverhead, returning
+// the total and its terms before the ratio is applied
+func memoryOverhead(spec *launcherSpec, architecture string, ratio float64) (float64, []OverheadComponent) {
+	var components []OverheadComponent
+	total := 0.0
+	add := func(name string, size float64, reason string) {
+		total += size
+		components = append(components, OverheadComponent{Name: name, Size: humanBytes(int64(size)), Reason: reason})
+	}
+
+	add("page tables", guestMemory(spec)/512, "1 byte per 512 bytes of guest memory")
+	for _, o := range launcherOverheads {
+		add(o.name, o.size, o.reason)
+	}
+	vcpus := vcpusOf(spec)
+	add("vcpus", float64(vcpus)*(8<<20), fmt.Sprintf("8Mi per vCPU, %d vCPUs", vcpus))
+	add("iothread", 8<<20, "static IOThread overhead")
+
+	devices := spec.Domain.Devices
+	if attach := devices.AutoattachGraphicsDevice; attach == nil || *attach {
+		add("graphics", 16<<20, "video RAM, autoattachGraphicsDevice is not false")
+	}
+	if architecture == "arm64" {
+		add("uefi pflash", 128<<20, "two 64Mi pflash devices of UEFI on arm64")
+	}
+	sriov := false
+	for _, iface := range devices.Interfaces {
+		sriov = sriov || iface.SRIOV != nil
+	}
+	if len(devices.HostDevices) > 0 || len(devices.GPUs) > 0 || sriov {
+		add("vfio", 1<<30, "host devices, GPUs or SR-IOV interfaces lock the guest memory and MMIO space")
+	}
+	downwardMetrics := devices.DownwardMetrics != nil
+	for _, volume := range spec.Volumes {
+		downwardMetrics = downwardMetrics || volume.DownwardMetrics != nil
+	}
+	if downwardMetrics {
+		add("downward metrics", 1<<20, "memory backed downward metrics volume")
+	}
+	liveness := spec.LivenessProbe != nil && spec.LivenessProbe.Exec != nil
+	readiness := spec.ReadinessProbe != nil && spec.ReadinessProbe.Exec != nil
+	if liveness || readiness {
+		add("virt-probe", 100<<20, "virt-probe binary of exec probes")
+	}
+	if liveness {
+		add("liveness probe", 10<<20, "exec liveness probe")
+	}
+	if readiness {
+		add("readiness probe", 10<<20, "exec readiness probe")
+	}
+	if spec.Domain.LaunchSecurity != nil && spec.Domain.LaunchSecurity.SEV != nil {
+		add("sev", 256<<20, "SEV memory encryption")
+	}
+	if devices.TPM != nil {
+		add("tpm", 53<<20, "swtpm process")
+	}
+	return total * ratio, components
+}
+
+// vcpusOf returns the vCPUs of the guest: its CPU topology, or without one
+// the CPU limit or request, at least one
+func vcpusOf(spec *launcherSpec) int {
+	domain := spec.Domain
+	if topology := domain.CPU; topology != nil {
+		return max(topology.Sockets, 1) * max(topology.Cores, 1) * max(topology.Threads, 1)
+	}
+	for _, quantity := range []string{domain.Resources.Limits["cpu"], domain.Resources.Requests["cpu"]} {
+		if cores, ok := parseQuantity(quantity); ok {
+			return max(int(cores), 1)
+		}
+	}
+	return 1
+}
+
+// guestMemory returns the memory of the guest: memory.guest, else the
+// memory request
+func guestMemory(spec *launcherSpec) float64 {
+	domain := spec.Domain
+	if domain.Memory != nil && domain.Memory.Guest != "" {
+		guest, _ := parseQuantity(domain.Memory.Guest)
+		return guest
+	}
+	guest, _ := parseQuantity(domain.Resources.Requests["memory"])
+	return guest
+}
+
+// launcherMemoryRequest returns the memory request of the compute container:
+// the VM's memory request, or the guest memory, plus the overhead. Hugepages
+// back the guest memory outside of the memory request.
+func launcherMemoryRequest(spec *launcherSpec, overhead float64) float64 {
+	domain := spec.Domain
+	if domain.Memory != nil && domain.Memory.Hugepages != nil {
+		return overhead
+	}
+	if request, ok := parseQuantity(domain.Resources.Requests["memory"]); ok {
+		return request + overhead
+	}
+	return guestMemory(spec) + overhead
+}
+
+// tables renders the overhead as an overview followed by the terms of the
+// formula
+func (r *MemoryOverheadResult) tables() []table {
+	overview := table{title: "Memory overhead " + r.Namespace + " " + r.VM, headers: []string{"FIELD", "VALUE"}}
+	overview.rows = append(overview.rows,
+		[]string{"Architecture", r.Architecture},
+		[]string{"vCPUs", strconv.Itoa(r.VCPUs)},
+		[]string{"Guest memory", r.GuestMemory},
+		[]string{"Overhead", fmt.Sprintf("%s (ratio %s)", r.Overhead, strconv.FormatFloat(r.OverheadRatio, 'f', -1, 64))},
+		[]string{"Requests memory", r.RequestsMemory},
+	)
+	if r.Hugepages != "" {
+		overview.rows = append(overview.rows, []string{"Hugepages", r.Hugepages})
+	}
+	if r.LimitsMemory != "" {
+		overview.rows = append(overview.rows, []string{"Limits memory", r.LimitsMemory})
+	}
+	if r.TotalRequestsMemory != "" {
+		overview.rows = append(overview.rows, []string{"Total requests memory", fmt.Sprintf("%s for %d VMs", r.TotalRequestsMemory, r.Count)})
+	}
+	for _, note := range r.Notes {
+		overview.rows = append(overview.rows, []string{"Note", note})
+	}
+
+	components := table{title: "Overhead terms", headers: []string{"TERM", "SIZE", "REASON"}}
+	for _, c := range r.Components {
+		components.rows = append(components.rows, []string{c.Name, c.Size, c.Reason})
+	}
+	return []table{overview, components}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func parseLauncherSpec(t *testing.T, spec string) *launcherSpec {
+	t.Helper()
+	var s launcherSpec
+	if err := json.Unmarshal([]byte(spec), &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func TestMemoryOverhead(t *testing.T) {
+	const memory2Gi = `"resources":{"requests":{"memory":"2Gi"}}`
+	tests := []struct {
+		name         string
+		spec         string
+		architecture string
+		ratio        float64
+		want         float64
+		terms        int
+	}{
+		// 4Mi of page tables, 220Mi of processes, 8Mi per vCPU, 8Mi of
+		// IOThread and 16Mi of video RAM
+		{"defaults", `{"domain":{` + memory2Gi + `}}`, "amd64", 1, 256 << 20, 9},
+		{"ratio", `{"domain":{` + memory2Gi + `}}`, "amd64", 1.5, 384 << 20, 9},
+		{"guest memory and topology without graphics", `{"domain":{"cpu":{"sockets":2,"cores":2},"memory":{"guest":"4Gi"},"devices":{"autoattachGraphicsDevice":false}}}`, "amd64", 1, 268 << 20, 8},
+		{"arm64 pflash", `{"domain":{` + memory2Gi + `}}`, "arm64", 1, 384 << 20, 10},
+		{"gpu", `{"domain":{` + memory2Gi + `,"devices":{"gpus":[{"name":"gpu1"}]}}}`, "amd64", 1, 1280 << 20, 10},
+		{"sriov", `{"domain":{` + memory2Gi + `,"devices":{"interfaces":[{"masquerade":{}},{"sriov":{}}]}}}`, "amd64", 1, 1280 << 20, 10},
+		{"bridge", `{"domain":{` + memory2Gi + `,"devices":{"interfaces":[{"bridge":{}}]}}}`, "amd64", 1, 256 << 20, 9},
+		{"exec probes", `{"domain":{` + memory2Gi + `},"livenessProbe":{"exec":{}},"readinessProbe":{"exec":{}}}`, "amd64", 1, 376 << 20, 12},
+		{"http probe", `{"domain":{` + memory2Gi + `},"readinessProbe":{"httpGet":{}}}`, "amd64", 1, 256 << 20, 9},
+		{"downward metrics volume", `{"domain":{` + memory2Gi + `},"volumes":[{"containerDisk":{}},{"downwardMetrics":{}}]}`, "amd64", 1, 257 << 20, 10},
+		{"tpm and sev", `{"domain":{` + memory2Gi + `,"devices":{"tpm":{}},"launchSecurity":{"sev":{}}}}`, "amd64", 1, 565 << 20, 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, components := memoryOverhead(parseLauncherSpec(t, tt.spec), tt.architecture, tt.ratio)
+			if got != tt.want {
+				t.Errorf("overhead = %s, want %s", humanBytes(int64(got)), humanBytes(int64(tt.want)))
+			}
+			if len(components) != tt.terms {
+				t.Errorf("components = %+v, want %d terms", components, tt.terms)
+			}
+		})
+	}
+}
+
+func TestVCPUsOf(t *testing.T) {
+	tests := []struct {
+		spec string
+		want int
+	}{
+		{`{"domain":{}}`, 1},
+		{`{"domain":{"cpu":{"cores":4}}}`, 4},
+		{`{"domain":{"cpu":{"sockets":2,"cores":2,"threads":2}}}`, 8},
+		{`{"domain":{"cpu":{"cores":2},"resources":{"limits":{"cpu":"8"}}}}`, 2},
+		{`{"domain":{"resources":{"limits":{"cpu":"3"},"requests":{"cpu":"1"}}}}`, 3},
+		{`{"domain":{"resources":{"requests":{"cpu":"2"}}}}`, 2},
+		{`{"domain":{"resources":{"requests":{"cpu":"500m"}}}}`, 1},
+	}
+	for _, tt := range tests {
+		if got := vcpusOf(parseLauncherSpec(t, tt.spec)); got != tt.want {
+			t.Errorf("vcpusOf(%s) = %d, want %d", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestLauncherMemoryRequest(t *testing.T) {
+	const overhead = 256 << 20
+	tests := []struct {
+		name string
+		spec string
+		want float64
+	}{
+		{"memory request", `{"domain":{"resources":{"requests":{"memory":"2Gi"}}}}`, 2<<30 + overhead},
+		{"guest memory", `{"domain":{"memory":{"guest":"4Gi"}}}`, 4<<30 + overhead},
+		{"request below the guest memory", `{"domain":{"memory":{"guest":"4Gi"},"resources":{"requests":{"memory":"1Gi"}}}}`, 1<<30 + overhead},
+		{"hugepages", `{"domain":{"memory":{"guest":"4Gi","hugepages":{"pageSize":"2Mi"}},"resources":{"requests":{"memory":"4Gi"}}}}`, overhead},
+	}
+	for _, tt := range tests {
+		if got := launcherMemoryRequest(parseLauncherSpec(t, tt.spec), overhead); got != tt.want {
+			t.Errorf("%s: request = %s, want %s", tt.name, humanBytes(int64(got)), humanBytes(int64(tt.want)))
+		}
+	}
+}
+
+func TestMemoryOverheadTotal(t *testing.T) {
+	useSimulation(t, simulationModel)
+	vm := `{"apiVersion":"kubevirt.io/v1","kind":"VirtualMachine","metadata":{"name":"big"},"spec":{"template":{"spec":{"domain":{"cpu":{"cores":2},"resources":{"requests":{"memory":"2Gi"},"limits":{"memory":"4Gi"}}}}}}}`
+	output, err := handleMemoryOverhead(context.Background(), json.RawMessage(`{"vm":`+vm+`,"count":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result MemoryOverheadResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatal(err)
+	}
+	// 256Mi with a second vCPU
+	if result.Overhead != "264Mi" || result.RequestsMemory != "2.3Gi" || result.LimitsMemory != "4.3Gi" || result.TotalRequestsMemory != "6.8Gi" {
+		t.Fatalf("result = %+v", result)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVMIActionTimeout = 30
+	defaultUnfreezeTimeout  = "5m"
+
+	// fsFrozen is the VMI fsFreezeStatus while the guest filesystems are frozen
+	fsFrozen = "frozen"
+)
+
+// VMPauseParams represents the parameters of vm_pause, vm_unpause,
+// vm_freeze, vm_unfreeze and vm_soft_reboot
+type VMPauseParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	VMName          string `json:"vm_name"`
+	UnfreezeTimeout string `json:"unfreeze_timeout,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"`
+}
+
+// VMPauseResult is the result of vm_pause, vm_unpause, vm_freeze,
+// vm_unfreeze and vm_soft_reboot
+type VMPauseResult struct {
+	Namespace string `json:"namespace"`
+	VMName    string `json:"vmName"`
+	Action    string `json:"action"`
+	State     string `json:"state"`
+	Changed   bool   `json:"changed"`
+	Duration  string `json:"duration,omitempty"`
+}
+
+// vmiAction is a VMI subresource changing the state of a running VMI
+type vmiAction struct {
+	name        string
+	subresource string
+	description string
+	// state is the state of the VMI once reached returns true, actions
+	// without a lasting state have no reached function and do not wait
+	state   string
+	reached func(vmi *VirtualMachineInstance) bool
+	// check returns why the action cannot run on the VMI
+	check func(vmi *VirtualMachineInstance) error
+}
+
+var vmiActions = []vmiAction{
+	{
+		name:        "vm_pause",
+		subresource: "pause",
+		description: "Pause a running VM: its vCPUs stop while memory and devices are kept, vm_unpause resumes it",
+		state:       "paused",
+		reached:     func(vmi *VirtualMachineInstance) bool { return pausedCondition(vmi) != nil },
+	},
+	{
+		name:        "vm_unpause",
+		subresource: "unpause",
+		description: "Resume a VM paused by vm_pause, or by KubeVirt after an I/O error once the volume is fixed",
+		state:       "running",
+		reached:     func(vmi *VirtualMachineInstance) bool { return pausedCondition(vmi) == nil },
+	},
+	{
+		name:        "vm_freeze",
+		subresource: "freeze",
+		description: "Freeze the guest filesystems through the guest agent, e.g. for a consistent backup, until vm_unfreeze or the unfreeze timeout",
+		state:       fsFrozen,
+		reached:     func(vmi *VirtualMachineInstance) bool { return vmi.Status.FSFreezeStatus == fsFrozen },
+		check:       checkGuestAgentAction,
+	},
+	{
+		name:        "vm_unfreeze",
+		subresource: "unfreeze",
+		description: "Thaw the guest filesystems frozen by vm_freeze",
+		state:       "thawed",
+		reached:     func(vmi *VirtualMachineInstance) bool { return vmi.Status.FSFreezeStatus != fsFrozen },
+		check:       checkGuestAgentAction,
+	},
+	{
+		name:        "vm_soft_reboot",
+		subresource: "softreboot",
+		description: "Reboot the guest OS through the guest agent, or ACPI without an agent, keeping the VMI, its pod and node; use it to recover a hung workload without a full VM restart",
+		state:       "reboot requested",
+		check:       checkNotPaused,
+	},
+}
+
+func init() {
+	for _, action := range vmiActions {
+		properties := map[string]interface{}{
+			"namespace": map[string]interface{}{
+				"type":        "string",
+				"description": "Kubernetes namespace containing the VM",
+				"default":     "default",
+			},
+			"vm_name": map[string]interface{}{
+				"type":        "string",
+				"description": "Name of the VM or VMI",
+			},
+		}
+		if action.reached != nil {
+			properties["timeout"] = map[string]interface{}{
+				"type":        "integer",
+				"description": "Timeout in seconds for the VMI to report the new state (default: 30)",
+				"default":     defaultVMIActionTimeout,
+			}
+		}
+		if action.subresource == "freeze" {
+			properties["unfreeze_timeout"] = map[string]interface{}{
+				"type":        "string",
+				"description": "Duration after which the guest is thawed even without vm_unfreeze, e.g. 1m",
+				"default":     defaultUnfreezeTimeout,
+			}
+		}
+
+		registerTool(Tool{
+			Name:        action.name,
+			Description: action.description,
+			InputSchema: map[string]interface{}{
+				"type":       "object",
+				"properties": properties,
+				"required":   []string{"vm_name"},
+			},
+			Handler: vmiActionHandler(action),
+		})
+	}
+}
+
+// vmiActionHandler returns the tools/call handler of an action
+func vmiActionHandler(action vmiAction) func(context.Context, json.RawMessage) (string, error) {
+	return func(ctx context.Context, args json.RawMessage) (string, error) {
+		var params VMPauseParams
+		if err := decodeArguments(args, &params); err != nil {
+			return "", err
+		}
+		if params.VMName == "" {
+			return "", missingArgument("vm_name")
+		}
+		if params.Timeout < 0 {
+			return "", &invalidParamsError{err: errors.New("timeout cannot be negative")}
+		}
+		if params.UnfreezeTimeout != "" {
+			if d, err := time.ParseDuration(params.UnfreezeTimeout); err != nil || d <= 0 {
+				return "", &invalidParamsError{err: fmt.Errorf("invalid unfreeze_timeout '%s', use a duration such as 5m", params.UnfreezeTimeout)}
+			}
+		}
+
+		// Set defaults if not provided
+		if params.Namespace == "" {
+			params.Namespace = "default"
+		}
+		if params.Timeout == 0 {
+			params.Timeout = defaultVMIActionTimeout
+		}
+		if params.UnfreezeTimeout == "" {
+			params.UnfreezeTimeout = defaultUnfreezeTimeout
+		}
+
+		result, err := runVMIAction(ctx, action, params)
+		if err != nil {
+			return "", err
+		}
+		return formatJSON(result)
+	}
+}
+
+// runVMIAction calls the subresource of the action and waits until the VMI
+// reports the new state. Nothing is called when the VMI is in it already.
+func runVMIAction(ctx context.Context, action vmiAction, params VMPauseParams) (*VMPauseResult, error) {
+	vmi, err := getRunningVMIObject(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return nil, err
+	}
+	result := &VMPauseResult{Namespace: params.Namespace, VMName: params.VMName, Action: action.subresource, State: action.state}
+	if action.reached != nil && action.reached(vmi) {
+		return result, nil
+	}
+	if action.check != nil {
+		if err := action.check(vmi); err != nil {
+			return nil, fmt.Errorf("cannot %s VMI %s/%s: %v", action.subresource, params.Namespace, params.VMName, err)
+		}
+	}
+
+	body := map[string]interface{}{}
+	if action.subresource == "freeze" {
+		timeout, _ := time.ParseDuration(params.UnfreezeTimeout)
+		body["unfreezeTimeout"] = timeout.String()
+	}
+	input, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	start := clock.Now()
+	path := fmt.Sprintf("/apis/subresources.kubevirt.io/v1/namespaces/%s/virtualmachineinstances/%s/%s", params.Namespace, params.VMName, action.subresource)
+	logMessage(LogInfo, action.name, "Calling %s on VMI %s/%s", action.subresource, params.Namespace, params.VMName)
+	if _, err := runKubectlWithInput(ctx, input, "replace", "--raw", path, "-f", "-"); err != nil {
+		return nil, fmt.Errorf("failed to %s VMI %s/%s: %v", action.subresource, params.Namespace, params.VMName, err)
+	}
+	result.Changed = true
+	if action.reached == nil {
+		return result, nil
+	}
+
+	reportProgress(ctx, "waiting for VMI %s/%s to be %s", params.Namespace, params.VMName, action.state)
+	deadline := clock.Now().Add(time.Duration(params.Timeout) * time.Second)
+	for {
+		// A fresh object, fsFreezeStatus is omitted once thawed
+		var current VirtualMachineInstance
+		if err := runKubectlJSON(ctx, &current, "get", "virtualmachineinstance", params.VMName, "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		if action.reached(&current) {
+			result.Duration = humanDuration(clock.Now().Sub(start))
+			return result, nil
+		}
+		if clock.Now().After(deadline) {
+			return nil, fmt.Errorf("VMI %s/%s was not %s within %ds", params.Namespace, params.VMName, action.state, params.Timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for VMI %s/%s cancelled", params.Namespace, params.VMName)
+		case <-clock.After(time.Second):
+		}
+	}
+}
+
+// getRunningVMIObject returns the VMI, failing when it does not exist or is
+// not running
+func getRunningVMIObject(ctx context.Context, namespace, name string) (*VirtualMachineInstance, error) {
+	var vmi VirtualMachineInstance
+	found, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("VM %s/%s has no VMI, start it first", namespace, name)
+	}
+	if vmi.Status.Phase != "Running" {
+		return nil, fmt.Errorf("VMI %s/%s is not running (phase: %s)", namespace, name, vmi.Status.Phase)
+	}
+	return &vmi, nil
+}
+
+// pausedCondition returns the Paused condition of the VMI when it is paused
+func pausedCondition(vmi *VirtualMachineInstance) *Condition {
+	for i, cond := range vmi.Status.Conditions {
+		if cond.Type == "Paused" && cond.Status == "True" {
+			return &vmi.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// pausedError describes why a paused VMI cannot run guest agent commands
+func pausedError(cond *Condition) error {
+	reason := cond.Reason
+	if cond.Message != "" {
+		reason += ": " + cond.Message
+	}
+	return fmt.Errorf("the VMI is paused (%s), resume it with vm_unpause", reason)
+}
+
+// checkNotPaused checks that the VMI is not paused
+func checkNotPaused(vmi *VirtualMachineInstance) error {
+	if cond := pausedCondition(vmi); cond != nil {
+		return pausedError(cond)
+	}
+	return nil
+}
+
+// checkGuestAgentAction checks that the guest agent can freeze or thaw the
+// filesystems
+func checkGuestAgentAction(vmi *VirtualMachineInstance) error {
+	if err := checkNotPaused(vmi); err != nil {
+		return err
+	}
+	if conditionStatus(vmi.Status.Conditions, "AgentConnected") != "True" {
+		return errors.New("the guest agent is not connected")
+	}
+	return nil
+}
+
+// pausedHint points to vm_unpause when vm-exec failed on a paused VMI
+func pausedHint(output string) string {
+	if strings.Contains(output, "is paused (") {
+		return "\nThe VMI is paused, resume it with vm_unpause"
+	}
+	return ""
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of objects that can be pinned
+const (
+	pinVM        = "vm"
+	pinNamespace = "namespace"
+	pinMigration = "migration"
+
+	// pinnedTarget is the target argument taking the pinned objects
+	pinnedTarget = "pinned"
+)
+
+// pinnedNameArguments names the VM argument of the tools not calling it
+// vm_name
+var pinnedNameArguments = map[string]string{
+	"vm_delete": "name",
+}
+
+// Pin is an object pinned as the working object of a session
+type Pin struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+	// VMName is the VM of a pinned migration
+	VMName string `json:"vmName,omitempty"`
+	Pinned string `json:"pinned"`
+}
+
+// sessionPins holds the pins of every session, keyed by session and kind.
+// Pins live in memory and end with their session.
+var sessionPins = struct {
+	sync.Mutex
+	pins map[string]map[string]Pin
+}{pins: map[string]map[string]Pin{}}
+
+// sessionKey is the context key of the HTTP session of a request
+type sessionKey struct{}
+
+// withSession returns a context carrying the HTTP session of a request
+func withSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+// requestSession identifies the session of a request: its HTTP session, else
+// the stream it was read from, stdio or a listener connection
+func requestSession(ctx context.Context) string {
+	if id, ok := ctx.Value(sessionKey{}).(string); ok && id != "" {
+		return "http/" + id
+	}
+	return connSession(requestConn(ctx))
+}
+
+// connSession identifies the session of a stream
+func connSession(conn *rpcWriter) string {
+	return fmt.Sprintf("conn/%p", conn)
+}
+
+// forgetPins drops the pins of a session that ended
+func forgetPins(session string) {
+	sessionPins.Lock()
+	delete(sessionPins.pins, session)
+	sessionPins.Unlock()
+}
+
+// PinSetParams represents the parameters of pin_set
+type PinSetParams struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+}
+
+// PinClearParams represents the parameters of pin_clear
+type PinClearParams struct {
+	Kind string `json:"kind,omitempty"`
+}
+
+// PinListParams represents the parameters of pin_list
+type PinListParams struct {
+	Format string `json:"format,omitempty"`
+}
+
+// PinsResult is the result of the pin tools, the pins of the session
+type PinsResult struct {
+	Pins    []Pin  `json:"pins"`
+	Cleared []Pin  `json:"cleared,omitempty"`
+	Note    string `json:"note,omitempty"`
+}
+
+func init() {
+	kinds := []string{pinVM, pinNamespace, pinMigration}
+	registerTool(Tool{
+		Name:        "pin_set",
+		Description: "Pin a VM, namespace or migration as the working object of this session, after checking it exists. Tools called with target set to pinned then take their VM name, namespace and cluster from the pins when not given. Pinning a kind replaces its previous pin",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"kind": map[string]interface{}{
+					"type":        "string",
+					"description": "Kind of object to pin",
+					"enum":        kinds,
+				},
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM, namespace or VirtualMachineInstanceMigration",
+				},
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Namespace of the VM or migration",
+					"default":     "default",
+				},
+			},
+			"required": []string{"kind", "name"},
+		},
+		Handler: handlePinSet,
+	})
+	registerTool(Tool{
+		Name:        "pin_list",
+		Description: "List the VM, namespace and migration pinned in this session",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"format": formatProperty(),
+			},
+		},
+		Handler: handlePinList,
+	})
+	registerTool(Tool{
+		Name:        "pin_clear",
+		Description: "Unpin the object of a kind, or every pinned object of this session",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"kind": map[string]interface{}{
+					"type":        "string",
+					"description": "Kind of object to unpin, every kind when not set",
+					"enum":        kinds,
+				},
+			},
+		},
+		Handler: handlePinClear,
+	})
+}
+
+// targetProperty returns the schema of the target argument of the tools
+// taking a pinned object
+func targetProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "string",
+		"description": "Set to pinned to take the VM, namespace and cluster not given from the objects pinned with pin_set",
+		"enum":        []string{pinnedTarget},
+	}
+}
+
+// pinnable reports whether a tool takes a VM or a namespace, which a pin
+// can provide
+func pinnable(tool Tool) bool {
+	if strings.HasPrefix(tool.Name, "pin_") {
+		return false
+	}
+	properties, _ := tool.InputSchema["properties"].(map[string]interface{})
+	return properties[pinnedVMArgument(tool)] != nil || properties["namespace"] != nil
+}
+
+// pinnedVMArgument returns the argument naming the VM of a tool
+func pinnedVMArgument(tool Tool) string {
+	if name, ok := pinnedNameArguments[tool.Name]; ok {
+		return name
+	}
+	return "vm_name"
+}
+
+// pinnedArguments fills the VM name, namespace and cluster arguments of a
+// call with target set to pinned from the pins of the session. Arguments
+// given by the call are kept. Migration tools take the VM of a pinned
+// migration over a pinned VM.
+func pinnedArguments(ctx context.Context, tool Tool, args json.RawMessage) (json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &fields); err != nil {
+			return args, nil
+		}
+	}
+	raw, ok := fields["target"]
+	if !ok {
+		return args, nil
+	}
+	var target string
+	if err := json.Unmarshal(raw, &target); err != nil || target != pinnedTarget {
+		return nil, &invalidParamsError{err: fmt.Errorf("invalid target %s, the only target is %s", raw, pinnedTarget)}
+	}
+	if !pinnable(tool) {
+		return nil, &invalidParamsError{err: fmt.Errorf("%s takes no pinned object", tool.Name)}
+	}
+	delete(fields, "target")
+
+	session := requestSession(ctx)
+	pins := map[string]Pin{}
+	sessionPins.Lock()
+	for kind, pin := range sessionPins.pins[session] {
+		pins[kind] = pin
+	}
+	sessionPins.Unlock()
+
+	properties, _ := tool.InputSchema["properties"].(map[string]interface{})
+	set := func(name, value string) {
+		if value == "" || properties[name] == nil {
+			return
+		}
+		if existing, ok := fields[name]; ok && string(existing) != `""` && string(existing) != "null" {
+			return
+		}
+		fields[name], _ = json.Marshal(value)
+	}
+
+	var object *Pin
+	if vmArgument := pinnedVMArgument(tool); properties[vmArgument] != nil {
+		if pin, ok := pins[pinMigration]; ok && migrationTool(tool.Name) {
+			object = &pin
+			set(vmArgument, pin.VMName)
+		} else if pin, ok := pins[pinVM]; ok {
+			object = &pin
+			set(vmArgument, pin.Name)
+		}
+	}
+	if object != nil {
+		set("namespace", object.Namespace)
+	} else if pin, ok := pins[pinNamespace]; ok {
+		object = &pin
+		set("namespace", pin.Name)
+	}
+	if object == nil {
+		return nil, &invalidParamsError{err: fmt.Errorf("nothing pinned for %s in this session, see pin_set", tool.Name)}
+	}
+	_, hasCluster := fields["cluster"]
+	_, hasContext := fields["context"]
+	if object.Cluster != "" && !hasCluster && !hasContext {
+		fields["cluster"], _ = json.Marshal(object.Cluster)
+	}
+
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// migrationTool reports whether a tool is about the migrations of a VM
+func migrationTool(name string) bool {
+	return strings.HasPrefix(name, "vmi_migration_") || name == "diagnose_migration"
+}
+
+// handlePinSet is the tools/call handler for pin_set
+func handlePinSet(ctx context.Context, args json.RawMessage) (string, error) {
+	var params PinSetParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Kind == "" {
+		return "", missingArgument("kind")
+	}
+	if params.Name == "" {
+		return "", missingArgument("name")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	pin := Pin{Kind: params.Kind, Name: params.Name, Namespace: params.Namespace, Cluster: params.Cluster, Pinned: clock.Now().UTC().Format(time.RFC3339)}
+	switch params.Kind {
+	case pinVM:
+		var vm VirtualMachine
+		found, err := getOptionalObject(ctx, &vm, "virtualmachine", params.Name, params.Namespace)
+		if err == nil && !found {
+			var vmi VirtualMachineInstance
+			found, err = getOptionalObject(ctx, &vmi, "virtualmachineinstance", params.Name, params.Namespace)
+		}
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", &invalidParamsError{err: fmt.Errorf("neither VM nor VMI found with name '%s' in namespace '%s'", params.Name, params.Namespace)}
+		}
+	case pinMigration:
+		var migration VirtualMachineInstanceMigration
+		found, err := getOptionalObject(ctx, &migration, "virtualmachineinstancemigration", params.Name, params.Namespace)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", &invalidParamsError{err: fmt.Errorf("migration %s/%s not found", params.Namespace, params.Name)}
+		}
+		pin.VMName = migration.Spec.VMIName
+	case pinNamespace:
+		if _, err := runKubectl(ctx, "get", "namespace", params.Name, "-o", "name"); err != nil {
+			return "", &invalidParamsError{err: fmt.Errorf("namespace %s not found: %v", params.Name, err)}
+		}
+		pin.Namespace = ""
+	default:
+		return "", &invalidParamsError{err: fmt.Errorf("unknown kind '%s', use %s, %s or %s", params.Kind, pinVM, pinNamespace, pinMigration)}
+	}
+
+	session := requestSession(ctx)
+	sessionPins.Lock()
+	if sessionPins.pins[session] == nil {
+		sessionPins.pins[session] = map[string]Pin{}
+	}
+	sessionPins.pins[session][pin.Kind] = pin
+	sessionPins.Unlock()
+	logMessage(LogInfo, "pin", "Pinned %s %s", pin.Kind, pinnedName(pin))
+
+	return formatJSON(sessionPinsResult(session))
+}
+
+// handlePinList is the tools/call handler for pin_list
+func handlePinList(ctx context.Context, args json.RawMessage) (string, error) {
+	var params PinListParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	result := sessionPinsResult(requestSession(ctx))
+	if len(result.Pins) == 0 {
+		result.Note = "nothing pinned, see pin_set"
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// handlePinClear is the tools/call handler for pin_clear
+func handlePinClear(ctx context.Context, args json.RawMessage) (string, error) {
+	var params PinClearParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Kind != "" && params.Kind != pinVM && params.Kind != pinNamespace && params.Kind != pinMigration {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown kind '%s', use %s, %s or %s", params.Kind, pinVM, pinNamespace, pinMigration)}
+	}
+
+	session := requestSession(ctx)
+	var cleared []Pin
+	sessionPins.Lock()
+	for kind, pin := range sessionPins.pins[session] {
+		if params.Kind == "" || kind == params.Kind {
+			cleared = append(cleared, pin)
+			delete(sessionPins.pins[session], kind)
+		}
+	}
+	sessionPins.Unlock()
+	sortPins(cleared)
+
+	result := sessionPinsResult(session)
+	result.Cleared = cleared
+	if len(cleared) == 0 {
+		result.Note = "nothing was pinned"
+	}
+	return formatJSON(result)
+}
+
+// sessionPinsResult returns the pins of a session
+func sessionPinsResult(session string) *PinsResult {
+	result := &PinsResult{Pins: []Pin{}}
+	sessionPins.Lock()
+	for _, pin := range sessionPins.pins[session] {
+		result.Pins = append(result.Pins, pin)
+	}
+	sessionPins.Unlock()
+	sortPins(result.Pins)
+	return result
+}
+
+// sortPins orders pins by kind: VM, namespace, then migration
+func sortPins(pins []Pin) {
+	order := map[string]int{pinVM: 0, pinNamespace: 1, pinMigration: 2}
+	sort.Slice(pins, func(i, j int) bool { return order[pins[i].Kind] < order[pins[j].Kind] })
+}
+
+// pinnedName returns namespace/name of a pin, the name of a namespace
+func pinnedName(pin Pin) string {
+	if pin.Namespace == "" {
+		return pin.Name
+	}
+	return pin.Namespace + "/" + pin.Name
+}
+
+// tables renders the pins of the session
+func (r *PinsResult) tables() []table {
+	pins := table{title: "Pinned objects", headers: []string{"KIND", "NAME", "VM", "CLUSTER", "PINNED"}}
+	for _, pin := range r.Pins {
+		pins.rows = append(pins.rows, []string{pin.Kind, pinnedName(pin), pin.VMName, pin.Cluster, pin.Pinned})
+	}
+	tables := []table{pins}
+	if r.Note != "" {
+		tables = append(tables, table{title: "Notes", headers: []string{"NOTE"}, rows: [][]string{{r.Note}}})
+	}
+	return tables
+}
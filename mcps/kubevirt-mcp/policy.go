@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Environment variables configuring the policy hook, see PolicyConfig. The
+// hook is enabled by setting a policy file.
+const (
+	policyFileEnv  = "KUBEVIRT_MCP_POLICY"
+	policyQueryEnv = "KUBEVIRT_MCP_POLICY_QUERY"
+	policyOPAEnv   = "KUBEVIRT_MCP_OPA"
+
+	// defaultPolicyQuery is the rule evaluated for every tool call
+	defaultPolicyQuery = "data.kubevirt_mcp.decision"
+)
+
+// policyInput is the input document of the policy, describing a tool call
+type policyInput struct {
+	Tool      string                 `json:"tool"`
+	Arguments map[string]interface{} `json:"arguments"`
+	ReadOnly  bool                   `json:"readOnly"`
+	Confirmed bool                   `json:"confirmed"`
+	Identity  *policyIdentity        `json:"identity"`
+}
+
+// policyIdentity is the caller identity as seen by the policy, null on stdio
+type policyIdentity struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces"`
+	ReadOnly   bool     `json:"readOnly"`
+}
+
+// policyDecision is the outcome of the policy for a tool call
+type policyDecision struct {
+	Allow   bool   `json:"allow"`
+	Confirm bool   `json:"confirm"`
+	Reason  string `json:"reason"`
+}
+
+// policyConfirmArgument is the argument confirming a call the policy asks
+// to confirm. It is apart from the confirm argument of tools such as
+// vm_rollout and vm_delete, where confirm turns a preview into the action.
+const policyConfirmArgument = "policy_confirm"
+
+// policyConfirmProperty returns the schema of the policy_confirm argument,
+// which the policy can require before running a call
+func policyConfirmProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "boolean",
+		"description": "Confirm a call the server policy asks to confirm, after checking it with the user. It does not confirm the action of the tool itself",
+		"default":     false,
+	}
+}
+
+// confirmProperty returns the schema of the confirm argument of the guest
+// commands matching a confirm pattern of the exec policy
+func confirmProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "boolean",
+		"description": "Confirm a command the exec policy asks to confirm, after checking it with the user",
+		"default":     false,
+	}
+}
+
+// startPolicy checks the policy file and the opa binary when the hook is
+// enabled, so a broken policy stops the server instead of every call
+func startPolicy() error {
+	config := serverConfig.Policy
+	if config.File == "" {
+		return nil
+	}
+	if _, err := os.Stat(expandHome(config.File)); err != nil {
+		return fmt.Errorf("failed to read policy: %v", err)
+	}
+	if _, err := exec.LookPath(config.OPA); err != nil {
+		return fmt.Errorf("the policy hook needs the opa binary: %v", err)
+	}
+	ctx, cancel := clock.WithTimeout(context.Background(), timeoutFor(timeoutPolicy))
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, config.OPA, "check", expandHome(config.File)).CombinedOutput(); err != nil {
+		return fmt.Errorf("invalid policy %s: %v\nOutput: %s", config.File, err, strings.TrimSpace(string(output)))
+	}
+	logMessage(LogInfo, "policy", "Evaluating %s of %s for every tool call", config.Query, config.File)
+	return nil
+}
+
+// evaluatePolicy applies the policy hook to a tool call: a denied call fails
+// with the reason of the policy, and a call requiring confirmation fails
+// until it is repeated with policy_confirm set to true. Calls fail closed when the
+// policy cannot be evaluated or yields no decision.
+func evaluatePolicy(ctx context.Context, tool Tool, args json.RawMessage) error {
+	config := serverConfig.Policy
+	if config.File == "" {
+		return nil
+	}
+
+	input := policyInput{Tool: tool.Name, Arguments: map[string]interface{}{}, ReadOnly: readOnlyTools[tool.Name]}
+	if len(args) > 0 {
+		json.Unmarshal(args, &input.Arguments)
+	}
+	input.Confirmed, _ = input.Arguments[policyConfirmArgument].(bool)
+	if identity, ok := callerIdentity(ctx); ok {
+		input.Identity = &policyIdentity{Name: identity.Name, Namespaces: identity.Namespaces, ReadOnly: identity.ReadOnly}
+	}
+
+	decision, err := queryPolicy(ctx, config, input)
+	if err != nil {
+		return &accessDeniedError{err: fmt.Errorf("policy evaluation failed for %s: %v", tool.Name, err)}
+	}
+	reason := ""
+	if decision.Reason != "" {
+		reason = ": " + decision.Reason
+	}
+	switch {
+	case !decision.Allow:
+		logMessage(LogWarning, "policy", "Denied %s%s", tool.Name, reason)
+		return &accessDeniedError{err: fmt.Errorf("policy denied %s%s", tool.Name, reason)}
+	case decision.Confirm && !input.Confirmed:
+		return &invalidParamsError{err: fmt.Errorf("policy requires confirmation of %s%s, call again with %s set to true", tool.Name, reason, policyConfirmArgument)}
+	}
+	return nil
+}
+
+// queryPolicy evaluates the policy query with opa eval
+func queryPolicy(ctx context.Context, config PolicyConfig, input policyInput) (*policyDecision, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode policy input: %v", err)
+	}
+	ctx, cancel := clock.WithTimeout(ctx, timeoutFor(timeoutPolicy))
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, config.OPA, "eval", "--format", "json", "--stdin-input", "--data", expandHome(config.File), config.Query)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("opa eval failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var result struct {
+		Result []struct {
+			Expressions []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse opa output: %v", err)
+	}
+	if len(result.Result) == 0 || len(result.Result[0].Expressions) == 0 {
+		return nil, fmt.Errorf("%s is undefined", config.Query)
+	}
+	return parseDecision(result.Result[0].Expressions[0].Value)
+}
+
+// parseDecision reads a decision written as an object with allow, confirm
+// and reason, a boolean allowing the call, or one of the strings allow,
+// deny and confirm
+func parseDecision(value json.RawMessage) (*policyDecision, error) {
+	var allow bool
+	if err := json.Unmarshal(value, &allow); err == nil {
+		return &policyDecision{Allow: allow}, nil
+	}
+	var word string
+	if err := json.Unmarshal(value, &word); err == nil {
+		switch word {
+		case "allow":
+			return &policyDecision{Allow: true}, nil
+		case "deny":
+			return &policyDecision{}, nil
+		case "confirm":
+			return &policyDecision{Allow: true, Confirm: true}, nil
+		}
+		return nil, fmt.Errorf("unknown decision %q, use allow, deny or confirm", word)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, errors.New("the decision must be an object, a boolean or a string")
+	}
+	if _, ok := fields["allow"]; !ok {
+		return nil, errors.New("the decision has no allow field")
+	}
+	var decision policyDecision
+	if err := json.Unmarshal(value, &decision); err != nil {
+		return nil, fmt.Errorf("invalid decision: %v", err)
+	}
+	return &decision, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// launcherVMNameLabel is set by KubeVirt on virt-launcher pods to the VMI name
+const launcherVMNameLabel = "vm.kubevirt.io/name"
+
+// PriorityReportParams represents the parameters for the VM priority report
+type PriorityReportParams struct {
+	Namespace     string `json:"namespace,omitempty"`
+	AllNamespaces bool   `json:"all_namespaces,omitempty"`
+	PriorityClass string `json:"priority_class,omitempty"`
+	CPU           string `json:"cpu,omitempty"`
+	Memory        string `json:"memory,omitempty"`
+	Format        string `json:"format,omitempty"`
+}
+
+// PriorityClassInfo describes a PriorityClass
+type PriorityClassInfo struct {
+	Name             string `json:"name"`
+	Value            int    `json:"value"`
+	GlobalDefault    bool   `json:"globalDefault,omitempty"`
+	PreemptionPolicy string `json:"preemptionPolicy,omitempty"`
+	VMs              int    `json:"vms"`
+}
+
+// VMPriority reports the scheduling priority of a running VM
+type VMPriority struct {
+	Namespace     string `json:"namespace"`
+	Name          string `json:"name"`
+	Node          string `json:"node,omitempty"`
+	PriorityClass string `json:"priorityClass,omitempty"`
+	Priority      int    `json:"priority"`
+}
+
+// PreemptionVictim is a pod that would be evicted to make room
+type PreemptionVictim struct {
+	Namespace string  `json:"namespace"`
+	Pod       string  `json:"pod"`
+	VM        string  `json:"vm,omitempty"`
+	Priority  int     `json:"priority"`
+	CPU       float64 `json:"cpu"`
+	MemoryMiB float64 `json:"memoryMiB"`
+}
+
+// NodePreemption is the simulated preemption outcome on one node
+type NodePreemption struct {
+	Node          string             `json:"node"`
+	FreeCPU       float64            `json:"freeCPU"`
+	FreeMemoryMiB float64            `json:"freeMemoryMiB"`
+	FitsWithout   bool               `json:"fitsWithoutPreemption"`
+	Feasible      bool               `json:"feasible"`
+	Victims       []PreemptionVictim `json:"victims,omitempty"`
+	VictimVMs     int                `json:"victimVMs"`
+}
+
+// PreemptionSimulation reports which VMs would be preempted for an incoming VM
+type PreemptionSimulation struct {
+	PriorityClass string           `json:"priorityClass"`
+	Priority      int              `json:"priority"`
+	CPU           float64          `json:"cpu"`
+	MemoryMiB     float64          `json:"memoryMiB"`
+	SelectedNode  string           `json:"selectedNode,omitempty"`
+	Nodes         []NodePreemption `json:"nodes"`
+	Note          string           `json:"note,omitempty"`
+}
+
+// PriorityReportResult is the vm_priority_report tool result
+type PriorityReportResult struct {
+	PriorityClasses []PriorityClassInfo   `json:"priorityClasses"`
+	VMs             []VMPriority          `json:"vms"`
+	Simulation      *PreemptionSimulation `json:"simulation,omitempty"`
+}
+
+type priorityClass struct {
+	Metadata         ObjectMeta `json:"metadata"`
+	Value            int        `json:"value"`
+	GlobalDefault    bool       `json:"globalDefault,omitempty"`
+	PreemptionPolicy string     `json:"preemptionPolicy,omitempty"`
+}
+
+type node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Unschedulable bool `json:"unschedulable,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Allocatable map[string]string `json:"allocatable,omitempty"`
+	} `json:"status"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_priority_report",
+		Description: "Report VM priority classes and simulate which VMs the scheduler would preempt to fit a new VM of a given priority, CPU and memory",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VMs to report",
+					"default":     "default",
+				},
+				"all_namespaces": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Report VMs in all namespaces",
+					"default":     false,
+				},
+				"priority_class": map[string]interface{}{
+					"type":        "string",
+					"description": "Priority class of the incoming VM to simulate; the simulation is skipped when unset",
+				},
+				"cpu": map[string]interface{}{
+					"type":        "string",
+					"description": "CPU request of the incoming VM's virt-launcher pod, e.g. 2 or 500m",
+					"default":     "1",
+				},
+				"memory": map[string]interface{}{
+					"type":        "string",
+					"description": "Memory request of the incoming VM's virt-launcher pod, e.g. 4Gi",
+					"default":     "2Gi",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handlePriorityReport,
+	})
+}
+
+// handlePriorityReport is the tools/call handler for vm_priority_report
+func handlePriorityReport(ctx context.Context, args json.RawMessage) (string, error) {
+	var params PriorityReportParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.CPU == "" {
+		params.CPU = "1"
+	}
+	if params.Memory == "" {
+		params.Memory = "2Gi"
+	}
+
+	result, err := priorityReport(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// tables renders the priority classes, VM priorities and the preemption
+// simulation as tables
+func (r *PriorityReportResult) tables() []table {
+	classes := table{
+		title:   "Priority classes",
+		headers: []string{"NAME", "VALUE", "GLOBAL DEFAULT", "PREEMPTION POLICY", "VMS"},
+	}
+	for _, class := range r.PriorityClasses {
+		classes.rows = append(classes.rows, []string{
+			class.Name, strconv.Itoa(class.Value), strconv.FormatBool(class.GlobalDefault),
+			class.PreemptionPolicy, strconv.Itoa(class.VMs),
+		})
+	}
+
+	vms := table{title: "VMs", headers: []string{"NAMESPACE", "NAME", "NODE", "PRIORITY CLASS", "PRIORITY"}}
+	for _, vm := range r.VMs {
+		vms.rows = append(vms.rows, []string{vm.Namespace, vm.Name, vm.Node, vm.PriorityClass, strconv.Itoa(vm.Priority)})
+	}
+
+	tables := []table{classes, vms}
+	if r.Simulation == nil {
+		return tables
+	}
+
+	sim := r.Simulation
+	nodes := table{
+		title:   fmt.Sprintf("Preemption simulation (%s, priority %d, %g CPU, %g MiB)", sim.PriorityClass, sim.Priority, sim.CPU, sim.MemoryMiB),
+		headers: []string{"NODE", "SELECTED", "FREE CPU", "FREE MEMORY MIB", "FITS WITHOUT PREEMPTION", "FEASIBLE", "VICTIM VMS"},
+	}
+	victims := table{title: "Preemption victims", headers: []string{"NODE", "NAMESPACE", "POD", "VM", "PRIORITY", "CPU", "MEMORY MIB"}}
+	for _, n := range sim.Nodes {
+		nodes.rows = append(nodes.rows, []string{
+			n.Node, strconv.FormatBool(n.Node == sim.SelectedNode),
+			strconv.FormatFloat(n.FreeCPU, 'g', -1, 64), strconv.FormatFloat(n.FreeMemoryMiB, 'g', -1, 64),
+			strconv.FormatBool(n.FitsWithout), strconv.FormatBool(n.Feasible), strconv.Itoa(n.VictimVMs),
+		})
+		for _, v := range n.Victims {
+			victims.rows = append(victims.rows, []string{
+				n.Node, v.Namespace, v.Pod, v.VM, strconv.Itoa(v.Priority),
+				strconv.FormatFloat(v.CPU, 'g', -1, 64), strconv.FormatFloat(v.MemoryMiB, 'g', -1, 64),
+			})
+		}
+	}
+	tables = append(tables, nodes, victims)
+	if sim.Note != "" {
+		tables = append(tables, table{title: "Note", headers: []string{"NOTE"}, rows: [][]string{{sim.Note}}})
+	}
+	return tables
+}
+
+// priorityReport lists VM priorities and optionally simulates preemption
+func priorityReport(ctx context.Context, params PriorityReportParams) (*PriorityReportResult, error) {
+	var classes struct {
+		Items []priorityClass `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &classes, "get", "priorityclasses"); err != nil {
+		return nil, err
+	}
+	classValues := map[string]priorityClass{}
+	defaultPriority := 0
+	for _, class := range classes.Items {
+		classValues[class.Metadata.Name] = class
+		if class.GlobalDefault {
+			defaultPriority = class.Value
+		}
+	}
+
+	var vmis VirtualMachineInstanceList
+	if err := runKubectlJSON(ctx, &vmis, append([]string{"get", "virtualmachineinstances"}, namespaceArgs(params.Namespace, params.AllNamespaces)...)...); err != nil {
+		return nil, err
+	}
+
+	result := &PriorityReportResult{VMs: []VMPriority{}}
+	vmCount := map[string]int{}
+	for _, vmi := range vmis.Items {
+		entry := VMPriority{
+			Namespace:     vmi.Metadata.Namespace,
+			Name:          vmi.Metadata.Name,
+			Node:          vmi.Status.NodeName,
+			PriorityClass: vmi.Spec.PriorityClassName,
+			Priority:      defaultPriority,
+		}
+		if class, ok := classValues[entry.PriorityClass]; ok {
+			entry.Priority = class.Value
+		}
+		vmCount[entry.PriorityClass]++
+		result.VMs = append(result.VMs, entry)
+	}
+	sort.Slice(result.VMs, func(i, j int) bool {
+		if result.VMs[i].Priority != result.VMs[j].Priority {
+			return result.VMs[i].Priority > result.VMs[j].Priority
+		}
+		return result.VMs[i].Namespace+"/"+result.VMs[i].Name < result.VMs[j].Namespace+"/"+result.VMs[j].Name
+	})
+
+	for _, class := range classes.Items {
+		result.PriorityClasses = append(result.PriorityClasses, PriorityClassInfo{
+			Name:             class.Metadata.Name,
+			Value:            class.Value,
+			GlobalDefault:    class.GlobalDefault,
+			PreemptionPolicy: class.PreemptionPolicy,
+			VMs:              vmCount[class.Metadata.Name],
+		})
+	}
+	sort.Slice(result.PriorityClasses, func(i, j int) bool {
+		return result.PriorityClasses[i].Value > result.PriorityClasses[j].Value
+	})
+
+	if params.PriorityClass != "" {
+		class, ok := classValues[params.PriorityClass]
+		if !ok {
+			return nil, &invalidParamsError{err: fmt.Errorf("priority class '%s' not found", params.PriorityClass)}
+		}
+		simulation, err := simulatePreemption(ctx, params, class)
+		if err != nil {
+			return nil, err
+		}
+		result.Simulation = simulation
+	}
+
+	return result, nil
+}
+
+// simulatePreemption mimics the scheduler's preemption for a pod with the
+// given priority and requests: on each node all lower priority pods are
+// removed, then reprieved from the highest priority down while the incoming
+// pod still fits. The node with the lowest highest-victim priority, then the
+// fewest victims, is selected. Affinity, taints and PodDisruptionBudgets are
+// not taken into account.
+func simulatePreemption(ctx context.Context, params PriorityReportParams, class priorityClass) (*PreemptionSimulation, error) {
+	cpu, ok := parseQuantity(params.CPU)
+	if !ok {
+		return nil, &invalidParamsError{err: fmt.Errorf("invalid cpu quantity '%s'", params.CPU)}
+	}
+	memory, ok := parseQuantity(params.Memory)
+	if !ok {
+		return nil, &invalidParamsError{err: fmt.Errorf("invalid memory quantity '%s'", params.Memory)}
+	}
+
+	var nodes struct {
+		Items []node `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &nodes, "get", "nodes"); err != nil {
+		return nil, err
+	}
+	var pods PodList
+	if err := runKubectlJSON(ctx, &pods, "get", "pods", "--all-namespaces"); err != nil {
+		return nil, err
+	}
+
+	podsByNode := map[string][]Pod{}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+			continue
+		}
+		podsByNode[pod.Spec.NodeName] = append(podsByNode[pod.Spec.NodeName], pod)
+	}
+
+	simulation := &PreemptionSimulation{
+		PriorityClass: class.Metadata.Name,
+		Priority:      class.Value,
+		CPU:           cpu,
+		MemoryMiB:     round2(memory / (1 << 20)),
+	}
+	preempts := class.PreemptionPolicy != "Never"
+	if !preempts {
+		simulation.Note = "priority class has preemptionPolicy Never, the VM waits for resources instead of preempting"
+	}
+
+	for _, n := range nodes.Items {
+		if n.Spec.Unschedulable {
+			continue
+		}
+		allocCPU, _ := parseQuantity(n.Status.Allocatable["cpu"])
+		allocMemory, _ := parseQuantity(n.Status.Allocatable["memory"])
+
+		freeCPU, freeMemory := allocCPU, allocMemory
+		var candidates []Pod
+		for _, pod := range podsByNode[n.Metadata.Name] {
+			podCPU, podMemory := pod.podRequests()
+			freeCPU -= podCPU
+			freeMemory -= podMemory
+			if podPriority(pod) < class.Value {
+				candidates = append(candidates, pod)
+			}
+		}
+
+		result := NodePreemption{
+			Node:          n.Metadata.Name,
+			FreeCPU:       round2(freeCPU),
+			FreeMemoryMiB: round2(freeMemory / (1 << 20)),
+			FitsWithout:   freeCPU >= cpu && freeMemory >= memory,
+		}
+		result.Feasible = result.FitsWithout
+		if !result.FitsWithout && preempts {
+			result.Feasible, result.Victims = selectVictims(candidates, freeCPU, freeMemory, cpu, memory)
+			for _, victim := range result.Victims {
+				if victim.VM != "" {
+					result.VictimVMs++
+				}
+			}
+		}
+		simulation.Nodes = append(simulation.Nodes, result)
+	}
+
+	sort.Slice(simulation.Nodes, func(i, j int) bool {
+		a, b := simulation.Nodes[i], simulation.Nodes[j]
+		if a.Feasible != b.Feasible {
+			return a.Feasible
+		}
+		if a.FitsWithout != b.FitsWithout {
+			return a.FitsWithout
+		}
+		if highestVictimPriority(a) != highestVictimPriority(b) {
+			return highestVictimPriority(a) < highestVictimPriority(b)
+		}
+		return len(a.Victims) < len(b.Victims)
+	})
+	if len(simulation.Nodes) > 0 && simulation.Nodes[0].Feasible {
+		simulation.SelectedNode = simulation.Nodes[0].Node
+	} else if simulation.Note == "" {
+		simulation.Note = "the VM does not fit on any node even after preempting all lower priority pods"
+	}
+
+	return simulation, nil
+}
+
+// selectVictims returns the minimal set of lower priority pods to evict so
+// the requested resources fit, following the scheduler's reprieve order
+func selectVictims(candidates []Pod, freeCPU, freeMemory, cpu, memory float64) (bool, []PreemptionVictim) {
+	for _, pod := range candidates {
+		podCPU, podMemory := pod.podRequests()
+		freeCPU += podCPU
+		freeMemory += podMemory
+	}
+	if freeCPU < cpu || freeMemory < memory {
+		return false, nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return podPriority(candidates[i]) > podPriority(candidates[j])
+	})
+
+	var victims []PreemptionVictim
+	for _, pod := range candidates {
+		podCPU, podMemory := pod.podRequests()
+		if freeCPU-podCPU >= cpu && freeMemory-podMemory >= memory {
+			// Reprieved, the incoming pod still fits with this one running
+			freeCPU -= podCPU
+			freeMemory -= podMemory
+			continue
+		}
+		victims = append(victims, PreemptionVictim{
+			Namespace: pod.Metadata.Namespace,
+			Pod:       pod.Metadata.Name,
+			VM:        pod.Metadata.Labels[launcherVMNameLabel],
+			Priority:  podPriority(pod),
+			CPU:       round2(podCPU),
+			MemoryMiB: round2(podMemory / (1 << 20)),
+		})
+	}
+	return true, victims
+}
+
+// podPriority returns the priority admitted into the pod spec
+func podPriority(pod Pod) int {
+	if pod.Spec.Priority == nil {
+		return 0
+	}
+	return *pod.Spec.Priority
+}
+
+// highestVictimPriority is the scheduler's first criterion to pick a node
+func highestVictimPriority(n NodePreemption) int {
+	highest := -1 << 31
+	for _, victim := range n.Victims {
+		if victim.Priority > highest {
+			highest = victim.Priority
+		}
+	}
+	return highest
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vmExecProgressPrefix marks the progress lines vm-exec --progress writes to stderr
+const vmExecProgressPrefix = "vm-exec-progress: "
+
+type progressKey struct{}
+
+// progressReporter sends notifications/progress for the progressToken a
+// client passed in the _meta of a request
+type progressReporter struct {
+	conn     *rpcWriter
+	mu       sync.Mutex
+	token    interface{}
+	progress int
+}
+
+// withProgress returns a context reporting progress for the token. A nil
+// token, i.e. a client not asking for progress, disables reporting.
+func withProgress(ctx context.Context, token interface{}) context.Context {
+	if token == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, progressKey{}, &progressReporter{conn: requestConn(ctx), token: token})
+}
+
+// progressEnabled reports whether the client asked for progress notifications
+func progressEnabled(ctx context.Context) bool {
+	_, ok := ctx.Value(progressKey{}).(*progressReporter)
+	return ok
+}
+
+// reportProgress sends a progress update with a human readable message. The
+// total is unknown, so progress is a counter increasing with every update.
+func reportProgress(ctx context.Context, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logMessage(LogDebug, "progress", "%s", message)
+
+	reporter, ok := ctx.Value(progressKey{}).(*progressReporter)
+	if !ok {
+		return
+	}
+
+	reporter.mu.Lock()
+	reporter.progress++
+	progress := reporter.progress
+	reporter.mu.Unlock()
+
+	notify(reporter.conn, "notifications/progress", map[string]interface{}{
+		"progressToken": reporter.token,
+		"progress":      progress,
+		"message":       message,
+	})
+}
+
+// lockedBuffer is a bytes.Buffer shared by the stdout and stderr of a command
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// vmExecProgressWriter turns the progress lines of vm-exec stderr into
+// progress notifications, when ctx is set, and passes everything else to
+// output. The phases also time the connections to the guest.
+type vmExecProgressWriter struct {
+	ctx     context.Context
+	output  *lockedBuffer
+	pending []byte
+
+	// connecting is the method of the connection in progress, since
+	// connectStart
+	connecting   string
+	connectStart time.Time
+
+	// span is the span of the vm-exec run, step the span of its current
+	// phase
+	span *traceSpan
+	step *traceSpan
+}
+
+func (w *vmExecProgressWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.pending[:i+1])
+		w.pending = w.pending[i+1:]
+		if strings.HasPrefix(line, vmExecProgressPrefix) {
+			phase := strings.TrimSpace(strings.TrimPrefix(line, vmExecProgressPrefix))
+			w.phase(phase)
+			if w.ctx != nil {
+				reportProgress(w.ctx, "%s", phase)
+			}
+			continue
+		}
+		w.output.Write([]byte(line))
+	}
+	return len(p), nil
+}
+
+// phase starts the span of a phase, and observes the connect latency when
+// the phase following a connection attempt shows it succeeded; a failed
+// attempt is followed by a retry or another connection
+func (w *vmExecProgressWriter) phase(phase string) {
+	w.step.end(nil)
+	w.step = w.span.child("vm-exec " + vmExecStep(phase))
+	w.step.setAttribute("vm_exec.phase", phase)
+
+	if w.connecting != "" && !strings.HasPrefix(phase, "connecting to ") && !strings.HasPrefix(phase, "console attempt ") {
+		consoleConnectDuration.observe(clock.Now().Sub(w.connectStart), w.connecting)
+	}
+	w.connecting = ""
+	switch {
+	case strings.HasPrefix(phase, "connecting to console"):
+		w.connecting, w.connectStart = "console", clock.Now()
+	case strings.HasPrefix(phase, "connecting to ssh"):
+		w.connecting, w.connectStart = "ssh", clock.Now()
+	}
+}
+
+// endPhase ends the span of the last phase with the result of vm-exec
+func (w *vmExecProgressWriter) endPhase(err error) {
+	w.step.end(err)
+}
+
+// flush passes a trailing line without newline to output
+func (w *vmExecProgressWriter) flush() {
+	w.output.Write(w.pending)
+	w.pending = nil
+}
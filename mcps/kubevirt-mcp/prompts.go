@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PromptArgument is an argument of a prompt as advertised by prompts/list
+type PromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// promptStep is one step of a playbook, calling tool. Steps whose tool is
+// disabled are left out of the rendered prompt.
+type promptStep struct {
+	tool string
+	text string
+}
+
+// Prompt is a troubleshooting playbook exposed via prompts/list and
+// rendered via prompts/get. {argument} placeholders in the intro, steps and
+// outro are replaced by the argument values.
+type Prompt struct {
+	Name        string
+	Description string
+	Arguments   []PromptArgument
+	intro       string
+	steps       []promptStep
+	outro       string
+}
+
+// registeredPrompts holds the prompts in registration order
+var registeredPrompts []Prompt
+
+// registerPrompt adds a prompt to the registry. It is meant to be called from init().
+func registerPrompt(prompt Prompt) {
+	registeredPrompts = append(registeredPrompts, prompt)
+}
+
+var (
+	vmNameArgument = PromptArgument{Name: "vm_name", Description: "Name of the VM", Required: true}
+	// namespaceArgument is optional, the playbooks default to "default"
+	namespaceArgument = PromptArgument{Name: "namespace", Description: "Kubernetes namespace, default \"default\""}
+)
+
+func init() {
+	registerPrompt(Prompt{
+		Name:        "diagnose_vm_boot",
+		Description: "Find out why a VM does not start or boot, from scheduling to the guest OS",
+		Arguments:   []PromptArgument{vmNameArgument, namespaceArgument},
+		intro:       "VM {vm_name} in namespace {namespace} does not boot. Find the root cause with the kubevirt-mcp tools, following these steps and stopping once the cause is clear:",
+		steps: []promptStep{
+			{"vm_info", "Call vm_info (vm_name: {vm_name}, namespace: {namespace}) for the VM status, run strategy, conditions and node."},
+			{"vm_events", "Call vm_events (vm_name: {vm_name}, namespace: {namespace}, type: Warning) for scheduling, image pull, volume and admission errors."},
+			{"vm_history", "Call vm_history (vm_name: {vm_name}, namespace: {namespace}) to see whether the VM ever ran and how it stopped."},
+			{"vm_launcher_logs", "If a virt-launcher pod exists, call vm_launcher_logs (vm_name: {vm_name}, namespace: {namespace}) and look for libvirt and QEMU errors."},
+			{"vm_console_log", "If the VMI is Running, call vm_console_log (vm_name: {vm_name}, namespace: {namespace}) to see how far the guest got: bootloader, kernel panic, cloud-init or login prompt."},
+			{"kubevirt_health", "If nothing points at the VM itself, call kubevirt_health to rule out a broken KubeVirt control plane."},
+			{"kubevirt_webhooks", "If creating or starting the VM failed with a webhook or \"context deadline exceeded\" error, call kubevirt_webhooks."},
+		},
+		outro: "Report the root cause, the evidence for it and the fix. Do not change or restart the VM without asking.",
+	})
+
+	registerPrompt(Prompt{
+		Name:        "diagnose_migration",
+		Description: "Find out why a live migration of a VM fails or does not converge",
+		Arguments:   []PromptArgument{vmNameArgument, namespaceArgument},
+		intro:       "Live migration of VM {vm_name} in namespace {namespace} fails or does not finish. Find out why with the kubevirt-mcp tools:",
+		steps: []promptStep{
+			{"vmi_migration_status", "Call vmi_migration_status (vm_name: {vm_name}, namespace: {namespace}) for the phase, source and target nodes and failure reason of the latest migrations."},
+			{"vm_info", "Call vm_info (vm_name: {vm_name}, namespace: {namespace}) and check the LiveMigratable condition, e.g. RWO volumes, host devices or bridge interfaces."},
+			{"vm_events", "Call vm_events (vm_name: {vm_name}, namespace: {namespace}) for migration and target pod scheduling events."},
+			{"vm_launcher_logs", "Call vm_launcher_logs (vm_name: {vm_name}, namespace: {namespace}) and look for the migration progress, dirty rate and QEMU errors."},
+			{"kubevirt_health", "Call kubevirt_health to check that virt-handler runs on the source and target nodes."},
+		},
+		outro: "Report why the migration fails, and whether it is a VM, node or cluster configuration problem. Only start a new migration, e.g. with vmi_migrate or vmi_migration_ping, after asking.",
+	})
+
+	registerPrompt(Prompt{
+		Name:        "diagnose_console_access",
+		Description: "Find out why the serial console, VNC or other VM subresources cannot be reached",
+		Arguments:   []PromptArgument{vmNameArgument, namespaceArgument},
+		intro:       "The console of VM {vm_name} in namespace {namespace} cannot be opened. Find out why with the kubevirt-mcp tools:",
+		steps: []promptStep{
+			{"vm_info", "Call vm_info (vm_name: {vm_name}, namespace: {namespace}) to check that the VMI is Running and not paused."},
+			{"vm_console_links", "Call vm_console_links (vm_name: {vm_name}, namespace: {namespace}) to check the console endpoints."},
+			{"kubevirt_webhooks", "Call kubevirt_webhooks and check that the v1.subresources.kubevirt.io APIService is available and virt-api has ready endpoints."},
+			{"kubevirt_certs", "Call kubevirt_certs for expired or untrusted virt-api and virt-handler certificates."},
+			{"vm_console_log", "Call vm_console_log (vm_name: {vm_name}, namespace: {namespace}) to tell a broken console path from a guest that writes nothing to the serial port."},
+		},
+		outro: "Report where the console path is broken: VM, virt-handler, virt-api, certificates or the guest.",
+	})
+
+	registerPrompt(Prompt{
+		Name:        "support_bundle",
+		Description: "Collect the KubeVirt control plane state and the state of the VMs of a namespace into a support report",
+		Arguments:   []PromptArgument{{Name: "namespace", Description: "Namespace of the VMs to collect", Required: true}},
+		intro:       "Collect a support bundle for the VMs of namespace {namespace} with the kubevirt-mcp tools. Only read, do not change anything:",
+		steps: []promptStep{
+			{"kubevirt_health", "Call kubevirt_health for the KubeVirt version, control plane readiness and warning events."},
+			{"kubevirt_config", "Call kubevirt_config for the feature gates and configuration."},
+			{"kubevirt_certs", "Call kubevirt_certs for the certificate state."},
+			{"kubevirt_webhooks", "Call kubevirt_webhooks (samples: 1) for the webhooks and the aggregated API."},
+			{"vm_list", "Call vm_list (namespace: {namespace}) for the VMs and their status."},
+			{"vm_info", "For every VM that is not Running, call vm_info (namespace: {namespace})."},
+			{"vm_events", "For the same VMs, call vm_events (namespace: {namespace}, type: Warning)."},
+			{"vm_launcher_logs", "For VMs with a failed or crash looping virt-launcher pod, call vm_launcher_logs (namespace: {namespace}, tail_lines: 200)."},
+			{"dv_list", "Call dv_list (namespace: {namespace}) for the DataVolumes and their import progress."},
+		},
+		outro: "Write the bundle as a report with a summary of the problems found first, then one section per step with the relevant output. Leave out healthy details that do not help support.",
+	})
+}
+
+// listPrompts returns the prompt definitions in the shape expected by
+// prompts/list
+func listPrompts() []map[string]interface{} {
+	definitions := make([]map[string]interface{}, 0, len(registeredPrompts))
+	for _, prompt := range registeredPrompts {
+		definitions = append(definitions, map[string]interface{}{
+			"name":        prompt.Name,
+			"description": prompt.Description,
+			"arguments":   prompt.Arguments,
+		})
+	}
+	return definitions
+}
+
+// getPrompt renders a prompt with its arguments for prompts/get
+func getPrompt(name string, args map[string]string) (map[string]interface{}, error) {
+	var prompt *Prompt
+	for i := range registeredPrompts {
+		if registeredPrompts[i].Name == name {
+			prompt = &registeredPrompts[i]
+		}
+	}
+	if prompt == nil {
+		return nil, &invalidParamsError{err: fmt.Errorf("unknown prompt %s", name)}
+	}
+
+	var replacements []string
+	for _, arg := range prompt.Arguments {
+		value := args[arg.Name]
+		if value == "" && arg.Required {
+			return nil, missingArgument(arg.Name)
+		}
+		if value == "" && arg.Name == "namespace" {
+			value = "default"
+		}
+		replacements = append(replacements, "{"+arg.Name+"}", value)
+	}
+	replacer := strings.NewReplacer(replacements...)
+
+	var text strings.Builder
+	text.WriteString(replacer.Replace(prompt.intro) + "\n\n")
+	step := 0
+	for _, s := range prompt.steps {
+		if _, ok := lookupTool(s.tool); !ok {
+			continue
+		}
+		step++
+		fmt.Fprintf(&text, "%d. %s\n", step, replacer.Replace(s.text))
+	}
+	text.WriteString("\n" + replacer.Replace(prompt.outro))
+
+	return map[string]interface{}{
+		"description": prompt.Description,
+		"messages": []map[string]interface{}{
+			{"role": "user", "content": map[string]interface{}{"type": "text", "text": text.String()}},
+		},
+	}, nil
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultCPUAllocationRatio is the KubeVirt default of vCPUs per
+	// requested CPU when the VM does not request CPU itself
+	defaultCPUAllocationRatio = 10
+	// defaultAutoMemoryLimitsRatio is the memory limit to request ratio
+	// KubeVirt uses when it sets limits because a quota requires them
+	defaultAutoMemoryLimitsRatio = 2
+	// autoMemoryLimitsRatioLabel overrides that ratio per namespace
+	autoMemoryLimitsRatioLabel = "alpha.kubevirt.io/auto-memory-limits-ratio"
+)
+
+// QuotaCheckParams represents the parameters of vm_quota_check
+type QuotaCheckParams struct {
+	Namespace string          `json:"namespace,omitempty"`
+	VMName    string          `json:"vm_name,omitempty"`
+	VM        json.RawMessage `json:"vm,omitempty"`
+	OS        string          `json:"os,omitempty"`
+	CPU       int             `json:"cpu,omitempty"`
+	Memory    string          `json:"memory,omitempty"`
+	Count     int             `json:"count,omitempty"`
+	Format    string          `json:"format,omitempty"`
+}
+
+// LauncherResources is the estimated footprint of a VM's virt-launcher pod
+// and volumes, which is what quotas and limit ranges are enforced on
+type LauncherResources struct {
+	VCPUs          int    `json:"vcpus"`
+	GuestMemory    string `json:"guestMemory"`
+	MemoryOverhead string `json:"memoryOverhead"`
+	RequestsCPU    string `json:"requestsCPU"`
+	RequestsMemory string `json:"requestsMemory"`
+	LimitsCPU      string `json:"limitsCPU,omitempty"`
+	LimitsMemory   string `json:"limitsMemory,omitempty"`
+	LimitsSource   string `json:"limitsSource,omitempty"`
+	Storage        string `json:"storage,omitempty"`
+	Volumes        int    `json:"volumes,omitempty"`
+}
+
+// QuotaCheck is the outcome of one quota or limit range constraint
+type QuotaCheck struct {
+	Source    string `json:"source"`
+	Resource  string `json:"resource"`
+	Requested string `json:"requested"`
+	Used      string `json:"used,omitempty"`
+	Limit     string `json:"limit"`
+	OK        bool   `json:"ok"`
+	Message   string `json:"message,omitempty"`
+}
+
+// QuotaCheckResult is the vm_quota_check tool result
+type QuotaCheckResult struct {
+	Namespace  string            `json:"namespace"`
+	VM         string            `json:"vm"`
+	Count      int               `json:"count"`
+	Launcher   LauncherResources `json:"launcher"`
+	Allowed    bool              `json:"allowed"`
+	Rejections []string          `json:"rejections,omitempty"`
+	Checks     []QuotaCheck      `json:"checks"`
+	Notes      []string          `json:"notes,omitempty"`
+}
+
+// quotaVM holds the fields of a VirtualMachine that size its launcher pod
+// and volumes
+type quotaVM struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		DataVolumeTemplates []struct {
+			Metadata ObjectMeta     `json:"metadata"`
+			Spec     dataVolumeSpec `json:"spec"`
+		} `json:"dataVolumeTemplates,omitempty"`
+		Template struct {
+			Spec launcherSpec `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+}
+
+// dataVolumeSpec holds the size and storage class of a DataVolume, given
+// in spec.storage or the older spec.pvc
+type dataVolumeSpec struct {
+	Storage *dataVolumeClaim `json:"storage,omitempty"`
+	PVC     *dataVolumeClaim `json:"pvc,omitempty"`
+}
+
+type dataVolumeClaim struct {
+	StorageClassName string `json:"storageClassName,omitempty"`
+	Resources        struct {
+		Requests map[string]string `json:"requests,omitempty"`
+	} `json:"resources"`
+}
+
+type resourceQuota struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Scopes        []string    `json:"scopes,omitempty"`
+		ScopeSelector interface{} `json:"scopeSelector,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Hard map[string]string `json:"hard,omitempty"`
+		Used map[string]string `json:"used,omitempty"`
+	} `json:"status"`
+}
+
+type limitRange struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Limits []struct {
+			Type                 string            `json:"type"`
+			Max                  map[string]string `json:"max,omitempty"`
+			Min                  map[string]string `json:"min,omitempty"`
+			Default              map[string]string `json:"default,omitempty"`
+			MaxLimitRequestRatio map[string]string `json:"maxLimitRequestRatio,omitempty"`
+		} `json:"limits"`
+	} `json:"spec"`
+}
+
+// launcherDemand is what one VM adds to the quota resources, in cores,
+// bytes and object counts
+type launcherDemand struct {
+	cpu, memory           float64
+	limitCPU, limitMemory float64
+	storage               float64
+	storageByClass        map[string]float64
+	volumes               int
+	newVM                 bool
+}
+
+func init() {
+	flavors := make([]string, 0, len(vmTemplates))
+	for flavor := range vmTemplates {
+		flavors = append(flavors, flavor)
+	}
+	sort.Strings(flavors)
+
+	registerTool(Tool{
+		Name:        "vm_quota_check",
+		Description: "Before creating or starting a VM, check it against the ResourceQuotas and LimitRanges of its namespace and report whether it will be rejected and why. The virt-launcher pod is sized with KubeVirt's memory overhead and CPU allocation ratio, so a VM that fits on paper but not with its overhead is caught",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of an existing, e.g. stopped, VM to check before starting it",
+				},
+				"vm": map[string]interface{}{
+					"type":        "object",
+					"description": "VirtualMachine manifest to check before creating it",
+				},
+				"os": map[string]interface{}{
+					"type":        "string",
+					"description": "Without vm_name or vm, the vm_create flavor to check",
+					"enum":        flavors,
+					"default":     defaultVMCreateOS,
+				},
+				"cpu": map[string]interface{}{
+					"type":        "integer",
+					"description": "Without vm_name or vm, the vm_create CPU cores",
+					"default":     1,
+				},
+				"memory": map[string]interface{}{
+					"type":        "string",
+					"description": "Without vm_name or vm, the vm_create memory, defaults to the flavor's",
+				},
+				"count": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of such VMs to fit, e.g. for vm_create_many",
+					"default":     1,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleQuotaCheck,
+	})
+}
+
+// handleQuotaCheck is the tools/call handler for vm_quota_check
+func handleQuotaCheck(ctx context.Context, args json.RawMessage) (string, error) {
+	var params QuotaCheckParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.VMName != "" && len(params.VM) > 0 {
+		return "", &invalidParamsError{err: errors.New("vm_name and vm are mutually exclusive")}
+	}
+	if params.Count < 0 {
+		return "", &invalidParamsError{err: errors.New("count must be positive")}
+	}
+	if params.Count == 0 {
+		params.Count = 1
+	}
+	if params.CPU < 0 {
+		return "", &invalidParamsError{err: errors.New("cpu must be positive")}
+	}
+	if params.Memory != "" {
+		if _, ok := parseQuantity(params.Memory); !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid memory %q", params.Memory)}
+		}
+	}
+	if params.OS == "" {
+		params.OS = defaultVMCreateOS
+	}
+	if _, ok := vmTemplates[params.OS]; !ok {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown os %q", params.OS)}
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	result, err := checkQuota(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// checkQuota sizes the VM's launcher pod and evaluates it against the
+// namespace quotas and limit ranges
+func checkQuota(ctx context.Context, params QuotaCheckParams) (*QuotaCheckResult, error) {
+	vm, label, newVM, err := quotaCheckVM(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	result := &QuotaCheckResult{Namespace: params.Namespace, VM: label, Count: params.Count, Checks: []QuotaCheck{}}
+
+	settings, err := readOverheadSettings(ctx)
+	if err != nil {
+		result.Notes = append(result.Notes, "KubeVirt CR not readable, default overhead and CPU allocation ratio assumed")
+	}
+
+	reportProgress(ctx, "reading quotas and limit ranges of %s", params.Namespace)
+	var quotas struct {
+		Items []resourceQuota `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &quotas, "get", "resourcequotas", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	var limitRanges struct {
+		Items []limitRange `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &limitRanges, "get", "limitranges", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	var namespace struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	if err := runKubectlJSON(ctx, &namespace, "get", "namespace", params.Namespace); err != nil {
+		return nil, err
+	}
+
+	demand := launcherDemandOf(vm, settings, &result.Launcher)
+	demand.newVM = newVM
+	applyLimits(&demand, &result.Launcher, quotas.Items, limitRanges.Items, namespace.Metadata.Labels)
+
+	for _, lr := range limitRanges.Items {
+		result.Checks = append(result.Checks, checkLimitRange(lr, demand)...)
+	}
+	for _, quota := range quotas.Items {
+		checks, notes := checkResourceQuota(quota, demand, params.Count)
+		result.Checks = append(result.Checks, checks...)
+		result.Notes = append(result.Notes, notes...)
+	}
+
+	for _, check := range result.Checks {
+		if !check.OK {
+			result.Rejections = append(result.Rejections, fmt.Sprintf("%s: %s", check.Source, check.Message))
+		}
+	}
+	result.Allowed = len(result.Rejections) == 0
+	vmRejected := false
+	for _, check := range result.Checks {
+		vmRejected = vmRejected || (!check.OK && check.Resource == "count/virtualmachines.kubevirt.io")
+	}
+	switch {
+	case vmRejected:
+		result.Notes = append(result.Notes, "the VM create itself is rejected by the quota")
+	case !result.Allowed && newVM:
+		result.Notes = append(result.Notes, "the VM is created, but its virt-launcher pod or volumes are rejected and it stays Stopped or Starting with FailedCreate events")
+	case !result.Allowed:
+		result.Notes = append(result.Notes, "starting the VM creates a VMI whose virt-launcher pod is rejected, see the VM's FailedCreate events")
+	}
+	if len(quotas.Items) == 0 && len(limitRanges.Items) == 0 {
+		result.Notes = append(result.Notes, "namespace has no ResourceQuota or LimitRange")
+	}
+	return result, nil
+}
+
+// quotaCheckVM returns the VM to check, a label for it and whether it is a
+// new VM that counts against VM quotas
+func quotaCheckVM(ctx context.Context, params QuotaCheckParams) (*quotaVM, string, bool, error) {
+	var vm quotaVM
+	switch {
+	case len(params.VM) > 0:
+		if err := json.Unmarshal(params.VM, &vm); err != nil {
+			return nil, "", false, &invalidParamsError{err: fmt.Errorf("vm is not a valid manifest: %v", err)}
+		}
+		return &vm, vm.Metadata.Name, true, nil
+	case params.VMName != "":
+		if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+			return nil, "", false, err
+		}
+		return &vm, params.VMName, false, nil
+	}
+
+	manifest, err := json.Marshal(vmCreateManifest(VMCreateParams{Name: "quota-check", Namespace: params.Namespace, OS: params.OS, CPU: max(params.CPU, 1), Memory: params.Memory}, vmTemplates[params.OS]))
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := json.Unmarshal(manifest, &vm); err != nil {
+		return nil, "", false, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &vm, "vm_create os=" + params.OS, true, nil
+}
+
+// launcherDemandOf estimates the virt-launcher pod requests like
+// virt-controller renders them: the guest memory plus KubeVirt's memory
+// overhead, and vCPUs divided by the CPU allocation ratio unless the VM
+// requests CPU itself
+func launcherDemandOf(vm *quotaVM, settings overheadSettings, launcher *LauncherResources) launcherDemand {
+	spec := &vm.Spec.Template.Spec
+	domain := spec.Domain
+	architecture := settings.architecture
+	if spec.Architecture != "" {
+		architecture = spec.Architecture
+	}
+	vcpus := vcpusOf(spec)
+	guest := guestMemory(spec)
+	overhead, _ := memoryOverhead(spec, architecture, settings.overheadRatio)
+
+	demand := launcherDemand{memory: launcherMemoryRequest(spec, overhead), cpu: float64(vcpus) / settings.cpuAllocationRatio, storageByClass: map[string]float64{}}
+	if request, ok := parseQuantity(domain.Resources.Requests["cpu"]); ok {
+		demand.cpu = request
+	}
+	if limit, ok := parseQuantity(domain.Resources.Limits["memory"]); ok {
+		demand.limitMemory = limit + overhead
+		launcher.LimitsSource = "VM"
+	}
+	if limit, ok := parseQuantity(domain.Resources.Limits["cpu"]); ok {
+		demand.limitCPU = limit
+		launcher.LimitsSource = "VM"
+	}
+
+	for _, dv := range vm.Spec.DataVolumeTemplates {
+		claim := dv.Spec.Storage
+		if claim == nil {
+			claim = dv.Spec.PVC
+		}
+		if claim == nil {
+			continue
+		}
+		size, _ := parseQuantity(claim.Resources.Requests["storage"])
+		demand.storage += size
+		demand.storageByClass[claim.StorageClassName] += size
+		demand.volumes++
+	}
+
+	launcher.VCPUs = vcpus
+	launcher.GuestMemory = humanBytes(int64(guest))
+	launcher.MemoryOverhead = humanBytes(int64(overhead))
+	launcher.RequestsCPU = formatCPU(demand.cpu)
+	launcher.RequestsMemory = humanBytes(int64(demand.memory))
+	if demand.storage > 0 {
+		launcher.Storage = humanBytes(int64(demand.storage))
+		launcher.Volumes = demand.volumes
+	}
+	return demand
+}
+
+// applyLimits fills in the limits the launcher pod gets when the VM sets
+// none: LimitRange defaults, or the limits KubeVirt sets itself when a
+// quota requires them
+func applyLimits(demand *launcherDemand, launcher *LauncherResources, quotas []resourceQuota, limitRanges []limitRange, labels map[string]string) {
+	for _, lr := range limitRanges {
+		for _, item := range lr.Spec.Limits {
+			if item.Type != "Container" {
+				continue
+			}
+			if limit, ok := parseQuantity(item.Default["memory"]); ok && demand.limitMemory == 0 {
+				demand.limitMemory = limit
+				launcher.LimitsSource = "limitrange/" + lr.Metadata.Name + " default"
+			}
+			if limit, ok := parseQuantity(item.Default["cpu"]); ok && demand.limitCPU == 0 {
+				demand.limitCPU = limit
+				launcher.LimitsSource = "limitrange/" + lr.Metadata.Name + " default"
+			}
+		}
+	}
+
+	for _, quota := range quotas {
+		if _, ok := quota.Status.Hard["limits.memory"]; ok && demand.limitMemory == 0 {
+			ratio := float64(defaultAutoMemoryLimitsRatio)
+			if value, err := strconv.ParseFloat(labels[autoMemoryLimitsRatioLabel], 64); err == nil && value >= 1 {
+				ratio = value
+			}
+			demand.limitMemory = demand.memory * ratio
+			launcher.LimitsSource = "set by KubeVirt for resourcequota/" + quota.Metadata.Name
+		}
+		if _, ok := quota.Status.Hard["limits.cpu"]; ok && demand.limitCPU == 0 {
+			demand.limitCPU = float64(launcher.VCPUs)
+			launcher.LimitsSource = "set by KubeVirt for resourcequota/" + quota.Metadata.Name
+		}
+	}
+
+	if demand.limitCPU > 0 {
+		launcher.LimitsCPU = formatCPU(demand.limitCPU)
+	}
+	if demand.limitMemory > 0 {
+		launcher.LimitsMemory = humanBytes(int64(demand.limitMemory))
+	}
+}
+
+// checkLimitRange checks the compute container and the VM's volumes against
+// the min, max and limit to request ratio constraints of a LimitRange
+func checkLimitRange(lr limitRange, demand launcherDemand) []QuotaCheck {
+	source := "limitrange/" + lr.Metadata.Name
+	var checks []QuotaCheck
+	for _, item := range lr.Spec.Limits {
+		switch item.Type {
+		case "Container", "Pod":
+			for _, resource := range []string{"cpu", "memory"} {
+				request, limit := demand.cpu, demand.limitCPU
+				format := formatCPU
+				if resource == "memory" {
+					request, limit = demand.memory, demand.limitMemory
+					format = func(v float64) string { return humanBytes(int64(v)) }
+				}
+				if minimum, ok := parseQuantity(item.Min[resource]); ok {
+					check := QuotaCheck{Source: source, Resource: item.Type + " min " + resource, Requested: format(request), Limit: item.Min[resource], OK: request >= minimum}
+					if !check.OK {
+						check.Message = fmt.Sprintf("minimum %s usage per %s is %s, but request is %s", resource, item.Type, item.Min[resource], format(request))
+					}
+					checks = append(checks, check)
+				}
+				if maximum, ok := parseQuantity(item.Max[resource]); ok {
+					check := QuotaCheck{Source: source, Resource: item.Type + " max " + resource, Requested: format(limit), Limit: item.Max[resource], OK: limit > 0 && limit <= maximum}
+					switch {
+					case limit == 0:
+						check.Requested = "no limit"
+						check.Message = fmt.Sprintf("maximum %s usage per %s is %s, no limit is specified", resource, item.Type, item.Max[resource])
+					case !check.OK:
+						check.Message = fmt.Sprintf("maximum %s usage per %s is %s, but limit is %s", resource, item.Type, item.Max[resource], format(limit))
+					}
+					checks = append(checks, check)
+				}
+				if ratio, ok := parseQuantity(item.MaxLimitRequestRatio[resource]); ok && limit > 0 && request > 0 {
+					actual := limit / request
+					check := QuotaCheck{Source: source, Resource: item.Type + " " + resource + " limit/request", Requested: strconv.FormatFloat(round2(actual), 'f', -1, 64), Limit: item.MaxLimitRequestRatio[resource], OK: actual <= ratio}
+					if !check.OK {
+						check.Message = fmt.Sprintf("%s max limit to request ratio per %s is %s, but provided ratio is %.2f", resource, item.Type, item.MaxLimitRequestRatio[resource], actual)
+					}
+					checks = append(checks, check)
+				}
+			}
+			if item.Type == "Container" && demand.limitMemory > 0 && demand.limitMemory < demand.memory {
+				checks = append(checks, QuotaCheck{
+					Source: source, Resource: "Container memory limit", Requested: humanBytes(int64(demand.memory)), Limit: humanBytes(int64(demand.limitMemory)),
+					Message: fmt.Sprintf("memory request %s with KubeVirt overhead is above the default limit %s", humanBytes(int64(demand.memory)), humanBytes(int64(demand.limitMemory))),
+				})
+			}
+		case "PersistentVolumeClaim":
+			if demand.volumes == 0 {
+				continue
+			}
+			for _, size := range demand.storageByClass {
+				if minimum, ok := parseQuantity(item.Min["storage"]); ok && size < minimum {
+					checks = append(checks, QuotaCheck{Source: source, Resource: "PersistentVolumeClaim min storage", Requested: humanBytes(int64(size)), Limit: item.Min["storage"],
+						Message: fmt.Sprintf("minimum storage usage per PersistentVolumeClaim is %s, but request is %s", item.Min["storage"], humanBytes(int64(size)))})
+				}
+				if maximum, ok := parseQuantity(item.Max["storage"]); ok && size > maximum {
+					checks = append(checks, QuotaCheck{Source: source, Resource: "PersistentVolumeClaim max storage", Requested: humanBytes(int64(size)), Limit: item.Max["storage"],
+						Message: fmt.Sprintf("maximum storage usage per PersistentVolumeClaim is %s, but request is %s", item.Max["storage"], humanBytes(int64(size)))})
+				}
+			}
+		}
+	}
+	return checks
+}
+
+// checkResourceQuota checks whether count VMs fit in the remaining quota,
+// like the quota admission plugin would for each object they create
+func checkResourceQuota(quota resourceQuota, demand launcherDemand, count int) ([]QuotaCheck, []string) {
+	source := "resourcequota/" + quota.Metadata.Name
+	var notes []string
+	if len(quota.Spec.Scopes) > 0 || quota.Spec.ScopeSelector != nil {
+		notes = append(notes, fmt.Sprintf("%s is scoped (%s), it is assumed to apply to the VM", source, strings.Join(quota.Spec.Scopes, ", ")))
+	}
+
+	n := float64(count)
+	needed := map[string]float64{
+		"pods":            n,
+		"count/pods":      n,
+		"requests.cpu":    demand.cpu * n,
+		"cpu":             demand.cpu * n,
+		"requests.memory": demand.memory * n,
+		"memory":          demand.memory * n,
+		"limits.cpu":      demand.limitCPU * n,
+		"limits.memory":   demand.limitMemory * n,
+		"count/virtualmachineinstances.kubevirt.io": n,
+	}
+	if demand.newVM {
+		needed["count/virtualmachines.kubevirt.io"] = n
+		needed["requests.storage"] = demand.storage * n
+		needed["persistentvolumeclaims"] = float64(demand.volumes) * n
+		needed["count/persistentvolumeclaims"] = float64(demand.volumes) * n
+		needed["count/datavolumes.cdi.kubevirt.io"] = float64(demand.volumes) * n
+		for class, size := range demand.storageByClass {
+			if class != "" {
+				needed[class+".storageclass.storage.k8s.io/requests.storage"] += size * n
+			}
+		}
+	}
+
+	resources := make([]string, 0, len(quota.Status.Hard))
+	for resource := range quota.Status.Hard {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	var checks []QuotaCheck
+	for _, resource := range resources {
+		want, ok := needed[resource]
+		if !ok {
+			continue
+		}
+		hard, _ := parseQuantity(quota.Status.Hard[resource])
+		used, _ := parseQuantity(quota.Status.Used[resource])
+		format := quotaFormatter(resource)
+		check := QuotaCheck{Source: source, Resource: resource, Requested: format(want), Used: format(used), Limit: quota.Status.Hard[resource], OK: used+want <= hard}
+		switch {
+		case strings.HasPrefix(resource, "limits.") && want == 0:
+			check.OK = false
+			check.Requested = "no limit"
+			check.Message = fmt.Sprintf("failed quota: %s: must specify %s", quota.Metadata.Name, resource)
+		case !check.OK:
+			check.Message = fmt.Sprintf("exceeded quota: %s, requested: %s=%s, used: %s=%s, limited: %s=%s", quota.Metadata.Name, resource, format(want), resource, format(used), resource, quota.Status.Hard[resource])
+		case resource == "requests.memory" || resource == "memory" || resource == "pods":
+			// Live migration runs a second launcher pod next to the source
+			perPod := demand.memory
+			if resource == "pods" {
+				perPod = 1
+			}
+			if used+want+perPod > hard {
+				notes = append(notes, fmt.Sprintf("%s %s has no room for a migration target pod, live migrations of the VM will be rejected", source, resource))
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks, notes
+}
+
+// quotaFormatter returns the formatter of a quota resource amount
+func quotaFormatter(resource string) func(float64) string {
+	switch {
+	case strings.HasSuffix(resource, "cpu"):
+		return formatCPU
+	case strings.HasSuffix(resource, "memory"), strings.HasSuffix(resource, "storage"):
+		return func(v float64) string { return humanBytes(int64(v)) }
+	}
+	return func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+}
+
+// formatCPU formats cores as a quantity, in millicores below one core
+func formatCPU(cores float64) string {
+	if cores == float64(int64(cores)) {
+		return strconv.FormatInt(int64(cores), 10)
+	}
+	return strconv.FormatInt(int64(cores*1000+0.5), 10) + "m"
+}
+
+// tables renders the quota check as an overview of the launcher pod
+// followed by the constraints checked
+func (r *QuotaCheckResult) tables() []table {
+	overview := table{title: "Quota check " + r.Namespace + " " + r.VM, headers: []string{"FIELD", "VALUE"}}
+	overview.rows = append(overview.rows,
+		[]string{"Allowed", strconv.FormatBool(r.Allowed)},
+		[]string{"Count", strconv.Itoa(r.Count)},
+		[]string{"vCPUs", strconv.Itoa(r.Launcher.VCPUs)},
+		[]string{"Guest memory", r.Launcher.GuestMemory},
+		[]string{"Memory overhead", r.Launcher.MemoryOverhead},
+		[]string{"Requests", "cpu=" + r.Launcher.RequestsCPU + " memory=" + r.Launcher.RequestsMemory},
+	)
+	if r.Launcher.LimitsSource != "" {
+		var limits []string
+		if r.Launcher.LimitsCPU != "" {
+			limits = append(limits, "cpu="+r.Launcher.LimitsCPU)
+		}
+		if r.Launcher.LimitsMemory != "" {
+			limits = append(limits, "memory="+r.Launcher.LimitsMemory)
+		}
+		overview.rows = append(overview.rows, []string{"Limits", fmt.Sprintf("%s (%s)", strings.Join(limits, " "), r.Launcher.LimitsSource)})
+	}
+	if r.Launcher.Storage != "" {
+		overview.rows = append(overview.rows, []string{"Storage", fmt.Sprintf("%s in %d volumes", r.Launcher.Storage, r.Launcher.Volumes)})
+	}
+	for _, rejection := range r.Rejections {
+		overview.rows = append(overview.rows, []string{"Rejection", rejection})
+	}
+	for _, note := range r.Notes {
+		overview.rows = append(overview.rows, []string{"Note", note})
+	}
+
+	checks := table{title: "Checks", headers: []string{"SOURCE", "RESOURCE", "REQUESTED", "USED", "LIMIT", "OK"}}
+	for _, c := range r.Checks {
+		checks.rows = append(checks.rows, []string{c.Source, c.Resource, c.Requested, c.Used, c.Limit, strconv.FormatBool(c.OK)})
+	}
+	return []table{overview, checks}
+}
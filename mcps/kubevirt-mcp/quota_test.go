@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		quantity string
+		want     float64
+		ok       bool
+	}{
+		{"2", 2, true},
+		{"1.5", 1.5, true},
+		{"500m", 0.5, true},
+		{"2500m", 2.5, true},
+		{"1k", 1e3, true},
+		{"1M", 1e6, true},
+		{"2G", 2e9, true},
+		{"1Ki", 1024, true},
+		{"64Mi", 64 << 20, true},
+		{"1.5Gi", 1.5 * (1 << 30), true},
+		{"2Ti", 2 << 40, true},
+		{" 4Gi ", 4 << 30, true},
+		{"", 0, false},
+		{"Gi", 0, false},
+		{"-1Gi", 0, false},
+		{"2GB", 0, false},
+		{"2gi", 0, false},
+		{"1e3", 0, false},
+		{"1.Gi", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseQuantity(tt.quantity)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseQuantity(%q) = %v, %v, want %v, %v", tt.quantity, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatCPU(t *testing.T) {
+	tests := []struct {
+		cores float64
+		want  string
+	}{
+		{0, "0"},
+		{2, "2"},
+		{0.5, "500m"},
+		{1.25, "1250m"},
+		{0.0005, "1m"},
+	}
+	for _, tt := range tests {
+		if got := formatCPU(tt.cores); got != tt.want {
+			t.Errorf("formatCPU(%v) = %q, want %q", tt.cores, got, tt.want)
+		}
+	}
+}
+
+func TestCheckResourceQuota(t *testing.T) {
+	quota := func(hard, used string) resourceQuota {
+		var q resourceQuota
+		doc := `{"metadata":{"name":"compute"},"status":{"hard":` + hard + `,"used":` + used + `}}`
+		if err := json.Unmarshal([]byte(doc), &q); err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	demand := launcherDemand{cpu: 0.5, memory: 2 << 30}
+	tests := []struct {
+		name    string
+		quota   resourceQuota
+		count   int
+		ok      []bool
+		message string
+		note    string
+	}{
+		{
+			name:  "fits with room for a migration",
+			quota: quota(`{"requests.cpu":"4","requests.memory":"16Gi"}`, `{"requests.cpu":"1","requests.memory":"4Gi"}`),
+			count: 1,
+			ok:    []bool{true, true},
+		},
+		{
+			name:    "memory exceeded",
+			quota:   quota(`{"requests.memory":"8Gi"}`, `{"requests.memory":"7Gi"}`),
+			count:   1,
+			ok:      []bool{false},
+			message: "exceeded quota: compute, requested: requests.memory=2Gi, used: requests.memory=7Gi, limited: requests.memory=8Gi",
+		},
+		{
+			name:    "exceeded by the count",
+			quota:   quota(`{"requests.cpu":"1500m"}`, `{"requests.cpu":"0"}`),
+			count:   4,
+			ok:      []bool{false},
+			message: "requested: requests.cpu=2, used: requests.cpu=0, limited: requests.cpu=1500m",
+		},
+		{
+			name:  "fits exactly, no room for a migration",
+			quota: quota(`{"memory":"4Gi"}`, `{"memory":"2Gi"}`),
+			count: 1,
+			ok:    []bool{true},
+			note:  "quota/compute memory has no room for a migration target pod",
+		},
+		{
+			name:    "limits required",
+			quota:   quota(`{"limits.memory":"32Gi"}`, `{}`),
+			count:   1,
+			ok:      []bool{false},
+			message: "failed quota: compute: must specify limits.memory",
+		},
+		{
+			name:  "unrelated resources are skipped",
+			quota: quota(`{"services":"10","pods":"10"}`, `{"pods":"3"}`),
+			count: 2,
+			ok:    []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks, notes := checkResourceQuota(tt.quota, demand, tt.count)
+			if len(checks) != len(tt.ok) {
+				t.Fatalf("checks = %+v, want %d", checks, len(tt.ok))
+			}
+			var messages []string
+			for i, check := range checks {
+				if check.OK != tt.ok[i] {
+					t.Errorf("%s OK = %v, want %v", check.Resource, check.OK, tt.ok[i])
+				}
+				messages = append(messages, check.Message)
+			}
+			if got := strings.Join(messages, "\n"); tt.message != "" && !strings.Contains(got, tt.message) || tt.message == "" && got != strings.Repeat("\n", len(checks)-1) {
+				t.Errorf("messages = %q, want %q", got, tt.message)
+			}
+			if got := strings.Join(notes, "\n"); tt.note != "" && !strings.Contains(got, tt.note) || tt.note == "" && got != "" {
+				t.Errorf("notes = %q, want %q", got, tt.note)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the maintenance window, see
+// RestartWindowConfig. Pending restarts are only applied when a window is
+// set.
+const (
+	restartWindowEnv         = "KUBEVIRT_MCP_RESTART_WINDOW"
+	restartWindowDurationEnv = "KUBEVIRT_MCP_RESTART_WINDOW_DURATION"
+
+	defaultRestartWindowDuration = time.Hour
+	minRestartWindowDuration     = time.Minute
+
+	// restartWindowCheckInterval is how often the scheduler looks for
+	// pending restarts while the window is open
+	restartWindowCheckInterval = time.Minute
+
+	// maxRecentRestarts bounds the restarts kept for the status
+	maxRecentRestarts = 50
+)
+
+// pendingRestartLabel selects the VMs with a pending restart, which is kept
+// as JSON in the annotation of the same name
+const pendingRestartLabel = "kubevirt-mcp/pending-restart"
+
+// pendingRestart is the restart request stored in the VM annotation
+type pendingRestart struct {
+	Reason      string    `json:"reason,omitempty"`
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	Since       time.Time `json:"since"`
+	Attempts    int       `json:"attempts,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// RestartScheduleParams represents the parameters of vm_restart_schedule
+type RestartScheduleParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	VMName          string `json:"vm_name,omitempty"`
+	RestartRequired bool   `json:"restart_required,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	Remove          bool   `json:"remove,omitempty"`
+}
+
+// RestartScheduleStatusParams represents the parameters of
+// vm_restart_schedule_status
+type RestartScheduleStatusParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// RestartWindowInfo describes the maintenance window
+type RestartWindowInfo struct {
+	Schedule  string     `json:"schedule,omitempty"`
+	Duration  string     `json:"duration,omitempty"`
+	State     string     `json:"state"`
+	OpenUntil *time.Time `json:"openUntil,omitempty"`
+	NextOpen  *time.Time `json:"nextOpen,omitempty"`
+}
+
+// PendingRestartInfo is a VM waiting for the maintenance window
+type PendingRestartInfo struct {
+	Namespace       string    `json:"namespace"`
+	VMName          string    `json:"vmName"`
+	Status          string    `json:"status,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+	RequestedBy     string    `json:"requestedBy,omitempty"`
+	Since           time.Time `json:"since"`
+	RestartRequired bool      `json:"restartRequired,omitempty"`
+	Attempts        int       `json:"attempts,omitempty"`
+	LastError       string    `json:"lastError,omitempty"`
+	Invalid         string    `json:"invalid,omitempty"`
+}
+
+// AppliedRestart is a pending restart this server applied
+type AppliedRestart struct {
+	Namespace string    `json:"namespace"`
+	VMName    string    `json:"vmName"`
+	Time      time.Time `json:"time"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// RestartScheduleResult is the vm_restart_schedule and
+// vm_restart_schedule_status tool result
+type RestartScheduleResult struct {
+	Window  RestartWindowInfo    `json:"window"`
+	Marked  []string             `json:"marked,omitempty"`
+	Removed bool                 `json:"removed,omitempty"`
+	Pending []PendingRestartInfo `json:"pending"`
+	Applied []AppliedRestart     `json:"applied,omitempty"`
+	Diff    string               `json:"diff,omitempty"`
+}
+
+// recentRestarts keeps the restarts this server applied, most recent last
+var recentRestarts struct {
+	sync.Mutex
+	restarts []AppliedRestart
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_restart_schedule",
+		Description: "Mark a VM, or every VM of a namespace whose RestartRequired condition is set, to be restarted in the next maintenance window instead of now. The server applies the pending restarts while the window is open, see vm_restart_schedule_status",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VMs",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"restart_required": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Mark every VM of the namespace with a true RestartRequired condition, e.g. after changing their instance type or CPU, instead of vm_name",
+					"default":     false,
+				},
+				"reason": map[string]interface{}{
+					"type":        "string",
+					"description": "Why the VM needs a restart, shown in the status",
+				},
+				"remove": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Cancel the pending restart of vm_name instead",
+					"default":     false,
+				},
+			},
+		},
+		Handler: handleRestartSchedule,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_restart_schedule_status",
+		Description: "Show the maintenance window, the VMs with a pending restart and the restarts this server applied",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Only list pending restarts in this namespace (default: all namespaces)",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleRestartScheduleStatus,
+	})
+}
+
+// handleRestartSchedule is the tools/call handler for vm_restart_schedule
+func handleRestartSchedule(ctx context.Context, args json.RawMessage) (string, error) {
+	var params RestartScheduleParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName != "" && params.RestartRequired {
+		return "", &invalidParamsError{err: fmt.Errorf("vm_name and restart_required cannot be combined")}
+	}
+	if params.VMName == "" && !params.RestartRequired {
+		return "", missingArgument("vm_name")
+	}
+	if params.Remove && (params.RestartRequired || params.Reason != "") {
+		return "", &invalidParamsError{err: fmt.Errorf("remove only takes vm_name")}
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result := &RestartScheduleResult{Window: restartWindowInfo(clock.Now()), Removed: params.Remove}
+	if params.Remove {
+		diff, err := mutationDiff(ctx, "virtualmachine", params.VMName, params.Namespace, func() error {
+			return clearPendingRestart(ctx, params.Namespace, params.VMName, "")
+		})
+		if err != nil {
+			return "", err
+		}
+		result.Diff = diff
+	} else {
+		names := []string{params.VMName}
+		if params.RestartRequired {
+			var err error
+			if names, err = restartRequiredVMs(ctx, params.Namespace); err != nil {
+				return "", err
+			}
+		}
+		mark := pendingRestart{Reason: params.Reason, RequestedBy: identityName(ctx), Since: clock.Now().UTC().Truncate(time.Second)}
+		if mark.Reason == "" && params.RestartRequired {
+			mark.Reason = "RestartRequired"
+		}
+		for _, name := range names {
+			diff, err := mutationDiff(ctx, "virtualmachine", name, params.Namespace, func() error {
+				return markPendingRestart(ctx, params.Namespace, name, mark)
+			})
+			if err != nil {
+				return "", err
+			}
+			result.Marked = append(result.Marked, name)
+			if params.VMName != "" {
+				result.Diff = diff
+			}
+		}
+		logMessage(LogInfo, "restarts", "Marked %d VMs in %s for a restart in the maintenance window", len(names), params.Namespace)
+	}
+
+	pending, err := pendingRestarts(ctx, params.Namespace)
+	if err != nil {
+		return "", err
+	}
+	result.Pending = pending
+	return formatJSON(result)
+}
+
+// handleRestartScheduleStatus is the tools/call handler for
+// vm_restart_schedule_status
+func handleRestartScheduleStatus(ctx context.Context, args json.RawMessage) (string, error) {
+	var params RestartScheduleStatusParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	pending, err := pendingRestarts(ctx, params.Namespace)
+	if err != nil {
+		return "", err
+	}
+	result := &RestartScheduleResult{Window: restartWindowInfo(clock.Now()), Pending: pending}
+	recentRestarts.Lock()
+	for _, restart := range recentRestarts.restarts {
+		if params.Namespace == "" || restart.Namespace == params.Namespace {
+			result.Applied = append(result.Applied, restart)
+		}
+	}
+	recentRestarts.Unlock()
+	return formatResult(params.Format, result, result.tables)
+}
+
+// restartRequiredVMs returns the names of the VMs of the namespace with a
+// true RestartRequired condition
+func restartRequiredVMs(ctx context.Context, namespace string) ([]string, error) {
+	var vms VirtualMachineList
+	if err := runKubectlJSON(ctx, &vms, "get", "virtualmachines", "-n", namespace); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, vm := range vms.Items {
+		if conditionStatus(vm.Status.Conditions, "RestartRequired") == "True" {
+			names = append(names, vm.Metadata.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// markPendingRestart stores the restart request on the VM
+func markPendingRestart(ctx context.Context, namespace, name string, mark pendingRestart) error {
+	value, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      map[string]interface{}{pendingRestartLabel: "true"},
+			"annotations": map[string]interface{}{pendingRestartLabel: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = runKubectl(ctx, "patch", "virtualmachine", name, "-n", namespace, "--type=merge", "-p", string(patch))
+	return err
+}
+
+// clearPendingRestart removes the restart request of the VM. With an
+// expected annotation the removal fails when the request changed since, so
+// only one of the servers sharing a cluster applies it.
+func clearPendingRestart(ctx context.Context, namespace, name, expected string) error {
+	var patch []byte
+	var err error
+	patchType := "--type=merge"
+	if expected == "" {
+		patch, err = json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      map[string]interface{}{pendingRestartLabel: nil},
+				"annotations": map[string]interface{}{pendingRestartLabel: nil},
+			},
+		})
+	} else {
+		key := strings.ReplaceAll(pendingRestartLabel, "/", "~1")
+		patchType = "--type=json"
+		patch, err = json.Marshal([]map[string]interface{}{
+			{"op": "test", "path": "/metadata/annotations/" + key, "value": expected},
+			{"op": "remove", "path": "/metadata/annotations/" + key},
+			{"op": "remove", "path": "/metadata/labels/" + key},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := runKubectl(ctx, "patch", "virtualmachine", name, "-n", namespace, patchType, "-p", string(patch)); err != nil {
+		return fmt.Errorf("failed to clear the pending restart of %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// pendingRestartVMs lists the VMs with a pending restart, in all namespaces
+// when namespace is empty
+func pendingRestartVMs(ctx context.Context, namespace string) ([]VirtualMachine, error) {
+	var vms VirtualMachineList
+	args := append([]string{"get", "virtualmachines", "-l", pendingRestartLabel + "=true"}, namespaceArgs(namespace, namespace == "")...)
+	if err := runKubectlJSON(ctx, &vms, args...); err != nil {
+		return nil, err
+	}
+	sort.Slice(vms.Items, func(i, j int) bool {
+		a, b := vms.Items[i].Metadata, vms.Items[j].Metadata
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return vms.Items, nil
+}
+
+// vmPendingRestart returns the restart request stored on the VM
+func vmPendingRestart(vm VirtualMachine) (pendingRestart, error) {
+	var mark pendingRestart
+	if err := json.Unmarshal([]byte(vm.Metadata.Annotations[pendingRestartLabel]), &mark); err != nil {
+		return mark, fmt.Errorf("invalid %s annotation: %v", pendingRestartLabel, err)
+	}
+	return mark, nil
+}
+
+// pendingRestarts reports the VMs waiting for the maintenance window
+func pendingRestarts(ctx context.Context, namespace string) ([]PendingRestartInfo, error) {
+	vms, err := pendingRestartVMs(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	pending := []PendingRestartInfo{}
+	for _, vm := range vms {
+		info := PendingRestartInfo{
+			Namespace:       vm.Metadata.Namespace,
+			VMName:          vm.Metadata.Name,
+			Status:          vm.Status.PrintableStatus,
+			RestartRequired: conditionStatus(vm.Status.Conditions, "RestartRequired") == "True",
+		}
+		mark, err := vmPendingRestart(vm)
+		if err != nil {
+			info.Invalid = err.Error()
+		}
+		info.Reason, info.RequestedBy, info.Since = mark.Reason, mark.RequestedBy, mark.Since
+		info.Attempts, info.LastError = mark.Attempts, mark.LastError
+		pending = append(pending, info)
+	}
+	return pending, nil
+}
+
+// restartWindow returns the start of the maintenance window open at now, or
+// the zero time when it is closed or none is set
+func restartWindow(now time.Time) (time.Time, *cronSchedule) {
+	if serverConfig.RestartWindow.Schedule == "" {
+		return time.Time{}, nil
+	}
+	cron, err := parseCron(serverConfig.RestartWindow.Schedule)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	// The window opens on a minute, the one opening exactly a duration ago
+	// has just closed
+	return cron.latest(now.Add(-serverConfig.RestartWindow.Duration), now), cron
+}
+
+// restartWindowInfo describes the maintenance window at now
+func restartWindowInfo(now time.Time) RestartWindowInfo {
+	if serverConfig.RestartWindow.Schedule == "" {
+		return RestartWindowInfo{State: "disabled, set " + restartWindowEnv + " to apply the pending restarts"}
+	}
+	info := RestartWindowInfo{Schedule: serverConfig.RestartWindow.Schedule, Duration: serverConfig.RestartWindow.Duration.String()}
+	start, cron := restartWindow(now)
+	if cron == nil {
+		info.State = "invalid schedule"
+		return info
+	}
+	if !start.IsZero() {
+		end := start.Add(serverConfig.RestartWindow.Duration)
+		info.State = "open, closes in " + humanDuration(end.Sub(now))
+		info.OpenUntil = &end
+		return info
+	}
+	if next := cron.next(now); !next.IsZero() {
+		info.State = "closed, opens in " + humanDuration(next.Sub(now))
+		info.NextOpen = &next
+	} else {
+		info.State = "never opens"
+	}
+	return info
+}
+
+// startRestartScheduler checks the maintenance window settings and starts
+// applying the pending restarts in the window unless none is set
+func startRestartScheduler() error {
+	window := serverConfig.RestartWindow
+	if window.Schedule == "" {
+		return nil
+	}
+	cron, err := parseCron(window.Schedule)
+	if err != nil {
+		return err
+	}
+	if cron.next(clock.Now()).IsZero() {
+		return fmt.Errorf("the restart window '%s' never opens", window.Schedule)
+	}
+	if window.Duration < minRestartWindowDuration {
+		return fmt.Errorf("the restart window duration must be at least %v", minRestartWindowDuration)
+	}
+
+	go func() {
+		for {
+			if start, _ := restartWindow(clock.Now()); !start.IsZero() {
+				if err := applyPendingRestarts(context.Background()); err != nil {
+					logMessage(LogDebug, "restarts", "Pending restarts not checked: %v", err)
+				}
+			}
+			<-clock.After(restartWindowCheckInterval)
+		}
+	}()
+	logMessage(LogInfo, "restarts", "Applying pending restarts in the window '%s' of %v", window.Schedule, window.Duration)
+	return nil
+}
+
+// applyPendingRestarts restarts the VMs with a pending restart. A stopped
+// VM picks the changes up when it starts, its request is only cleared. A
+// failed restart is kept with its error and retried while the window is
+// open.
+func applyPendingRestarts(ctx context.Context) error {
+	vms, err := pendingRestartVMs(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		namespace, name := vm.Metadata.Namespace, vm.Metadata.Name
+		mark, _ := vmPendingRestart(vm)
+		var err error
+		// Claim the request first, another server may be applying it
+		if err := clearPendingRestart(ctx, namespace, name, vm.Metadata.Annotations[pendingRestartLabel]); err != nil {
+			logMessage(LogDebug, "restarts", "Pending restart of %s/%s not claimed: %v", namespace, name, err)
+			continue
+		}
+
+		outcome := "restarted"
+		if vm.Status.PrintableStatus == "Stopped" {
+			outcome = "stopped, cleared"
+		} else {
+			err = restartVM(ctx, namespace, name)
+		}
+		if err != nil {
+			logMessage(LogWarning, "restarts", "%v", err)
+			mark.Attempts++
+			mark.LastError = err.Error()
+			if markErr := markPendingRestart(ctx, namespace, name, mark); markErr != nil {
+				logMessage(LogWarning, "restarts", "Pending restart of %s/%s lost: %v", namespace, name, markErr)
+			}
+			outcome = "failed"
+		} else {
+			logMessage(LogInfo, "restarts", "Applied the pending restart of %s/%s: %s", namespace, name, outcome)
+		}
+		recordRestart(AppliedRestart{Namespace: namespace, VMName: name, Time: clock.Now().UTC().Truncate(time.Second), Outcome: outcome}, err)
+	}
+	return nil
+}
+
+// restartVM restarts a running VM through the restart subresource
+func restartVM(ctx context.Context, namespace, name string) error {
+	path := fmt.Sprintf("/apis/subresources.kubevirt.io/v1/namespaces/%s/virtualmachines/%s/restart", namespace, name)
+	if _, err := runKubectlWithInput(ctx, []byte("{}"), "replace", "--raw", path, "-f", "-"); err != nil {
+		return fmt.Errorf("failed to restart VM %s/%s: %v", namespace, name, err)
+	}
+	return nil
+}
+
+// recordRestart keeps an applied restart for the status
+func recordRestart(restart AppliedRestart, err error) {
+	if err != nil {
+		restart.Error = err.Error()
+	}
+	recentRestarts.Lock()
+	recentRestarts.restarts = append(recentRestarts.restarts, restart)
+	if len(recentRestarts.restarts) > maxRecentRestarts {
+		recentRestarts.restarts = recentRestarts.restarts[len(recentRestarts.restarts)-maxRecentRestarts:]
+	}
+	recentRestarts.Unlock()
+}
+
+// tables renders the window, the pending restarts and the applied ones
+func (r *RestartScheduleResult) tables() []table {
+	window := table{title: "Maintenance window", headers: []string{"SCHEDULE", "DURATION", "STATE"}}
+	window.rows = append(window.rows, []string{r.Window.Schedule, r.Window.Duration, r.Window.State})
+	pending := table{title: "Pending restarts", headers: []string{"NAMESPACE", "VM", "STATUS", "REASON", "REQUESTED BY", "SINCE", "ATTEMPTS", "LAST ERROR"}}
+	for _, p := range r.Pending {
+		lastError := p.LastError
+		if p.Invalid != "" {
+			lastError = p.Invalid
+		}
+		pending.rows = append(pending.rows, []string{p.Namespace, p.VMName, p.Status, p.Reason, p.RequestedBy, p.Since.UTC().Format(time.RFC3339), fmt.Sprint(p.Attempts), lastError})
+	}
+	applied := table{title: "Applied restarts", headers: []string{"NAMESPACE", "VM", "TIME", "OUTCOME", "ERROR"}}
+	for _, a := range r.Applied {
+		applied.rows = append(applied.rows, []string{a.Namespace, a.VMName, a.Time.Format(time.RFC3339), a.Outcome, a.Error})
+	}
+	return []table{window, pending, applied}
+}
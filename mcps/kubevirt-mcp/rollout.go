@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How vm_rollout gets the running VMIs to pick the change up
+const (
+	rolloutRestartNone     = "none"
+	rolloutRestartRequired = "required"
+	rolloutRestartAlways   = "always"
+	rolloutRestartWindow   = "window"
+
+	// rolloutHealthNone skips the health check between batches, the other
+	// checks are the vm_wait_ready stages
+	rolloutHealthNone = "none"
+
+	defaultRolloutTimeout = 300
+)
+
+var rolloutRestarts = []string{rolloutRestartNone, rolloutRestartRequired, rolloutRestartAlways, rolloutRestartWindow}
+
+// Outcomes of a VM in a rollout
+const (
+	rolloutUnchanged = "unchanged"
+	rolloutPending   = "pending"
+	rolloutUpdated   = "updated"
+	rolloutHealthy   = "healthy"
+	rolloutFailed    = "failed"
+	rolloutSkipped   = "skipped"
+)
+
+// VMRolloutParams represents the parameters of vm_rollout
+type VMRolloutParams struct {
+	Namespace   string                 `json:"namespace,omitempty"`
+	Selector    string                 `json:"selector"`
+	Patch       map[string]interface{} `json:"patch"`
+	BatchSize   int                    `json:"batch_size,omitempty"`
+	Restart     string                 `json:"restart,omitempty"`
+	Health      string                 `json:"health,omitempty"`
+	Timeout     int                    `json:"timeout,omitempty"`
+	MaxFailures int                    `json:"max_failures,omitempty"`
+	Confirm     bool                   `json:"confirm,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+}
+
+// RolloutVM is the outcome of a VM in a rollout
+type RolloutVM struct {
+	Name      string `json:"name"`
+	Batch     int    `json:"batch,omitempty"`
+	Status    string `json:"status"`
+	Running   bool   `json:"running"`
+	Restarted bool   `json:"restarted,omitempty"`
+	Scheduled bool   `json:"scheduled,omitempty"`
+	Duration  string `json:"duration,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Diff      string `json:"diff,omitempty"`
+}
+
+// VMRolloutResult is the vm_rollout tool result
+type VMRolloutResult struct {
+	Namespace string      `json:"namespace"`
+	Selector  string      `json:"selector"`
+	BatchSize int         `json:"batchSize"`
+	Restart   string      `json:"restart"`
+	Health    string      `json:"health"`
+	Confirmed bool        `json:"confirmed"`
+	Batches   int         `json:"batches"`
+	Completed bool        `json:"completed"`
+	Halted    string      `json:"halted,omitempty"`
+	Failures  int         `json:"failures"`
+	Duration  string      `json:"duration,omitempty"`
+	VMs       []RolloutVM `json:"vms"`
+	Note      string      `json:"note,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_rollout",
+		Description: "Roll the same change out to every VM matching a label selector, e.g. bump the instance type, add a label or switch a network: the VMs are patched a batch at a time, restarted as requested and health checked before the next batch, halting after too many failures. Previews the batches unless confirm is set",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VMs",
+					"default":     "default",
+				},
+				"selector": map[string]interface{}{
+					"type":        "string",
+					"description": "Label selector of the VMs, e.g. app=web,tier!=db",
+				},
+				"patch": map[string]interface{}{
+					"type":        "object",
+					"description": "JSON merge patch applied to every VM, limited to metadata.labels, metadata.annotations and spec, e.g. {\"spec\": {\"instancetype\": {\"name\": \"u1.large\"}}}; null removes a field",
+				},
+				"batch_size": map[string]interface{}{
+					"type":        "integer",
+					"description": "VMs changed at a time",
+					"default":     1,
+				},
+				"restart": map[string]interface{}{
+					"type":        "string",
+					"description": "How running VMs pick the change up: none leaves them, required restarts those whose RestartRequired condition the change set, always restarts every running VM, window marks those the change set RestartRequired on for the maintenance window of vm_restart_schedule",
+					"enum":        rolloutRestarts,
+					"default":     rolloutRestartRequired,
+				},
+				"health": map[string]interface{}{
+					"type":        "string",
+					"description": "Check of the running VMs of a batch before the next one, a vm_wait_ready stage or none",
+					"enum":        append([]string{rolloutHealthNone}, readyStages...),
+					"default":     readyStageRunning,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout of each VM in seconds, for virt-controller to observe the patch and for the health check",
+					"default":     defaultRolloutTimeout,
+				},
+				"max_failures": map[string]interface{}{
+					"type":        "integer",
+					"description": "Failed VMs tolerated, the rollout halts after the batch that exceeds it",
+					"default":     0,
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Roll the change out, otherwise only preview the VMs it changes and their batches",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"selector", "patch"},
+		},
+		Handler: handleVMRollout,
+	})
+}
+
+// handleVMRollout is the tools/call handler for vm_rollout
+func handleVMRollout(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMRolloutParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Selector == "" {
+		return "", missingArgument("selector")
+	}
+	if len(params.Patch) == 0 {
+		return "", missingArgument("patch")
+	}
+	if err := validateRolloutPatch(params.Patch); err != nil {
+		return "", &invalidParamsError{err: err}
+	}
+	if params.Restart != "" && !containsString(rolloutRestarts, params.Restart) {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported restart '%s'", params.Restart)}
+	}
+	if params.Health != "" && params.Health != rolloutHealthNone && !containsString(readyStages, params.Health) {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported health check '%s'", params.Health)}
+	}
+	if params.BatchSize < 0 || params.Timeout < 0 || params.MaxFailures < 0 {
+		return "", &invalidParamsError{err: errors.New("batch_size, timeout and max_failures cannot be negative")}
+	}
+
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.BatchSize == 0 {
+		params.BatchSize = 1
+	}
+	if params.Restart == "" {
+		params.Restart = rolloutRestartRequired
+	}
+	if params.Health == "" {
+		params.Health = readyStageRunning
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultRolloutTimeout
+	}
+
+	result, err := rolloutVMs(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// validateRolloutPatch keeps the patch to the fields a fleet change is
+// about, names and status are not rolled out
+func validateRolloutPatch(patch map[string]interface{}) error {
+	for key, value := range patch {
+		switch key {
+		case "spec":
+			if _, ok := value.(map[string]interface{}); !ok {
+				return errors.New("patch spec must be an object")
+			}
+		case "metadata":
+			metadata, ok := value.(map[string]interface{})
+			if !ok {
+				return errors.New("patch metadata must be an object")
+			}
+			for field := range metadata {
+				if field != "labels" && field != "annotations" {
+					return fmt.Errorf("patch cannot change metadata.%s, only labels and annotations", field)
+				}
+			}
+		default:
+			return fmt.Errorf("patch cannot change %s, only metadata and spec", key)
+		}
+	}
+	return nil
+}
+
+// rolloutVMs patches the selected VMs a batch at a time, or previews the
+// batches without confirm
+func rolloutVMs(ctx context.Context, params VMRolloutParams) (*VMRolloutResult, error) {
+	output, err := runKubectl(ctx, "get", "virtualmachines", "-n", params.Namespace, "-l", params.Selector, "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	var vms VirtualMachineList
+	if err := json.Unmarshal(output, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse VM list: %v", err)
+	}
+	if err := json.Unmarshal(output, &vms); err != nil {
+		return nil, fmt.Errorf("failed to parse VM list: %v", err)
+	}
+
+	result := &VMRolloutResult{
+		Namespace: params.Namespace,
+		Selector:  params.Selector,
+		BatchSize: params.BatchSize,
+		Restart:   params.Restart,
+		Health:    params.Health,
+		Confirmed: params.Confirm,
+		VMs:       []RolloutVM{},
+	}
+
+	// VMs the patch leaves as they are are not part of any batch
+	var changed []int
+	for i, vm := range vms.Items {
+		entry := RolloutVM{Name: vm.Metadata.Name, Status: rolloutUnchanged, Running: vm.Status.PrintableStatus != "Stopped"}
+		patched := deepCopy(raw.Items[i])
+		mergePatch(patched, params.Patch)
+		if !reflect.DeepEqual(patched, raw.Items[i]) {
+			entry.Status = rolloutPending
+			entry.Batch = len(changed)/params.BatchSize + 1
+			changed = append(changed, len(result.VMs))
+		}
+		result.VMs = append(result.VMs, entry)
+	}
+	sortRolloutVMs(result.VMs, changed)
+	result.Batches = (len(changed) + params.BatchSize - 1) / params.BatchSize
+
+	if !params.Confirm {
+		result.Note = "Preview only, set confirm to true to roll the change out"
+		if len(result.VMs) == 0 {
+			result.Note = "No VM matches the selector"
+		}
+		return result, nil
+	}
+
+	patch, err := json.Marshal(params.Patch)
+	if err != nil {
+		return nil, err
+	}
+	start := clock.Now()
+	for batch := 1; batch <= result.Batches; batch++ {
+		if err := ctx.Err(); err != nil {
+			result.Halted = fmt.Sprintf("cancelled before batch %d: %v", batch, err)
+			break
+		}
+		reportProgress(ctx, "rolling out batch %d/%d", batch, result.Batches)
+		var members []*RolloutVM
+		for _, i := range changed {
+			if result.VMs[i].Batch == batch {
+				members = append(members, &result.VMs[i])
+			}
+		}
+		rolloutBatch(ctx, params, string(patch), members)
+		for _, vm := range members {
+			if vm.Status == rolloutFailed {
+				result.Failures++
+			}
+		}
+		if result.Failures > params.MaxFailures {
+			result.Halted = fmt.Sprintf("%d VMs failed after batch %d, more than the %d tolerated", result.Failures, batch, params.MaxFailures)
+			break
+		}
+	}
+	for _, i := range changed {
+		if result.VMs[i].Status == rolloutPending {
+			result.VMs[i].Status = rolloutSkipped
+		}
+	}
+	result.Completed = result.Halted == ""
+	result.Duration = humanDuration(clock.Now().Sub(start))
+	if result.Halted != "" {
+		logMessage(LogWarning, "rollout", "Rollout to %s in %s halted: %s", params.Selector, params.Namespace, result.Halted)
+	} else {
+		logMessage(LogInfo, "rollout", "Rolled out to %d VMs matching %s in %s", len(changed), params.Selector, params.Namespace)
+	}
+	if params.Restart == rolloutRestartWindow {
+		result.Note = "VMs requiring a restart restart in the maintenance window, see vm_restart_schedule_status"
+	}
+	return result, nil
+}
+
+// sortRolloutVMs moves the changed VMs first, in batch order, keeping the
+// unchanged ones at the end
+func sortRolloutVMs(vms []RolloutVM, changed []int) {
+	ordered := make([]RolloutVM, 0, len(vms))
+	for _, i := range changed {
+		ordered = append(ordered, vms[i])
+	}
+	for _, vm := range vms {
+		if vm.Status == rolloutUnchanged {
+			ordered = append(ordered, vm)
+		}
+	}
+	copy(vms, ordered)
+	for i := range changed {
+		changed[i] = i
+	}
+}
+
+// rolloutBatch patches and restarts the VMs of a batch, then health checks
+// the running ones
+func rolloutBatch(ctx context.Context, params VMRolloutParams, patch string, members []*RolloutVM) {
+	oldVMIs := map[string]string{}
+	for _, vm := range members {
+		start := clock.Now()
+		var vmi VirtualMachineInstance
+		if found, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", vm.Name, params.Namespace); err == nil && found {
+			oldVMIs[vm.Name] = vmi.Metadata.UID
+		}
+		diff, err := mutationDiff(ctx, "virtualmachine", vm.Name, params.Namespace, func() error {
+			_, err := runKubectl(ctx, "patch", "virtualmachine", vm.Name, "-n", params.Namespace, "--type=merge", "-p", patch)
+			return err
+		})
+		if err == nil {
+			vm.Diff = diff
+			vm.Status = rolloutUpdated
+			err = applyRolloutRestart(ctx, params, vm)
+		}
+		if err != nil {
+			vm.Status, vm.Error = rolloutFailed, err.Error()
+		}
+		vm.Duration = humanDuration(clock.Now().Sub(start))
+	}
+
+	for _, vm := range members {
+		if vm.Status == rolloutFailed || !vm.Running || params.Health == rolloutHealthNone {
+			continue
+		}
+		start := clock.Now()
+		err := rolloutHealthCheck(ctx, params, vm, oldVMIs[vm.Name])
+		if err != nil {
+			vm.Status, vm.Error = rolloutFailed, err.Error()
+		} else {
+			vm.Status = rolloutHealthy
+		}
+		vm.Duration = humanDuration(clock.Now().Sub(start))
+	}
+}
+
+// applyRolloutRestart gets the running VMI of a patched VM to pick the
+// change up as the restart parameter asks
+func applyRolloutRestart(ctx context.Context, params VMRolloutParams, vm *RolloutVM) error {
+	if !vm.Running || params.Restart == rolloutRestartNone {
+		return nil
+	}
+	if params.Restart == rolloutRestartRequired || params.Restart == rolloutRestartWindow {
+		conditions, err := observedVMConditions(ctx, params, vm.Name)
+		if err != nil {
+			return err
+		}
+		if conditionStatus(conditions, "RestartRequired") != "True" {
+			return nil
+		}
+	}
+	if params.Restart == rolloutRestartWindow {
+		mark := pendingRestart{Reason: "vm_rollout " + params.Selector, RequestedBy: identityName(ctx), Since: clock.Now().UTC().Truncate(time.Second)}
+		if err := markPendingRestart(ctx, params.Namespace, vm.Name, mark); err != nil {
+			return err
+		}
+		vm.Scheduled = true
+		return nil
+	}
+	if err := restartVM(ctx, params.Namespace, vm.Name); err != nil {
+		return err
+	}
+	vm.Restarted = true
+	return nil
+}
+
+// observedVMConditions returns the conditions of a patched VM once
+// virt-controller has seen the patch, which sets RestartRequired some time
+// after it. KubeVirt versions without status.observedGeneration are read
+// right away.
+func observedVMConditions(ctx context.Context, params VMRolloutParams, name string) ([]Condition, error) {
+	ctx, cancel := clock.WithTimeout(ctx, time.Duration(params.Timeout)*time.Second)
+	defer cancel()
+	for {
+		var updated struct {
+			Metadata struct {
+				Generation int64 `json:"generation"`
+			} `json:"metadata"`
+			Status struct {
+				ObservedGeneration int64       `json:"observedGeneration"`
+				Conditions         []Condition `json:"conditions"`
+			} `json:"status"`
+		}
+		if err := runKubectlJSON(ctx, &updated, "get", "virtualmachine", name, "-n", params.Namespace); err != nil {
+			return nil, err
+		}
+		if updated.Status.ObservedGeneration == 0 || updated.Status.ObservedGeneration >= updated.Metadata.Generation {
+			return updated.Status.Conditions, nil
+		}
+		last := fmt.Errorf("virt-controller has not observed generation %d of the VM yet", updated.Metadata.Generation)
+		if err := waitReadyRetry(ctx, time.Second, last); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rolloutHealthCheck waits for the VM to pass the health check, after its
+// VMI was replaced when it was restarted
+func rolloutHealthCheck(ctx context.Context, params VMRolloutParams, vm *RolloutVM, oldVMI string) error {
+	ctx, cancel := clock.WithTimeout(ctx, time.Duration(params.Timeout)*time.Second)
+	defer cancel()
+	if vm.Restarted && oldVMI != "" {
+		for {
+			var vmi VirtualMachineInstance
+			found, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", vm.Name, params.Namespace)
+			if err != nil {
+				return err
+			}
+			if found && vmi.Metadata.UID != oldVMI {
+				break
+			}
+			if err := waitReadyRetry(ctx, 2*time.Second, errors.New("the VMI was not replaced")); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := waitVMReady(ctx, VMWaitReadyParams{Namespace: params.Namespace, VMName: vm.Name, Until: params.Health, Timeout: params.Timeout})
+	return err
+}
+
+// tables renders the VMs of the rollout
+func (r *VMRolloutResult) tables() []table {
+	state := "preview"
+	switch {
+	case r.Halted != "":
+		state = "halted: " + r.Halted
+	case r.Completed:
+		state = "completed"
+	}
+	vms := table{
+		title:   fmt.Sprintf("Rollout to %s in %s (%d batches of %d, restart %s, health %s, %s)", r.Selector, r.Namespace, r.Batches, r.BatchSize, r.Restart, r.Health, state),
+		headers: []string{"VM", "BATCH", "STATUS", "RUNNING", "RESTART", "DURATION", "ERROR"},
+	}
+	for _, vm := range r.VMs {
+		batch, restart := "", ""
+		if vm.Batch > 0 {
+			batch = strconv.Itoa(vm.Batch)
+		}
+		switch {
+		case vm.Restarted:
+			restart = "restarted"
+		case vm.Scheduled:
+			restart = "scheduled"
+		}
+		vms.rows = append(vms.rows, []string{vm.Name, batch, vm.Status, strconv.FormatBool(vm.Running), restart, vm.Duration, strings.TrimSpace(vm.Error)})
+	}
+	return []table{vms}
+}
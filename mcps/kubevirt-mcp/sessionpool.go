@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the pool of logged in vm-exec sessions,
+// see SessionsConfig
+const (
+	sessionPoolSizeEnv    = "KUBEVIRT_MCP_SESSION_POOL_SIZE"
+	sessionIdleTimeoutEnv = "KUBEVIRT_MCP_SESSION_IDLE_TIMEOUT"
+
+	defaultSessionPoolSize    = 8
+	defaultSessionIdleTimeout = 5 * time.Minute
+
+	// sessionCheckAfter is how long a session may sit idle before it is
+	// checked with a no-op command on reuse, e.g. after the guest rebooted
+	sessionCheckAfter = 30 * time.Second
+
+	// sessionCheckTimeout bounds the no-op command, in seconds
+	sessionCheckTimeout = 5
+)
+
+// vmExecSession is a vm-exec --serve process logged in to a VM
+type vmExecSession struct {
+	key    string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *lockedBuffer
+
+	// busy is held while a request runs, requests to the same VM queue on it
+	busy     chan struct{}
+	lastUsed time.Time
+	used     bool
+}
+
+// sessionResponse mirrors the ServeResponse lines of vm-exec --serve
+type sessionResponse struct {
+	Results []VMExecResult `json:"results"`
+	Error   string         `json:"error"`
+}
+
+// sessionPool keeps vm-exec sessions keyed by cluster, VM and login
+// settings, so consecutive commands to a VM skip the console login
+type sessionPool struct {
+	mu       sync.Mutex
+	sessions map[string]*vmExecSession
+}
+
+// vmExecSessions is the session pool of the server
+var vmExecSessions = &sessionPool{sessions: map[string]*vmExecSession{}}
+
+// sessionPoolEnabled reports whether the commands can run in a pooled
+// session. Recorded and replayed invocations and verbose runs always start
+// a new vm-exec.
+func sessionPoolEnabled(params VMExecParams) bool {
+	return serverConfig.Sessions.PoolSize > 0 && fixtures == nil && simulation == nil && !params.Verbose
+}
+
+// execute runs the commands in the pooled session of the VM and returns the
+// same JSON document as vm-exec --output json. When the pool is full of busy
+// sessions the commands run in a new vm-exec instead.
+func (p *sessionPool) execute(ctx context.Context, params VMExecParams) (string, error) {
+	commands := params.Commands
+	if params.Command != "" {
+		commands = append([]string{params.Command}, commands...)
+	}
+
+	// The timeout is sent with each request, it does not select the session
+	sessionParams := params
+	sessionParams.Timeout = 0
+	args, env, err := vmExecArgs(sessionParams)
+	if err != nil {
+		return "", err
+	}
+	args = append(kubeconfigArgs(ctx), args...)
+
+	s, err := p.acquire(ctx, args, env)
+	if err != nil {
+		return "", err
+	}
+	if s == nil {
+		return runVMCommand(ctx, params)
+	}
+	defer p.release(s)
+
+	results, err := p.request(ctx, s, commands, params.Timeout)
+	if err != nil {
+		return "", err
+	}
+	if len(results) != len(commands) {
+		p.discard(s)
+		return "", fmt.Errorf("vm-exec session returned %d results for %d commands", len(results), len(commands))
+	}
+
+	var document interface{} = results
+	if len(commands) == 1 && len(params.Commands) == 0 {
+		results[0].Command = ""
+		document = results[0]
+	}
+	output, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(output) + "\n", nil
+}
+
+// acquire returns the session for the arguments, starting one when there is
+// none, and waits until it is free. It returns nil when the pool is full and
+// no idle session can be closed to make room.
+func (p *sessionPool) acquire(ctx context.Context, args, env []string) (*vmExecSession, error) {
+	key := strings.Join(append(append([]string{}, args...), env...), "\x00")
+
+	for {
+		p.mu.Lock()
+		s := p.sessions[key]
+		var evicted *vmExecSession
+		if s == nil {
+			if len(p.sessions) >= serverConfig.Sessions.PoolSize {
+				if evicted = p.evictLocked(); evicted == nil {
+					p.mu.Unlock()
+					return nil, nil
+				}
+			}
+			var err error
+			if s, err = startSession(key, args, env); err != nil {
+				p.mu.Unlock()
+				if evicted != nil {
+					evicted.stop()
+				}
+				return nil, err
+			}
+			p.sessions[key] = s
+		}
+		p.mu.Unlock()
+		// The evicted vm-exec is stopped without the lock, it can be slow
+		// to exit
+		if evicted != nil {
+			evicted.stop()
+		}
+
+		select {
+		case s.busy <- struct{}{}:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("vm-exec cancelled")
+		}
+
+		// The session may have been closed while waiting for it
+		p.mu.Lock()
+		current := p.sessions[key] == s
+		p.mu.Unlock()
+		if !current {
+			<-s.busy
+			continue
+		}
+
+		if !s.used || clock.Now().Sub(s.lastUsed) < sessionCheckAfter {
+			return s, nil
+		}
+		if _, err := p.request(ctx, s, []string{"true"}, sessionCheckTimeout); err != nil {
+			<-s.busy
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			logMessage(LogInfo, "sessions", "Replacing stale vm-exec session: %v", err)
+			continue
+		}
+		return s, nil
+	}
+}
+
+// release returns the session to the pool
+func (p *sessionPool) release(s *vmExecSession) {
+	p.mu.Lock()
+	s.lastUsed = clock.Now()
+	p.mu.Unlock()
+	<-s.busy
+}
+
+// request sends the commands to the session and waits for their results.
+// The session is discarded when vm-exec reports an error, the request is
+// cancelled or it does not answer within the deadline of a new vm-exec,
+// since its console state is unknown.
+func (p *sessionPool) request(ctx context.Context, s *vmExecSession, commands []string, timeout int) ([]VMExecResult, error) {
+	line, err := json.Marshal(map[string]interface{}{"commands": commands, "timeout": timeout})
+	if err != nil {
+		return nil, err
+	}
+	s.used = true
+	logMessage(LogDebug, "vm-exec", "session request %s", line)
+	// The first request also waits for the login
+	limit := vmExecDeadline(timeout, len(commands)) + vmExecKillGrace
+
+	replies := make(chan []byte, 1)
+	go func() {
+		if _, err := s.stdin.Write(append(line, '\n')); err != nil {
+			close(replies)
+			return
+		}
+		reply, err := s.stdout.ReadBytes('\n')
+		if err != nil {
+			close(replies)
+			return
+		}
+		replies <- reply
+	}()
+
+	select {
+	case reply, ok := <-replies:
+		if !ok {
+			p.discard(s)
+			return nil, fmt.Errorf("vm-exec session ended\nOutput: %s", s.stderr.String())
+		}
+		var response sessionResponse
+		if err := json.Unmarshal(reply, &response); err != nil {
+			p.discard(s)
+			return nil, fmt.Errorf("failed to parse vm-exec output: %v", err)
+		}
+		if response.Error != "" {
+			p.discard(s)
+			err := fmt.Errorf("vm-exec failed: %s%s", response.Error, pausedHint(response.Error))
+			observeVMExecError(err)
+			return nil, err
+		}
+		return response.Results, nil
+	case <-ctx.Done():
+		p.discard(s)
+		return nil, fmt.Errorf("vm-exec cancelled")
+	case <-clock.After(limit):
+		p.discard(s)
+		return nil, fmt.Errorf("vm-exec session did not answer within %v and was discarded\nOutput: %s", limit, s.stderr.String())
+	}
+}
+
+// startSession starts vm-exec --serve with the arguments. It logs in while
+// the first request is already queued on its stdin.
+func startSession(key string, args, env []string) (*vmExecSession, error) {
+	vmExecPath, err := findVMExecBinary()
+	if err != nil {
+		return nil, fmt.Errorf("vm-exec binary not found: %v", err)
+	}
+	logMessage(LogDebug, "vm-exec", "%s %s --serve", vmExecPath, strings.Join(args, " "))
+
+	cmd := exec.Command(vmExecPath, append(args, "--serve", "--progress")...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &lockedBuffer{}
+	// The phases time the connection of the session
+	cmd.Stderr = &vmExecProgressWriter{output: stderr}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start vm-exec: %v", err)
+	}
+
+	return &vmExecSession{
+		key:      key,
+		cmd:      cmd,
+		stdin:    stdin,
+		stdout:   bufio.NewReader(stdout),
+		stderr:   stderr,
+		busy:     make(chan struct{}, 1),
+		lastUsed: clock.Now(),
+	}, nil
+}
+
+// discard removes the session from the pool and stops its vm-exec
+func (p *sessionPool) discard(s *vmExecSession) {
+	p.mu.Lock()
+	if p.sessions[s.key] == s {
+		delete(p.sessions, s.key)
+	}
+	p.mu.Unlock()
+	s.stop()
+}
+
+// stop ends the vm-exec of the session, which logs out by closing the
+// console connection
+func (s *vmExecSession) stop() {
+	s.stdin.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
+
+// evictLocked removes the least recently used idle session to make room for
+// a new one and returns it, nil when there is none. p.mu must be held; the
+// caller stops the session after releasing it.
+func (p *sessionPool) evictLocked() *vmExecSession {
+	var oldest *vmExecSession
+	for _, s := range p.sessions {
+		if len(s.busy) == 0 && (oldest == nil || s.lastUsed.Before(oldest.lastUsed)) {
+			oldest = s
+		}
+	}
+	if oldest != nil {
+		delete(p.sessions, oldest.key)
+	}
+	return oldest
+}
+
+// startSessionPool checks the session pool settings and starts closing the
+// idle sessions when the pool is enabled
+func startSessionPool() error {
+	config := serverConfig.Sessions
+	if config.PoolSize < 0 {
+		return fmt.Errorf("invalid session pool size %d", config.PoolSize)
+	}
+	if config.PoolSize == 0 {
+		return nil
+	}
+	if config.IdleTimeout < time.Second {
+		return fmt.Errorf("the session idle timeout must be at least 1s")
+	}
+	go vmExecSessions.closeIdle(config.IdleTimeout)
+	return nil
+}
+
+// closeIdle closes the sessions that were not used for the idle timeout
+func (p *sessionPool) closeIdle(idleTimeout time.Duration) {
+	for {
+		<-clock.After(idleTimeout / 2)
+
+		var idle []*vmExecSession
+		p.mu.Lock()
+		for key, s := range p.sessions {
+			if len(s.busy) == 0 && clock.Now().Sub(s.lastUsed) >= idleTimeout {
+				delete(p.sessions, key)
+				idle = append(idle, s)
+			}
+		}
+		p.mu.Unlock()
+		for _, s := range idle {
+			s.stop()
+		}
+	}
+}
+
+// closeAll stops every session, before the server exits
+func (p *sessionPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.sessions {
+		delete(p.sessions, key)
+		s.stop()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// errShuttingDown is the cause of the requests cancelled by a shutdown
+var errShuttingDown = errors.New("server shutting down")
+
+// serverCtx is the parent of every request context, cancelled with
+// errShuttingDown on SIGINT or SIGTERM
+var serverCtx, stopServer = context.WithCancelCause(context.Background())
+
+// handleSignals shuts the server down on the first SIGINT or SIGTERM and
+// exits right away on the second one
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, shutting down", sig)
+		stopServer(errShuttingDown)
+		sig = <-signals
+		log.Printf("Received %v again, exiting without waiting for the running requests", sig)
+		os.Exit(1)
+	}()
+}
+
+// shuttingDown reports whether a context was cancelled by a shutdown
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errShuttingDown)
+}
+
+// shutdownResponse answers a request cancelled by a shutdown, so the client
+// does not wait for it
+func shutdownResponse(req JSONRPCRequest) JSONRPCResponse {
+	return JSONRPCResponse{
+		JSONRPC: "2.0",
+		ID:      safeID(req.ID),
+		Error:   &RPCError{Code: -32603, Message: "Request cancelled: " + errShuttingDown.Error()},
+	}
+}
+
+// nextRequest returns the next request read from a stream, false once the
+// stream is closed or ctx is done, such as when the server shuts down
+func nextRequest(ctx context.Context, requests <-chan JSONRPCRequest) (JSONRPCRequest, bool) {
+	if ctx.Err() != nil {
+		return JSONRPCRequest{}, false
+	}
+	select {
+	case req, ok := <-requests:
+		return req, ok
+	case <-ctx.Done():
+		return JSONRPCRequest{}, false
+	}
+}
+
+// waitRequests waits for the running requests of a stream to send their
+// response. Once ctx is done, on shutdown or when a listener client
+// disconnects, they are already cancelled and get the shutdown timeout to
+// clean up; after stdin is closed they run to completion.
+func waitRequests(ctx context.Context, pending *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	select {
+	case <-done:
+	case <-clock.After(timeoutFor(timeoutShutdown)):
+		log.Printf("Requests still running after %v, exiting", timeoutFor(timeoutShutdown))
+	}
+}
+
+// closeServer releases what the server holds before exiting: the pooled
+// vm-exec sessions, the console sessions and the decrypted credentials
+func closeServer() {
+	vmExecSessions.closeAll()
+	closeConsoleSessions()
+	removeDecryptedCredentials()
+	closeAudit()
+	closeTracing()
+}
@@ -0,0 +1,2210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables of the simulation mode, see SimulationConfig
+const (
+	simulateEnv      = "KUBEVIRT_MCP_SIMULATE"
+	simulateModelEnv = "KUBEVIRT_MCP_SIMULATE_MODEL"
+)
+
+const (
+	// simulatedKubeVirtVersion is the version reported by the simulated
+	// KubeVirt CR
+	simulatedKubeVirtVersion = "v1.4.0-simulated"
+	// simulatedNodes is the number of nodes of the default model
+	simulatedNodes = 3
+)
+
+// simulatedSubresourceRegex matches the KubeVirt subresource paths used with
+// kubectl --raw
+var simulatedSubresourceRegex = regexp.MustCompile(`^/apis/subresources\.kubevirt\.io/v1/namespaces/([^/]+)/(virtualmachines|virtualmachineinstances)/([^/]+)/([^/]+)$`)
+
+// clusterScopedResources are the resources stored without a namespace
+var clusterScopedResources = map[string]bool{
+	"nodes":                           true,
+	"namespaces":                      true,
+	"priorityclasses":                 true,
+	"storageclasses":                  true,
+	"persistentvolumes":               true,
+	"apiservices":                     true,
+	"customresourcedefinitions":       true,
+	"validatingwebhookconfigurations": true,
+	"mutatingwebhookconfigurations":   true,
+	"clusterroles":                    true,
+	"clusterrolebindings":             true,
+
+	"virtualmachineclusterinstancetypes": true,
+	"virtualmachineclusterpreferences":   true,
+}
+
+// resourceAliases maps the short and singular names used with kubectl to the
+// plural resource names
+var resourceAliases = map[string]string{
+	"vm": "virtualmachines", "vms": "virtualmachines",
+	"vmi": "virtualmachineinstances", "vmis": "virtualmachineinstances",
+	"vmim": "virtualmachineinstancemigrations", "vmims": "virtualmachineinstancemigrations",
+	"vmsnapshot": "virtualmachinesnapshots", "vmsnapshots": "virtualmachinesnapshots",
+	"vmrestore": "virtualmachinerestores", "vmrestores": "virtualmachinerestores",
+	"dv": "datavolumes", "dvs": "datavolumes",
+	"pvc": "persistentvolumeclaims", "pvcs": "persistentvolumeclaims",
+	"po": "pods", "no": "nodes", "ns": "namespaces", "ev": "events",
+	"svc": "services", "ds": "daemonsets", "deploy": "deployments", "cm": "configmaps",
+	"kv": "kubevirts", "pdb": "poddisruptionbudgets", "sc": "storageclasses",
+	"endpoints": "endpoints",
+}
+
+// resourceGroups names the API group of the resources in kubectl messages
+var resourceGroups = map[string]string{
+	"virtualmachines":                  "kubevirt.io",
+	"virtualmachineinstances":          "kubevirt.io",
+	"virtualmachineinstancemigrations": "kubevirt.io",
+	"kubevirts":                        "kubevirt.io",
+	"virtualmachinesnapshots":          "snapshot.kubevirt.io",
+	"virtualmachinesnapshotcontents":   "snapshot.kubevirt.io",
+	"virtualmachinerestores":           "snapshot.kubevirt.io",
+	"datavolumes":                      "cdi.kubevirt.io",
+	"daemonsets":                       "apps",
+	"deployments":                      "apps",
+}
+
+// simulatedCluster is the in-memory model of a cluster used instead of
+// kubectl and vm-exec in simulation mode. Objects are stored as decoded
+// JSON, and controllers reconcile them after every change, so VMs start,
+// stop and migrate right away.
+type simulatedCluster struct {
+	mu sync.Mutex
+	// objects are keyed by resource, namespace and name
+	objects map[string]map[string]interface{}
+	serial  int
+}
+
+// simulation is the simulated cluster, nil unless in simulation mode
+var simulation *simulatedCluster
+
+// startSimulation builds the simulated cluster when simulation mode is on:
+// nodes, KubeVirt and the namespaces of the default model, then the objects
+// of the model file
+func startSimulation() error {
+	config := serverConfig.Simulation
+	if !config.Enabled {
+		if config.Model != "" {
+			return fmt.Errorf("the simulation model needs --simulate or %s", simulateEnv)
+		}
+		return nil
+	}
+	if fixtures != nil {
+		return errors.New("simulation cannot be combined with recording or replaying fixtures")
+	}
+
+	s := &simulatedCluster{objects: map[string]map[string]interface{}{}}
+	var model []map[string]interface{}
+	if config.Model != "" {
+		data, err := os.ReadFile(expandHome(config.Model))
+		if err != nil {
+			return fmt.Errorf("failed to read simulation model: %v", err)
+		}
+		if model, err = decodeSimulatedObjects(data); err != nil {
+			return fmt.Errorf("invalid simulation model %s: %v", config.Model, err)
+		}
+	}
+	s.seed(model)
+	for _, obj := range model {
+		if _, err := s.create(obj, "default", false); err != nil {
+			return fmt.Errorf("invalid simulation model %s: %v", config.Model, err)
+		}
+	}
+	s.reconcile()
+
+	simulation = s
+	logMessage(LogWarning, "simulation", "Simulating a cluster of %d nodes and %d VMs, no real cluster is used", len(s.list("nodes", "", true)), len(s.list("virtualmachines", "", true)))
+	return nil
+}
+
+// simulatedCommand runs a kubectl, vm-exec or virtctl invocation against the
+// simulated cluster, returning the output like recorded does
+func simulatedCommand(ctx context.Context, command string, args []string, input []byte) (string, string, error) {
+	if ctx.Err() != nil {
+		return "", "", fmt.Errorf("%s %s cancelled", command, strings.Join(args, " "))
+	}
+	simulation.mu.Lock()
+	defer simulation.mu.Unlock()
+
+	switch command {
+	case "kubectl":
+		output, err := simulation.kubectl(parseKubectlCall(args), input)
+		if err != nil {
+			return "", "", fmt.Errorf("kubectl %s failed: exit status 1\nOutput: %s", strings.Join(args, " "), err)
+		}
+		return output, "", nil
+	case "vm-exec":
+		stdout, err := simulation.vmExec(args)
+		if err != nil {
+			return "", "", fmt.Errorf("vm-exec failed: exit status 1\nOutput: %s", err)
+		}
+		return stdout, stdout, nil
+	}
+	return "", "", fmt.Errorf("%s is not available in simulation mode", command)
+}
+
+// kubectlCall is a parsed kubectl command line
+type kubectlCall struct {
+	verb           string
+	args           []string
+	namespace      string
+	allNamespaces  bool
+	output         string
+	selector       string
+	fieldSelector  string
+	ignoreNotFound bool
+	dryRun         bool
+	patchType      string
+	patch          string
+	raw            string
+	waitFor        string
+	fromFiles      []string
+	command        []string
+}
+
+// kubectlValueFlags are the flags taking a value as the next argument
+var kubectlValueFlags = map[string]bool{
+	"-n": true, "--namespace": true, "-o": true, "--output": true,
+	"-l": true, "--selector": true, "--field-selector": true,
+	"-p": true, "--patch": true, "--type": true, "--raw": true,
+	"--for": true, "--timeout": true, "--kubeconfig": true, "--context": true,
+	"-f": true, "--filename": true, "-c": true, "--container": true,
+	"--tail": true, "--since": true, "--since-time": true, "--field-manager": true,
+}
+
+// parseKubectlCall splits a kubectl command line into its verb, positional
+// arguments and the flags the simulation understands
+func parseKubectlCall(args []string) kubectlCall {
+	var call kubectlCall
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			call.command = args[i+1:]
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			if call.verb == "" {
+				call.verb = arg
+			} else {
+				call.args = append(call.args, arg)
+			}
+			continue
+		}
+		name, value, hasValue := strings.Cut(arg, "=")
+		if !hasValue && kubectlValueFlags[name] && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		switch name {
+		case "-n", "--namespace":
+			call.namespace = value
+		case "-A", "--all-namespaces":
+			call.allNamespaces = true
+		case "-o", "--output":
+			call.output = value
+		case "-l", "--selector":
+			call.selector = value
+		case "--field-selector":
+			call.fieldSelector = value
+		case "--ignore-not-found":
+			call.ignoreNotFound = value != "false"
+		case "--dry-run":
+			call.dryRun = value != "none"
+		case "--type":
+			call.patchType = value
+		case "-p", "--patch":
+			call.patch = value
+		case "--raw":
+			call.raw = value
+		case "--for":
+			call.waitFor = value
+		case "--from-file":
+			call.fromFiles = append(call.fromFiles, value)
+		}
+	}
+	return call
+}
+
+// kubectl runs a parsed kubectl call, s.mu must be held
+func (s *simulatedCluster) kubectl(call kubectlCall, input []byte) (string, error) {
+	namespace := call.namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	switch call.verb {
+	case "get":
+		if call.raw != "" {
+			return s.rawGet(call.raw)
+		}
+		return s.get(call, namespace)
+	case "create":
+		if call.raw != "" {
+			return s.rawPost(call.raw)
+		}
+		if len(call.args) >= 3 && call.args[0] == "secret" {
+			return s.createSecret(call, namespace)
+		}
+		return s.createManifest(call, input, namespace, false)
+	case "apply":
+		return s.createManifest(call, input, namespace, true)
+	case "replace":
+		if call.raw != "" {
+			return s.rawPut(call.raw, input)
+		}
+	case "delete":
+		return s.delete(call, namespace)
+	case "patch":
+		return s.patchObject(call, namespace)
+	case "annotate", "label":
+		return s.setMetadata(call, namespace)
+	case "wait":
+		return s.wait(call, namespace)
+	case "logs":
+		return s.logs(call, namespace)
+	case "exec":
+		if len(call.command) > 0 && call.command[0] == "date" {
+			now := clock.Now()
+			return fmt.Sprintf("%d.%09d\n", now.Unix(), now.Nanosecond()), nil
+		}
+		return "", nil
+	case "api-resources":
+		return simulatedAPIResources, nil
+	case "api-versions":
+		return "apps/v1\ncdi.kubevirt.io/v1beta1\nkubevirt.io/v1\nsnapshot.kubevirt.io/v1beta1\nv1\n", nil
+	case "cluster-info":
+		return "Kubernetes control plane is running at https://simulated-cluster:6443\n", nil
+	case "version":
+		return `{"clientVersion":{"gitVersion":"v1.31.0"},"serverVersion":{"gitVersion":"v1.31.0-simulated"}}` + "\n", nil
+	case "config":
+		return simulatedKubeconfig(call), nil
+	case "auth":
+		if len(call.args) > 0 && call.args[0] == "whoami" {
+			return "simulated-admin", nil
+		}
+		return "yes\n", nil
+	}
+	return "", fmt.Errorf("error: kubectl %s is not supported in simulation mode", call.verb)
+}
+
+// simulatedAPIResources is the api-resources listing of a Kubernetes
+// cluster with KubeVirt and CDI
+const simulatedAPIResources = `NAME                               SHORTNAMES   APIVERSION                      NAMESPACED   KIND
+namespaces                         ns           v1                              false        Namespace
+nodes                              no           v1                              false        Node
+pods                               po           v1                              true         Pod
+datavolumes                        dv,dvs       cdi.kubevirt.io/v1beta1         true         DataVolume
+kubevirts                          kv,kvs       kubevirt.io/v1                  true         KubeVirt
+virtualmachineinstancemigrations   vmim,vmims   kubevirt.io/v1                  true         VirtualMachineInstanceMigration
+virtualmachineinstances            vmi,vmis     kubevirt.io/v1                  true         VirtualMachineInstance
+virtualmachines                    vm,vms       kubevirt.io/v1                  true         VirtualMachine
+virtualmachinerestores             vmrestore    snapshot.kubevirt.io/v1beta1    true         VirtualMachineRestore
+virtualmachinesnapshots            vmsnapshot   snapshot.kubevirt.io/v1beta1    true         VirtualMachineSnapshot
+`
+
+// simulatedKubeconfig answers the kubectl config commands
+func simulatedKubeconfig(call kubectlCall) string {
+	if len(call.args) > 0 && call.args[0] == "view" {
+		return `{"contexts":[{"name":"simulated","context":{"cluster":"simulated","user":"simulated-admin"}}],"users":[{"name":"simulated-admin","user":{"token":"REDACTED"}}]}` + "\n"
+	}
+	return "simulated\n"
+}
+
+// resourceName returns the plural resource name of a kubectl resource
+// argument, such as vm, virtualmachine or virtualmachines.kubevirt.io
+func resourceName(resource string) string {
+	resource, _, _ = strings.Cut(strings.ToLower(resource), ".")
+	if alias, ok := resourceAliases[resource]; ok {
+		return alias
+	}
+	return pluralResource(resource)
+}
+
+// pluralResource returns the plural of a lower case resource or kind name
+func pluralResource(name string) string {
+	switch {
+	case strings.HasSuffix(name, "ss"):
+		return name + "es"
+	case strings.HasSuffix(name, "s"):
+		return name
+	case strings.HasSuffix(name, "y"):
+		return strings.TrimSuffix(name, "y") + "ies"
+	}
+	return name + "s"
+}
+
+// kindResource returns the resource of an object
+func kindResource(obj map[string]interface{}) string {
+	kind, _ := obj["kind"].(string)
+	return resourceName(kind)
+}
+
+// qualifiedResource names a resource like kubectl messages do, e.g.
+// virtualmachines.kubevirt.io
+func qualifiedResource(resource string) string {
+	if group, ok := resourceGroups[resource]; ok {
+		return resource + "." + group
+	}
+	return resource
+}
+
+// resourceArgs returns the resource and names of a call, written either as
+// "resource name..." or "resource/name"
+func resourceArgs(args []string) (string, []string) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if resource, name, ok := strings.Cut(args[0], "/"); ok {
+		return resourceName(resource), []string{name}
+	}
+	return resourceName(args[0]), args[1:]
+}
+
+func objectKey(resource, namespace, name string) string {
+	if clusterScopedResources[resource] {
+		namespace = ""
+	}
+	return resource + "/" + namespace + "/" + name
+}
+
+func notFound(resource, name string) error {
+	return fmt.Errorf("Error from server (NotFound): %s %q not found", qualifiedResource(resource), name)
+}
+
+// object returns a stored object, nil when it does not exist
+func (s *simulatedCluster) object(resource, namespace, name string) map[string]interface{} {
+	return s.objects[objectKey(resource, namespace, name)]
+}
+
+// list returns the objects of a resource in a namespace, or in every
+// namespace, sorted by namespace and name
+func (s *simulatedCluster) list(resource, namespace string, all bool) []map[string]interface{} {
+	var keys []string
+	prefix := resource + "/"
+	if !all && !clusterScopedResources[resource] {
+		prefix += namespace + "/"
+	}
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	objects := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, s.objects[key])
+	}
+	return objects
+}
+
+// store saves an object under its resource, namespace and name
+func (s *simulatedCluster) store(obj map[string]interface{}) {
+	metadata := objectMetadata(obj)
+	name, _ := metadata["name"].(string)
+	namespace, _ := metadata["namespace"].(string)
+	s.objects[objectKey(kindResource(obj), namespace, name)] = obj
+}
+
+// remove deletes an object and, like the garbage collector, the objects it
+// owns
+func (s *simulatedCluster) remove(resource, namespace, name string) {
+	key := objectKey(resource, namespace, name)
+	obj, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	delete(s.objects, key)
+	uid, _ := objectMetadata(obj)["uid"].(string)
+	for _, owned := range s.ownedBy(uid) {
+		metadata := objectMetadata(owned)
+		s.remove(kindResource(owned), stringField(metadata, "namespace"), stringField(metadata, "name"))
+	}
+}
+
+// ownedBy returns the objects with an owner reference to uid
+func (s *simulatedCluster) ownedBy(uid string) []map[string]interface{} {
+	var owned []map[string]interface{}
+	for _, obj := range s.objects {
+		refs, _ := objectMetadata(obj)["ownerReferences"].([]interface{})
+		for _, ref := range refs {
+			if ref, ok := ref.(map[string]interface{}); ok && ref["uid"] == uid {
+				owned = append(owned, obj)
+			}
+		}
+	}
+	return owned
+}
+
+// objectMetadata returns the metadata of an object, creating it if needed
+func objectMetadata(obj map[string]interface{}) map[string]interface{} {
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		obj["metadata"] = metadata
+	}
+	return metadata
+}
+
+// childMap returns the map under key, creating it if needed
+func childMap(m map[string]interface{}, key string) map[string]interface{} {
+	child, ok := m[key].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		m[key] = child
+	}
+	return child
+}
+
+// deepCopy copies a decoded JSON value
+func deepCopy(obj map[string]interface{}) map[string]interface{} {
+	data, _ := json.Marshal(obj)
+	var copied map[string]interface{}
+	json.Unmarshal(data, &copied)
+	return copied
+}
+
+// nextUID returns a new object UID
+func (s *simulatedCluster) nextUID() string {
+	s.serial++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", s.serial)
+}
+
+func simulatedTimestamp() string {
+	return clock.Now().UTC().Format(time.RFC3339)
+}
+
+// get answers kubectl get
+func (s *simulatedCluster) get(call kubectlCall, namespace string) (string, error) {
+	resource, names := resourceArgs(call.args)
+	if resource == "" {
+		return "", errors.New("error: you must specify the type of resource to get")
+	}
+
+	var objects []map[string]interface{}
+	single := len(names) == 1
+	if len(names) > 0 {
+		for _, name := range names {
+			obj := s.object(resource, namespace, name)
+			if obj == nil {
+				if call.ignoreNotFound {
+					continue
+				}
+				return "", notFound(resource, name)
+			}
+			objects = append(objects, obj)
+		}
+		if len(objects) == 0 {
+			return "", nil
+		}
+	} else {
+		for _, obj := range s.list(resource, namespace, call.allNamespaces) {
+			if matchesLabels(obj, call.selector) && matchesFields(obj, call.fieldSelector) {
+				objects = append(objects, obj)
+			}
+		}
+	}
+
+	var result interface{}
+	if single {
+		result = objects[0]
+	} else {
+		items := make([]interface{}, len(objects))
+		for i, obj := range objects {
+			items[i] = obj
+		}
+		result = map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items, "metadata": map[string]interface{}{}}
+	}
+
+	switch {
+	case call.output == "json":
+		data, err := json.MarshalIndent(result, "", "    ")
+		return string(data) + "\n", err
+	case call.output == "yaml":
+		data, err := yaml.Marshal(result)
+		return string(data), err
+	case call.output == "name":
+		var b strings.Builder
+		for _, obj := range objects {
+			fmt.Fprintf(&b, "%s/%s\n", qualifiedResource(resource), stringField(objectMetadata(obj), "name"))
+		}
+		return b.String(), nil
+	case strings.HasPrefix(call.output, "jsonpath="):
+		return evaluateJSONPath(result, strings.TrimPrefix(call.output, "jsonpath="))
+	}
+	if len(objects) == 0 {
+		return "", nil
+	}
+	return simulatedTable(objects, call.allNamespaces), nil
+}
+
+// simulatedTable renders objects like the default kubectl get output
+func simulatedTable(objects []map[string]interface{}, namespaces bool) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 3, ' ', 0)
+	if namespaces {
+		fmt.Fprint(w, "NAMESPACE\t")
+	}
+	fmt.Fprintln(w, "NAME\tSTATUS")
+	for _, obj := range objects {
+		metadata := objectMetadata(obj)
+		status, _ := obj["status"].(map[string]interface{})
+		phase := stringField(status, "printableStatus")
+		if phase == "" {
+			phase = stringField(status, "phase")
+		}
+		if namespaces {
+			fmt.Fprintf(w, "%s\t", stringField(metadata, "namespace"))
+		}
+		fmt.Fprintf(w, "%s\t%s\n", stringField(metadata, "name"), phase)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// evaluateJSONPath evaluates the simple JSONPath templates used by the
+// server, such as {.items[0].status.phase}
+func evaluateJSONPath(value interface{}, template string) (string, error) {
+	path := strings.TrimSuffix(strings.TrimPrefix(template, "{"), "}")
+	current := value
+	for _, part := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		if part == "" {
+			continue
+		}
+		field, index, indexed := strings.Cut(part, "[")
+		if field != "" {
+			m, _ := current.(map[string]interface{})
+			current = m[field]
+		}
+		if indexed {
+			items, _ := current.([]interface{})
+			i, err := strconv.Atoi(strings.TrimSuffix(index, "]"))
+			if err != nil {
+				return "", fmt.Errorf("error: unsupported JSONPath %s in simulation mode", template)
+			}
+			// Negative indices count from the end, like kubectl
+			if i < 0 {
+				i += len(items)
+			}
+			if i < 0 || i >= len(items) {
+				return "", fmt.Errorf("error: array index out of bounds: index %s, length %d", strings.TrimSuffix(index, "]"), len(items))
+			}
+			current = items[i]
+		}
+	}
+	switch v := current.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		data, err := json.Marshal(v)
+		return string(data), err
+	}
+}
+
+// matchesLabels reports whether an object matches an equality based label
+// selector such as app=web,tier!=db,debug
+func matchesLabels(obj map[string]interface{}, selector string) bool {
+	labels, _ := objectMetadata(obj)["labels"].(map[string]interface{})
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			if labels[key] == value {
+				return false
+			}
+			continue
+		}
+		if key, value, ok := strings.Cut(strings.Replace(term, "==", "=", 1), "="); ok {
+			if labels[key] != value {
+				return false
+			}
+			continue
+		}
+		if key, ok := strings.CutPrefix(term, "!"); ok {
+			if _, exists := labels[key]; exists {
+				return false
+			}
+			continue
+		}
+		if _, exists := labels[term]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesFields reports whether an object matches a field selector such as
+// type=Warning,involvedObject.name=vm1
+func matchesFields(obj map[string]interface{}, selector string) bool {
+	for _, term := range strings.Split(selector, ",") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		negate := strings.Contains(term, "!=")
+		key, value, _ := strings.Cut(strings.Replace(strings.Replace(term, "!=", "=", 1), "==", "=", 1), "=")
+		actual, _ := evaluateJSONPath(obj, "{."+strings.TrimSpace(key)+"}")
+		if (actual == value) == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeSimulatedObjects decodes the objects of a YAML or JSON manifest,
+// expanding List objects
+func decodeSimulatedObjects(data []byte) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("error: the manifest is not valid YAML or JSON: %v", err)
+		}
+		if len(obj) == 0 {
+			continue
+		}
+		// Round trip through JSON so numbers and maps have the types of
+		// decoded JSON
+		encoded, err := json.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("error: %v", err)
+		}
+		var normalized map[string]interface{}
+		json.Unmarshal(encoded, &normalized)
+		if items, ok := normalized["items"].([]interface{}); ok && strings.HasSuffix(stringField(normalized, "kind"), "List") {
+			for _, item := range items {
+				if item, ok := item.(map[string]interface{}); ok {
+					objects = append(objects, item)
+				}
+			}
+			continue
+		}
+		if stringField(normalized, "kind") == "" {
+			return nil, errors.New("error: Object 'Kind' is missing")
+		}
+		objects = append(objects, normalized)
+	}
+	return objects, nil
+}
+
+// createManifest answers kubectl create -f - and kubectl apply -f -
+func (s *simulatedCluster) createManifest(call kubectlCall, input []byte, namespace string, apply bool) (string, error) {
+	objects, err := decodeSimulatedObjects(input)
+	if err != nil {
+		return "", err
+	}
+	if len(objects) == 0 {
+		return "", errors.New("error: no objects passed to " + call.verb)
+	}
+
+	var lines []string
+	var results []interface{}
+	for _, obj := range objects {
+		resource := kindResource(obj)
+		metadata := objectMetadata(obj)
+		if stringField(metadata, "namespace") == "" && !clusterScopedResources[resource] {
+			metadata["namespace"] = namespace
+		}
+		var stored map[string]interface{}
+		action := "created"
+		existing := s.object(resource, stringField(metadata, "namespace"), stringField(metadata, "name"))
+		switch {
+		case apply && existing != nil:
+			stored, action = s.update(existing, obj, call.dryRun), "configured"
+		default:
+			if stored, err = s.create(obj, namespace, call.dryRun); err != nil {
+				return "", err
+			}
+		}
+		if apply {
+			action = "serverside-applied"
+		}
+		if !call.dryRun {
+			if apply {
+				manage(stored, "kubectl", "Apply", manifestFields(obj))
+			} else {
+				manage(stored, "kubectl-create", "Update", manifestFields(obj))
+			}
+		}
+		if call.dryRun {
+			action += " (server dry run)"
+		}
+		results = append(results, stored)
+		lines = append(lines, fmt.Sprintf("%s/%s %s", qualifiedResource(resource), stringField(objectMetadata(stored), "name"), action))
+	}
+	if !call.dryRun {
+		s.reconcile()
+	}
+
+	if call.output == "json" {
+		var result interface{} = results[0]
+		if len(results) > 1 {
+			result = map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": results}
+		}
+		data, err := json.MarshalIndent(result, "", "    ")
+		return string(data) + "\n", err
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// create stores a new object, setting the metadata the API server sets.
+// The object is only validated with dryRun.
+func (s *simulatedCluster) create(obj map[string]interface{}, namespace string, dryRun bool) (map[string]interface{}, error) {
+	obj = deepCopy(obj)
+	resource := kindResource(obj)
+	metadata := objectMetadata(obj)
+	if clusterScopedResources[resource] {
+		delete(metadata, "namespace")
+	} else if stringField(metadata, "namespace") == "" {
+		metadata["namespace"] = namespace
+	}
+	if stringField(metadata, "name") == "" {
+		prefix := stringField(metadata, "generateName")
+		if prefix == "" {
+			return nil, errors.New("error: resource name may not be empty")
+		}
+		s.serial++
+		metadata["name"] = fmt.Sprintf("%s%05x", prefix, s.serial)
+	}
+	name, ns := stringField(metadata, "name"), stringField(metadata, "namespace")
+	if ns != "" && s.object("namespaces", "", ns) == nil {
+		return nil, fmt.Errorf("Error from server (NotFound): namespaces %q not found", ns)
+	}
+	if s.object(resource, ns, name) != nil {
+		return nil, fmt.Errorf("Error from server (AlreadyExists): %s %q already exists", qualifiedResource(resource), name)
+	}
+
+	metadata["uid"] = s.nextUID()
+	metadata["creationTimestamp"] = simulatedTimestamp()
+	metadata["generation"] = 1
+	metadata["resourceVersion"] = strconv.Itoa(s.serial)
+	if dryRun {
+		return obj, nil
+	}
+	s.store(obj)
+	return obj, nil
+}
+
+// update replaces the fields of an existing object set by a manifest,
+// keeping its status and the metadata the API server sets
+func (s *simulatedCluster) update(existing, obj map[string]interface{}, dryRun bool) map[string]interface{} {
+	updated := deepCopy(existing)
+	for key, value := range obj {
+		switch key {
+		case "metadata", "status":
+		default:
+			updated[key] = value
+		}
+	}
+	metadata := objectMetadata(updated)
+	for _, key := range []string{"labels", "annotations"} {
+		if value, ok := objectMetadata(obj)[key]; ok {
+			metadata[key] = value
+		}
+	}
+	if !dryRun {
+		s.touch(updated)
+		s.store(updated)
+	}
+	return updated
+}
+
+// touch bumps the generation and resource version of a changed object
+func (s *simulatedCluster) touch(obj map[string]interface{}) {
+	s.serial++
+	metadata := objectMetadata(obj)
+	generation, _ := metadata["generation"].(float64)
+	if g, ok := metadata["generation"].(int); ok {
+		generation = float64(g)
+	}
+	metadata["generation"] = generation + 1
+	metadata["resourceVersion"] = strconv.Itoa(s.serial)
+}
+
+// manage records a write of a field manager in the managedFields of an
+// object, replacing the previous write of the manager with the operation
+func manage(obj map[string]interface{}, manager, operation string, fields map[string]interface{}) {
+	metadata := objectMetadata(obj)
+	entries, _ := metadata["managedFields"].([]interface{})
+	kept := entries[:0:0]
+	for _, entry := range entries {
+		if entry, _ := entry.(map[string]interface{}); entry["manager"] == manager && entry["operation"] == operation {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	metadata["managedFields"] = append(kept, map[string]interface{}{
+		"manager":    manager,
+		"operation":  operation,
+		"apiVersion": obj["apiVersion"],
+		"time":       simulatedTimestamp(),
+		"fieldsType": "FieldsV1",
+		"fieldsV1":   fields,
+	})
+}
+
+// fieldSet returns the fieldsV1 set of the fields of a value, lists are
+// owned as a whole
+func fieldSet(value interface{}) map[string]interface{} {
+	set := map[string]interface{}{}
+	if m, ok := value.(map[string]interface{}); ok {
+		for key, child := range m {
+			set["f:"+key] = fieldSet(child)
+		}
+	}
+	return set
+}
+
+// manifestFields returns the fieldsV1 set of the fields a manifest writes,
+// leaving out those identifying the object and the status
+func manifestFields(obj map[string]interface{}) map[string]interface{} {
+	written := map[string]interface{}{}
+	for key, value := range obj {
+		switch key {
+		case "apiVersion", "kind", "status":
+		case "metadata":
+			metadata := map[string]interface{}{}
+			for _, field := range []string{"labels", "annotations"} {
+				if value, ok := objectMetadata(obj)[field]; ok {
+					metadata[field] = value
+				}
+			}
+			written[key] = metadata
+		default:
+			written[key] = value
+		}
+	}
+	return fieldSet(written)
+}
+
+// pointerFields returns the fieldsV1 set of the JSON pointers of a JSON
+// patch
+func pointerFields(operations []interface{}) map[string]interface{} {
+	set := map[string]interface{}{}
+	for _, operation := range operations {
+		op, _ := operation.(map[string]interface{})
+		current := set
+		for _, part := range strings.Split(strings.TrimPrefix(stringField(op, "path"), "/"), "/") {
+			if _, err := strconv.Atoi(part); err == nil || part == "-" {
+				break
+			}
+			key := "f:" + strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+			if _, ok := current[key].(map[string]interface{}); !ok {
+				current[key] = map[string]interface{}{}
+			}
+			current = current[key].(map[string]interface{})
+		}
+	}
+	return set
+}
+
+// createSecret answers kubectl create secret generic NAME --from-file=...
+func (s *simulatedCluster) createSecret(call kubectlCall, namespace string) (string, error) {
+	data := map[string]interface{}{}
+	for _, source := range call.fromFiles {
+		key, path, ok := strings.Cut(source, "=")
+		if !ok {
+			path, key = source, source[strings.LastIndex(source, "/")+1:]
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error: %v", err)
+		}
+		data[key] = base64.StdEncoding.EncodeToString(content)
+	}
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": call.args[2], "namespace": namespace},
+		"type":       "Opaque",
+		"data":       data,
+	}
+	if _, err := s.create(secret, namespace, call.dryRun); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("secret/%s created\n", call.args[2]), nil
+}
+
+// delete answers kubectl delete
+func (s *simulatedCluster) delete(call kubectlCall, namespace string) (string, error) {
+	resource, names := resourceArgs(call.args)
+	var b strings.Builder
+	for _, name := range names {
+		if s.object(resource, namespace, name) == nil {
+			if call.ignoreNotFound {
+				continue
+			}
+			return "", notFound(resource, name)
+		}
+		if !call.dryRun {
+			s.remove(resource, namespace, name)
+		}
+		fmt.Fprintf(&b, "%s %q deleted\n", qualifiedResource(resource), name)
+	}
+	s.reconcile()
+	return b.String(), nil
+}
+
+// patchObject answers kubectl patch with a merge or JSON patch
+func (s *simulatedCluster) patchObject(call kubectlCall, namespace string) (string, error) {
+	resource, names := resourceArgs(call.args)
+	if len(names) != 1 {
+		return "", errors.New("error: patch needs one object")
+	}
+	existing := s.object(resource, namespace, names[0])
+	if existing == nil {
+		return "", notFound(resource, names[0])
+	}
+	var patch interface{}
+	if err := json.Unmarshal([]byte(call.patch), &patch); err != nil {
+		return "", fmt.Errorf("error: unable to parse %q: %v", call.patch, err)
+	}
+
+	patched := deepCopy(existing)
+	if call.patchType == "json" {
+		operations, _ := patch.([]interface{})
+		for _, operation := range operations {
+			if err := applyJSONPatch(patched, operation); err != nil {
+				return "", err
+			}
+		}
+		manage(patched, "kubectl-patch", "Update", pointerFields(operations))
+	} else {
+		patchMap, ok := patch.(map[string]interface{})
+		if !ok {
+			return "", errors.New("error: a merge patch must be an object")
+		}
+		mergePatch(patched, patchMap)
+		manage(patched, "kubectl-patch", "Update", fieldSet(patchMap))
+	}
+	s.touch(patched)
+	s.store(patched)
+	s.reconcile()
+	return fmt.Sprintf("%s/%s patched\n", qualifiedResource(resource), names[0]), nil
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to an object
+func mergePatch(target, patch map[string]interface{}) {
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			child, ok := target[key].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				target[key] = child
+			}
+			mergePatch(child, value)
+		default:
+			target[key] = value
+		}
+	}
+}
+
+// applyJSONPatch applies one add, replace or remove operation of a JSON
+// patch (RFC 6902)
+func applyJSONPatch(obj map[string]interface{}, operation interface{}) error {
+	op, _ := operation.(map[string]interface{})
+	pointer := stringField(op, "path")
+	parts := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+	}
+
+	var parent interface{} = obj
+	for _, part := range parts[:len(parts)-1] {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			parent = p[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(p) {
+				return fmt.Errorf("error: invalid patch path %s", pointer)
+			}
+			parent = p[i]
+		default:
+			return fmt.Errorf("error: the path %s does not exist", pointer)
+		}
+	}
+
+	last := parts[len(parts)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		switch stringField(op, "op") {
+		case "test":
+			if !reflect.DeepEqual(p[last], op["value"]) {
+				return fmt.Errorf("The request is invalid: the server rejected our request due to an error in our request: testing value %s failed", pointer)
+			}
+		case "remove":
+			delete(p, last)
+		default:
+			p[last] = op["value"]
+		}
+		return nil
+	case []interface{}:
+		// Arrays are changed in place through their parent, only appending
+		// with "-" and replacing elements are supported
+		if last == "-" && stringField(op, "op") == "add" {
+			return setJSONPointer(obj, parts[:len(parts)-1], append(p, op["value"]))
+		}
+		// add may also insert at the end, index len(p)
+		limit := len(p)
+		if stringField(op, "op") == "add" {
+			limit++
+		}
+		i, err := strconv.Atoi(last)
+		if err != nil || i < 0 || i >= limit {
+			return fmt.Errorf("error: invalid patch path %s", pointer)
+		}
+		switch stringField(op, "op") {
+		case "remove":
+			return setJSONPointer(obj, parts[:len(parts)-1], append(p[:i:i], p[i+1:]...))
+		case "add":
+			grown := append(p[:i:i], op["value"])
+			return setJSONPointer(obj, parts[:len(parts)-1], append(grown, p[i:]...))
+		}
+		p[i] = op["value"]
+		return nil
+	}
+	return fmt.Errorf("error: the path %s does not exist", pointer)
+}
+
+// setJSONPointer replaces the value at a path of map keys
+func setJSONPointer(obj map[string]interface{}, parts []string, value interface{}) error {
+	current := obj
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			current[part] = value
+			return nil
+		}
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("error: unsupported patch path /%s", strings.Join(parts, "/"))
+		}
+		current = next
+	}
+	return nil
+}
+
+// setMetadata answers kubectl annotate and kubectl label with key=value and
+// key- arguments
+func (s *simulatedCluster) setMetadata(call kubectlCall, namespace string) (string, error) {
+	if len(call.args) < 2 {
+		return "", fmt.Errorf("error: %s needs a resource and a name", call.verb)
+	}
+	resource, names := resourceArgs(call.args[:2])
+	values := call.args[2:]
+	if strings.Contains(call.args[0], "/") {
+		resource, names = resourceArgs(call.args[:1])
+		values = call.args[1:]
+	}
+	obj := s.object(resource, namespace, names[0])
+	if obj == nil {
+		return "", notFound(resource, names[0])
+	}
+	field := "annotations"
+	if call.verb == "label" {
+		field = "labels"
+	}
+	existing := childMap(objectMetadata(obj), field)
+	written := map[string]interface{}{}
+	for _, arg := range values {
+		if key, ok := strings.CutSuffix(arg, "-"); ok && !strings.Contains(arg, "=") {
+			delete(existing, key)
+		} else if key, value, ok := strings.Cut(arg, "="); ok {
+			existing[key] = value
+			written["f:"+key] = map[string]interface{}{}
+		}
+	}
+	manage(obj, "kubectl-"+call.verb, "Update", map[string]interface{}{"f:metadata": map[string]interface{}{"f:" + field: written}})
+	s.touch(obj)
+	s.reconcile()
+	return fmt.Sprintf("%s/%s %sed\n", qualifiedResource(resource), names[0], strings.TrimSuffix(call.verb, "e")), nil
+}
+
+// wait answers kubectl wait. The controllers reconcile right away, so the
+// condition either holds already or times out.
+func (s *simulatedCluster) wait(call kubectlCall, namespace string) (string, error) {
+	resource, names := resourceArgs(call.args)
+	if len(names) != 1 {
+		return "", errors.New("error: wait needs one object")
+	}
+	obj := s.object(resource, namespace, names[0])
+	timedOut := fmt.Errorf("error: timed out waiting for the condition on %s/%s", qualifiedResource(resource), names[0])
+	switch {
+	case call.waitFor == "delete":
+		if obj != nil {
+			return "", timedOut
+		}
+		return fmt.Sprintf("%s/%s condition met\n", qualifiedResource(resource), names[0]), nil
+	case obj == nil:
+		return "", notFound(resource, names[0])
+	case strings.HasPrefix(call.waitFor, "condition="):
+		if !hasCondition(obj, strings.TrimPrefix(call.waitFor, "condition=")) {
+			return "", timedOut
+		}
+	case strings.HasPrefix(call.waitFor, "jsonpath="):
+		path, want, _ := strings.Cut(strings.TrimPrefix(call.waitFor, "jsonpath="), "}=")
+		if got, _ := evaluateJSONPath(obj, path+"}"); got != want {
+			return "", timedOut
+		}
+	}
+	return fmt.Sprintf("%s/%s condition met\n", qualifiedResource(resource), names[0]), nil
+}
+
+// hasCondition reports whether an object has a True status condition
+func hasCondition(obj map[string]interface{}, conditionType string) bool {
+	status, _ := obj["status"].(map[string]interface{})
+	conditions, _ := status["conditions"].([]interface{})
+	for _, condition := range conditions {
+		condition, _ := condition.(map[string]interface{})
+		if strings.EqualFold(stringField(condition, "type"), conditionType) && stringField(condition, "status") == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// logs answers kubectl logs with a few lines of the simulated container
+func (s *simulatedCluster) logs(call kubectlCall, namespace string) (string, error) {
+	resource, names := "pods", call.args
+	if len(call.args) > 0 && strings.Contains(call.args[0], "/") {
+		resource, names = resourceArgs(call.args[:1])
+	}
+	if len(names) == 0 || s.object(resource, namespace, names[0]) == nil {
+		name := ""
+		if len(names) > 0 {
+			name = names[0]
+		}
+		return "", notFound(resource, name)
+	}
+	now := simulatedTimestamp()
+	return fmt.Sprintf("%s {\"component\":\"simulation\",\"level\":\"info\",\"msg\":\"simulated container of %s started\"}\n", now, names[0]), nil
+}
+
+// rawGet answers kubectl get --raw
+func (s *simulatedCluster) rawGet(path string) (string, error) {
+	if path == "/apis/subresources.kubevirt.io/v1/healthz" || path == "/healthz" || path == "/readyz" {
+		return "ok", nil
+	}
+	match := simulatedSubresourceRegex.FindStringSubmatch(path)
+	if match != nil && match[2] == "virtualmachineinstances" && match[4] == "guestosinfo" {
+		vmi := s.object("virtualmachineinstances", match[1], match[3])
+		if vmi == nil {
+			return "", notFound("virtualmachineinstances", match[3])
+		}
+		status := childMap(vmi, "status")
+		data, err := json.Marshal(map[string]interface{}{
+			"guestAgentVersion": "9.0.0",
+			"hostname":          match[3],
+			"os":                status["guestOSInfo"],
+			"timezone":          "UTC, 0",
+		})
+		return string(data), err
+	}
+	return "", fmt.Errorf("Error from server (NotFound): the server could not find the requested resource %s", path)
+}
+
+// rawPost answers kubectl create --raw, such as pod evictions
+func (s *simulatedCluster) rawPost(path string) (string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	// /api/v1/namespaces/NS/pods/NAME/eviction
+	if len(parts) == 7 && parts[4] == "pods" && parts[6] == "eviction" {
+		pod := s.object("pods", parts[3], parts[5])
+		if pod == nil {
+			return "", notFound("pods", parts[5])
+		}
+		vmiName := stringField(childMap(objectMetadata(pod), "labels"), "kubevirt.io/vm")
+		if vmi := s.object("virtualmachineinstances", parts[3], vmiName); vmi != nil {
+			if stringField(childMap(vmi, "spec"), "evictionStrategy") == "LiveMigrate" {
+				s.startMigration(vmi, "evacuation")
+				s.reconcile()
+				return "", errors.New("Error from server (TooManyRequests): evacuation in progress")
+			}
+		}
+		s.remove("pods", parts[3], parts[5])
+		s.reconcile()
+		return "{}", nil
+	}
+	return "", fmt.Errorf("Error from server (NotFound): the server could not find the requested resource %s", path)
+}
+
+// rawPut answers the KubeVirt subresources called with kubectl replace --raw
+func (s *simulatedCluster) rawPut(path string, input []byte) (string, error) {
+	match := simulatedSubresourceRegex.FindStringSubmatch(path)
+	if match == nil {
+		return "", fmt.Errorf("Error from server (NotFound): the server could not find the requested resource %s", path)
+	}
+	namespace, kind, name, subresource := match[1], match[2], match[3], match[4]
+	obj := s.object(kind, namespace, name)
+	if obj == nil {
+		return "", notFound(kind, name)
+	}
+	var body map[string]interface{}
+	json.Unmarshal(input, &body)
+
+	vm := s.object("virtualmachines", namespace, name)
+	vmi := s.object("virtualmachineinstances", namespace, name)
+	notRunning := fmt.Errorf("Error from server (Conflict): Operation cannot be fulfilled on virtualmachineinstance.kubevirt.io %q: VMI is not running", name)
+
+	switch subresource {
+	case "start", "stop", "restart":
+		if vm == nil {
+			return "", notFound("virtualmachines", name)
+		}
+		spec := childMap(vm, "spec")
+		delete(spec, "running")
+		switch subresource {
+		case "start":
+			if vmi != nil {
+				return "", fmt.Errorf("Error from server (Conflict): VM %q is already running", name)
+			}
+			spec["runStrategy"] = "Always"
+		case "stop":
+			if vmi == nil {
+				return "", fmt.Errorf("Error from server (Conflict): VM %q is not running", name)
+			}
+			spec["runStrategy"] = "Halted"
+		case "restart":
+			if vmi == nil {
+				return "", fmt.Errorf("Error from server (Conflict): VM %q is not running", name)
+			}
+			s.remove("virtualmachineinstances", namespace, name)
+		}
+		if subresource != "restart" {
+			manage(vm, "virt-api", "Update", fieldSet(map[string]interface{}{"spec": map[string]interface{}{"runStrategy": nil}}))
+		}
+		s.touch(vm)
+	case "pause", "unpause", "freeze", "unfreeze", "softreboot":
+		if vmi == nil || stringField(childMap(vmi, "status"), "phase") != "Running" {
+			return "", notRunning
+		}
+		conditionType := map[string]string{"pause": "Paused", "unpause": "Paused", "freeze": "Frozen", "unfreeze": "Frozen"}[subresource]
+		if conditionType != "" {
+			setCondition(vmi, conditionType, subresource == "pause" || subresource == "freeze", "")
+			if conditionType == "Frozen" {
+				status := childMap(vmi, "status")
+				status["fsFreezeStatus"] = map[bool]string{true: "frozen", false: ""}[subresource == "freeze"]
+			}
+		}
+		reason := map[string]string{"pause": "Paused", "unpause": "Unpaused", "freeze": "Frozen", "unfreeze": "Unfrozen", "softreboot": "SoftRebooted"}[subresource]
+		s.event(vmi, "Normal", reason, fmt.Sprintf("VirtualMachineInstance %s %s", name, subresource))
+	case "addvolume", "removevolume":
+		volumeName := stringField(body, "name")
+		if volumeName == "" {
+			return "", errors.New("Error from server (BadRequest): the volume name is required")
+		}
+		for _, target := range []map[string]interface{}{vmi, vm} {
+			if target == nil {
+				continue
+			}
+			spec := childMap(target, "spec")
+			if stringField(target, "kind") == "VirtualMachine" {
+				spec = childMap(childMap(spec, "template"), "spec")
+			}
+			volumes, _ := spec["volumes"].([]interface{})
+			kept := volumes[:0:0]
+			for _, volume := range volumes {
+				if volume, _ := volume.(map[string]interface{}); stringField(volume, "name") != volumeName {
+					kept = append(kept, volume)
+				}
+			}
+			if subresource == "addvolume" {
+				source, _ := body["volumeSource"].(map[string]interface{})
+				volume := map[string]interface{}{"name": volumeName}
+				for key, value := range source {
+					volume[key] = value
+				}
+				kept = append(kept, volume)
+			}
+			spec["volumes"] = kept
+		}
+	case "memorydump", "removememorydump":
+		if vm == nil {
+			return "", notFound("virtualmachines", name)
+		}
+		status := childMap(vm, "status")
+		if subresource == "removememorydump" {
+			delete(status, "memoryDumpRequest")
+		} else {
+			status["memoryDumpRequest"] = map[string]interface{}{
+				"claimName":      body["claimName"],
+				"phase":          "Completed",
+				"startTimestamp": simulatedTimestamp(),
+				"endTimestamp":   simulatedTimestamp(),
+				"fileName":       fmt.Sprintf("%s-%s.memory.dump", name, clock.Now().UTC().Format("20060102-150405")),
+			}
+		}
+	case "migrate":
+		if vmi == nil {
+			return "", notRunning
+		}
+		s.startMigration(vmi, "")
+	default:
+		return "", fmt.Errorf("Error from server (NotFound): the subresource %s is not simulated", subresource)
+	}
+	s.reconcile()
+	return "", nil
+}
+
+// setCondition sets a status condition of an object
+func setCondition(obj map[string]interface{}, conditionType string, value bool, reason string) {
+	status := childMap(obj, "status")
+	conditions, _ := status["conditions"].([]interface{})
+	state := "False"
+	if value {
+		state = "True"
+	}
+	for _, condition := range conditions {
+		if condition, _ := condition.(map[string]interface{}); stringField(condition, "type") == conditionType {
+			if stringField(condition, "status") != state {
+				condition["lastTransitionTime"] = simulatedTimestamp()
+			}
+			condition["status"] = state
+			condition["reason"] = reason
+			return
+		}
+	}
+	status["conditions"] = append(conditions, map[string]interface{}{
+		"type":               conditionType,
+		"status":             state,
+		"reason":             reason,
+		"lastTransitionTime": simulatedTimestamp(),
+	})
+}
+
+// event records an event about an object
+func (s *simulatedCluster) event(obj map[string]interface{}, eventType, reason, message string) {
+	metadata := objectMetadata(obj)
+	now := simulatedTimestamp()
+	s.serial++
+	s.store(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]interface{}{
+			"name":              fmt.Sprintf("%s.%x", stringField(metadata, "name"), s.serial),
+			"namespace":         stringField(metadata, "namespace"),
+			"uid":               s.nextUID(),
+			"creationTimestamp": now,
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": obj["apiVersion"],
+			"kind":       obj["kind"],
+			"name":       metadata["name"],
+			"namespace":  metadata["namespace"],
+			"uid":        metadata["uid"],
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"count":          1,
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"source":         map[string]interface{}{"component": "virt-controller"},
+	})
+}
+
+// ownerReference returns a controller owner reference to obj
+func ownerReference(obj map[string]interface{}) []interface{} {
+	metadata := objectMetadata(obj)
+	return []interface{}{map[string]interface{}{
+		"apiVersion":         obj["apiVersion"],
+		"kind":               obj["kind"],
+		"name":               metadata["name"],
+		"uid":                metadata["uid"],
+		"controller":         true,
+		"blockOwnerDeletion": true,
+	}}
+}
+
+// reconcile runs the controllers of the simulated cluster until the objects
+// match their spec
+func (s *simulatedCluster) reconcile() {
+	for _, vm := range s.list("virtualmachines", "", true) {
+		s.reconcileVM(vm)
+	}
+	for _, vmi := range s.list("virtualmachineinstances", "", true) {
+		reconcileVolumeStatus(vmi)
+	}
+	for _, migration := range s.list("virtualmachineinstancemigrations", "", true) {
+		status := childMap(migration, "status")
+		if stringField(status, "phase") == "" {
+			s.runMigration(migration)
+		}
+	}
+	for _, snapshot := range s.list("virtualmachinesnapshots", "", true) {
+		s.reconcileSnapshot(snapshot)
+	}
+	for _, restore := range s.list("virtualmachinerestores", "", true) {
+		s.reconcileRestore(restore)
+	}
+	for _, dv := range s.list("datavolumes", "", true) {
+		s.reconcileDataVolume(dv)
+	}
+	for _, pvc := range s.list("persistentvolumeclaims", "", true) {
+		childMap(pvc, "status")["phase"] = "Bound"
+	}
+	for _, pod := range s.list("pods", "", true) {
+		status := childMap(pod, "status")
+		if stringField(status, "phase") != "" {
+			continue
+		}
+		status["phase"] = "Running"
+		if policy := stringField(childMap(pod, "spec"), "restartPolicy"); policy == "Never" || policy == "OnFailure" {
+			status["phase"] = "Succeeded"
+		}
+		status["startTime"] = simulatedTimestamp()
+		setCondition(pod, "Ready", status["phase"] == "Running", "")
+		if stringField(childMap(pod, "spec"), "nodeName") == "" {
+			childMap(pod, "spec")["nodeName"] = s.pickNode("")
+		}
+	}
+	for _, ds := range s.list("daemonsets", "", true) {
+		nodes := len(s.list("nodes", "", true))
+		status := childMap(ds, "status")
+		for _, field := range []string{"desiredNumberScheduled", "currentNumberScheduled", "numberReady", "numberAvailable", "updatedNumberScheduled"} {
+			status[field] = nodes
+		}
+	}
+	for _, deployment := range s.list("deployments", "", true) {
+		replicas, ok := childMap(deployment, "spec")["replicas"].(float64)
+		if !ok {
+			replicas = 1
+		}
+		status := childMap(deployment, "status")
+		for _, field := range []string{"replicas", "readyReplicas", "availableReplicas", "updatedReplicas"} {
+			status[field] = replicas
+		}
+	}
+	for _, namespace := range s.list("namespaces", "", true) {
+		childMap(namespace, "status")["phase"] = "Active"
+	}
+}
+
+// vmRunning reports whether the run strategy of a VM asks for a VMI
+func vmRunning(vm map[string]interface{}) bool {
+	spec := childMap(vm, "spec")
+	if running, ok := spec["running"].(bool); ok {
+		return running
+	}
+	switch stringField(spec, "runStrategy") {
+	case "Always", "RerunOnFailure", "Once":
+		return true
+	}
+	return false
+}
+
+// reconcileVM starts or stops the VMI of a VM and updates its status
+func (s *simulatedCluster) reconcileVM(vm map[string]interface{}) {
+	metadata := objectMetadata(vm)
+	namespace, name := stringField(metadata, "namespace"), stringField(metadata, "name")
+	vmi := s.object("virtualmachineinstances", namespace, name)
+	manual := stringField(childMap(vm, "spec"), "runStrategy") == "Manual"
+	s.pinInstancetypes(vm)
+
+	switch {
+	case vmRunning(vm) && vmi == nil:
+		vmi = s.startVMI(vm)
+	case !vmRunning(vm) && !manual && vmi != nil:
+		s.remove("virtualmachineinstances", namespace, name)
+		s.event(vm, "Normal", "SuccessfulDelete", "Stopped the virtual machine by deleting the virtual machine instance "+name)
+		vmi = nil
+	}
+
+	status := childMap(vm, "status")
+	status["created"] = vmi != nil
+	status["ready"] = vmi != nil
+	status["printableStatus"] = "Stopped"
+	if vmi != nil {
+		status["printableStatus"] = "Running"
+		if hasCondition(vmi, "Paused") {
+			status["printableStatus"] = "Paused"
+			status["ready"] = false
+		}
+		migration, _ := childMap(vmi, "status")["migrationState"].(map[string]interface{})
+		if migration != nil && migration["completed"] != true {
+			status["printableStatus"] = "Migrating"
+		}
+	}
+	status["runStrategy"] = stringField(childMap(vm, "spec"), "runStrategy")
+	if status["runStrategy"] == "" {
+		status["runStrategy"] = map[bool]string{true: "Always", false: "Halted"}[vmRunning(vm)]
+	}
+	setCondition(vm, "Ready", status["ready"] == true, "")
+	setCondition(vm, "Paused", vmi != nil && hasCondition(vmi, "Paused"), "")
+	status["observedGeneration"] = metadata["generation"]
+	status["desiredGeneration"] = metadata["generation"]
+}
+
+// startVMI creates the VMI and virt-launcher pod of a VM
+func (s *simulatedCluster) startVMI(vm map[string]interface{}) map[string]interface{} {
+	metadata := objectMetadata(vm)
+	namespace, name := stringField(metadata, "namespace"), stringField(metadata, "name")
+	template := deepCopy(childMap(childMap(vm, "spec"), "template"))
+	labels := childMap(objectMetadata(template), "labels")
+	labels["kubevirt.io/domain"] = name
+	labels["kubevirt.io/nodeName"] = ""
+
+	vmi := map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstance",
+		"metadata": map[string]interface{}{
+			"name":            name,
+			"namespace":       namespace,
+			"labels":          labels,
+			"annotations":     objectMetadata(template)["annotations"],
+			"ownerReferences": ownerReference(vm),
+		},
+		"spec": childMap(template, "spec"),
+	}
+	vmi, _ = s.create(vmi, namespace, false)
+	s.startRevision(vm)
+
+	node := s.pickNode("")
+	labels["kubevirt.io/nodeName"] = node
+	s.serial++
+	status := childMap(vmi, "status")
+	status["phase"] = "Running"
+	status["nodeName"] = node
+	status["qosClass"] = "Burstable"
+	status["migrationMethod"] = "BlockMigration"
+	status["launcherContainerImageVersion"] = "quay.io/kubevirt/virt-launcher:" + simulatedKubeVirtVersion
+	status["guestOSInfo"] = simulatedGuestOS(stringField(labels, "kubevirt.io/os"))
+	status["interfaces"] = []interface{}{map[string]interface{}{
+		"name":          "default",
+		"ipAddress":     fmt.Sprintf("10.244.%d.%d", s.serial/250%250, s.serial%250+2),
+		"ipAddresses":   []interface{}{fmt.Sprintf("10.244.%d.%d", s.serial/250%250, s.serial%250+2)},
+		"interfaceName": "eth0",
+		"infoSource":    "domain, guest-agent",
+	}}
+	status["phaseTransitionTimestamps"] = []interface{}{
+		map[string]interface{}{"phase": "Pending", "phaseTransitionTimestamp": simulatedTimestamp()},
+		map[string]interface{}{"phase": "Scheduled", "phaseTransitionTimestamp": simulatedTimestamp()},
+		map[string]interface{}{"phase": "Running", "phaseTransitionTimestamp": simulatedTimestamp()},
+	}
+	setCondition(vmi, "Ready", true, "")
+	setCondition(vmi, "LiveMigratable", true, "")
+	setCondition(vmi, "AgentConnected", true, "")
+	s.startLauncher(vmi, node)
+
+	s.event(vm, "Normal", "SuccessfulCreate", "Started the virtual machine by creating the new virtual machine instance "+name)
+	s.event(vmi, "Normal", "Started", "VirtualMachineInstance started.")
+	return vmi
+}
+
+// startRevision stores the ControllerRevision virt-controller keeps of the
+// spec a VM was started with
+func (s *simulatedCluster) startRevision(vm map[string]interface{}) {
+	metadata := objectMetadata(vm)
+	generation, _ := metadata["generation"].(float64)
+	if g, ok := metadata["generation"].(int); ok {
+		generation = float64(g)
+	}
+	name := fmt.Sprintf("revision-start-vm-%s-%d", stringField(metadata, "uid"), int(generation))
+	namespace := stringField(metadata, "namespace")
+	if s.object("controllerrevisions", namespace, name) != nil {
+		return
+	}
+	s.create(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "ControllerRevision",
+		"metadata": map[string]interface{}{
+			"name":            name,
+			"namespace":       namespace,
+			"ownerReferences": ownerReference(vm),
+		},
+		"data":     map[string]interface{}{"spec": deepCopy(childMap(vm, "spec"))},
+		"revision": int(generation),
+	}, namespace, false)
+}
+
+// pinInstancetypes stores a ControllerRevision of the current instance type
+// and preference of a VM not pinned yet, and pins the VM to it
+func (s *simulatedCluster) pinInstancetypes(vm map[string]interface{}) {
+	metadata := objectMetadata(vm)
+	namespace := stringField(metadata, "namespace")
+	for _, m := range instancetypeMatchers {
+		matcher, ok := childMap(vm, "spec")[m.field].(map[string]interface{})
+		if !ok || stringField(matcher, "revisionName") != "" {
+			continue
+		}
+		kind := stringField(matcher, "kind")
+		if kind == "" {
+			kind = m.defaultKind
+		}
+		object := s.object(resourceName(kind), namespace, stringField(matcher, "name"))
+		if object == nil {
+			continue
+		}
+		objectMeta := objectMetadata(object)
+		generation := 1
+		if g, ok := objectMeta["generation"].(float64); ok {
+			generation = int(g)
+		} else if g, ok := objectMeta["generation"].(int); ok {
+			generation = g
+		}
+		name := fmt.Sprintf("%s-%s-%s-%d", stringField(metadata, "name"), stringField(objectMeta, "name"), stringField(objectMeta, "uid"), generation)
+		if s.object("controllerrevisions", namespace, name) == nil {
+			s.create(map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "ControllerRevision",
+				"metadata": map[string]interface{}{
+					"name":            name,
+					"namespace":       namespace,
+					"ownerReferences": ownerReference(vm),
+					"labels": map[string]interface{}{
+						revisionObjectNameLabel:       stringField(objectMeta, "name"),
+						revisionObjectKindLabel:       kind,
+						revisionObjectGenerationLabel: strconv.Itoa(generation),
+						revisionObjectVersionLabel:    stringField(object, "apiVersion"),
+					},
+				},
+				"data":     deepCopy(object),
+				"revision": 1,
+			}, namespace, false)
+		}
+		matcher["revisionName"] = name
+		manage(vm, "virt-controller", "Update", map[string]interface{}{
+			"f:spec": map[string]interface{}{"f:" + m.field: map[string]interface{}{"f:revisionName": map[string]interface{}{}}},
+		})
+	}
+}
+
+// simulatedGuestOS returns the guest OS info of a VMI labeled with os, a
+// Fedora guest when it has no label
+func simulatedGuestOS(os string) map[string]interface{} {
+	if os == "" || os == "fedora" {
+		return map[string]interface{}{"id": "fedora", "name": "Fedora Linux", "version": "40", "prettyName": "Fedora Linux 40 (Cloud Edition)", "kernelRelease": "6.8.5-301.fc40.x86_64"}
+	}
+	if strings.HasPrefix(os, "win") {
+		return map[string]interface{}{"id": "mswindows", "name": "Microsoft Windows", "version": "2022", "prettyName": "Windows Server 2022 Datacenter", "kernelRelease": "20348"}
+	}
+	return map[string]interface{}{"id": os, "name": strings.ToUpper(os[:1]) + os[1:], "prettyName": strings.ToUpper(os[:1]) + os[1:] + " (simulated)", "kernelRelease": "6.8.0"}
+}
+
+// reconcileVolumeStatus reports every volume of a VMI as attached, hotplugged
+// volumes included
+func reconcileVolumeStatus(vmi map[string]interface{}) {
+	volumes, _ := childMap(vmi, "spec")["volumes"].([]interface{})
+	statuses := make([]interface{}, 0, len(volumes))
+	for i, volume := range volumes {
+		volume, _ := volume.(map[string]interface{})
+		statuses = append(statuses, map[string]interface{}{
+			"name":   volume["name"],
+			"target": fmt.Sprintf("vd%c", 'a'+i%26),
+			"phase":  hotplugReady,
+		})
+	}
+	childMap(vmi, "status")["volumeStatus"] = statuses
+}
+
+// startLauncher creates the virt-launcher pod of a VMI on a node
+func (s *simulatedCluster) startLauncher(vmi map[string]interface{}, node string) {
+	metadata := objectMetadata(vmi)
+	s.serial++
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":      fmt.Sprintf("virt-launcher-%s-%05x", metadata["name"], s.serial),
+			"namespace": metadata["namespace"],
+			"labels": map[string]interface{}{
+				"kubevirt.io":            "virt-launcher",
+				"kubevirt.io/created-by": metadata["uid"],
+				"kubevirt.io/vm":         metadata["name"],
+				"vm.kubevirt.io/name":    metadata["name"],
+			},
+			"ownerReferences": ownerReference(vmi),
+		},
+		"spec": map[string]interface{}{
+			"nodeName":   node,
+			"containers": []interface{}{map[string]interface{}{"name": computeContainer, "image": "quay.io/kubevirt/virt-launcher:" + simulatedKubeVirtVersion}},
+		},
+	}
+	if pod, err := s.create(pod, stringField(metadata, "namespace"), false); err == nil {
+		status := childMap(pod, "status")
+		status["phase"] = "Running"
+		status["startTime"] = simulatedTimestamp()
+		status["containerStatuses"] = []interface{}{map[string]interface{}{"name": computeContainer, "ready": true, "restartCount": 0}}
+		setCondition(pod, "Ready", true, "")
+		childMap(vmi, "status")["activePods"] = map[string]interface{}{stringField(objectMetadata(pod), "uid"): node}
+	}
+}
+
+// pickNode returns the ready node running the fewest VMIs, other than
+// exclude
+func (s *simulatedCluster) pickNode(exclude string) string {
+	load := map[string]int{}
+	for _, vmi := range s.list("virtualmachineinstances", "", true) {
+		load[stringField(childMap(vmi, "status"), "nodeName")]++
+	}
+	best := ""
+	for _, node := range s.list("nodes", "", true) {
+		name := stringField(objectMetadata(node), "name")
+		if name == exclude || childMap(node, "spec")["unschedulable"] == true {
+			continue
+		}
+		if best == "" || load[name] < load[best] {
+			best = name
+		}
+	}
+	return best
+}
+
+// startMigration creates a migration of a VMI, like an eviction does
+func (s *simulatedCluster) startMigration(vmi map[string]interface{}, prefix string) {
+	metadata := objectMetadata(vmi)
+	if prefix == "" {
+		prefix = "migrate"
+	}
+	s.create(map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstanceMigration",
+		"metadata":   map[string]interface{}{"generateName": fmt.Sprintf("kubevirt-%s-%s-", prefix, metadata["name"]), "namespace": metadata["namespace"]},
+		"spec":       map[string]interface{}{"vmiName": metadata["name"]},
+	}, stringField(metadata, "namespace"), false)
+}
+
+// runMigration moves the VMI of a migration to another node
+func (s *simulatedCluster) runMigration(migration map[string]interface{}) {
+	metadata := objectMetadata(migration)
+	namespace := stringField(metadata, "namespace")
+	vmiName := stringField(childMap(migration, "spec"), "vmiName")
+	status := childMap(migration, "status")
+	vmi := s.object("virtualmachineinstances", namespace, vmiName)
+	now := simulatedTimestamp()
+
+	source := ""
+	if vmi != nil {
+		source = stringField(childMap(vmi, "status"), "nodeName")
+	}
+	target := s.pickNode(source)
+	if vmi == nil || target == "" || !hasCondition(vmi, "LiveMigratable") {
+		status["phase"] = "Failed"
+		s.event(migration, "Warning", "FailedMigration", fmt.Sprintf("VirtualMachineInstance %s cannot be migrated", vmiName))
+		return
+	}
+
+	for _, pod := range s.list("pods", namespace, false) {
+		if childMap(objectMetadata(pod), "labels")["kubevirt.io/created-by"] == objectMetadata(vmi)["uid"] {
+			s.remove("pods", namespace, stringField(objectMetadata(pod), "name"))
+		}
+	}
+	s.startLauncher(vmi, target)
+	vmiStatus := childMap(vmi, "status")
+	vmiStatus["nodeName"] = target
+	childMap(objectMetadata(vmi), "labels")["kubevirt.io/nodeName"] = target
+	vmiStatus["migrationState"] = map[string]interface{}{
+		"migrationUid":   metadata["uid"],
+		"sourceNode":     source,
+		"targetNode":     target,
+		"startTimestamp": now,
+		"endTimestamp":   now,
+		"completed":      true,
+		"failed":         false,
+		"mode":           "PreCopy",
+	}
+	status["phase"] = "Succeeded"
+	status["phaseTransitionTimestamps"] = []interface{}{
+		map[string]interface{}{"phase": "Scheduling", "phaseTransitionTimestamp": now},
+		map[string]interface{}{"phase": "Running", "phaseTransitionTimestamp": now},
+		map[string]interface{}{"phase": "Succeeded", "phaseTransitionTimestamp": now},
+	}
+	status["migrationState"] = vmiStatus["migrationState"]
+	s.event(vmi, "Normal", "Migrated", fmt.Sprintf("The VirtualMachineInstance migrated to node %s.", target))
+}
+
+// reconcileSnapshot completes a snapshot, saving the spec of its VM
+func (s *simulatedCluster) reconcileSnapshot(snapshot map[string]interface{}) {
+	status := childMap(snapshot, "status")
+	if status["readyToUse"] == true {
+		return
+	}
+	metadata := objectMetadata(snapshot)
+	namespace := stringField(metadata, "namespace")
+	source := childMap(childMap(snapshot, "spec"), "source")
+	vm := s.object("virtualmachines", namespace, stringField(source, "name"))
+	if vm == nil {
+		status["phase"] = "Failed"
+		status["error"] = map[string]interface{}{"message": fmt.Sprintf("VirtualMachine %q not found", source["name"])}
+		return
+	}
+
+	content, err := s.create(map[string]interface{}{
+		"apiVersion": "snapshot.kubevirt.io/v1beta1",
+		"kind":       "VirtualMachineSnapshotContent",
+		"metadata": map[string]interface{}{
+			"name":            "vmsnapshot-content-" + strings.TrimPrefix(stringField(metadata, "uid"), "00000000-0000-4000-8000-"),
+			"namespace":       namespace,
+			"ownerReferences": ownerReference(snapshot),
+		},
+		"spec": map[string]interface{}{
+			"source":                     map[string]interface{}{"virtualMachine": map[string]interface{}{"spec": deepCopy(childMap(vm, "spec"))}},
+			"virtualMachineSnapshotName": metadata["name"],
+		},
+	}, namespace, false)
+	if err != nil {
+		return
+	}
+	indication := "Offline"
+	if s.object("virtualmachineinstances", namespace, stringField(source, "name")) != nil {
+		indication = "Online"
+	}
+	status["phase"] = "Succeeded"
+	status["readyToUse"] = true
+	status["creationTime"] = simulatedTimestamp()
+	status["sourceUID"] = objectMetadata(vm)["uid"]
+	status["indications"] = []interface{}{indication}
+	status["virtualMachineSnapshotContentName"] = objectMetadata(content)["name"]
+	setCondition(snapshot, "Ready", true, "Operation complete")
+	setCondition(snapshot, "Progressing", false, "Operation complete")
+	s.event(vm, "Normal", "SuccessfulVirtualMachineSnapshot", "Successfully completed VirtualMachineSnapshot "+stringField(metadata, "name"))
+}
+
+// reconcileRestore restores the spec saved by a snapshot
+func (s *simulatedCluster) reconcileRestore(restore map[string]interface{}) {
+	status := childMap(restore, "status")
+	if status["complete"] == true {
+		return
+	}
+	metadata := objectMetadata(restore)
+	namespace := stringField(metadata, "namespace")
+	spec := childMap(restore, "spec")
+	snapshot := s.object("virtualmachinesnapshots", namespace, stringField(spec, "virtualMachineSnapshotName"))
+	vm := s.object("virtualmachines", namespace, stringField(childMap(spec, "target"), "name"))
+	if snapshot == nil || vm == nil {
+		setCondition(restore, "Failure", true, "snapshot or target VM not found")
+		return
+	}
+	content := s.object("virtualmachinesnapshotcontents", namespace, stringField(childMap(snapshot, "status"), "virtualMachineSnapshotContentName"))
+	if content != nil {
+		saved, _ := childMap(childMap(childMap(content, "spec"), "source"), "virtualMachine")["spec"].(map[string]interface{})
+		if saved != nil {
+			vm["spec"] = deepCopy(saved)
+			s.touch(vm)
+		}
+	}
+	status["complete"] = true
+	status["restoreTime"] = simulatedTimestamp()
+	setCondition(restore, "Ready", true, "Operation complete")
+	setCondition(restore, "Progressing", false, "Operation complete")
+	s.event(vm, "Normal", "VirtualMachineRestoreComplete", "Successfully completed VirtualMachineRestore "+stringField(metadata, "name"))
+}
+
+// reconcileDataVolume completes the import of a DataVolume into its PVC
+func (s *simulatedCluster) reconcileDataVolume(dv map[string]interface{}) {
+	status := childMap(dv, "status")
+	if stringField(status, "phase") == "Succeeded" {
+		return
+	}
+	metadata := objectMetadata(dv)
+	namespace, name := stringField(metadata, "namespace"), stringField(metadata, "name")
+	if s.object("persistentvolumeclaims", namespace, name) == nil {
+		spec := childMap(dv, "spec")
+		pvcSpec, _ := spec["pvc"].(map[string]interface{})
+		if pvcSpec == nil {
+			pvcSpec, _ = spec["storage"].(map[string]interface{})
+		}
+		s.create(map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "PersistentVolumeClaim",
+			"metadata":   map[string]interface{}{"name": name, "namespace": namespace, "ownerReferences": ownerReference(dv)},
+			"spec":       pvcSpec,
+			"status":     map[string]interface{}{"phase": "Bound"},
+		}, namespace, false)
+	}
+	status["phase"] = "Succeeded"
+	status["progress"] = "100.0%"
+	status["claimName"] = name
+	setCondition(dv, "Bound", true, "Bound")
+	setCondition(dv, "Ready", true, "")
+	setCondition(dv, "Running", false, "Completed")
+}
+
+// vmExec answers vm-exec against a running VMI: command runs with the
+// --output json document, and reading the console with a login prompt.
+// There is no real guest behind it.
+func (s *simulatedCluster) vmExec(args []string) (string, error) {
+	namespace, name, method := "default", "", ""
+	maxOutput := 0
+	var commands []string
+	readConsole := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--read-console" {
+			readConsole = true
+			continue
+		}
+		if i+1 == len(args) {
+			break
+		}
+		switch args[i] {
+		case "-n", "--namespace":
+			namespace = args[i+1]
+		case "-v", "--vm":
+			name = args[i+1]
+		case "--method":
+			method = args[i+1]
+		case "--max-output":
+			maxOutput, _ = strconv.Atoi(args[i+1])
+		case "-c", "--command":
+			commands = append(commands, args[i+1])
+		default:
+			continue
+		}
+		i++
+	}
+	if len(commands) == 0 && !readConsole {
+		return "", errors.New("only running commands and reading the console are supported in simulation mode")
+	}
+	vmi := s.object("virtualmachineinstances", namespace, name)
+	if vmi == nil {
+		return "", fmt.Errorf("Error: VMI %s/%s not found, is the VM running?", namespace, name)
+	}
+	if hasCondition(vmi, "Paused") {
+		return "", fmt.Errorf("Error: VMI %s/%s is paused", namespace, name)
+	}
+	if readConsole {
+		return fmt.Sprintf("\n%s login: ", name), nil
+	}
+
+	guestOS, _ := childMap(vmi, "status")["guestOSInfo"].(map[string]interface{})
+	vmType := stringField(guestOS, "id")
+	if vmType == "mswindows" {
+		// Like vm-exec, Windows guests only run commands through the agent
+		vmType = "windows"
+		if method == "console" || method == "ssh" {
+			return "", fmt.Errorf("Error: VMI '%s' runs Windows, which has no console login to automate; commands run through the guest agent only", name)
+		}
+	}
+	results := make([]VMExecResult, len(commands))
+	for i, command := range commands {
+		stdout, exitCode := simulatedGuestCommand(name, command)
+		results[i] = VMExecResult{Stdout: stdout, ExitCode: exitCode, DurationMs: 1, VMType: vmType}
+		if maxOutput > 0 && len(stdout) > maxOutput {
+			results[i].Stdout = stdout[:maxOutput] + fmt.Sprintf("\n... vm-exec: output truncated at %d bytes ...\n", maxOutput)
+			results[i].Truncated = true
+		}
+		if len(commands) > 1 {
+			results[i].Command = command
+		}
+	}
+	var v interface{} = results[0]
+	if len(results) > 1 {
+		v = results
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	return string(data) + "\n", err
+}
+
+// simulatedGuestCommand answers the few guest commands that have an obvious
+// result, the others succeed with a note instead of their output
+func simulatedGuestCommand(vmName, command string) (string, int) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", 0
+	}
+	switch fields[0] {
+	case "true", ":":
+		return "", 0
+	case "false":
+		return "", 1
+	case "echo":
+		return strings.Join(fields[1:], " ") + "\n", 0
+	case "hostname":
+		return vmName + "\n", 0
+	case "whoami":
+		return "root\n", 0
+	case "uname":
+		return "Linux\n", 0
+	case "date":
+		return clock.Now().UTC().Format(time.UnixDate) + "\n", 0
+	case "cloud-init":
+		return "status: done\n", 0
+	case "seq":
+		// Enough lines to page through, bounded like the capture limit
+		count, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || count < 0 || count > 1000000 {
+			return "seq: invalid argument\n", 1
+		}
+		var lines strings.Builder
+		for i := 1; i <= count; i++ {
+			lines.WriteString(strconv.Itoa(i) + "\n")
+		}
+		return lines.String(), 0
+	}
+	return fmt.Sprintf("simulated: %q was not run, there is no real guest\n", command), 0
+}
+
+// seed adds the objects of the default model the model file does not
+// define: the nodes, the namespaces and the KubeVirt installation
+func (s *simulatedCluster) seed(model []map[string]interface{}) {
+	defined := map[string]bool{}
+	for _, obj := range model {
+		defined[kindResource(obj)] = true
+	}
+	now := simulatedTimestamp()
+	add := func(obj map[string]interface{}) {
+		metadata := objectMetadata(obj)
+		if clusterScopedResources[kindResource(obj)] {
+			delete(metadata, "namespace")
+		}
+		metadata["uid"] = s.nextUID()
+		metadata["creationTimestamp"] = now
+		metadata["generation"] = 1
+		metadata["resourceVersion"] = strconv.Itoa(s.serial)
+		if s.object(kindResource(obj), stringField(metadata, "namespace"), stringField(metadata, "name")) == nil {
+			s.store(obj)
+		}
+	}
+
+	for _, namespace := range []string{"default", "kube-system", "kubevirt", "cdi"} {
+		add(map[string]interface{}{"apiVersion": "v1", "kind": "Namespace", "metadata": map[string]interface{}{"name": namespace}})
+	}
+	// Namespaces of the model objects exist, so the model does not need to
+	// declare them
+	for _, obj := range model {
+		if namespace := stringField(objectMetadata(obj), "namespace"); namespace != "" {
+			add(map[string]interface{}{"apiVersion": "v1", "kind": "Namespace", "metadata": map[string]interface{}{"name": namespace}})
+		}
+	}
+
+	if !defined["nodes"] {
+		for i := 1; i <= simulatedNodes; i++ {
+			name := fmt.Sprintf("node%02d", i)
+			node := map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Node",
+				"metadata": map[string]interface{}{
+					"name": name,
+					"labels": map[string]interface{}{
+						"kubernetes.io/hostname":  name,
+						"kubevirt.io/schedulable": "true",
+					},
+				},
+				"spec": map[string]interface{}{},
+				"status": map[string]interface{}{
+					"capacity":    map[string]interface{}{"cpu": "16", "memory": "64Gi", "pods": "110"},
+					"allocatable": map[string]interface{}{"cpu": "15", "memory": "62Gi", "pods": "110"},
+					"nodeInfo":    map[string]interface{}{"kubeletVersion": "v1.31.0", "osImage": "Simulated Linux", "architecture": "amd64"},
+				},
+			}
+			if i == 1 {
+				node["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["node-role.kubernetes.io/control-plane"] = ""
+			}
+			setCondition(node, "Ready", true, "KubeletReady")
+			add(node)
+		}
+	}
+
+	if !defined["kubevirts"] {
+		kubevirt := map[string]interface{}{
+			"apiVersion": "kubevirt.io/v1",
+			"kind":       "KubeVirt",
+			"metadata":   map[string]interface{}{"name": "kubevirt", "namespace": "kubevirt"},
+			"spec": map[string]interface{}{
+				"configuration": map[string]interface{}{
+					"developerConfiguration": map[string]interface{}{"featureGates": []interface{}{"Snapshot", "HotplugVolumes"}},
+				},
+			},
+			"status": map[string]interface{}{
+				"phase":                   "Deployed",
+				"observedKubeVirtVersion": simulatedKubeVirtVersion,
+				"targetKubeVirtVersion":   simulatedKubeVirtVersion,
+			},
+		}
+		setCondition(kubevirt, "Available", true, "AllComponentsReady")
+		add(kubevirt)
+	}
+
+	if !defined["storageclasses"] {
+		add(map[string]interface{}{
+			"apiVersion":  "storage.k8s.io/v1",
+			"kind":        "StorageClass",
+			"metadata":    map[string]interface{}{"name": "local", "annotations": map[string]interface{}{"storageclass.kubernetes.io/is-default-class": "true"}},
+			"provisioner": "kubevirt.io.hostpath-provisioner",
+		})
+	}
+
+	apiService := map[string]interface{}{
+		"apiVersion": "apiregistration.k8s.io/v1",
+		"kind":       "APIService",
+		"metadata":   map[string]interface{}{"name": subresourcesAPIService},
+		"spec":       map[string]interface{}{"service": map[string]interface{}{"name": "virt-api", "namespace": "kubevirt"}},
+	}
+	setCondition(apiService, "Available", true, "Passed")
+	add(apiService)
+	add(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "virt-api", "namespace": "kubevirt"},
+		"spec":       map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": 443}}},
+	})
+	add(map[string]interface{}{
+		"apiVersion":  "discovery.k8s.io/v1",
+		"kind":        "EndpointSlice",
+		"metadata":    map[string]interface{}{"name": "virt-api-simulated", "namespace": "kubevirt", "labels": map[string]interface{}{"kubernetes.io/service-name": "virt-api"}},
+		"addressType": "IPv4",
+		"endpoints":   []interface{}{map[string]interface{}{"addresses": []interface{}{"10.244.0.10"}, "conditions": map[string]interface{}{"ready": true}}},
+	})
+	for _, component := range []string{"virt-api", "virt-controller", "virt-operator"} {
+		add(map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": component, "namespace": "kubevirt", "labels": map[string]interface{}{"kubevirt.io": component}},
+			"spec":       map[string]interface{}{"replicas": float64(2)},
+		})
+	}
+	add(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "DaemonSet",
+		"metadata":   map[string]interface{}{"name": "virt-handler", "namespace": "kubevirt", "labels": map[string]interface{}{"kubevirt.io": "virt-handler"}},
+	})
+	for _, component := range []string{"virt-api", "virt-controller", "virt-handler", "virt-operator"} {
+		pod := map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata": map[string]interface{}{
+				"name":      component + "-simulated",
+				"namespace": "kubevirt",
+				"labels":    map[string]interface{}{"kubevirt.io": component},
+			},
+			"spec": map[string]interface{}{"nodeName": "node01", "containers": []interface{}{map[string]interface{}{"name": component}}},
+			"status": map[string]interface{}{
+				"phase":             "Running",
+				"containerStatuses": []interface{}{map[string]interface{}{"name": component, "ready": true, "restartCount": 0}},
+			},
+		}
+		setCondition(pod, "Ready", true, "")
+		add(pod)
+	}
+}
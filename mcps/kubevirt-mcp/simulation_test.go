@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// simulationModel is the model of the simulation tests: a running and a
+// stopped VM in default and a running VM in dev
+const simulationModel = `
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: web
+  namespace: default
+  labels: {app: web}
+spec:
+  runStrategy: Always
+  template:
+    metadata:
+      labels: {kubevirt.io/vm: web}
+    spec:
+      domain:
+        devices:
+          disks:
+          - name: root
+            disk: {bus: virtio}
+        resources: {requests: {memory: 1Gi}}
+      volumes:
+      - name: root
+        containerDisk: {image: quay.io/containerdisks/fedora}
+---
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: db
+  namespace: default
+  labels: {app: db}
+spec:
+  runStrategy: Halted
+  template:
+    spec:
+      domain:
+        devices: {}
+        resources: {requests: {memory: 2Gi}}
+---
+apiVersion: kubevirt.io/v1
+kind: VirtualMachine
+metadata:
+  name: ci
+  namespace: dev
+spec:
+  runStrategy: Always
+  template:
+    spec:
+      domain:
+        devices: {}
+        resources: {requests: {memory: 1Gi}}
+`
+
+// useSimulation runs the kubectl calls of the test against a simulated
+// cluster built from the model, like --simulate --simulate-model
+func useSimulation(t *testing.T, model string) *simulatedCluster {
+	t.Helper()
+	useFakeClock(t)
+	s := &simulatedCluster{objects: map[string]map[string]interface{}{}}
+	objects, err := decodeSimulatedObjects([]byte(model))
+	if err != nil {
+		t.Fatalf("invalid model: %v", err)
+	}
+	s.seed(objects)
+	for _, obj := range objects {
+		if _, err := s.create(obj, "default", false); err != nil {
+			t.Fatalf("invalid model: %v", err)
+		}
+	}
+	s.reconcile()
+
+	previous := simulation
+	simulation = s
+	t.Cleanup(func() { simulation = previous })
+	return s
+}
+
+func TestSimulatedKubectl(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   [][]string
+		args    []string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "get name of a selected list",
+			args: []string{"get", "virtualmachines", "-n", "default", "-l", "app=web", "-o", "name"},
+			want: "virtualmachines.kubevirt.io/web\n",
+		},
+		{
+			name: "get all namespaces",
+			args: []string{"get", "vms", "--all-namespaces", "-o", "name"},
+			want: "virtualmachines.kubevirt.io/db\nvirtualmachines.kubevirt.io/web\nvirtualmachines.kubevirt.io/ci\n",
+		},
+		{
+			name: "get with a negated label selector",
+			args: []string{"get", "virtualmachines", "-n", "default", "-l", "app!=web", "-o", "name"},
+			want: "virtualmachines.kubevirt.io/db\n",
+		},
+		{
+			name: "get with a field selector",
+			args: []string{"get", "vmi", "-A", "--field-selector", "metadata.namespace=dev", "-o", "name"},
+			want: "virtualmachineinstances.kubevirt.io/ci\n",
+		},
+		{
+			name:    "get of a missing object",
+			args:    []string{"get", "virtualmachine", "nope", "-n", "default", "-o", "json"},
+			wantErr: `Error from server (NotFound): virtualmachines.kubevirt.io "nope" not found`,
+		},
+		{
+			name: "get of a missing object ignored",
+			args: []string{"get", "virtualmachine", "nope", "-n", "default", "--ignore-not-found", "-o", "json"},
+			want: "",
+		},
+		{
+			name: "jsonpath of a single object",
+			args: []string{"get", "virtualmachine/web", "-n", "default", "-o", "jsonpath={.status.printableStatus}"},
+			want: "Running",
+		},
+		{
+			name: "jsonpath of the KubeVirt version",
+			args: []string{"get", "kubevirt", "-A", "-o", "jsonpath={.items[0].status.observedKubeVirtVersion}"},
+			want: simulatedKubeVirtVersion,
+		},
+		{
+			name: "jsonpath with a negative index",
+			args: []string{"get", "virtualmachines", "-n", "default", "-o", "jsonpath={.items[-1].metadata.name}"},
+			want: "web",
+		},
+		{
+			name:    "jsonpath index out of bounds",
+			args:    []string{"get", "virtualmachines", "-n", "default", "-o", "jsonpath={.items[-3].metadata.name}"},
+			wantErr: "array index out of bounds: index -3, length 2",
+		},
+		{
+			name:  "create of a new object",
+			args:  []string{"create", "-f", "-"},
+			input: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"settings"},"data":{"a":"1"}}`,
+			want:  "configmaps/settings created\n",
+		},
+		{
+			name:    "create of an existing object",
+			args:    []string{"create", "-f", "-"},
+			input:   `{"apiVersion":"kubevirt.io/v1","kind":"VirtualMachine","metadata":{"name":"web"}}`,
+			wantErr: `Error from server (AlreadyExists): virtualmachines.kubevirt.io "web" already exists`,
+		},
+		{
+			name:    "create in a missing namespace",
+			args:    []string{"create", "-f", "-"},
+			input:   `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"settings","namespace":"nope"}}`,
+			wantErr: `Error from server (NotFound): namespaces "nope" not found`,
+		},
+		{
+			name:  "server side apply of a new and an existing object",
+			args:  applyArgs(false),
+			input: "apiVersion: v1\nkind: ConfigMap\nmetadata: {name: settings}\n---\napiVersion: kubevirt.io/v1\nkind: VirtualMachine\nmetadata: {name: db}\nspec: {runStrategy: Halted}\n",
+			want:  "configmaps/settings serverside-applied\nvirtualmachines.kubevirt.io/db serverside-applied\n",
+		},
+		{
+			name:  "server side dry run",
+			args:  applyArgs(false, "--dry-run=server"),
+			input: "apiVersion: v1\nkind: ConfigMap\nmetadata: {name: settings}\n",
+			want:  "configmaps/settings serverside-applied (server dry run)\n",
+		},
+		{
+			name:    "apply without kind",
+			args:    applyArgs(false),
+			input:   "metadata: {name: settings}\n",
+			wantErr: "error: Object 'Kind' is missing",
+		},
+		{
+			name: "merge patch",
+			args: []string{"patch", "virtualmachine", "db", "-n", "default", "--type=merge", "-p", `{"metadata":{"labels":{"tier":"data"}}}`},
+			want: "virtualmachines.kubevirt.io/db patched\n",
+		},
+		{
+			name:    "patch of a missing object",
+			args:    []string{"patch", "virtualmachine", "nope", "-n", "default", "--type=merge", "-p", `{}`},
+			wantErr: `Error from server (NotFound): virtualmachines.kubevirt.io "nope" not found`,
+		},
+		{
+			name:    "JSON patch with a negative index",
+			args:    []string{"patch", "virtualmachine", "web", "-n", "default", "--type=json", "-p", `[{"op":"replace","path":"/spec/template/spec/domain/devices/disks/-1","value":{}}]`},
+			wantErr: "error: invalid patch path /spec/template/spec/domain/devices/disks/-1",
+		},
+		{
+			name:    "JSON patch with a failing test",
+			args:    []string{"patch", "virtualmachine", "web", "-n", "default", "--type=json", "-p", `[{"op":"test","path":"/spec/runStrategy","value":"Halted"}]`},
+			wantErr: "testing value /spec/runStrategy failed",
+		},
+		{
+			name:    "patch that is not JSON",
+			args:    []string{"patch", "virtualmachine", "web", "-n", "default", "--type=merge", "-p", `{runStrategy: Halted}`},
+			wantErr: "error: unable to parse",
+		},
+		{
+			name: "annotate",
+			args: []string{"annotate", "virtualmachine", "web", "-n", "default", "--overwrite", "note=x"},
+			want: "virtualmachines.kubevirt.io/web annotated\n",
+		},
+		{
+			name: "delete ignoring a missing object",
+			args: []string{"delete", "pod", "probe", "-n", "default", "--ignore-not-found", "--wait=false"},
+			want: "",
+		},
+		{
+			name:    "delete of a missing object",
+			args:    []string{"delete", "virtualmachine", "nope", "-n", "default", "--wait=false"},
+			wantErr: `Error from server (NotFound): virtualmachines.kubevirt.io "nope" not found`,
+		},
+		{
+			name: "wait for a condition",
+			args: []string{"wait", "-n", "default", "vmi/web", "--for=condition=Ready", "--timeout=60s"},
+			want: "virtualmachineinstances.kubevirt.io/web condition met\n",
+		},
+		{
+			name:    "wait for a condition that does not hold",
+			args:    []string{"wait", "-n", "default", "vm/db", "--for=condition=Ready", "--timeout=60s"},
+			wantErr: "timed out waiting for the condition on virtualmachines.kubevirt.io/db",
+		},
+		{
+			name: "wait for a jsonpath value",
+			args: []string{"wait", "-n", "kubevirt", "pod/virt-api-simulated", "--for=jsonpath={.status.phase}=Running", "--timeout=60s"},
+			want: "pods/virt-api-simulated condition met\n",
+		},
+		{
+			name:  "wait for a deletion",
+			setup: [][]string{{"delete", "virtualmachine", "db", "-n", "default", "--wait=false"}},
+			args:  []string{"wait", "-n", "default", "virtualmachine/db", "--for=delete", "--timeout=60s"},
+			want:  "virtualmachines.kubevirt.io/db condition met\n",
+		},
+		{
+			name:    "unsupported verb",
+			args:    []string{"rollout", "status", "deployment/virt-api", "-n", "kubevirt"},
+			wantErr: "error: kubectl rollout is not supported in simulation mode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useSimulation(t, simulationModel)
+			for _, args := range tt.setup {
+				if _, err := runKubectl(context.Background(), args...); err != nil {
+					t.Fatalf("setup %v: %v", args, err)
+				}
+			}
+
+			var input []byte
+			if tt.input != "" {
+				input = []byte(tt.input)
+			}
+			output, err := runKubectlWithInput(context.Background(), input, tt.args...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("kubectl %v: error %v, want %q", tt.args, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("kubectl %v: %v", tt.args, err)
+			}
+			if string(output) != tt.want {
+				t.Fatalf("kubectl %v = %q, want %q", tt.args, output, tt.want)
+			}
+		})
+	}
+}
+
+// simulatedObject returns an object of the simulated cluster as the tools
+// read it
+func simulatedObject(t *testing.T, resource, namespace, name string) map[string]interface{} {
+	t.Helper()
+	var obj map[string]interface{}
+	if err := runKubectlJSON(context.Background(), &obj, "get", resource, name, "-n", namespace); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestSimulatedRunStrategy(t *testing.T) {
+	useSimulation(t, simulationModel)
+	ctx := context.Background()
+
+	// Stopping a VM deletes its VMI and launcher pod
+	if _, err := runKubectl(ctx, "patch", "virtualmachine", "web", "-n", "default", "--type=merge", "-p", `{"spec":{"runStrategy":"Halted"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runKubectl(ctx, "get", "virtualmachineinstance", "web", "-n", "default"); err == nil {
+		t.Fatal("the VMI of the stopped VM still exists")
+	}
+	vm := simulatedObject(t, "virtualmachine", "default", "web")
+	status := vm["status"].(map[string]interface{})
+	if status["printableStatus"] != "Stopped" {
+		t.Fatalf("printableStatus = %v, want Stopped", status["printableStatus"])
+	}
+	metadata := vm["metadata"].(map[string]interface{})
+	if metadata["generation"] != float64(2) || status["observedGeneration"] != float64(2) {
+		t.Fatalf("generation = %v, observedGeneration = %v, want 2", metadata["generation"], status["observedGeneration"])
+	}
+
+	// Starting it again creates a VMI owned by the VM
+	if _, err := runKubectl(ctx, "patch", "virtualmachine", "db", "-n", "default", "--type=merge", "-p", `{"spec":{"runStrategy":"Always"}}`); err != nil {
+		t.Fatal(err)
+	}
+	vmi := simulatedObject(t, "virtualmachineinstance", "default", "db")
+	refs, _ := vmi["metadata"].(map[string]interface{})["ownerReferences"].([]interface{})
+	if len(refs) != 1 || refs[0].(map[string]interface{})["kind"] != "VirtualMachine" {
+		t.Fatalf("ownerReferences = %v, want the VirtualMachine", refs)
+	}
+
+	// Deleting the VM collects the VMI
+	if _, err := runKubectl(ctx, "delete", "virtualmachine", "db", "-n", "default", "--wait=false"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runKubectl(ctx, "get", "virtualmachineinstance", "db", "-n", "default"); err == nil {
+		t.Fatal("the VMI of the deleted VM still exists")
+	}
+}
+
+func TestSimulatedManagedFields(t *testing.T) {
+	useSimulation(t, simulationModel)
+	ctx := context.Background()
+
+	manifest := "apiVersion: v1\nkind: ConfigMap\nmetadata: {name: settings, labels: {app: web}}\ndata: {a: '1'}\n"
+	for i := 0; i < 2; i++ {
+		if _, err := runKubectlWithInput(ctx, []byte(manifest), applyArgs(false)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := runKubectl(ctx, "patch", "configmap", "settings", "-n", "default", "--type=json", "-p", `[{"op":"add","path":"/data/b","value":"2"}]`); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := simulatedObject(t, "configmap", "default", "settings")
+	entries := obj["metadata"].(map[string]interface{})["managedFields"].([]interface{})
+	var managers []string
+	for _, entry := range entries {
+		entry := entry.(map[string]interface{})
+		managers = append(managers, entry["manager"].(string)+"/"+entry["operation"].(string))
+	}
+	// Applying twice leaves one entry of the manager
+	if want := []string{"kubectl/Apply", "kubectl-patch/Update"}; !reflect.DeepEqual(managers, want) {
+		t.Fatalf("managers = %v, want %v", managers, want)
+	}
+	apply := entries[0].(map[string]interface{})["fieldsV1"]
+	want := map[string]interface{}{
+		"f:data":     map[string]interface{}{"f:a": map[string]interface{}{}},
+		"f:metadata": map[string]interface{}{"f:labels": map[string]interface{}{"f:app": map[string]interface{}{}}},
+	}
+	if !reflect.DeepEqual(apply, want) {
+		t.Fatalf("fieldsV1 of the apply = %v, want %v", apply, want)
+	}
+	patch := entries[1].(map[string]interface{})["fieldsV1"]
+	if want := map[string]interface{}{"f:data": map[string]interface{}{"f:b": map[string]interface{}{}}}; !reflect.DeepEqual(patch, want) {
+		t.Fatalf("fieldsV1 of the patch = %v, want %v", patch, want)
+	}
+}
+
+func TestEvaluateJSONPath(t *testing.T) {
+	var value interface{}
+	json.Unmarshal([]byte(`{"items":[{"name":"a","ports":[80,443]},{"name":"b","labels":{"app":"web"}}]}`), &value)
+
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{template: "{.items[0].name}", want: "a"},
+		{template: "{.items[1].labels}", want: `{"app":"web"}`},
+		{template: "{.items[0].ports[1]}", want: "443"},
+		{template: "{.items[-1].name}", want: "b"},
+		{template: "{.items[-2].ports[-1]}", want: "443"},
+		{template: "{.items[0].missing}", want: ""},
+		{template: "{.items[2].name}", wantErr: true},
+		{template: "{.items[-3].name}", wantErr: true},
+		{template: "{.items[*].name}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := evaluateJSONPath(value, tt.template)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("evaluateJSONPath(%s) error = %v, want error %v", tt.template, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("evaluateJSONPath(%s) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	var target, patch, want map[string]interface{}
+	json.Unmarshal([]byte(`{"spec":{"runStrategy":"Always","template":{"a":1}},"metadata":{"labels":{"x":"1","y":"2"}}}`), &target)
+	json.Unmarshal([]byte(`{"spec":{"runStrategy":"Halted","template":null},"metadata":{"labels":{"y":null,"z":"3"}},"list":[1]}`), &patch)
+	json.Unmarshal([]byte(`{"spec":{"runStrategy":"Halted"},"metadata":{"labels":{"x":"1","z":"3"}},"list":[1]}`), &want)
+
+	mergePatch(target, patch)
+	if !reflect.DeepEqual(target, want) {
+		t.Fatalf("mergePatch() = %v, want %v", target, want)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	const object = `{"spec":{"disks":[{"name":"a"},{"name":"b"}],"labels":{"k":"v"}}}`
+	tests := []struct {
+		name      string
+		operation string
+		want      string
+		wantErr   bool
+	}{
+		{name: "add a field", operation: `{"op":"add","path":"/spec/labels/n","value":"1"}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"b"}],"labels":{"k":"v","n":"1"}}}`},
+		{name: "escaped key", operation: `{"op":"add","path":"/spec/labels/kubevirt.io~1vm","value":"x"}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"b"}],"labels":{"k":"v","kubevirt.io/vm":"x"}}}`},
+		{name: "append with -", operation: `{"op":"add","path":"/spec/disks/-","value":{"name":"c"}}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"b"},{"name":"c"}],"labels":{"k":"v"}}}`},
+		{name: "insert", operation: `{"op":"add","path":"/spec/disks/1","value":{"name":"c"}}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"c"},{"name":"b"}],"labels":{"k":"v"}}}`},
+		{name: "add at the end index", operation: `{"op":"add","path":"/spec/disks/2","value":{"name":"c"}}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"b"},{"name":"c"}],"labels":{"k":"v"}}}`},
+		{name: "add past the end", operation: `{"op":"add","path":"/spec/disks/3","value":{}}`, wantErr: true},
+		{name: "add at a negative index", operation: `{"op":"add","path":"/spec/disks/-1","value":{}}`, wantErr: true},
+		{name: "replace an element", operation: `{"op":"replace","path":"/spec/disks/0","value":{"name":"z"}}`, want: `{"spec":{"disks":[{"name":"z"},{"name":"b"}],"labels":{"k":"v"}}}`},
+		{name: "replace at the end index", operation: `{"op":"replace","path":"/spec/disks/2","value":{}}`, wantErr: true},
+		{name: "remove an element", operation: `{"op":"remove","path":"/spec/disks/0"}`, want: `{"spec":{"disks":[{"name":"b"}],"labels":{"k":"v"}}}`},
+		{name: "remove at a negative index", operation: `{"op":"remove","path":"/spec/disks/-1"}`, wantErr: true},
+		{name: "field of an element", operation: `{"op":"replace","path":"/spec/disks/1/name","value":"y"}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"y"}],"labels":{"k":"v"}}}`},
+		{name: "field of a negative element", operation: `{"op":"replace","path":"/spec/disks/-1/name","value":"y"}`, wantErr: true},
+		{name: "remove a field", operation: `{"op":"remove","path":"/spec/labels/k"}`, want: `{"spec":{"disks":[{"name":"a"},{"name":"b"}],"labels":{}}}`},
+		{name: "test that holds", operation: `{"op":"test","path":"/spec/labels/k","value":"v"}`, want: object},
+		{name: "test that fails", operation: `{"op":"test","path":"/spec/labels/k","value":"w"}`, wantErr: true},
+		{name: "missing parent", operation: `{"op":"add","path":"/status/phase/x","value":"y"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var obj map[string]interface{}
+			var operation interface{}
+			json.Unmarshal([]byte(object), &obj)
+			json.Unmarshal([]byte(tt.operation), &operation)
+
+			err := applyJSONPatch(obj, operation)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyJSONPatch(%s) error = %v, want error %v", tt.operation, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, _ := json.Marshal(obj)
+			if string(got) != tt.want {
+				t.Fatalf("applyJSONPatch(%s) = %s, want %s", tt.operation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKubectlCall(t *testing.T) {
+	call := parseKubectlCall([]string{"--kubeconfig", "/tmp/kc", "--context", "lab", "patch", "virtualmachine", "web", "-n", "dev", "--type=json", "-p", "[]", "--dry-run=server"})
+	want := kubectlCall{verb: "patch", args: []string{"virtualmachine", "web"}, namespace: "dev", patchType: "json", patch: "[]", dryRun: true}
+	if !reflect.DeepEqual(call, want) {
+		t.Fatalf("parseKubectlCall() = %+v, want %+v", call, want)
+	}
+
+	call = parseKubectlCall([]string{"exec", "virt-handler-x", "-n", "kubevirt", "-c", "virt-handler", "--", "date", "-n"})
+	if call.namespace != "kubevirt" || !reflect.DeepEqual(call.command, []string{"date", "-n"}) {
+		t.Fatalf("parseKubectlCall() = %+v, want the command after --", call)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSmokeTestImage   = "quay.io/kubevirt/cirros-container-disk-demo"
+	defaultSmokeTestTimeout = 300
+	smokeTestMarker         = "kubevirt-mcp-smoketest-ok"
+
+	smokeTestPassed  = "passed"
+	smokeTestFailed  = "failed"
+	smokeTestSkipped = "skipped"
+)
+
+// SmokeTestParams represents the parameters for the cluster smoke test
+type SmokeTestParams struct {
+	Namespace     string `json:"namespace,omitempty"`
+	Image         string `json:"image,omitempty"`
+	Migration     bool   `json:"migration,omitempty"`
+	Timeout       int    `json:"timeout,omitempty"`
+	KeepOnFailure bool   `json:"keep_on_failure,omitempty"`
+	Format        string `json:"format,omitempty"`
+}
+
+// SmokeTestStep is the outcome of one smoke test step
+type SmokeTestStep struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Duration string `json:"duration,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// SmokeTestResult is the cluster_smoketest tool result
+type SmokeTestResult struct {
+	Passed    bool            `json:"passed"`
+	Namespace string          `json:"namespace"`
+	VMName    string          `json:"vmName"`
+	Duration  string          `json:"duration"`
+	Steps     []SmokeTestStep `json:"steps"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "cluster_smoketest",
+		Description: "Smoke test a newly provisioned cluster: create a cirros VM, wait for it to run, exec a command, check the console and optionally live migrate it, then clean up. Returns a pass/fail report for CI gates",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Namespace to create the test VM in",
+					"default":     "default",
+				},
+				"image": map[string]interface{}{
+					"type":        "string",
+					"description": "cirros containerdisk image of the test VM",
+					"default":     defaultSmokeTestImage,
+				},
+				"migration": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also live migrate the VM, requires at least two schedulable nodes",
+					"default":     false,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for each step (default: 300)",
+					"default":     defaultSmokeTestTimeout,
+				},
+				"keep_on_failure": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Keep the test VM when a step fails, for debugging",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleSmokeTest,
+	})
+}
+
+// handleSmokeTest is the tools/call handler for cluster_smoketest
+func handleSmokeTest(ctx context.Context, args json.RawMessage) (string, error) {
+	var params SmokeTestParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Image == "" {
+		params.Image = defaultSmokeTestImage
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultSmokeTestTimeout
+	}
+
+	result := runSmokeTest(ctx, params)
+	return formatResult(params.Format, result, result.tables)
+}
+
+// tables renders the smoke test outcome and its steps as tables
+func (r *SmokeTestResult) tables() []table {
+	outcome := smokeTestFailed
+	if r.Passed {
+		outcome = smokeTestPassed
+	}
+	summary := table{
+		title:   "Smoke test",
+		headers: []string{"RESULT", "NAMESPACE", "VM", "DURATION"},
+		rows:    [][]string{{outcome, r.Namespace, r.VMName, r.Duration}},
+	}
+
+	steps := table{title: "Steps", headers: []string{"STEP", "STATUS", "DURATION", "MESSAGE"}}
+	for _, step := range r.Steps {
+		steps.rows = append(steps.rows, []string{step.Name, step.Status, step.Duration, step.Message})
+	}
+	return []table{summary, steps}
+}
+
+// runSmokeTest runs the smoke test steps in order. A failed step skips the
+// remaining ones, except cleanup which always runs.
+func runSmokeTest(ctx context.Context, params SmokeTestParams) *SmokeTestResult {
+	name := generateName("kubevirt-mcp-smoketest-")
+	timeout := time.Duration(params.Timeout) * time.Second
+	result := &SmokeTestResult{Namespace: params.Namespace, VMName: name, Passed: true}
+	start := time.Now()
+
+	step := func(stepName string, run func() error) {
+		if !result.Passed {
+			result.Steps = append(result.Steps, SmokeTestStep{Name: stepName, Status: smokeTestSkipped})
+			return
+		}
+		reportProgress(ctx, "smoke test step %s", stepName)
+		stepStart := time.Now()
+		entry := SmokeTestStep{Name: stepName, Status: smokeTestPassed}
+		if err := run(); err != nil {
+			entry.Status = smokeTestFailed
+			entry.Message = err.Error()
+			result.Passed = false
+		}
+		entry.Duration = time.Since(stepStart).Round(time.Second).String()
+		result.Steps = append(result.Steps, entry)
+	}
+
+	created := false
+	step("create_vm", func() error {
+		if err := createObject(ctx, smokeTestVM(name, params)); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+
+	step("wait_running", func() error {
+		return waitFor(ctx, params.Namespace, "vmi/"+name, "condition=Ready", timeout)
+	})
+
+	step("vm_exec", func() error {
+		result, err := runGuestCommand(ctx, VMExecParams{
+			Namespace: params.Namespace,
+			VMName:    name,
+			Command:   "echo " + smokeTestMarker,
+			Timeout:   params.Timeout,
+		})
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(result.Stdout, smokeTestMarker) {
+			return fmt.Errorf("unexpected command output: %s", result.Stdout)
+		}
+		return nil
+	})
+
+	step("console", func() error {
+		_, err := runVMExec(ctx, vmExecDeadline(0, 0)+3*time.Second, []string{
+			"-n", params.Namespace,
+			"-v", name,
+			"--read-console",
+			"--duration", "3",
+		}, nil)
+		return err
+	})
+
+	if params.Migration {
+		step("migration", func() error {
+			return migrateSmokeTestVM(ctx, name, params.Namespace, timeout)
+		})
+	}
+
+	// Cleanup also runs when the tool call was cancelled, so it keeps the
+	// selected cluster but not the cancellation of ctx
+	if created && (result.Passed || !params.KeepOnFailure) {
+		cleanupCtx := context.WithoutCancel(ctx)
+		stepStart := time.Now()
+		entry := SmokeTestStep{Name: "cleanup", Status: smokeTestPassed}
+		if _, err := runKubectl(cleanupCtx, "delete", "virtualmachine", name, "-n", params.Namespace, "--ignore-not-found"); err != nil {
+			entry.Status = smokeTestFailed
+			entry.Message = err.Error()
+			result.Passed = false
+		} else if err := waitForDeletion(cleanupCtx, params.Namespace, "vmi/"+name, timeout); err != nil {
+			entry.Status = smokeTestFailed
+			entry.Message = fmt.Sprintf("VMI was not removed: %v", err)
+			result.Passed = false
+		}
+		entry.Duration = time.Since(stepStart).Round(time.Second).String()
+		result.Steps = append(result.Steps, entry)
+	} else if created {
+		result.Steps = append(result.Steps, SmokeTestStep{
+			Name:    "cleanup",
+			Status:  smokeTestSkipped,
+			Message: "keep_on_failure is set, delete the VM manually",
+		})
+	}
+
+	result.Duration = time.Since(start).Round(time.Second).String()
+	return result
+}
+
+// smokeTestVM returns the manifest of the cirros test VM
+func smokeTestVM(name string, params SmokeTestParams) map[string]interface{} {
+	labels := managedLabels("cluster_smoketest", true)
+	return map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata":   map[string]interface{}{"name": name, "namespace": params.Namespace, "labels": labels},
+		"spec": map[string]interface{}{
+			"runStrategy": "Always",
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels": map[string]string{managedByLabel: managedByValue, "kubevirt.io/os": "cirros"},
+				},
+				"spec": map[string]interface{}{
+					"domain": map[string]interface{}{
+						"devices": map[string]interface{}{
+							"disks": []map[string]interface{}{{
+								"name": "containerdisk",
+								"disk": map[string]interface{}{"bus": "virtio"},
+							}},
+							// Masquerade keeps the VM live migratable on the pod network
+							"interfaces": []map[string]interface{}{{
+								"name":       "default",
+								"masquerade": map[string]interface{}{},
+							}},
+						},
+						"resources": map[string]interface{}{
+							"requests": map[string]interface{}{"memory": "128Mi"},
+						},
+					},
+					"networks": []map[string]interface{}{{
+						"name": "default",
+						"pod":  map[string]interface{}{},
+					}},
+					"volumes": []map[string]interface{}{{
+						"name":          "containerdisk",
+						"containerDisk": map[string]interface{}{"image": params.Image},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// migrateSmokeTestVM live migrates the VMI and checks that it changed node
+func migrateSmokeTestVM(ctx context.Context, name, namespace string, timeout time.Duration) error {
+	var before VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &before, "get", "virtualmachineinstance", name, "-n", namespace); err != nil {
+		return err
+	}
+
+	if err := startMigration(ctx, namespace, name, name); err != nil {
+		return err
+	}
+	defer runKubectl(context.WithoutCancel(ctx), "delete", "virtualmachineinstancemigration", name, "-n", namespace, "--ignore-not-found", "--wait=false")
+
+	if err := waitForMigration(ctx, namespace, name, timeout); err != nil {
+		return err
+	}
+
+	var after VirtualMachineInstance
+	if err := runKubectlJSON(ctx, &after, "get", "virtualmachineinstance", name, "-n", namespace); err != nil {
+		return err
+	}
+	if after.Status.NodeName == before.Status.NodeName {
+		return fmt.Errorf("VMI is still on node %s after the migration", after.Status.NodeName)
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotAPIGroup       = "snapshot.kubevirt.io"
+	defaultSnapshotTimeout = 300
+)
+
+// SnapshotParams represents the parameters of the snapshot tools
+type SnapshotParams struct {
+	Namespace    string `json:"namespace,omitempty"`
+	VMName       string `json:"vm_name"`
+	SnapshotName string `json:"snapshot_name,omitempty"`
+	Wait         bool   `json:"wait,omitempty"`
+	Timeout      int    `json:"timeout,omitempty"`
+}
+
+type virtualMachineSnapshot struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Source struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"source"`
+	} `json:"spec"`
+	Status *struct {
+		Phase        string      `json:"phase,omitempty"`
+		ReadyToUse   *bool       `json:"readyToUse,omitempty"`
+		CreationTime *time.Time  `json:"creationTime,omitempty"`
+		Indications  []string    `json:"indications,omitempty"`
+		Conditions   []Condition `json:"conditions,omitempty"`
+		Error        *struct {
+			Message string `json:"message,omitempty"`
+		} `json:"error,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+type virtualMachineRestore struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Target struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"target"`
+		VirtualMachineSnapshotName string `json:"virtualMachineSnapshotName"`
+	} `json:"spec"`
+	Status *struct {
+		Complete    *bool       `json:"complete,omitempty"`
+		RestoreTime *time.Time  `json:"restoreTime,omitempty"`
+		Conditions  []Condition `json:"conditions,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// SnapshotInfo reports a VirtualMachineSnapshot
+type SnapshotInfo struct {
+	Name        string   `json:"name"`
+	Phase       string   `json:"phase,omitempty"`
+	ReadyToUse  bool     `json:"readyToUse"`
+	Created     string   `json:"created,omitempty"`
+	Indications []string `json:"indications,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// RestoreInfo reports a VirtualMachineRestore
+type RestoreInfo struct {
+	Name     string `json:"name"`
+	Snapshot string `json:"snapshot"`
+	Complete bool   `json:"complete"`
+	Restored string `json:"restored,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// SnapshotResult is the result of the snapshot tools
+type SnapshotResult struct {
+	Namespace string         `json:"namespace"`
+	VMName    string         `json:"vmName"`
+	Snapshot  *SnapshotInfo  `json:"snapshot,omitempty"`
+	Restore   *RestoreInfo   `json:"restore,omitempty"`
+	Snapshots []SnapshotInfo `json:"snapshots,omitempty"`
+	Restores  []RestoreInfo  `json:"restores,omitempty"`
+	Note      string         `json:"note,omitempty"`
+}
+
+func init() {
+	properties := func(snapshotDescription string) map[string]interface{} {
+		return map[string]interface{}{
+			"namespace": map[string]interface{}{
+				"type":        "string",
+				"description": "Kubernetes namespace containing the VM",
+				"default":     "default",
+			},
+			"vm_name": map[string]interface{}{
+				"type":        "string",
+				"description": "Name of the VM",
+			},
+			"snapshot_name": map[string]interface{}{
+				"type":        "string",
+				"description": snapshotDescription,
+			},
+			"wait": map[string]interface{}{
+				"type":        "boolean",
+				"description": "Wait until the operation finished",
+				"default":     false,
+			},
+			"timeout": map[string]interface{}{
+				"type":        "integer",
+				"description": "Timeout in seconds when waiting (default: 300)",
+				"default":     defaultSnapshotTimeout,
+			},
+		}
+	}
+
+	registerTool(Tool{
+		Name:        "vm_snapshot",
+		Description: "Checkpoint a VM with a VirtualMachineSnapshot before risky in-guest operations, optionally waiting until it is ready to use",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": properties("Name of the snapshot (default: generated from the VM name)"),
+			"required":   []string{"vm_name"},
+		},
+		Handler: handleSnapshot,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_restore",
+		Description: "Roll a VM back to a VirtualMachineSnapshot with a VirtualMachineRestore, optionally waiting until the restore completed. Stop the VM first unless the cluster supports online restore",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": properties("Name of the snapshot to restore (default: the most recent ready snapshot of the VM)"),
+			"required":   []string{"vm_name"},
+		},
+		Handler: handleRestore,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_snapshot_status",
+		Description: "List the snapshots and restores of a VM with their readiness, age and errors",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleSnapshotStatus,
+	})
+}
+
+// decodeSnapshotParams decodes and validates the snapshot tool arguments
+func decodeSnapshotParams(args json.RawMessage) (SnapshotParams, error) {
+	var params SnapshotParams
+	if err := decodeArguments(args, &params); err != nil {
+		return params, err
+	}
+	if params.VMName == "" {
+		return params, missingArgument("vm_name")
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultSnapshotTimeout
+	}
+	return params, nil
+}
+
+// handleSnapshot is the tools/call handler for vm_snapshot
+func handleSnapshot(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeSnapshotParams(args)
+	if err != nil {
+		return "", err
+	}
+	if params.SnapshotName == "" {
+		params.SnapshotName = generateName(params.VMName + "-snapshot-")
+	}
+
+	apiVersion, err := snapshotAPIVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := createObject(ctx, map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "VirtualMachineSnapshot",
+		"metadata": map[string]interface{}{
+			"name":      params.SnapshotName,
+			"namespace": params.Namespace,
+			"labels":    managedLabels("vm_snapshot", false),
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"apiGroup": "kubevirt.io", "kind": "VirtualMachine", "name": params.VMName},
+		},
+	}); err != nil {
+		return "", fmt.Errorf("failed to create snapshot: %v", err)
+	}
+
+	if params.Wait {
+		reportProgress(ctx, "waiting for snapshot %s to be ready", params.SnapshotName)
+		if err := waitFor(ctx, params.Namespace, "virtualmachinesnapshot/"+params.SnapshotName, "jsonpath={.status.readyToUse}=true", time.Duration(params.Timeout)*time.Second); err != nil {
+			return "", fmt.Errorf("snapshot %s is not ready: %v", params.SnapshotName, err)
+		}
+	}
+
+	var snapshot virtualMachineSnapshot
+	if err := runKubectlJSON(ctx, &snapshot, "get", "virtualmachinesnapshot", params.SnapshotName, "-n", params.Namespace); err != nil {
+		return "", err
+	}
+	info := snapshotInfo(snapshot)
+	result := &SnapshotResult{Namespace: params.Namespace, VMName: params.VMName, Snapshot: &info}
+	if !info.ReadyToUse && containsString(info.Indications, "NoGuestAgent") {
+		result.Note = "the guest agent is not connected, the snapshot is not filesystem consistent"
+	}
+	return formatJSON(result)
+}
+
+// handleRestore is the tools/call handler for vm_restore
+func handleRestore(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeSnapshotParams(args)
+	if err != nil {
+		return "", err
+	}
+
+	if params.SnapshotName == "" {
+		snapshots, err := listSnapshots(ctx, params.Namespace, params.VMName)
+		if err != nil {
+			return "", err
+		}
+		for _, snapshot := range snapshots {
+			if snapshot.ReadyToUse {
+				params.SnapshotName = snapshot.Name
+				break
+			}
+		}
+		if params.SnapshotName == "" {
+			return "", fmt.Errorf("VM '%s' has no snapshot ready to use", params.VMName)
+		}
+	}
+
+	apiVersion, err := snapshotAPIVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	name := generateName(params.VMName + "-restore-")
+	if err := createObject(ctx, map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "VirtualMachineRestore",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": params.Namespace,
+			"labels":    managedLabels("vm_restore", false),
+		},
+		"spec": map[string]interface{}{
+			"target":                     map[string]interface{}{"apiGroup": "kubevirt.io", "kind": "VirtualMachine", "name": params.VMName},
+			"virtualMachineSnapshotName": params.SnapshotName,
+		},
+	}); err != nil {
+		return "", fmt.Errorf("failed to create restore: %v", err)
+	}
+
+	if params.Wait {
+		reportProgress(ctx, "waiting for restore %s to complete", name)
+		if err := waitFor(ctx, params.Namespace, "virtualmachinerestore/"+name, "jsonpath={.status.complete}=true", time.Duration(params.Timeout)*time.Second); err != nil {
+			return "", fmt.Errorf("restore %s did not complete, is the VM stopped?: %v", name, err)
+		}
+	}
+
+	var restore virtualMachineRestore
+	if err := runKubectlJSON(ctx, &restore, "get", "virtualmachinerestore", name, "-n", params.Namespace); err != nil {
+		return "", err
+	}
+	info := restoreInfo(restore)
+	result := &SnapshotResult{Namespace: params.Namespace, VMName: params.VMName, Restore: &info}
+	if !info.Complete {
+		result.Note = "restores of a running VM wait until it is stopped, unless the cluster supports online restore"
+	}
+	return formatJSON(result)
+}
+
+// handleSnapshotStatus is the tools/call handler for vm_snapshot_status
+func handleSnapshotStatus(ctx context.Context, args json.RawMessage) (string, error) {
+	params, err := decodeSnapshotParams(args)
+	if err != nil {
+		return "", err
+	}
+
+	snapshots, err := listSnapshots(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return "", err
+	}
+
+	var restores struct {
+		Items []virtualMachineRestore `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &restores, "get", "virtualmachinerestores", "-n", params.Namespace); err != nil {
+		return "", err
+	}
+	sort.Slice(restores.Items, func(i, j int) bool {
+		return restores.Items[i].Metadata.CreationTimestamp.After(restores.Items[j].Metadata.CreationTimestamp)
+	})
+
+	result := &SnapshotResult{Namespace: params.Namespace, VMName: params.VMName, Snapshots: snapshots}
+	for _, restore := range restores.Items {
+		if restore.Spec.Target.Name == params.VMName {
+			result.Restores = append(result.Restores, restoreInfo(restore))
+		}
+	}
+	return formatJSON(result)
+}
+
+// listSnapshots returns the snapshots of a VM, most recent first
+func listSnapshots(ctx context.Context, namespace, vmName string) ([]SnapshotInfo, error) {
+	var list struct {
+		Items []virtualMachineSnapshot `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &list, "get", "virtualmachinesnapshots", "-n", namespace); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Metadata.CreationTimestamp.After(list.Items[j].Metadata.CreationTimestamp)
+	})
+
+	var snapshots []SnapshotInfo
+	for _, snapshot := range list.Items {
+		if snapshot.Spec.Source.Name == vmName {
+			snapshots = append(snapshots, snapshotInfo(snapshot))
+		}
+	}
+	return snapshots, nil
+}
+
+// snapshotAPIVersion returns the served snapshot API version, preferring v1beta1
+func snapshotAPIVersion(ctx context.Context) (string, error) {
+	output, err := runKubectl(ctx, "api-versions")
+	if err != nil {
+		return "", err
+	}
+	versions := strings.Fields(string(output))
+	for _, version := range []string{"v1beta1", "v1alpha1"} {
+		if containsString(versions, snapshotAPIGroup+"/"+version) {
+			return snapshotAPIGroup + "/" + version, nil
+		}
+	}
+	return "", fmt.Errorf("the %s API is not served, is the Snapshot feature gate enabled?", snapshotAPIGroup)
+}
+
+// snapshotInfo summarizes a snapshot
+func snapshotInfo(snapshot virtualMachineSnapshot) SnapshotInfo {
+	info := SnapshotInfo{Name: snapshot.Metadata.Name}
+	if created := since(snapshot.Metadata.CreationTimestamp); created != "" {
+		info.Created = created + " ago"
+	}
+	if snapshot.Status == nil {
+		return info
+	}
+	info.Phase = snapshot.Status.Phase
+	info.ReadyToUse = snapshot.Status.ReadyToUse != nil && *snapshot.Status.ReadyToUse
+	info.Indications = snapshot.Status.Indications
+	if snapshot.Status.Error != nil {
+		info.Error = snapshot.Status.Error.Message
+	}
+	return info
+}
+
+// restoreInfo summarizes a restore
+func restoreInfo(restore virtualMachineRestore) RestoreInfo {
+	info := RestoreInfo{Name: restore.Metadata.Name, Snapshot: restore.Spec.VirtualMachineSnapshotName}
+	if restore.Status == nil {
+		return info
+	}
+	info.Complete = restore.Status.Complete != nil && *restore.Status.Complete
+	if restore.Status.RestoreTime != nil {
+		info.Restored = since(*restore.Status.RestoreTime) + " ago"
+	}
+	for _, condition := range restore.Status.Conditions {
+		if condition.Status != "True" && condition.Message != "" {
+			info.Message = condition.Message
+		}
+	}
+	return info
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variable configuring the snapshot scheduler, see
+// SnapshotSchedulesConfig. Setting it to 0 stops the server from taking
+// scheduled snapshots.
+const (
+	snapshotScheduleIntervalEnv = "KUBEVIRT_MCP_SNAPSHOT_SCHEDULE_INTERVAL"
+
+	defaultSnapshotScheduleInterval = time.Minute
+
+	// minSnapshotScheduleInterval keeps the scheduler from listing the
+	// cluster back to back
+	minSnapshotScheduleInterval = 10 * time.Second
+
+	defaultSnapshotRetention = 7
+	maxSnapshotRetention     = 100
+)
+
+const (
+	// snapshotScheduleLabel selects the VMs with a schedule, which is kept
+	// as JSON in the annotation of the same name
+	snapshotScheduleLabel = "kubevirt-mcp/snapshot-schedule"
+
+	// scheduledSnapshotLabel marks the snapshots taken by the scheduler,
+	// only those are pruned
+	scheduledSnapshotLabel = "kubevirt-mcp/scheduled"
+
+	// scheduledForAnnotation records the schedule slot a snapshot was
+	// taken for
+	scheduledForAnnotation = "kubevirt-mcp/scheduled-for"
+)
+
+// snapshotSchedule is the schedule of a VM stored in its annotation
+type snapshotSchedule struct {
+	Schedule  string    `json:"schedule"`
+	Retention int       `json:"retention"`
+	Since     time.Time `json:"since"`
+}
+
+// SnapshotScheduleParams represents the parameters of vm_snapshot_schedule
+type SnapshotScheduleParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Schedule  string `json:"schedule,omitempty"`
+	Retention int    `json:"retention,omitempty"`
+	Remove    bool   `json:"remove,omitempty"`
+}
+
+// SnapshotScheduleStatusParams represents the parameters of
+// vm_snapshot_schedule_status
+type SnapshotScheduleStatusParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// SnapshotScheduleInfo reports the schedule of a VM and its snapshots
+type SnapshotScheduleInfo struct {
+	Namespace string         `json:"namespace"`
+	VMName    string         `json:"vmName"`
+	Schedule  string         `json:"schedule"`
+	Retention int            `json:"retention"`
+	NextRun   *time.Time     `json:"nextRun,omitempty"`
+	NextRunIn string         `json:"nextRunIn,omitempty"`
+	LastRun   *time.Time     `json:"lastRun,omitempty"`
+	LastError string         `json:"lastError,omitempty"`
+	Snapshots []SnapshotInfo `json:"snapshots"`
+	Invalid   string         `json:"invalid,omitempty"`
+}
+
+// SnapshotScheduleResult is the vm_snapshot_schedule and
+// vm_snapshot_schedule_status tool result
+type SnapshotScheduleResult struct {
+	Scheduler string                 `json:"scheduler"`
+	Schedules []SnapshotScheduleInfo `json:"schedules"`
+	Removed   bool                   `json:"removed,omitempty"`
+	Diff      string                 `json:"diff,omitempty"`
+}
+
+// scheduleRun is the outcome of the last scheduler run for a VM
+type scheduleRun struct {
+	time time.Time
+	err  string
+}
+
+// scheduleRuns records the last scheduler run of each VM, by namespace/name
+var scheduleRuns = struct {
+	sync.Mutex
+	runs map[string]scheduleRun
+}{runs: map[string]scheduleRun{}}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_snapshot_schedule",
+		Description: "Take VirtualMachineSnapshots of a VM on a cron schedule, keeping the most recent ones and deleting older scheduled snapshots. The schedule is stored on the VM and run by the server, see vm_snapshot_schedule_status",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"schedule": map[string]interface{}{
+					"type":        "string",
+					"description": "Cron expression in UTC with minute, hour, day of month, month and day of week fields, e.g. '0 2 * * *' for every night at 02:00, or @hourly, @daily, @weekly, @monthly",
+				},
+				"retention": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of scheduled snapshots to keep",
+					"default":     defaultSnapshotRetention,
+				},
+				"remove": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Remove the schedule instead, the snapshots it took are kept",
+					"default":     false,
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleSnapshotSchedule,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_snapshot_schedule_status",
+		Description: "List the snapshot schedules with their next run, the last run error and the scheduled snapshots they keep",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Only list schedules in this namespace (default: all namespaces)",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Only report the schedule of this VM, requires namespace",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleSnapshotScheduleStatus,
+	})
+}
+
+// handleSnapshotSchedule is the tools/call handler for vm_snapshot_schedule
+func handleSnapshotSchedule(ctx context.Context, args json.RawMessage) (string, error) {
+	var params SnapshotScheduleParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	var patch map[string]interface{}
+	if params.Remove {
+		if params.Schedule != "" {
+			return "", &invalidParamsError{err: fmt.Errorf("schedule and remove cannot be combined")}
+		}
+		patch = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      map[string]interface{}{snapshotScheduleLabel: nil},
+				"annotations": map[string]interface{}{snapshotScheduleLabel: nil},
+			},
+		}
+	} else {
+		if params.Schedule == "" {
+			return "", missingArgument("schedule")
+		}
+		cron, err := parseCron(params.Schedule)
+		if err != nil {
+			return "", &invalidParamsError{err: err}
+		}
+		if cron.next(clock.Now()).IsZero() {
+			return "", &invalidParamsError{err: fmt.Errorf("schedule '%s' never runs", params.Schedule)}
+		}
+		if params.Retention == 0 {
+			params.Retention = defaultSnapshotRetention
+		}
+		if params.Retention < 1 || params.Retention > maxSnapshotRetention {
+			return "", &invalidParamsError{err: fmt.Errorf("retention must be between 1 and %d", maxSnapshotRetention)}
+		}
+		schedule, err := json.Marshal(snapshotSchedule{Schedule: params.Schedule, Retention: params.Retention, Since: clock.Now().UTC().Truncate(time.Second)})
+		if err != nil {
+			return "", err
+		}
+		patch = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      map[string]interface{}{snapshotScheduleLabel: "true"},
+				"annotations": map[string]interface{}{snapshotScheduleLabel: string(schedule)},
+			},
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+
+	diff, err := mutationDiff(ctx, "virtualmachine", params.VMName, params.Namespace, func() error {
+		_, err := runKubectl(ctx, "patch", "virtualmachine", params.VMName, "-n", params.Namespace, "--type=merge", "-p", string(data))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	result := &SnapshotScheduleResult{Scheduler: schedulerState(), Schedules: []SnapshotScheduleInfo{}, Removed: params.Remove, Diff: diff}
+	if !params.Remove {
+		schedules, err := snapshotSchedules(ctx, params.Namespace, params.VMName)
+		if err != nil {
+			return "", err
+		}
+		result.Schedules = schedules
+	}
+	return formatJSON(result)
+}
+
+// handleSnapshotScheduleStatus is the tools/call handler for
+// vm_snapshot_schedule_status
+func handleSnapshotScheduleStatus(ctx context.Context, args json.RawMessage) (string, error) {
+	var params SnapshotScheduleStatusParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.VMName != "" && params.Namespace == "" {
+		return "", missingArgument("namespace")
+	}
+
+	schedules, err := snapshotSchedules(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return "", err
+	}
+	result := &SnapshotScheduleResult{Scheduler: schedulerState(), Schedules: schedules}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// schedulerState tells whether this server takes the scheduled snapshots
+func schedulerState() string {
+	if serverConfig.SnapshotSchedules.Interval == 0 {
+		return "disabled, set " + snapshotScheduleIntervalEnv + " to take scheduled snapshots"
+	}
+	return "running every " + serverConfig.SnapshotSchedules.Interval.String()
+}
+
+// scheduledVMs lists the VMs with a snapshot schedule, in all namespaces
+// when namespace is empty
+func scheduledVMs(ctx context.Context, namespace, vmName string) ([]VirtualMachine, error) {
+	var vms VirtualMachineList
+	args := append([]string{"get", "virtualmachines", "-l", snapshotScheduleLabel + "=true"}, namespaceArgs(namespace, namespace == "")...)
+	if err := runKubectlJSON(ctx, &vms, args...); err != nil {
+		return nil, err
+	}
+	var scheduled []VirtualMachine
+	for _, vm := range vms.Items {
+		if vmName == "" || vm.Metadata.Name == vmName {
+			scheduled = append(scheduled, vm)
+		}
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		a, b := scheduled[i].Metadata, scheduled[j].Metadata
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return scheduled, nil
+}
+
+// vmSnapshotSchedule returns the schedule stored on the VM
+func vmSnapshotSchedule(vm VirtualMachine) (snapshotSchedule, *cronSchedule, error) {
+	var schedule snapshotSchedule
+	if err := json.Unmarshal([]byte(vm.Metadata.Annotations[snapshotScheduleLabel]), &schedule); err != nil {
+		return schedule, nil, fmt.Errorf("invalid %s annotation: %v", snapshotScheduleLabel, err)
+	}
+	cron, err := parseCron(schedule.Schedule)
+	if err != nil {
+		return schedule, nil, err
+	}
+	if schedule.Retention < 1 {
+		schedule.Retention = defaultSnapshotRetention
+	}
+	return schedule, cron, nil
+}
+
+// scheduledSnapshots returns the snapshots the scheduler took of each VM,
+// most recent first, by namespace/name
+func scheduledSnapshots(ctx context.Context, namespace string) (map[string][]virtualMachineSnapshot, error) {
+	var list struct {
+		Items []virtualMachineSnapshot `json:"items"`
+	}
+	args := append([]string{"get", "virtualmachinesnapshots", "-l", scheduledSnapshotLabel + "=true"}, namespaceArgs(namespace, namespace == "")...)
+	if err := runKubectlJSON(ctx, &list, args...); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		return list.Items[i].Metadata.CreationTimestamp.After(list.Items[j].Metadata.CreationTimestamp)
+	})
+	snapshots := map[string][]virtualMachineSnapshot{}
+	for _, snapshot := range list.Items {
+		key := snapshot.Metadata.Namespace + "/" + snapshot.Spec.Source.Name
+		snapshots[key] = append(snapshots[key], snapshot)
+	}
+	return snapshots, nil
+}
+
+// snapshotSchedules reports the schedules and their snapshots
+func snapshotSchedules(ctx context.Context, namespace, vmName string) ([]SnapshotScheduleInfo, error) {
+	vms, err := scheduledVMs(ctx, namespace, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if len(vms) == 0 {
+		return []SnapshotScheduleInfo{}, nil
+	}
+	snapshots, err := scheduledSnapshots(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := []SnapshotScheduleInfo{}
+	for _, vm := range vms {
+		key := vm.Metadata.Namespace + "/" + vm.Metadata.Name
+		info := SnapshotScheduleInfo{Namespace: vm.Metadata.Namespace, VMName: vm.Metadata.Name, Snapshots: []SnapshotInfo{}}
+		schedule, cron, err := vmSnapshotSchedule(vm)
+		info.Schedule, info.Retention = schedule.Schedule, schedule.Retention
+		if err != nil {
+			info.Invalid = err.Error()
+		} else if next := cron.next(clock.Now()); !next.IsZero() {
+			info.NextRun = &next
+			info.NextRunIn = humanDuration(next.Sub(clock.Now()))
+		}
+
+		scheduleRuns.Lock()
+		if run, ok := scheduleRuns.runs[key]; ok {
+			info.LastRun, info.LastError = &run.time, run.err
+		}
+		scheduleRuns.Unlock()
+
+		for _, snapshot := range snapshots[key] {
+			info.Snapshots = append(info.Snapshots, snapshotInfo(snapshot))
+		}
+		schedules = append(schedules, info)
+	}
+	return schedules, nil
+}
+
+// startSnapshotScheduler checks the scheduler settings and starts taking
+// the scheduled snapshots unless it is disabled
+func startSnapshotScheduler() error {
+	interval := serverConfig.SnapshotSchedules.Interval
+	if interval == 0 {
+		return nil
+	}
+	if interval < minSnapshotScheduleInterval {
+		return fmt.Errorf("the snapshot schedule interval must be at least %v", minSnapshotScheduleInterval)
+	}
+
+	go func() {
+		for {
+			if err := runSnapshotSchedules(context.Background()); err != nil {
+				// Expected when no cluster is reachable, the server may be
+				// started long before one is
+				logMessage(LogDebug, "snapshots", "Snapshot schedules not checked: %v", err)
+			}
+			<-clock.After(interval)
+		}
+	}()
+	return nil
+}
+
+// runSnapshotSchedules takes the snapshots that are due and prunes the
+// scheduled snapshots beyond the retention of each VM. Snapshots are named
+// after their schedule slot, so servers sharing a cluster take each one once.
+func runSnapshotSchedules(ctx context.Context) error {
+	vms, err := scheduledVMs(ctx, "", "")
+	if err != nil || len(vms) == 0 {
+		return err
+	}
+	snapshots, err := scheduledSnapshots(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now().Truncate(time.Second)
+	for _, vm := range vms {
+		key := vm.Metadata.Namespace + "/" + vm.Metadata.Name
+		schedule, cron, err := vmSnapshotSchedule(vm)
+		if err != nil {
+			recordScheduleRun(key, now, err)
+			continue
+		}
+
+		// The slot of the most recent snapshot, or when the schedule was set
+		last := schedule.Since
+		if existing := snapshots[key]; len(existing) > 0 {
+			if slot, err := time.Parse(time.RFC3339, existing[0].Metadata.Annotations[scheduledForAnnotation]); err == nil && slot.After(last) {
+				last = slot
+			}
+		}
+		slot := cron.latest(last, now)
+		if slot.IsZero() {
+			continue
+		}
+
+		name, err := takeScheduledSnapshot(ctx, vm.Metadata.Namespace, vm.Metadata.Name, slot)
+		if err == nil {
+			logMessage(LogInfo, "snapshots", "Took scheduled snapshot %s/%s", vm.Metadata.Namespace, name)
+			err = pruneScheduledSnapshots(ctx, vm.Metadata.Namespace, vm.Metadata.Name, schedule.Retention)
+		}
+		if err != nil {
+			logMessage(LogWarning, "snapshots", "Scheduled snapshot of %s failed: %v", key, err)
+		}
+		recordScheduleRun(key, now, err)
+	}
+	return nil
+}
+
+// recordScheduleRun keeps the outcome of a scheduler run for the status
+func recordScheduleRun(key string, t time.Time, err error) {
+	run := scheduleRun{time: t}
+	if err != nil {
+		run.err = err.Error()
+	}
+	scheduleRuns.Lock()
+	scheduleRuns.runs[key] = run
+	scheduleRuns.Unlock()
+}
+
+// takeScheduledSnapshot creates the snapshot of the VM for the slot,
+// succeeding when another server already took it
+func takeScheduledSnapshot(ctx context.Context, namespace, vmName string, slot time.Time) (string, error) {
+	apiVersion, err := snapshotAPIVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	labels := managedLabels("vm_snapshot_schedule", false)
+	labels[scheduledSnapshotLabel] = "true"
+	name := vmName + "-scheduled-" + slot.UTC().Format("20060102-1504")
+	err = createObject(ctx, map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "VirtualMachineSnapshot",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   namespace,
+			"labels":      labels,
+			"annotations": map[string]string{scheduledForAnnotation: slot.UTC().Format(time.RFC3339)},
+		},
+		"spec": map[string]interface{}{
+			"source": map[string]interface{}{"apiGroup": "kubevirt.io", "kind": "VirtualMachine", "name": vmName},
+		},
+	})
+	if err != nil && !strings.Contains(err.Error(), "AlreadyExists") {
+		return "", fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	return name, nil
+}
+
+// pruneScheduledSnapshots deletes the oldest scheduled snapshots of the VM
+// beyond the retention
+func pruneScheduledSnapshots(ctx context.Context, namespace, vmName string, retention int) error {
+	snapshots, err := scheduledSnapshots(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	existing := snapshots[namespace+"/"+vmName]
+	if len(existing) <= retention {
+		return nil
+	}
+	var failed []string
+	for _, snapshot := range existing[retention:] {
+		if _, err := runKubectl(ctx, "delete", "virtualmachinesnapshot", snapshot.Metadata.Name, "-n", namespace, "--ignore-not-found", "--wait=false"); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", snapshot.Metadata.Name, err))
+			continue
+		}
+		logMessage(LogInfo, "snapshots", "Deleted scheduled snapshot %s/%s beyond the retention of %d", namespace, snapshot.Metadata.Name, retention)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete old snapshots: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// tables renders the schedules and the snapshots they keep
+func (r *SnapshotScheduleResult) tables() []table {
+	schedules := table{title: "Snapshot schedules (scheduler " + r.Scheduler + ")", headers: []string{"NAMESPACE", "VM", "SCHEDULE", "RETENTION", "NEXT RUN", "SNAPSHOTS", "LAST ERROR"}}
+	snapshots := table{title: "Scheduled snapshots", headers: []string{"NAMESPACE", "VM", "NAME", "READY", "CREATED", "ERROR"}}
+	for _, s := range r.Schedules {
+		next := s.Invalid
+		if s.NextRun != nil {
+			next = s.NextRun.UTC().Format(time.RFC3339) + " (in " + s.NextRunIn + ")"
+		}
+		schedules.rows = append(schedules.rows, []string{s.Namespace, s.VMName, s.Schedule, strconv.Itoa(s.Retention), next, strconv.Itoa(len(s.Snapshots)), s.LastError})
+		for _, snapshot := range s.Snapshots {
+			snapshots.rows = append(snapshots.rows, []string{s.Namespace, s.VMName, snapshot.Name, strconv.FormatBool(snapshot.ReadyToUse), snapshot.Created, snapshot.Error})
+		}
+	}
+	return []table{schedules, snapshots}
+}
+
+// cronSchedule is a parsed cron expression, evaluated in UTC
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays []bool
+	// anyDay and anyWeekday tell whether the day fields are *, when both
+	// are restricted a day matching either runs, like cron does
+	anyDay, anyWeekday bool
+}
+
+// cronMacros are the shorthands accepted instead of the five fields
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression with minute, hour, day of month, month
+// and day of week fields. Fields take *, numbers, ranges, lists and steps.
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) == 1 {
+		if macro, ok := cronMacros[fields[0]]; ok {
+			fields = strings.Fields(macro)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule '%s', use five fields: minute hour day-of-month month day-of-week", expression)
+	}
+
+	var c cronSchedule
+	var err error
+	bounds := []struct {
+		field    *[]bool
+		min, max int
+		name     string
+	}{
+		{&c.minutes, 0, 59, "minute"},
+		{&c.hours, 0, 23, "hour"},
+		{&c.days, 1, 31, "day of month"},
+		{&c.months, 1, 12, "month"},
+		{&c.weekdays, 0, 7, "day of week"},
+	}
+	for i, b := range bounds {
+		if *b.field, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("invalid %s '%s' in schedule '%s': %v", b.name, fields[i], expression, err)
+		}
+	}
+	// Sunday is 0 or 7
+	c.weekdays[0] = c.weekdays[0] || c.weekdays[7]
+	c.anyDay = fields[2] == "*"
+	c.anyWeekday = fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField returns the values a cron field matches, indexed by value
+func parseCronField(field string, min, max int) ([]bool, error) {
+	values := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step '%s'", stepPart)
+			}
+		}
+
+		low, high := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", from)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value '%s'", to)
+				}
+			} else if hasStep {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("'%s' is not within %d-%d", part, min, max)
+		}
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matchesDay reports whether the schedule runs on the day of t
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	day, weekday := c.days[t.Day()], c.weekdays[t.Weekday()]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	}
+	return day || weekday
+}
+
+// next returns the first time after t the schedule runs, or the zero time
+// when it never does, e.g. on February 30
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !c.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !c.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+		case !c.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// latest returns the most recent time the schedule ran after last and not
+// after now, or the zero time when it did not. Missed runs are not caught
+// up one by one.
+func (c *cronSchedule) latest(last, now time.Time) time.Time {
+	var slot time.Time
+	for t := c.next(last); !t.IsZero() && !t.After(now); t = c.next(t) {
+		slot = t
+	}
+	return slot
+}
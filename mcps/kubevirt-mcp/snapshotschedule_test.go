@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"* * *", "use five fields"},
+		{"@reboot", "use five fields"},
+		{"60 * * * *", "invalid minute '60'"},
+		{"* 24 * * *", "invalid hour '24'"},
+		{"* * 0 * *", "invalid day of month '0'"},
+		{"* * 32 * *", "invalid day of month '32'"},
+		{"* * * 13 *", "invalid month '13'"},
+		{"* * * * 8", "invalid day of week '8'"},
+		{"5-1 * * * *", "'5-1' is not within 0-59"},
+		{"*/0 * * * *", "invalid step '0'"},
+		{"1-5/x * * * *", "invalid step 'x'"},
+		{"a * * * *", "invalid value 'a'"},
+		{"1-b * * * *", "invalid value 'b'"},
+		{"1,,2 * * * *", "invalid value ''"},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expression); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseCron(%q) error = %v, want %q", tt.expression, err, tt.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2025-01-01 is a Wednesday
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2025, month, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name       string
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		{"step", "*/15 * * * *", at(1, 1, 10, 7), at(1, 1, 10, 15)},
+		{"range with a step", "10-40/10 * * * *", at(1, 1, 10, 40).Add(30 * time.Second), at(1, 1, 11, 10)},
+		{"value with a step", "50/5 * * * *", at(1, 1, 10, 56), at(1, 1, 11, 50)},
+		{"list", "5,35 8,20 * * *", at(1, 1, 8, 35), at(1, 1, 20, 5)},
+		{"macro", "@hourly", at(1, 1, 10, 7), at(1, 1, 11, 0)},
+		{"sunday as 7", "0 0 * * 7", at(1, 1, 0, 0), at(1, 5, 0, 0)},
+		{"sunday as 0", "0 0 * * 0", at(1, 1, 0, 0), at(1, 5, 0, 0)},
+		{"weekdays", "30 2 * * 1-5", at(1, 3, 3, 0), at(1, 6, 2, 30)},
+		{"day of month only", "0 0 13 * *", at(1, 1, 0, 0), at(1, 13, 0, 0)},
+		{"day of month or week, the weekday first", "0 12 13 * 5", at(1, 1, 0, 0), at(1, 3, 12, 0)},
+		{"day of month or week, the next weekday", "0 12 13 * 5", at(1, 3, 12, 0), at(1, 10, 12, 0)},
+		{"day of month or week, the day of month", "0 12 13 * 5", at(1, 10, 12, 0), at(1, 13, 12, 0)},
+		{"month step", "0 0 1 */3 *", at(1, 1, 0, 0), at(4, 1, 0, 0)},
+		{"next year", "0 0 1 1 *", at(12, 31, 23, 59), time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", at(1, 1, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"not in the past minute", "* * * * *", at(1, 1, 10, 7).Add(59 * time.Second), at(1, 1, 10, 8)},
+		{"in another zone", "0 10 * * *", time.Date(2025, 1, 1, 10, 30, 0, 0, time.FixedZone("CET", 3600)), at(1, 1, 10, 0)},
+		{"never", "0 0 30 2 *", at(1, 1, 0, 0), time.Time{}},
+		{"never on the 31st", "0 0 31 4,6,9,11 *", at(1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCron(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.next(tt.from); !got.Equal(tt.want) {
+				t.Fatalf("next(%s) of %q = %s, want %s", tt.from, tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronLatest(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		expression string
+		last, now  time.Time
+		want       time.Time
+	}{
+		// Missed runs collapse into the latest one
+		{"0 * * * *", at(10, 0), at(13, 30), at(13, 0)},
+		{"0 * * * *", at(10, 0), at(13, 0), at(13, 0)},
+		{"0 * * * *", at(10, 0), at(10, 30), time.Time{}},
+		{"0 0 30 2 *", at(10, 0), at(13, 30), time.Time{}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := schedule.latest(tt.last, tt.now); !got.Equal(tt.want) {
+			t.Errorf("latest(%s, %s) of %q = %s, want %s", tt.last, tt.now, tt.expression, got, tt.want)
+		}
+	}
+}
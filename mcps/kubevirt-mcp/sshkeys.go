@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	sshKeyFile      = "id_ed25519"
+	sshUserFile     = "user"
+	sshInjectExec   = "exec"
+	sshInjectAccess = "access_credentials"
+)
+
+// guestUserRegex matches valid guest user names, which are used in shell commands
+var guestUserRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// SSHBootstrapParams represents the parameters for the SSH key-pair bootstrap
+type SSHBootstrapParams struct {
+	Namespace   string `json:"namespace,omitempty"`
+	VMName      string `json:"vm_name"`
+	User        string `json:"user"`
+	Inject      string `json:"inject,omitempty"`
+	StoreSecret bool   `json:"store_secret,omitempty"`
+	Regenerate  bool   `json:"regenerate,omitempty"`
+}
+
+// SSHBootstrapResult reports where the key pair was stored and how it was injected
+type SSHBootstrapResult struct {
+	Namespace      string `json:"namespace"`
+	VMName         string `json:"vmName"`
+	User           string `json:"user"`
+	PrivateKeyPath string `json:"privateKeyPath"`
+	PublicKey      string `json:"publicKey"`
+	Inject         string `json:"inject"`
+	PrivateSecret  string `json:"privateKeySecret,omitempty"`
+	PublicSecret   string `json:"publicKeySecret,omitempty"`
+	Note           string `json:"note,omitempty"`
+	Diff           string `json:"diff,omitempty"`
+}
+
+// SSHKey is a key pair stored in the server keystore for a VM, with the
+// private key decrypted when the keystore is encrypted
+type SSHKey struct {
+	PrivateKeyPath string
+	User           string
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_ssh_bootstrap",
+		Description: "Generate an SSH key pair for a VM, keep the private key server-side and inject the public key into the guest so ssh-mode execs can use it",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"user": map[string]interface{}{
+					"type":        "string",
+					"description": "Guest user that the public key is authorized for",
+				},
+				"inject": map[string]interface{}{
+					"type":        "string",
+					"description": "How to inject the public key: exec appends it to authorized_keys right away (via vm_exec), access_credentials adds a KubeVirt accessCredentials entry propagated by the guest agent (applies after a restart)",
+					"enum":        []string{sshInjectExec, sshInjectAccess},
+					"default":     sshInjectExec,
+				},
+				"store_secret": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also store the private key in a Kubernetes Secret next to the VM",
+					"default":     false,
+				},
+				"regenerate": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Replace an existing key pair for this VM",
+					"default":     false,
+				},
+			},
+			"required": []string{"vm_name", "user"},
+		},
+		Handler: handleSSHBootstrap,
+	})
+}
+
+// handleSSHBootstrap is the tools/call handler for vm_ssh_bootstrap
+func handleSSHBootstrap(ctx context.Context, args json.RawMessage) (string, error) {
+	var params SSHBootstrapParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.User == "" {
+		return "", missingArgument("user")
+	}
+	if !guestUserRegex.MatchString(params.User) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid user name '%s'", params.User)}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Inject == "" {
+		params.Inject = sshInjectExec
+	}
+	if params.Inject != sshInjectExec && params.Inject != sshInjectAccess {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported inject method '%s'", params.Inject)}
+	}
+	if err := checkVMStateNames(params.Namespace, params.VMName); err != nil {
+		return "", err
+	}
+
+	result, err := bootstrapSSHKey(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// bootstrapSSHKey generates (or reuses) the VM key pair and injects the public key
+func bootstrapSSHKey(ctx context.Context, params SSHBootstrapParams) (*SSHBootstrapResult, error) {
+	// The keystore is only touched for VMs that exist, so no directories are
+	// left behind for mistyped names
+	var vm VirtualMachine
+	found, err := getOptionalObject(ctx, &vm, "virtualmachine", params.VMName, params.Namespace)
+	if err == nil && !found {
+		found, err = getOptionalObject(ctx, &vm, "virtualmachineinstance", params.VMName, params.Namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("VM '%s' not found in namespace '%s'", params.VMName, params.Namespace)
+	}
+
+	keyDir := sshKeyDir(params.Namespace, params.VMName)
+	privateKeyPath := filepath.Join(keyDir, sshKeyFile)
+
+	if params.Regenerate {
+		forgetCredential(privateKeyPath)
+		os.Remove(privateKeyPath + ".pub")
+	}
+
+	if !credentialStored(privateKeyPath) {
+		if err := generateSSHKey(keyDir, fmt.Sprintf("kubevirt-mcp@%s/%s", params.Namespace, params.VMName)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(keyDir, sshUserFile), []byte(params.User+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to record SSH user: %v", err)
+	}
+
+	publicKey, err := os.ReadFile(privateKeyPath + ".pub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %v", err)
+	}
+
+	result := &SSHBootstrapResult{
+		Namespace:      params.Namespace,
+		VMName:         params.VMName,
+		User:           params.User,
+		PrivateKeyPath: privateKeyPath,
+		PublicKey:      strings.TrimSpace(string(publicKey)),
+		Inject:         params.Inject,
+	}
+
+	if credentialsKey != nil {
+		result.PrivateKeyPath += encryptedSuffix
+	}
+
+	if params.StoreSecret {
+		result.PrivateSecret = fmt.Sprintf("kubevirt-mcp-ssh-%s", params.VMName)
+		keyFile, ok := credentialFile(privateKeyPath)
+		if !ok {
+			return nil, fmt.Errorf("failed to read the private key %s", result.PrivateKeyPath)
+		}
+		if err := applySecretFromFile(ctx, params.Namespace, result.PrivateSecret, "ssh-privatekey", keyFile); err != nil {
+			return nil, fmt.Errorf("failed to store private key secret: %v", err)
+		}
+	}
+
+	switch params.Inject {
+	case sshInjectExec:
+		if err := injectKeyViaExec(ctx, params, result.PublicKey); err != nil {
+			return nil, err
+		}
+	case sshInjectAccess:
+		result.PublicSecret = fmt.Sprintf("kubevirt-mcp-ssh-%s-pub", params.VMName)
+		if err := applySecretFromFile(ctx, params.Namespace, result.PublicSecret, "key", privateKeyPath+".pub"); err != nil {
+			return nil, fmt.Errorf("failed to store public key secret: %v", err)
+		}
+		// Secrets are left out of the diff so key material is not echoed back
+		diff, err := mutationDiff(ctx, "virtualmachine", params.VMName, params.Namespace, func() error {
+			return addAccessCredential(ctx, params.Namespace, params.VMName, result.PublicSecret, params.User)
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Diff = diff
+		result.Note = "accessCredentials added to the VM template, restart the VM for the guest agent to propagate the key"
+	}
+
+	return result, nil
+}
+
+// generateSSHKey generates the key pair of a VM in its keystore directory.
+// The private key is generated in a temporary directory and stored with
+// writeCredential, so it never reaches the state directory in clear when
+// encryption is on.
+func generateSSHKey(keyDir, comment string) error {
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	tmpDir, err := os.MkdirTemp(os.Getenv("XDG_RUNTIME_DIR"), "kubevirt-mcp-ssh-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpKey := filepath.Join(tmpDir, sshKeyFile)
+	cmd := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", comment, "-f", tmpKey)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ssh-keygen failed: %v\nOutput: %s", err, string(output))
+	}
+	privateKey, err := os.ReadFile(tmpKey)
+	if err != nil {
+		return fmt.Errorf("failed to read generated key: %v", err)
+	}
+	publicKey, err := os.ReadFile(tmpKey + ".pub")
+	if err != nil {
+		return fmt.Errorf("failed to read generated public key: %v", err)
+	}
+	if err := writeCredential(filepath.Join(keyDir, sshKeyFile), privateKey); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(keyDir, sshKeyFile+".pub"), publicKey, 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	return nil
+}
+
+// injectKeyViaExec appends the public key to the user's authorized_keys
+func injectKeyViaExec(ctx context.Context, params SSHBootstrapParams, publicKey string) error {
+	home := fmt.Sprintf("$(getent passwd %s | cut -d: -f6)", params.User)
+	script := fmt.Sprintf(
+		`h=%s; mkdir -p "$h/.ssh" && grep -qxF '%s' "$h/.ssh/authorized_keys" 2>/dev/null || echo '%s' >> "$h/.ssh/authorized_keys"; chmod 700 "$h/.ssh" && chmod 600 "$h/.ssh/authorized_keys" && chown -R %s: "$h/.ssh"`,
+		home, publicKey, publicKey, params.User)
+
+	if _, err := runGuestCommand(ctx, VMExecParams{
+		Namespace: params.Namespace,
+		VMName:    params.VMName,
+		Command:   script,
+		Timeout:   60,
+	}); err != nil {
+		return fmt.Errorf("failed to inject public key: %v", err)
+	}
+	return nil
+}
+
+// addAccessCredential adds an sshPublicKey access credential propagated by the
+// guest agent to the VM template, unless one for the secret already exists
+func addAccessCredential(ctx context.Context, namespace, vmName, secretName, user string) error {
+	var vm struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					AccessCredentials []json.RawMessage `json:"accessCredentials"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", vmName, "-n", namespace); err != nil {
+		return err
+	}
+
+	for _, credential := range vm.Spec.Template.Spec.AccessCredentials {
+		if strings.Contains(string(credential), `"`+secretName+`"`) {
+			return nil
+		}
+	}
+
+	credential := map[string]interface{}{
+		"sshPublicKey": map[string]interface{}{
+			"source": map[string]interface{}{
+				"secret": map[string]interface{}{"secretName": secretName},
+			},
+			"propagationMethod": map[string]interface{}{
+				"qemuGuestAgent": map[string]interface{}{"users": []string{user}},
+			},
+		},
+	}
+
+	op := map[string]interface{}{"op": "add", "path": "/spec/template/spec/accessCredentials/-", "value": credential}
+	if len(vm.Spec.Template.Spec.AccessCredentials) == 0 {
+		op = map[string]interface{}{"op": "add", "path": "/spec/template/spec/accessCredentials", "value": []interface{}{credential}}
+	}
+
+	patch, err := json.Marshal([]interface{}{op})
+	if err != nil {
+		return err
+	}
+	if _, err := runKubectl(ctx, "patch", "virtualmachine", vmName, "-n", namespace, "--type=json", "-p", string(patch)); err != nil {
+		return fmt.Errorf("failed to add access credentials: %v", err)
+	}
+	return nil
+}
+
+// applySecretFromFile creates or updates a generic Secret holding a single file
+func applySecretFromFile(ctx context.Context, namespace, name, key, path string) error {
+	manifest, err := runKubectl(ctx, "create", "secret", "generic", name, "-n", namespace,
+		"--from-file="+key+"="+path, "--dry-run=client", "-o", "json")
+	if err != nil {
+		return err
+	}
+
+	var secret map[string]interface{}
+	if err := json.Unmarshal(manifest, &secret); err != nil {
+		return err
+	}
+	metadata, _ := secret["metadata"].(map[string]interface{})
+	if metadata != nil {
+		metadata["labels"] = managedLabels("vm_ssh_bootstrap", false)
+	}
+
+	data, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+	_, err = runKubectlWithInput(ctx, data, "apply", "-f", "-")
+	return err
+}
+
+// stateDirEnv overrides the directory of the server state, like stateDir in
+// the configuration file and the --state-dir flag
+const stateDirEnv = "KUBEVIRT_MCP_STATE_DIR"
+
+// stateDir returns the directory where the server keeps local state such as
+// SSH keys. It defaults to ~/.kubevirt-mcp.
+func stateDir() string {
+	if dir := serverConfig.StateDir; dir != "" {
+		return expandHome(dir)
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "kubevirt-mcp")
+	}
+	return filepath.Join(homeDir, ".kubevirt-mcp")
+}
+
+// sshKeyDir returns the keystore directory of a VM. The names must have
+// passed checkVMStateNames.
+func sshKeyDir(namespace, vmName string) string {
+	return filepath.Join(stateDir(), "ssh", namespace, vmName)
+}
+
+// checkVMStateNames checks that the namespace and VM name of a per-VM path in
+// the state directory are DNS-1123 names, so client arguments such as ../..
+// cannot reach out of it
+func checkVMStateNames(namespace, vmName string) error {
+	if !vmNameRegex.MatchString(namespace) {
+		return &invalidParamsError{err: fmt.Errorf("invalid namespace '%s'", namespace)}
+	}
+	if !vmNameRegex.MatchString(vmName) {
+		return &invalidParamsError{err: fmt.Errorf("invalid VM name '%s'", vmName)}
+	}
+	return nil
+}
+
+// lookupSSHKey returns the bootstrapped key pair of a VM, if any
+func lookupSSHKey(namespace, vmName string) (*SSHKey, bool) {
+	if checkVMStateNames(namespace, vmName) != nil {
+		return nil, false
+	}
+	keyDir := sshKeyDir(namespace, vmName)
+	privateKeyPath, ok := credentialFile(filepath.Join(keyDir, sshKeyFile))
+	if !ok {
+		return nil, false
+	}
+
+	user, err := os.ReadFile(filepath.Join(keyDir, sshUserFile))
+	if err != nil {
+		return nil, false
+	}
+
+	return &SSHKey{PrivateKeyPath: privateKeyPath, User: strings.TrimSpace(string(user))}, true
+}
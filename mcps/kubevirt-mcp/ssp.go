@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// templateNameLabel and templateNamespaceLabel link a VM to the common
+	// template it was created from
+	templateNameLabel      = "vm.kubevirt.io/template"
+	templateNamespaceLabel = "vm.kubevirt.io/template.namespace"
+
+	// vmValidationsAnnotation overrides the template rules on the VM itself
+	vmValidationsAnnotation = "vm.kubevirt.io/validations"
+
+	// templateValidationsAnnotation holds the rules on the template
+	templateValidationsAnnotation = "validations"
+
+	// defaultCommonTemplatesNamespace is used when the SSP CR does not set one
+	defaultCommonTemplatesNamespace = "openshift"
+
+	jsonPathPrefix = "jsonpath::"
+)
+
+// TemplateValidationParams represents the parameters for the template validation tool
+type TemplateValidationParams struct {
+	Namespace         string          `json:"namespace,omitempty"`
+	VMName            string          `json:"vm_name,omitempty"`
+	VM                json.RawMessage `json:"vm,omitempty"`
+	Template          string          `json:"template,omitempty"`
+	TemplateNamespace string          `json:"template_namespace,omitempty"`
+	DryRun            bool            `json:"dry_run,omitempty"`
+}
+
+// validationRule is one entry of the template validations annotation, as
+// understood by the SSP template validator webhook
+type validationRule struct {
+	Name        string      `json:"name"`
+	Path        string      `json:"path"`
+	Rule        string      `json:"rule"`
+	Message     string      `json:"message"`
+	Valid       string      `json:"valid,omitempty"`
+	JustWarning bool        `json:"justWarning,omitempty"`
+	Min         interface{} `json:"min,omitempty"`
+	Max         interface{} `json:"max,omitempty"`
+	MinLength   interface{} `json:"minLength,omitempty"`
+	MaxLength   interface{} `json:"maxLength,omitempty"`
+	Values      []string    `json:"values,omitempty"`
+	Regex       string      `json:"regex,omitempty"`
+}
+
+// RuleViolation describes a validation rule the VM does not satisfy
+type RuleViolation struct {
+	Name    string      `json:"name"`
+	Path    string      `json:"path"`
+	Message string      `json:"message"`
+	Value   interface{} `json:"value,omitempty"`
+	Detail  string      `json:"detail"`
+}
+
+// TemplateValidationResult is the vm_validate_template tool result
+type TemplateValidationResult struct {
+	VM                string          `json:"vm"`
+	Template          string          `json:"template,omitempty"`
+	TemplateNamespace string          `json:"templateNamespace,omitempty"`
+	RulesSource       string          `json:"rulesSource"`
+	RulesChecked      int             `json:"rulesChecked"`
+	Skipped           []string        `json:"skipped,omitempty"`
+	Violations        []RuleViolation `json:"violations,omitempty"`
+	Warnings          []RuleViolation `json:"warnings,omitempty"`
+	Valid             bool            `json:"valid"`
+	DryRunError       string          `json:"dryRunError,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_validate_template",
+		Description: "On clusters with SSP, check a VM against the validation rules of its common template and report violations before it is created",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace of the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of an existing VM to validate",
+				},
+				"vm": map[string]interface{}{
+					"type":        "object",
+					"description": "VirtualMachine manifest to validate before creating it",
+				},
+				"template": map[string]interface{}{
+					"type":        "string",
+					"description": "Template name, defaults to the VM's vm.kubevirt.io/template label",
+				},
+				"template_namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Template namespace, defaults to the VM label or the SSP common templates namespace",
+				},
+				"dry_run": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also submit the manifest with a server-side dry run to catch other admission webhook denials",
+					"default":     false,
+				},
+			},
+		},
+		Handler: handleTemplateValidation,
+	})
+}
+
+// handleTemplateValidation is the tools/call handler for vm_validate_template
+func handleTemplateValidation(ctx context.Context, args json.RawMessage) (string, error) {
+	var params TemplateValidationParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" && len(params.VM) == 0 {
+		return "", missingArgument("vm_name or vm")
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := validateVMTemplate(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// validateVMTemplate evaluates the template validation rules against the VM
+func validateVMTemplate(ctx context.Context, params TemplateValidationParams) (*TemplateValidationResult, error) {
+	vm := map[string]interface{}{}
+	if len(params.VM) > 0 {
+		if err := json.Unmarshal(params.VM, &vm); err != nil {
+			return nil, &invalidParamsError{err: fmt.Errorf("vm is not a valid manifest: %v", err)}
+		}
+	} else if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+
+	metadata := nestedMap(vm, "metadata")
+	name, _ := metadata["name"].(string)
+	result := &TemplateValidationResult{VM: name}
+
+	rules, err := loadValidationRules(ctx, params, vm, result)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		violation, applies := checkValidationRule(vm, rule)
+		if !applies {
+			result.Skipped = append(result.Skipped, rule.Name)
+			continue
+		}
+		result.RulesChecked++
+		if violation == nil {
+			continue
+		}
+		if rule.JustWarning {
+			result.Warnings = append(result.Warnings, *violation)
+		} else {
+			result.Violations = append(result.Violations, *violation)
+		}
+	}
+	result.Valid = len(result.Violations) == 0
+
+	if params.DryRun && len(params.VM) > 0 {
+		if _, ok := metadata["namespace"]; !ok {
+			metadata["namespace"] = params.Namespace
+			vm["metadata"] = metadata
+		}
+		manifest, err := json.Marshal(vm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode manifest: %v", err)
+		}
+		if _, err := runKubectlWithInput(ctx, manifest, "create", "--dry-run=server", "-f", "-"); err != nil {
+			result.DryRunError = err.Error()
+			result.Valid = false
+		}
+	}
+
+	return result, nil
+}
+
+// loadValidationRules returns the rules that apply to the VM, preferring the
+// VM's own validations annotation over the template, like the SSP webhook
+func loadValidationRules(ctx context.Context, params TemplateValidationParams, vm map[string]interface{}, result *TemplateValidationResult) ([]validationRule, error) {
+	annotations := nestedMap(vm, "metadata", "annotations")
+	if rules, ok := annotations[vmValidationsAnnotation].(string); ok && rules != "" {
+		result.RulesSource = "vm annotation " + vmValidationsAnnotation
+		return parseValidationRules(rules)
+	}
+
+	labels := nestedMap(vm, "metadata", "labels")
+	templateName := params.Template
+	if templateName == "" {
+		templateName, _ = labels[templateNameLabel].(string)
+	}
+	if templateName == "" {
+		return nil, &invalidParamsError{err: fmt.Errorf("VM has no %s label, pass the template name", templateNameLabel)}
+	}
+	templateNamespace := params.TemplateNamespace
+	if templateNamespace == "" {
+		templateNamespace, _ = labels[templateNamespaceLabel].(string)
+	}
+	if templateNamespace == "" {
+		namespace, err := commonTemplatesNamespace(ctx)
+		if err != nil {
+			return nil, err
+		}
+		templateNamespace = namespace
+	}
+
+	var template struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	if err := runKubectlJSON(ctx, &template, "get", "templates.template.openshift.io", templateName, "-n", templateNamespace); err != nil {
+		return nil, fmt.Errorf("failed to get template %s/%s: %v", templateNamespace, templateName, err)
+	}
+
+	result.Template = templateName
+	result.TemplateNamespace = templateNamespace
+	result.RulesSource = "template annotation " + templateValidationsAnnotation
+
+	rules := template.Metadata.Annotations[templateValidationsAnnotation]
+	if rules == "" {
+		return nil, nil
+	}
+	return parseValidationRules(rules)
+}
+
+// commonTemplatesNamespace returns the namespace SSP deploys the common templates to
+func commonTemplatesNamespace(ctx context.Context) (string, error) {
+	var ssps struct {
+		Items []struct {
+			Spec struct {
+				CommonTemplates struct {
+					Namespace string `json:"namespace"`
+				} `json:"commonTemplates"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &ssps, "get", "ssps.ssp.kubevirt.io", "--all-namespaces"); err != nil {
+		return "", fmt.Errorf("SSP not found, is it installed? %v", err)
+	}
+	if len(ssps.Items) == 0 {
+		return "", fmt.Errorf("no SSP CR found, is SSP installed?")
+	}
+	if namespace := ssps.Items[0].Spec.CommonTemplates.Namespace; namespace != "" {
+		return namespace, nil
+	}
+	return defaultCommonTemplatesNamespace, nil
+}
+
+// parseValidationRules decodes a validations annotation
+func parseValidationRules(data string) ([]validationRule, error) {
+	var rules []validationRule
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse validation rules: %v", err)
+	}
+	return rules, nil
+}
+
+// checkValidationRule evaluates a rule against the VM. It reports whether
+// the rule applies, which it does not when its path or valid path is unset.
+func checkValidationRule(vm map[string]interface{}, rule validationRule) (*RuleViolation, bool) {
+	if rule.Valid != "" && len(lookupJSONPath(vm, rule.Valid)) == 0 {
+		return nil, false
+	}
+	values := lookupJSONPath(vm, rule.Path)
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	for _, value := range values {
+		if detail := ruleViolation(vm, rule, value); detail != "" {
+			return &RuleViolation{
+				Name:    rule.Name,
+				Path:    strings.TrimPrefix(rule.Path, jsonPathPrefix),
+				Message: rule.Message,
+				Value:   value,
+				Detail:  detail,
+			}, true
+		}
+	}
+	return nil, true
+}
+
+// ruleViolation returns why a single value breaks the rule, or "" if it does not
+func ruleViolation(vm map[string]interface{}, rule validationRule, value interface{}) string {
+	switch rule.Rule {
+	case "integer":
+		number, ok := toInt64(value)
+		if !ok {
+			return fmt.Sprintf("value %v is not an integer", value)
+		}
+		if min, ok := ruleBound(vm, rule.Min); ok && number < min {
+			return fmt.Sprintf("value %d is lower than %d", number, min)
+		}
+		if max, ok := ruleBound(vm, rule.Max); ok && number > max {
+			return fmt.Sprintf("value %d is greater than %d", number, max)
+		}
+	case "string":
+		text := fmt.Sprint(value)
+		if min, ok := ruleBound(vm, rule.MinLength); ok && int64(len(text)) < min {
+			return fmt.Sprintf("length %d is shorter than %d", len(text), min)
+		}
+		if max, ok := ruleBound(vm, rule.MaxLength); ok && int64(len(text)) > max {
+			return fmt.Sprintf("length %d is longer than %d", len(text), max)
+		}
+	case "enum":
+		text := fmt.Sprint(value)
+		for _, allowed := range rule.Values {
+			if text == allowed {
+				return ""
+			}
+		}
+		return fmt.Sprintf("value %q is not one of %s", text, strings.Join(rule.Values, ", "))
+	case "regex":
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Sprintf("invalid rule regex %q: %v", rule.Regex, err)
+		}
+		if !re.MatchString(fmt.Sprint(value)) {
+			return fmt.Sprintf("value %q does not match %s", value, rule.Regex)
+		}
+	}
+	return ""
+}
+
+// ruleBound resolves a min/max rule field, which is either a number or a
+// jsonpath into the VM
+func ruleBound(vm map[string]interface{}, bound interface{}) (int64, bool) {
+	if path, ok := bound.(string); ok && strings.HasPrefix(path, jsonPathPrefix) {
+		values := lookupJSONPath(vm, path)
+		if len(values) == 0 {
+			return 0, false
+		}
+		bound = values[0]
+	}
+	if bound == nil {
+		return 0, false
+	}
+	return toInt64(bound)
+}
+
+// lookupJSONPath returns the values at a "jsonpath::.a.b[*].c" path. Only the
+// subset of JSONPath used by the common templates is supported: field
+// selection, [*] and numeric indexes.
+func lookupJSONPath(obj map[string]interface{}, path string) []interface{} {
+	path = strings.TrimPrefix(path, jsonPathPrefix)
+	path = strings.ReplaceAll(path, "[", ".[")
+
+	current := []interface{}{obj}
+	for _, segment := range strings.Split(strings.Trim(path, "."), ".") {
+		if segment == "" {
+			continue
+		}
+		var next []interface{}
+		for _, node := range current {
+			switch {
+			case segment == "[*]":
+				if list, ok := node.([]interface{}); ok {
+					next = append(next, list...)
+				}
+			case strings.HasPrefix(segment, "["):
+				index, err := strconv.Atoi(strings.Trim(segment, "[]"))
+				if list, ok := node.([]interface{}); ok && err == nil && index >= 0 && index < len(list) {
+					next = append(next, list[index])
+				}
+			default:
+				if fields, ok := node.(map[string]interface{}); ok {
+					if value, found := fields[segment]; found {
+						next = append(next, value)
+					}
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// toInt64 converts JSON numbers and Kubernetes quantities such as "2Gi"
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		number, ok := parseQuantity(v)
+		return int64(number), ok
+	}
+	return 0, false
+}
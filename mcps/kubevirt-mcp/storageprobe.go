@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultProbeImage   = "registry.access.redhat.com/ubi9/ubi-minimal"
+	defaultProbeSize    = "1Gi"
+	defaultProbeSizeMiB = 256
+	defaultProbeTimeout = 300
+	probeSyncWrites     = 1000
+)
+
+// StorageProbeParams represents the parameters for the storage latency probe
+type StorageProbeParams struct {
+	Namespace    string `json:"namespace,omitempty"`
+	StorageClass string `json:"storage_class"`
+	Size         string `json:"size,omitempty"`
+	TestSizeMiB  int    `json:"test_size_mib,omitempty"`
+	Image        string `json:"image,omitempty"`
+	Timeout      int    `json:"timeout,omitempty"`
+}
+
+// StorageProbeResult reports the measurements of a storage probe run
+type StorageProbeResult struct {
+	StorageClass         string  `json:"storageClass"`
+	Namespace            string  `json:"namespace"`
+	TestSizeMiB          int     `json:"testSizeMiB"`
+	WriteThroughputMBps  float64 `json:"writeThroughputMBps"`
+	ReadThroughputMBps   float64 `json:"readThroughputMBps"`
+	SyncWriteLatencyMs   float64 `json:"syncWriteLatencyMs"`
+	BindAndStartDuration string  `json:"bindAndStartDuration"`
+}
+
+// ddSummaryRegex matches the summary line of GNU dd, e.g.
+// "104857600 bytes (105 MB, 100 MiB) copied, 0.123 s, 849 MB/s"
+var ddSummaryRegex = regexp.MustCompile(`(\d+) bytes .*copied, ([0-9.]+) s`)
+
+// probeScript runs the dd measurements. Each measurement is prefixed by a
+// marker line so the summaries can be told apart in the pod log.
+const probeScript = `set -e
+export LC_ALL=C
+cd /data
+echo "== write"
+dd if=/dev/zero of=probe bs=1M count=%[1]d oflag=direct 2>&1 | tail -n 1
+echo "== read"
+dd if=probe of=/dev/null bs=1M iflag=direct 2>&1 | tail -n 1
+echo "== sync"
+dd if=/dev/zero of=sync bs=4k count=%[2]d oflag=dsync 2>&1 | tail -n 1
+rm -f probe sync
+`
+
+func init() {
+	registerTool(Tool{
+		Name:        "storage_probe",
+		Description: "Measure write/read throughput and sync write latency of a StorageClass using a temporary PVC and helper pod",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Namespace to create the temporary PVC and pod in",
+					"default":     "default",
+				},
+				"storage_class": map[string]interface{}{
+					"type":        "string",
+					"description": "StorageClass to probe",
+				},
+				"size": map[string]interface{}{
+					"type":        "string",
+					"description": "Size of the temporary PVC (default: 1Gi)",
+					"default":     defaultProbeSize,
+				},
+				"test_size_mib": map[string]interface{}{
+					"type":        "integer",
+					"description": "Amount of data written for the throughput test in MiB (default: 256)",
+					"default":     defaultProbeSizeMiB,
+				},
+				"image": map[string]interface{}{
+					"type":        "string",
+					"description": "Helper pod image, must provide GNU dd",
+					"default":     defaultProbeImage,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for the whole probe (default: 300)",
+					"default":     defaultProbeTimeout,
+				},
+			},
+			"required": []string{"storage_class"},
+		},
+		Handler: handleStorageProbe,
+	})
+}
+
+// handleStorageProbe is the tools/call handler for storage_probe
+func handleStorageProbe(ctx context.Context, args json.RawMessage) (string, error) {
+	var params StorageProbeParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.StorageClass == "" {
+		return "", missingArgument("storage_class")
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Size == "" {
+		params.Size = defaultProbeSize
+	}
+	if params.TestSizeMiB == 0 {
+		params.TestSizeMiB = defaultProbeSizeMiB
+	}
+	if params.Image == "" {
+		params.Image = defaultProbeImage
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultProbeTimeout
+	}
+
+	result, err := probeStorage(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// probeStorage creates the PVC and helper pod, waits for the measurements and
+// always removes both objects afterwards
+func probeStorage(ctx context.Context, params StorageProbeParams) (*StorageProbeResult, error) {
+	name := generateName("kubevirt-mcp-storage-probe-")
+	labels := managedLabels("storage_probe", true)
+	timeout := time.Duration(params.Timeout) * time.Second
+
+	pvc := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata":   map[string]interface{}{"name": name, "namespace": params.Namespace, "labels": labels},
+		"spec": map[string]interface{}{
+			"storageClassName": params.StorageClass,
+			"accessModes":      []string{"ReadWriteOnce"},
+			"volumeMode":       "Filesystem",
+			"resources": map[string]interface{}{
+				"requests": map[string]interface{}{"storage": params.Size},
+			},
+		},
+	}
+
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": name, "namespace": params.Namespace, "labels": labels},
+		"spec": map[string]interface{}{
+			"restartPolicy": "Never",
+			"containers": []map[string]interface{}{{
+				"name":         "probe",
+				"image":        params.Image,
+				"command":      []string{"/bin/sh", "-c", fmt.Sprintf(probeScript, params.TestSizeMiB, probeSyncWrites)},
+				"volumeMounts": []map[string]interface{}{{"name": "data", "mountPath": "/data"}},
+			}},
+			"volumes": []map[string]interface{}{{
+				"name":                  "data",
+				"persistentVolumeClaim": map[string]interface{}{"claimName": name},
+			}},
+		},
+	}
+
+	if err := createObject(ctx, pvc); err != nil {
+		return nil, fmt.Errorf("failed to create probe PVC: %v", err)
+	}
+	// Cleanup also runs when the tool call was cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer runKubectl(cleanupCtx, "delete", "pvc", name, "-n", params.Namespace, "--ignore-not-found", "--wait=false")
+
+	if err := createObject(ctx, pod); err != nil {
+		return nil, fmt.Errorf("failed to create probe pod: %v", err)
+	}
+	defer runKubectl(cleanupCtx, "delete", "pod", name, "-n", params.Namespace, "--ignore-not-found", "--wait=false")
+
+	start := time.Now()
+	if err := waitFor(ctx, params.Namespace, "pod/"+name, "jsonpath={.status.phase}=Running", timeout); err != nil {
+		// The pod may already have completed before we observed it running
+		if waitErr := waitFor(ctx, params.Namespace, "pod/"+name, "jsonpath={.status.phase}=Succeeded", 5*time.Second); waitErr != nil {
+			return nil, fmt.Errorf("probe pod did not start (is the StorageClass able to bind?): %v", err)
+		}
+	}
+	bindAndStart := time.Since(start)
+
+	remaining := timeout - bindAndStart
+	if remaining < 10*time.Second {
+		remaining = 10 * time.Second
+	}
+	if err := waitFor(ctx, params.Namespace, "pod/"+name, "jsonpath={.status.phase}=Succeeded", remaining); err != nil {
+		logs, _ := runKubectl(ctx, "logs", name, "-n", params.Namespace)
+		return nil, fmt.Errorf("probe pod did not complete: %v\nLogs: %s", err, string(logs))
+	}
+
+	logs, err := runKubectl(ctx, "logs", name, "-n", params.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read probe results: %v", err)
+	}
+
+	result, err := parseProbeOutput(string(logs))
+	if err != nil {
+		return nil, err
+	}
+	result.StorageClass = params.StorageClass
+	result.Namespace = params.Namespace
+	result.TestSizeMiB = params.TestSizeMiB
+	result.BindAndStartDuration = bindAndStart.Round(time.Second).String()
+
+	return result, nil
+}
+
+// parseProbeOutput extracts the dd summaries printed by probeScript
+func parseProbeOutput(output string) (*StorageProbeResult, error) {
+	result := &StorageProbeResult{}
+	section := ""
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "== ") {
+			section = strings.TrimPrefix(line, "== ")
+			continue
+		}
+
+		match := ddSummaryRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		bytes, _ := strconv.ParseFloat(match[1], 64)
+		seconds, _ := strconv.ParseFloat(match[2], 64)
+		if seconds <= 0 {
+			continue
+		}
+
+		switch section {
+		case "write":
+			result.WriteThroughputMBps = round2(bytes / seconds / 1e6)
+		case "read":
+			result.ReadThroughputMBps = round2(bytes / seconds / 1e6)
+		case "sync":
+			result.SyncWriteLatencyMs = round2(seconds * 1000 / probeSyncWrites)
+		}
+	}
+
+	if result.WriteThroughputMBps == 0 && result.ReadThroughputMBps == 0 && result.SyncWriteLatencyMs == 0 {
+		return nil, fmt.Errorf("could not parse probe output:\n%s", output)
+	}
+	return result, nil
+}
+
+// round2 rounds to two decimal places
+func round2(v float64) float64 {
+	return float64(int64(v*100+0.5)) / 100
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReclaimMinAge leaves volumes being imported or just created for a
+// VM alone
+const defaultReclaimMinAge = time.Hour
+
+// dataImportCronLabel marks the DataVolumes of the golden image imports,
+// which are kept for DataSources even when no VM uses them
+const dataImportCronLabel = "cdi.kubevirt.io/dataImportCron"
+
+// persistentStateLabel names the VM of the PVC holding its TPM and EFI state
+const persistentStateLabel = "persistent-state-for"
+
+// StorageReclaimParams represents the parameters of storage_reclaim
+type StorageReclaimParams struct {
+	Namespace string   `json:"namespace,omitempty"`
+	MinAge    string   `json:"min_age,omitempty"`
+	Names     []string `json:"names,omitempty"`
+	Confirm   bool     `json:"confirm,omitempty"`
+	Format    string   `json:"format,omitempty"`
+}
+
+// ReclaimableVolume is a DataVolume or PVC no VM references
+type ReclaimableVolume struct {
+	Kind         string `json:"kind"`
+	Namespace    string `json:"namespace"`
+	Name         string `json:"name"`
+	StorageClass string `json:"storageClass,omitempty"`
+	Size         string `json:"size,omitempty"`
+	Bytes        int64  `json:"bytes"`
+	Phase        string `json:"phase,omitempty"`
+	Age          string `json:"age"`
+	Deleted      bool   `json:"deleted"`
+	Error        string `json:"error,omitempty"`
+}
+
+// StorageClassReclaim sums the reclaimable capacity of a storage class
+type StorageClassReclaim struct {
+	StorageClass string `json:"storageClass"`
+	Volumes      int    `json:"volumes"`
+	Bytes        int64  `json:"bytes"`
+	Size         string `json:"size"`
+}
+
+// StorageReclaimResult is the storage_reclaim tool result
+type StorageReclaimResult struct {
+	Namespace        string                `json:"namespace,omitempty"`
+	MinAge           string                `json:"minAge"`
+	Confirmed        bool                  `json:"confirmed"`
+	Volumes          []ReclaimableVolume   `json:"volumes"`
+	ReclaimableBytes int64                 `json:"reclaimableBytes"`
+	Reclaimable      string                `json:"reclaimable"`
+	ReclaimedBytes   int64                 `json:"reclaimedBytes,omitempty"`
+	StorageClasses   []StorageClassReclaim `json:"storageClasses"`
+	Errors           []string              `json:"errors,omitempty"`
+	Note             string                `json:"note,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "storage_reclaim",
+		Description: "Find DataVolumes and PVCs not referenced by any VM, VMI, running pod or DataSource and report the capacity they hold per storage class. Deletes them when confirm is set, in the namespace or only the ones listed in names",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Only look in this namespace (default: all namespaces)",
+				},
+				"min_age": map[string]interface{}{
+					"type":        "string",
+					"description": "Only report volumes older than this duration, so volumes of VMs being created are kept",
+					"default":     defaultReclaimMinAge.String(),
+				},
+				"names": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Only delete these volumes, as name or namespace/name, e.g. from a previous report",
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Must be true to delete the reported volumes of namespace or those listed in names; without it the tool only reports",
+					"default":     false,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleStorageReclaim,
+	})
+}
+
+// handleStorageReclaim is the tools/call handler for storage_reclaim
+func handleStorageReclaim(ctx context.Context, args json.RawMessage) (string, error) {
+	var params StorageReclaimParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	minAge := defaultReclaimMinAge
+	if params.MinAge != "" {
+		d, err := time.ParseDuration(params.MinAge)
+		if err != nil || d < 0 {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid min_age '%s', use a duration such as 30m", params.MinAge)}
+		}
+		minAge = d
+	}
+	if len(params.Names) > 0 && !params.Confirm {
+		return "", &invalidParamsError{err: errors.New("names selects the volumes to delete, set confirm to true as well")}
+	}
+	// A cluster-wide report is fine, a cluster-wide delete is too easy to
+	// ask for by mistake
+	if params.Confirm && params.Namespace == "" && len(params.Names) == 0 {
+		return "", &invalidParamsError{err: errors.New("confirm deletes only in a namespace or the volumes listed in names, set one of them; without both the tool only reports")}
+	}
+
+	result, err := reclaimStorage(ctx, params, minAge)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// reclaimObject holds the fields of a DataVolume or PVC needed to decide
+// whether it is used
+type reclaimObject struct {
+	Metadata struct {
+		ObjectMeta
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		StorageClassName string `json:"storageClassName,omitempty"`
+		Resources        struct {
+			Requests map[string]string `json:"requests,omitempty"`
+		} `json:"resources,omitempty"`
+		// Source is the clone source of a DataVolume
+		Source struct {
+			PVC *struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"pvc,omitempty"`
+		} `json:"source,omitempty"`
+	} `json:"spec"`
+	Status struct {
+		Phase    string            `json:"phase,omitempty"`
+		Capacity map[string]string `json:"capacity,omitempty"`
+	} `json:"status"`
+}
+
+// ownedBy returns the kind of the first owner of the object, if any
+func (o *reclaimObject) ownedBy() string {
+	if len(o.Metadata.OwnerReferences) == 0 {
+		return ""
+	}
+	return o.Metadata.OwnerReferences[0].Kind
+}
+
+// volumeUsers lists the objects that may reference a DataVolume or PVC
+type volumeUsers struct {
+	vms struct {
+		Items []struct {
+			Metadata ObjectMeta `json:"metadata"`
+			Spec     struct {
+				DataVolumeTemplates []struct {
+					Metadata ObjectMeta `json:"metadata"`
+				} `json:"dataVolumeTemplates,omitempty"`
+				Template struct {
+					Spec struct {
+						Volumes []Volume `json:"volumes,omitempty"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+			Status struct {
+				MemoryDumpRequest *struct {
+					ClaimName string `json:"claimName"`
+				} `json:"memoryDumpRequest,omitempty"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	vmis VirtualMachineInstanceList
+	pods struct {
+		Items []struct {
+			Metadata ObjectMeta `json:"metadata"`
+			Spec     struct {
+				Volumes []Volume `json:"volumes,omitempty"`
+			} `json:"spec"`
+			Status struct {
+				Phase string `json:"phase,omitempty"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	dataSources struct {
+		Items []struct {
+			Metadata ObjectMeta `json:"metadata"`
+			Spec     struct {
+				Source struct {
+					PVC *struct {
+						Namespace string `json:"namespace"`
+						Name      string `json:"name"`
+					} `json:"pvc,omitempty"`
+				} `json:"source"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+}
+
+// referencedVolumes returns the namespace/name keys of the DataVolumes and
+// PVCs in use. VMs, VMIs and pods are listed in the namespace of the
+// volumes, DataSources and clone sources may point to any namespace.
+func referencedVolumes(users *volumeUsers, dataVolumes []reclaimObject) map[string]bool {
+	referenced := map[string]bool{}
+	add := func(namespace string, volumes []Volume) {
+		for _, volume := range volumes {
+			if volume.DataVolume != nil {
+				referenced[namespace+"/"+volume.DataVolume.Name] = true
+			}
+			if volume.PersistentVolumeClaim != nil {
+				referenced[namespace+"/"+volume.PersistentVolumeClaim.ClaimName] = true
+			}
+		}
+	}
+
+	for _, vm := range users.vms.Items {
+		ns := vm.Metadata.Namespace
+		add(ns, vm.Spec.Template.Spec.Volumes)
+		for _, template := range vm.Spec.DataVolumeTemplates {
+			referenced[ns+"/"+template.Metadata.Name] = true
+		}
+		if dump := vm.Status.MemoryDumpRequest; dump != nil {
+			referenced[ns+"/"+dump.ClaimName] = true
+		}
+	}
+	for _, vmi := range users.vmis.Items {
+		add(vmi.Metadata.Namespace, vmi.Spec.Volumes)
+	}
+	for _, pod := range users.pods.Items {
+		if pod.Status.Phase != "Succeeded" && pod.Status.Phase != "Failed" {
+			add(pod.Metadata.Namespace, pod.Spec.Volumes)
+		}
+	}
+	// Sources without a namespace are in the namespace of their user
+	source := func(namespace, sourceNamespace, name string) string {
+		if sourceNamespace == "" {
+			sourceNamespace = namespace
+		}
+		return sourceNamespace + "/" + name
+	}
+	for _, ds := range users.dataSources.Items {
+		if pvc := ds.Spec.Source.PVC; pvc != nil {
+			referenced[source(ds.Metadata.Namespace, pvc.Namespace, pvc.Name)] = true
+		}
+	}
+	// A clone in progress still reads its source
+	for _, dv := range dataVolumes {
+		if pvc := dv.Spec.Source.PVC; pvc != nil && dv.Status.Phase != "Succeeded" {
+			referenced[source(dv.Metadata.Namespace, pvc.Namespace, pvc.Name)] = true
+		}
+	}
+	return referenced
+}
+
+// reclaimStorage finds the unreferenced volumes older than minAge and,
+// when confirmed, deletes them. A DataVolume stands for its PVC, deleting
+// it lets CDI delete the PVC. Volumes with another owner are left to it.
+func reclaimStorage(ctx context.Context, params StorageReclaimParams, minAge time.Duration) (*StorageReclaimResult, error) {
+	result := &StorageReclaimResult{Namespace: params.Namespace, MinAge: minAge.String(), Confirmed: params.Confirm, Volumes: []ReclaimableVolume{}, StorageClasses: []StorageClassReclaim{}}
+	scope := namespaceArgs(params.Namespace, params.Namespace == "")
+
+	// Without the VMs nothing can be told apart, the other lists are optional
+	users := &volumeUsers{}
+	reportProgress(ctx, "listing VMs")
+	if err := runKubectlJSON(ctx, &users.vms, append([]string{"get", "virtualmachines"}, scope...)...); err != nil {
+		return nil, fmt.Errorf("failed to list VMs: %v", err)
+	}
+	if err := runKubectlJSON(ctx, &users.vmis, append([]string{"get", "virtualmachineinstances"}, scope...)...); err != nil {
+		return nil, fmt.Errorf("failed to list VMIs: %v", err)
+	}
+	reportProgress(ctx, "listing pods")
+	if err := runKubectlJSON(ctx, &users.pods, append([]string{"get", "pods"}, scope...)...); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	var dataVolumes struct {
+		Items []reclaimObject `json:"items"`
+	}
+	reportProgress(ctx, "listing DataVolumes and PVCs")
+	cdi := true
+	if err := runKubectlJSON(ctx, &dataVolumes, append([]string{"get", "datavolumes.cdi.kubevirt.io"}, scope...)...); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// Clusters without CDI only have PVCs
+		cdi = false
+		logMessage(LogDebug, "storage", "Not listing DataVolumes: %v", err)
+	}
+	if cdi {
+		if err := runKubectlJSON(ctx, &users.dataSources, "get", "datasources.cdi.kubevirt.io", "--all-namespaces"); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to list DataSources, golden images may be reported: %v", err))
+		}
+	}
+	var pvcs struct {
+		Items []reclaimObject `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &pvcs, append([]string{"get", "persistentvolumeclaims"}, scope...)...); err != nil {
+		return nil, fmt.Errorf("failed to list PVCs: %v", err)
+	}
+
+	referenced := referencedVolumes(users, dataVolumes.Items)
+	vms := map[string]bool{}
+	for _, vm := range users.vms.Items {
+		vms[vm.Metadata.Namespace+"/"+vm.Metadata.Name] = true
+	}
+	pvcByKey := map[string]*reclaimObject{}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		pvcByKey[pvc.Metadata.Namespace+"/"+pvc.Metadata.Name] = pvc
+	}
+
+	now := clock.Now()
+	unused := func(obj *reclaimObject) bool {
+		key := obj.Metadata.Namespace + "/" + obj.Metadata.Name
+		if referenced[key] || now.Sub(obj.Metadata.CreationTimestamp) < minAge {
+			return false
+		}
+		// The TPM and EFI state outlives the VMI but belongs to the VM
+		if vm := obj.Metadata.Labels[persistentStateLabel]; vm != "" && vms[obj.Metadata.Namespace+"/"+vm] {
+			return false
+		}
+		return true
+	}
+
+	var candidates []ReclaimableVolume
+	for i := range dataVolumes.Items {
+		dv := &dataVolumes.Items[i]
+		if dv.ownedBy() != "" || dv.Metadata.Labels[dataImportCronLabel] != "" || !unused(dv) {
+			continue
+		}
+		// The PVC of the DataVolume may be in use on its own
+		pvc := pvcByKey[dv.Metadata.Namespace+"/"+dv.Metadata.Name]
+		if pvc != nil && !unused(pvc) {
+			continue
+		}
+		candidates = append(candidates, reclaimableVolume("DataVolume", dv, pvc, now))
+	}
+	for i := range pvcs.Items {
+		pvc := &pvcs.Items[i]
+		if pvc.ownedBy() != "" || !unused(pvc) {
+			continue
+		}
+		candidates = append(candidates, reclaimableVolume("PersistentVolumeClaim", pvc, pvc, now))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+
+	selected, err := selectReclaimVolumes(candidates, params.Names)
+	if err != nil {
+		return nil, err
+	}
+
+	classes := map[string]*StorageClassReclaim{}
+	for i := range candidates {
+		volume := &candidates[i]
+		result.ReclaimableBytes += volume.Bytes
+		class := classes[volume.StorageClass]
+		if class == nil {
+			class = &StorageClassReclaim{StorageClass: volume.StorageClass}
+			classes[volume.StorageClass] = class
+		}
+		class.Volumes++
+		class.Bytes += volume.Bytes
+
+		if !params.Confirm || !selected[i] {
+			continue
+		}
+		resource := "persistentvolumeclaim"
+		if volume.Kind == "DataVolume" {
+			resource = "datavolumes.cdi.kubevirt.io"
+		}
+		reportProgress(ctx, "deleting %s %s/%s", strings.ToLower(volume.Kind), volume.Namespace, volume.Name)
+		if _, err := runKubectl(ctx, "delete", resource, volume.Name, "-n", volume.Namespace, "--ignore-not-found", "--wait=false"); err != nil {
+			volume.Error = err.Error()
+			continue
+		}
+		volume.Deleted = true
+		result.ReclaimedBytes += volume.Bytes
+		logMessage(LogInfo, "storage", "Deleted unused %s %s/%s", strings.ToLower(volume.Kind), volume.Namespace, volume.Name)
+	}
+	result.Volumes = append(result.Volumes, candidates...)
+	result.Reclaimable = humanBytes(result.ReclaimableBytes)
+
+	for _, class := range classes {
+		class.Size = humanBytes(class.Bytes)
+		result.StorageClasses = append(result.StorageClasses, *class)
+	}
+	sort.Slice(result.StorageClasses, func(i, j int) bool {
+		return result.StorageClasses[i].Bytes > result.StorageClasses[j].Bytes
+	})
+
+	if !params.Confirm && len(candidates) > 0 {
+		result.Note = "Nothing was deleted. Check the volumes, then call again with confirm set to true, optionally listing the volumes to delete in names"
+	}
+	return result, nil
+}
+
+// reclaimableVolume describes obj, sized by the capacity of its PVC
+func reclaimableVolume(kind string, obj, pvc *reclaimObject, now time.Time) ReclaimableVolume {
+	volume := ReclaimableVolume{
+		Kind:      kind,
+		Namespace: obj.Metadata.Namespace,
+		Name:      obj.Metadata.Name,
+		Phase:     obj.Status.Phase,
+		Age:       humanDuration(now.Sub(obj.Metadata.CreationTimestamp)),
+	}
+	if pvc == nil {
+		return volume
+	}
+	volume.StorageClass = pvc.Spec.StorageClassName
+	volume.Size = pvc.Status.Capacity["storage"]
+	if volume.Size == "" {
+		volume.Size = pvc.Spec.Resources.Requests["storage"]
+	}
+	if bytes, ok := parseQuantity(volume.Size); ok {
+		volume.Bytes = int64(bytes)
+	}
+	return volume
+}
+
+// selectReclaimVolumes returns which candidates to delete: all of them, or
+// the ones listed in names as name or namespace/name. A name that matches
+// no candidate is an error, it may be in use after all.
+func selectReclaimVolumes(candidates []ReclaimableVolume, names []string) (map[int]bool, error) {
+	selected := map[int]bool{}
+	if len(names) == 0 {
+		for i := range candidates {
+			selected[i] = true
+		}
+		return selected, nil
+	}
+
+	for _, name := range names {
+		found := false
+		for i, volume := range candidates {
+			if name == volume.Name || name == volume.Namespace+"/"+volume.Name {
+				selected[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, &invalidParamsError{err: fmt.Errorf("'%s' is not an unused volume older than min_age", name)}
+		}
+	}
+	return selected, nil
+}
+
+// humanBytes formats a byte count with a binary unit, e.g. 1.5Gi
+func humanBytes(bytes int64) string {
+	if bytes < 1024 {
+		return strconv.FormatInt(bytes, 10)
+	}
+	value := float64(bytes)
+	unit := ""
+	for _, u := range []string{"Ki", "Mi", "Gi", "Ti", "Pi"} {
+		if value < 1024 {
+			break
+		}
+		value /= 1024
+		unit = u
+	}
+	return strings.TrimSuffix(strconv.FormatFloat(value, 'f', 1, 64), ".0") + unit
+}
+
+// tables renders the unused volumes and the capacity per storage class
+func (r *StorageReclaimResult) tables() []table {
+	title := "Unused volumes"
+	if r.Confirmed {
+		title += fmt.Sprintf(" (%s reclaimed)", humanBytes(r.ReclaimedBytes))
+	}
+	volumes := table{title: title, headers: []string{"KIND", "NAMESPACE", "NAME", "STORAGECLASS", "SIZE", "PHASE", "AGE", "DELETED", "ERROR"}}
+	for _, v := range r.Volumes {
+		volumes.rows = append(volumes.rows, []string{v.Kind, v.Namespace, v.Name, v.StorageClass, v.Size, v.Phase, v.Age, strconv.FormatBool(v.Deleted), v.Error})
+	}
+	classes := table{title: fmt.Sprintf("Reclaimable capacity (%s)", r.Reclaimable), headers: []string{"STORAGECLASS", "VOLUMES", "SIZE"}}
+	for _, c := range r.StorageClasses {
+		classes.rows = append(classes.rows, []string{c.StorageClass, strconv.Itoa(c.Volumes), c.Size})
+	}
+	tables := []table{volumes, classes}
+	if len(r.Errors) > 0 {
+		errors := table{title: "Errors", headers: []string{"ERROR"}}
+		for _, e := range r.Errors {
+			errors.rows = append(errors.rows, []string{e})
+		}
+		tables = append(tables, errors)
+	}
+	if r.Note != "" {
+		tables = append(tables, table{title: "Note", headers: []string{"NOTE"}, rows: [][]string{{r.Note}}})
+	}
+	return tables
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawResultsScheme prefixes the URIs of raw results kept as resources
+const rawResultsScheme = "kubevirt-mcp://results/"
+
+// maxRawResults bounds the raw results kept in memory, the oldest go first
+const maxRawResults = 50
+
+// resourcesPageSize is the number of resources per resources/list page
+const resourcesPageSize = 100
+
+// Summarizer condenses the raw result of a tool, e.g. hundreds of entries
+// into counts
+type Summarizer func(result string) (string, error)
+
+// summarizers holds the summarizers by tool name
+var summarizers = map[string]Summarizer{}
+
+// registerSummarizer adds a summarizer for a tool, selected by calling the
+// tool with summarize set. It is meant to be called from init().
+func registerSummarizer(toolName string, summarizer Summarizer) {
+	summarizers[toolName] = summarizer
+}
+
+// summarizeProperty is the input schema of the summarize argument, added to
+// the tools that have a summarizer
+func summarizeProperty() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "boolean",
+		"description": "Return a summary instead of the full result; the full result stays readable as an MCP resource",
+		"default":     false,
+	}
+}
+
+// wantsSummary reports whether tool arguments set summarize
+func wantsSummary(args json.RawMessage) bool {
+	var params struct {
+		Summarize bool `json:"summarize"`
+	}
+	json.Unmarshal(args, &params)
+	return params.Summarize
+}
+
+// rawResult is a full tool result kept as a resource
+type rawResult struct {
+	uri     string
+	tool    string
+	owner   string
+	created time.Time
+	text    string
+}
+
+var rawResults = struct {
+	sync.Mutex
+	items []rawResult
+	next  int
+}{}
+
+// summarizeResult summarizes a tool result and keeps the raw result as a
+// resource, returning the summary with a pointer to it
+func summarizeResult(ctx context.Context, toolName, result string) (string, error) {
+	summarizer, ok := summarizers[toolName]
+	if !ok {
+		return "", &invalidParamsError{err: errors.New(toolName + " does not support summarize")}
+	}
+	summary, err := summarizer(result)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize %s result: %v", toolName, err)
+	}
+
+	rawResults.Lock()
+	rawResults.next++
+	uri := fmt.Sprintf("%s%d", rawResultsScheme, rawResults.next)
+	rawResults.items = append(rawResults.items, rawResult{uri: uri, tool: toolName, owner: identityName(ctx), created: time.Now(), text: result})
+	if len(rawResults.items) > maxRawResults {
+		rawResults.items = rawResults.items[len(rawResults.items)-maxRawResults:]
+	}
+	rawResults.Unlock()
+
+	return fmt.Sprintf("%s\n\nFull result: resources/read %s", summary, uri), nil
+}
+
+// listResources returns the recorded VM histories, the kept raw results and
+// the documents of the docs folders in the shape expected by resources/list,
+// one page of resourcesPageSize entries starting at cursor. The cursor of the
+// next page is empty on the last page.
+func listResources(ctx context.Context, cursor string) ([]map[string]interface{}, string, error) {
+	start := 0
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 {
+			return nil, "", &invalidParamsError{err: fmt.Errorf("invalid cursor %q", cursor)}
+		}
+		start = n
+	}
+
+	resources := []map[string]interface{}{}
+	for _, resource := range historyResources() {
+		if identityResource(ctx, resource["uri"].(string), "") {
+			resources = append(resources, resource)
+		}
+	}
+	rawResults.Lock()
+	for _, raw := range rawResults.items {
+		if !identityResource(ctx, raw.uri, raw.owner) {
+			continue
+		}
+		resources = append(resources, map[string]interface{}{
+			"uri":         raw.uri,
+			"name":        fmt.Sprintf("%s result %s", raw.tool, raw.created.Format(time.RFC3339)),
+			"description": "Full result of a summarized " + raw.tool + " call",
+			"mimeType":    "text/plain",
+		})
+	}
+	rawResults.Unlock()
+	resources = append(resources, docResources()...)
+
+	if start > len(resources) {
+		start = len(resources)
+	}
+	end := min(start+resourcesPageSize, len(resources))
+	next := ""
+	if end < len(resources) {
+		next = strconv.Itoa(end)
+	}
+	return resources[start:end], next, nil
+}
+
+// readResource returns the contents of a VM history, a kept raw result or a
+// document for resources/read
+func readResource(ctx context.Context, uri string) (map[string]interface{}, error) {
+	if strings.HasPrefix(uri, historyScheme) {
+		if !identityResource(ctx, uri, "") {
+			return nil, &accessDeniedError{err: fmt.Errorf("identity %s may not read %s", identityName(ctx), uri)}
+		}
+		return readHistoryResource(uri)
+	}
+	if strings.HasPrefix(uri, docsScheme) {
+		return readDocResource(uri)
+	}
+
+	rawResults.Lock()
+	defer rawResults.Unlock()
+
+	for _, raw := range rawResults.items {
+		if raw.uri == uri && identityResource(ctx, raw.uri, raw.owner) {
+			return map[string]interface{}{
+				"contents": []map[string]interface{}{
+					{"uri": raw.uri, "mimeType": "text/plain", "text": raw.text},
+				},
+			}, nil
+		}
+	}
+	return nil, &invalidParamsError{err: fmt.Errorf("unknown resource %s", uri)}
+}
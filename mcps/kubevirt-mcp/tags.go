@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tagPrefix is the prefix of the annotations holding VM tags. Tags whose
+// value is a valid label value are also set as labels with the same key, so
+// they can be selected with kubectl -l.
+const tagPrefix = "tag.kubevirt-mcp/"
+
+var (
+	// tagKeyRegex matches the name part of a label key
+	tagKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+
+	// labelValueRegex matches the values that can be stored in a label
+	labelValueRegex = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// VMTagParams represents the parameters of vm_tag
+type VMTagParams struct {
+	Namespace string            `json:"namespace,omitempty"`
+	VMName    string            `json:"vm_name"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Remove    []string          `json:"remove,omitempty"`
+}
+
+// VMTagResult is the vm_tag tool result
+type VMTagResult struct {
+	Namespace string            `json:"namespace"`
+	VMName    string            `json:"vmName"`
+	Tags      map[string]string `json:"tags"`
+	Diff      string            `json:"diff,omitempty"`
+}
+
+// VMSearchParams represents the parameters of vm_search
+type VMSearchParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	Query     string `json:"query,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// VMSearchEntry is a VM matching a vm_search query
+type VMSearchEntry struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Status    string            `json:"status,omitempty"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// VMSearchResult is the vm_search tool result
+type VMSearchResult struct {
+	Query string          `json:"query,omitempty"`
+	VMs   []VMSearchEntry `json:"vms"`
+	Total int             `json:"total"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_tag",
+		Description: "Set or remove tags on a VM, free-form key/values kept as " + tagPrefix + "<key> annotations (and labels when the value fits in one). Use vm_search to find VMs by tag",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM to tag",
+				},
+				"tags": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": map[string]interface{}{"type": "string"},
+					"description":          "Tags to set, e.g. {\"owner\": \"team-a\", \"purpose\": \"migration test\"}. Keys are up to 63 letters, digits, '-', '_' and '.'",
+				},
+				"remove": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Tag keys to remove",
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMTag,
+	})
+
+	registerTool(Tool{
+		Name:        "vm_search",
+		Description: "Find VMs by their vm_tag tags with an expression such as 'owner=team-a,purpose' or 'env=prod || env=staging-*', returning each VM with its status and tags",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Only search this namespace (default: all namespaces)",
+				},
+				"query": map[string]interface{}{
+					"type":        "string",
+					"description": "Terms separated by ',' must all match, alternatives are separated by '||'. A term is key (tag set), !key (tag not set), key=value or key!=value; values may use * and ? wildcards. Empty lists every tagged VM",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleVMSearch,
+	})
+}
+
+// handleVMTag is the tools/call handler for vm_tag
+func handleVMTag(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMTagParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if len(params.Tags) == 0 && len(params.Remove) == 0 {
+		return "", missingArgument("tags or remove")
+	}
+	for key := range params.Tags {
+		if !tagKeyRegex.MatchString(key) {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid tag key '%s', use up to 63 letters, digits, '-', '_' and '.'", key)}
+		}
+	}
+	for _, key := range params.Remove {
+		if _, ok := params.Tags[key]; ok {
+			return "", &invalidParamsError{err: fmt.Errorf("tag '%s' is both set and removed", key)}
+		}
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := tagVM(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// tagVM sets and removes the tags of the VM with a single merge patch, so
+// the annotations and labels of a tag are changed together
+func tagVM(ctx context.Context, params VMTagParams) (*VMTagResult, error) {
+	labels := map[string]interface{}{}
+	annotations := map[string]interface{}{}
+	for key, value := range params.Tags {
+		annotations[tagPrefix+key] = value
+		// A tag that no longer fits in a label loses its label
+		labels[tagPrefix+key] = nil
+		if labelValueRegex.MatchString(value) {
+			labels[tagPrefix+key] = value
+		}
+	}
+	for _, key := range params.Remove {
+		annotations[tagPrefix+key] = nil
+		labels[tagPrefix+key] = nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels, "annotations": annotations},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	diff, err := mutationDiff(ctx, "virtualmachine", params.VMName, params.Namespace, func() error {
+		_, err := runKubectl(ctx, "patch", "virtualmachine", params.VMName, "-n", params.Namespace, "--type=merge", "-p", string(patch))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var vm VirtualMachine
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.VMName, "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+	return &VMTagResult{Namespace: params.Namespace, VMName: params.VMName, Tags: vmTags(vm.Metadata), Diff: diff}, nil
+}
+
+// vmTags returns the tags of an object. Annotations hold the exact values,
+// labels set with kubectl under the prefix are included as well.
+func vmTags(meta ObjectMeta) map[string]string {
+	tags := map[string]string{}
+	for key, value := range meta.Labels {
+		if name, ok := strings.CutPrefix(key, tagPrefix); ok {
+			tags[name] = value
+		}
+	}
+	for key, value := range meta.Annotations {
+		if name, ok := strings.CutPrefix(key, tagPrefix); ok {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// handleVMSearch is the tools/call handler for vm_search
+func handleVMSearch(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMSearchParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	query, err := parseTagQuery(params.Query)
+	if err != nil {
+		return "", err
+	}
+
+	var vms VirtualMachineList
+	if err := runKubectlJSON(ctx, &vms, append([]string{"get", "virtualmachines"}, namespaceArgs(params.Namespace, params.Namespace == "")...)...); err != nil {
+		return "", err
+	}
+
+	result := &VMSearchResult{Query: params.Query, VMs: []VMSearchEntry{}}
+	for _, vm := range vms.Items {
+		tags := vmTags(vm.Metadata)
+		if len(tags) == 0 || !query.matches(tags) {
+			continue
+		}
+		result.VMs = append(result.VMs, VMSearchEntry{
+			Namespace: vm.Metadata.Namespace,
+			Name:      vm.Metadata.Name,
+			Status:    vm.Status.PrintableStatus,
+			Tags:      tags,
+		})
+	}
+	sort.Slice(result.VMs, func(i, j int) bool {
+		a, b := result.VMs[i], result.VMs[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	result.Total = len(result.VMs)
+	return formatResult(params.Format, result, result.tables)
+}
+
+// tagTerm is a single condition of a tag query
+type tagTerm struct {
+	key    string
+	negate bool
+	// value matches the tag value, nil when the term only checks whether
+	// the tag is set
+	value *regexp.Regexp
+}
+
+// tagQuery holds alternatives of terms that must all match
+type tagQuery [][]tagTerm
+
+// parseTagQuery parses a query such as "owner=team-a,!temporary || env=prod*"
+func parseTagQuery(query string) (tagQuery, error) {
+	var parsed tagQuery
+	if strings.TrimSpace(query) == "" {
+		return parsed, nil
+	}
+	for _, alternative := range strings.Split(query, "||") {
+		var terms []tagTerm
+		for _, term := range strings.Split(alternative, ",") {
+			term = strings.TrimSpace(term)
+			if term == "" {
+				return nil, &invalidParamsError{err: fmt.Errorf("empty term in query '%s'", query)}
+			}
+			var t tagTerm
+			key, value, hasValue := strings.Cut(term, "=")
+			switch {
+			case hasValue && strings.HasSuffix(key, "!"):
+				key, t.negate = strings.TrimSuffix(key, "!"), true
+			case !hasValue && strings.HasPrefix(key, "!"):
+				key, t.negate = key[1:], true
+			}
+			t.key = strings.TrimSpace(key)
+			if !tagKeyRegex.MatchString(t.key) {
+				return nil, &invalidParamsError{err: fmt.Errorf("invalid tag key '%s' in query '%s'", t.key, query)}
+			}
+			if hasValue {
+				t.value = globRegex(strings.TrimSpace(value))
+			}
+			terms = append(terms, t)
+		}
+		parsed = append(parsed, terms)
+	}
+	return parsed, nil
+}
+
+// matches reports whether the tags match any alternative of the query, an
+// empty query matches every tagged VM
+func (q tagQuery) matches(tags map[string]string) bool {
+	if len(q) == 0 {
+		return true
+	}
+	for _, terms := range q {
+		all := true
+		for _, t := range terms {
+			if !t.matches(tags) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the tags satisfy the term
+func (t tagTerm) matches(tags map[string]string) bool {
+	value, ok := tags[t.key]
+	if t.value != nil {
+		ok = ok && t.value.MatchString(value)
+	}
+	return ok != t.negate
+}
+
+// globRegex compiles a value pattern where * matches any characters and ?
+// a single one
+func globRegex(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+// tables renders the matching VMs with their tags
+func (r *VMSearchResult) tables() []table {
+	vms := table{title: "VMs", headers: []string{"NAMESPACE", "NAME", "STATUS", "TAGS"}}
+	for _, vm := range r.VMs {
+		keys := make([]string, 0, len(vm.Tags))
+		for key := range vm.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var tags []string
+		for _, key := range keys {
+			tags = append(tags, key+"="+vm.Tags[key])
+		}
+		vms.rows = append(vms.rows, []string{vm.Namespace, vm.Name, vm.Status, strings.Join(tags, ",")})
+	}
+	return []table{vms}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTagQueryMatches(t *testing.T) {
+	web := map[string]string{"owner": "team-a", "env": "prod-eu", "tier": "web"}
+	scratch := map[string]string{"owner": "team-b", "env": "dev", "temporary": ""}
+	tests := []struct {
+		query              string
+		matchWeb, matchTmp bool
+	}{
+		{"", true, true},
+		{"   ", true, true},
+		{"owner", true, true},
+		{"owner=team-a", true, false},
+		{"owner=team-*", true, true},
+		{"owner=team-?", true, true},
+		{"owner=team", false, false},
+		{"env=prod*", true, false},
+		{"temporary", false, true},
+		{"temporary=", false, true},
+		{"!temporary", true, false},
+		{"owner!=team-a", false, true},
+		{"missing!=x", true, true},
+		{"owner=team-a,tier=web", true, false},
+		{"owner=team-a,tier=db", false, false},
+		{"owner=team-a,!temporary || env=dev", true, true},
+		{"tier=db || env=staging", false, false},
+		{" owner = team-b , temporary ", false, true},
+		{"owner=*", true, true},
+		{"owner=team.a", false, false},
+	}
+	for _, tt := range tests {
+		query, err := parseTagQuery(tt.query)
+		if err != nil {
+			t.Fatalf("parseTagQuery(%q): %v", tt.query, err)
+		}
+		if got := query.matches(web); got != tt.matchWeb {
+			t.Errorf("%q matches %v = %v, want %v", tt.query, web, got, tt.matchWeb)
+		}
+		if got := query.matches(scratch); got != tt.matchTmp {
+			t.Errorf("%q matches %v = %v, want %v", tt.query, scratch, got, tt.matchTmp)
+		}
+	}
+}
+
+func TestParseTagQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{",", "empty term"},
+		{"owner=team-a,", "empty term"},
+		{"owner=team-a || ", "empty term"},
+		{"|| env=prod", "empty term"},
+		{"owner=a,,env=b", "empty term"},
+		{"!", "invalid tag key ''"},
+		{"=value", "invalid tag key ''"},
+		{"!=value", "invalid tag key ''"},
+		{"-owner", "invalid tag key '-owner'"},
+		{"owner name=x", "invalid tag key 'owner name'"},
+		{"!!owner", "invalid tag key '!owner'"},
+		{strings.Repeat("k", 64), "invalid tag key"},
+	}
+	for _, tt := range tests {
+		_, err := parseTagQuery(tt.query)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTagQuery(%q) error = %v, want %q", tt.query, err, tt.want)
+		}
+		if _, ok := err.(*invalidParamsError); err != nil && !ok {
+			t.Errorf("parseTagQuery(%q) error is %T, want invalid params", tt.query, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// timeoutsEnv overrides the built-in timeouts, e.g. "detection=10s,kubectl=1m",
+// like the timeouts of the configuration file and the --timeouts flag
+const timeoutsEnv = "KUBEVIRT_MCP_TIMEOUTS"
+
+// Names of the configurable timeouts
+const (
+	timeoutDetection      = "detection"
+	timeoutKubectl        = "kubectl"
+	timeoutLogin          = "login"
+	timeoutConsoleConnect = "console-connect"
+	timeoutConsoleLogin   = "console-login"
+	timeoutConsolePrompt  = "console-prompt"
+	timeoutShutdown       = "shutdown"
+	timeoutPolicy         = "policy"
+)
+
+// defaultTimeouts are used unless overridden in KUBEVIRT_MCP_TIMEOUTS. The
+// console timeouts are the defaults of vm-exec.
+var defaultTimeouts = map[string]time.Duration{
+	timeoutDetection:      5 * time.Second,
+	timeoutKubectl:        30 * time.Second,
+	timeoutLogin:          30 * time.Second,
+	timeoutConsoleConnect: 10 * time.Second,
+	timeoutConsoleLogin:   60 * time.Second,
+	timeoutConsolePrompt:  5 * time.Second,
+	timeoutShutdown:       10 * time.Second,
+	timeoutPolicy:         5 * time.Second,
+}
+
+// timeoutFor returns the configured timeout with the given name
+func timeoutFor(name string) time.Duration {
+	if d, ok := serverConfig.Timeouts[name]; ok {
+		return d
+	}
+	return defaultTimeouts[name]
+}
+
+// vm-exec run deadlines, see vmExecDeadline
+const (
+	// vmExecCommandTimeout is the default --timeout of vm-exec
+	vmExecCommandTimeout = 30 * time.Second
+
+	// vmExecDeadlineSlack covers the API calls around the console, like the
+	// slack vm-exec adds to its default deadline
+	vmExecDeadlineSlack = 15 * time.Second
+
+	// vmExecKillGrace is how long after its deadline vm-exec is killed,
+	// longer than the grace of its own watchdog so it can report the
+	// timeout itself
+	vmExecKillGrace = 10 * time.Second
+)
+
+// vmExecDeadline returns the overall deadline of a vm-exec run of steps
+// commands with the given timeout in seconds: connecting to the console,
+// logging in and every command
+func vmExecDeadline(timeout, steps int) time.Duration {
+	commandTimeout := vmExecCommandTimeout
+	if timeout > 0 {
+		commandTimeout = time.Duration(timeout) * time.Second
+	}
+	return timeoutFor(timeoutConsoleConnect) + timeoutFor(timeoutConsoleLogin) + time.Duration(steps)*commandTimeout + vmExecDeadlineSlack
+}
+
+// timeoutNames returns the names of the configurable timeouts, sorted
+func timeoutNames() []string {
+	names := make([]string, 0, len(defaultTimeouts))
+	for name := range defaultTimeouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Clock is the time source of timeouts and polling loops. Tests replace it
+// with a fake clock to run timeout branches without waiting for them.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc)
+}
+
+// realClock is the Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, d)
+}
+
+// clock is the Clock used by the server
+var clock Clock = realClock{}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced, so timeouts expire
+// deterministically and without waiting
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+
+	// scheduled receives a value for every timer started on the clock
+	scheduled chan struct{}
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	fire     func(now time.Time)
+}
+
+// useFakeClock replaces the server clock with a fake one for the test
+func useFakeClock(t *testing.T) *fakeClock {
+	c := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), scheduled: make(chan struct{}, 100)}
+	previous := clock
+	clock = c
+	t.Cleanup(func() { clock = previous })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.schedule(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+func (c *fakeClock) WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx := &fakeTimeoutContext{Context: parent, done: make(chan struct{})}
+	timer := c.schedule(d, func(time.Time) { ctx.stop(context.DeadlineExceeded) })
+	go func() {
+		select {
+		case <-parent.Done():
+			ctx.stop(parent.Err())
+		case <-ctx.done:
+		}
+	}()
+	return ctx, func() {
+		c.unschedule(timer)
+		ctx.stop(context.Canceled)
+	}
+}
+
+// Advance moves the clock forward and fires the timers that became due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due, pending []*fakeTimer
+	for _, timer := range c.timers {
+		if timer.deadline.After(now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	for _, timer := range due {
+		timer.fire(now)
+	}
+}
+
+func (c *fakeClock) schedule(d time.Duration, fire func(now time.Time)) *fakeTimer {
+	c.mu.Lock()
+	timer := &fakeTimer{deadline: c.now.Add(d), fire: fire}
+	c.timers = append(c.timers, timer)
+	c.mu.Unlock()
+	c.scheduled <- struct{}{}
+	return timer
+}
+
+func (c *fakeClock) unschedule(timer *fakeTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+// fakeTimeoutContext is the context returned by fakeClock.WithTimeout, done
+// when the fake clock reaches its deadline
+type fakeTimeoutContext struct {
+	context.Context
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (ctx *fakeTimeoutContext) Done() <-chan struct{} { return ctx.done }
+
+func (ctx *fakeTimeoutContext) Err() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.err
+}
+
+func (ctx *fakeTimeoutContext) stop(err error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.err == nil {
+		ctx.err = err
+		close(ctx.done)
+	}
+}
+
+// fakeKubectl puts a kubectl shell script first in PATH for the test
+func fakeKubectl(t *testing.T, script string) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "kubectl"), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestTimeoutOverrides(t *testing.T) {
+	var overrides timeoutOverrides
+	if err := overrides.Set("detection=10s, kubectl=2m"); err != nil {
+		t.Fatal(err)
+	}
+	want := timeoutOverrides{timeoutDetection: 10 * time.Second, timeoutKubectl: 2 * time.Minute}
+	if overrides.String() != want.String() {
+		t.Fatalf("overrides = %v, want %v", overrides.String(), want.String())
+	}
+
+	for _, value := range []string{"login=oops", "console-prompt=-1s", "unknown=1s"} {
+		if err := overrides.Set(value); err == nil {
+			t.Errorf("Set(%q) accepted an invalid timeout", value)
+		}
+	}
+}
+
+func TestVMExecArgsConsoleTimeouts(t *testing.T) {
+	params := VMExecParams{Namespace: "default", VMName: "fedora"}
+	args, _, _ := vmExecArgs(params)
+	if strings.Contains(strings.Join(args, " "), "timeout") {
+		t.Fatalf("default console timeouts passed to vm-exec: %v", args)
+	}
+
+	previous := serverConfig
+	serverConfig = defaultServerConfig()
+	serverConfig.Timeouts = timeoutOverrides{timeoutConsoleLogin: 2 * time.Minute}
+	t.Cleanup(func() { serverConfig = previous })
+	args, _, _ = vmExecArgs(params)
+	if got := strings.Join(args, " "); !strings.HasSuffix(got, "--login-timeout 2m0s") {
+		t.Fatalf("vmExecArgs() = %q, want the login timeout override", got)
+	}
+}
+
+func TestVMExecArgsConsoleRetries(t *testing.T) {
+	params := VMExecParams{Namespace: "default", VMName: "fedora"}
+	args, _, _ := vmExecArgs(params)
+	if strings.Contains(strings.Join(args, " "), "retr") {
+		t.Fatalf("default console retries passed to vm-exec: %v", args)
+	}
+
+	previous := serverConfig
+	serverConfig = defaultServerConfig()
+	serverConfig.Console = ConsoleConfig{Retries: 0, RetryBackoff: 5 * time.Second}
+	t.Cleanup(func() { serverConfig = previous })
+	args, _, _ = vmExecArgs(params)
+	if got := strings.Join(args, " "); !strings.HasSuffix(got, "--console-retries 0 --retry-backoff 5s") {
+		t.Fatalf("vmExecArgs() = %q, want the console retry overrides", got)
+	}
+}
+
+func TestClusterConnectivityTimeout(t *testing.T) {
+	fake := useFakeClock(t)
+	fakeKubectl(t, "exec sleep 60")
+
+	result := make(chan ClusterInfo)
+	go func() { result <- testClusterConnectivity("/nonexistent/kubeconfig") }()
+
+	<-fake.scheduled
+	fake.Advance(timeoutFor(timeoutDetection))
+
+	info := <-result
+	if info.Found {
+		t.Fatal("cluster found although kubectl timed out")
+	}
+	if want := "timed out after " + timeoutFor(timeoutDetection).String(); !strings.Contains(info.Message, want) {
+		t.Fatalf("message %q does not contain %q", info.Message, want)
+	}
+}
+
+func TestWaitForMigrationTimeout(t *testing.T) {
+	fake := useFakeClock(t)
+	fakeKubectl(t, `echo '{"status":{"phase":"Running"}}'`)
+
+	done := make(chan error)
+	go func() { done <- waitForMigration(context.Background(), "default", "migration", 5*time.Second) }()
+
+	// Every poll starts a kubectl timeout and then waits for the poll
+	// interval, which is skipped by advancing the clock
+	for {
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), `did not finish within 5s (phase "Running")`) {
+				t.Fatalf("waitForMigration() = %v, want a timeout in phase Running", err)
+			}
+			return
+		case <-fake.scheduled:
+			fake.Advance(2 * time.Second)
+		}
+	}
+}
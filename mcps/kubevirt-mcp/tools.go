@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Tool describes an MCP tool exposed via tools/list and dispatched via tools/call
+type Tool struct {
+	Name        string
+	Description string
+	InputSchema map[string]interface{}
+	// OutputSchema describes the structured content the handler returns
+	// alongside its text result with setStructuredContent, if any
+	OutputSchema map[string]interface{}
+	Handler      func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// disabledToolsEnv lists tools hidden from clients, like tools.disabled in
+// the configuration file and the --disable-tools flag
+const disabledToolsEnv = "KUBEVIRT_MCP_DISABLED_TOOLS"
+
+// registeredTools holds the tools in registration order, which is also the
+// order they are advertised to clients
+var registeredTools []Tool
+
+// registerTool adds a tool to the registry. It is meant to be called from init().
+func registerTool(tool Tool) {
+	registeredTools = append(registeredTools, tool)
+}
+
+// lookupTool returns the registered tool with the given name, unless the
+// tool policy disables it
+func lookupTool(name string) (Tool, bool) {
+	if containsString(serverConfig.Tools.Disabled, name) {
+		return Tool{}, false
+	}
+	for _, tool := range registeredTools {
+		if tool.Name == name {
+			return tool, true
+		}
+	}
+	return Tool{}, false
+}
+
+// toolRegistered reports whether a tool with the given name is registered
+func toolRegistered(name string) bool {
+	for _, tool := range registeredTools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listTools returns the tool definitions in the shape expected by tools/list
+func listTools() []map[string]interface{} {
+	definitions := make([]map[string]interface{}, 0, len(registeredTools))
+	for _, tool := range registeredTools {
+		if containsString(serverConfig.Tools.Disabled, tool.Name) {
+			continue
+		}
+		definition := map[string]interface{}{
+			"name":        tool.Name,
+			"description": tool.Description,
+			"inputSchema": inputSchema(tool),
+		}
+		if tool.OutputSchema != nil {
+			definition["outputSchema"] = tool.OutputSchema
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions
+}
+
+type structuredKey struct{}
+
+// structuredContent holds the structured content of a tool call
+type structuredContent struct {
+	value interface{}
+}
+
+// withStructuredContent returns a context collecting the structured content
+// set by the tool handler
+func withStructuredContent(ctx context.Context) (context.Context, *structuredContent) {
+	content := &structuredContent{}
+	return context.WithValue(ctx, structuredKey{}, content), content
+}
+
+// setStructuredContent sets the MCP structured content of the tool result,
+// a JSON object matching the tool's OutputSchema
+func setStructuredContent(ctx context.Context, v interface{}) {
+	if content, ok := ctx.Value(structuredKey{}).(*structuredContent); ok {
+		content.value = v
+	}
+}
+
+// inputSchema returns the input schema of a tool, with the cluster and
+// context arguments, the summarize argument when a summarizer is registered for it, the
+// policy_confirm argument of the policy hook and the confirm argument of the
+// exec policy added.
+// The default of the namespace argument follows the configured default namespace.
+func inputSchema(tool Tool) map[string]interface{} {
+	properties := map[string]interface{}{"cluster": clusterProperty(), "context": contextProperty()}
+	if _, ok := summarizers[tool.Name]; ok {
+		properties["summarize"] = summarizeProperty()
+	}
+	if serverConfig.Policy.File != "" {
+		properties[policyConfirmArgument] = policyConfirmProperty()
+	}
+	if execCommandTools[tool.Name] && len(serverConfig.Exec.Confirm) > 0 {
+		properties["confirm"] = confirmProperty()
+	}
+	if pinnable(tool) {
+		properties["target"] = targetProperty()
+	}
+	if existing, ok := tool.InputSchema["properties"].(map[string]interface{}); ok {
+		for name, property := range existing {
+			properties[name] = property
+		}
+	}
+	if namespace, ok := properties["namespace"].(map[string]interface{}); ok && namespace["default"] == "default" && serverConfig.DefaultNamespace != "" {
+		property := make(map[string]interface{}, len(namespace))
+		for key, value := range namespace {
+			property[key] = value
+		}
+		property["default"] = serverConfig.DefaultNamespace
+		properties["namespace"] = property
+	}
+	schema := make(map[string]interface{}, len(tool.InputSchema))
+	for key, value := range tool.InputSchema {
+		schema[key] = value
+	}
+	schema["properties"] = properties
+	return schema
+}
+
+// invalidParamsError marks errors caused by bad tool arguments so they are
+// reported with the JSON-RPC "invalid params" code
+type invalidParamsError struct {
+	err error
+}
+
+func (e *invalidParamsError) Error() string {
+	return "Invalid parameters: " + e.err.Error()
+}
+
+func (e *invalidParamsError) Unwrap() error {
+	return e.err
+}
+
+// decodeArguments unmarshals tool arguments, tolerating an empty payload
+func decodeArguments(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return &invalidParamsError{err: err}
+	}
+	return nil
+}
+
+// missingArgument returns an invalid params error for a required argument
+func missingArgument(name string) error {
+	return &invalidParamsError{err: errors.New(name + " is required")}
+}
+
+// toolError converts a tool handler error into a JSON-RPC error
+func toolError(err error) *RPCError {
+	var paramsErr *invalidParamsError
+	if errors.As(err, &paramsErr) {
+		return &RPCError{Code: -32602, Message: err.Error()}
+	}
+	var deniedErr *accessDeniedError
+	if errors.As(err, &deniedErr) {
+		return &RPCError{Code: accessDeniedCode, Message: err.Error()}
+	}
+	return &RPCError{Code: -32603, Message: err.Error()}
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "detect_kubevirtci_cluster",
+		Description: "Detect kubevirtci cluster and set KUBECONFIG. The kubeconfig, auth mode, cluster type, KubeVirt version and setup commands are also returned as structured content",
+		InputSchema: map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		},
+		OutputSchema: clusterDetectionSchema(),
+		Handler: func(ctx context.Context, args json.RawMessage) (string, error) {
+			detection, err := detectKubevirtciCluster(ctx)
+			observeClusterDetection(detection, err)
+			if err != nil {
+				return "", err
+			}
+			setStructuredContent(ctx, detection)
+			return detection.text(), nil
+		},
+	})
+
+	registerTool(Tool{
+		Name:        "vm_exec",
+		Description: "Execute a command on a KubeVirt VM via the guest agent or console connection, returning its stdout, exit code, duration and the VM type as JSON. With separate_stderr its stderr is returned apart from stdout, Windows VMs run the command through the guest agent in PowerShell or cmd and always return it apart. Long output is paged with continue tokens",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI to execute command on",
+				},
+				"command": map[string]interface{}{
+					"type":        "string",
+					"description": "Command to execute inside the VM",
+				},
+				"commands": map[string]interface{}{
+					"type":        "array",
+					"items":       map[string]interface{}{"type": "string"},
+					"description": "Several commands to run in one session, returning a JSON array of per-command output and exit codes",
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds (default: 30)",
+					"default":     30,
+				},
+				"verbose": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Enable verbose console logging",
+					"default":     false,
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "Execution method: auto uses the guest agent when connected and falls back when guest-exec fails, then SSH when the guest accepts it and the console otherwise. SSH logs in with the vm_ssh_bootstrap key or the console credentials",
+					"enum":        []string{"auto", "agent", "ssh", "console"},
+					"default":     "auto",
+				},
+				"shell": map[string]interface{}{
+					"type":        "string",
+					"description": "Shell running the command on Windows VMs, ignored on Linux",
+					"enum":        []string{"powershell", "cmd"},
+					"default":     "powershell",
+				},
+				"separate_stderr": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Return the stderr of the command in its own stderr field instead of combined with stdout; on the console it is redirected to a file in the guest and read back",
+					"default":     false,
+				},
+				"env": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": map[string]interface{}{"type": "string"},
+					"description":          "Environment variables of the command, passed to guest-exec by the guest agent and exported in a subshell on the console and SSH",
+				},
+				"cwd": map[string]interface{}{
+					"type":        "string",
+					"description": "Working directory of the command in the guest, the exec policy patterns see the command with its cd",
+				},
+				"run_as": map[string]interface{}{
+					"type":        "string",
+					"description": "Guest user running the command through sudo -n, so the login user needs passwordless sudo; Linux guests only. The exec policy patterns see the command with its sudo",
+				},
+				"max_output": map[string]interface{}{
+					"type":        "integer",
+					"description": "Bytes of stdout and stderr returned at once (default: the server output.maxSize, 64 KiB); longer output ends with a truncation marker and a continue token for the next page",
+				},
+				"output_file": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Also write the whole stdout and stderr to files on the server and return their paths",
+					"default":     false,
+				},
+				"continue": map[string]interface{}{
+					"type":        "string",
+					"description": "Token of a previous truncated result returning the next page of its output instead of running a command",
+				},
+				"normalize_locale": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Run with LANG=C, LC_ALL=C and TZ=UTC so output such as dates, numbers, journalctl or cloud-init status is parsable on localized guests",
+					"default":     false,
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"credentials_file": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+				},
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMExec,
+	})
+}
+
+// handleVMExec is the tools/call handler for vm_exec
+func handleVMExec(ctx context.Context, args json.RawMessage) (string, error) {
+	var vmParams VMExecParams
+	if err := json.Unmarshal(args, &vmParams); err != nil {
+		return "", &invalidParamsError{err: err}
+	}
+	if vmParams.Continue != "" {
+		return continueVMExecOutput(vmParams)
+	}
+	if vmParams.Command == "" && len(vmParams.Commands) == 0 {
+		return "", missingArgument("command or commands")
+	}
+	for name := range vmParams.Env {
+		if !envNameRegex.MatchString(name) {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid environment variable name '%s'", name)}
+		}
+	}
+	if vmParams.RunAs != "" && !guestUserRegex.MatchString(vmParams.RunAs) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid run_as user '%s'", vmParams.RunAs)}
+	}
+
+	// Set defaults if not provided
+	if vmParams.Namespace == "" {
+		vmParams.Namespace = "default"
+	}
+	if vmParams.Timeout == 0 {
+		vmParams.Timeout = 30
+	}
+
+	output, err := executeVMCommand(ctx, vmParams)
+	if err != nil {
+		return "", err
+	}
+	return limitVMExecOutput(vmParams, output)
+}
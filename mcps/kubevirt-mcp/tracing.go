@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the tracing, see TracingConfig. Spans
+// are exported when an OTLP endpoint is set.
+const (
+	otlpEndpointEnv    = "KUBEVIRT_MCP_OTLP_ENDPOINT"
+	otlpServiceNameEnv = "KUBEVIRT_MCP_OTLP_SERVICE_NAME"
+
+	defaultOTLPServiceName = "kubevirt-mcp"
+
+	// tracingFlushInterval is how often the ended spans are exported
+	tracingFlushInterval = 5 * time.Second
+	// tracingBatchSize exports the spans early when that many are waiting
+	tracingBatchSize = 512
+	// maxPendingSpans bounds the spans kept while the collector is down,
+	// the oldest are dropped
+	maxPendingSpans = 4096
+)
+
+// Span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// traceSpan is an OpenTelemetry span. A nil span is tracing turned off, its
+// methods do nothing.
+type traceSpan struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	// remote spans are the parents passed by clients, they are not exported
+	remote bool
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	ended      bool
+}
+
+type spanKey struct{}
+
+// tracer exports the ended spans in batches to the OTLP/HTTP endpoint
+var tracer struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+
+	mu      sync.Mutex
+	pending []map[string]interface{}
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startTracing starts the span exporter when an OTLP endpoint is set, from
+// the configuration or else the standard OTEL_EXPORTER_OTLP_* variables
+func startTracing() error {
+	endpoint := serverConfig.Tracing.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	}
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return nil
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return fmt.Errorf("invalid OTLP endpoint %q, use an http:// or https:// URL", endpoint)
+	}
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	tracer.endpoint = endpoint
+	tracer.serviceName = serverConfig.Tracing.ServiceName
+	tracer.client = &http.Client{Timeout: 10 * time.Second}
+	tracer.wake = make(chan struct{}, 1)
+	tracer.done = make(chan struct{})
+	tracer.stopped = make(chan struct{})
+	go exportSpans()
+	logMessage(LogInfo, "tracing", "Exporting spans to %s", endpoint)
+	return nil
+}
+
+// closeTracing exports the spans still waiting, before the server exits
+func closeTracing() {
+	if tracer.endpoint == "" {
+		return
+	}
+	close(tracer.done)
+	<-tracer.stopped
+}
+
+// exportSpans sends the ended spans every flush interval or once a batch is
+// full, until closeTracing
+func exportSpans() {
+	defer close(tracer.stopped)
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tracer.wake:
+		case <-tracer.done:
+			flushSpans()
+			return
+		}
+		flushSpans()
+	}
+}
+
+// flushSpans posts the pending spans to the collector. Spans that cannot be
+// sent are dropped, tracing never holds up the tool calls.
+func flushSpans() {
+	tracer.mu.Lock()
+	spans := tracer.pending
+	tracer.pending = nil
+	tracer.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": tracer.serviceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "kubevirt-mcp"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logMessage(LogWarning, "tracing", "Failed to encode %d spans: %v", len(spans), err)
+		return
+	}
+	resp, err := tracer.client.Post(tracer.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logMessage(LogWarning, "tracing", "Failed to export %d spans: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logMessage(LogWarning, "tracing", "Failed to export %d spans: %s", len(spans), resp.Status)
+	}
+}
+
+// startSpan starts a span, the child of the span of ctx when there is one,
+// and returns the context carrying it
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	if tracer.endpoint == "" {
+		return ctx, nil
+	}
+	span := spanFromContext(ctx).newChild(name, kind)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// spanFromContext returns the span of ctx, nil when there is none
+func spanFromContext(ctx context.Context) *traceSpan {
+	span, _ := ctx.Value(spanKey{}).(*traceSpan)
+	return span
+}
+
+// child starts a span under s, for the work that has no context of its own
+// such as the phases of vm-exec
+func (s *traceSpan) child(name string) *traceSpan {
+	if s == nil {
+		return nil
+	}
+	return s.newChild(name, spanKindInternal)
+}
+
+// newChild starts a span under s, a root span when s is nil
+func (s *traceSpan) newChild(name string, kind int) *traceSpan {
+	span := &traceSpan{name: name, kind: kind, start: clock.Now(), attributes: map[string]interface{}{}}
+	rand.Read(span.spanID[:])
+	if s != nil {
+		span.traceID, span.parentID = s.traceID, s.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	return span
+}
+
+// setAttribute sets an attribute of the span
+func (s *traceSpan) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// end ends the span, with an error status when err is set, and queues it for
+// export. Ending a span again does nothing.
+func (s *traceSpan) end(err error) {
+	if s == nil || s.remote {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	encoded := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(clock.Now().UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	s.mu.Unlock()
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		encoded["status"] = map[string]interface{}{"code": 2, "message": err.Error()}
+	}
+
+	tracer.mu.Lock()
+	if len(tracer.pending) >= maxPendingSpans {
+		tracer.pending = tracer.pending[1:]
+	}
+	tracer.pending = append(tracer.pending, encoded)
+	full := len(tracer.pending) >= tracingBatchSize
+	tracer.mu.Unlock()
+	if full {
+		select {
+		case tracer.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// otlpAttributes encodes attributes as OTLP key values
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	encoded := make([]interface{}, 0, len(attributes))
+	for _, key := range sortedKeys(attributes) {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": value})
+	}
+	return encoded
+}
+
+// remoteParent returns the span context a client passed in the _meta of a
+// request, as a W3C traceparent or a bare 32 hex digit traceId
+func remoteParent(params json.RawMessage) *traceSpan {
+	var request struct {
+		Meta struct {
+			Traceparent string `json:"traceparent"`
+			TraceID     string `json:"traceId"`
+		} `json:"_meta"`
+	}
+	if len(params) == 0 || json.Unmarshal(params, &request) != nil {
+		return nil
+	}
+	parent := &traceSpan{remote: true}
+	if parts := strings.Split(request.Meta.Traceparent, "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		traceID, err1 := hex.DecodeString(parts[1])
+		spanID, err2 := hex.DecodeString(parts[2])
+		if err1 == nil && err2 == nil {
+			copy(parent.traceID[:], traceID)
+			copy(parent.spanID[:], spanID)
+			return validParent(parent)
+		}
+	}
+	if traceID, err := hex.DecodeString(request.Meta.TraceID); err == nil && len(traceID) == 16 {
+		copy(parent.traceID[:], traceID)
+		// Without a parent span the request span is the root of the trace
+		return validParent(parent)
+	}
+	return nil
+}
+
+// validParent drops the all zero trace IDs W3C Trace Context forbids
+func validParent(parent *traceSpan) *traceSpan {
+	if parent.traceID == [16]byte{} {
+		return nil
+	}
+	return parent
+}
+
+// startRequestSpan starts the span of a JSON-RPC request, in the trace the
+// client passed in _meta when it did. tools/call spans are named after the
+// tool.
+func startRequestSpan(ctx context.Context, req JSONRPCRequest) (context.Context, *traceSpan) {
+	if tracer.endpoint == "" {
+		return ctx, nil
+	}
+	if parent := remoteParent(req.Params); parent != nil {
+		ctx = context.WithValue(ctx, spanKey{}, parent)
+	}
+	name := req.Method
+	var params struct {
+		Name string `json:"name"`
+	}
+	if req.Method == "tools/call" && json.Unmarshal(req.Params, &params) == nil && toolRegistered(params.Name) {
+		name += " " + params.Name
+	}
+	ctx, span := startSpan(ctx, name, spanKindServer)
+	span.setAttribute("rpc.system", "jsonrpc")
+	span.setAttribute("rpc.method", req.Method)
+	if params.Name != "" {
+		span.setAttribute("mcp.tool.name", params.Name)
+	}
+	if identity := identityName(ctx); identity != "" {
+		span.setAttribute("enduser.id", identity)
+	}
+	if session := requestSession(ctx); session != "" {
+		span.setAttribute("mcp.session.id", session)
+	}
+	return ctx, span
+}
+
+// vmExecStep names the span of a vm-exec progress phase after its step, so
+// the phases of many calls compare in a trace viewer: connect, login, run...
+func vmExecStep(phase string) string {
+	for _, step := range []struct{ prefix, name string }{
+		{"looking up", "lookup"},
+		{"connecting to", "connect"},
+		{"logging in", "login"},
+		{"attached", "attached"},
+		{"running command", "run"},
+		{"serving commands", "run"},
+		{"writing", "transfer"},
+		{"reading", "transfer"},
+		{"console attempt", "retry"},
+	} {
+		if strings.HasPrefix(phase, step.prefix) {
+			return step.name
+		}
+	}
+	return "phase"
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVMCreateOS      = "cirros"
+	defaultVMCreateTimeout = 300
+)
+
+// vmNameRegex matches valid VM names (DNS-1123 labels, since the name is
+// also used for the VMI and its virt-launcher pod)
+var vmNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// vmTemplate is a built-in VM flavor. The default user data sets the
+// password vm-exec uses for the OS, so created VMs work with vm_exec as is.
+type vmTemplate struct {
+	image    string
+	memory   string
+	userData string
+}
+
+// vmTemplates are the OS flavors vm_create can provision
+var vmTemplates = map[string]vmTemplate{
+	"cirros": {
+		image:  "quay.io/kubevirt/cirros-container-disk-demo",
+		memory: "128Mi",
+	},
+	"alpine": {
+		image:  "quay.io/kubevirt/alpine-container-disk-demo",
+		memory: "256Mi",
+	},
+	"fedora": {
+		image:    "quay.io/containerdisks/fedora:latest",
+		memory:   "2Gi",
+		userData: "#cloud-config\npassword: fedora\nchpasswd: { expire: False }\n",
+	},
+	"ubuntu": {
+		image:    "quay.io/containerdisks/ubuntu:22.04",
+		memory:   "2Gi",
+		userData: "#cloud-config\npassword: ubuntu\nchpasswd: { expire: False }\n",
+	},
+	"centos-stream": {
+		image:    "quay.io/containerdisks/centos-stream:9",
+		memory:   "2Gi",
+		userData: "#cloud-config\npassword: cloud-user\nchpasswd: { expire: False }\n",
+	},
+}
+
+// VMCreateParams represents the parameters for creating a VM
+type VMCreateParams struct {
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+	OS         string `json:"os,omitempty"`
+	Image      string `json:"image,omitempty"`
+	DataVolume string `json:"data_volume,omitempty"`
+	CPU        int    `json:"cpu,omitempty"`
+	Memory     string `json:"memory,omitempty"`
+	CloudInit  string `json:"cloud_init,omitempty"`
+	Wait       bool   `json:"wait,omitempty"`
+	Timeout    int    `json:"timeout,omitempty"`
+}
+
+// VMCreateResult is the vm_create tool result
+type VMCreateResult struct {
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace"`
+	OS        string                 `json:"os"`
+	Status    string                 `json:"status,omitempty"`
+	Manifest  map[string]interface{} `json:"manifest"`
+	Diff      string                 `json:"diff,omitempty"`
+}
+
+func init() {
+	flavors := make([]string, 0, len(vmTemplates))
+	for flavor := range vmTemplates {
+		flavors = append(flavors, flavor)
+	}
+	sort.Strings(flavors)
+
+	registerTool(Tool{
+		Name:        "vm_create",
+		Description: "Create a VirtualMachine from a built-in OS template (" + strings.Join(flavors, ", ") + ") with optional CPU, memory, containerdisk image or DataVolume disk and cloud-init user data, optionally wait for it to be ready, and return the applied manifest",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM",
+				},
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace to create the VM in",
+					"default":     "default",
+				},
+				"os": map[string]interface{}{
+					"type":        "string",
+					"description": "OS flavor of the built-in template",
+					"enum":        flavors,
+					"default":     defaultVMCreateOS,
+				},
+				"image": map[string]interface{}{
+					"type":        "string",
+					"description": "containerdisk image, overrides the template image",
+				},
+				"data_volume": map[string]interface{}{
+					"type":        "string",
+					"description": "Existing DataVolume booted instead of the containerdisk, e.g. created by dv_create; os still picks the memory and the console login",
+				},
+				"cpu": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of CPU cores (default: 1)",
+					"default":     1,
+				},
+				"memory": map[string]interface{}{
+					"type":        "string",
+					"description": "Guest memory, e.g. 1Gi (default: the template memory)",
+				},
+				"cloud_init": map[string]interface{}{
+					"type":        "string",
+					"description": "cloud-init user data, replaces the template user data that sets the console password",
+				},
+				"wait": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Wait for the VM to be ready",
+					"default":     false,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds when waiting (default: 300)",
+					"default":     defaultVMCreateTimeout,
+				},
+			},
+			"required": []string{"name"},
+		},
+		Handler: handleVMCreate,
+	})
+}
+
+// handleVMCreate is the tools/call handler for vm_create
+func handleVMCreate(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMCreateParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Name == "" {
+		return "", missingArgument("name")
+	}
+	if !vmNameRegex.MatchString(params.Name) {
+		return "", &invalidParamsError{err: fmt.Errorf("invalid VM name %q, use lowercase letters, digits and dashes", params.Name)}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.OS == "" {
+		params.OS = defaultVMCreateOS
+	}
+	if params.CPU == 0 {
+		params.CPU = 1
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultVMCreateTimeout
+	}
+
+	template, ok := vmTemplates[params.OS]
+	if !ok {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown os %q", params.OS)}
+	}
+	if params.Image != "" && params.DataVolume != "" {
+		return "", &invalidParamsError{err: errors.New("image and data_volume are mutually exclusive")}
+	}
+	if params.CPU < 0 {
+		return "", &invalidParamsError{err: errors.New("cpu must be positive")}
+	}
+	if params.Memory != "" {
+		if _, ok := parseQuantity(params.Memory); !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid memory %q", params.Memory)}
+		}
+	}
+
+	result, err := createVM(ctx, params, template)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// createVM creates the VM and optionally waits for it to become ready
+func createVM(ctx context.Context, params VMCreateParams, template vmTemplate) (*VMCreateResult, error) {
+	manifest := vmCreateManifest(params, template)
+	diff, err := mutationDiff(ctx, "virtualmachine", params.Name, params.Namespace, func() error {
+		return createObject(ctx, manifest)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM: %v", err)
+	}
+
+	result := &VMCreateResult{Name: params.Name, Namespace: params.Namespace, OS: params.OS, Manifest: manifest, Diff: diff}
+	if !params.Wait {
+		return result, nil
+	}
+
+	reportProgress(ctx, "waiting for VM %s/%s to be ready", params.Namespace, params.Name)
+	// Wait on the VM rather than the VMI, which does not exist right after creation
+	waitErr := waitFor(ctx, params.Namespace, "vm/"+params.Name, "condition=Ready", time.Duration(params.Timeout)*time.Second)
+
+	var vm VirtualMachine
+	if err := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.Name, "-n", params.Namespace); err == nil {
+		result.Status = vm.Status.PrintableStatus
+	}
+	if waitErr != nil {
+		return nil, fmt.Errorf("VM %s/%s was created but is not ready (status %q): %v", params.Namespace, params.Name, result.Status, waitErr)
+	}
+	return result, nil
+}
+
+// vmCreateManifest renders the VirtualMachine manifest from the template and
+// the parameters overriding it
+func vmCreateManifest(params VMCreateParams, template vmTemplate) map[string]interface{} {
+	image := template.image
+	if params.Image != "" {
+		image = params.Image
+	}
+	memory := template.memory
+	if params.Memory != "" {
+		memory = params.Memory
+	}
+	userData := template.userData
+	if params.CloudInit != "" {
+		userData = params.CloudInit
+	}
+
+	disks := []map[string]interface{}{{
+		"name": "containerdisk",
+		"disk": map[string]interface{}{"bus": "virtio"},
+	}}
+	volumes := []map[string]interface{}{{
+		"name":          "containerdisk",
+		"containerDisk": map[string]interface{}{"image": image},
+	}}
+	if params.DataVolume != "" {
+		disks[0]["name"] = "rootdisk"
+		volumes = []map[string]interface{}{{
+			"name":       "rootdisk",
+			"dataVolume": map[string]interface{}{"name": params.DataVolume},
+		}}
+	}
+	if userData != "" {
+		disks = append(disks, map[string]interface{}{
+			"name": "cloudinitdisk",
+			"disk": map[string]interface{}{"bus": "virtio"},
+		})
+		volumes = append(volumes, map[string]interface{}{
+			"name":             "cloudinitdisk",
+			"cloudInitNoCloud": map[string]interface{}{"userData": userData},
+		})
+	}
+
+	return map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata": map[string]interface{}{
+			"name":      params.Name,
+			"namespace": params.Namespace,
+			"labels":    managedLabels("vm_create", false),
+		},
+		"spec": map[string]interface{}{
+			"runStrategy": "Always",
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					// vm-exec picks the login method from the kubevirt.io/os label
+					// when the image name does not tell the OS
+					"labels": map[string]string{managedByLabel: managedByValue, "kubevirt.io/os": params.OS},
+				},
+				"spec": map[string]interface{}{
+					"domain": map[string]interface{}{
+						"cpu": map[string]interface{}{"cores": params.CPU},
+						"devices": map[string]interface{}{
+							"disks": disks,
+							"interfaces": []map[string]interface{}{{
+								"name":       "default",
+								"masquerade": map[string]interface{}{},
+							}},
+						},
+						"resources": map[string]interface{}{
+							"requests": map[string]interface{}{"memory": memory},
+						},
+					},
+					"networks": []map[string]interface{}{{
+						"name": "default",
+						"pod":  map[string]interface{}{},
+					}},
+					"volumes": volumes,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCreateManyParallelism = 10
+	defaultCreateManyTimeout     = 600
+	maxCreateManyCount           = 500
+	maxCreateManyParallelism     = 50
+
+	// createManyIndex is replaced by the index of each VM in the name template
+	createManyIndex = "{index}"
+
+	// batchLabel groups the VMs created by one vm_create_many call
+	batchLabel = "kubevirt-mcp/batch"
+)
+
+// VMCreateManyParams represents the parameters of vm_create_many
+type VMCreateManyParams struct {
+	Name        string `json:"name"`
+	Count       int    `json:"count"`
+	Namespace   string `json:"namespace,omitempty"`
+	OS          string `json:"os,omitempty"`
+	Image       string `json:"image,omitempty"`
+	CPU         int    `json:"cpu,omitempty"`
+	Memory      string `json:"memory,omitempty"`
+	CloudInit   string `json:"cloud_init,omitempty"`
+	Parallelism int    `json:"parallelism,omitempty"`
+	Quorum      int    `json:"quorum,omitempty"`
+	Timeout     int    `json:"timeout,omitempty"`
+	Format      string `json:"format,omitempty"`
+}
+
+// CreatedVM reports one VM of vm_create_many
+type CreatedVM struct {
+	Name         string  `json:"name"`
+	Status       string  `json:"status,omitempty"`
+	Ready        bool    `json:"ready"`
+	ReadySeconds float64 `json:"readySeconds,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// ReadyStats are the creation to Ready times of the ready VMs, in seconds
+type ReadyStats struct {
+	Min  float64 `json:"minSeconds"`
+	Mean float64 `json:"meanSeconds"`
+	P50  float64 `json:"p50Seconds"`
+	P90  float64 `json:"p90Seconds"`
+	Max  float64 `json:"maxSeconds"`
+}
+
+// VMCreateManyResult is the vm_create_many tool result
+type VMCreateManyResult struct {
+	Namespace      string      `json:"namespace"`
+	Batch          string      `json:"batch"`
+	Selector       string      `json:"selector"`
+	Requested      int         `json:"requested"`
+	Created        int         `json:"created"`
+	Ready          int         `json:"ready"`
+	Failed         int         `json:"failed"`
+	Quorum         int         `json:"quorum"`
+	QuorumReached  bool        `json:"quorumReached"`
+	CreateDuration string      `json:"createDuration"`
+	TotalDuration  string      `json:"totalDuration"`
+	Stats          *ReadyStats `json:"stats,omitempty"`
+	VMs            []CreatedVM `json:"vms"`
+	Note           string      `json:"note,omitempty"`
+}
+
+func init() {
+	flavors := make([]string, 0, len(vmTemplates))
+	for flavor := range vmTemplates {
+		flavors = append(flavors, flavor)
+	}
+	sort.Strings(flavors)
+
+	registerTool(Tool{
+		Name:        "vm_create_many",
+		Description: "Create count identical VMs from a built-in OS template in parallel, wait until all of them or a quorum are Ready, and report the creation and time-to-Ready stats, e.g. for scale testing virt-controller",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "VM name template, " + createManyIndex + " is replaced by the VM index counted from 1, e.g. scale-" + createManyIndex + " (appended as -" + createManyIndex + " when missing)",
+				},
+				"count": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("Number of VMs to create, at most %d", maxCreateManyCount),
+				},
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace to create the VMs in",
+					"default":     "default",
+				},
+				"os": map[string]interface{}{
+					"type":        "string",
+					"description": "OS flavor of the built-in template",
+					"enum":        flavors,
+					"default":     defaultVMCreateOS,
+				},
+				"image": map[string]interface{}{
+					"type":        "string",
+					"description": "containerdisk image, overrides the template image",
+				},
+				"cpu": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of CPU cores (default: 1)",
+					"default":     1,
+				},
+				"memory": map[string]interface{}{
+					"type":        "string",
+					"description": "Guest memory, e.g. 1Gi (default: the template memory)",
+				},
+				"cloud_init": map[string]interface{}{
+					"type":        "string",
+					"description": "cloud-init user data, replaces the template user data that sets the console password",
+				},
+				"parallelism": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("Number of VMs created at the same time, at most %d (default: %d)", maxCreateManyParallelism, defaultCreateManyParallelism),
+					"default":     defaultCreateManyParallelism,
+				},
+				"quorum": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of Ready VMs to wait for (default: count)",
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for creating the VMs and waiting for the quorum (default: 600)",
+					"default":     defaultCreateManyTimeout,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"name", "count"},
+		},
+		Handler: handleVMCreateMany,
+	})
+}
+
+// handleVMCreateMany is the tools/call handler for vm_create_many
+func handleVMCreateMany(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMCreateManyParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Name == "" {
+		return "", missingArgument("name")
+	}
+	if params.Count == 0 {
+		return "", missingArgument("count")
+	}
+	if params.Count < 0 || params.Count > maxCreateManyCount {
+		return "", &invalidParamsError{err: fmt.Errorf("count must be between 1 and %d", maxCreateManyCount)}
+	}
+	if !strings.Contains(params.Name, createManyIndex) {
+		params.Name += "-" + createManyIndex
+	}
+	for _, index := range []int{1, params.Count} {
+		if name := createManyName(params.Name, index); !vmNameRegex.MatchString(name) {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid VM name %q, use lowercase letters, digits and dashes", name)}
+		}
+	}
+	if params.Parallelism < 0 || params.Parallelism > maxCreateManyParallelism {
+		return "", &invalidParamsError{err: fmt.Errorf("parallelism must be between 1 and %d", maxCreateManyParallelism)}
+	}
+	if params.Quorum < 0 || params.Quorum > params.Count {
+		return "", &invalidParamsError{err: errors.New("quorum must be between 1 and count")}
+	}
+	if params.CPU < 0 {
+		return "", &invalidParamsError{err: errors.New("cpu must be positive")}
+	}
+	if params.Timeout < 0 {
+		return "", &invalidParamsError{err: errors.New("timeout cannot be negative")}
+	}
+	if params.Memory != "" {
+		if _, ok := parseQuantity(params.Memory); !ok {
+			return "", &invalidParamsError{err: fmt.Errorf("invalid memory %q", params.Memory)}
+		}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.OS == "" {
+		params.OS = defaultVMCreateOS
+	}
+	if params.CPU == 0 {
+		params.CPU = 1
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = defaultCreateManyParallelism
+	}
+	if params.Quorum == 0 {
+		params.Quorum = params.Count
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultCreateManyTimeout
+	}
+
+	template, ok := vmTemplates[params.OS]
+	if !ok {
+		return "", &invalidParamsError{err: fmt.Errorf("unknown os %q", params.OS)}
+	}
+
+	result, err := createManyVMs(ctx, params, template)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// createManyName returns the name of the VM with the given index
+func createManyName(template string, index int) string {
+	return strings.ReplaceAll(template, createManyIndex, strconv.Itoa(index))
+}
+
+// createManyVMs creates the VMs with a pool of workers, then waits for the
+// quorum. Failed creations are reported per VM and do not stop the others.
+func createManyVMs(ctx context.Context, params VMCreateManyParams, template vmTemplate) (*VMCreateManyResult, error) {
+	ctx, cancel := clock.WithTimeout(ctx, time.Duration(params.Timeout)*time.Second)
+	defer cancel()
+
+	batch := generateName("batch-")
+	result := &VMCreateManyResult{
+		Namespace: params.Namespace,
+		Batch:     batch,
+		Selector:  batchLabel + "=" + batch,
+		Requested: params.Count,
+		Quorum:    params.Quorum,
+		VMs:       make([]CreatedVM, params.Count),
+	}
+
+	start := clock.Now()
+	indexes := make(chan int)
+	var workers sync.WaitGroup
+	for i := 0; i < min(params.Parallelism, params.Count); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indexes {
+				result.VMs[i] = createBatchVM(ctx, params, template, batch, i+1)
+			}
+		}()
+	}
+	for i := 0; i < params.Count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	workers.Wait()
+	result.CreateDuration = humanDuration(clock.Now().Sub(start))
+
+	for _, vm := range result.VMs {
+		if vm.Error == "" {
+			result.Created++
+		} else {
+			result.Failed++
+		}
+	}
+	logMessage(LogInfo, "vm_create_many", "Created %d of %d VMs of batch %s in %s", result.Created, params.Count, batch, result.CreateDuration)
+
+	if result.Created >= params.Quorum {
+		if err := waitForQuorum(ctx, result); err != nil {
+			result.Note = err.Error()
+		}
+	} else {
+		result.Note = fmt.Sprintf("only %d VMs were created, the quorum of %d cannot be reached", result.Created, params.Quorum)
+	}
+
+	result.TotalDuration = humanDuration(clock.Now().Sub(start))
+	result.Stats = readyStats(result.VMs)
+	return result, nil
+}
+
+// createBatchVM creates one VM of the batch
+func createBatchVM(ctx context.Context, params VMCreateManyParams, template vmTemplate, batch string, index int) CreatedVM {
+	vm := CreatedVM{Name: createManyName(params.Name, index)}
+	manifest := vmCreateManifest(VMCreateParams{
+		Name:      vm.Name,
+		Namespace: params.Namespace,
+		OS:        params.OS,
+		Image:     params.Image,
+		CPU:       params.CPU,
+		Memory:    params.Memory,
+		CloudInit: params.CloudInit,
+	}, template)
+	labels := managedLabels("vm_create_many", false)
+	labels[batchLabel] = batch
+	manifest["metadata"].(map[string]interface{})["labels"] = labels
+	// The VMIs carry the batch label too, to select them for measurements
+	spec := manifest["spec"].(map[string]interface{})
+	spec["template"].(map[string]interface{})["metadata"].(map[string]interface{})["labels"].(map[string]string)[batchLabel] = batch
+
+	if err := createObject(ctx, manifest); err != nil {
+		vm.Error = kubectlErrorMessage(err)
+	}
+	return vm
+}
+
+// kubectlErrorMessage returns the output of a failed kubectl command on a
+// single line, such as the AlreadyExists error of the API server
+func kubectlErrorMessage(err error) string {
+	message := err.Error()
+	if i := strings.LastIndex(message, "Output: "); i >= 0 {
+		message = message[i+len("Output: "):]
+	}
+	return strings.Join(strings.Fields(message), " ")
+}
+
+// waitForQuorum polls the VMs of the batch until the quorum is Ready, too
+// many of them failed or the timeout expired, recording the status and the
+// time to Ready of each VM
+func waitForQuorum(ctx context.Context, result *VMCreateManyResult) error {
+	for {
+		var list VirtualMachineList
+		if err := runKubectlJSON(ctx, &list, "get", "virtualmachines", "-n", result.Namespace, "-l", result.Selector); err != nil {
+			return fmt.Errorf("failed to list the VMs: %v", err)
+		}
+		vms := map[string]VirtualMachine{}
+		for _, vm := range list.Items {
+			vms[vm.Metadata.Name] = vm
+		}
+
+		ready, failed := 0, 0
+		for i := range result.VMs {
+			created := &result.VMs[i]
+			vm, ok := vms[created.Name]
+			switch {
+			case created.Error != "":
+				failed++
+			case !ok:
+				created.Status = "Deleted"
+				failed++
+			case vm.Status.Ready:
+				if !created.Ready {
+					created.Ready = true
+					created.ReadySeconds = timeToReady(vm)
+				}
+				created.Status = vm.Status.PrintableStatus
+				ready++
+			default:
+				created.Status = vm.Status.PrintableStatus
+				if failingVMStatuses[vm.Status.PrintableStatus] {
+					failed++
+				}
+			}
+		}
+		result.Ready = ready
+		result.Failed = failed
+
+		if ready >= result.Quorum {
+			result.QuorumReached = true
+			return nil
+		}
+		if result.Requested-result.Failed < result.Quorum {
+			return fmt.Errorf("%d VMs failed, the quorum of %d cannot be reached", result.Failed, result.Quorum)
+		}
+		reportProgress(ctx, "%d of %d VMs ready", ready, result.Quorum)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("only %d of %d VMs were ready within the timeout", ready, result.Quorum)
+		case <-clock.After(2 * time.Second):
+		}
+	}
+}
+
+// timeToReady returns the seconds from the creation of the VM to its Ready
+// condition, both taken from the API server
+func timeToReady(vm VirtualMachine) float64 {
+	readySince := clock.Now()
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type == "Ready" && !cond.LastTransitionTime.IsZero() {
+			readySince = cond.LastTransitionTime
+		}
+	}
+	return roundSeconds(readySince.Sub(vm.Metadata.CreationTimestamp))
+}
+
+// roundSeconds converts a duration to seconds with a 0.1s precision
+func roundSeconds(d time.Duration) float64 {
+	return math.Round(d.Seconds()*10) / 10
+}
+
+// readyStats aggregates the time to Ready of the ready VMs, nil when none
+// is ready
+func readyStats(vms []CreatedVM) *ReadyStats {
+	var times []time.Duration
+	var total time.Duration
+	for _, vm := range vms {
+		if vm.Ready {
+			d := time.Duration(vm.ReadySeconds * float64(time.Second))
+			times = append(times, d)
+			total += d
+		}
+	}
+	if len(times) == 0 {
+		return nil
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return &ReadyStats{
+		Min:  roundSeconds(times[0]),
+		Mean: roundSeconds(total / time.Duration(len(times))),
+		P50:  roundSeconds(percentile(times, 50)),
+		P90:  roundSeconds(percentile(times, 90)),
+		Max:  roundSeconds(times[len(times)-1]),
+	}
+}
+
+// tables renders the result for the text format
+func (r *VMCreateManyResult) tables() []table {
+	title := fmt.Sprintf("%d of %d VMs ready (quorum %d) in %s, created in %s, selector %s",
+		r.Ready, r.Requested, r.Quorum, r.TotalDuration, r.CreateDuration, r.Selector)
+	if r.Note != "" {
+		title += ": " + r.Note
+	}
+	tables := []table{}
+	if r.Stats != nil {
+		tables = append(tables, table{
+			title:   "Time to Ready (seconds)",
+			headers: []string{"MIN", "MEAN", "P50", "P90", "MAX"},
+			rows: [][]string{{
+				strconv.FormatFloat(r.Stats.Min, 'f', 1, 64),
+				strconv.FormatFloat(r.Stats.Mean, 'f', 1, 64),
+				strconv.FormatFloat(r.Stats.P50, 'f', 1, 64),
+				strconv.FormatFloat(r.Stats.P90, 'f', 1, 64),
+				strconv.FormatFloat(r.Stats.Max, 'f', 1, 64),
+			}},
+		})
+	}
+	vms := table{title: title, headers: []string{"NAME", "STATUS", "READY", "READY AFTER", "ERROR"}}
+	for _, vm := range r.VMs {
+		readyAfter := ""
+		if vm.Ready {
+			readyAfter = strconv.FormatFloat(vm.ReadySeconds, 'f', 1, 64) + "s"
+		}
+		vms.rows = append(vms.rows, []string{vm.Name, vm.Status, strconv.FormatBool(vm.Ready), readyAfter, vm.Error})
+	}
+	return append([]table{vms}, tables...)
+}
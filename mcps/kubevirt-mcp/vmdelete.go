@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultVMDeleteTimeout = 120
+
+// VMDeleteParams represents the parameters for deleting a VM or VMI
+type VMDeleteParams struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Cascade   *bool  `json:"cascade,omitempty"`
+	Wait      bool   `json:"wait,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+	Confirm   bool   `json:"confirm,omitempty"`
+	Force     bool   `json:"force,omitempty"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+}
+
+// VMDeleteResult is the vm_delete tool result
+type VMDeleteResult struct {
+	Name         string   `json:"name"`
+	Namespace    string   `json:"namespace"`
+	Kind         string   `json:"kind"`
+	DryRun       bool     `json:"dryRun,omitempty"`
+	Cascade      bool     `json:"cascade"`
+	Deleted      []string `json:"deleted"`
+	LauncherPods []string `json:"launcherPods,omitempty"`
+	Waited       bool     `json:"waited,omitempty"`
+	Diff         string   `json:"diff,omitempty"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_delete",
+		Description: "Delete a VM or VMI, optionally waiting for the VMI and its virt-launcher pod to be gone. Requires confirm unless dry_run is set",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"kind": map[string]interface{}{
+					"type":        "string",
+					"description": "What to delete; auto deletes the VM when one exists and the standalone VMI otherwise",
+					"enum":        []string{"auto", "vm", "vmi"},
+					"default":     "auto",
+				},
+				"cascade": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Delete the VMI together with its VM; false orphans the running VMI",
+					"default":     true,
+				},
+				"wait": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Wait for the VMI and virt-launcher pods to be deleted",
+					"default":     false,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds when waiting (default: 120)",
+					"default":     defaultVMDeleteTimeout,
+				},
+				"confirm": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Must be true to actually delete, as a guard against accidental deletion",
+					"default":     false,
+				},
+				"force": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Delete immediately with a zero grace period instead of shutting the guest down gracefully",
+					"default":     false,
+				},
+				"dry_run": map[string]interface{}{
+					"type":        "boolean",
+					"description": "Validate the deletion with a server-side dry run and report what would be deleted",
+					"default":     false,
+				},
+			},
+			"required": []string{"name"},
+		},
+		Handler: handleVMDelete,
+	})
+}
+
+// handleVMDelete is the tools/call handler for vm_delete
+func handleVMDelete(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMDeleteParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Name == "" {
+		return "", missingArgument("name")
+	}
+	if !params.Confirm && !params.DryRun {
+		return "", &invalidParamsError{err: errors.New("set confirm to true to delete, or dry_run to preview the deletion")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Kind == "" {
+		params.Kind = "auto"
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultVMDeleteTimeout
+	}
+	if params.Kind != "auto" && params.Kind != "vm" && params.Kind != "vmi" {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported kind '%s'", params.Kind)}
+	}
+
+	result, err := deleteVM(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatJSON(result)
+}
+
+// deleteVM deletes the VM or VMI and optionally waits for the VMI and its
+// virt-launcher pods to disappear
+func deleteVM(ctx context.Context, params VMDeleteParams) (*VMDeleteResult, error) {
+	cascade := params.Cascade == nil || *params.Cascade
+	result := &VMDeleteResult{Name: params.Name, Namespace: params.Namespace, DryRun: params.DryRun, Cascade: cascade, Deleted: []string{}}
+
+	var vm VirtualMachine
+	vmErr := runKubectlJSON(ctx, &vm, "get", "virtualmachine", params.Name, "-n", params.Namespace)
+	var vmi VirtualMachineInstance
+	vmiErr := runKubectlJSON(ctx, &vmi, "get", "virtualmachineinstance", params.Name, "-n", params.Namespace)
+
+	resource := "virtualmachine"
+	switch params.Kind {
+	case "vm":
+		if vmErr != nil {
+			return nil, vmErr
+		}
+	case "vmi":
+		if vmiErr != nil {
+			return nil, vmiErr
+		}
+		resource = "virtualmachineinstance"
+	default:
+		if vmErr != nil {
+			if vmiErr != nil {
+				return nil, fmt.Errorf("neither VM nor VMI found with name '%s' in namespace '%s'", params.Name, params.Namespace)
+			}
+			resource = "virtualmachineinstance"
+		}
+	}
+	result.Kind = "VirtualMachine"
+	if resource == "virtualmachineinstance" {
+		result.Kind = "VirtualMachineInstance"
+	}
+
+	// The VMI and its launcher pods go away with the VM unless it is orphaned
+	result.Deleted = append(result.Deleted, resource+"/"+params.Name)
+	removesVMI := vmiErr == nil && (resource == "virtualmachineinstance" || cascade)
+	if removesVMI {
+		if resource == "virtualmachine" {
+			result.Deleted = append(result.Deleted, "virtualmachineinstance/"+params.Name)
+		}
+		var pods PodList
+		if err := runKubectlJSON(ctx, &pods, "get", "pods", "-n", params.Namespace, "-l", "kubevirt.io/created-by="+vmi.Metadata.UID); err == nil {
+			for _, pod := range pods.Items {
+				result.LauncherPods = append(result.LauncherPods, pod.Metadata.Name)
+			}
+		}
+	}
+
+	args := []string{"delete", resource, params.Name, "-n", params.Namespace, "--wait=false"}
+	if !cascade {
+		args = append(args, "--cascade=orphan")
+	}
+	if params.Force {
+		args = append(args, "--grace-period=0", "--force")
+	}
+	if params.DryRun {
+		if _, err := runKubectl(ctx, append(args, "--dry-run=server")...); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	diff, err := mutationDiff(ctx, resource, params.Name, params.Namespace, func() error {
+		_, err := runKubectl(ctx, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Diff = diff
+
+	if !params.Wait || !removesVMI {
+		return result, nil
+	}
+
+	timeout := time.Duration(params.Timeout) * time.Second
+	reportProgress(ctx, "waiting for VMI %s/%s to be deleted", params.Namespace, params.Name)
+	if err := waitForDeletion(ctx, params.Namespace, "virtualmachineinstance/"+params.Name, timeout); err != nil {
+		return nil, fmt.Errorf("%s was deleted but the VMI is still present: %v", resource, err)
+	}
+	for _, pod := range result.LauncherPods {
+		reportProgress(ctx, "waiting for virt-launcher pod %s to be deleted", pod)
+		if err := waitForDeletion(ctx, params.Namespace, "pod/"+pod, timeout); err != nil {
+			return nil, fmt.Errorf("%s was deleted but virt-launcher pod %s is still present: %v", resource, pod, err)
+		}
+	}
+	result.Waited = true
+	return result, nil
+}
+
+// waitForDeletion waits for an object to be deleted, an object that is
+// already gone counts as deleted
+func waitForDeletion(ctx context.Context, namespace, resource string, timeout time.Duration) error {
+	if err := waitFor(ctx, namespace, resource, "delete", timeout); err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	return nil
+}
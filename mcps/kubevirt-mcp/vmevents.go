@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultVMEventsLimit = 50
+
+// launcherPodPrefix is the name prefix of the virt-launcher pods of a VM,
+// followed by a random 5 character suffix
+const launcherPodPrefix = "virt-launcher-"
+
+// VMEventsParams represents the parameters of vm_events
+type VMEventsParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Since     string `json:"since,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Format    string `json:"format,omitempty"`
+}
+
+// VMEvent is an event of a VM, its VMI or launcher pods, with repeated
+// occurrences folded together
+type VMEvent struct {
+	Type      string    `json:"type"`
+	Object    string    `json:"object"`
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Age       string    `json:"age,omitempty"`
+}
+
+// VMEventsResult is the vm_events tool result
+type VMEventsResult struct {
+	Namespace string    `json:"namespace"`
+	VMName    string    `json:"vmName"`
+	Since     string    `json:"since,omitempty"`
+	Total     int       `json:"total"`
+	Events    []VMEvent `json:"events"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_events",
+		Description: "List the Kubernetes events of a VM, its VMI and its virt-launcher pods, oldest first with repeated events folded together. Use it to see why a VM does not schedule, start or migrate",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or standalone VMI",
+				},
+				"since": map[string]interface{}{
+					"type":        "string",
+					"description": "Only return events seen after this RFC 3339 timestamp or within this duration, e.g. 2024-05-01T10:00:00Z or 30m",
+				},
+				"type": map[string]interface{}{
+					"type":        "string",
+					"description": "Only return events of this type",
+					"enum":        []string{"Normal", "Warning"},
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of events to return, the most recent ones are kept",
+					"default":     defaultVMEventsLimit,
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMEvents,
+	})
+}
+
+// handleVMEvents is the tools/call handler for vm_events
+func handleVMEvents(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMEventsParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Type != "" && params.Type != "Normal" && params.Type != "Warning" {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported event type '%s', use Normal or Warning", params.Type)}
+	}
+	if params.Limit < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("limit must not be negative")}
+	}
+	if params.Limit == 0 {
+		params.Limit = defaultVMEventsLimit
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	var after time.Time
+	if params.Since != "" {
+		var err error
+		if after, err = parseSince(params.Since); err != nil {
+			return "", &invalidParamsError{err: err}
+		}
+	}
+
+	result, err := vmEvents(ctx, params, after)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// parseSince parses an RFC 3339 timestamp or a duration before now
+func parseSince(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid since '%s', use an RFC 3339 timestamp or a duration such as 30m", value)
+	}
+	return clock.Now().Add(-d), nil
+}
+
+// vmEvents collects the events of the VM, its VMI and launcher pods
+func vmEvents(ctx context.Context, params VMEventsParams, after time.Time) (*VMEventsResult, error) {
+	reportProgress(ctx, "reading events in %s", params.Namespace)
+	var list struct {
+		Items []Event `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &list, "get", "events", "-n", params.Namespace); err != nil {
+		return nil, err
+	}
+
+	folded := map[string]*VMEvent{}
+	var events []*VMEvent
+	for _, e := range list.Items {
+		if !isVMEvent(e, params.VMName) || (params.Type != "" && e.Type != params.Type) {
+			continue
+		}
+		if !after.IsZero() && !e.lastSeen().After(after) {
+			continue
+		}
+		count := e.Count
+		if count == 0 {
+			count = 1
+		}
+
+		object := strings.ToLower(e.InvolvedObject.Kind) + "/" + e.InvolvedObject.Name
+		key := strings.Join([]string{object, e.Type, e.Reason, e.Message}, "\x00")
+		if existing, ok := folded[key]; ok {
+			existing.Count += count
+			if e.firstSeen().Before(existing.FirstSeen) {
+				existing.FirstSeen = e.firstSeen()
+			}
+			if e.lastSeen().After(existing.LastSeen) {
+				existing.LastSeen = e.lastSeen()
+			}
+			continue
+		}
+		event := &VMEvent{
+			Type:      e.Type,
+			Object:    object,
+			Reason:    e.Reason,
+			Message:   e.Message,
+			Count:     count,
+			FirstSeen: e.firstSeen(),
+			LastSeen:  e.lastSeen(),
+		}
+		folded[key] = event
+		events = append(events, event)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].LastSeen.Before(events[j].LastSeen)
+	})
+
+	result := &VMEventsResult{Namespace: params.Namespace, VMName: params.VMName, Since: params.Since, Total: len(events), Events: []VMEvent{}}
+	if len(events) > params.Limit {
+		events = events[len(events)-params.Limit:]
+	}
+	for _, event := range events {
+		event.Age = since(event.LastSeen)
+		result.Events = append(result.Events, *event)
+	}
+	return result, nil
+}
+
+// isVMEvent reports whether the event is about the VM, its VMI or one of its
+// launcher pods, including pods that no longer exist
+func isVMEvent(e Event, vmName string) bool {
+	switch e.InvolvedObject.Kind {
+	case "VirtualMachine", "VirtualMachineInstance":
+		return e.InvolvedObject.Name == vmName
+	case "Pod":
+		suffix, ok := strings.CutPrefix(e.InvolvedObject.Name, launcherPodPrefix+vmName+"-")
+		return ok && len(suffix) == 5 && !strings.Contains(suffix, "-")
+	}
+	return false
+}
+
+// tables renders the events oldest first
+func (r *VMEventsResult) tables() []table {
+	title := fmt.Sprintf("Events of %s/%s", r.Namespace, r.VMName)
+	if len(r.Events) < r.Total {
+		title += fmt.Sprintf(" (%d most recent of %d)", len(r.Events), r.Total)
+	}
+	events := table{title: title, headers: []string{"LAST SEEN", "TYPE", "OBJECT", "REASON", "COUNT", "MESSAGE"}}
+	for _, e := range r.Events {
+		events.rows = append(events.rows, []string{e.Age, e.Type, e.Object, e.Reason, strconv.Itoa(e.Count), e.Message})
+	}
+	return []table{events}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// VMInfoParams represents the parameters of vm_info
+type VMInfoParams struct {
+	Namespace string `json:"namespace,omitempty"`
+	VMName    string `json:"vm_name"`
+	Format    string `json:"format,omitempty"`
+}
+
+// VMInfoCPU is the CPU topology and allocation of a VMI
+type VMInfoCPU struct {
+	Sockets int    `json:"sockets,omitempty"`
+	Cores   int    `json:"cores,omitempty"`
+	Threads int    `json:"threads,omitempty"`
+	VCPUs   int    `json:"vcpus,omitempty"`
+	Request string `json:"request,omitempty"`
+	Limit   string `json:"limit,omitempty"`
+}
+
+// VMInfoMemory is the memory allocation of a VMI
+type VMInfoMemory struct {
+	Guest        string `json:"guest,omitempty"`
+	GuestCurrent string `json:"guestCurrent,omitempty"`
+	Request      string `json:"request,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+// VMInfoInterface is a network interface of a VMI
+type VMInfoInterface struct {
+	Name          string   `json:"name,omitempty"`
+	InterfaceName string   `json:"interfaceName,omitempty"`
+	IPAddress     string   `json:"ipAddress,omitempty"`
+	IPAddresses   []string `json:"ipAddresses,omitempty"`
+	MAC           string   `json:"mac,omitempty"`
+}
+
+// VMInfoVolume is a volume of a VM with its status in the VMI
+type VMInfoVolume struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+	Phase  string `json:"phase,omitempty"`
+	Size   string `json:"size,omitempty"`
+}
+
+// VMInfoFilesystem is a guest filesystem reported by the guest agent
+type VMInfoFilesystem struct {
+	MountPoint string `json:"mountPoint"`
+	Type       string `json:"type,omitempty"`
+	Disk       string `json:"disk,omitempty"`
+	UsedBytes  int64  `json:"usedBytes,omitempty"`
+	TotalBytes int64  `json:"totalBytes,omitempty"`
+}
+
+// VMInfoGuestOS is what the guest agent reports about the guest
+type VMInfoGuestOS struct {
+	ID            string             `json:"id,omitempty"`
+	Name          string             `json:"name,omitempty"`
+	PrettyName    string             `json:"prettyName,omitempty"`
+	Version       string             `json:"version,omitempty"`
+	KernelRelease string             `json:"kernelRelease,omitempty"`
+	Hostname      string             `json:"hostname,omitempty"`
+	Timezone      string             `json:"timezone,omitempty"`
+	AgentVersion  string             `json:"agentVersion,omitempty"`
+	Filesystems   []VMInfoFilesystem `json:"filesystems,omitempty"`
+}
+
+// VMInfoResult is the vm_info tool result
+type VMInfoResult struct {
+	Namespace      string            `json:"namespace"`
+	Name           string            `json:"name"`
+	Kind           string            `json:"kind"`
+	Status         string            `json:"status,omitempty"`
+	RunStrategy    string            `json:"runStrategy,omitempty"`
+	Phase          string            `json:"phase,omitempty"`
+	Node           string            `json:"node,omitempty"`
+	LauncherPod    string            `json:"launcherPod,omitempty"`
+	Age            string            `json:"age,omitempty"`
+	Uptime         string            `json:"uptime,omitempty"`
+	AgentConnected bool              `json:"agentConnected"`
+	CPU            *VMInfoCPU        `json:"cpu,omitempty"`
+	Memory         *VMInfoMemory     `json:"memory,omitempty"`
+	Interfaces     []VMInfoInterface `json:"interfaces,omitempty"`
+	Volumes        []VMInfoVolume    `json:"volumes,omitempty"`
+	Conditions     []Condition       `json:"conditions,omitempty"`
+	GuestOS        *VMInfoGuestOS    `json:"guestOS,omitempty"`
+	Note           string            `json:"note,omitempty"`
+}
+
+// guestOSInfoReply is the reply of the VMI guestosinfo subresource
+type guestOSInfoReply struct {
+	GuestAgentVersion string `json:"guestAgentVersion"`
+	Hostname          string `json:"hostname"`
+	OS                struct {
+		ID            string `json:"id"`
+		Name          string `json:"name"`
+		PrettyName    string `json:"prettyName"`
+		Version       string `json:"version"`
+		KernelRelease string `json:"kernelRelease"`
+	} `json:"os"`
+	Timezone string `json:"timezone"`
+	FSInfo   struct {
+		Disks []struct {
+			DiskName       string `json:"diskName"`
+			MountPoint     string `json:"mountPoint"`
+			FileSystemType string `json:"fileSystemType"`
+			UsedBytes      int64  `json:"usedBytes"`
+			TotalBytes     int64  `json:"totalBytes"`
+		} `json:"disks"`
+	} `json:"fsInfo"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_info",
+		Description: "Describe a VM and its VMI: phase, conditions, node, interfaces with IPs and MACs, volumes, CPU and memory allocation, launcher pod and guest OS details from the guest agent, without exec'ing into the guest",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or standalone VMI",
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMInfo,
+	})
+}
+
+// handleVMInfo is the tools/call handler for vm_info
+func handleVMInfo(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMInfoParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+
+	result, err := vmInfo(ctx, params.Namespace, params.VMName)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// vmInfo describes a VM, a stopped VM without VMI or a standalone VMI
+func vmInfo(ctx context.Context, namespace, name string) (*VMInfoResult, error) {
+	var vm VirtualMachine
+	vmFound, err := getOptionalObject(ctx, &vm, "virtualmachine", name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var vmi VirtualMachineInstance
+	vmiFound, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", name, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !vmFound && !vmiFound {
+		return nil, fmt.Errorf("VM '%s' not found in namespace '%s'", name, namespace)
+	}
+
+	result := &VMInfoResult{Namespace: namespace, Name: name, Kind: "VirtualMachine"}
+	volumes := vm.Spec.Template.Spec.Volumes
+	if vmFound {
+		result.Status = vm.Status.PrintableStatus
+		result.RunStrategy = vm.Spec.RunStrategy
+		result.Age = since(vm.Metadata.CreationTimestamp)
+		result.Conditions = vm.Status.Conditions
+	} else {
+		result.Kind = "VirtualMachineInstance"
+		result.Age = since(vmi.Metadata.CreationTimestamp)
+	}
+
+	if !vmiFound {
+		result.Volumes = volumeInfo(volumes, nil)
+		result.Note = "The VM is not running, start it to see its node, interfaces and guest details"
+		return result, nil
+	}
+
+	result.Phase = vmi.Status.Phase
+	result.Node = vmi.Status.NodeName
+	result.Uptime = vmiUptime(vmi)
+	result.Conditions = vmi.Status.Conditions
+	result.AgentConnected = conditionStatus(vmi.Status.Conditions, "AgentConnected") == "True"
+	result.CPU = cpuInfo(vmi)
+	result.Memory = memoryInfo(vmi)
+	result.Volumes = volumeInfo(vmi.Spec.Volumes, vmi.Status.VolumeStatus)
+	for _, iface := range vmi.Status.Interfaces {
+		result.Interfaces = append(result.Interfaces, VMInfoInterface(iface))
+	}
+
+	if pod, err := launcherPodOf(ctx, &vmi); err == nil {
+		result.LauncherPod = pod.Metadata.Name
+	} else {
+		logMessage(LogDebug, "vm-info", "No launcher pod for %s/%s: %v", namespace, name, err)
+	}
+
+	result.GuestOS = guestOSInfo(ctx, &vmi, result.AgentConnected)
+	if !result.AgentConnected {
+		result.Note = "The guest agent is not connected, guest OS details and IP addresses may be missing"
+	}
+	return result, nil
+}
+
+// getOptionalObject fetches an object, reporting whether it exists
+func getOptionalObject(ctx context.Context, v interface{}, resource, name, namespace string) (bool, error) {
+	output, err := runKubectl(ctx, "get", resource, name, "-n", namespace, "--ignore-not-found", "-o", "json")
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(string(output)) == "" {
+		return false, nil
+	}
+	if err := json.Unmarshal(output, v); err != nil {
+		return false, fmt.Errorf("failed to parse kubectl output: %v", err)
+	}
+	return true, nil
+}
+
+// cpuInfo returns the CPU topology the VMI runs with and its requests
+func cpuInfo(vmi VirtualMachineInstance) *VMInfoCPU {
+	info := &VMInfoCPU{
+		Request: vmi.Spec.Domain.Resources.Requests["cpu"],
+		Limit:   vmi.Spec.Domain.Resources.Limits["cpu"],
+	}
+	topology := vmi.Status.CurrentCPUTopology
+	if topology == nil {
+		topology = vmi.Spec.Domain.CPU
+	}
+	if topology != nil {
+		info.Sockets, info.Cores, info.Threads = topology.Sockets, topology.Cores, topology.Threads
+		info.VCPUs = max(topology.Sockets, 1) * max(topology.Cores, 1) * max(topology.Threads, 1)
+	}
+	if *info == (VMInfoCPU{}) {
+		return nil
+	}
+	return info
+}
+
+// memoryInfo returns the guest memory of the VMI and its requests
+func memoryInfo(vmi VirtualMachineInstance) *VMInfoMemory {
+	info := &VMInfoMemory{
+		Request: vmi.Spec.Domain.Resources.Requests["memory"],
+		Limit:   vmi.Spec.Domain.Resources.Limits["memory"],
+	}
+	if vmi.Spec.Domain.Memory != nil {
+		info.Guest = vmi.Spec.Domain.Memory.Guest
+	}
+	if vmi.Status.Memory != nil {
+		if info.Guest == "" {
+			info.Guest = vmi.Status.Memory.GuestAtBoot
+		}
+		info.GuestCurrent = vmi.Status.Memory.GuestCurrent
+	}
+	if *info == (VMInfoMemory{}) {
+		return nil
+	}
+	return info
+}
+
+// volumeInfo describes the volumes, with the target and phase reported by
+// the VMI when it runs
+func volumeInfo(volumes []Volume, statuses []VolumeStatus) []VMInfoVolume {
+	var infos []VMInfoVolume
+	for _, volume := range volumes {
+		info := VMInfoVolume{Name: volume.Name, Type: "other"}
+		switch {
+		case volume.ContainerDisk != nil:
+			info.Type, info.Source = "containerDisk", volume.ContainerDisk.Image
+		case volume.DataVolume != nil:
+			info.Type, info.Source = "dataVolume", volume.DataVolume.Name
+		case volume.PersistentVolumeClaim != nil:
+			info.Type, info.Source = "persistentVolumeClaim", volume.PersistentVolumeClaim.ClaimName
+		case volume.CloudInitNoCloud != nil:
+			info.Type = "cloudInitNoCloud"
+		case volume.CloudInitConfigDrive != nil:
+			info.Type = "cloudInitConfigDrive"
+		case volume.EmptyDisk != nil:
+			info.Type, info.Size = "emptyDisk", volume.EmptyDisk.Capacity
+		case volume.Secret != nil:
+			info.Type, info.Source = "secret", volume.Secret.SecretName
+		case volume.ConfigMap != nil:
+			info.Type, info.Source = "configMap", volume.ConfigMap.Name
+		}
+		for _, status := range statuses {
+			if status.Name != volume.Name {
+				continue
+			}
+			info.Target = status.Target
+			info.Phase = status.Phase
+			if status.PersistentVolumeClaimInfo != nil && status.PersistentVolumeClaimInfo.Capacity["storage"] != "" {
+				info.Size = status.PersistentVolumeClaimInfo.Capacity["storage"]
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// guestOSInfo returns the guest details from the guestosinfo subresource when
+// the agent is connected, and otherwise what the VMI status last recorded
+func guestOSInfo(ctx context.Context, vmi *VirtualMachineInstance, agentConnected bool) *VMInfoGuestOS {
+	status := vmi.Status.GuestOSInfo
+	info := &VMInfoGuestOS{
+		ID:            status.ID,
+		Name:          status.Name,
+		PrettyName:    status.PrettyName,
+		Version:       status.Version,
+		KernelRelease: status.KernelRelease,
+	}
+
+	if agentConnected {
+		path := fmt.Sprintf("/apis/subresources.kubevirt.io/v1/namespaces/%s/virtualmachineinstances/%s/guestosinfo", vmi.Metadata.Namespace, vmi.Metadata.Name)
+		var reply guestOSInfoReply
+		if output, err := runKubectl(ctx, "get", "--raw", path); err != nil {
+			logMessage(LogDebug, "vm-info", "Failed to read guest OS info of %s/%s: %v", vmi.Metadata.Namespace, vmi.Metadata.Name, err)
+		} else if err := json.Unmarshal(output, &reply); err == nil {
+			info.ID, info.Name, info.PrettyName = reply.OS.ID, reply.OS.Name, reply.OS.PrettyName
+			info.Version, info.KernelRelease = reply.OS.Version, reply.OS.KernelRelease
+			info.Hostname = reply.Hostname
+			info.Timezone = reply.Timezone
+			info.AgentVersion = reply.GuestAgentVersion
+			for _, disk := range reply.FSInfo.Disks {
+				info.Filesystems = append(info.Filesystems, VMInfoFilesystem{
+					MountPoint: disk.MountPoint,
+					Type:       disk.FileSystemType,
+					Disk:       disk.DiskName,
+					UsedBytes:  disk.UsedBytes,
+					TotalBytes: disk.TotalBytes,
+				})
+			}
+		}
+	}
+
+	if info.ID == "" && info.PrettyName == "" && info.Hostname == "" {
+		return nil
+	}
+	return info
+}
+
+// tables renders the VM description as an overview followed by its
+// interfaces, volumes and conditions
+func (r *VMInfoResult) tables() []table {
+	overview := table{title: fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name), headers: []string{"FIELD", "VALUE"}}
+	add := func(field, value string) {
+		if value != "" {
+			overview.rows = append(overview.rows, []string{field, value})
+		}
+	}
+	add("Status", r.Status)
+	add("Run strategy", r.RunStrategy)
+	add("Phase", r.Phase)
+	add("Node", r.Node)
+	add("Launcher pod", r.LauncherPod)
+	add("Age", r.Age)
+	add("Uptime", r.Uptime)
+	add("Agent connected", strconv.FormatBool(r.AgentConnected))
+	if r.CPU != nil {
+		add("vCPUs", fmt.Sprintf("%d (%d sockets, %d cores, %d threads)", r.CPU.VCPUs, r.CPU.Sockets, r.CPU.Cores, r.CPU.Threads))
+		add("CPU request", r.CPU.Request)
+		add("CPU limit", r.CPU.Limit)
+	}
+	if r.Memory != nil {
+		add("Guest memory", r.Memory.Guest)
+		add("Current guest memory", r.Memory.GuestCurrent)
+		add("Memory request", r.Memory.Request)
+		add("Memory limit", r.Memory.Limit)
+	}
+	if r.GuestOS != nil {
+		add("Guest OS", r.GuestOS.PrettyName)
+		add("Kernel", r.GuestOS.KernelRelease)
+		add("Hostname", r.GuestOS.Hostname)
+		add("Timezone", r.GuestOS.Timezone)
+	}
+	add("Note", r.Note)
+
+	interfaces := table{title: "Interfaces", headers: []string{"NAME", "INTERFACE", "IP", "IPS", "MAC"}}
+	for _, iface := range r.Interfaces {
+		interfaces.rows = append(interfaces.rows, []string{iface.Name, iface.InterfaceName, iface.IPAddress, strings.Join(iface.IPAddresses, ","), iface.MAC})
+	}
+
+	volumes := table{title: "Volumes", headers: []string{"NAME", "TYPE", "SOURCE", "TARGET", "PHASE", "SIZE"}}
+	for _, volume := range r.Volumes {
+		volumes.rows = append(volumes.rows, []string{volume.Name, volume.Type, volume.Source, volume.Target, volume.Phase, volume.Size})
+	}
+
+	conditions := table{title: "Conditions", headers: []string{"TYPE", "STATUS", "REASON", "MESSAGE"}}
+	for _, cond := range r.Conditions {
+		conditions.rows = append(conditions.rows, []string{cond.Type, cond.Status, cond.Reason, cond.Message})
+	}
+
+	return []table{overview, interfaces, volumes, conditions}
+}
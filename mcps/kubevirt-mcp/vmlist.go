@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VMListParams represents the parameters for listing VMs
+type VMListParams struct {
+	Namespace     string `json:"namespace,omitempty"`
+	AllNamespaces bool   `json:"all_namespaces,omitempty"`
+	LabelSelector string `json:"label_selector,omitempty"`
+	FieldSelector string `json:"field_selector,omitempty"`
+	Format        string `json:"format,omitempty"`
+
+	VMIFieldSelector string `json:"vmi_field_selector,omitempty"`
+}
+
+// VMListEntry describes a single VM or standalone VMI
+type VMListEntry struct {
+	Name        string   `json:"name"`
+	Namespace   string   `json:"namespace"`
+	Kind        string   `json:"kind"`
+	Status      string   `json:"status"`
+	Phase       string   `json:"phase,omitempty"`
+	Node        string   `json:"node,omitempty"`
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+	Ready       string   `json:"ready,omitempty"`
+	OS          string   `json:"os,omitempty"`
+	Age         string   `json:"age,omitempty"`
+	Uptime      string   `json:"uptime,omitempty"`
+	Migration   string   `json:"migration,omitempty"`
+}
+
+// VMListResult is the vm_list tool result
+type VMListResult struct {
+	VMs     []VMListEntry  `json:"vms"`
+	Summary map[string]int `json:"summary"`
+	Total   int            `json:"total"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_list",
+		Description: "List VMs and VMIs with phase, node, IP addresses, readiness and OS guess, plus a status summary",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace to list VMs in",
+					"default":     "default",
+				},
+				"all_namespaces": map[string]interface{}{
+					"type":        "boolean",
+					"description": "List VMs across all namespaces",
+					"default":     false,
+				},
+				"label_selector": map[string]interface{}{
+					"type":        "string",
+					"description": "Label selector to filter VMs and standalone VMIs (e.g. 'app=web,tier!=db')",
+				},
+				"field_selector": map[string]interface{}{
+					"type":        "string",
+					"description": "Field selector to filter VMs (e.g. 'metadata.name=vm1'); standalone VMIs are left out when it is set",
+				},
+				"vmi_field_selector": map[string]interface{}{
+					"type":        "string",
+					"description": "Field selector to filter VMIs (e.g. 'status.phase=Running'); VMs without a matching VMI are left out",
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleVMList,
+	})
+	registerSummarizer("vm_list", summarizeVMList)
+}
+
+// handleVMList is the tools/call handler for vm_list
+func handleVMList(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMListParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	result, err := listVMs(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// tables renders the VM list and the status summary as tables
+func (r *VMListResult) tables() []table {
+	vms := table{
+		title:   "VMs",
+		headers: []string{"NAMESPACE", "NAME", "KIND", "STATUS", "PHASE", "NODE", "IP ADDRESSES", "READY", "OS", "AGE", "UPTIME", "MIGRATION"},
+	}
+	for _, vm := range r.VMs {
+		vms.rows = append(vms.rows, []string{
+			vm.Namespace, vm.Name, vm.Kind, vm.Status, vm.Phase, vm.Node,
+			strings.Join(vm.IPAddresses, ","), vm.Ready, vm.OS, vm.Age, vm.Uptime, vm.Migration,
+		})
+	}
+
+	summary := table{title: "Summary", headers: []string{"STATUS", "COUNT"}}
+	statuses := make([]string, 0, len(r.Summary))
+	for status := range r.Summary {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		summary.rows = append(summary.rows, []string{status, strconv.Itoa(r.Summary[status])})
+	}
+	summary.rows = append(summary.rows, []string{"Total", strconv.Itoa(r.Total)})
+
+	return []table{vms, summary}
+}
+
+// listVMs joins VirtualMachines with their VMIs. The selectors filter the
+// VMs, whose VMIs are then looked up by namespace and name, since VMs and
+// VMIs carry different labels and fields. VMIs that are not owned by a VM
+// (standalone VMIs) are listed on their own when their labels match.
+func listVMs(ctx context.Context, params VMListParams) (*VMListResult, error) {
+	filterArgs := namespaceArgs(params.Namespace, params.AllNamespaces)
+	vmiArgs := append([]string{"get", "virtualmachineinstances"}, filterArgs...)
+	if params.VMIFieldSelector != "" {
+		vmiArgs = append(vmiArgs, "--field-selector", params.VMIFieldSelector)
+	}
+	if params.LabelSelector != "" {
+		filterArgs = append(filterArgs, "-l", params.LabelSelector)
+	}
+	if params.FieldSelector != "" {
+		filterArgs = append(filterArgs, "--field-selector", params.FieldSelector)
+	}
+
+	var vms VirtualMachineList
+	if err := runKubectlJSON(ctx, &vms, append([]string{"get", "virtualmachines"}, filterArgs...)...); err != nil {
+		return nil, err
+	}
+
+	var vmis VirtualMachineInstanceList
+	if err := runKubectlJSON(ctx, &vmis, vmiArgs...); err != nil {
+		return nil, err
+	}
+
+	// field_selector only applies to VMs, standalone VMIs are left out
+	// when it is set
+	var standalone []VirtualMachineInstance
+	switch {
+	case params.FieldSelector != "":
+	case params.LabelSelector != "":
+		var selected VirtualMachineInstanceList
+		if err := runKubectlJSON(ctx, &selected, append(vmiArgs, "-l", params.LabelSelector)...); err != nil {
+			return nil, err
+		}
+		standalone = selected.Items
+	default:
+		standalone = vmis.Items
+	}
+
+	vmiByKey := make(map[string]VirtualMachineInstance, len(vmis.Items))
+	for _, vmi := range vmis.Items {
+		vmiByKey[vmi.Metadata.Namespace+"/"+vmi.Metadata.Name] = vmi
+	}
+
+	result := &VMListResult{Summary: map[string]int{}}
+
+	for _, vm := range vms.Items {
+		vmi, ok := vmiByKey[vm.Metadata.Namespace+"/"+vm.Metadata.Name]
+		if !ok && params.VMIFieldSelector != "" {
+			continue
+		}
+		entry := VMListEntry{
+			Name:      vm.Metadata.Name,
+			Namespace: vm.Metadata.Namespace,
+			Kind:      "VirtualMachine",
+			Status:    vm.Status.PrintableStatus,
+			Age:       since(vm.Metadata.CreationTimestamp),
+			OS:        guessOS(GuestOSInfo{}, vm.Spec.Template.Spec.Volumes, vm.Spec.Template.Metadata.Labels),
+		}
+		if ok {
+			fillVMIDetails(&entry, vmi)
+		}
+		result.VMs = append(result.VMs, entry)
+	}
+
+	for _, vmi := range standalone {
+		if ownedByVM(vmi) {
+			continue
+		}
+		entry := VMListEntry{
+			Name:      vmi.Metadata.Name,
+			Namespace: vmi.Metadata.Namespace,
+			Kind:      "VirtualMachineInstance",
+			Status:    vmi.Status.Phase,
+			Age:       since(vmi.Metadata.CreationTimestamp),
+		}
+		fillVMIDetails(&entry, vmi)
+		result.VMs = append(result.VMs, entry)
+	}
+
+	sort.Slice(result.VMs, func(i, j int) bool {
+		if result.VMs[i].Namespace != result.VMs[j].Namespace {
+			return result.VMs[i].Namespace < result.VMs[j].Namespace
+		}
+		return result.VMs[i].Name < result.VMs[j].Name
+	})
+
+	for _, entry := range result.VMs {
+		status := entry.Status
+		if status == "" {
+			status = "Unknown"
+		}
+		result.Summary[status]++
+	}
+	result.Total = len(result.VMs)
+
+	return result, nil
+}
+
+// fillVMIDetails copies the runtime details of a VMI into a list entry
+func fillVMIDetails(entry *VMListEntry, vmi VirtualMachineInstance) {
+	entry.Phase = vmi.Status.Phase
+	entry.Node = vmi.Status.NodeName
+	entry.Ready = conditionStatus(vmi.Status.Conditions, "Ready")
+	entry.Uptime = vmiUptime(vmi)
+	entry.Migration = migrationSummary(vmi.Status.MigrationState)
+
+	for _, iface := range vmi.Status.Interfaces {
+		if len(iface.IPAddresses) > 0 {
+			entry.IPAddresses = append(entry.IPAddresses, iface.IPAddresses...)
+		} else if iface.IPAddress != "" {
+			entry.IPAddresses = append(entry.IPAddresses, iface.IPAddress)
+		}
+	}
+
+	if osGuess := guessOS(vmi.Status.GuestOSInfo, vmi.Spec.Volumes, vmi.Metadata.Labels); osGuess != "" {
+		entry.OS = osGuess
+	}
+}
+
+// vmiUptime returns how long a running VMI has been in the Running phase
+func vmiUptime(vmi VirtualMachineInstance) string {
+	if vmi.Status.Phase != "Running" {
+		return ""
+	}
+	var running time.Time
+	for _, transition := range vmi.Status.PhaseTransitionTimestamps {
+		if transition.Phase == "Running" && transition.PhaseTransitionTimestamp.After(running) {
+			running = transition.PhaseTransitionTimestamp
+		}
+	}
+	return since(running)
+}
+
+// migrationSummary describes the last migration of a VMI relative to now,
+// e.g. "migrated 12m ago from node01 to node02"
+func migrationSummary(state *MigrationState) string {
+	if state == nil || state.StartTimestamp == nil {
+		return ""
+	}
+	switch {
+	case state.Failed && state.EndTimestamp != nil:
+		return fmt.Sprintf("migration to %s failed %s ago", state.TargetNode, since(*state.EndTimestamp))
+	case state.Completed && state.EndTimestamp != nil:
+		return fmt.Sprintf("migrated %s ago from %s to %s", since(*state.EndTimestamp), state.SourceNode, state.TargetNode)
+	}
+	return fmt.Sprintf("migrating to %s for %s", state.TargetNode, since(*state.StartTimestamp))
+}
+
+// VMListSummary is the summarized vm_list result
+type VMListSummary struct {
+	Total       int            `json:"total"`
+	ByStatus    map[string]int `json:"byStatus"`
+	ByNamespace map[string]int `json:"byNamespace"`
+	ByNode      map[string]int `json:"byNode,omitempty"`
+	ByOS        map[string]int `json:"byOS,omitempty"`
+	NotReady    []string       `json:"notReady,omitempty"`
+}
+
+// maxSummaryNotReady bounds the not ready VMs named in a summary
+const maxSummaryNotReady = 20
+
+// summarizeVMList condenses a vm_list result into counts, naming only the
+// running VMs that are not ready
+func summarizeVMList(result string) (string, error) {
+	var list VMListResult
+	if err := json.Unmarshal([]byte(result), &list); err != nil {
+		return "", fmt.Errorf("summarize needs the json format: %v", err)
+	}
+
+	summary := VMListSummary{
+		Total:       list.Total,
+		ByStatus:    list.Summary,
+		ByNamespace: map[string]int{},
+		ByNode:      map[string]int{},
+		ByOS:        map[string]int{},
+	}
+	notReady := 0
+	for _, vm := range list.VMs {
+		summary.ByNamespace[vm.Namespace]++
+		if vm.Node != "" {
+			summary.ByNode[vm.Node]++
+		}
+		if vm.OS != "" {
+			summary.ByOS[vm.OS]++
+		}
+		if vm.Phase == "Running" && vm.Ready != "True" {
+			if notReady++; notReady <= maxSummaryNotReady {
+				summary.NotReady = append(summary.NotReady, vm.Namespace+"/"+vm.Name)
+			}
+		}
+	}
+	if notReady > maxSummaryNotReady {
+		summary.NotReady = append(summary.NotReady, fmt.Sprintf("... and %d more", notReady-maxSummaryNotReady))
+	}
+	return formatJSON(summary)
+}
+
+// ownedByVM reports whether a VMI belongs to a VirtualMachine
+func ownedByVM(vmi VirtualMachineInstance) bool {
+	for _, owner := range vmi.Metadata.OwnerReferences {
+		if owner.Kind == "VirtualMachine" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestListVMsSelectors(t *testing.T) {
+	useSimulation(t, simulationModel+`---
+apiVersion: kubevirt.io/v1
+kind: VirtualMachineInstance
+metadata:
+  name: scratch
+  namespace: default
+  labels: {app: web}
+spec:
+  domain:
+    devices: {}
+    resources: {requests: {memory: 1Gi}}
+`)
+
+	tests := []struct {
+		name   string
+		params VMListParams
+		want   []string
+	}{
+		{
+			name: "everything",
+			want: []string{"VirtualMachine/db/", "VirtualMachineInstance/scratch/", "VirtualMachine/web/Running"},
+		},
+		{
+			// The VMI of web does not carry the VM labels
+			name:   "label selector",
+			params: VMListParams{LabelSelector: "app=web"},
+			want:   []string{"VirtualMachineInstance/scratch/", "VirtualMachine/web/Running"},
+		},
+		{
+			name:   "label selector matching no standalone VMI",
+			params: VMListParams{LabelSelector: "app=db"},
+			want:   []string{"VirtualMachine/db/"},
+		},
+		{
+			// VM fields do not exist on VMIs
+			name:   "field selector",
+			params: VMListParams{FieldSelector: "spec.runStrategy=Always"},
+			want:   []string{"VirtualMachine/web/Running"},
+		},
+		{
+			// The simulation does not run standalone VMIs
+			name:   "VMI field selector",
+			params: VMListParams{VMIFieldSelector: "status.phase=Running"},
+			want:   []string{"VirtualMachine/web/Running"},
+		},
+		{
+			name:   "label and VMI field selector",
+			params: VMListParams{LabelSelector: "app=db", VMIFieldSelector: "status.phase=Running"},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := listVMs(context.Background(), tt.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range result.VMs {
+				got = append(got, entry.Kind+"/"+entry.Name+"/"+entry.Phase)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("listVMs(%+v) = %v, want %v", tt.params, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Stages of vm_wait_ready, each one waits for the previous ones
+const (
+	readyStageRunning   = "running"
+	readyStageGuest     = "guest"
+	readyStageCloudInit = "cloud_init"
+
+	defaultWaitReadyTimeout = 300
+
+	// readyLoginTimeout bounds each login attempt of the guest stage, in
+	// seconds
+	readyLoginTimeout = 10
+)
+
+var readyStages = []string{readyStageRunning, readyStageGuest, readyStageCloudInit}
+
+// failingVMStatuses are the printable VM statuses that do not resolve by
+// waiting
+var failingVMStatuses = map[string]bool{
+	"ErrorUnschedulable": true,
+	"ErrImagePull":       true,
+	"ImagePullBackOff":   true,
+	"ErrorPvcNotFound":   true,
+	"DataVolumeError":    true,
+	"CrashLoopBackOff":   true,
+}
+
+// cloudInitStatusRegex matches the status line of "cloud-init status"
+var cloudInitStatusRegex = regexp.MustCompile(`(?m)^status:\s*(.+?)\s*$`)
+
+// VMWaitReadyParams represents the parameters of vm_wait_ready
+type VMWaitReadyParams struct {
+	Namespace       string `json:"namespace,omitempty"`
+	VMName          string `json:"vm_name"`
+	Until           string `json:"until,omitempty"`
+	Timeout         int    `json:"timeout,omitempty"`
+	Method          string `json:"method,omitempty"`
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	Format          string `json:"format,omitempty"`
+}
+
+// ReadyStage reports one stage of vm_wait_ready
+type ReadyStage struct {
+	Stage    string `json:"stage"`
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Details  string `json:"details,omitempty"`
+}
+
+// VMWaitReadyResult is the vm_wait_ready tool result
+type VMWaitReadyResult struct {
+	Namespace string       `json:"namespace"`
+	VMName    string       `json:"vmName"`
+	Until     string       `json:"until"`
+	Stages    []ReadyStage `json:"stages"`
+	Duration  string       `json:"duration"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "vm_wait_ready",
+		Description: "Wait until a VM is usable: its VMI is Running, the guest agent is connected or a login succeeds, and cloud-init has finished. Use instead of polling vm_exec; fails early on scheduling, image and volume errors",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Kubernetes namespace containing the VM",
+					"default":     "default",
+				},
+				"vm_name": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of the VM or VMI",
+				},
+				"until": map[string]interface{}{
+					"type":        "string",
+					"description": "Last stage to wait for: running (VMI Running), guest (agent connected or login works) or cloud_init (cloud-init finished, skipped when the guest has no cloud-init)",
+					"enum":        readyStages,
+					"default":     readyStageCloudInit,
+				},
+				"timeout": map[string]interface{}{
+					"type":        "integer",
+					"description": "Timeout in seconds for all the stages (default: 300)",
+					"default":     defaultWaitReadyTimeout,
+				},
+				"method": map[string]interface{}{
+					"type":        "string",
+					"description": "Execution method of the guest checks: auto accepts a connected guest agent or a login over SSH or the console, agent waits for the guest agent only",
+					"enum":        []string{"auto", "agent", "ssh", "console"},
+					"default":     "auto",
+				},
+				"username": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login username, overrides the VM type default",
+				},
+				"password": map[string]interface{}{
+					"type":        "string",
+					"description": "Console login password, overrides the VM type default",
+				},
+				"credentials_file": map[string]interface{}{
+					"type":        "string",
+					"description": "Name of a YAML file of the server credentials directory (exec.credentialsDir) with console credentials keyed by namespace, VM name or labels",
+				},
+				"format": formatProperty(),
+			},
+			"required": []string{"vm_name"},
+		},
+		Handler: handleVMWaitReady,
+	})
+}
+
+// handleVMWaitReady is the tools/call handler for vm_wait_ready
+func handleVMWaitReady(ctx context.Context, args json.RawMessage) (string, error) {
+	var params VMWaitReadyParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+	if params.VMName == "" {
+		return "", missingArgument("vm_name")
+	}
+	if params.Until != "" && !containsString(readyStages, params.Until) {
+		return "", &invalidParamsError{err: fmt.Errorf("unsupported stage '%s'", params.Until)}
+	}
+	if params.Timeout < 0 {
+		return "", &invalidParamsError{err: errors.New("timeout cannot be negative")}
+	}
+
+	// Set defaults if not provided
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Until == "" {
+		params.Until = readyStageCloudInit
+	}
+	if params.Timeout == 0 {
+		params.Timeout = defaultWaitReadyTimeout
+	}
+
+	result, err := waitVMReady(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// waitVMReady runs the stages up to params.Until within the timeout
+func waitVMReady(ctx context.Context, params VMWaitReadyParams) (*VMWaitReadyResult, error) {
+	timeout := time.Duration(params.Timeout) * time.Second
+	ctx, cancel := clock.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := &VMWaitReadyResult{
+		Namespace: params.Namespace,
+		VMName:    params.VMName,
+		Until:     params.Until,
+	}
+	start := clock.Now()
+
+	stages := map[string]func(context.Context, VMWaitReadyParams) (string, string, error){
+		readyStageRunning:   waitVMIRunning,
+		readyStageGuest:     waitGuestReachable,
+		readyStageCloudInit: waitCloudInit,
+	}
+	for _, name := range readyStages {
+		stageStart := clock.Now()
+		reportProgress(ctx, "waiting for %s", name)
+		status, details, err := stages[name](ctx, params)
+		if err != nil {
+			return nil, fmt.Errorf("VM %s/%s is not ready after %s: %s stage failed: %v",
+				params.Namespace, params.VMName, humanDuration(clock.Now().Sub(start)), name, err)
+		}
+		result.Stages = append(result.Stages, ReadyStage{
+			Stage:    name,
+			Status:   status,
+			Duration: humanDuration(clock.Now().Sub(stageStart)),
+			Details:  details,
+		})
+		if name == params.Until {
+			break
+		}
+	}
+
+	result.Duration = humanDuration(clock.Now().Sub(start))
+	return result, nil
+}
+
+// waitReadyRetry waits before the next check of a stage, returning the last
+// error of the stage when the timeout expired or the call was cancelled
+func waitReadyRetry(ctx context.Context, interval time.Duration, last error) error {
+	select {
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out: %v", last)
+		}
+		return fmt.Errorf("waiting cancelled: %v", last)
+	case <-clock.After(interval):
+		return nil
+	}
+}
+
+// waitVMIRunning waits until the VMI is Running, failing early when the VM
+// is halted or in an error state
+func waitVMIRunning(ctx context.Context, params VMWaitReadyParams) (string, string, error) {
+	for {
+		var vm VirtualMachine
+		vmFound, err := getOptionalObject(ctx, &vm, "virtualmachine", params.VMName, params.Namespace)
+		if err != nil {
+			return "", "", err
+		}
+		var vmi VirtualMachineInstance
+		vmiFound, err := getOptionalObject(ctx, &vmi, "virtualmachineinstance", params.VMName, params.Namespace)
+		if err != nil {
+			return "", "", err
+		}
+
+		var pending error
+		switch {
+		case !vmFound && !vmiFound:
+			return "", "", fmt.Errorf("VM %s/%s not found", params.Namespace, params.VMName)
+		case vmiFound && vmi.Status.Phase == "Running":
+			return "ok", fmt.Sprintf("running on %s", vmi.Status.NodeName), nil
+		case vmiFound && (vmi.Status.Phase == "Failed" || vmi.Status.Phase == "Succeeded"):
+			return "", "", fmt.Errorf("VMI is %s", vmi.Status.Phase)
+		case vmFound && failingVMStatuses[vm.Status.PrintableStatus]:
+			return "", "", fmt.Errorf("VM is %s", vm.Status.PrintableStatus)
+		case vmFound && !vmiFound && vm.Spec.RunStrategy == "Halted":
+			return "", "", errors.New("VM is stopped (run strategy Halted)")
+		case vmiFound:
+			pending = fmt.Errorf("VMI is %s", vmi.Status.Phase)
+		default:
+			pending = fmt.Errorf("VM is %s", vm.Status.PrintableStatus)
+		}
+
+		reportProgress(ctx, "%v", pending)
+		if err := waitReadyRetry(ctx, 2*time.Second, pending); err != nil {
+			return "", "", err
+		}
+	}
+}
+
+// waitGuestReachable waits until the guest agent is connected or, unless
+// the method is agent, a no-op command runs in the guest
+func waitGuestReachable(ctx context.Context, params VMWaitReadyParams) (string, string, error) {
+	for {
+		var vmi VirtualMachineInstance
+		if err := runKubectlJSON(ctx, &vmi, "get", "virtualmachineinstance", params.VMName, "-n", params.Namespace); err != nil {
+			return "", "", err
+		}
+		if vmi.Status.Phase != "Running" {
+			return "", "", fmt.Errorf("VMI is %s", vmi.Status.Phase)
+		}
+		if cond := pausedCondition(&vmi); cond != nil {
+			return "", "", pausedError(cond)
+		}
+		agent := conditionStatus(vmi.Status.Conditions, "AgentConnected") == "True"
+		if agent && (params.Method == "" || params.Method == "auto" || params.Method == "agent") {
+			return "ok", "guest agent connected", nil
+		}
+
+		pending := errors.New("guest agent not connected")
+		if params.Method != "agent" {
+			_, err := runGuestCommand(ctx, VMExecParams{
+				Namespace:       params.Namespace,
+				VMName:          params.VMName,
+				Command:         "true",
+				Timeout:         readyLoginTimeout,
+				Method:          params.Method,
+				Username:        params.Username,
+				Password:        params.Password,
+				CredentialsFile: params.CredentialsFile,
+			})
+			if err == nil {
+				return "ok", "login succeeded", nil
+			}
+			pending = fmt.Errorf("login failed: %v", err)
+		}
+
+		reportProgress(ctx, "%v", pending)
+		if err := waitReadyRetry(ctx, 5*time.Second, pending); err != nil {
+			return "", "", err
+		}
+	}
+}
+
+// waitCloudInit waits for cloud-init with "cloud-init status --wait". The
+// stage is skipped when the guest has no cloud-init or it is disabled, and
+// passes with a recoverable (degraded) error.
+func waitCloudInit(ctx context.Context, params VMWaitReadyParams) (string, string, error) {
+	deadline, _ := ctx.Deadline()
+	remaining := int(deadline.Sub(clock.Now()) / time.Second)
+	if remaining < 1 {
+		return "", "", errors.New("timed out before checking cloud-init")
+	}
+
+	output, err := executeVMCommand(ctx, VMExecParams{
+		Namespace:       params.Namespace,
+		VMName:          params.VMName,
+		Command:         "cloud-init status --wait --long",
+		Timeout:         remaining,
+		Method:          params.Method,
+		Username:        params.Username,
+		Password:        params.Password,
+		CredentialsFile: params.CredentialsFile,
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", "", errors.New("timed out waiting for cloud-init to finish")
+		}
+		return "", "", err
+	}
+	var result VMExecResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return "", "", fmt.Errorf("failed to parse vm-exec output: %v", err)
+	}
+
+	stdout := strings.TrimSpace(result.Stdout)
+	match := cloudInitStatusRegex.FindStringSubmatch(stdout)
+	if match == nil {
+		if result.ExitCode == 127 || strings.Contains(stdout, "not found") {
+			return "skipped", "cloud-init is not installed", nil
+		}
+		return "", "", fmt.Errorf("cloud-init status exited with code %d: %s", result.ExitCode, stdout)
+	}
+
+	switch status := match[1]; status {
+	case "done":
+		if result.ExitCode == 2 {
+			return "ok", "done with recoverable errors", nil
+		}
+		return "ok", "done", nil
+	case "disabled":
+		return "skipped", "cloud-init is disabled", nil
+	default:
+		return "", "", fmt.Errorf("cloud-init status %s: %s", status, stdout)
+	}
+}
+
+// tables renders the result for the text format
+func (r *VMWaitReadyResult) tables() []table {
+	stages := table{
+		title:   fmt.Sprintf("VM %s/%s ready (%s) in %s", r.Namespace, r.VMName, r.Until, r.Duration),
+		headers: []string{"STAGE", "STATUS", "DURATION", "DETAILS"},
+	}
+	for _, s := range r.Stages {
+		stages.rows = append(stages.rows, []string{s.Stage, s.Status, s.Duration, s.Details})
+	}
+	return []table{stages}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWebhookSamples = 3
+	maxWebhookSamples     = 20
+	// defaultWebhookTimeout is the API server default for webhooks without
+	// timeoutSeconds
+	defaultWebhookTimeout = 10
+	// slowWebhookFraction of the webhook timeout above which admission is
+	// reported as close to timing out
+	slowWebhookFraction = 0.5
+)
+
+// webhookNameRegex extracts the webhook name from admission error messages,
+// e.g. `admission webhook "virtualmachine-validator.kubevirt.io" denied the
+// request` or `failed calling webhook "..."`
+var webhookNameRegex = regexp.MustCompile(`webhook "([^"]+)"`)
+
+// WebhookParams represents the parameters of kubevirt_webhooks
+type WebhookParams struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Samples     int    `json:"samples,omitempty"`
+	EventsLimit int    `json:"events_limit,omitempty"`
+	Format      string `json:"format,omitempty"`
+}
+
+// WebhookInfo is an admission webhook of KubeVirt or CDI and the state of
+// its backing service
+type WebhookInfo struct {
+	Name           string `json:"name"`
+	Kind           string `json:"kind"`
+	Configuration  string `json:"configuration"`
+	Service        string `json:"service,omitempty"`
+	FailurePolicy  string `json:"failurePolicy"`
+	TimeoutSeconds int    `json:"timeoutSeconds"`
+	ReadyEndpoints int    `json:"readyEndpoints"`
+	CAExpiry       string `json:"caExpiry,omitempty"`
+	Healthy        bool   `json:"healthy"`
+	Message        string `json:"message,omitempty"`
+}
+
+// LatencyProbe is the timing of a request going through the webhooks or
+// the aggregated API
+type LatencyProbe struct {
+	Name    string  `json:"name"`
+	Samples int     `json:"samples"`
+	Errors  int     `json:"errors"`
+	MinMs   float64 `json:"minMs"`
+	AvgMs   float64 `json:"avgMs"`
+	MaxMs   float64 `json:"maxMs"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// AdmissionFailure groups recent warning events caused by a webhook
+type AdmissionFailure struct {
+	Webhook  string `json:"webhook"`
+	Kind     string `json:"kind"`
+	Count    int    `json:"count"`
+	LastSeen string `json:"lastSeen"`
+	Object   string `json:"object"`
+	Message  string `json:"message"`
+}
+
+// WebhookResult is the kubevirt_webhooks tool result
+type WebhookResult struct {
+	Namespace      string             `json:"namespace"`
+	Healthy        bool               `json:"healthy"`
+	Diagnosis      []string           `json:"diagnosis,omitempty"`
+	APIService     string             `json:"apiService"`
+	Webhooks       []WebhookInfo      `json:"webhooks"`
+	Latency        []LatencyProbe     `json:"latency"`
+	RecentFailures []AdmissionFailure `json:"recentFailures,omitempty"`
+}
+
+type webhookConfiguration struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Webhooks []struct {
+		Name         string `json:"name"`
+		ClientConfig struct {
+			URL      string `json:"url,omitempty"`
+			CABundle string `json:"caBundle,omitempty"`
+			Service  *struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+				Path      string `json:"path,omitempty"`
+			} `json:"service,omitempty"`
+		} `json:"clientConfig"`
+		FailurePolicy  string `json:"failurePolicy,omitempty"`
+		TimeoutSeconds *int   `json:"timeoutSeconds,omitempty"`
+	} `json:"webhooks"`
+}
+
+func init() {
+	registerTool(Tool{
+		Name:        "kubevirt_webhooks",
+		Description: "Troubleshoot KubeVirt and CDI admission webhooks and the subresources aggregated API: backing service endpoints, failure policy, CA expiry, admission latency measured with server side dry run creates, and recent webhook denials and call failures from warning events. Use it to explain errors like \"cannot create VM: context deadline exceeded\"",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"namespace": map[string]interface{}{
+					"type":        "string",
+					"description": "Namespace of the dry run VirtualMachine creates used to measure admission latency",
+					"default":     "default",
+				},
+				"samples": map[string]interface{}{
+					"type":        "integer",
+					"description": fmt.Sprintf("Number of latency samples per probe (max %d)", maxWebhookSamples),
+					"default":     defaultWebhookSamples,
+				},
+				"events_limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Maximum number of webhooks to report recent failures for",
+					"default":     defaultHealthEventsLimit,
+				},
+				"format": formatProperty(),
+			},
+		},
+		Handler: handleWebhooks,
+	})
+}
+
+// handleWebhooks is the tools/call handler for kubevirt_webhooks
+func handleWebhooks(ctx context.Context, args json.RawMessage) (string, error) {
+	var params WebhookParams
+	if err := decodeArguments(args, &params); err != nil {
+		return "", err
+	}
+	if params.Namespace == "" {
+		params.Namespace = "default"
+	}
+	if params.Samples < 0 || params.Samples > maxWebhookSamples {
+		return "", &invalidParamsError{err: fmt.Errorf("samples must be between 1 and %d", maxWebhookSamples)}
+	}
+	if params.Samples == 0 {
+		params.Samples = defaultWebhookSamples
+	}
+	if params.EventsLimit < 0 {
+		return "", &invalidParamsError{err: fmt.Errorf("events_limit must not be negative")}
+	}
+	if params.EventsLimit == 0 {
+		params.EventsLimit = defaultHealthEventsLimit
+	}
+	if err := validateFormat(params.Format); err != nil {
+		return "", err
+	}
+
+	result, err := checkWebhooks(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	return formatResult(params.Format, result, result.tables)
+}
+
+// checkWebhooks inspects the webhooks and the aggregated API, measures
+// admission latency and correlates the findings into a diagnosis
+func checkWebhooks(ctx context.Context, params WebhookParams) (*WebhookResult, error) {
+	reportProgress(ctx, "reading the KubeVirt CR")
+	kv, _, err := getKubeVirtCR(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &WebhookResult{Namespace: kv.Metadata.Namespace}
+
+	reportProgress(ctx, "reading admission webhook configurations")
+	webhooks, err := kubeVirtWebhooks(ctx, result.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	result.Webhooks = webhooks
+	maxTimeout := 0
+	for _, w := range webhooks {
+		maxTimeout = max(maxTimeout, w.TimeoutSeconds)
+		if w.Healthy {
+			continue
+		}
+		effect := "requests it handles are admitted without it"
+		if w.FailurePolicy != "Ignore" {
+			effect = "requests it handles fail, typically with \"context deadline exceeded\" or \"connection refused\""
+		}
+		result.Diagnosis = append(result.Diagnosis, fmt.Sprintf("%s webhook %s: %s, %s", w.Kind, w.Name, w.Message, effect))
+	}
+
+	reportProgress(ctx, "checking the %s APIService", subresourcesAPIService)
+	result.APIService, err = apiServiceAvailability(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if result.APIService != "Available" {
+		result.Diagnosis = append(result.Diagnosis, fmt.Sprintf("APIService %s is %s: console, VNC and other subresources fail, and API discovery may stall kubectl", subresourcesAPIService, result.APIService))
+	}
+
+	reportProgress(ctx, "measuring admission latency with %d dry run creates", params.Samples)
+	vm := map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachine",
+		"metadata": map[string]interface{}{
+			"name":      generateName("webhook-probe"),
+			"namespace": params.Namespace,
+		},
+		"spec": map[string]interface{}{
+			"runStrategy": "Halted",
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"domain": map[string]interface{}{
+						"devices":   map[string]interface{}{},
+						"resources": map[string]interface{}{"requests": map[string]interface{}{"memory": "64Mi"}},
+					},
+				},
+			},
+		},
+	}
+	manifest, err := json.Marshal(vm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	admission := probeLatency(ctx, "VirtualMachine dry run create", params.Samples, func() error {
+		_, err := runKubectlWithInput(ctx, manifest, "create", "--dry-run=server", "-f", "-")
+		return err
+	})
+	aggregated := probeLatency(ctx, "subresources API healthz", params.Samples, func() error {
+		_, err := runKubectl(ctx, "get", "--raw", "/apis/subresources.kubevirt.io/v1/healthz")
+		return err
+	})
+	result.Latency = []LatencyProbe{admission, aggregated}
+	if admission.Error != "" {
+		result.Diagnosis = append(result.Diagnosis, fmt.Sprintf("%d of %d dry run VM creates failed: %s", admission.Errors, admission.Samples, admission.Error))
+	}
+	if maxTimeout > 0 && admission.MaxMs > float64(maxTimeout)*1000*slowWebhookFraction {
+		result.Diagnosis = append(result.Diagnosis, fmt.Sprintf("admission took up to %.0fms, more than half the %ds webhook timeout; a loaded virt-api will start timing out", admission.MaxMs, maxTimeout))
+	}
+	if aggregated.Error != "" {
+		result.Diagnosis = append(result.Diagnosis, fmt.Sprintf("%d of %d subresources API requests failed: %s", aggregated.Errors, aggregated.Samples, aggregated.Error))
+	}
+
+	reportProgress(ctx, "correlating recent webhook failures")
+	failures, err := admissionFailures(ctx, params.EventsLimit)
+	if err != nil {
+		return nil, err
+	}
+	result.RecentFailures = failures
+	for _, f := range failures {
+		if f.Kind == "call failed" {
+			result.Diagnosis = append(result.Diagnosis, fmt.Sprintf("webhook %s could not be called %d times, last %s ago: %s", f.Webhook, f.Count, f.LastSeen, f.Message))
+		}
+	}
+
+	result.Healthy = len(result.Diagnosis) == 0
+	return result, nil
+}
+
+// kubeVirtWebhooks returns the validating and mutating webhooks served from
+// the KubeVirt namespace or named after a kubevirt.io group, with the ready
+// endpoints of their services
+func kubeVirtWebhooks(ctx context.Context, namespace string) ([]WebhookInfo, error) {
+	var webhooks []WebhookInfo
+	endpoints := map[string]int{}
+	for _, kind := range []string{"validating", "mutating"} {
+		var list struct {
+			Items []webhookConfiguration `json:"items"`
+		}
+		if err := runKubectlJSON(ctx, &list, "get", kind+"webhookconfigurations"); err != nil {
+			return nil, err
+		}
+		for _, config := range list.Items {
+			for _, hook := range config.Webhooks {
+				service := hook.ClientConfig.Service
+				if !strings.HasSuffix(hook.Name, "kubevirt.io") && (service == nil || service.Namespace != namespace) {
+					continue
+				}
+				info := WebhookInfo{
+					Name:           hook.Name,
+					Kind:           kind,
+					Configuration:  config.Metadata.Name,
+					FailurePolicy:  hook.FailurePolicy,
+					TimeoutSeconds: defaultWebhookTimeout,
+					Healthy:        true,
+				}
+				if info.FailurePolicy == "" {
+					info.FailurePolicy = "Fail"
+				}
+				if hook.TimeoutSeconds != nil {
+					info.TimeoutSeconds = *hook.TimeoutSeconds
+				}
+				if service != nil {
+					info.Service = service.Namespace + "/" + service.Name
+					ready, ok := endpoints[info.Service]
+					if !ok {
+						var err error
+						if ready, err = readyEndpoints(ctx, service.Namespace, service.Name); err != nil {
+							return nil, err
+						}
+						endpoints[info.Service] = ready
+					}
+					info.ReadyEndpoints = ready
+					if ready == 0 {
+						info.Healthy = false
+						info.Message = fmt.Sprintf("service %s has no ready endpoints", info.Service)
+					}
+				} else {
+					info.Service = hook.ClientConfig.URL
+				}
+				checkWebhookCA(&info, hook.ClientConfig.CABundle)
+				webhooks = append(webhooks, info)
+			}
+		}
+	}
+	sort.SliceStable(webhooks, func(i, j int) bool {
+		return !webhooks[i].Healthy && webhooks[j].Healthy
+	})
+	return webhooks, nil
+}
+
+// checkWebhookCA reports when the CA the API server uses to verify the
+// webhook expires, an expired one fails every call with an x509 error
+func checkWebhookCA(info *WebhookInfo, caBundle string) {
+	pemData, err := base64.StdEncoding.DecodeString(caBundle)
+	var cas []*x509.Certificate
+	if err == nil {
+		cas, err = parseCertificates(pemData)
+	}
+	if err != nil || len(cas) == 0 {
+		if info.Healthy {
+			info.Healthy = false
+			info.Message = "caBundle holds no valid certificate"
+		}
+		return
+	}
+	latest := cas[0].NotAfter
+	for _, ca := range cas[1:] {
+		if ca.NotAfter.After(latest) {
+			latest = ca.NotAfter
+		}
+	}
+	info.CAExpiry = latest.UTC().Format(time.RFC3339)
+	if clock.Now().After(latest) && info.Healthy {
+		info.Healthy = false
+		info.Message = "caBundle expired " + humanDuration(clock.Now().Sub(latest)) + " ago"
+	}
+}
+
+// readyEndpoints counts the ready endpoints of a service
+func readyEndpoints(ctx context.Context, namespace, service string) (int, error) {
+	var slices struct {
+		Items []struct {
+			Endpoints []struct {
+				Conditions struct {
+					Ready *bool `json:"ready,omitempty"`
+				} `json:"conditions"`
+			} `json:"endpoints"`
+		} `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &slices, "get", "endpointslices", "-n", namespace, "-l", "kubernetes.io/service-name="+service); err != nil {
+		return 0, err
+	}
+	ready := 0
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			// A nil ready condition is to be interpreted as ready
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				ready++
+			}
+		}
+	}
+	return ready, nil
+}
+
+// apiServiceAvailability returns "Available", or why the subresources
+// APIService is not
+func apiServiceAvailability(ctx context.Context) (string, error) {
+	output, err := runKubectl(ctx, "get", "apiservice", subresourcesAPIService, "--ignore-not-found", "-o", "json")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(output)) == "" {
+		return "not found", nil
+	}
+	var svc apiService
+	if err := json.Unmarshal(output, &svc); err != nil {
+		return "", fmt.Errorf("failed to parse kubectl output: %v", err)
+	}
+	for _, cond := range svc.Status.Conditions {
+		if cond.Type != "Available" {
+			continue
+		}
+		if cond.Status == "True" {
+			return "Available", nil
+		}
+		return fmt.Sprintf("unavailable (%s: %s)", cond.Reason, cond.Message), nil
+	}
+	return "unknown, no Available condition", nil
+}
+
+// probeLatency times samples calls of fn. The timings include starting
+// kubectl, so they are an upper bound of the server side latency.
+func probeLatency(ctx context.Context, name string, samples int, fn func() error) LatencyProbe {
+	probe := LatencyProbe{Name: name, Samples: samples}
+	var total time.Duration
+	for i := 0; i < samples && ctx.Err() == nil; i++ {
+		start := clock.Now()
+		err := fn()
+		elapsed := clock.Now().Sub(start)
+		if err != nil {
+			probe.Errors++
+			probe.Error = kubectlErrorMessage(err)
+		}
+		total += elapsed
+		ms := milliseconds(elapsed)
+		if i == 0 || ms < probe.MinMs {
+			probe.MinMs = ms
+		}
+		probe.MaxMs = max(probe.MaxMs, ms)
+	}
+	probe.AvgMs = milliseconds(total / time.Duration(samples))
+	return probe
+}
+
+// admissionFailures groups the recent warning events mentioning a webhook
+// by webhook, telling denials from calls that failed to reach it
+func admissionFailures(ctx context.Context, limit int) ([]AdmissionFailure, error) {
+	var list struct {
+		Items []Event `json:"items"`
+	}
+	if err := runKubectlJSON(ctx, &list, "get", "events", "--all-namespaces", "--field-selector", "type=Warning"); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list.Items, func(i, j int) bool {
+		return list.Items[i].lastSeen().After(list.Items[j].lastSeen())
+	})
+
+	byWebhook := map[string]*AdmissionFailure{}
+	var failures []*AdmissionFailure
+	for _, e := range list.Items {
+		match := webhookNameRegex.FindStringSubmatch(e.Message)
+		if match == nil {
+			continue
+		}
+		kind := "denied"
+		if strings.Contains(e.Message, "failed calling webhook") {
+			kind = "call failed"
+		}
+		key := match[1] + "/" + kind
+		count := max(e.Count, 1)
+		if f, ok := byWebhook[key]; ok {
+			f.Count += count
+			continue
+		}
+		if len(failures) == limit {
+			continue
+		}
+		f := &AdmissionFailure{
+			Webhook:  match[1],
+			Kind:     kind,
+			Count:    count,
+			LastSeen: since(e.lastSeen()),
+			Object:   e.Metadata.Namespace + "/" + strings.ToLower(e.InvolvedObject.Kind) + "/" + e.InvolvedObject.Name,
+			Message:  e.Message,
+		}
+		byWebhook[key] = f
+		failures = append(failures, f)
+	}
+
+	var result []AdmissionFailure
+	for _, f := range failures {
+		result = append(result, *f)
+	}
+	return result, nil
+}
+
+// tables renders the webhook report as an overview followed by the
+// webhooks, latency probes and recent failures
+func (r *WebhookResult) tables() []table {
+	overview := table{title: "KubeVirt webhooks " + r.Namespace, headers: []string{"FIELD", "VALUE"}}
+	overview.rows = append(overview.rows,
+		[]string{"Healthy", strconv.FormatBool(r.Healthy)},
+		[]string{"APIService " + subresourcesAPIService, r.APIService},
+	)
+	for _, d := range r.Diagnosis {
+		overview.rows = append(overview.rows, []string{"Diagnosis", d})
+	}
+
+	webhooks := table{title: "Webhooks", headers: []string{"NAME", "KIND", "SERVICE", "POLICY", "TIMEOUT", "READY", "CA EXPIRY", "HEALTHY", "MESSAGE"}}
+	for _, w := range r.Webhooks {
+		webhooks.rows = append(webhooks.rows, []string{
+			w.Name, w.Kind, w.Service, w.FailurePolicy, strconv.Itoa(w.TimeoutSeconds) + "s", strconv.Itoa(w.ReadyEndpoints), w.CAExpiry, strconv.FormatBool(w.Healthy), w.Message,
+		})
+	}
+
+	latency := table{title: "Latency", headers: []string{"PROBE", "SAMPLES", "ERRORS", "MIN MS", "AVG MS", "MAX MS", "ERROR"}}
+	for _, l := range r.Latency {
+		latency.rows = append(latency.rows, []string{
+			l.Name, strconv.Itoa(l.Samples), strconv.Itoa(l.Errors),
+			strconv.FormatFloat(l.MinMs, 'f', 1, 64), strconv.FormatFloat(l.AvgMs, 'f', 1, 64), strconv.FormatFloat(l.MaxMs, 'f', 1, 64), l.Error,
+		})
+	}
+
+	failures := table{title: "Recent webhook failures", headers: []string{"WEBHOOK", "KIND", "COUNT", "LAST SEEN", "OBJECT", "MESSAGE"}}
+	for _, f := range r.RecentFailures {
+		failures.rows = append(failures.rows, []string{f.Webhook, f.Kind, strconv.Itoa(f.Count), f.LastSeen, f.Object, f.Message})
+	}
+
+	return []table{overview, webhooks, latency, failures}
+}